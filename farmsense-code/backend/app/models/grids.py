@@ -72,10 +72,27 @@ class VirtualSensorGrid20m(Base):
     created_at = Column(DateTime, default=datetime.utcnow)
     physical_probe_value = Column(Float)
     edge_device_id = Column(String(50))
+    rain_state = Column(String(16))  # raining | draining during an edge-detected rain event
+    need_flag = Column(String(20))  # low_confidence when the edge deferred the cell to its zone
+    batch_id = Column(UUID(as_uuid=True), index=True)  # edge compute cycle (grid_batches)
+    algorithm_version = Column(String(32))
+    drydown_rate_mm_day = Column(Float)  # edge trend layers; NULL when not fitted
+    temp_trend_c_day = Column(Float)
+    hours_to_refill = Column(Float)
+    hours_to_wilting = Column(Float)
+    soil_ec_dsm = Column(Float)  # interpolated soil EC; NULL without EC probes
+    leaching_fraction = Column(Float)
+    salinity_yield_loss_pct = Column(Float)
+    quality_flags = Column(Integer, nullable=False, default=0)  # edge interpolation caveats bitfield
+    moisture_root_pct_30d = Column(Float)  # percentile in the cell's own record; NULL with too little history
+    moisture_root_pct_90d = Column(Float)
+    moisture_root_last_season = Column(Float)  # same week last season
+    moisture_root_vs_last_season = Column(Float)
     
     __table_args__ = (
         Index('idx_field_grid_time', 'field_id', 'grid_id', 'timestamp'),
         Index('idx_spatial_20m', 'location', postgresql_using='gist'),
+        Index('uq_grid_20m_cell_batch', 'grid_id', 'timestamp', 'batch_id', unique=True),  # edge upsert key
     )
 
 
@@ -68,6 +68,7 @@ class SoilSensorReading(Base):
     
     # Vertical profiling (inches)
     vertical_profile = Column(JSON)  # [{depth_in: 10, moisture: 0.25, temp: 18.5}, ...]
+    channels = Column(JSON)  # registered extra channels from the edge, e.g. {"soil_ec": 1.2} (dS/m)
     
     # Salinity and nutrients
     ec_surface = Column(Float)
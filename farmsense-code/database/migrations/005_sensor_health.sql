@@ -0,0 +1,17 @@
+-- Create sensor_health table (one row per probe, upserted by edge devices)
+CREATE TABLE IF NOT EXISTS sensor_health (
+    sensor_id VARCHAR PRIMARY KEY,
+    field_id VARCHAR NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    cadence_score DOUBLE PRECISION,
+    battery_score DOUBLE PRECISION,
+    variance_score DOUBLE PRECISION,
+    neighbor_score DOUBLE PRECISION,
+    last_seen TIMESTAMPTZ,
+    battery_voltage DOUBLE PRECISION,
+    issues TEXT,
+    assessed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Maintenance crews list the worst probes per field
+CREATE INDEX IF NOT EXISTS idx_sensor_health_field_score ON sensor_health(field_id, score);
@@ -0,0 +1,17 @@
+-- Create device_commands table (cloud-to-edge command queue)
+-- Edge devices claim pending rows for their external_id, run them and
+-- record the outcome; the row is never deleted so operators keep a history.
+CREATE TABLE IF NOT EXISTS device_commands (
+    id BIGSERIAL PRIMARY KEY,
+    device_external_id VARCHAR(100) NOT NULL,
+    command VARCHAR(32) NOT NULL CHECK (command IN ('reboot', 'resync', 'recompute')),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    result TEXT,
+    created_by VARCHAR,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ
+);
+
+-- Devices poll for their own pending commands every heartbeat
+CREATE INDEX IF NOT EXISTS idx_device_commands_device_status ON device_commands(device_external_id, status, created_at);
@@ -0,0 +1,29 @@
+-- Create zone_stats table (per-management-zone rollup of each grid cycle)
+-- Edge devices insert one row per zone per cycle; (field_id, zone_id,
+-- timestamp) is unique so a replayed sync batch or a recomputed cycle
+-- replaces the earlier row.
+CREATE TABLE IF NOT EXISTS zone_stats (
+    field_id VARCHAR NOT NULL,
+    zone_id VARCHAR NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    zone_name VARCHAR,
+    cells INTEGER NOT NULL,
+    area_m2 DOUBLE PRECISION NOT NULL,
+    moisture_root_mean DOUBLE PRECISION,
+    moisture_root_min DOUBLE PRECISION,
+    moisture_root_max DOUBLE PRECISION,
+    moisture_surface_mean DOUBLE PRECISION,
+    water_deficit_mean_mm DOUBLE PRECISION,
+    deficit_volume_m3 DOUBLE PRECISION,
+    stressed_area_pct DOUBLE PRECISION,
+    irrigation_need VARCHAR(16),
+    edge_device_id VARCHAR,
+    UNIQUE (field_id, zone_id, timestamp)
+);
+
+SELECT create_hypertable('zone_stats', 'timestamp',
+    chunk_time_interval => INTERVAL '1 week',
+    if_not_exists => TRUE
+);
+
+SELECT add_retention_policy('zone_stats', INTERVAL '1 year', if_not_exists => TRUE);
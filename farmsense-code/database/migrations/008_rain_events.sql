@@ -0,0 +1,21 @@
+-- Rain detection on edge devices
+-- Tipping-bucket gauge tips (one row per report, tip_count since the last),
+-- the per-cycle rain tag on grid cells and per-zone rainfall on zone stats.
+CREATE TABLE IF NOT EXISTS rain_gauge_readings (
+    gauge_id VARCHAR NOT NULL,
+    field_id VARCHAR NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    tip_count INTEGER NOT NULL,
+    UNIQUE (gauge_id, timestamp)
+);
+
+SELECT create_hypertable('rain_gauge_readings', 'timestamp',
+    chunk_time_interval => INTERVAL '1 week',
+    if_not_exists => TRUE
+);
+
+CREATE INDEX IF NOT EXISTS idx_rain_gauge_field_time
+    ON rain_gauge_readings (field_id, timestamp DESC);
+
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS rain_state VARCHAR(16);
+ALTER TABLE zone_stats ADD COLUMN IF NOT EXISTS rainfall_mm DOUBLE PRECISION;
@@ -0,0 +1,4 @@
+-- Multi-depth soil probe profiles
+-- Edge devices read and forward each reading's depth profile in the same
+-- format the backend model uses: [{depth_in, moisture, temp}, ...].
+ALTER TABLE soil_sensor_readings ADD COLUMN IF NOT EXISTS vertical_profile JSON;
@@ -0,0 +1,4 @@
+-- Confidence-gated irrigation need
+-- need_flag is "low_confidence" on cells whose urgent need was replaced by
+-- their management zone's consensus.
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS need_flag VARCHAR(20);
@@ -0,0 +1,17 @@
+-- Sensor metadata registry
+-- What the installer recorded for each probe. Edge devices sync their
+-- field's rows hourly and normalize readings with them (offsets, texture,
+-- install depth) before interpolation.
+CREATE TABLE IF NOT EXISTS sensor_registry (
+    sensor_id VARCHAR PRIMARY KEY,
+    field_id VARCHAR NOT NULL,
+    install_depth_cm DOUBLE PRECISION,
+    soil_texture VARCHAR(16),
+    installed_at TIMESTAMPTZ,
+    moisture_offset_vwc DOUBLE PRECISION DEFAULT 0,
+    temp_offset_c DOUBLE PRECISION DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sensor_registry_field
+    ON sensor_registry (field_id);
@@ -0,0 +1,15 @@
+-- Stable grid cell IDs
+-- Edge devices now name cells <field_id>_rNNN_cNNN by row/column from the
+-- field origin instead of formatting coordinates. Running the edge binary
+-- with -migrate-grid-ids fills this table for its field and rewrites the
+-- field's virtual_sensor_grid_20m rows; the warehouse can join older
+-- extracts through it.
+CREATE TABLE IF NOT EXISTS grid_id_map (
+    field_id VARCHAR NOT NULL,
+    legacy_grid_id VARCHAR NOT NULL,
+    grid_id VARCHAR NOT NULL,
+    PRIMARY KEY (field_id, legacy_grid_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_grid_id_map_grid
+    ON grid_id_map (field_id, grid_id);
@@ -0,0 +1,39 @@
+-- Water budget tables
+-- irrigation_events holds what irrigation controllers logged per zone
+-- (depth and/or volume applied over a run). Edge devices use it for zones
+-- without a flow meter and upsert each zone's daily soil-water balance
+-- into water_budget_daily; (field_id, zone_id, day) is unique so the
+-- running day row is replaced as the day accumulates.
+CREATE TABLE IF NOT EXISTS irrigation_events (
+    id BIGSERIAL PRIMARY KEY,
+    field_id VARCHAR NOT NULL,
+    zone_id VARCHAR NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    ended_at TIMESTAMPTZ NOT NULL,
+    applied_mm DOUBLE PRECISION,
+    volume_l DOUBLE PRECISION,
+    source VARCHAR(32),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_irrigation_events_zone
+    ON irrigation_events (field_id, zone_id, ended_at DESC);
+
+CREATE TABLE IF NOT EXISTS water_budget_daily (
+    field_id VARCHAR NOT NULL,
+    zone_id VARCHAR NOT NULL,
+    day DATE NOT NULL,
+    season VARCHAR(32) NOT NULL,
+    applied_mm DOUBLE PRECISION NOT NULL DEFAULT 0,
+    rain_mm DOUBLE PRECISION NOT NULL DEFAULT 0,
+    et_mm DOUBLE PRECISION NOT NULL DEFAULT 0,
+    drainage_mm DOUBLE PRECISION NOT NULL DEFAULT 0,
+    depletion_mm DOUBLE PRECISION NOT NULL DEFAULT 0,
+    measured_deficit_mm DOUBLE PRECISION,
+    applied_source VARCHAR(16),
+    edge_device_id VARCHAR,
+    UNIQUE (field_id, zone_id, day)
+);
+
+CREATE INDEX IF NOT EXISTS idx_water_budget_daily_season
+    ON water_budget_daily (field_id, season, day);
@@ -0,0 +1,8 @@
+-- Zone run time recommendations
+-- Edge devices with irrigation_hardware configured report, per zone and
+-- cycle, the installed system type, the gross depth to apply (deficit over
+-- application efficiency) and the run time in minutes at its application
+-- rate.
+ALTER TABLE zone_stats ADD COLUMN IF NOT EXISTS hardware_type VARCHAR(32);
+ALTER TABLE zone_stats ADD COLUMN IF NOT EXISTS gross_depth_mm DOUBLE PRECISION;
+ALTER TABLE zone_stats ADD COLUMN IF NOT EXISTS runtime_min DOUBLE PRECISION;
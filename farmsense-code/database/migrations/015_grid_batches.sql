@@ -0,0 +1,27 @@
+-- Grid batches
+-- Every edge compute cycle or backfill recompute is one batch with a UUID
+-- and the algorithm version that produced it. The edge registers the batch
+-- row in the same transaction as its cells and skips cells of a batch
+-- that is already registered, so upload retries never duplicate rows; a
+-- recompute of a timestamp is a separate batch (take the latest
+-- registered_at per field and cycle_at for the current answer).
+CREATE TABLE IF NOT EXISTS grid_batches (
+    batch_id UUID PRIMARY KEY,
+    field_id VARCHAR(50) NOT NULL,
+    edge_device_id VARCHAR(50),
+    cycle_at TIMESTAMPTZ NOT NULL,
+    algorithm_version VARCHAR(32) NOT NULL,
+    config_version VARCHAR(64),
+    computation_mode VARCHAR(20),
+    cells INTEGER NOT NULL,
+    registered_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_grid_batches_field_cycle
+    ON grid_batches (field_id, cycle_at DESC, registered_at DESC);
+
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS batch_id UUID;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS algorithm_version VARCHAR(32);
+
+CREATE INDEX IF NOT EXISTS idx_grid_20m_batch
+    ON virtual_sensor_grid_20m (batch_id, timestamp);
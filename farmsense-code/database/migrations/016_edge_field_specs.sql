@@ -0,0 +1,13 @@
+-- Edge field specs
+-- Each edge device publishes the config of every field it computes (grid,
+-- probes, crop, zones; no credentials or device settings) whenever it
+-- changes, so a neighbouring device can take the fields over if it fails
+-- without having reached it on the LAN first.
+CREATE TABLE IF NOT EXISTS edge_field_specs (
+    device_id VARCHAR(50) NOT NULL,
+    field_id VARCHAR(50) NOT NULL,
+    spec JSONB NOT NULL,
+    spec_hash VARCHAR(16) NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (device_id, field_id)
+);
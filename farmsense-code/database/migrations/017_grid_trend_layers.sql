@@ -0,0 +1,9 @@
+-- Grid trend layers
+-- Per-cell rates the edge fits over its recent cycles: root-zone drydown
+-- (mm/day), temperature trend (°C/day) and the hours until the refill and
+-- wilting points at the current drydown rate. NULL where the edge had too
+-- few cycles to fit or the cell isn't drying.
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS drydown_rate_mm_day DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS temp_trend_c_day DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS hours_to_refill DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS hours_to_wilting DOUBLE PRECISION;
@@ -0,0 +1,13 @@
+-- Soil salinity
+-- Registered extra reading channels (soil_ec in dS/m, pH...) as a JSON
+-- object per reading, and the edge's salinity layers per cell: the
+-- interpolated soil EC, the leaching fraction added to the irrigation
+-- recommendation when ECe exceeds the crop's threshold, and the
+-- Maas-Hoffman yield loss at that ECe. Forwarded edge readings also fill
+-- ec_root from soil_ec, and readings with only ec_root are read back by the
+-- edge as soil_ec.
+ALTER TABLE soil_sensor_readings ADD COLUMN IF NOT EXISTS channels JSON;
+
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS soil_ec_dsm DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS leaching_fraction DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS salinity_yield_loss_pct DOUBLE PRECISION;
@@ -0,0 +1,29 @@
+-- Sync reconciliation
+-- Grid cells are upserted on (grid_id, timestamp, batch_id): a retried or
+-- partially synced batch fills in the cells the cloud is missing and skips
+-- the ones it already has, instead of being skipped (or duplicated) as a
+-- whole. Rows written before batch IDs (batch_id NULL) never conflict.
+-- Duplicates left by earlier uploads are removed before the index is built.
+DELETE FROM virtual_sensor_grid_20m a
+    USING virtual_sensor_grid_20m b
+    WHERE a.batch_id IS NOT NULL
+      AND a.batch_id = b.batch_id
+      AND a.grid_id = b.grid_id
+      AND a.timestamp = b.timestamp
+      AND a.id > b.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uq_grid_20m_cell_batch
+    ON virtual_sensor_grid_20m (grid_id, timestamp, batch_id);
+
+-- Server-acknowledged high-water mark per edge device, field and stream:
+-- the latest cycle_at of any batch committed for it, advanced in the same
+-- transaction as the cells. A reconnecting device only needs to ask about
+-- queued batches at or below it.
+CREATE TABLE IF NOT EXISTS edge_sync_watermarks (
+    edge_device_id VARCHAR(50) NOT NULL,
+    field_id VARCHAR(50) NOT NULL,
+    stream VARCHAR(20) NOT NULL,
+    high_water TIMESTAMPTZ NOT NULL,
+    acked_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (edge_device_id, field_id, stream)
+);
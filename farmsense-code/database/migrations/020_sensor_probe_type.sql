@@ -0,0 +1,6 @@
+-- Sensor probe type
+-- Which probe model is installed (capacitive, tdr, ...). Edge devices
+-- group probes into sensor classes by probe type and install depth and
+-- interpolate each class on its own before fusing them, so mixed probe
+-- types don't bias each other's cells.
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS probe_type VARCHAR(24);
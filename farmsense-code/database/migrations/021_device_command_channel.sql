@@ -0,0 +1,36 @@
+-- Device command channel
+-- Commands can carry parameters (a backfill window, a log level), and
+-- every new command NOTIFYs channel device_commands with the device's
+-- external ID so listening devices run it right away instead of on their
+-- next heartbeat poll.
+ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS params JSONB;
+
+ALTER TABLE device_commands DROP CONSTRAINT IF EXISTS device_commands_command_check;
+ALTER TABLE device_commands ADD CONSTRAINT device_commands_command_check
+    CHECK (command IN ('reboot', 'resync', 'recompute', 'sync', 'backfill', 'diagnostics', 'log_level'));
+
+CREATE OR REPLACE FUNCTION notify_device_command() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('device_commands', NEW.device_external_id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_notify_device_command ON device_commands;
+CREATE TRIGGER trg_notify_device_command
+    AFTER INSERT ON device_commands
+    FOR EACH ROW EXECUTE FUNCTION notify_device_command();
+
+-- Diagnostics bundles uploaded in answer to a diagnostics command: recent
+-- log lines, the running config without secrets, local cache statistics
+-- and the device's storage, throttle and backfill state.
+CREATE TABLE IF NOT EXISTS device_diagnostics (
+    id BIGSERIAL PRIMARY KEY,
+    device_external_id VARCHAR(100) NOT NULL,
+    command_id BIGINT REFERENCES device_commands (id),
+    collected_at TIMESTAMPTZ NOT NULL,
+    bundle JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_diagnostics_device
+    ON device_diagnostics (device_external_id, collected_at DESC);
@@ -0,0 +1,27 @@
+-- Tenant partitioning
+-- A co-op's edge device serves fields belonging to several growers. Each
+-- field is owned by a tenant (a grower or organization), and edge devices
+-- tag their grid cells, zone stats and grid batches with it so one
+-- grower's data can be selected, exported and access-checked without
+-- joining through fields.
+CREATE TABLE IF NOT EXISTS tenants (
+    tenant_id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(200) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE fields ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(50) REFERENCES tenants (tenant_id);
+CREATE INDEX IF NOT EXISTS idx_fields_tenant ON fields (tenant_id);
+
+-- Uploads carry the tenant the device was configured with; NULL for
+-- devices without tenant_id, whose fields belong to the farm as before.
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(50);
+CREATE INDEX IF NOT EXISTS idx_grid_20m_tenant
+    ON virtual_sensor_grid_20m (tenant_id, field_id, timestamp DESC);
+
+ALTER TABLE zone_stats ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(50);
+CREATE INDEX IF NOT EXISTS idx_zone_stats_tenant
+    ON zone_stats (tenant_id, field_id, timestamp DESC);
+
+ALTER TABLE grid_batches ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(50);
+CREATE INDEX IF NOT EXISTS idx_grid_batches_tenant ON grid_batches (tenant_id, field_id);
@@ -0,0 +1,9 @@
+-- Superseded grid batches
+-- A reading that reaches an edge device after the cycle whose window it
+-- falls in was missing from that cycle's batch. The device marks such a
+-- batch superseded and, by default, recomputes the cycle as a new backfill
+-- batch; current views should skip superseded batches.
+ALTER TABLE grid_batches ADD COLUMN IF NOT EXISTS superseded_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_grid_batches_live
+    ON grid_batches (field_id, cycle_at DESC) WHERE superseded_at IS NULL;
@@ -0,0 +1,8 @@
+-- Vendor extra channels
+-- Readings keep vendor-specific channels outside the edge's variable
+-- registry (soil oxygen, dendrometer, leaf wetness...) as a JSONB object
+-- per reading instead of dropping them. Edge devices forward them with
+-- each reading and read them back for interpolation when configured.
+ALTER TABLE soil_sensor_readings ADD COLUMN IF NOT EXISTS extras JSONB;
+CREATE INDEX IF NOT EXISTS idx_soil_readings_extras
+    ON soil_sensor_readings USING GIN (extras) WHERE extras IS NOT NULL;
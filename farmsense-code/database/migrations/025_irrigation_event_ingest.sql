@@ -0,0 +1,10 @@
+-- Edge-ingested irrigation events
+-- Edge devices record controller runs and pulse flow meter runs locally
+-- and upsert completed ones here, keyed by their own event ID per field so
+-- a re-upload replaces the row. edge_device_id lets a device skip its own
+-- runs when it reads the table back for the water budget. Rows logged by
+-- other sources leave both NULL.
+ALTER TABLE irrigation_events ADD COLUMN IF NOT EXISTS event_uid VARCHAR;
+ALTER TABLE irrigation_events ADD COLUMN IF NOT EXISTS edge_device_id VARCHAR;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_irrigation_events_uid
+    ON irrigation_events (field_id, event_uid);
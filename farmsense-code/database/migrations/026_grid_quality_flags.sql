@@ -0,0 +1,6 @@
+-- Grid quality flags
+-- Edge cells carry a bitfield of interpolation caveats: 1 extrapolated
+-- beyond the probes' hull, 2 one probe dominating the cell's weight,
+-- 4 stale inputs, 8 low confidence. 0 is a clean cell, so consumers can
+-- filter with quality_flags = 0 or test single bits.
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS quality_flags INTEGER NOT NULL DEFAULT 0;
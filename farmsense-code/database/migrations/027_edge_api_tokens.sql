@@ -0,0 +1,22 @@
+-- Edge API tokens
+-- Per-user credentials for gateways' local API. Only the SHA-256 of a
+-- token is stored (hex); gateways with api_cloud_tokens pull the rows for
+-- themselves (device_external_id) or every gateway (NULL) and cache them
+-- for offline use, so revoking takes effect at their next pull. role is
+-- what the user may do on the gateway: viewer reads, operator also
+-- triggers compute and acknowledges alerts, admin also changes config.
+CREATE TABLE IF NOT EXISTS edge_api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id),
+    device_external_id VARCHAR(100),
+    tenant_id VARCHAR(50) REFERENCES tenants (tenant_id),
+    role VARCHAR(20) NOT NULL CHECK (role IN ('viewer', 'operator', 'admin')),
+    token_sha256 CHAR(64) NOT NULL UNIQUE,
+    description VARCHAR,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_edge_api_tokens_device
+    ON edge_api_tokens (device_external_id) WHERE revoked_at IS NULL;
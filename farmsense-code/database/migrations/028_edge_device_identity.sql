@@ -0,0 +1,49 @@
+-- Edge device identity
+-- Binds a gateway's device ID to its hardware so a cloned SD card can't
+-- sync as the original. An operator issues a one-time provisioning token
+-- (only its SHA-256 is stored, hex), optionally for a given device ID; the
+-- gateway's provision command claims it, generates an Ed25519 key and
+-- records the hardware fingerprint, public key (base64) and its signature
+-- of 'farmsense-provision-v1|device_id|hardware_id|public_key|token_sha256'.
+-- Gateways refuse to sync while their device ID's live row names other
+-- hardware, and record each such sighting in edge_identity_conflicts.
+-- last_signature signs 'farmsense-identity-v1|device_id|hardware_id|unix
+-- time of last_signed_at' with the device key.
+CREATE TABLE IF NOT EXISTS edge_provisioning_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    token_sha256 CHAR(64) NOT NULL UNIQUE,
+    device_external_id VARCHAR(100),
+    created_by UUID REFERENCES users (id),
+    description VARCHAR,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    used_at TIMESTAMPTZ,
+    used_by_hardware_id CHAR(32),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS edge_device_identities (
+    device_external_id VARCHAR(100) PRIMARY KEY,
+    hardware_id CHAR(32) NOT NULL,
+    public_key VARCHAR(64) NOT NULL,
+    provision_token_sha256 CHAR(64) NOT NULL,
+    provision_signature VARCHAR(100) NOT NULL,
+    provisioned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ,
+    last_seen_at TIMESTAMPTZ,
+    last_signed_at TIMESTAMPTZ,
+    last_signature VARCHAR(100)
+);
+
+-- One live identity per board
+CREATE UNIQUE INDEX IF NOT EXISTS idx_edge_device_identities_hardware
+    ON edge_device_identities (hardware_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS edge_identity_conflicts (
+    device_external_id VARCHAR(100) NOT NULL,
+    hardware_id CHAR(32) NOT NULL,
+    first_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sightings INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (device_external_id, hardware_id)
+);
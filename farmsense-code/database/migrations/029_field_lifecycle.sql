@@ -0,0 +1,38 @@
+-- Field lifecycle
+-- Edge devices upload each recorded lifecycle transition (planting,
+-- mid_season, harvest, fallow) into field_lifecycle_events, unique per
+-- event_uid ('device_id:local id'), and each closed season into
+-- field_seasons with the zones' season water budget totals as JSON.
+-- season matches water_budget_daily.season: the planting date, or
+-- 'fallow-<date>' between crops.
+CREATE TABLE IF NOT EXISTS field_lifecycle_events (
+    id BIGSERIAL PRIMARY KEY,
+    field_id VARCHAR NOT NULL,
+    event_uid VARCHAR NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    event_date DATE NOT NULL,
+    crop_type VARCHAR(64),
+    stages JSONB,
+    note VARCHAR,
+    season VARCHAR(32) NOT NULL,
+    recorded_by VARCHAR,
+    recorded_at TIMESTAMPTZ NOT NULL,
+    edge_device_id VARCHAR,
+    UNIQUE (field_id, event_uid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_field_lifecycle_events_field
+    ON field_lifecycle_events (field_id, event_date);
+
+CREATE TABLE IF NOT EXISTS field_seasons (
+    field_id VARCHAR NOT NULL,
+    season VARCHAR(32) NOT NULL,
+    crop_type VARCHAR(64),
+    start_date DATE NOT NULL,
+    end_date DATE NOT NULL,
+    end_state VARCHAR(16) NOT NULL,
+    zones JSONB NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL,
+    edge_device_id VARCHAR,
+    PRIMARY KEY (field_id, season)
+);
@@ -0,0 +1,30 @@
+-- Zone anomalies
+-- Edge devices chart each management zone's hourly root moisture and
+-- temperature change (EWMA and CUSUM against the zone's own baseline) and
+-- upload one row per anomaly episode, unique per anomaly_uid
+-- ('device_id:local id'). class separates field_event (probes agree),
+-- sensor_fault (the move comes from probes with a failure signature) and
+-- unconfirmed; sensors and signatures are comma separated lists.
+CREATE TABLE IF NOT EXISTS zone_anomalies (
+    id BIGSERIAL PRIMARY KEY,
+    field_id VARCHAR NOT NULL,
+    anomaly_uid VARCHAR NOT NULL,
+    zone_id VARCHAR NOT NULL,
+    metric VARCHAR(32) NOT NULL,
+    direction VARCHAR(8) NOT NULL,
+    detector VARCHAR(8) NOT NULL,
+    class VARCHAR(16) NOT NULL,
+    value_per_h DOUBLE PRECISION NOT NULL,
+    baseline_per_h DOUBLE PRECISION NOT NULL,
+    sigma_per_h DOUBLE PRECISION NOT NULL,
+    statistic DOUBLE PRECISION NOT NULL,
+    limit_value DOUBLE PRECISION NOT NULL,
+    sensors VARCHAR NOT NULL DEFAULT '',
+    signatures VARCHAR NOT NULL DEFAULT '',
+    detected_at TIMESTAMPTZ NOT NULL,
+    edge_device_id VARCHAR,
+    UNIQUE (field_id, anomaly_uid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_zone_anomalies_zone
+    ON zone_anomalies (field_id, zone_id, detected_at DESC);
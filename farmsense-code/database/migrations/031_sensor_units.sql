@@ -0,0 +1,14 @@
+-- Sensor reporting units
+-- The units each probe reports in, so edge devices can convert every
+-- reading to m³/m³, °C and mm before interpolation: moisture as a
+-- fraction, percent or raw counts (with a two-point calibration),
+-- temperature in c, f or k, and per-channel length units (mm, cm, in).
+-- NULL means canonical. Readings whose probe names a unit the edge
+-- doesn't know are rejected.
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS moisture_unit VARCHAR(16);
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS raw_dry_counts DOUBLE PRECISION;
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS raw_dry_vwc DOUBLE PRECISION;
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS raw_wet_counts DOUBLE PRECISION;
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS raw_wet_vwc DOUBLE PRECISION;
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS temp_unit VARCHAR(4);
+ALTER TABLE sensor_registry ADD COLUMN IF NOT EXISTS channel_units JSONB;
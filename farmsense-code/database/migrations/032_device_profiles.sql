@@ -0,0 +1,23 @@
+-- Device runtime profiles
+-- A profile command asks a device for a Go runtime profile (a CPU profile
+-- over some seconds or one compute cycle, or a heap, allocs or goroutine
+-- snapshot); the device uploads it here on its next sync. profile holds
+-- the gzipped pprof protobuf as `go tool pprof` reads it.
+ALTER TABLE device_commands DROP CONSTRAINT IF EXISTS device_commands_command_check;
+ALTER TABLE device_commands ADD CONSTRAINT device_commands_command_check
+    CHECK (command IN ('reboot', 'resync', 'recompute', 'sync', 'backfill', 'diagnostics', 'log_level', 'profile'));
+
+CREATE TABLE IF NOT EXISTS device_profiles (
+    id BIGSERIAL PRIMARY KEY,
+    device_external_id VARCHAR(100) NOT NULL,
+    command_id BIGINT REFERENCES device_commands (id),
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('cpu', 'heap', 'allocs', 'goroutine')),
+    captured_at TIMESTAMPTZ NOT NULL,
+    duration_ms BIGINT NOT NULL,
+    app_version VARCHAR(32),
+    profile BYTEA NOT NULL,
+    uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_profiles_device
+    ON device_profiles (device_external_id, captured_at DESC);
@@ -0,0 +1,28 @@
+-- Grid epochs
+-- An edge upload commits its cells, batches and the field's epoch in one
+-- transaction: grid_epochs names the newest batch of each field that has
+-- landed in full, with a counter that goes up on every advance. The epoch
+-- only moves forward, so a backfill of an older cycle leaves it alone.
+CREATE TABLE IF NOT EXISTS grid_epochs (
+    field_id VARCHAR(50) PRIMARY KEY,
+    epoch BIGINT NOT NULL,
+    batch_id UUID NOT NULL,
+    edge_device_id VARCHAR(50),
+    cycle_at TIMESTAMPTZ NOT NULL,
+    cells INTEGER NOT NULL,
+    committed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- The field's grid as of its epoch: each cell's latest row at or before the
+-- epoch's cycle, skipping superseded batches and preferring the newest
+-- batch where a cycle was recomputed. Devices that only upload changed
+-- cells leave unchanged cells on their last row, which this picks up.
+-- Dashboards should read this instead of the raw table, so they never show
+-- two cycles at once.
+CREATE OR REPLACE VIEW virtual_sensor_grid_current AS
+SELECT DISTINCT ON (g.field_id, g.grid_id) g.*, e.epoch, e.cycle_at AS epoch_cycle_at
+FROM grid_epochs e
+JOIN virtual_sensor_grid_20m g ON g.field_id = e.field_id AND g.timestamp <= e.cycle_at
+LEFT JOIN grid_batches b ON b.batch_id = g.batch_id
+WHERE b.superseded_at IS NULL
+ORDER BY g.field_id, g.grid_id, g.timestamp DESC, b.registered_at DESC NULLS LAST;
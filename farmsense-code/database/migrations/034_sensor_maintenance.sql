@@ -0,0 +1,24 @@
+-- Sensor maintenance schedule
+-- Edge devices fit each probe's battery discharge curve and group probes
+-- needing a visit into trips. Each plan replaces the field's visits; stops
+-- lists the probes on the trip with why (battery or health) and, for
+-- batteries, when the pack is forecast to cross its cutoff.
+CREATE TABLE IF NOT EXISTS sensor_maintenance_visits (
+    field_id VARCHAR NOT NULL,
+    visit_id VARCHAR NOT NULL,
+    due_by TIMESTAMPTZ NOT NULL,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    stops JSONB NOT NULL,
+    planned_at TIMESTAMPTZ NOT NULL,
+    edge_device_id VARCHAR,
+    PRIMARY KEY (field_id, visit_id)
+);
+
+-- Crews list upcoming visits across fields
+CREATE INDEX IF NOT EXISTS idx_sensor_maintenance_due ON sensor_maintenance_visits(due_by);
+
+-- Battery forecast per probe (NULL dead_by: not declining toward the cutoff)
+ALTER TABLE sensor_health ADD COLUMN IF NOT EXISTS battery_dead_by TIMESTAMPTZ;
+ALTER TABLE sensor_health ADD COLUMN IF NOT EXISTS battery_slope_v_day DOUBLE PRECISION;
+ALTER TABLE sensor_health ADD COLUMN IF NOT EXISTS battery_model VARCHAR;
@@ -0,0 +1,34 @@
+-- Audit log
+-- Edge devices append config changes, commands, irrigation actuations and
+-- alert acknowledgements with the actor and before/after values, and
+-- upload them once; (edge_device_id, field_id, local_id) makes a re-sent
+-- entry a no-op. Water-district reports read this table, so it is
+-- append-only: updates and deletes are refused.
+CREATE TABLE IF NOT EXISTS audit_log (
+    edge_device_id VARCHAR(100) NOT NULL,
+    field_id VARCHAR(50) NOT NULL,
+    local_id BIGINT NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('config', 'command', 'actuation', 'alert_ack')),
+    actor VARCHAR NOT NULL,
+    action VARCHAR NOT NULL,
+    subject VARCHAR NOT NULL DEFAULT '',
+    before JSONB,
+    after JSONB,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (edge_device_id, field_id, local_id)
+);
+
+-- Reports run per field over a period
+CREATE INDEX IF NOT EXISTS idx_audit_log_field_time ON audit_log(field_id, occurred_at);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
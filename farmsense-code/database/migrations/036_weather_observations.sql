@@ -0,0 +1,33 @@
+-- Weather station observations
+-- Edge devices poll on-farm stations (Davis WeatherLink, Campbell TOA5
+-- files, METER ATMOS 41) and upload one row per station and timestamp,
+-- normalized to metric units; a re-sent row is a no-op. rainfall_mm and
+-- et0_mm cover the interval since the station's previous observation, so
+-- they can be summed over any period.
+CREATE TABLE IF NOT EXISTS weather_observations (
+    station_id VARCHAR(50) NOT NULL,
+    field_id VARCHAR(50) NOT NULL,
+    edge_device_id VARCHAR(100) NOT NULL,
+    observed_at TIMESTAMPTZ NOT NULL,
+    source VARCHAR(20) NOT NULL CHECK (source IN ('davis_weatherlink', 'campbell_csv', 'atmos41')),
+    temperature_c FLOAT,
+    humidity_pct FLOAT,
+    pressure_hpa FLOAT,
+    wind_speed_ms FLOAT,
+    wind_direction_deg FLOAT,
+    gust_ms FLOAT,
+    rainfall_mm FLOAT,
+    solar_radiation_wm2 FLOAT,
+    et0_mm FLOAT,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (station_id, observed_at)
+);
+
+SELECT create_hypertable('weather_observations', 'observed_at',
+    chunk_time_interval => INTERVAL '1 week',
+    if_not_exists => TRUE
+);
+
+CREATE INDEX IF NOT EXISTS idx_weather_observations_field_time ON weather_observations(field_id, observed_at DESC);
+
+SELECT add_retention_policy('weather_observations', INTERVAL '2 years', if_not_exists => TRUE);
@@ -0,0 +1,47 @@
+-- Shadow interpolation
+-- Edge devices with shadow_interpolator set interpolate each cycle a
+-- second time with a candidate algorithm (kriging, IDW at another power,
+-- an RBF basis). Its cells are kept apart from virtual_sensor_grid_20m so
+-- nothing that reads the live grid, irrigation included, ever sees them;
+-- computation_mode names the algorithm (edge_20m_shadow_<algorithm>).
+CREATE TABLE IF NOT EXISTS virtual_sensor_grid_shadow (
+    field_id VARCHAR(50) NOT NULL,
+    grid_id VARCHAR(100) NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    computation_mode VARCHAR(50) NOT NULL,
+    edge_device_id VARCHAR(100) NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    moisture_surface FLOAT,
+    moisture_root FLOAT,
+    temperature FLOAT,
+    confidence FLOAT,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (field_id, grid_id, timestamp, computation_mode)
+);
+
+SELECT create_hypertable('virtual_sensor_grid_shadow', 'timestamp',
+    chunk_time_interval => INTERVAL '1 week',
+    if_not_exists => TRUE
+);
+
+SELECT add_retention_policy('virtual_sensor_grid_shadow', INTERVAL '180 days', if_not_exists => TRUE);
+
+-- One row per cycle and variable: both algorithms' leave-one-out RMSE and
+-- how far the shadow cells were from the live ones.
+CREATE TABLE IF NOT EXISTS interpolation_shadow_comparisons (
+    field_id VARCHAR(50) NOT NULL,
+    cycle_time TIMESTAMPTZ NOT NULL,
+    algorithm VARCHAR(32) NOT NULL,
+    variable VARCHAR(50) NOT NULL,
+    edge_device_id VARCHAR(100) NOT NULL,
+    live_rmse FLOAT,
+    shadow_rmse FLOAT,
+    mean_abs_diff FLOAT,
+    max_abs_diff FLOAT,
+    cells INTEGER NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (field_id, cycle_time, algorithm, variable)
+);
+
+CREATE INDEX IF NOT EXISTS idx_shadow_comparisons_algorithm_time
+    ON interpolation_shadow_comparisons (algorithm, variable, cycle_time DESC);
@@ -0,0 +1,26 @@
+-- Edge local cache keys
+-- Escrow for gateways whose local cache is SQLCipher-encrypted with
+-- local_cache_key_source=cloud. A gateway generates its first key and
+-- inserts it active, and fetches it on every start. A rotation is staged
+-- as a pending row, by the gateway's rotate-cache-key command or by an
+-- operator (key_hex = encode(gen_random_bytes(32), 'hex') with pgcrypto);
+-- on its next start the gateway re-encrypts its cache, retires the active
+-- key and makes the pending one active. Retired keys are kept so a cache
+-- restored from an old backup can still be opened. key_hex is the raw
+-- 256-bit key: grant this table to the edge role and key custodians only.
+CREATE TABLE IF NOT EXISTS edge_cache_keys (
+    key_id BIGSERIAL PRIMARY KEY,
+    device_external_id VARCHAR(100) NOT NULL,
+    key_hex CHAR(64) NOT NULL,
+    state VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (state IN ('active', 'pending', 'retired')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    activated_at TIMESTAMPTZ,
+    retired_at TIMESTAMPTZ
+);
+
+-- One active key per device
+CREATE UNIQUE INDEX IF NOT EXISTS idx_edge_cache_keys_active
+    ON edge_cache_keys (device_external_id) WHERE state = 'active';
+
+CREATE INDEX IF NOT EXISTS idx_edge_cache_keys_device
+    ON edge_cache_keys (device_external_id, state, created_at DESC);
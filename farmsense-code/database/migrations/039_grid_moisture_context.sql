@@ -0,0 +1,10 @@
+-- Grid moisture context
+-- Edge cells carry where their root moisture sits in their own record:
+-- the percentile (0-100) among the cell's daily means over the previous
+-- 30 and 90 days, and the cell's mean over the same week last season with
+-- the current value's difference from it. NULL until the gateway has
+-- enough of the cell's history.
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS moisture_root_pct_30d DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS moisture_root_pct_90d DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS moisture_root_last_season DOUBLE PRECISION;
+ALTER TABLE virtual_sensor_grid_20m ADD COLUMN IF NOT EXISTS moisture_root_vs_last_season DOUBLE PRECISION;
@@ -0,0 +1,145 @@
+"""FarmSense GPU interpolation sidecar - CUDA neighbor search for the edge processor.
+
+Serves POST /neighbors on a unix socket for edge_processor (gpu_interp.go).
+The request carries every grid cell and probe as [lon, lat], the search
+radius and optional anisotropy; the reply lists, per cell, the probes within
+radius and their distance in compressed rows:
+
+    {"offsets": [...], "sensors": [...], "distances": [...]}
+
+with cell i's neighbors at [offsets[i], offsets[i+1]), probes in request
+order. Distances match the processor's CPU path exactly in definition:
+orb's equirectangular geo.Distance (earth radius 6378137 m), anything under
+1 m counts as on the cell (0), and with anisotropy the offset is rescaled
+along the row azimuth using the spherical radius 6371008.8 m.
+
+The distance matrix is evaluated on the GPU with CuPy in blocks of cells so
+memory stays bounded on an 8 GB Jetson. --numpy runs the same code on the
+CPU for development machines without CUDA.
+"""
+
+import argparse
+import json
+import logging
+import os
+import socketserver
+from http.server import BaseHTTPRequestHandler
+
+ORB_EARTH_RADIUS_M = 6378137.0
+SPHERE_RADIUS_M = 6371008.8
+COINCIDENT_M = 1.0
+DEFAULT_SOCKET = "/run/farmsense/gpu-interp.sock"
+DEFAULT_BLOCK_CELLS = 8192
+
+log = logging.getLogger("farmsense-gpu-interp")
+xp = None  # cupy, or numpy with --numpy
+
+
+def neighbor_rows(cells, sensors, radius, anisotropy, block):
+    """Return offsets, sensor indices and distances for every cell."""
+    sensors = xp.asarray(sensors, dtype=xp.float64).reshape(-1, 2)
+    s_lon = xp.radians(sensors[:, 0])[None, :]
+    s_lat = xp.radians(sensors[:, 1])[None, :]
+    cells = xp.asarray(cells, dtype=xp.float64).reshape(-1, 2)
+
+    counts, idx_parts, dist_parts = [], [], []
+    for start in range(0, cells.shape[0], block):
+        c = cells[start:start + block]
+        c_lon = xp.radians(c[:, 0])[:, None]
+        c_lat = xp.radians(c[:, 1])[:, None]
+
+        # orb geo.Distance: equirectangular on the mean latitude
+        d_lat = c_lat - s_lat
+        d_lon = xp.abs(c_lon - s_lon)
+        d_lon = xp.where(d_lon > xp.pi, 2 * xp.pi - d_lon, d_lon)
+        mean_lat = (c_lat + s_lat) / 2
+        geodesic = xp.sqrt(d_lat ** 2 + (d_lon * xp.cos(mean_lat)) ** 2) * ORB_EARTH_RADIUS_M
+
+        dist = geodesic
+        if anisotropy:
+            east = (s_lon - c_lon) * SPHERE_RADIUS_M * xp.cos(mean_lat)
+            north = (s_lat - c_lat) * SPHERE_RADIUS_M
+            az = xp.radians(anisotropy["azimuth_deg"])
+            along = east * xp.sin(az) + north * xp.cos(az)
+            across = east * xp.cos(az) - north * xp.sin(az)
+            dist = xp.hypot(along / anisotropy["ratio"], across)
+        dist = xp.where(geodesic < COINCIDENT_M, 0.0, dist)
+
+        within = dist <= radius
+        rows, cols = xp.nonzero(within)  # row-major, so probes stay in request order per cell
+        counts.append(within.sum(axis=1))
+        idx_parts.append(cols)
+        dist_parts.append(dist[rows, cols])
+
+    if not counts:
+        return [0], [], []
+    offsets = xp.concatenate([xp.zeros(1, dtype=xp.int64), xp.cumsum(xp.concatenate(counts))])
+    return (to_list(offsets), to_list(xp.concatenate(idx_parts)), to_list(xp.concatenate(dist_parts)))
+
+
+def to_list(a):
+    return a.get().tolist() if hasattr(a, "get") else a.tolist()
+
+
+class Handler(BaseHTTPRequestHandler):
+    block = DEFAULT_BLOCK_CELLS
+
+    def do_POST(self):
+        if self.path != "/neighbors":
+            self.send_error(404)
+            return
+        try:
+            req = json.loads(self.rfile.read(int(self.headers.get("Content-Length", 0))))
+            anisotropy = req.get("anisotropy")
+            if anisotropy and anisotropy.get("ratio", 1) <= 1:
+                anisotropy = None
+            offsets, sensors, distances = neighbor_rows(
+                req["cells"], req["sensors"], float(req["search_radius_m"]), anisotropy, self.block)
+        except (ValueError, KeyError, TypeError) as err:
+            self.send_error(400, str(err))
+            return
+        body = json.dumps({"offsets": offsets, "sensors": sensors, "distances": distances}).encode()
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, fmt, *args):
+        log.debug(fmt, *args)  # unix socket peers have no address
+
+
+class Server(socketserver.UnixStreamServer):
+    pass
+
+
+def main():
+    global xp
+    parser = argparse.ArgumentParser(description=__doc__.splitlines()[0])
+    parser.add_argument("-socket", default=DEFAULT_SOCKET)
+    parser.add_argument("-block-cells", type=int, default=DEFAULT_BLOCK_CELLS)
+    parser.add_argument("--numpy", action="store_true", help="run on the CPU (development only)")
+    parser.add_argument("-v", action="store_true", help="log every request")
+    args = parser.parse_args()
+    logging.basicConfig(level=logging.DEBUG if args.v else logging.INFO, format="%(levelname)s %(message)s")
+
+    if args.numpy:
+        import numpy
+        xp = numpy
+    else:
+        import cupy
+        xp = cupy
+        log.info("CUDA device %s", cupy.cuda.runtime.getDeviceProperties(0)["name"].decode())
+    Handler.block = args.block_cells
+
+    if os.path.exists(args.socket):
+        os.unlink(args.socket)
+    os.makedirs(os.path.dirname(args.socket), exist_ok=True)
+    with Server(args.socket, Handler) as server:
+        os.chmod(args.socket, 0o660)
+        log.info("Listening on %s", args.socket)
+        server.serve_forever()
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,135 @@
+// Alerts - in-memory log of maintenance and agronomic alerts
+// Detectors raise alerts here; the local API exposes them, and the MQTT
+// publisher and notification channels (notifications.go) are handed each
+// one as it is raised.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const defaultAlertLogSize = 500
+
+// Severity levels
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert is a single detector finding.
+type Alert struct {
+	ID       string    `json:"alert_id"`
+	Kind     string    `json:"kind"`
+	Severity string    `json:"severity"`
+	FieldID  string    `json:"field_id"`
+	Subject  string    `json:"subject"` // zone_id, sensor_id, grid_id...
+	Message  string    `json:"message"`
+	Value    float64   `json:"value"`
+	RaisedAt time.Time `json:"raised_at"`
+
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"` // user or credential that acknowledged it (api_rbac.go)
+}
+
+// AlertLog is a bounded, concurrency-safe alert history.
+type AlertLog struct {
+	mu     sync.RWMutex
+	alerts []Alert
+	max    int
+	seq    int
+	notify []func(Alert) // delivery hooks, none = log only
+	logger *slog.Logger
+}
+
+func NewAlertLog(max int) *AlertLog {
+	if max <= 0 {
+		max = defaultAlertLogSize
+	}
+	return &AlertLog{
+		alerts: make([]Alert, 0),
+		max:    max,
+		logger: slog.With("component", "alerts"),
+	}
+}
+
+// Raise records an alert, assigning ID and timestamp if unset.
+func (l *AlertLog) Raise(a Alert) Alert {
+	l.mu.Lock()
+	l.seq++
+	if a.ID == "" {
+		a.ID = fmt.Sprintf("alert_%d_%d", time.Now().Unix(), l.seq)
+	}
+	if a.RaisedAt.IsZero() {
+		a.RaisedAt = time.Now()
+	}
+	l.alerts = append(l.alerts, a)
+	if len(l.alerts) > l.max {
+		l.alerts = l.alerts[len(l.alerts)-l.max:]
+	}
+	notify := l.notify
+	l.mu.Unlock()
+
+	for _, fn := range notify {
+		fn(a)
+	}
+
+	l.logger.Warn("Alert raised", "kind", a.Kind, "severity", a.Severity,
+		"field_id", a.FieldID, "subject", a.Subject, "message", a.Message)
+	return a
+}
+
+// OnRaise adds a function called with every alert raised from now on.
+// It must not block.
+func (l *AlertLog) OnRaise(fn func(Alert)) {
+	l.mu.Lock()
+	l.notify = append(l.notify, fn)
+	l.mu.Unlock()
+}
+
+// Acknowledge marks an alert as seen by someone; acknowledging it again
+// keeps the first acknowledgement. ok is false for an unknown ID.
+func (l *AlertLog) Acknowledge(id, by string) (Alert, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.alerts {
+		if l.alerts[i].ID != id {
+			continue
+		}
+		if l.alerts[i].AcknowledgedAt == nil {
+			now := time.Now()
+			l.alerts[i].AcknowledgedAt, l.alerts[i].AcknowledgedBy = &now, by
+		}
+		return l.alerts[i], true
+	}
+	return Alert{}, false
+}
+
+// Get returns an alert by ID.
+func (l *AlertLog) Get(id string) (Alert, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, a := range l.alerts {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Alert{}, false
+}
+
+// List returns alerts newest first, optionally filtered by kind.
+func (l *AlertLog) List(kind string) []Alert {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]Alert, 0, len(l.alerts))
+	for i := len(l.alerts) - 1; i >= 0; i-- {
+		if kind == "" || l.alerts[i].Kind == kind {
+			out = append(out, l.alerts[i])
+		}
+	}
+	return out
+}
@@ -116,7 +116,8 @@ func (ac *AllianceChain) broadcast(phase Phase, payload interface{}) {
 	}
 	
 	// Simulation: Send over LoRa Mesh 900MHz
-	log.Printf("[AllianceChain] Broadcasting %s phase to %d peers", phase, len(ac.Peers))
+	frame, _ := json.Marshal(msg)
+	log.Printf("[AllianceChain] Broadcasting %s phase to %d peers (%d bytes)", phase, len(ac.Peers), len(frame))
 	
 	// In a real implementation, this would trigger HandleMessage on peers
 }
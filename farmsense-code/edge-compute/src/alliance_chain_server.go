@@ -41,6 +41,7 @@ type AllianceChainServer struct {
 	chain               *AllianceChain
 	backendCallbackURL  string
 	port                int
+	auth                *APIAuth // nil = open
 }
 
 func NewAllianceChainServer(nodeID string, peers []string, port int, callbackURL string) *AllianceChainServer {
@@ -63,7 +64,7 @@ func (s *AllianceChainServer) Start() {
 
 	srv := &http.Server{
 		Addr:         addr,
-		Handler:      mux,
+		Handler:      s.auth.Wrap(mux, "/health"),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
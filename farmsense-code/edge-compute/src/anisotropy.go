@@ -0,0 +1,53 @@
+// Anisotropy - direction-dependent distance for IDW
+// Under drip, moisture is correlated much further along a row (water moves
+// along the tape and the wetted strip is continuous) than across rows. With
+// anisotropy set, the offset between a cell and a sensor is split into
+// along-row and across-row components and the along-row part is shrunk by
+// the ratio before computing distance, so the weight decays over ratio× the
+// range along rows. The search radius applies to the same effective
+// distance, which lets a sensor reach further down its row.
+
+package main
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+const earthRadiusM = 6371008.8
+
+// Anisotropy describes a field's row direction and correlation stretch.
+type Anisotropy struct {
+	AzimuthDeg float64 `json:"azimuth_deg"` // Row direction, degrees clockwise from north
+	Ratio      float64 `json:"ratio"`       // Along-row ÷ across-row correlation range (1 = isotropic)
+}
+
+// localOffsetMeters returns the east/north offset from a to b. An
+// equirectangular projection is accurate to well under a metre at
+// interpolation distances.
+func localOffsetMeters(a, b orb.Point) (float64, float64) {
+	meanLat := (a.Lat() + b.Lat()) / 2 * math.Pi / 180
+	east := (b.Lon() - a.Lon()) * math.Pi / 180 * earthRadiusM * math.Cos(meanLat)
+	north := (b.Lat() - a.Lat()) * math.Pi / 180 * earthRadiusM
+	return east, north
+}
+
+// anisotropicDistance rescales the a→b offset into isotropic distance.
+func (an *Anisotropy) anisotropicDistance(a, b orb.Point) float64 {
+	east, north := localOffsetMeters(a, b)
+	az := an.AzimuthDeg * math.Pi / 180
+	along := east*math.Sin(az) + north*math.Cos(az)
+	across := east*math.Cos(az) - north*math.Sin(az)
+	return math.Hypot(along/an.Ratio, across)
+}
+
+// effectiveDistance is the distance used for IDW weights and the search
+// radius: geodesic unless the field has anisotropy configured.
+func (ep *EdgeProcessor) effectiveDistance(a, b orb.Point, geodesic float64) float64 {
+	an := ep.config.Anisotropy
+	if an == nil || an.Ratio <= 1 {
+		return geodesic
+	}
+	return an.anisotropicDistance(a, b)
+}
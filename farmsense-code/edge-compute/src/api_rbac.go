@@ -0,0 +1,280 @@
+// API Roles - role-based access to the local API
+// Every authenticated caller has a role, and each role includes the ones
+// below it:
+//
+//	viewer    read endpoints: grids, tiles, sensors, zones, trends, alerts,
+//	          the audit log
+//	operator  trigger work: POST /commands (recompute, sync, resync),
+//	          POST /grid/backfill, POST /zones/flow-baseline/reset and
+//	          POST /alerts/ack
+//	admin     change the device: PUT /config, packet captures, /debug/pprof
+//
+// Credentials from the config (api_keys, api_tenant_keys, client
+// certificates) are admin unless a tenant key sets role, and a JWT takes
+// its role claim (admin without one), so configs from before roles keep
+// their access. Tenancy (tenancy.go) applies on top: a tenant's admin
+// still only reaches its own fields and no device endpoints.
+//
+// With api_cloud_tokens the cloud provisions per-user tokens in
+// edge_api_tokens (migration 027): the SHA-256 of the token, the role,
+// an optional tenant and expiry, for every gateway or one device. The
+// gateway pulls its rows every api_token_sync_sec (default 300) into the
+// local api_tokens table and authenticates from that copy, so users keep
+// working while the gateway is offline; a revocation takes effect at the
+// next successful pull. Actions above viewer are logged with the user, and
+// config changes, commands and acknowledgements are also audited under
+// it (audit_log.go).
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// API roles
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+const (
+	defaultAPITokenSyncSec = 300
+	apiTokenSyncTimeout    = 30 * time.Second
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// validRole accepts a role name, empty meaning admin.
+func validRole(role string) bool {
+	return role == "" || roleRank[role] > 0
+}
+
+// roleName is the principal's role, admin for credentials without one.
+func (p apiPrincipal) roleName() string {
+	if p.role == "" {
+		return RoleAdmin
+	}
+	return p.role
+}
+
+func (p apiPrincipal) allows(role string) bool {
+	return roleRank[p.roleName()] >= roleRank[role]
+}
+
+// name identifies the principal in logs and acknowledgements.
+func (p apiPrincipal) name() string {
+	switch {
+	case p.user != "":
+		return p.user
+	case p.tenant != "":
+		return "tenant:" + p.tenant
+	default:
+		return "device"
+	}
+}
+
+// requireRole refuses principals below role.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalOf(r)
+		if !p.allows(role) {
+			http.Error(w, "forbidden: needs the "+role+" role", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			slog.Info("API action", "component", "edge_api", "method", r.Method, "path", r.URL.Path,
+				"user", p.name(), "role", p.roleName())
+		}
+		h(w, r)
+	}
+}
+
+// writesRequire applies requireRole to everything but GET and HEAD.
+func writesRequire(role string, h http.HandlerFunc) http.HandlerFunc {
+	guarded := requireRole(role, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// apiToken is one provisioned user token.
+type apiToken struct {
+	userID  string
+	tenant  string
+	role    string
+	expires time.Time // zero = no expiry
+}
+
+// APITokenDirectory holds the cloud-provisioned user tokens.
+type APITokenDirectory struct {
+	mu       sync.RWMutex
+	tokens   map[string]apiToken // by hex SHA-256 of the token
+	local    *sql.DB
+	cloud    *CloudConnManager
+	deviceID string
+	interval time.Duration
+	logger   *slog.Logger
+}
+
+// NewAPITokenDirectory loads the cached tokens from the local cache.
+func NewAPITokenDirectory(c EdgeConfig, processor *EdgeProcessor) (*APITokenDirectory, error) {
+	interval := time.Duration(c.APITokenSyncSec) * time.Second
+	if interval <= 0 {
+		interval = defaultAPITokenSyncSec * time.Second
+	}
+	d := &APITokenDirectory{
+		tokens:   make(map[string]apiToken),
+		local:    processor.localDB,
+		cloud:    processor.cloud,
+		deviceID: processor.deviceID,
+		interval: interval,
+		logger:   slog.With("component", "api_tokens"),
+	}
+	if _, err := d.local.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			token_sha256 TEXT PRIMARY KEY,
+			user_id      TEXT NOT NULL,
+			tenant_id    TEXT,
+			role         TEXT NOT NULL,
+			expires_at   INTEGER
+		);
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create api_tokens: %v", err)
+	}
+	rows, err := d.local.Query(`SELECT token_sha256, user_id, COALESCE(tenant_id, ''), role, COALESCE(expires_at, 0) FROM api_tokens`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api_tokens: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		var t apiToken
+		var expires int64
+		if err := rows.Scan(&hash, &t.userID, &t.tenant, &t.role, &expires); err != nil {
+			return nil, fmt.Errorf("failed to load api_tokens: %v", err)
+		}
+		if expires > 0 {
+			t.expires = time.Unix(expires, 0)
+		}
+		d.tokens[hash] = t
+	}
+	return d, rows.Err()
+}
+
+// Run pulls the device's tokens from the cloud until the process exits.
+func (d *APITokenDirectory) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.sync(); err != nil {
+			d.logger.Warn("Token sync failed, using the cached tokens", "error", err, "tokens", d.count())
+		}
+		<-ticker.C
+	}
+}
+
+func (d *APITokenDirectory) count() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.tokens)
+}
+
+// sync replaces the cached tokens with the cloud's current set.
+func (d *APITokenDirectory) sync() error {
+	db := d.cloud.DB()
+	if db == nil {
+		return fmt.Errorf("cloud database offline")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTokenSyncTimeout)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.token_sha256, t.user_id::text, COALESCE(t.tenant_id, ''), t.role, t.expires_at
+		FROM edge_api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE (t.device_external_id IS NULL OR t.device_external_id = $1)
+		  AND t.revoked_at IS NULL
+		  AND (t.expires_at IS NULL OR t.expires_at > NOW())
+		  AND u.is_active
+	`, d.deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to query edge_api_tokens: %v", err)
+	}
+	defer rows.Close()
+	tokens := make(map[string]apiToken)
+	for rows.Next() {
+		var hash string
+		var t apiToken
+		var expires sql.NullTime
+		if err := rows.Scan(&hash, &t.userID, &t.tenant, &t.role, &expires); err != nil {
+			return fmt.Errorf("failed to read edge_api_tokens: %v", err)
+		}
+		if !validRole(t.role) || t.role == "" {
+			d.logger.Warn("Skipping token with unknown role", "user_id", t.userID, "role", t.role)
+			continue
+		}
+		if expires.Valid {
+			t.expires = expires.Time
+		}
+		tokens[hash] = t
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read edge_api_tokens: %v", err)
+	}
+
+	tx, err := d.local.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin token cache update: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM api_tokens`); err != nil {
+		return fmt.Errorf("failed to clear token cache: %v", err)
+	}
+	for hash, t := range tokens {
+		var expires interface{}
+		if !t.expires.IsZero() {
+			expires = t.expires.Unix()
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO api_tokens (token_sha256, user_id, tenant_id, role, expires_at) VALUES (?, ?, ?, ?, ?)
+		`, hash, t.userID, nullString(t.tenant), t.role, expires); err != nil {
+			return fmt.Errorf("failed to cache token: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit token cache: %v", err)
+	}
+
+	d.mu.Lock()
+	changed := len(tokens) != len(d.tokens)
+	d.tokens = tokens
+	d.mu.Unlock()
+	if changed {
+		d.logger.Info("Synced API tokens", "tokens", len(tokens))
+	}
+	return nil
+}
+
+// lookup returns the unexpired token matching a presented credential.
+func (d *APITokenDirectory) lookup(token string, now time.Time) (apiToken, bool) {
+	sum := sha256.Sum256([]byte(token))
+	d.mu.RLock()
+	t, ok := d.tokens[hex.EncodeToString(sum[:])]
+	d.mu.RUnlock()
+	if !ok || (!t.expires.IsZero() && now.After(t.expires)) {
+		return apiToken{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,203 @@
+// Attribution - how much each probe contributed to each grid cell
+// SourceSensors says which probes reached a cell; attribution says by how
+// much. For every cell the weights the root moisture interpolator gave its
+// neighbors are kept with the cycle (normalized to sum to 1, alongside each
+// probe's distance and root moisture), so "why does this corner say
+// critical?" is answered by the probes that actually pulled it there.
+//
+// Summed over the grid, a probe's weights are the number of cells' worth
+// of estimate it is responsible for. A probe whose share of the grid is
+// over overInfluenceFactor times an even share across the contributing
+// probes is flagged over_influential: it is carrying an area that probably
+// needs a second probe, and a fault in it skews the whole area.
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+)
+
+const (
+	overInfluenceFactor = 2.0
+	dominantWeight      = 0.5 // a probe dominates a cell at half the weight or more
+)
+
+// SampleWeighter is implemented by interpolators whose estimate is a
+// weighted mean of the samples; Weights returns them normalized.
+type SampleWeighter interface {
+	Weights(samples []NeighborSample) []float64
+}
+
+// Weights returns the normalized IDW weights; a probe on the cell takes all
+// of it.
+func (idw IDWInterpolator) Weights(samples []NeighborSample) []float64 {
+	weights := make([]float64, len(samples))
+	total := 0.0
+	for i, s := range samples {
+		if s.Distance == 0 {
+			for j := range weights {
+				weights[j] = 0
+			}
+			weights[i] = 1
+			return weights
+		}
+		weights[i] = 1.0 / math.Pow(s.Distance, idw.Power)
+		total += weights[i]
+	}
+	if total > 0 {
+		for i := range weights {
+			weights[i] /= total
+		}
+	}
+	return weights
+}
+
+// SensorContribution is one probe's part in a cell's estimate.
+type SensorContribution struct {
+	SensorID     string  `json:"sensor_id"`
+	Distance     float64 `json:"distance"` // metres (hops on logical grids)
+	Weight       float64 `json:"weight"`
+	MoistureRoot float64 `json:"moisture_root"`
+}
+
+// CellAttribution is one cell's estimate and where it came from, largest
+// contribution first.
+type CellAttribution struct {
+	GridID         string               `json:"grid_id"`
+	MoistureRoot   float64              `json:"moisture_root"`
+	WaterDeficit   float64              `json:"water_deficit_mm"`
+	IrrigationNeed string               `json:"irrigation_need"`
+	Sources        []SensorContribution `json:"sources"`
+}
+
+// SensorInfluence is one probe's reach over the latest grid.
+type SensorInfluence struct {
+	SensorID        string  `json:"sensor_id"`
+	Cells           int     `json:"cells"`          // cells it contributes to
+	DominantCells   int     `json:"dominant_cells"` // cells where its weight is 0.5 or more
+	WeightSum       float64 `json:"weight_sum"`     // cells' worth of estimate it accounts for
+	GridShare       float64 `json:"grid_share"`     // weight_sum over all attributed cells
+	MaxWeight       float64 `json:"max_weight"`
+	OverInfluential bool    `json:"over_influential"`
+}
+
+// attributeSources records each neighbor's share of the cell's root
+// moisture estimate.
+func (ep *EdgeProcessor) attributeSources(cell *VirtualGridPoint, neighbors []sensorNeighbor) {
+	var interp Interpolator = ep.idw()
+	var root *SensorVariable
+	for i, v := range sensorVariables {
+		if v.Name == VarMoistureRoot {
+			root = &sensorVariables[i]
+			if v.Interpolator != nil {
+				interp = v.Interpolator
+			}
+		}
+	}
+	weighter, ok := interp.(SampleWeighter)
+	if !ok || root == nil {
+		return // not a weighted mean; SourceSensors is all there is
+	}
+	samples := make([]NeighborSample, 0, len(neighbors))
+	classes := make([]string, 0, len(neighbors))
+	contributing := make([]sensorNeighbor, 0, len(neighbors))
+	for _, n := range neighbors {
+		if value, ok := root.Read(n.sensor); ok {
+			samples = append(samples, NeighborSample{Distance: n.distance, Value: value})
+			classes = append(classes, n.sensor.class)
+			contributing = append(contributing, n)
+		}
+	}
+	var weights []float64
+	if len(ep.config.SensorClasses) > 0 {
+		weights = ep.fusedWeights(orb.Point{cell.Longitude, cell.Latitude}, *root, weighter, samples, classes)
+	} else {
+		weights = weighter.Weights(samples)
+	}
+	cell.attribution = make([]SensorContribution, len(contributing))
+	for i, n := range contributing {
+		cell.attribution[i] = SensorContribution{
+			SensorID:     n.sensor.SensorID,
+			Distance:     n.distance,
+			Weight:       weights[i],
+			MoistureRoot: samples[i].Value,
+		}
+	}
+	sort.SliceStable(cell.attribution, func(i, j int) bool {
+		return cell.attribution[i].Weight > cell.attribution[j].Weight
+	})
+}
+
+// CellAttributions returns the latest grid's per-cell attribution, for
+// every cell or just gridID and/or the cells sensorID contributes to.
+func (ep *EdgeProcessor) CellAttributions(gridID, sensorID string) []CellAttribution {
+	cells := make([]CellAttribution, 0)
+	for _, p := range ep.LatestGrid() {
+		if gridID != "" && p.GridID != gridID {
+			continue
+		}
+		if sensorID != "" && !hasContribution(p.attribution, sensorID) {
+			continue
+		}
+		cells = append(cells, CellAttribution{
+			GridID:         p.GridID,
+			MoistureRoot:   p.MoistureRoot,
+			WaterDeficit:   p.WaterDeficit,
+			IrrigationNeed: p.IrrigationNeed,
+			Sources:        p.attribution,
+		})
+	}
+	return cells
+}
+
+func hasContribution(sources []SensorContribution, sensorID string) bool {
+	for _, c := range sources {
+		if c.SensorID == sensorID {
+			return true
+		}
+	}
+	return false
+}
+
+// SensorInfluences summarizes each probe's reach over the latest grid,
+// most influential first.
+func (ep *EdgeProcessor) SensorInfluences() []SensorInfluence {
+	bySensor := make(map[string]*SensorInfluence)
+	attributed := 0
+	for _, p := range ep.LatestGrid() {
+		if len(p.attribution) == 0 {
+			continue
+		}
+		attributed++
+		for _, c := range p.attribution {
+			inf := bySensor[c.SensorID]
+			if inf == nil {
+				inf = &SensorInfluence{SensorID: c.SensorID}
+				bySensor[c.SensorID] = inf
+			}
+			inf.Cells++
+			inf.WeightSum += c.Weight
+			inf.MaxWeight = math.Max(inf.MaxWeight, c.Weight)
+			if c.Weight >= dominantWeight {
+				inf.DominantCells++
+			}
+		}
+	}
+
+	influences := make([]SensorInfluence, 0, len(bySensor))
+	for _, inf := range bySensor {
+		inf.GridShare = inf.WeightSum / float64(attributed)
+		inf.OverInfluential = len(bySensor) > 1 && inf.GridShare > overInfluenceFactor/float64(len(bySensor))
+		influences = append(influences, *inf)
+	}
+	sort.Slice(influences, func(i, j int) bool {
+		if influences[i].WeightSum != influences[j].WeightSum {
+			return influences[i].WeightSum > influences[j].WeightSum
+		}
+		return influences[i].SensorID < influences[j].SensorID
+	})
+	return influences
+}
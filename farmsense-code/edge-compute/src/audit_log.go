@@ -0,0 +1,347 @@
+// Audit Log - who changed what on the device, for water-district reporting
+// Every change that affects how water is managed is appended to the local
+// audit_log table with when it happened, who did it, and its before and
+// after values:
+//
+//	config     a config reload: the settings that changed, old and new.
+//	           The actor is the API user behind PUT /config, config_file
+//	           for an edit on disk, or remote_config:<version> for the
+//	           control-plane overlay. Secrets (database_url,
+//	           mqtt_password, api_keys, api_tenant_keys) appear only as a
+//	           short fingerprint, so a change shows without its value.
+//	command    a fleet command (actor device_commands.created_by) or a
+//	           POST /commands (the API user), with its params and outcome
+//	actuation  an irrigation run changing state: a controller's report
+//	           (scheduled, running, completed, cancelled) or a pulse meter
+//	           starting or completing a run. The device doesn't drive
+//	           valves itself; these are the actuations it is told about
+//	           or measures.
+//	alert_ack  the first acknowledgement of an alert
+//
+// The table is append-only: triggers refuse UPDATE and DELETE, and no
+// retention setting prunes it. Entries are uploaded to the cloud
+// audit_log table (migration 035) oldest first by a watermark in
+// sync_state; the cloud table refuses changes too, and re-sent entries are
+// ignored. GET /audit lists the field's entries.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Audit kinds
+const (
+	AuditConfig    = "config"
+	AuditCommand   = "command"
+	AuditActuation = "actuation"
+	AuditAlertAck  = "alert_ack"
+)
+
+const (
+	auditSyncBatch       = 1000
+	defaultAuditLimit    = 500
+	maxAuditLimit        = 5000
+	defaultAuditLookback = 30 * 24 * time.Hour
+)
+
+// auditSecretKeys are config settings recorded only as a fingerprint.
+var auditSecretKeys = []string{"database_url", "mqtt_password", "api_keys", "api_tenant_keys"}
+
+// AuditEntry is one recorded change.
+type AuditEntry struct {
+	ID      int64           `json:"id"`
+	FieldID string          `json:"field_id"`
+	At      time.Time       `json:"at"`
+	Kind    string          `json:"kind"`
+	Actor   string          `json:"actor"`
+	Action  string          `json:"action"`
+	Subject string          `json:"subject,omitempty"` // the command, zone run or alert acted on
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+}
+
+func initAuditSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			field_id TEXT    NOT NULL,
+			at       INTEGER NOT NULL,
+			kind     TEXT    NOT NULL,
+			actor    TEXT    NOT NULL,
+			action   TEXT    NOT NULL,
+			subject  TEXT    NOT NULL DEFAULT '',
+			before   TEXT,
+			after    TEXT
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_field_at ON audit_log (field_id, at);
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+	`)
+	return err
+}
+
+// appendAudit records an entry; before and after are encoded as JSON.
+func appendAudit(db *sql.DB, e AuditEntry, before, after interface{}) error {
+	enc := func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+	b, err := enc(before)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	a, err := enc(after)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO audit_log (field_id, at, kind, actor, action, subject, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, e.FieldID, e.At.UnixMilli(), e.Kind, e.Actor, e.Action, e.Subject, b, a); err != nil {
+		return fmt.Errorf("failed to append audit entry: %v", err)
+	}
+	return nil
+}
+
+// audit records an entry for the field now, logging when it can't.
+func (ep *EdgeProcessor) audit(kind, actor, action, subject string, before, after interface{}) {
+	e := AuditEntry{FieldID: ep.config.FieldID, At: time.Now(), Kind: kind, Actor: actor, Action: action, Subject: subject}
+	if err := appendAudit(ep.localDB, e, before, after); err != nil {
+		ep.logger.Error("Audit entry lost", "component", "audit", "kind", kind, "actor", actor, "action", action, "error", err)
+	}
+}
+
+// auditConfigFields is a config's settings by JSON key, secrets replaced
+// by a fingerprint.
+func auditConfigFields(c EdgeConfig) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, key := range auditSecretKeys {
+		raw, ok := fields[key]
+		if !ok || bytes.Equal(raw, []byte(`""`)) || bytes.Equal(raw, []byte("null")) || bytes.Equal(raw, []byte("[]")) {
+			continue
+		}
+		sum := sha256.Sum256(raw)
+		fields[key], _ = json.Marshal(fmt.Sprintf("(redacted %x)", sum[:4]))
+	}
+	return fields, nil
+}
+
+// auditConfigChange records the settings that differ between two configs.
+func (ep *EdgeProcessor) auditConfigChange(actor string, old, updated EdgeConfig) {
+	before, err := auditConfigFields(old)
+	if err != nil {
+		ep.logger.Error("Audit entry lost", "component", "audit", "kind", AuditConfig, "actor", actor, "error", err)
+		return
+	}
+	after, err := auditConfigFields(updated)
+	if err != nil {
+		ep.logger.Error("Audit entry lost", "component", "audit", "kind", AuditConfig, "actor", actor, "error", err)
+		return
+	}
+	// A setting left out by omitempty reads as null on that side
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			after[key] = json.RawMessage("null")
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			before[key] = json.RawMessage("null")
+		}
+	}
+	for key, v := range after {
+		if bytes.Equal(before[key], v) {
+			delete(before, key)
+			delete(after, key)
+		}
+	}
+	if len(after) > 0 {
+		ep.audit(AuditConfig, actor, "reload", "", before, after)
+	}
+}
+
+// auditCommand records a command's params and outcome.
+func (ep *EdgeProcessor) auditCommand(cmd FleetCommand, result error) {
+	actor, subject := cmd.CreatedBy, ""
+	if cmd.ID > 0 {
+		subject = fmt.Sprintf("device_command:%d", cmd.ID)
+		if actor == "" {
+			actor = "fleet"
+		}
+	}
+	after := map[string]interface{}{"status": "done"}
+	if len(cmd.Params) > 0 {
+		after["params"] = cmd.Params
+	}
+	if result != nil {
+		after["status"], after["error"] = "failed", result.Error()
+	}
+	ep.audit(AuditCommand, actor, cmd.Command, subject, nil, after)
+}
+
+// auditAlertAck records an alert's first acknowledgement.
+func (ep *EdgeProcessor) auditAlertAck(a Alert) {
+	ep.audit(AuditAlertAck, a.AcknowledgedBy, "acknowledge", "alert:"+a.ID,
+		map[string]interface{}{"acknowledged_at": nil},
+		map[string]interface{}{"acknowledged_at": a.AcknowledgedAt, "acknowledged_by": a.AcknowledgedBy})
+}
+
+// auditRun records an irrigation run moving from state before ("" for a
+// new run) to its current state.
+func (in *IrrigationIngestor) auditRun(actor string, e IrrigationEvent, before string, at time.Time) {
+	var prev interface{}
+	if before != "" {
+		prev = map[string]interface{}{"state": before}
+	}
+	entry := AuditEntry{FieldID: e.FieldID, At: at, Kind: AuditActuation, Actor: actor,
+		Action: e.State, Subject: fmt.Sprintf("zone:%s run:%s", e.ZoneID, e.EventID)}
+	after := map[string]interface{}{"state": e.State, "started_at": e.StartedAt, "ended_at": e.EndedAt}
+	if e.VolumeL > 0 {
+		after["volume_l"] = e.VolumeL
+	}
+	if e.AppliedMM > 0 {
+		after["applied_mm"] = e.AppliedMM
+	}
+	if err := appendAudit(in.localDB, entry, prev, after); err != nil {
+		in.logger.Error("Audit entry lost", "kind", AuditActuation, "actor", actor, "error", err)
+	}
+}
+
+// storedRunState is a run's state in the local cache, "" when new.
+func storedRunState(db *sql.DB, fieldID, eventID string) (string, error) {
+	var state string
+	err := db.QueryRow(`SELECT state FROM irrigation_events WHERE field_id = ? AND event_id = ?`, fieldID, eventID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return state, err
+}
+
+// AuditLog returns the field's entries in [from, to) after afterID,
+// oldest first; kind filters when set.
+func (ep *EdgeProcessor) AuditLog(from, to time.Time, kind string, afterID int64, limit int) ([]AuditEntry, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT id, at, kind, actor, action, subject, COALESCE(before, ''), COALESCE(after, '')
+		FROM audit_log
+		WHERE field_id = ? AND at >= ? AND at < ? AND id > ? AND (? = '' OR kind = ?)
+		ORDER BY id
+		LIMIT ?
+	`, ep.config.FieldID, from.UnixMilli(), to.UnixMilli(), afterID, kind, kind, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer rows.Close()
+	return scanAuditEntries(rows, ep.config.FieldID)
+}
+
+func scanAuditEntries(rows *sql.Rows, fieldID string) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		e := AuditEntry{FieldID: fieldID}
+		var at int64
+		var before, after string
+		if err := rows.Scan(&e.ID, &at, &e.Kind, &e.Actor, &e.Action, &e.Subject, &before, &after); err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %v", err)
+		}
+		e.At = time.UnixMilli(at).UTC()
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (ep *EdgeProcessor) auditWatermarkKey() string {
+	return "audit_log:" + ep.config.FieldID
+}
+
+// syncAuditLog uploads entries past the watermark, a batch per sync.
+func (ep *EdgeProcessor) syncAuditLog() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	var mark int64
+	err := ep.localDB.QueryRow(`SELECT value FROM sync_state WHERE name = ?`, ep.auditWatermarkKey()).Scan(&mark)
+	if err != nil && err != sql.ErrNoRows {
+		ep.cycleLog.Error("Failed to read audit watermark", "component", "audit", "error", err)
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT id, at, kind, actor, action, subject, COALESCE(before, ''), COALESCE(after, '')
+		FROM audit_log WHERE field_id = ? AND id > ? ORDER BY id LIMIT ?
+	`, ep.config.FieldID, mark, auditSyncBatch)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read audit log", "component", "audit", "error", err)
+		return
+	}
+	entries, err := scanAuditEntries(rows, ep.config.FieldID)
+	rows.Close()
+	if err != nil {
+		ep.cycleLog.Error("Failed to read audit log", "component", "audit", "error", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	defer tx.Rollback()
+	jsonOrNil := func(raw json.RawMessage) interface{} {
+		if len(raw) == 0 {
+			return nil
+		}
+		return string(raw)
+	}
+	for _, e := range entries {
+		if _, err := tx.Exec(`
+			INSERT INTO audit_log
+				(edge_device_id, field_id, local_id, occurred_at, kind, actor, action, subject, before, after)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::jsonb, $10::jsonb)
+			ON CONFLICT (edge_device_id, field_id, local_id) DO NOTHING
+		`, ep.deviceID, e.FieldID, e.ID, e.At, e.Kind, e.Actor, e.Action, e.Subject,
+			jsonOrNil(e.Before), jsonOrNil(e.After)); err != nil {
+			ep.cycleLog.Warn("Audit upload failed, retrying next sync", "component", "audit", "error", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	last := entries[len(entries)-1].ID
+	if _, err := ep.localDB.Exec(`INSERT OR REPLACE INTO sync_state (name, value) VALUES (?, ?)`,
+		ep.auditWatermarkKey(), last); err != nil {
+		ep.cycleLog.Warn("Failed to advance audit watermark", "component", "audit", "error", err)
+	}
+	ep.cycleLog.Info("Synced audit log", "component", "audit", "entries", len(entries))
+}
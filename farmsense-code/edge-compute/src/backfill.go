@@ -0,0 +1,369 @@
+// Backfill - recompute grids for a historical window
+// After a bad probe calibration or a wrong soil/crop setting is fixed, the
+// history computed with it stays wrong. A backfill replays the stored
+// sensor readings of a past time range through the current configuration
+// and regenerates the grid for each cycle in it: the local grid_history
+// and zone_stats rows for those timestamps are replaced, and the new cells
+// and zone stats are uploaded tagged computation_mode "..._recompute".
+//
+// Cycles are taken from the timestamps already in grid_history, so the
+// corrected history lines up with the original one; a range with no
+// history (or an explicit step) is walked every step instead. One job runs
+// at a time, one cycle per main-loop iteration, so live cycles keep their
+// schedule while it runs. Recomputed cycles don't touch the live grid,
+// the trafficability summary or the delta-sync baseline.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	backfillSensorWindow = 15 * time.Minute // same window as a live cycle
+	maxBackfillCycles    = 20000
+)
+
+// Backfill job states
+const (
+	BackfillQueued  = "queued"
+	BackfillRunning = "running"
+	BackfillDone    = "done"
+	BackfillFailed  = "failed"
+)
+
+var errBackfillRunning = errors.New("a backfill is already in progress")
+
+// BackfillRequest is a historical window to recompute. Step 0 means reuse
+// the cycle timestamps recorded in grid_history; Cycles, when set, are
+// the exact timestamps to recompute (late readings, late_readings.go).
+type BackfillRequest struct {
+	From   time.Time
+	To     time.Time
+	Step   time.Duration
+	Cycles []time.Time
+}
+
+// BackfillStatus is a job's progress as reported by the API.
+type BackfillStatus struct {
+	ID            string     `json:"id"`
+	From          time.Time  `json:"from"`
+	To            time.Time  `json:"to"`
+	Step          string     `json:"step,omitempty"`
+	Status        string     `json:"status"`
+	Cycles        int        `json:"cycles"`
+	Done          int        `json:"done"`
+	Skipped       int        `json:"skipped"` // too few sensors at that time
+	UploadsFailed int        `json:"uploads_failed"`
+	Points        int        `json:"points"`
+	Error         string     `json:"error,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+// backfillJob is a job on the main loop.
+type backfillJob struct {
+	req    BackfillRequest
+	status BackfillStatus
+	cycles []time.Time
+	next   int
+}
+
+// readyNow is always ready to receive, to run one backfill cycle per
+// main-loop iteration.
+var readyNow = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func (r BackfillRequest) validate() error {
+	if r.From.IsZero() || r.To.IsZero() {
+		return fmt.Errorf("from and to are required")
+	}
+	if !r.To.After(r.From) && (len(r.Cycles) == 0 || r.To.Before(r.From)) {
+		return fmt.Errorf("to must be after from")
+	}
+	if r.Step < 0 {
+		return fmt.Errorf("step must not be negative")
+	}
+	return nil
+}
+
+// StartBackfill queues a job for the main loop. Safe to call from any
+// goroutine; fails while another job is queued or running.
+func (ep *EdgeProcessor) StartBackfill(req BackfillRequest) (BackfillStatus, error) {
+	if err := req.validate(); err != nil {
+		return BackfillStatus{}, err
+	}
+
+	ep.stateMu.Lock()
+	defer ep.stateMu.Unlock()
+	if s := ep.backfillStatus; s != nil && (s.Status == BackfillQueued || s.Status == BackfillRunning) {
+		return *s, errBackfillRunning
+	}
+	job := newBackfillJob(req)
+	status := job.status
+	ep.backfillStatus = &status
+	ep.backfillRequests <- job // buffered; at most one job is ever pending
+	return status, nil
+}
+
+func newBackfillJob(req BackfillRequest) *backfillJob {
+	status := BackfillStatus{
+		ID:        newCycleID(),
+		From:      req.From.UTC(),
+		To:        req.To.UTC(),
+		Status:    BackfillQueued,
+		StartedAt: time.Now().UTC(),
+	}
+	if req.Step > 0 {
+		status.Step = req.Step.String()
+	}
+	return &backfillJob{req: req, status: status}
+}
+
+// BackfillStatus returns the latest job's progress, or nil before any.
+func (ep *EdgeProcessor) BackfillStatus() *BackfillStatus {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	if ep.backfillStatus == nil {
+		return nil
+	}
+	s := *ep.backfillStatus
+	return &s
+}
+
+// RunBackfill runs a job to completion on the calling goroutine, for the
+// command-line mode where the main loop isn't running.
+func (ep *EdgeProcessor) RunBackfill(req BackfillRequest) (BackfillStatus, error) {
+	if err := req.validate(); err != nil {
+		return BackfillStatus{}, err
+	}
+	ep.beginBackfill(newBackfillJob(req))
+	for ep.backfill != nil {
+		ep.stepBackfill()
+	}
+	status := *ep.BackfillStatus()
+	if status.Status == BackfillFailed {
+		return status, fmt.Errorf("%s", status.Error)
+	}
+	return status, nil
+}
+
+// beginBackfill resolves the job's cycles and makes it the active job.
+func (ep *EdgeProcessor) beginBackfill(job *backfillJob) {
+	cycles, err := ep.backfillCycles(job.req)
+	if err != nil {
+		job.status.Status = BackfillFailed
+		job.status.Error = err.Error()
+		now := time.Now().UTC()
+		job.status.FinishedAt = &now
+		ep.publishBackfill(job)
+		ep.logger.Error("Backfill not started", "component", "backfill", "backfill_id", job.status.ID, "error", err)
+		return
+	}
+	job.cycles = cycles
+	job.status.Cycles = len(cycles)
+	job.status.Status = BackfillRunning
+	ep.backfill = job
+	ep.publishBackfill(job)
+	ep.logger.Info("Backfill started", "component", "backfill", "backfill_id", job.status.ID,
+		"from", job.status.From, "to", job.status.To, "cycles", len(cycles))
+}
+
+// stepBackfill recomputes the active job's next cycle.
+func (ep *EdgeProcessor) stepBackfill() {
+	job := ep.backfill
+	if job == nil {
+		return
+	}
+	if job.next >= len(job.cycles) {
+		job.status.Status = BackfillDone
+		now := time.Now().UTC()
+		job.status.FinishedAt = &now
+		ep.backfill = nil
+		ep.publishBackfill(job)
+		ep.logger.Info("Backfill complete", "component", "backfill", "backfill_id", job.status.ID,
+			"done", job.status.Done, "skipped", job.status.Skipped, "uploads_failed", job.status.UploadsFailed)
+		return
+	}
+
+	at := job.cycles[job.next]
+	job.next++
+	points, uploaded, err := ep.recomputeAt(job.status.ID, at)
+	switch {
+	case errors.Is(err, errInsufficientSensors):
+		job.status.Skipped++
+	case err != nil:
+		job.status.Status = BackfillFailed
+		job.status.Error = fmt.Sprintf("cycle %s: %v", at.Format(time.RFC3339), err)
+		now := time.Now().UTC()
+		job.status.FinishedAt = &now
+		ep.backfill = nil
+		ep.logger.Error("Backfill failed", "component", "backfill", "backfill_id", job.status.ID, "at", at, "error", err)
+	default:
+		job.status.Done++
+		job.status.Points += points
+		if !uploaded {
+			job.status.UploadsFailed++
+		}
+	}
+	ep.publishBackfill(job)
+}
+
+func (ep *EdgeProcessor) publishBackfill(job *backfillJob) {
+	status := job.status
+	ep.stateMu.Lock()
+	ep.backfillStatus = &status
+	ep.stateMu.Unlock()
+}
+
+// backfillCycles lists the timestamps to recompute in [from, to].
+func (ep *EdgeProcessor) backfillCycles(req BackfillRequest) ([]time.Time, error) {
+	if len(req.Cycles) > 0 {
+		return req.Cycles, nil
+	}
+	if req.Step == 0 {
+		cycles, err := ep.historyTimestamps(req.From, req.To)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read grid history: %v", err)
+		}
+		if len(cycles) > 0 {
+			return cycles, nil
+		}
+		req.Step = time.Duration(ep.config.ComputeInterval) * time.Second
+	}
+	if n := req.To.Sub(req.From) / req.Step; n >= maxBackfillCycles {
+		return nil, fmt.Errorf("window needs %d cycles at step %s (max %d)", n+1, req.Step, maxBackfillCycles)
+	}
+	cycles := make([]time.Time, 0)
+	for at := req.From; !at.After(req.To); at = at.Add(req.Step) {
+		cycles = append(cycles, at.UTC())
+	}
+	return cycles, nil
+}
+
+// historyTimestamps returns the distinct cycle timestamps recorded locally.
+func (ep *EdgeProcessor) historyTimestamps(from, to time.Time) ([]time.Time, error) {
+	rows, err := ep.localDB.Query(fmt.Sprintf(`
+		SELECT DISTINCT timestamp FROM %s
+		WHERE field_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp
+		LIMIT ?
+	`, ep.historyTable()), ep.config.FieldID, from.Unix(), to.Unix(), maxBackfillCycles+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cycles := make([]time.Time, 0)
+	for rows.Next() {
+		var ts int64
+		if err := rows.Scan(&ts); err != nil {
+			return nil, err
+		}
+		cycles = append(cycles, time.Unix(ts, 0).UTC())
+	}
+	if len(cycles) > maxBackfillCycles {
+		return nil, fmt.Errorf("window has more than %d recorded cycles", maxBackfillCycles)
+	}
+	return cycles, rows.Err()
+}
+
+var errInsufficientSensors = errors.New("insufficient sensors")
+
+// recomputeAt regenerates the grid as of at from the readings stored for
+// the preceding sensor window. Returns the cell count and whether the
+// cloud upload went through (false when offline or it failed).
+func (ep *EdgeProcessor) recomputeAt(jobID string, at time.Time) (int, bool, error) {
+	ep.cycleLog = ep.logger.With("cycle_id", newCycleID(), "cycle", "backfill", "backfill_id", jobID)
+	liveCrop := ep.cycleCrop
+	defer func() {
+		ep.cycleLog = ep.logger
+		ep.cycleCrop = liveCrop
+	}()
+
+	ep.readingMark = ep.localReadingMark()
+	sensors, err := ep.fetchSensorsBetween(at.Add(-backfillSensorWindow), at)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to fetch readings: %v", err)
+	}
+	sensors = ep.excludeMisinstalledSensors(sensors)
+	ep.normalizeReadings(sensors)
+	if len(sensors) < ep.config.MinSensors {
+		ep.cycleLog.Debug("Skipping backfill cycle", "at", at, "sensors", len(sensors), "min_sensors", ep.config.MinSensors)
+		return 0, false, errInsufficientSensors
+	}
+
+	ep.cycleCrop = ep.cropDayAt(at)
+	points := ep.interpolateField(sensors)
+	points = ep.applyExtrapolationGuard(points, sensors)
+	ep.applyConfidenceGate(points)
+	ep.applyQualityFlags(points, sensors, at)
+	ep.applySalinity(points)
+	ep.applyTrendLayers(points, at)
+	ep.applyMoistureContext(points, at)
+	ep.applyLifecycle(points, at)
+	configVersion := ep.remoteConfig.VersionTag()
+	for i := range points {
+		points[i].Timestamp = at
+		points[i].ConfigVersion = configVersion
+		points[i].ComputationMode += "_recompute"
+	}
+	ep.stampBatch(points, BatchKindBackfill, at)
+	if ep.config.LogicalGrid == nil {
+		ep.scoreTrafficability(points, at) // per-cell index only; the live summary stays
+	}
+
+	if err := ep.replaceTrendHistory(at, points); err != nil {
+		ep.abandonBatches(batchIDs(points))
+		return 0, false, err
+	}
+	ep.forgetDailyMoisture(at)
+
+	var zoneStats []ZoneStats
+	if ep.zones != nil {
+		zoneStats = ep.zones.Aggregate(points, at, ep.classifyIrrigationNeed)
+		if err := ep.replaceZoneStatsLocal(at, zoneStats); err != nil {
+			return 0, false, err
+		}
+	}
+
+	uploaded := false
+	if ep.store.Available() {
+		if err := ep.storeCloud(points); err != nil {
+			ep.cycleLog.Warn("Backfill upload failed", "component", "backfill", "at", at, "error", err)
+			ep.cloud.ReportFailure(err)
+		} else {
+			uploaded = true
+		}
+	}
+	ep.syncZoneStats(zoneStats) // queued like live stats while offline
+
+	ep.cycleLog.Debug("Recomputed cycle", "component", "backfill", "at", at, "points", len(points), "sensors", len(sensors))
+	return len(points), uploaded, nil
+}
+
+// replaceTrendHistory swaps the local history of one cycle for points.
+func (ep *EdgeProcessor) replaceTrendHistory(at time.Time, points []VirtualGridPoint) error {
+	if ep.packedHistory() {
+		return ep.replacePackedCycle(historyCycleOf(at, points))
+	}
+	return ep.writeHistoryRows(points, &at) // old and new cycle swap in one transaction
+}
+
+// replaceZoneStatsLocal swaps the local zone stats of one cycle, dropping
+// zones that no longer have cells.
+func (ep *EdgeProcessor) replaceZoneStatsLocal(at time.Time, stats []ZoneStats) error {
+	if _, err := ep.localDB.Exec(`DELETE FROM zone_stats WHERE field_id = ? AND timestamp = ?`,
+		ep.config.FieldID, at.Unix()); err != nil {
+		return fmt.Errorf("failed to clear zone stats: %v", err)
+	}
+	if err := ep.storeZoneStatsLocal(stats); err != nil {
+		return fmt.Errorf("failed to store zone stats: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,634 @@
+// Cache Encryption - SQLCipher at rest for the local cache
+// Gateways sit in unlocked pump houses, and the local cache holds every
+// reading, grid and credential-free record a thief would want. With
+// local_cache_encryption=sqlcipher the cache is opened through SQLCipher
+// (sqlite_sqlcipher.go; build with -tags sqlcipher and cgo) under a
+// random 256-bit raw key, so the file, its journal and any copy of the
+// card are unreadable without it. The key comes from local_cache_key_source:
+//
+//	tpm    sealed in the board's TPM at persistent handle
+//	       local_cache_tpm_handle (default 0x81010010) through tpm2-tools;
+//	       generated and sealed on first start, so it never touches disk
+//	       and a card moved to another board can't be opened
+//	cloud  escrowed in edge_cache_keys (migration 038) under the device
+//	       ID; generated and uploaded on first start and fetched on every
+//	       one after, so a gateway can't open its cache, and waits,
+//	       retrying, until the cloud answers
+//	env    FARMSENSE_LOCAL_CACHE_KEY, 64 hex digits, for sites that
+//	       provision secrets through their service manager
+//
+// An existing plaintext cache is encrypted in place on the first start
+// with encryption on (sqlcipher_export into a new file that replaces it).
+// A cache that is encrypted while encryption is off is refused rather
+// than opened as an empty database.
+//
+// Rotation is staged and applied at start. rotate-cache-key seals a new
+// key at local_cache_tpm_handle+1 (tpm) or adds a pending row (cloud);
+// with env, set FARMSENSE_LOCAL_CACHE_NEW_KEY. On the next start the cache
+// is opened with the current key, re-encrypted with PRAGMA rekey, and the
+// pending key becomes current (the old TPM handle is evicted, the old
+// cloud row retired). A start interrupted between the rekey and the
+// promotion finds the current key refused and the pending one accepted,
+// and finishes the promotion. After an env rotation, move the new key to
+// FARMSENSE_LOCAL_CACHE_KEY and drop FARMSENSE_LOCAL_CACHE_NEW_KEY.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache encryption modes and key sources
+const (
+	CacheEncryptionOff       = "off"
+	CacheEncryptionSQLCipher = "sqlcipher"
+
+	CacheKeyTPM   = "tpm"
+	CacheKeyCloud = "cloud"
+	CacheKeyEnv   = "env"
+)
+
+const (
+	cacheKeyBytes          = 32
+	defaultCacheTPMHandle  = 0x81010010
+	cacheKeyCloudTimeout   = 30 * time.Second
+	cacheKeyCloudMaxWait   = 5 * time.Minute // cap on the retry backoff
+	sqlitePlaintextHeader  = "SQLite format 3\x00"
+	cacheEncryptingSuffix  = ".encrypting"
+	cacheKeyStateActive    = "active"
+	cacheKeyStatePending   = "pending"
+	cacheKeyStateRetired   = "retired"
+	tpmPersistentHandleMin = 0x81000000
+	tpmPersistentHandleMax = 0x81FFFFFF
+)
+
+// cacheKeyStore holds the cache key and a staged replacement.
+type cacheKeyStore interface {
+	Name() string
+	Current() ([]byte, error) // nil when there is none yet
+	Pending() ([]byte, error) // nil when no rotation is staged
+	Create() ([]byte, error)  // generates and stores the first key
+	Stage() ([]byte, error)   // generates and stages a replacement
+	Promote() error           // the staged key becomes current
+	Close()
+}
+
+func (c EdgeConfig) cacheEncrypted() bool {
+	return c.LocalCacheEncryption == CacheEncryptionSQLCipher
+}
+
+// checkCacheEncryption validates the encryption settings for this build.
+func checkCacheEncryption(c EdgeConfig) error {
+	switch c.LocalCacheEncryption {
+	case "", CacheEncryptionOff:
+		return nil
+	case CacheEncryptionSQLCipher:
+	default:
+		return fmt.Errorf("local_cache_encryption must be off or sqlcipher (got %q)", c.LocalCacheEncryption)
+	}
+	name, err := resolveLocalDriver(c.LocalCacheDriver)
+	if err != nil {
+		return err
+	}
+	if localDrivers[name].keyedDSN == nil {
+		return fmt.Errorf("local_cache_encryption=sqlcipher needs the sqlcipher driver (build with -tags sqlcipher), not %s", name)
+	}
+	switch c.LocalCacheKeySource {
+	case CacheKeyTPM:
+		if _, err := c.cacheTPMHandle(); err != nil {
+			return err
+		}
+	case CacheKeyCloud:
+		if c.DatabaseURL == "" {
+			return fmt.Errorf("local_cache_key_source=cloud needs database_url")
+		}
+	case CacheKeyEnv:
+		if _, err := parseCacheKey(c.LocalCacheKey); err != nil {
+			return fmt.Errorf("FARMSENSE_LOCAL_CACHE_KEY: %v", err)
+		}
+		if c.LocalCacheNewKey != "" {
+			if _, err := parseCacheKey(c.LocalCacheNewKey); err != nil {
+				return fmt.Errorf("FARMSENSE_LOCAL_CACHE_NEW_KEY: %v", err)
+			}
+		}
+	default:
+		return fmt.Errorf("local_cache_key_source must be tpm, cloud or env (got %q)", c.LocalCacheKeySource)
+	}
+	return nil
+}
+
+func parseCacheKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != cacheKeyBytes {
+		return nil, fmt.Errorf("want %d hex digits", 2*cacheKeyBytes)
+	}
+	return key, nil
+}
+
+func newCacheKey() ([]byte, error) {
+	key := make([]byte, cacheKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate cache key: %v", err)
+	}
+	return key, nil
+}
+
+// newCacheKeyStore returns the configured key source.
+func newCacheKeyStore(c EdgeConfig, deviceID string) (cacheKeyStore, error) {
+	switch c.LocalCacheKeySource {
+	case CacheKeyTPM:
+		handle, err := c.cacheTPMHandle()
+		if err != nil {
+			return nil, err
+		}
+		return &tpmKeyStore{handle: handle}, nil
+	case CacheKeyCloud:
+		return &cloudKeyStore{config: c, deviceID: deviceID}, nil
+	case CacheKeyEnv:
+		return &envKeyStore{current: c.LocalCacheKey, pending: c.LocalCacheNewKey}, nil
+	}
+	return nil, fmt.Errorf("unknown local_cache_key_source %q", c.LocalCacheKeySource)
+}
+
+// cacheFileState reports whether path exists and holds a plaintext
+// SQLite database (false for an empty or encrypted file).
+func cacheFileState(path string) (exists, plaintext bool, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(sqlitePlaintextHeader))
+	n, _ := f.Read(header)
+	if n == 0 {
+		return false, false, nil // an empty file is a new database either way
+	}
+	return true, n == len(header) && string(header) == sqlitePlaintextHeader, nil
+}
+
+// openEncryptedCache opens the cache with its key, creating the key,
+// encrypting a plaintext cache and applying a staged rotation first as
+// needed.
+func openEncryptedCache(config EdgeConfig, deviceID string, d localDriver) (*sql.DB, error) {
+	path := config.LocalCacheDB
+	logger := slog.With("component", "cache_encryption", "path", path)
+	store, err := newCacheKeyStore(config, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	exists, plaintext, err := cacheFileState(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local cache: %v", err)
+	}
+
+	key, err := store.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache key from %s: %v", store.Name(), err)
+	}
+	pending, err := store.Pending()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load staged cache key from %s: %v", store.Name(), err)
+	}
+	if key == nil && pending != nil {
+		// A promotion dropped the old key and stopped: the cache is
+		// already under the staged one
+		if err := store.Promote(); err != nil {
+			return nil, fmt.Errorf("failed to promote staged cache key in %s: %v", store.Name(), err)
+		}
+		key, pending = pending, nil
+	}
+	if key == nil {
+		if exists && !plaintext {
+			return nil, fmt.Errorf("local cache is encrypted but %s has no key for it", store.Name())
+		}
+		if key, err = store.Create(); err != nil {
+			return nil, fmt.Errorf("failed to create cache key in %s: %v", store.Name(), err)
+		}
+		logger.Info("Cache key created", "source", store.Name())
+	}
+	if plaintext {
+		if err := encryptPlaintextCache(d, path, key); err != nil {
+			return nil, fmt.Errorf("failed to encrypt local cache: %v", err)
+		}
+		logger.Info("Plaintext local cache encrypted", "source", store.Name())
+	}
+
+	if pending != nil {
+		if key, err = rotateCacheKey(d, path, store, key, pending); err != nil {
+			return nil, err
+		}
+		logger.Info("Local cache re-encrypted with the staged key", "source", store.Name())
+	}
+
+	db, err := sql.Open(d.sqlName, d.keyedDSN(path, key))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCacheKey(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("local cache rejected the key from %s: %v", store.Name(), err)
+	}
+	return db, nil
+}
+
+// verifyCacheKey reads the schema, which fails under a wrong key.
+func verifyCacheKey(db *sql.DB) error {
+	var n int
+	return db.QueryRow(`SELECT count(*) FROM sqlite_master`).Scan(&n)
+}
+
+// rotateCacheKey re-encrypts the cache from key to next and promotes
+// next, returning the key the cache is now under.
+func rotateCacheKey(d localDriver, path string, store cacheKeyStore, key, next []byte) ([]byte, error) {
+	db, err := sql.Open(d.sqlName, d.keyedDSN(path, key))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if verifyCacheKey(db) != nil {
+		// Rekeyed before an interrupted promotion?
+		db2, err := sql.Open(d.sqlName, d.keyedDSN(path, next))
+		if err != nil {
+			return nil, err
+		}
+		defer db2.Close()
+		if err := verifyCacheKey(db2); err != nil {
+			return nil, fmt.Errorf("local cache rejected both the current and the staged key")
+		}
+	} else {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.ExecContext(context.Background(), `PRAGMA rekey = "x'`+hex.EncodeToString(next)+`'"`)
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt local cache: %v", err)
+		}
+	}
+	if err := store.Promote(); err != nil {
+		return nil, fmt.Errorf("local cache re-encrypted but the key was not promoted in %s: %v", store.Name(), err)
+	}
+	return next, nil
+}
+
+// encryptPlaintextCache copies a plaintext cache into an encrypted one
+// and swaps it in, removing the plaintext journal.
+func encryptPlaintextCache(d localDriver, path string, key []byte) error {
+	tmp := path + cacheEncryptingSuffix
+	os.Remove(tmp)
+	db, err := sql.Open(d.sqlName, d.dsn(path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	var version int
+	if err := conn.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS encrypted KEY ?`, tmp, "x'"+hex.EncodeToString(key)+"'"); err != nil {
+		return fmt.Errorf("failed to create encrypted copy: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT sqlcipher_export('encrypted')`); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to export into encrypted copy: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, `PRAGMA encrypted.user_version = `+strconv.Itoa(version)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `DETACH DATABASE encrypted`); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	conn.Close()
+	db.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace plaintext cache: %v", err)
+	}
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+	return nil
+}
+
+// envKeyStore takes the keys from the environment.
+type envKeyStore struct {
+	current, pending string
+}
+
+func (s *envKeyStore) Name() string { return "environment" }
+
+func (s *envKeyStore) Current() ([]byte, error) { return parseCacheKey(s.current) }
+
+func (s *envKeyStore) Pending() ([]byte, error) {
+	if s.pending == "" {
+		return nil, nil
+	}
+	return parseCacheKey(s.pending)
+}
+
+func (s *envKeyStore) Create() ([]byte, error) {
+	return nil, fmt.Errorf("set FARMSENSE_LOCAL_CACHE_KEY")
+}
+
+func (s *envKeyStore) Stage() ([]byte, error) {
+	key, err := newCacheKey()
+	if err != nil {
+		return nil, err
+	}
+	return key, nil // the operator sets FARMSENSE_LOCAL_CACHE_NEW_KEY to it
+}
+
+func (s *envKeyStore) Promote() error { return nil }
+
+func (s *envKeyStore) Close() {}
+
+// tpmKeyStore seals keys in the TPM with tpm2-tools: the current key at
+// handle, a staged one at handle+1.
+type tpmKeyStore struct {
+	handle uint32
+}
+
+func (c EdgeConfig) cacheTPMHandle() (uint32, error) {
+	if c.LocalCacheTPMHandle == "" {
+		return defaultCacheTPMHandle, nil
+	}
+	h, err := strconv.ParseUint(c.LocalCacheTPMHandle, 0, 32)
+	if err != nil || h < tpmPersistentHandleMin || h >= tpmPersistentHandleMax {
+		return 0, fmt.Errorf("local_cache_tpm_handle must be a persistent handle 0x81000000-0x81fffffe (got %q)", c.LocalCacheTPMHandle)
+	}
+	return uint32(h), nil
+}
+
+func (s *tpmKeyStore) Name() string { return "TPM" }
+
+func tpmHandleString(h uint32) string { return fmt.Sprintf("0x%08x", h) }
+
+// tpm2 runs a tpm2-tools command.
+func tpm2(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// persisted reports whether an object is persisted at h.
+func (s *tpmKeyStore) persisted(h uint32) (bool, error) {
+	out, err := tpm2(nil, "tpm2_getcap", "handles-persistent")
+	if err != nil {
+		return false, err
+	}
+	want := tpmHandleString(h)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "-")), want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *tpmKeyStore) unseal(h uint32) ([]byte, error) {
+	ok, err := s.persisted(h)
+	if err != nil || !ok {
+		return nil, err
+	}
+	out, err := tpm2(nil, "tpm2_unseal", "-c", tpmHandleString(h))
+	if err != nil {
+		return nil, err
+	}
+	return parseCacheKey(string(out))
+}
+
+// seal seals key under the owner hierarchy's primary and persists it at
+// h, replacing whatever was there.
+func (s *tpmKeyStore) seal(h uint32, key []byte) error {
+	dir, err := os.MkdirTemp("", "farmsense-tpm-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	primary, pub, priv, sealed := filepath.Join(dir, "primary.ctx"), filepath.Join(dir, "seal.pub"),
+		filepath.Join(dir, "seal.priv"), filepath.Join(dir, "seal.ctx")
+	if _, err := tpm2(nil, "tpm2_createprimary", "-Q", "-C", "o", "-c", primary); err != nil {
+		return err
+	}
+	if _, err := tpm2([]byte(hex.EncodeToString(key)), "tpm2_create", "-Q", "-C", primary, "-i", "-", "-u", pub, "-r", priv); err != nil {
+		return err
+	}
+	if _, err := tpm2(nil, "tpm2_load", "-Q", "-C", primary, "-u", pub, "-r", priv, "-c", sealed); err != nil {
+		return err
+	}
+	if err := s.evict(h); err != nil {
+		return err
+	}
+	_, err = tpm2(nil, "tpm2_evictcontrol", "-Q", "-C", "o", "-c", sealed, tpmHandleString(h))
+	return err
+}
+
+// sealNew seals a fresh key at h.
+func (s *tpmKeyStore) sealNew(h uint32) ([]byte, error) {
+	key, err := newCacheKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.seal(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// evict removes the object persisted at h, if any.
+func (s *tpmKeyStore) evict(h uint32) error {
+	ok, err := s.persisted(h)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = tpm2(nil, "tpm2_evictcontrol", "-Q", "-C", "o", "-c", tpmHandleString(h))
+	return err
+}
+
+func (s *tpmKeyStore) Current() ([]byte, error) { return s.unseal(s.handle) }
+
+func (s *tpmKeyStore) Pending() ([]byte, error) { return s.unseal(s.handle + 1) }
+
+func (s *tpmKeyStore) Create() ([]byte, error) { return s.sealNew(s.handle) }
+
+func (s *tpmKeyStore) Stage() ([]byte, error) { return s.sealNew(s.handle + 1) }
+
+// Promote reseals the staged key at the current handle (a persistent
+// object can't be moved) and evicts the staged one. Until then a crash
+// leaves the staged key in place and the next start promotes again.
+func (s *tpmKeyStore) Promote() error {
+	key, err := s.unseal(s.handle + 1)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("no staged key at %s", tpmHandleString(s.handle+1))
+	}
+	if err := s.seal(s.handle, key); err != nil {
+		return err
+	}
+	return s.evict(s.handle + 1)
+}
+
+func (s *tpmKeyStore) Close() {}
+
+// cloudKeyStore escrows keys in the cloud's edge_cache_keys.
+type cloudKeyStore struct {
+	config   EdgeConfig
+	deviceID string
+	db       *sql.DB
+}
+
+func (s *cloudKeyStore) Name() string { return "cloud" }
+
+// conn opens the cloud database, retrying with backoff until it answers:
+// without its key the cache, and so the gateway, can't run.
+func (s *cloudKeyStore) conn() (*sql.DB, error) {
+	if s.db != nil {
+		return s.db, nil
+	}
+	dsn, err := cloudDSN(s.config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud connection settings: %v", err)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	wait := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheKeyCloudTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			s.db = db
+			return db, nil
+		}
+		slog.Warn("Cloud unreachable, waiting for the cache key", "component", "cache_encryption", "retry_in", wait, "error", err)
+		time.Sleep(wait)
+		if wait *= 2; wait > cacheKeyCloudMaxWait {
+			wait = cacheKeyCloudMaxWait
+		}
+	}
+}
+
+func (s *cloudKeyStore) key(state string) ([]byte, error) {
+	db, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheKeyCloudTimeout)
+	defer cancel()
+	var keyHex string
+	err = db.QueryRowContext(ctx, `
+		SELECT key_hex FROM edge_cache_keys
+		WHERE device_external_id = $1 AND state = $2
+		ORDER BY created_at DESC LIMIT 1
+	`, s.deviceID, state).Scan(&keyHex)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseCacheKey(keyHex)
+}
+
+func (s *cloudKeyStore) add(state string) ([]byte, error) {
+	db, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	key, err := newCacheKey()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheKeyCloudTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO edge_cache_keys (device_external_id, key_hex, state) VALUES ($1, $2, $3)
+	`, s.deviceID, hex.EncodeToString(key), state); err != nil {
+		return nil, fmt.Errorf("failed to store cache key: %v", err)
+	}
+	return key, nil
+}
+
+func (s *cloudKeyStore) Current() ([]byte, error) { return s.key(cacheKeyStateActive) }
+
+func (s *cloudKeyStore) Pending() ([]byte, error) { return s.key(cacheKeyStatePending) }
+
+func (s *cloudKeyStore) Create() ([]byte, error) { return s.add(cacheKeyStateActive) }
+
+func (s *cloudKeyStore) Stage() ([]byte, error) { return s.add(cacheKeyStatePending) }
+
+func (s *cloudKeyStore) Promote() error {
+	db, err := s.conn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheKeyCloudTimeout)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE edge_cache_keys SET state = $2, retired_at = NOW()
+		WHERE device_external_id = $1 AND state = $3
+	`, s.deviceID, cacheKeyStateRetired, cacheKeyStateActive); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE edge_cache_keys SET state = $2, activated_at = NOW()
+		WHERE key_id = (SELECT key_id FROM edge_cache_keys WHERE device_external_id = $1 AND state = $3
+		                ORDER BY created_at DESC LIMIT 1)
+	`, s.deviceID, cacheKeyStateActive, cacheKeyStatePending); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE edge_cache_keys SET state = $2, retired_at = NOW()
+		WHERE device_external_id = $1 AND state = $3
+	`, s.deviceID, cacheKeyStateRetired, cacheKeyStatePending); err != nil {
+		return err // older staged keys never applied
+	}
+	return tx.Commit()
+}
+
+func (s *cloudKeyStore) Close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
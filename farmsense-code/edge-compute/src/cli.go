@@ -0,0 +1,975 @@
+// CLI - edge binary subcommands
+// The daemon is one subcommand next to the one-off operations a tech runs
+// over SSH, so nothing needs a code or config edit:
+//
+//	run              the daemon; the default, so existing units keep working
+//	                 (-simulate: against a synthetic field, see simulation.go)
+//	compute-once     run one grid cycle now (-explain: report how each cell
+//	                 was computed instead of storing it, see grid_explain.go)
+//	sync-now         flush the offline queues to the cloud
+//	export           cycles from the local grid history (-format geotiff|csv|tiles, -since 24h)
+//	import           historical readings from legacy logger CSV/Excel exports
+//	                 (see reading_import.go), forwarded and optionally backfilled
+//	suggest-probes   where N more probes would help the grid most, as GeoJSON
+//	                 for the install crew (see probe_placement.go)
+//	provision        bind the device ID to this board with a one-time cloud
+//	                 token (see device_identity.go)
+//	rotate-cache-key stage a new local cache key, applied at the daemon's
+//	                 next start (see cache_encryption.go)
+//	migrate-cache    plan (-dry-run), apply or roll back (-to N) local cache
+//	                 schema migrations, or -restore a backup (see
+//	                 local_migrations.go)
+//	status           daemon, cloud link and local cache state as JSON
+//	validate-config  load and validate a config without starting anything
+//
+// Every subcommand takes -config (default $FARMSENSE_EDGE_CONFIG).
+// compute-once and sync-now hand the work to a running daemon through its
+// local API (POST /commands) when it answers, since the daemon's in-memory
+// upload queue only drains from inside it; with no daemon, or with -local,
+// they run in this process against the local cache. A daemon whose API
+// requires client certificates (api_client_ca) can't be reached this way.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+// cliCommand is one subcommand.
+type cliCommand struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var cliCommands = []cliCommand{
+	{"run", "run the edge processor daemon (default)", cmdRun},
+	{"compute-once", "compute one grid cycle now", cmdComputeOnce},
+	{"sync-now", "flush the offline queues to the cloud", cmdSyncNow},
+	{"export", "write grid cycles from the local history as GeoTIFF, CSV or map tiles", cmdExport},
+	{"import", "load historical readings from legacy CSV or Excel exports", cmdImport},
+	{"suggest-probes", "suggest locations for additional probes as GeoJSON", cmdSuggestProbes},
+	{"provision", "register this hardware's identity with the cloud", cmdProvision},
+	{"rotate-cache-key", "stage a new encryption key for the local cache", cmdRotateCacheKey},
+	{"migrate-cache", "migrate, roll back or restore the local cache schema", cmdMigrateCache},
+	{"status", "print daemon, cloud link and local cache state", cmdStatus},
+	{"validate-config", "load and validate a config file", cmdValidateConfig},
+}
+
+// runCLI dispatches to the subcommand named by the first argument; flags
+// without a subcommand mean run.
+func runCLI(args []string) {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		cliUsage(os.Stdout)
+		return
+	}
+	for _, c := range cliCommands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	cliUsage(os.Stderr)
+	os.Exit(2)
+}
+
+func cliUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nrun '%s <command> -h' for a command's flags\n", os.Args[0])
+}
+
+// commandFlags returns a subcommand's flag set with the shared -config.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("FARMSENSE_EDGE_CONFIG"),
+		"path to JSON or YAML edge config (run hot-reloads it on SIGHUP or change)")
+	return fs, configPath
+}
+
+// commandProcessor loads the config and builds a processor for a one-off
+// command.
+func commandProcessor(configPath string) (*EdgeProcessor, error) {
+	config, err := LoadEdgeConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	registerExtraChannels(config.ExtraChannels)
+	setupLogging(config, os.Stderr)
+	processor, err := NewEdgeProcessor(config, config.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize processor: %v", err)
+	}
+	return processor, nil
+}
+
+func cmdRun(args []string) error {
+	fs, configPath := commandFlags("run")
+	exportRepro := fs.String("export-repro", "", "write an anonymized reproduction bundle to this path and exit")
+	reproWindow := fs.Duration("repro-window", 24*time.Hour, "how far back to include sensor readings in the reproduction bundle")
+	backfillFrom := fs.String("backfill-from", "", "recompute grids from this RFC3339 time (with -backfill-to) and exit")
+	backfillTo := fs.String("backfill-to", "", "end of the window to recompute, RFC3339")
+	backfillStep := fs.Duration("backfill-step", 0, "recompute every step instead of at the recorded cycle times")
+	migrateGridIDs := fs.Bool("migrate-grid-ids", false, "map legacy coordinate grid IDs to stable row/column IDs in the cloud and exit")
+	simulate := fs.Bool("simulate", false, "run against a synthetic field (the config's simulation block) with no cloud, writing results under its output_dir")
+	fs.Parse(args)
+
+	// Before anything that could fail, so a bad update can't crash-loop forever
+	CheckUpdateBoot()
+
+	config, err := LoadEdgeConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *simulate {
+		if config, err = simulationConfig(config); err != nil {
+			log.Fatalf("Invalid simulation: %v", err)
+		}
+	}
+	deviceID := config.DeviceID
+	registerExtraChannels(config.ExtraChannels)
+
+	setupLogging(config, os.Stderr)
+
+	if *exportRepro != "" {
+		processor, err := NewEdgeProcessor(config, deviceID)
+		if err != nil {
+			log.Fatalf("Failed to initialize processor: %v", err)
+		}
+		if err := processor.ExportReproBundle(*exportRepro, *reproWindow); err != nil {
+			log.Fatalf("Reproduction bundle export failed: %v", err)
+		}
+		return nil
+	}
+
+	if *migrateGridIDs {
+		processor, err := NewEdgeProcessor(config, deviceID)
+		if err != nil {
+			log.Fatalf("Failed to initialize processor: %v", err)
+		}
+		if err := processor.cloud.check(); err != nil {
+			log.Fatalf("Grid ID migration needs the cloud database: %v", err)
+		}
+		rows, err := processor.MigrateCloudGridIDs()
+		if err != nil {
+			log.Fatalf("Grid ID migration failed: %v", err)
+		}
+		slog.Info("Grid ID migration finished", "component", "trends", "rows", rows)
+		return nil
+	}
+
+	if *backfillFrom != "" || *backfillTo != "" {
+		req := BackfillRequest{Step: *backfillStep}
+		if req.From, err = time.Parse(time.RFC3339, *backfillFrom); err != nil {
+			log.Fatalf("Invalid -backfill-from: %v", err)
+		}
+		if req.To, err = time.Parse(time.RFC3339, *backfillTo); err != nil {
+			log.Fatalf("Invalid -backfill-to: %v", err)
+		}
+		processor, err := NewEdgeProcessor(config, deviceID)
+		if err != nil {
+			log.Fatalf("Failed to initialize processor: %v", err)
+		}
+		if err := processor.cloud.check(); err != nil {
+			slog.Warn("Cloud unreachable, recomputing from the local cache without uploading",
+				"component", "backfill", "error", err)
+		}
+		status, err := processor.RunBackfill(req)
+		if err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		slog.Info("Backfill finished", "component", "backfill", "cycles", status.Cycles, "done", status.Done,
+			"skipped", status.Skipped, "uploads_failed", status.UploadsFailed, "points", status.Points)
+		return nil
+	}
+
+	// Boot the edge grid processor. Everything below is built from its
+	// config, which carries the cached remote overlay, so a restart-only
+	// setting pushed by the control plane takes effect on this restart.
+	processor, err := NewEdgeProcessor(config, deviceID)
+	if err != nil {
+		log.Fatalf("Failed to initialize processor: %v", err)
+	}
+	config = processor.config
+
+	auth := NewAPIAuth(config)
+	if auth == nil && (config.APIHTTPPort > 0 || config.AllianceHTTPPort > 0) {
+		slog.Warn("Local HTTP APIs have no authentication configured (api_keys, FARMSENSE_API_JWT_SECRET or api_client_ca)",
+			"component", "edge_api")
+	}
+	apiTLS, err := apiTLSConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid API TLS settings: %v", err)
+	}
+
+	// Boot the AllianceChain HTTP server in a goroutine.
+	// It accepts trade requests from the Python backend and calls back on commit.
+	if config.AllianceHTTPPort > 0 {
+		allianceSrv := NewAllianceChainServer(
+			deviceID,
+			config.PeerDHUAddresses,
+			config.AllianceHTTPPort,
+			config.BackendCallbackURL,
+		)
+		allianceSrv.auth = auth
+		go allianceSrv.Start()
+	}
+
+	if config.APICloudTokens {
+		tokens, err := NewAPITokenDirectory(config, processor)
+		if err != nil {
+			log.Fatalf("Failed to load API tokens: %v", err)
+		}
+		auth.tokens = tokens
+		go tokens.Run()
+	}
+
+	var uplinks *UplinkIngestor
+	if config.MQTTBrokerURL != "" && len(config.LoRaWANDevices) > 0 {
+		uplinks = NewUplinkIngestor(config, processor.localDB, processor.clock)
+		if err := uplinks.Start(); err != nil {
+			slog.Error("LoRaWAN ingest unavailable", "component", "lorawan", "error", err)
+		}
+	}
+	var serial *SerialIngestor
+	if len(config.SerialPorts) > 0 {
+		serial = NewSerialIngestor(config, processor.localDB, processor.clock)
+		if err := serial.Start(); err != nil {
+			slog.Error("Serial ingest unavailable", "component", "serial", "error", err)
+		}
+	}
+	var weather *WeatherIngestor
+	if len(config.WeatherStations) > 0 {
+		weather = NewWeatherIngestor(config, processor.localDB, processor.clock)
+		if err := weather.Start(); err != nil {
+			slog.Error("Weather station ingest unavailable", "component", "weather", "error", err)
+		}
+	}
+	var irrigation *IrrigationIngestor
+	if irrigationEventsEnabled(config) {
+		irrigation = NewIrrigationIngestor(config, processor.localDB, processor.clock)
+		if err := irrigation.Start(); err != nil {
+			slog.Error("Irrigation event ingest unavailable", "component", "irrigation_events", "error", err)
+		}
+	}
+
+	var scheduler *FieldScheduler
+	if len(config.Fields) > 0 {
+		if scheduler, err = startGatewayFields(config, processor); err != nil {
+			log.Fatalf("Failed to start gateway fields: %v", err)
+		}
+	}
+
+	var fleet *FleetClient
+	if config.FleetHeartbeatSec > 0 {
+		fleet = NewFleetClient(config, processor.cloud, processor.health)
+		processor.ManageFleet(fleet)
+	}
+	var updater *Updater
+	if config.UpdateManifestURL != "" {
+		if updater, err = NewUpdater(config, processor.health); err != nil {
+			log.Fatalf("Invalid update settings: %v", err)
+		}
+		processor.ApplyUpdates(updater)
+	}
+
+	var peers *PeerMonitor
+	if (len(config.Peers) > 0 || config.PeerDiscovery) && !*simulate {
+		if peers, err = NewPeerMonitor(config, processor, scheduler); err != nil {
+			log.Fatalf("Invalid peer failover settings: %v", err)
+		}
+		peers.Start()
+	}
+	gatewayFields := func() []*EdgeProcessor { return gatewayProcessors(processor, scheduler) }
+	for _, p := range gatewayFields() {
+		p.UseNeighborGrids(gatewayFields, peers)
+	}
+
+	if config.APIHTTPPort > 0 {
+		api := NewEdgeAPIServer(processor, config.APIHTTPPort)
+		api.peers = peers
+		api.scheduler = scheduler
+		api.uplinks = uplinks
+		api.serial = serial
+		api.weather = weather
+		api.irrigation = irrigation
+		api.fleet = fleet
+		api.updater = updater
+		api.auth = auth
+		api.tls = apiTLS
+		if !*simulate {
+			api.configPath = *configPath
+		}
+		go api.Start()
+	}
+	if config.OPCUAPort > 0 {
+		opcua, err := NewOPCUAServer(config, gatewayFields)
+		if err != nil {
+			log.Fatalf("Invalid OPC UA settings: %v", err)
+		}
+		if err := opcua.Start(context.Background()); err != nil {
+			slog.Error("OPC UA server unavailable", "component", "opcua", "error", err)
+		}
+	}
+	if *simulate {
+		if err := processor.EnableSimulation(); err != nil {
+			log.Fatalf("Failed to start simulation: %v", err)
+		}
+	} else if *configPath != "" {
+		processor.WatchConfig(NewConfigWatcher(*configPath))
+	}
+	if config.RemoteConfigPublicKey != "" {
+		rs, err := NewRemoteConfigSync(config, processor.cloud, processor.remoteConfig)
+		if err != nil {
+			log.Fatalf("Invalid remote config settings: %v", err)
+		}
+		processor.SyncRemoteConfig(rs)
+	}
+
+	slog.Info("FarmSense Edge Processor starting", "field_id", config.FieldID, "device_id", deviceID)
+	processor.Run()
+	return nil
+}
+
+func cmdComputeOnce(args []string) error {
+	fs, configPath := commandFlags("compute-once")
+	local := fs.Bool("local", false, "compute in this process even when the daemon is running")
+	explain := fs.Bool("explain", false, "run the pipeline without storing anything and print a per-cell report of how it was computed")
+	explainAt := fs.String("at", "", "with -explain, explain the cycle at this RFC3339 time instead of now")
+	explainCell := fs.String("cell", "", "with -explain, report only this grid ID")
+	explainLat := fs.Float64("lat", 0, "with -explain and -lon, report only the cell nearest this point")
+	explainLon := fs.Float64("lon", 0, "longitude for -lat")
+	explainOut := fs.String("out", "", "with -explain, write the report to this file instead of stdout")
+	fs.Parse(args)
+
+	processor, err := commandProcessor(*configPath)
+	if err != nil {
+		return err
+	}
+	if *explain {
+		opts := ExplainOptions{GridID: *explainCell}
+		if *explainAt != "" {
+			if opts.At, err = time.Parse(time.RFC3339, *explainAt); err != nil {
+				return fmt.Errorf("invalid -at: %v", err)
+			}
+		}
+		if *explainLat != 0 || *explainLon != 0 {
+			opts.Near = &orb.Point{*explainLon, *explainLat}
+		}
+		return explainCompute(processor, opts, *explainOut)
+	}
+	if !*local {
+		if handled, err := daemonCommand(processor.config, FleetCommandRecompute); handled {
+			if err == nil {
+				fmt.Println("Grid recomputed by the running daemon")
+			}
+			return err
+		}
+	}
+
+	if err := processor.cloud.check(); err != nil {
+		slog.Warn("Cloud unreachable, computing from the local cache without uploading", "component", "cli", "error", err)
+	}
+	processor.computeVirtualGrid()
+	if n := len(processor.pendingSync); n > 0 {
+		slog.Warn("Cells not uploaded, they are kept in the local grid history only", "component", "cli", "points", n)
+	}
+	if processor.lastGrid == nil {
+		return fmt.Errorf("no grid computed (see the log above)")
+	}
+	return printJSON(processor.gridSummary(processor.lastGrid, processor.ZoneStats(), processor.clock.Now()))
+}
+
+// explainCompute runs an explain cycle in this process; nothing is stored,
+// so there is no reason to hand it to the daemon.
+func explainCompute(processor *EdgeProcessor, opts ExplainOptions, out string) error {
+	if err := processor.cloud.check(); err != nil {
+		slog.Warn("Cloud unreachable, explaining from the local cache", "component", "cli", "error", err)
+	}
+	report, err := processor.ExplainGrid(opts)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		return printJSON(report)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+	if err := os.WriteFile(out, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	fmt.Printf("Explained %d cells to %s\n", len(report.Cells), out)
+	return nil
+}
+
+func cmdSyncNow(args []string) error {
+	fs, configPath := commandFlags("sync-now")
+	local := fs.Bool("local", false, "sync from this process even when the daemon is running")
+	fs.Parse(args)
+
+	processor, err := commandProcessor(*configPath)
+	if err != nil {
+		return err
+	}
+	if !*local {
+		if handled, err := daemonCommand(processor.config, FleetCommandSync); handled {
+			if err == nil {
+				fmt.Println("Offline queues flushed by the running daemon")
+			}
+			return err
+		}
+	}
+
+	if err := processor.cloud.check(); err != nil {
+		return fmt.Errorf("cloud unreachable: %v", err)
+	}
+	processor.syncToCloud()
+	backlog, err := processor.LocalBacklog()
+	if err != nil {
+		return err
+	}
+	return printJSON(backlog)
+}
+
+func cmdExport(args []string) error {
+	fs, configPath := commandFlags("export")
+	format := fs.String("format", ExportFormatGeoTIFF, "geotiff (one raster per cycle), csv or tiles (PNG XYZ tiles of the latest cycle)")
+	since := fs.String("since", "", "export cycles since this RFC3339 time or this long ago, e.g. 24h (default: the latest cycle)")
+	variable := fs.String("variable", "moisture_root", "GeoTIFF band or tile layer: "+strings.Join(exportVariables, ", "))
+	units := fs.String("units", "", "metric or imperial (default: the field's units setting)")
+	out := fs.String("out", ".", "directory to write the files to")
+	minZoom := fs.Int("min-zoom", defaultMinTileZoom, "tiles: lowest zoom level")
+	maxZoom := fs.Int("max-zoom", defaultMaxTileZoom, "tiles: highest zoom level")
+	fs.Parse(args)
+
+	req := ExportRequest{Format: *format, Variable: *variable, Units: *units, OutDir: *out, MinZoom: *minZoom, MaxZoom: *maxZoom}
+	if *since != "" {
+		if d, err := time.ParseDuration(*since); err == nil {
+			req.Since = time.Now().Add(-d)
+		} else if req.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("-since must be an RFC3339 time or a duration like 24h")
+		}
+	}
+	processor, err := commandProcessor(*configPath)
+	if err != nil {
+		return err
+	}
+	files, err := processor.ExportGridHistory(req)
+	for _, f := range files {
+		fmt.Println(f)
+	}
+	return err
+}
+
+// ImportReport is what the import subcommand prints.
+type ImportReport struct {
+	Files     []ImportResult  `json:"files"`
+	Forwarded bool            `json:"forwarded"` // imported readings reached the cloud
+	Backlog   *LocalBacklog   `json:"backlog,omitempty"`
+	Backfill  *BackfillStatus `json:"backfill,omitempty"`
+}
+
+func cmdImport(args []string) error {
+	fs, configPath := commandFlags("import")
+	format := fs.String("format", "", "csv or xlsx (default: from the file extension)")
+	delimiter := fs.String("delimiter", ",", "CSV field separator, e.g. ; or \\t")
+	columns := fs.String("columns", "", "field=header pairs for columns not found by name, e.g. \"moisture_root=VWC 30cm,sensor_id=Logger\"")
+	sensorID := fs.String("sensor-id", "", "sensor ID for every row of a single-logger file")
+	timeFormat := fs.String("time-format", importUnitAuto, "Go layout, rfc3339, unix, unix_ms, excel or auto")
+	timezone := fs.String("timezone", "UTC", "IANA zone for timestamps without one, e.g. America/Denver")
+	moistureUnit := fs.String("moisture-unit", importUnitAuto, "fraction, percent or auto")
+	tempUnit := fs.String("temp-unit", TempUnitC, "c, f or k")
+	batteryUnit := fs.String("battery-unit", importUnitAuto, "v, mv or auto")
+	lat := fs.Float64("lat", 0, "latitude for probes without a position column or lorawan_devices entry")
+	lon := fs.Float64("lon", 0, "longitude for probes without a position column or lorawan_devices entry")
+	dryRun := fs.Bool("dry-run", false, "parse and report without writing anything")
+	noUpload := fs.Bool("no-upload", false, "leave the readings queued for the daemon's next sync")
+	backfillStep := fs.Duration("backfill-step", 0, "recompute grids over the imported span every step, e.g. 1h (0 = don't)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no files given")
+	}
+
+	opts := ImportOptions{
+		Format:       *format,
+		SensorID:     *sensorID,
+		TimeFormat:   *timeFormat,
+		MoistureUnit: *moistureUnit,
+		TempUnit:     *tempUnit,
+		BatteryUnit:  *batteryUnit,
+		Latitude:     *lat,
+		Longitude:    *lon,
+		DryRun:       *dryRun,
+	}
+	sep := []rune(strings.ReplaceAll(*delimiter, `\t`, "\t"))
+	if len(sep) != 1 {
+		return fmt.Errorf("-delimiter must be a single character")
+	}
+	opts.Delimiter = sep[0]
+	if *columns != "" {
+		opts.Columns = make(map[string]string)
+		for _, pair := range strings.Split(*columns, ",") {
+			field, header, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("-columns: %q is not field=header", pair)
+			}
+			opts.Columns[strings.TrimSpace(field)] = strings.TrimSpace(header)
+		}
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return fmt.Errorf("-timezone: %v", err)
+	}
+	opts.Location = loc
+	if !containsString([]string{importUnitAuto, MoistureUnitFraction, MoistureUnitPercent}, opts.MoistureUnit) ||
+		!containsString([]string{TempUnitC, TempUnitF, TempUnitK}, opts.TempUnit) ||
+		!containsString([]string{importUnitAuto, BatteryUnitV, BatteryUnitMV}, opts.BatteryUnit) {
+		return fmt.Errorf("unknown unit (moisture: fraction|percent|auto, temp: c|f|k, battery: v|mv|auto)")
+	}
+
+	processor, err := commandProcessor(*configPath)
+	if err != nil {
+		return err
+	}
+	var report ImportReport
+	var span ImportResult
+	for _, path := range fs.Args() {
+		opts.Path = path
+		res, err := processor.ImportReadings(opts)
+		report.Files = append(report.Files, res)
+		if err != nil {
+			printJSON(report)
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if res.From != nil && (span.From == nil || res.From.Before(*span.From)) {
+			span.From = res.From
+		}
+		if res.To != nil && (span.To == nil || res.To.After(*span.To)) {
+			span.To = res.To
+		}
+	}
+	if *dryRun {
+		return printJSON(report)
+	}
+
+	// Forward everything now rather than a capped batch per daemon sync
+	if !*noUpload {
+		if err := processor.cloud.check(); err != nil {
+			slog.Warn("Cloud unreachable, imported readings stay queued for the daemon", "component", "cli", "error", err)
+		} else {
+			for {
+				before, err := processor.LocalBacklog()
+				if err != nil {
+					return err
+				}
+				processor.forwardRawReadings()
+				after, err := processor.LocalBacklog()
+				if err != nil {
+					return err
+				}
+				if after.RawReadings == 0 || after.RawReadings >= before.RawReadings {
+					report.Forwarded = after.RawReadings == 0
+					break
+				}
+			}
+		}
+	}
+
+	if req, ok := importedBackfill(span, *backfillStep); ok {
+		status, err := processor.RunBackfill(req)
+		report.Backfill = &status
+		if err != nil {
+			printJSON(report)
+			return fmt.Errorf("backfill failed: %v", err)
+		}
+	}
+	backlog, err := processor.LocalBacklog()
+	if err != nil {
+		return err
+	}
+	report.Backlog = &backlog
+	return printJSON(report)
+}
+
+func cmdSuggestProbes(args []string) error {
+	fs, configPath := commandFlags("suggest-probes")
+	probes := fs.Int("n", 3, "number of probes to place")
+	objective := fs.String("objective", PlacementVariance, "variance (minimize predicted interpolation error) or coverage (maximize cells with min_sensors probes in range)")
+	window := fs.Duration("window", defaultPlacementWindow, "history to cross-validate the existing probes over")
+	boundary := fs.String("boundary", "", "GeoJSON file with the field outline (default: the cloud fields row, then the grid extent)")
+	out := fs.String("out", "", "write the GeoJSON to this file instead of stdout")
+	fs.Parse(args)
+
+	opts := PlacementOptions{Probes: *probes, Objective: *objective, Window: *window}
+	if *boundary != "" {
+		data, err := os.ReadFile(*boundary)
+		if err != nil {
+			return fmt.Errorf("failed to read boundary: %v", err)
+		}
+		if opts.Boundary, err = parseBoundaryGeoJSON(data); err != nil {
+			return fmt.Errorf("%s: %v", *boundary, err)
+		}
+	}
+	processor, err := commandProcessor(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := processor.cloud.check(); err != nil {
+		slog.Warn("Cloud unreachable, cross-validating from the local cache", "component", "cli", "error", err)
+	}
+	plan, err := processor.SuggestProbePlacement(opts)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return printJSON(plan)
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode placement: %v", err)
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write placement: %v", err)
+	}
+	fmt.Printf("Suggested %d probes to %s\n", plan.Placement.SuggestedProbes, *out)
+	return nil
+}
+
+func cmdProvision(args []string) error {
+	fs, configPath := commandFlags("provision")
+	token := fs.String("token", os.Getenv("FARMSENSE_PROVISION_TOKEN"), "one-time provisioning token from the cloud (default $FARMSENSE_PROVISION_TOKEN)")
+	deviceID := fs.String("device-id", "", "device ID to provision as (default: the token's, then the config's)")
+	fs.Parse(args)
+	if *token == "" {
+		return fmt.Errorf("no provisioning token (-token or $FARMSENSE_PROVISION_TOKEN)")
+	}
+
+	config, err := LoadEdgeConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupLogging(config, os.Stderr)
+	id, err := provisionDevice(config, *token, *deviceID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Provisioned %s (hardware %s), identity in %s\n", id.DeviceID, id.HardwareID, config.deviceIdentityPath())
+	if config.DeviceID != id.DeviceID {
+		fmt.Printf("Remove device_id from the config or set it to %s before restarting\n", id.DeviceID)
+	}
+	return nil
+}
+
+func cmdRotateCacheKey(args []string) error {
+	fs, configPath := commandFlags("rotate-cache-key")
+	fs.Parse(args)
+
+	config, err := LoadEdgeConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if !config.cacheEncrypted() {
+		return fmt.Errorf("local_cache_encryption is off")
+	}
+	setupLogging(config, os.Stderr)
+	store, err := newCacheKeyStore(config, config.DeviceID)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	key, err := store.Stage()
+	if err != nil {
+		return fmt.Errorf("failed to stage cache key in %s: %v", store.Name(), err)
+	}
+	if config.LocalCacheKeySource == CacheKeyEnv {
+		fmt.Printf("Set FARMSENSE_LOCAL_CACHE_NEW_KEY=%s and restart the daemon to re-encrypt the cache\n", hex.EncodeToString(key))
+		return nil
+	}
+	fmt.Printf("New cache key staged in %s; restart the daemon to re-encrypt the cache\n", store.Name())
+	return nil
+}
+
+func cmdMigrateCache(args []string) error {
+	fs, configPath := commandFlags("migrate-cache")
+	dryRun := fs.Bool("dry-run", false, "print the plan and its SQL without changing anything")
+	to := fs.Int("to", latestLocalSchema(), "schema version to migrate to; lower rolls back")
+	restore := fs.String("restore", "", "replace the cache with this backup (the daemon must be stopped)")
+	list := fs.Bool("list-backups", false, "print the cache's migration backups, newest first")
+	fs.Parse(args)
+
+	config, err := LoadEdgeConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	setupLogging(config, os.Stderr)
+	if *list {
+		return printJSON(localBackups(config.LocalCacheDB))
+	}
+	if *to < 0 || *to > latestLocalSchema() {
+		return fmt.Errorf("-to must be between 0 and %d", latestLocalSchema())
+	}
+	if *restore != "" || !*dryRun {
+		if c := newDaemonClient(config); c != nil {
+			if resp, err := c.do(http.MethodGet, "/readyz", daemonProbeTimeout); err == nil {
+				resp.Body.Close()
+				return fmt.Errorf("the daemon is running; stop it first")
+			}
+		}
+	}
+	if *restore != "" {
+		if err := restoreLocalCache(config.LocalCacheDB, *restore); err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s from %s; the daemon migrates it at its next start\n", config.LocalCacheDB, *restore)
+		return nil
+	}
+
+	db, _, err := openLocalCache(config, config.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to open local cache: %v", err)
+	}
+	defer db.Close()
+	plan, err := planLocalMigration(db, config.LocalCacheDB, *to)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return printJSON(plan)
+	}
+	if err := applyLocalMigration(db, plan, config.LocalMigrationBackups); err != nil {
+		return err
+	}
+	fmt.Printf("Local cache at schema version %d (was %d)\n", plan.Target, plan.Current)
+	return nil
+}
+
+// EdgeStatus is what the status subcommand prints.
+type EdgeStatus struct {
+	FieldID       string                 `json:"field_id"`
+	DeviceID      string                 `json:"device_id"`
+	AppVersion    string                 `json:"app_version"`
+	Daemon        string                 `json:"daemon"`                  // readyz status, or "unreachable"
+	DaemonDetail  map[string]interface{} `json:"daemon_detail,omitempty"` // the /readyz body
+	Cloud         string                 `json:"cloud"`                   // "online" or the connection error
+	Identity      *IdentityStatus        `json:"identity,omitempty"`      // nil without a hardware ID
+	LastGridAt    *time.Time             `json:"last_grid_at,omitempty"`
+	LastGridCells int                    `json:"last_grid_cells"`
+	Backlog       LocalBacklog           `json:"backlog"`
+}
+
+func cmdStatus(args []string) error {
+	fs, configPath := commandFlags("status")
+	fs.Parse(args)
+
+	processor, err := commandProcessor(*configPath)
+	if err != nil {
+		return err
+	}
+	st := EdgeStatus{
+		FieldID:    processor.config.FieldID,
+		DeviceID:   processor.deviceID,
+		AppVersion: appVersion,
+		Daemon:     "unreachable",
+		Cloud:      "online",
+	}
+	if c := newDaemonClient(processor.config); c != nil {
+		if resp, err := c.do(http.MethodGet, "/readyz", daemonProbeTimeout); err == nil {
+			if json.NewDecoder(resp.Body).Decode(&st.DaemonDetail) == nil {
+				st.Daemon, _ = st.DaemonDetail["status"].(string)
+			}
+			resp.Body.Close()
+		}
+	}
+	if err := processor.cloud.check(); err != nil {
+		st.Cloud = err.Error()
+	}
+	if processor.identity != nil {
+		identity := processor.identity.Status()
+		st.Identity = &identity
+	}
+
+	var last int64
+	if err := processor.localDB.QueryRow(fmt.Sprintf(`
+		SELECT COALESCE(MAX(timestamp), 0) FROM %s WHERE field_id = ?
+	`, processor.historyTable()), processor.config.FieldID).Scan(&last); err != nil {
+		return fmt.Errorf("failed to read grid history: %v", err)
+	}
+	if last > 0 {
+		t := time.Unix(last, 0).UTC()
+		st.LastGridAt = &t
+		query := `SELECT COUNT(*) FROM grid_history WHERE field_id = ? AND timestamp = ?`
+		if processor.packedHistory() {
+			query = `SELECT cells FROM grid_history_packed WHERE field_id = ? AND timestamp = ?`
+		}
+		if err := processor.localDB.QueryRow(query, processor.config.FieldID, last).Scan(&st.LastGridCells); err != nil {
+			return fmt.Errorf("failed to read grid history: %v", err)
+		}
+	}
+	if st.Backlog, err = processor.LocalBacklog(); err != nil {
+		return err
+	}
+	return printJSON(st)
+}
+
+func cmdValidateConfig(args []string) error {
+	fs, configPath := commandFlags("validate-config")
+	fs.Parse(args)
+	path := *configPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	if path == "" {
+		return fmt.Errorf("no config given (-config, a path argument or $FARMSENSE_EDGE_CONFIG)")
+	}
+
+	config, err := LoadEdgeConfig(path)
+	if err != nil {
+		return err
+	}
+	if _, err := apiTLSConfig(config); err != nil {
+		return fmt.Errorf("invalid API TLS settings: %v", err)
+	}
+	fmt.Printf("%s: OK (field %s, device %s)\n", path, config.FieldID, config.DeviceID)
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// LocalBacklog counts what the local cache still has to upload.
+type LocalBacklog struct {
+	RawReadings     int `json:"raw_readings"`
+	WaterBudgetDays int `json:"water_budget_days"`
+	GridBatches     int `json:"grid_batches"` // cycles not yet acknowledged by the cloud
+}
+
+// LocalBacklog reads the upload backlog kept in the local cache. Grid
+// cycles count from their batch records; the daemon's in-memory queue
+// holds their cells.
+func (ep *EdgeProcessor) LocalBacklog() (LocalBacklog, error) {
+	var b LocalBacklog
+	mark, err := ep.readingWatermark()
+	if err != nil {
+		return b, fmt.Errorf("failed to read reading watermark: %v", err)
+	}
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(*) FROM soil_sensor_readings WHERE rowid > ? AND field_id = ? AND origin = ?
+	`, mark, ep.config.FieldID, ReadingOriginLocal).Scan(&b.RawReadings); err != nil {
+		return b, fmt.Errorf("failed to count queued readings: %v", err)
+	}
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(*) FROM water_budget WHERE field_id = ? AND synced = 0
+	`, ep.config.FieldID).Scan(&b.WaterBudgetDays); err != nil {
+		return b, fmt.Errorf("failed to count queued water budget days: %v", err)
+	}
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(*) FROM grid_batches WHERE field_id = ? AND synced_at IS NULL
+	`, ep.config.FieldID).Scan(&b.GridBatches); err != nil {
+		return b, fmt.Errorf("failed to count unsynced grid batches: %v", err)
+	}
+	return b, nil
+}
+
+const daemonProbeTimeout = 5 * time.Second
+
+// daemonClient calls the local API of a daemon on this host.
+type daemonClient struct {
+	base   string
+	apiKey string
+	client *http.Client
+}
+
+// newDaemonClient returns a client for the config's local API, or nil
+// when it is disabled or needs client certificates.
+func newDaemonClient(config EdgeConfig) *daemonClient {
+	if config.APIHTTPPort <= 0 || config.APIClientCA != "" {
+		return nil
+	}
+	c := &daemonClient{
+		base:   fmt.Sprintf("http://127.0.0.1:%d", config.APIHTTPPort),
+		client: &http.Client{},
+	}
+	if len(config.APIKeys) > 0 {
+		c.apiKey = config.APIKeys[0]
+	}
+	if config.APITLSCert != "" {
+		// Trust the daemon's own certificate as well as the system roots
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if pem, err := os.ReadFile(config.APITLSCert); err == nil {
+			pool.AppendCertsFromPEM(pem)
+		}
+		c.base = fmt.Sprintf("https://localhost:%d", config.APIHTTPPort)
+		c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return c
+}
+
+func (c *daemonClient) do(method, path string, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	c.client.Timeout = timeout
+	return c.client.Do(req)
+}
+
+// daemonCommand asks a running daemon to run command. handled is false
+// when no daemon took it, and the caller should run it itself.
+func daemonCommand(config EdgeConfig, command string) (handled bool, err error) {
+	c := newDaemonClient(config)
+	if c == nil {
+		return false, nil
+	}
+	resp, err := c.do(http.MethodPost, "/commands?command="+command, localCommandTimeout)
+	if err != nil {
+		slog.Debug("No daemon answered, running here", "component", "cli", "error", err)
+		return false, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden:
+		slog.Warn("Daemon didn't accept the command, running here", "component", "cli", "status", resp.Status)
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return true, fmt.Errorf("daemon: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,189 @@
+// Cloud Connection Manager - resilient PostgreSQL connectivity
+// Field gateways boot before the LTE/backhaul link is up and lose it for
+// hours at a time. The manager keeps retrying with exponential backoff and
+// jitter, pings while connected, and notifies listeners whenever
+// connectivity flips so the processor can queue or flush accordingly.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCloudPingInterval = 30 * time.Second
+	defaultCloudMinBackoff   = 5 * time.Second
+	defaultCloudMaxBackoff   = 10 * time.Minute
+	cloudConnectTimeout      = 10 * time.Second
+)
+
+// CloudConnManager owns the cloud *sql.DB handle and its online state.
+type CloudConnManager struct {
+	dsn          string
+	pingInterval time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+
+	connMaxLifetime time.Duration // 0 = connections live until closed
+
+	// gate, when set, must pass after every ping for the link to count
+	// as online (device_identity.go)
+	gate func(ctx context.Context, db *sql.DB) error
+
+	mu        sync.RWMutex
+	db        *sql.DB
+	online    bool
+	callbacks []func(online bool)
+
+	failures chan error // out-of-band failure reports from query paths
+	logger   *slog.Logger
+}
+
+func NewCloudConnManager(dsn string, pingInterval, maxBackoff time.Duration) *CloudConnManager {
+	if pingInterval <= 0 {
+		pingInterval = defaultCloudPingInterval
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultCloudMaxBackoff
+	}
+	return &CloudConnManager{
+		dsn:          dsn,
+		pingInterval: pingInterval,
+		minBackoff:   defaultCloudMinBackoff,
+		maxBackoff:   maxBackoff,
+		failures:     make(chan error, 1),
+		logger:       slog.With("component", "cloud_conn"),
+	}
+}
+
+// OnChange registers a callback invoked (from the manager goroutine)
+// every time connectivity flips.
+func (m *CloudConnManager) OnChange(cb func(online bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.callbacks = append(m.callbacks, cb)
+}
+
+// DB returns the cloud handle, or nil while offline.
+func (m *CloudConnManager) DB() *sql.DB {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.online {
+		return nil
+	}
+	return m.db
+}
+
+func (m *CloudConnManager) Online() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.online
+}
+
+// ReportFailure lets callers signal that a cloud query failed so the
+// manager re-verifies the link immediately instead of at the next ping.
+func (m *CloudConnManager) ReportFailure(err error) {
+	select {
+	case m.failures <- err:
+	default: // a check is already pending
+	}
+}
+
+// Run maintains the connection until stop is closed.
+func (m *CloudConnManager) Run(stop <-chan struct{}) {
+	if m.dsn == "" {
+		m.logger.Warn("No database URL configured, running offline")
+		return
+	}
+
+	backoff := m.minBackoff
+	for {
+		var wait time.Duration
+		if err := m.check(); err != nil {
+			m.logger.Warn("Cloud DB unreachable", "error", err, "retry_in", backoff.String())
+			wait = withJitter(backoff)
+			backoff *= 2
+			if backoff > m.maxBackoff {
+				backoff = m.maxBackoff
+			}
+		} else {
+			backoff = m.minBackoff
+			wait = m.pingInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case err := <-m.failures:
+			timer.Stop()
+			m.logger.Info("Query failure reported, re-checking link", "error", err)
+		case <-timer.C:
+		}
+	}
+}
+
+// check opens the handle if needed and pings it, updating the online state.
+func (m *CloudConnManager) check() error {
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+
+	if db == nil {
+		var err error
+		db, err = sql.Open("postgres", m.dsn)
+		if err != nil {
+			m.setOnline(false)
+			return err
+		}
+		db.SetConnMaxLifetime(m.connMaxLifetime)
+		m.mu.Lock()
+		m.db = db
+		m.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cloudConnectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		m.setOnline(false)
+		return err
+	}
+	if m.gate != nil {
+		if err := m.gate(ctx, db); err != nil {
+			m.setOnline(false)
+			return err
+		}
+	}
+
+	m.setOnline(true)
+	return nil
+}
+
+func (m *CloudConnManager) setOnline(online bool) {
+	m.mu.Lock()
+	changed := m.online != online
+	m.online = online
+	callbacks := append([]func(bool){}, m.callbacks...)
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	m.logger.Info("Connectivity changed", "online", online)
+	for _, cb := range callbacks {
+		cb(online)
+	}
+}
+
+// withJitter spreads retries of a fleet that lost backhaul at the same
+// moment by +/-20%.
+func withJitter(d time.Duration) time.Duration {
+	spread := float64(d) * 0.2
+	return d + time.Duration((rand.Float64()*2-1)*spread)
+}
@@ -0,0 +1,398 @@
+// Cloud Store - pluggable destination for grid uploads
+// Each cycle's cells are a time series keyed by field, cell and time, and
+// where they land is chosen per deployment with cloud_store:
+//
+//   - postgres: rows in virtual_sensor_grid_20m over the cloud connection
+//   - timescaledb: the same table, kept a compressed hypertable (created
+//     and given a compression policy on first upload if the migration
+//     didn't already)
+//   - influxdb: points in line protocol to an InfluxDB 2.x /api/v2/write
+//   - http: the FarmSense ingest endpoint (sync_upload_url, sync_encoding)
+//   - s3: compressed batch files with manifests in S3-compatible object
+//     storage (object_store.go)
+//
+// Unset means http when sync_upload_url is set, postgres otherwise. The
+// store only carries grid cells; zone stats, fleet state and commands stay
+// on the Postgres connection. A store that isn't Available has its points
+// queued for the next sync like any failed upload. Each upload lands
+// whole or not at all, and moves the field's epoch (grid_epochs.go).
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cloud store backends
+const (
+	CloudStorePostgres    = "postgres"
+	CloudStoreTimescaleDB = "timescaledb"
+	CloudStoreInfluxDB    = "influxdb"
+	CloudStoreHTTP        = "http"
+)
+
+const (
+	cloudGridTable       = "virtual_sensor_grid_20m"
+	gridInsertBatch      = 500 // rows per INSERT (19 parameters each, well under the 65535 limit)
+	influxGridMeasure    = "virtual_grid_20m"
+	defaultTSCompressAge = "7 days"
+)
+
+// CloudStore uploads grid cells to the cloud.
+type CloudStore interface {
+	Name() string
+	Available() bool // false = known unreachable, queue instead of trying
+	StoreGrid(points []VirtualGridPoint) error
+}
+
+// cloudStoreKind resolves the configured backend, applying the default.
+func cloudStoreKind(c EdgeConfig) string {
+	if c.CloudStore != "" {
+		return c.CloudStore
+	}
+	if c.SyncUploadURL != "" {
+		return CloudStoreHTTP
+	}
+	return CloudStorePostgres
+}
+
+// newCloudStore builds the configured backend for ep.
+func newCloudStore(ep *EdgeProcessor) (CloudStore, error) {
+	switch kind := cloudStoreKind(ep.config); kind {
+	case CloudStorePostgres:
+		return &postgresStore{cloud: ep.cloud}, nil
+	case CloudStoreTimescaleDB:
+		return &postgresStore{cloud: ep.cloud, timescale: true}, nil
+	case CloudStoreInfluxDB:
+		return newInfluxStore(ep.config)
+	case CloudStoreHTTP:
+		return &ingestStore{ep: ep}, nil
+	case CloudStoreS3:
+		return newObjectStore(ep)
+	default:
+		return nil, fmt.Errorf("unknown cloud_store %q", kind)
+	}
+}
+
+// ingestStore posts batches to the HTTP ingest endpoint. It reads the
+// live config, so sync_encoding and sync_compression hot-reload.
+type ingestStore struct {
+	ep *EdgeProcessor
+}
+
+func (s *ingestStore) Name() string    { return CloudStoreHTTP }
+func (s *ingestStore) Available() bool { return true }
+
+func (s *ingestStore) StoreGrid(points []VirtualGridPoint) error {
+	return s.ep.uploadBatch(points)
+}
+
+// postgresStore inserts cells into the cloud grid table.
+type postgresStore struct {
+	cloud     *CloudConnManager
+	timescale bool
+
+	mu          sync.Mutex
+	schemaReady bool
+}
+
+func (s *postgresStore) Name() string {
+	if s.timescale {
+		return CloudStoreTimescaleDB
+	}
+	return CloudStorePostgres
+}
+
+func (s *postgresStore) Available() bool {
+	return s.cloud.Online() && s.cloud.DB() != nil
+}
+
+func (s *postgresStore) StoreGrid(points []VirtualGridPoint) error {
+	db := s.cloud.DB()
+	if db == nil {
+		return fmt.Errorf("cloud database offline")
+	}
+	if s.timescale {
+		if err := s.ensureHypertable(db); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin grid upload: %v", err)
+	}
+	defer tx.Rollback()
+	if err := registerCloudBatches(tx, points); err != nil {
+		return err
+	}
+	for start := 0; start < len(points); start += gridInsertBatch {
+		end := start + gridInsertBatch
+		if end > len(points) {
+			end = len(points)
+		}
+		query, args, err := gridInsert(points[start:end])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to insert grid cells: %v", err)
+		}
+	}
+	if err := advanceCloudHighWater(tx, points); err != nil {
+		return err
+	}
+	if err := advanceCloudEpoch(tx, points); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit grid upload: %v", err)
+	}
+	return nil
+}
+
+// gridInsert builds one multi-row upsert for points. Cells the cloud
+// already has for their (grid_id, timestamp, batch_id) are skipped.
+func gridInsert(points []VirtualGridPoint) (string, []interface{}, error) {
+	const cols = 32
+	var b strings.Builder
+	b.WriteString(`INSERT INTO ` + cloudGridTable + ` (id, field_id, grid_id, timestamp, location, moisture_surface,
+		moisture_root, temperature, water_deficit_mm, stress_index, irrigation_need, computation_mode,
+		source_sensors, confidence, edge_device_id, rain_state, need_flag, batch_id, algorithm_version,
+		drydown_rate_mm_day, temp_trend_c_day, hours_to_refill, hours_to_wilting, soil_ec_dsm, leaching_fraction,
+		salinity_yield_loss_pct, tenant_id, quality_flags, moisture_root_pct_30d, moisture_root_pct_90d,
+		moisture_root_last_season, moisture_root_vs_last_season) VALUES `)
+	args := make([]interface{}, 0, len(points)*cols)
+	for i, p := range points {
+		sources, err := json.Marshal(p.SourceSensors)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to encode source sensors: %v", err)
+		}
+		var soilEC *float64
+		if ec, ok := p.Variables[VarSoilEC]; ok {
+			soilEC = &ec
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		n := i * cols
+		fmt.Fprintf(&b, "(gen_random_uuid(), $%d, $%d, $%d, ST_SetSRID(ST_MakePoint($%d, $%d), 4326)", n+1, n+2, n+3, n+4, n+5)
+		for c := 6; c <= cols; c++ {
+			fmt.Fprintf(&b, ", $%d", n+c)
+		}
+		b.WriteString(")")
+		args = append(args, p.FieldID, p.GridID, p.Timestamp, p.Longitude, p.Latitude, p.MoistureSurface,
+			p.MoistureRoot, p.Temperature, p.WaterDeficit, p.StressIndex, p.IrrigationNeed, p.ComputationMode,
+			string(sources), p.Confidence, p.EdgeDeviceID, nullString(p.RainState), nullString(p.NeedFlag),
+			nullString(p.BatchID), nullString(p.AlgorithmVersion), p.DrydownRate, p.TempTrend, p.HoursToRefill,
+			p.HoursToWilting, soilEC, p.LeachingFraction, p.SalinityLossPct, nullString(p.TenantID), int64(p.QualityFlags),
+			p.MoisturePct30d, p.MoisturePct90d, p.MoistureLastSeason, p.MoistureVsLastSeason)
+	}
+	b.WriteString(` ON CONFLICT (grid_id, timestamp, batch_id) DO NOTHING`)
+	return b.String(), args, nil
+}
+
+// nullString stores an empty tag as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// ensureHypertable makes the grid table a compressed hypertable, once per
+// process. Already-converted tables and existing policies are left alone.
+func (s *postgresStore) ensureHypertable(db *sql.DB) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schemaReady {
+		return nil
+	}
+
+	if _, err := db.Exec(`SELECT create_hypertable($1, 'timestamp',
+		chunk_time_interval => INTERVAL '1 week', if_not_exists => TRUE, migrate_data => TRUE)`, cloudGridTable); err != nil {
+		return fmt.Errorf("failed to create grid hypertable: %v", err)
+	}
+	var compressed bool
+	if err := db.QueryRow(`SELECT compression_enabled FROM timescaledb_information.hypertables
+		WHERE hypertable_name = $1`, cloudGridTable).Scan(&compressed); err != nil {
+		return fmt.Errorf("failed to read grid hypertable settings: %v", err)
+	}
+	if !compressed {
+		if _, err := db.Exec(`ALTER TABLE ` + cloudGridTable + ` SET (timescaledb.compress,
+			timescaledb.compress_segmentby = 'field_id, grid_id', timescaledb.compress_orderby = 'timestamp DESC')`); err != nil {
+			return fmt.Errorf("failed to enable grid compression: %v", err)
+		}
+	}
+	if _, err := db.Exec(`SELECT add_compression_policy($1, INTERVAL '`+defaultTSCompressAge+`', if_not_exists => TRUE)`,
+		cloudGridTable); err != nil {
+		return fmt.Errorf("failed to add grid compression policy: %v", err)
+	}
+	s.schemaReady = true
+	return nil
+}
+
+// influxStore writes cells to InfluxDB 2.x in line protocol.
+type influxStore struct {
+	writeURL string
+	token    string
+}
+
+func newInfluxStore(c EdgeConfig) (*influxStore, error) {
+	if c.InfluxURL == "" || c.InfluxOrg == "" || c.InfluxBucket == "" {
+		return nil, fmt.Errorf("cloud_store influxdb needs influx_url, influx_org and influx_bucket")
+	}
+	u, err := url.Parse(strings.TrimRight(c.InfluxURL, "/") + "/api/v2/write")
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx_url: %v", err)
+	}
+	q := url.Values{}
+	q.Set("org", c.InfluxOrg)
+	q.Set("bucket", c.InfluxBucket)
+	q.Set("precision", "ms")
+	u.RawQuery = q.Encode()
+	return &influxStore{writeURL: u.String(), token: c.InfluxToken}, nil
+}
+
+func (s *influxStore) Name() string    { return CloudStoreInfluxDB }
+func (s *influxStore) Available() bool { return true }
+
+func (s *influxStore) StoreGrid(points []VirtualGridPoint) error {
+	if err := s.write(influxLines(points)); err != nil {
+		return err
+	}
+	// Only once every cell is in (grid_epochs.go)
+	if epoch := influxEpochLines(points); len(epoch) > 0 {
+		return s.write(epoch)
+	}
+	return nil
+}
+
+func (s *influxStore) write(lines []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewReader(lines))
+	if err != nil {
+		return fmt.Errorf("failed to build influx write: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := syncHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write to influx: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("influx write returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// influxLines encodes one line per cell. Identity and enums are tags;
+// measurements, location and extra variables (prefixed var_) are fields.
+func influxLines(points []VirtualGridPoint) []byte {
+	var b bytes.Buffer
+	for _, p := range points {
+		b.WriteString(influxGridMeasure)
+		writeInfluxTag(&b, "field_id", p.FieldID)
+		writeInfluxTag(&b, "tenant_id", p.TenantID)
+		writeInfluxTag(&b, "grid_id", p.GridID)
+		writeInfluxTag(&b, "edge_device_id", p.EdgeDeviceID)
+		writeInfluxTag(&b, "computation_mode", p.ComputationMode)
+		writeInfluxTag(&b, "irrigation_need", p.IrrigationNeed)
+		writeInfluxTag(&b, "rain_state", p.RainState)
+		writeInfluxTag(&b, "need_flag", p.NeedFlag)
+
+		fields := []string{
+			"latitude=" + influxFloat(p.Latitude),
+			"longitude=" + influxFloat(p.Longitude),
+			"moisture_surface=" + influxFloat(p.MoistureSurface),
+			"moisture_root=" + influxFloat(p.MoistureRoot),
+			"temperature=" + influxFloat(p.Temperature),
+			"water_deficit_mm=" + influxFloat(p.WaterDeficit),
+			"stress_index=" + influxFloat(p.StressIndex),
+			"trafficability_index=" + influxFloat(p.Trafficability),
+			"trafficable=" + strconv.FormatBool(p.Trafficable),
+			"confidence=" + influxFloat(p.Confidence),
+			"loocv_rmse_vwc=" + influxFloat(p.LOOCVRMSE),
+			"source_sensors=" + strconv.Itoa(len(p.SourceSensors)) + "i",
+			"quality_flags=" + strconv.FormatUint(uint64(p.QualityFlags), 10) + "i",
+		}
+		if p.LeachingFraction > 0 {
+			fields = append(fields, "leaching_fraction="+influxFloat(p.LeachingFraction),
+				"salinity_yield_loss_pct="+influxFloat(p.SalinityLossPct))
+		}
+		if p.ConfigVersion != "" {
+			fields = append(fields, `config_version="`+influxFieldString(p.ConfigVersion)+`"`)
+		}
+		if p.BatchID != "" {
+			fields = append(fields, `batch_id="`+p.BatchID+`"`,
+				`algorithm_version="`+influxFieldString(p.AlgorithmVersion)+`"`)
+		}
+		for _, layer := range []struct {
+			name  string
+			value *float64
+		}{
+			{"drydown_rate_mm_day", p.DrydownRate},
+			{"temp_trend_c_day", p.TempTrend},
+			{"hours_to_refill", p.HoursToRefill},
+			{"hours_to_wilting", p.HoursToWilting},
+			{"moisture_root_pct_30d", p.MoisturePct30d},
+			{"moisture_root_pct_90d", p.MoisturePct90d},
+			{"moisture_root_last_season", p.MoistureLastSeason},
+			{"moisture_root_vs_last_season", p.MoistureVsLastSeason},
+		} {
+			if layer.value != nil {
+				fields = append(fields, layer.name+"="+influxFloat(*layer.value))
+			}
+		}
+		names := make([]string, 0, len(p.Variables))
+		for name := range p.Variables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fields = append(fields, influxKey("var_"+name)+"="+influxFloat(p.Variables[name]))
+		}
+		b.WriteByte(' ')
+		b.WriteString(strings.Join(fields, ","))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(p.Timestamp.UnixMilli(), 10))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+func writeInfluxTag(b *bytes.Buffer, key, value string) {
+	if value == "" {
+		return // empty tag values are rejected
+	}
+	b.WriteByte(',')
+	b.WriteString(influxKey(key))
+	b.WriteByte('=')
+	b.WriteString(influxKey(value))
+}
+
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func influxKey(s string) string { return influxKeyEscaper.Replace(s) }
+
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func influxFieldString(s string) string { return influxStringEscaper.Replace(s) }
+
+// influxFloat formats a float field. Line protocol has no NaN or Inf, so
+// those are written as 0 rather than failing the whole batch.
+func influxFloat(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		v = 0
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
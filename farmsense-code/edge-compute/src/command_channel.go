@@ -0,0 +1,300 @@
+// Command Channel - immediate cloud commands and the parameterized ones
+// device_commands rows are otherwise claimed on the next fleet heartbeat,
+// up to fleet_heartbeat_sec later. An insert trigger NOTIFYs channel
+// device_commands with the device's external ID; with command_channel
+// listen (the default) the fleet client holds a LISTEN connection of its
+// own and polls as soon as a notification for it arrives, so a remote
+// recompute starts within seconds and nobody needs SSH into the farm
+// network. The listener reconnects by itself and polls after every
+// reconnect, since notifications sent while it was down are lost. Use
+// poll behind a pooler that can't LISTEN (PgBouncer in transaction mode).
+//
+// Commands that take params (device_commands.params, JSON):
+//
+//	backfill     {"from": "2024-06-01T00:00:00Z", "to": "...", "step": "1h"}
+//	             queue a historical recompute (backfill.go); step optional
+//	diagnostics  {"log_lines": 500}
+//	             upload the latest log lines, the running config with
+//	             secrets removed, local cache table sizes and upload
+//	             backlog, and the storage, throttle and backfill state to
+//	             device_diagnostics
+//	log_level    {"level": "debug", "duration": "30m"}
+//	             change the log level live; it goes back to log_level from
+//	             the config after duration (default 1h, at most 24h)
+//	profile      {"kind": "cpu", "seconds": 30}
+//	             capture a runtime profile and upload it to
+//	             device_profiles (profiling.go)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Command channels
+const (
+	CommandChannelListen = "listen"
+	CommandChannelPoll   = "poll"
+)
+
+const (
+	commandNotifyChannel     = "device_commands"
+	commandListenMinBackoff  = 10 * time.Second
+	commandListenMaxBackoff  = 5 * time.Minute
+	commandListenPing        = 90 * time.Second
+	defaultLogLevelDuration  = time.Hour
+	maxLogLevelDuration      = 24 * time.Hour
+	defaultDiagnosticsLines  = 500
+	diagnosticsUploadTimeout = 30 * time.Second
+)
+
+// listen wakes Run whenever a command is queued for this device.
+func (fc *FleetClient) listen() {
+	listener := pq.NewListener(fc.listenDSN, commandListenMinBackoff, commandListenMaxBackoff,
+		func(ev pq.ListenerEventType, err error) {
+			switch ev {
+			case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+				fc.logger.Debug("Command listener offline", "error", err)
+			case pq.ListenerEventReconnected:
+				fc.logger.Info("Command listener reconnected")
+			}
+		})
+	defer listener.Close()
+	if err := listener.Listen(commandNotifyChannel); err != nil {
+		fc.logger.Warn("Command listener not started, commands arrive on the heartbeat", "error", err)
+		return
+	}
+	fc.logger.Info("Listening for commands", "channel", commandNotifyChannel)
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			// nil after a reconnect: anything sent meanwhile was missed
+			if n == nil || n.Extra == fc.deviceID {
+				fc.wakeUp()
+			}
+		case <-time.After(commandListenPing):
+			go listener.Ping()
+		}
+	}
+}
+
+func (fc *FleetClient) wakeUp() {
+	select {
+	case fc.wake <- struct{}{}:
+	default: // a poll is already due
+	}
+}
+
+// decodeCommandParams unmarshals a command's params into v.
+func decodeCommandParams(cmd FleetCommand, v interface{}) error {
+	if len(cmd.Params) == 0 {
+		return fmt.Errorf("%s needs params", cmd.Command)
+	}
+	if err := json.Unmarshal(cmd.Params, v); err != nil {
+		return fmt.Errorf("invalid %s params: %v", cmd.Command, err)
+	}
+	return nil
+}
+
+// remoteBackfill queues the backfill a command asks for.
+func (ep *EdgeProcessor) remoteBackfill(cmd FleetCommand) error {
+	var p struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+		Step string    `json:"step"`
+	}
+	if err := decodeCommandParams(cmd, &p); err != nil {
+		return err
+	}
+	req := BackfillRequest{From: p.From, To: p.To}
+	if p.Step != "" {
+		step, err := time.ParseDuration(p.Step)
+		if err != nil {
+			return fmt.Errorf("invalid backfill step: %v", err)
+		}
+		req.Step = step
+	}
+	status, err := ep.StartBackfill(req)
+	if err != nil {
+		return err
+	}
+	ep.logger.Info("Backfill queued by command", "component", "fleet", "backfill_id", status.ID,
+		"command_id", cmd.ID, "from", status.From, "to", status.To)
+	return nil
+}
+
+// remoteLogLevel applies a temporary log level.
+func (ep *EdgeProcessor) remoteLogLevel(cmd FleetCommand) error {
+	var p struct {
+		Level    string `json:"level"`
+		Duration string `json:"duration"`
+	}
+	if err := decodeCommandParams(cmd, &p); err != nil {
+		return err
+	}
+	if !validLogLevel(p.Level) {
+		return fmt.Errorf("level must be debug, info, warn or error (got %q)", p.Level)
+	}
+	d := defaultLogLevelDuration
+	if p.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(p.Duration); err != nil || d <= 0 || d > maxLogLevelDuration {
+			return fmt.Errorf("duration must be between 0 and %s (got %q)", maxLogLevelDuration, p.Duration)
+		}
+	}
+	logLevel.Set(parseLogLevel(p.Level))
+	ep.logLevelUntil = time.Now().Add(d)
+	ep.logger.Info("Log level changed by command", "component", "fleet", "level", strings.ToLower(p.Level),
+		"until", ep.logLevelUntil.UTC(), "command_id", cmd.ID)
+	return nil
+}
+
+// maybeRevertLogLevel restores the configured level when a log_level
+// command's duration is up.
+func (ep *EdgeProcessor) maybeRevertLogLevel() {
+	if ep.logLevelUntil.IsZero() || time.Now().Before(ep.logLevelUntil) {
+		return
+	}
+	ep.logLevelUntil = time.Time{}
+	logLevel.Set(parseLogLevel(ep.config.LogLevel))
+	ep.logger.Info("Log level restored from config", "component", "fleet", "level", ep.config.LogLevel)
+}
+
+// LocalDBStats sizes the local cache.
+type LocalDBStats struct {
+	FileBytes int64            `json:"file_bytes"`
+	Tables    map[string]int64 `json:"tables"` // rows per table
+	Backlog   LocalBacklog     `json:"backlog"`
+}
+
+// DiagnosticsBundle is what a diagnostics command uploads.
+type DiagnosticsBundle struct {
+	DeviceID      string          `json:"device_id"`
+	FieldID       string          `json:"field_id"`
+	AppVersion    string          `json:"app_version"`
+	CollectedAt   time.Time       `json:"collected_at"`
+	ConfigVersion string          `json:"config_version"`
+	Config        EdgeConfig      `json:"config"` // secrets removed
+	LogLevel      string          `json:"log_level"`
+	Logs          []string        `json:"logs"` // oldest first
+	LocalDB       LocalDBStats    `json:"local_db"`
+	Storage       *StorageStatus  `json:"storage,omitempty"`
+	Throttle      *ThrottleState  `json:"throttle,omitempty"`
+	Backfill      *BackfillStatus `json:"backfill,omitempty"`
+	Errors        []string        `json:"errors,omitempty"` // parts that couldn't be collected
+}
+
+// diagnosticConfig is cfg without values that grant access. Fields
+// tagged json:"-" never leave the process anyway.
+func diagnosticConfig(cfg EdgeConfig) EdgeConfig {
+	if cfg.DatabaseURL != "" {
+		cfg.DatabaseURL = "(redacted)"
+	}
+	if cfg.MQTTPassword != "" {
+		cfg.MQTTPassword = "(redacted)"
+	}
+	cfg.APIKeys = nil
+	cfg.APITenantKeys = nil
+	return cfg
+}
+
+// collectDiagnostics gathers a bundle from the running processor.
+func (ep *EdgeProcessor) collectDiagnostics(logLines int) DiagnosticsBundle {
+	b := DiagnosticsBundle{
+		DeviceID:      ep.deviceID,
+		FieldID:       ep.config.FieldID,
+		AppVersion:    appVersion,
+		CollectedAt:   time.Now().UTC(),
+		ConfigVersion: ep.remoteConfig.VersionTag(),
+		Config:        diagnosticConfig(ep.config),
+		LogLevel:      strings.ToLower(logLevel.Level().String()),
+		Logs:          recentLogs.Tail(logLines),
+		LocalDB:       LocalDBStats{FileBytes: ep.localCacheBytes(), Tables: make(map[string]int64)},
+		Storage:       ep.StorageStatus(),
+		Throttle:      ep.ThrottleState(),
+		Backfill:      ep.BackfillStatus(),
+	}
+	if err := ep.countLocalTables(b.LocalDB.Tables); err != nil {
+		b.Errors = append(b.Errors, fmt.Sprintf("table sizes: %v", err))
+	}
+	backlog, err := ep.LocalBacklog()
+	if err != nil {
+		b.Errors = append(b.Errors, fmt.Sprintf("backlog: %v", err))
+	}
+	b.LocalDB.Backlog = backlog
+	return b
+}
+
+// countLocalTables counts the rows of every local cache table.
+func (ep *EdgeProcessor) countLocalTables(counts map[string]int64) error {
+	rows, err := ep.localDB.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	for _, name := range names {
+		var n int64
+		quoted := `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		if err := ep.localDB.QueryRow(`SELECT COUNT(*) FROM ` + quoted).Scan(&n); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		counts[name] = n
+	}
+	return nil
+}
+
+// uploadDiagnostics answers a diagnostics command.
+func (ep *EdgeProcessor) uploadDiagnostics(cmd FleetCommand) error {
+	var p struct {
+		LogLines int `json:"log_lines"`
+	}
+	if len(cmd.Params) > 0 {
+		if err := decodeCommandParams(cmd, &p); err != nil {
+			return err
+		}
+	}
+	if p.LogLines <= 0 {
+		p.LogLines = defaultDiagnosticsLines
+	}
+	db := ep.cloud.DB()
+	if db == nil {
+		return fmt.Errorf("cloud database offline")
+	}
+
+	bundle := ep.collectDiagnostics(p.LogLines)
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to encode diagnostics: %v", err)
+	}
+	var commandID interface{}
+	if cmd.ID > 0 {
+		commandID = cmd.ID
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsUploadTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO device_diagnostics (device_external_id, command_id, collected_at, bundle)
+		VALUES ($1, $2, $3, $4)
+	`, ep.deviceID, commandID, bundle.CollectedAt, string(data)); err != nil {
+		return fmt.Errorf("failed to upload diagnostics: %v", err)
+	}
+	ep.logger.Info("Uploaded diagnostics", "component", "fleet", "command_id", cmd.ID,
+		"log_lines", len(bundle.Logs), "bytes", len(data))
+	return nil
+}
@@ -0,0 +1,228 @@
+// Compute Schedule - cycles on wall-clock slots
+// Cycles run on slots fixed to the clock rather than wherever a ticker
+// started: every compute_interval_sec counted from the Unix epoch (900 s
+// gives :00/:15/:30/:45 UTC), or the times matched by a five-field cron
+// expression in compute_schedule (minute hour day-of-month month
+// day-of-week, in UTC; *, lists, ranges and /steps). A cycle's cells,
+// batch and zone stats are stamped with its slot, so every device on the
+// same schedule produces grids with the same timestamps and the cloud can
+// join fields without resampling.
+//
+// compute_jitter_sec spreads the fleet's uploads: each device waits a
+// fixed delay in [0, compute_jitter_sec) after every slot, derived from
+// its device and field IDs, and still stamps the slot. Cycles brought
+// forward by sensor events (compute_triggers.go), fleet commands and the
+// CLI aren't on a slot and are stamped when they run. A slot missed
+// because a cycle overran is skipped, not run late. On multi-field
+// gateways the field scheduler grants each field its slots the same way.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// computeSchedule is when a processor's cycles are due.
+type computeSchedule struct {
+	cron     *cronSchedule // nil = every interval from the epoch
+	interval time.Duration
+	offset   time.Duration // this device's jitter
+}
+
+// computeSchedule builds the processor's schedule; safe to call from
+// other goroutines.
+func (ep *EdgeProcessor) computeSchedule() computeSchedule {
+	ep.stateMu.RLock()
+	c := ep.config
+	ep.stateMu.RUnlock()
+
+	s := computeSchedule{interval: time.Duration(c.ComputeInterval) * time.Second}
+	if c.ComputeSchedule != "" {
+		cron, err := parseCron(c.ComputeSchedule)
+		if err != nil {
+			// Validated at load; an interval schedule is the safe fallback
+			ep.logger.Warn("Invalid compute_schedule, using compute_interval_sec", "component", "schedule", "error", err)
+		} else {
+			s.cron = cron
+		}
+	}
+	if c.ComputeJitterSec > 0 {
+		h := fnv.New64a()
+		h.Write([]byte(ep.deviceID + "/" + c.FieldID))
+		s.offset = time.Duration(h.Sum64()%uint64(c.ComputeJitterSec*1000)) * time.Millisecond
+	}
+	return s
+}
+
+// next is the first slot after t.
+func (s computeSchedule) next(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(t)
+	}
+	if s.interval <= 0 {
+		return t
+	}
+	ns, step := t.UnixNano(), s.interval.Nanoseconds()
+	from := ns - ns%step
+	if ns < 0 && ns%step != 0 {
+		from -= step
+	}
+	return time.Unix(0, from+step).UTC()
+}
+
+// upcoming is the first slot that isn't due yet at now.
+func (s computeSchedule) upcoming(now time.Time) time.Time {
+	return s.next(now.Add(-s.offset))
+}
+
+// due reports whether slot's cycle should run at now.
+func (s computeSchedule) due(slot, now time.Time) bool {
+	return !now.Before(slot.Add(s.offset))
+}
+
+// resetComputeTimer points t at the upcoming slot and returns the slot.
+func (ep *EdgeProcessor) resetComputeTimer(t *time.Timer) time.Time {
+	s := ep.computeSchedule()
+	now := ep.clock.Now()
+	slot := s.upcoming(now)
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(slot.Add(s.offset).Sub(now))
+	return slot
+}
+
+// cycleTime is the nominal time of the cycle in progress.
+func (ep *EdgeProcessor) cycleTime() time.Time {
+	if !ep.cycleAt.IsZero() {
+		return ep.cycleAt
+	}
+	return ep.clock.Now()
+}
+
+// cronSchedule is a parsed five-field cron expression; bit n of a field
+// is set when value n matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// cronMaxSearch bounds next; any satisfiable expression matches within
+// it (29 February can be 8 years away).
+const cronMaxSearch = 9 * 366 * 24 * time.Hour
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day-of-month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day-of-week: %v", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domAny, c.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	if c.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of *, n, a-b, with an
+// optional /step.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max // n/step runs from n to the end
+			}
+		}
+		if lo < min || hi > max {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches applies cron's rule that a restricted day-of-month and
+// day-of-week match when either does.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// next is the first matching minute after t (UTC), or zero if none
+// within cronMaxSearch.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronMaxSearch)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,144 @@
+// Compute Triggers - event-driven cycles on significant sensor change
+// The compute schedule alone leaves a fast event (irrigation starting, a
+// storm front) out of the grid for up to compute_interval_sec. With
+// event_trigger_delta_vwc set, the main loop checks every event_check_sec
+// for readings that arrived since the last check and compares each with the
+// last grid's cell nearest the probe (after the same registry normalization
+// the cycle applies); a surface or root moisture that differs from the cell
+// by more than the delta makes a cycle due now.
+//
+// Cycles stay at least event_min_spacing_sec apart, counting scheduled
+// cycles, so a burst of uplinks can't turn into back-to-back recomputes; an
+// event inside the guard runs when it ends. Any cycle clears the pending
+// event. Under a FieldScheduler the event only marks the field due and the
+// scheduler grants it like any other cycle.
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+const (
+	defaultEventCheckSec      = 60
+	defaultEventMinSpacingSec = 120
+)
+
+// eventTriggersEnabled reports whether readings can trigger cycles.
+func (ep *EdgeProcessor) eventTriggersEnabled() bool {
+	return ep.config.EventTriggerDeltaVWC > 0
+}
+
+func (ep *EdgeProcessor) eventCheckInterval() time.Duration {
+	if ep.config.EventCheckSec > 0 {
+		return time.Duration(ep.config.EventCheckSec) * time.Second
+	}
+	return defaultEventCheckSec * time.Second
+}
+
+// eventDue reports whether a pending event may run a cycle now. Safe to
+// call from the scheduler.
+func (ep *EdgeProcessor) eventDue() bool {
+	if !ep.eventPending.Load() {
+		return false
+	}
+	spacing := time.Duration(ep.eventMinSpacingSec.Load()) * time.Second
+	last := ep.health.LastCycle()
+	return last.IsZero() || time.Since(last) >= spacing
+}
+
+// checkSensorEvents looks at readings since the last check and marks an
+// event pending when one has moved away from the grid.
+func (ep *EdgeProcessor) checkSensorEvents() {
+	spacing := ep.config.EventMinSpacingSec
+	if spacing <= 0 {
+		spacing = defaultEventMinSpacingSec
+	}
+	ep.eventMinSpacingSec.Store(int64(spacing))
+
+	now := ep.clock.Now()
+	since := ep.eventWatermark
+	if since.IsZero() {
+		// Readings before the first check are in the grid already or the
+		// next scheduled cycle's business
+		ep.eventWatermark = now
+		return
+	}
+	if ep.eventPending.Load() {
+		return
+	}
+	grid := ep.lastGrid
+	if len(grid) == 0 {
+		return
+	}
+
+	readings, err := ep.readingsSince(since, now)
+	if err != nil {
+		ep.logger.Warn("Event check failed", "component", "triggers", "error", err)
+		return
+	}
+	ep.normalizeReadings(readings)
+	for _, r := range readings {
+		if r.Timestamp.After(ep.eventWatermark) {
+			ep.eventWatermark = r.Timestamp
+		}
+	}
+
+	delta := ep.config.EventTriggerDeltaVWC
+	for _, r := range readings {
+		cell, ok := ep.nearestCell(grid, r)
+		if !ok {
+			continue
+		}
+		change := 0.0
+		if !r.noSurface {
+			change = math.Abs(r.MoistureSurface - cell.MoistureSurface)
+		}
+		if !r.noRoot {
+			change = math.Max(change, math.Abs(r.MoistureRoot-cell.MoistureRoot))
+		}
+		if change > delta {
+			ep.eventPending.Store(true)
+			ep.logger.Info("Sensor change triggers a cycle", "component", "triggers", "sensor_id", r.SensorID,
+				"grid_id", cell.GridID, "change_vwc", change, "delta_vwc", delta)
+			return
+		}
+	}
+}
+
+// readingsSince fetches the field's valid readings in (from, to], from the
+// cloud when it answers and the local cache otherwise. Unlike
+// fetchSensorsBetween it doesn't trace or mirror them; the cycle will. Both
+// convert them to canonical units.
+func (ep *EdgeProcessor) readingsSince(from, to time.Time) ([]SensorReading, error) {
+	if db := ep.cloud.DB(); db != nil {
+		if readings, err := ep.querySensors(db, cloudSensorQuery, from, to); err == nil {
+			return ep.canonicalizeReadings(readings), nil
+		}
+	}
+	readings, err := ep.querySensors(ep.localDB, localSensorQuery, readingTimestamp(from), readingTimestamp(to))
+	if err != nil {
+		return nil, err
+	}
+	return ep.canonicalizeReadings(readings), nil
+}
+
+// nearestCell returns the grid cell nearest a reading, if the reading is
+// within one cell of it.
+func (ep *EdgeProcessor) nearestCell(grid []VirtualGridPoint, r SensorReading) (VirtualGridPoint, bool) {
+	at := orb.Point{r.Longitude, r.Latitude}
+	best, bestDist := -1, math.Inf(1)
+	for i, p := range grid {
+		if d := geo.Distance(at, orb.Point{p.Longitude, p.Latitude}); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	if best < 0 || bestDist > ep.config.GridResolution {
+		return VirtualGridPoint{}, false
+	}
+	return grid[best], true
+}
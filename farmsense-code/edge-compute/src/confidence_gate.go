@@ -0,0 +1,105 @@
+// Confidence Gate - low-confidence cells defer to their zone
+// A cell interpolated from one or two sensors, or from badly spread ones,
+// can swing to "high" or "critical" on a single flaky probe, and one such
+// cell is enough to start a pivot. Cells whose Confidence is below
+// min_need_confidence therefore never raise an urgent need on their own:
+// a high/critical cell takes the need of the confident cells of its
+// management zone (classified from their mean deficit and stress, like a
+// zone), or of the whole field outside zones, and is flagged
+// need_flag "low_confidence". With no confident cell to defer to the cell
+// is capped at "medium".
+//
+// The gate runs before zone aggregation, so gated cells don't count
+// toward a zone's stressed area either.
+
+package main
+
+const defaultMinNeedConfidence = 0.3
+
+// Need flags
+const NeedFlagLowConfidence = "low_confidence"
+
+func (c EdgeConfig) minNeedConfidence() float64 {
+	if c.MinNeedConfidence <= 0 {
+		return defaultMinNeedConfidence
+	}
+	return c.MinNeedConfidence
+}
+
+// needConsensus grades the mean deficit and stress of a set of cells.
+type needConsensus struct {
+	deficit, stress float64
+	n               int
+}
+
+func (c *needConsensus) add(p VirtualGridPoint) {
+	c.deficit += p.WaterDeficit
+	c.stress += p.StressIndex
+	c.n++
+}
+
+func (ep *EdgeProcessor) consensusNeed(c needConsensus) (string, bool) {
+	if c.n == 0 {
+		return "", false
+	}
+	return ep.classifyIrrigationNeed(c.deficit/float64(c.n), c.stress/float64(c.n)), true
+}
+
+// applyConfidenceGate replaces the urgent needs of low-confidence cells
+// with their zone's consensus.
+func (ep *EdgeProcessor) applyConfidenceGate(points []VirtualGridPoint) {
+	minConf := ep.config.minNeedConfidence()
+	zoneOf := func(p VirtualGridPoint) int {
+		if ep.zones == nil {
+			return -1
+		}
+		return ep.zones.zoneOf(p)
+	}
+
+	var field needConsensus
+	var zones map[int]*needConsensus
+	gated := false
+	for _, p := range points {
+		if p.Confidence < minConf {
+			gated = gated || irrigationNeedRank[p.IrrigationNeed] >= irrigationNeedRank["high"]
+			continue
+		}
+		field.add(p)
+		if idx := zoneOf(p); idx >= 0 {
+			if zones == nil {
+				zones = make(map[int]*needConsensus)
+			}
+			if zones[idx] == nil {
+				zones[idx] = &needConsensus{}
+			}
+			zones[idx].add(p)
+		}
+	}
+	if !gated {
+		return
+	}
+
+	fieldNeed, fieldOK := ep.consensusNeed(field)
+	held := 0
+	for i := range points {
+		p := &points[i]
+		if p.Confidence >= minConf || irrigationNeedRank[p.IrrigationNeed] < irrigationNeedRank["high"] {
+			continue
+		}
+		need, ok := "", false
+		if zc := zones[zoneOf(*p)]; zc != nil {
+			need, ok = ep.consensusNeed(*zc)
+		}
+		if !ok {
+			need, ok = fieldNeed, fieldOK
+		}
+		if !ok {
+			need = "medium"
+		}
+		p.IrrigationNeed = need
+		p.NeedFlag = NeedFlagLowConfidence
+		held++
+	}
+	ep.cycleLog.Info("Deferred low-confidence cells to zone consensus", "component", "confidence_gate",
+		"cells", held, "min_confidence", minConf)
+}
@@ -0,0 +1,293 @@
+// Crop Model - FAO-56 crop coefficient by growth stage
+// A field's crop type and planting date (budbreak for perennials) place it
+// on a four-stage Kc curve: flat Kc_ini through the initial stage, linear
+// rise through development, flat Kc_mid, linear decline to Kc_end. The
+// daily Kc times reference ET0 gives crop water use ETc, and the stage
+// also sets the active root depth and the depletion fraction p at which
+// the crop starts to stress. With a crop model configured:
+//   - water_deficit_mm is root-zone depletion projected 24 h ahead
+//     (current depletion + ETc), i.e. what refills the root zone by tomorrow
+//   - irrigation_need compares that projection with readily available
+//     water (RAW = p × TAW), so a vineyard at 40% depletion can wait while
+//     lettuce at the same depletion cannot; irrigation_thresholds can set
+//     the allowed depletion per crop and stage instead of p
+//
+// Without one, the original fixed 60 cm / absolute-mm thresholds apply.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	fieldCapacityVWC = 0.35 // matches calculateWaterDeficit
+	wiltingPointVWC  = 0.15
+	minRootDepthM    = 0.2 // at planting for annuals
+)
+
+// CropStageCurve is a crop's FAO-56 stage lengths and coefficients.
+type CropStageCurve struct {
+	InitialDays       int     `json:"initial_days"`
+	DevelopmentDays   int     `json:"development_days"`
+	MidDays           int     `json:"mid_days"`
+	LateDays          int     `json:"late_days"`
+	KcIni             float64 `json:"kc_ini"`
+	KcMid             float64 `json:"kc_mid"`
+	KcEnd             float64 `json:"kc_end"`
+	RootDepthM        float64 `json:"root_depth_m"`       // Maximum effective rooting depth
+	DepletionFraction float64 `json:"depletion_fraction"` // p: share of TAW usable before stress
+	Perennial         bool    `json:"perennial"`          // Roots don't grow from planting depth
+}
+
+// CropModel places a field on a growth-stage curve.
+type CropModel struct {
+	CropType     string          `json:"crop_type"`
+	PlantingDate string          `json:"planting_date"`    // YYYY-MM-DD; budbreak for perennials
+	Stages       *CropStageCurve `json:"stages,omitempty"` // Overrides the built-in curve for crop_type
+
+	SalinityThresholdDSm float64 `json:"salinity_threshold_dsm"` // ECe where yield loss starts (overrides the built-in tolerance)
+	SalinitySlopePct     float64 `json:"salinity_slope_pct"`     // Yield loss % per dS/m above it
+}
+
+// Built-in curves from FAO-56 Tables 11, 12 and 22
+var cropCurves = map[string]CropStageCurve{
+	"maize":   {30, 40, 50, 30, 0.30, 1.20, 0.60, 1.0, 0.55, false},
+	"wheat":   {20, 25, 60, 30, 0.30, 1.15, 0.40, 1.5, 0.55, false},
+	"soybean": {20, 30, 60, 25, 0.40, 1.15, 0.50, 0.9, 0.50, false},
+	"cotton":  {30, 50, 60, 55, 0.35, 1.15, 0.50, 1.5, 0.65, false},
+	"potato":  {25, 30, 45, 30, 0.50, 1.15, 0.75, 0.5, 0.35, false},
+	"tomato":  {30, 40, 40, 25, 0.60, 1.15, 0.80, 1.0, 0.40, false},
+	"lettuce": {20, 30, 15, 10, 0.70, 1.00, 0.95, 0.4, 0.30, false},
+	"spinach": {20, 20, 15, 5, 0.70, 1.00, 0.95, 0.4, 0.20, false},
+	"grapes":  {30, 60, 40, 80, 0.30, 0.70, 0.45, 1.5, 0.45, true},
+	"almonds": {30, 50, 130, 30, 0.40, 0.90, 0.65, 1.5, 0.40, true},
+}
+
+// Growth stages
+const (
+	StagePrePlant    = "pre_plant"
+	StageInitial     = "initial"
+	StageDevelopment = "development"
+	StageMid         = "mid_season"
+	StageLate        = "late_season"
+	StagePostHarvest = "post_harvest"
+)
+
+// CropDay is the crop model evaluated for one day.
+type CropDay struct {
+	CropType    string    `json:"crop_type"`
+	Date        time.Time `json:"date"`
+	DaysAfter   int       `json:"days_after_planting"`
+	Stage       string    `json:"stage"`
+	Kc          float64   `json:"kc"`
+	ET0MM       float64   `json:"et0_mm"`
+	ETcMM       float64   `json:"etc_mm"`
+	RootDepthMM float64   `json:"root_depth_mm"`
+	TAWMM       float64   `json:"taw_mm"`
+	RAWMM       float64   `json:"raw_mm"`
+	MADPct      float64   `json:"mad_pct"` // management allowed depletion behind RAWMM
+	ET0Known    bool      `json:"et0_known"`
+
+	NeedBreakpoints []float64 `json:"need_breakpoints,omitempty"` // nil = defaultNeedBreakpoints
+	ThresholdSource string    `json:"threshold_source"`           // crop_curve | config (irrigation_thresholds.go)
+}
+
+// curve returns the configured or built-in curve for the model.
+func (m *CropModel) curve() (CropStageCurve, error) {
+	if m.Stages != nil {
+		return *m.Stages, nil
+	}
+	c, ok := cropCurves[m.CropType]
+	if !ok {
+		return CropStageCurve{}, fmt.Errorf("unknown crop_type %q and no stages given", m.CropType)
+	}
+	return c, nil
+}
+
+// evaluate returns stage, Kc and root depth (m) on a given day.
+func (c CropStageCurve) evaluate(daysAfter int) (string, float64, float64) {
+	d := float64(daysAfter)
+	ini := float64(c.InitialDays)
+	dev := ini + float64(c.DevelopmentDays)
+	mid := dev + float64(c.MidDays)
+	end := mid + float64(c.LateDays)
+
+	rootMin := minRootDepthM
+	if c.Perennial || rootMin > c.RootDepthM {
+		rootMin = c.RootDepthM
+	}
+	// Roots reach full depth at the start of mid-season
+	root := rootMin + (c.RootDepthM-rootMin)*math.Min(math.Max(d/dev, 0), 1)
+
+	switch {
+	case d < 0:
+		return StagePrePlant, c.KcIni, rootMin
+	case d < ini:
+		return StageInitial, c.KcIni, root
+	case d < dev:
+		return StageDevelopment, c.KcIni + (c.KcMid-c.KcIni)*(d-ini)/(dev-ini), root
+	case d < mid:
+		return StageMid, c.KcMid, root
+	case d < end:
+		return StageLate, c.KcMid + (c.KcEnd-c.KcMid)*(d-mid)/(end-mid), root
+	default:
+		return StagePostHarvest, c.KcEnd, root
+	}
+}
+
+// cropDayFor evaluates the model on date with reference ET0 (mm/day).
+func cropDayFor(m *CropModel, date time.Time, et0 float64, et0Known bool) (*CropDay, error) {
+	curve, err := m.curve()
+	if err != nil {
+		return nil, err
+	}
+	planted, err := time.Parse("2006-01-02", m.PlantingDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid planting_date %q: %v", m.PlantingDate, err)
+	}
+
+	days := int(math.Floor(date.Sub(planted).Hours() / 24))
+	stage, kc, rootM := curve.evaluate(days)
+	rootMM := rootM * 1000
+	taw := (fieldCapacityVWC - wiltingPointVWC) * rootMM
+	return &CropDay{
+		CropType:    m.CropType,
+		Date:        date,
+		DaysAfter:   days,
+		Stage:       stage,
+		Kc:          kc,
+		ET0MM:       et0,
+		ETcMM:       kc * et0,
+		RootDepthMM: rootMM,
+		TAWMM:       taw,
+		RAWMM:       curve.DepletionFraction * taw,
+		MADPct:      curve.DepletionFraction * 100,
+		ET0Known:    et0Known,
+
+		ThresholdSource: "crop_curve",
+	}, nil
+}
+
+// fetchReferenceET0 sums ET0 reported over the last 24 h, from the
+// field's weather stations when they report it (weather_stations.go).
+func (ep *EdgeProcessor) fetchReferenceET0(now time.Time) (float64, bool, error) {
+	if len(ep.config.WeatherStations) > 0 {
+		if et0, n, err := ep.stationWeatherSum("et0_mm", now.Add(-24*time.Hour), now); err != nil || n > 0 {
+			return et0, n > 0, err
+		}
+	}
+	query := `
+		SELECT COUNT(et0_mm), COALESCE(SUM(et0_mm), 0)
+		FROM weather_data
+		WHERE field_id = $1
+		  AND timestamp > $2
+		  AND timestamp <= $3
+		  AND et0_mm IS NOT NULL
+	`
+
+	db := ep.cloud.DB()
+	if db == nil {
+		db = ep.localDB
+	}
+
+	var n int
+	var et0 float64
+	if err := db.QueryRow(query, ep.config.FieldID, now.Add(-24*time.Hour), now).Scan(&n, &et0); err != nil {
+		return 0, false, err
+	}
+	return et0, n > 0, nil
+}
+
+// updateCropDay evaluates the crop model for this cycle.
+func (ep *EdgeProcessor) updateCropDay(now time.Time) {
+	day := ep.cropDayAt(now)
+	ep.cycleCrop = day
+	if day == nil {
+		return
+	}
+
+	ep.stateMu.Lock()
+	ep.cropDay = day
+	ep.stateMu.Unlock()
+	ep.cycleLog.Debug("Crop coefficient", "stage", day.Stage, "kc", day.Kc, "etc_mm", day.ETcMM)
+}
+
+// cropDayAt evaluates the crop growing at now (see cropModelAt), or
+// returns nil without one.
+func (ep *EdgeProcessor) cropDayAt(now time.Time) *CropDay {
+	crop := ep.cropModelAt(now)
+	if crop == nil {
+		return nil
+	}
+	et0, known, err := ep.fetchReferenceET0(now)
+	if err != nil {
+		ep.cycleLog.Warn("ET0 lookup failed, using soil depletion only", "component", "crop_model", "error", err)
+	}
+	day, err := cropDayFor(crop, now, et0, known)
+	if err != nil {
+		ep.cycleLog.Error("Crop model unavailable", "component", "crop_model", "error", err)
+		return nil
+	}
+	applyNeedThreshold(day, ep.config.IrrigationThresholds)
+	return day
+}
+
+// CropDay returns the latest crop model evaluation, or nil.
+func (ep *EdgeProcessor) CropDay() *CropDay {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return ep.cropDay
+}
+
+// classifyByRAW grades projected depletion against readily available
+// water at the given breakpoints (nil = defaultNeedBreakpoints).
+func classifyByRAW(projectedDeficit, raw float64, breakpoints []float64) string {
+	if raw <= 0 {
+		return "critical"
+	}
+	if len(breakpoints) != 4 {
+		breakpoints = defaultNeedBreakpoints
+	}
+	ratio := projectedDeficit / raw
+	switch {
+	case ratio < breakpoints[0]:
+		return "none"
+	case ratio < breakpoints[1]:
+		return "low"
+	case ratio < breakpoints[2]:
+		return "medium"
+	case ratio < breakpoints[3]:
+		return "high"
+	default:
+		return "critical"
+	}
+}
+
+var irrigationNeedRank = map[string]int{"none": 0, "low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// worseNeed returns the more urgent of two irrigation need classes.
+func worseNeed(a, b string) string {
+	if irrigationNeedRank[b] > irrigationNeedRank[a] {
+		return b
+	}
+	return a
+}
+
+// classifyStress grades the stress index on the same scale as irrigation need.
+func classifyStress(stressIndex float64) string {
+	switch {
+	case stressIndex < 0.2:
+		return "none"
+	case stressIndex < 0.4:
+		return "low"
+	case stressIndex < 0.6:
+		return "medium"
+	case stressIndex < 0.8:
+		return "high"
+	default:
+		return "critical"
+	}
+}
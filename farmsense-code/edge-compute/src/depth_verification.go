@@ -0,0 +1,287 @@
+// Install Depth Verification - catches probes that aren't where they claim to be
+// The diurnal soil temperature wave is damped and delayed with depth:
+//
+//	A(z)   = A0 * exp(-z/d)
+//	lag(z) = z / (d * ω)            ω = 2π / 24h
+//
+// where d is the soil's damping depth (~10-15 cm). For each recently
+// installed probe we fit a 24h sinusoid to its temperature, infer the depth
+// that best explains its amplitude and lag relative to established probes in
+// the same field, and flag it for re-installation if that disagrees with the
+// declared depth. Flagged probes are kept out of interpolation.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	depthCheckInterval     = 6 * time.Hour
+	depthCheckHistory      = 72 * time.Hour
+	depthCheckMinSpan      = 48 * time.Hour
+	depthCheckMinSamples   = 24
+	defaultNewInstallDays  = 14
+	defaultDampingDepthCm  = 12.0
+	diurnalOmegaPerHour    = 2 * math.Pi / 24.0
+	minDepthToleranceCm    = 10.0
+	relativeDepthTolerance = 0.4
+)
+
+// Depth check outcomes
+const (
+	DepthOK               = "ok"
+	DepthTooShallow       = "too_shallow" // typically not fully inserted
+	DepthTooDeep          = "too_deep"    // typically mislabeled depth
+	DepthInsufficientData = "insufficient_data"
+	DepthNoReference      = "no_reference"
+)
+
+// DepthCheck is the verification result for a single probe.
+type DepthCheck struct {
+	SensorID        string    `json:"sensor_id"`
+	DeclaredDepthCm float64   `json:"declared_depth_cm"`
+	InferredDepthCm float64   `json:"inferred_depth_cm"`
+	AmplitudeC      float64   `json:"amplitude_c"`
+	PeakHourUTC     float64   `json:"peak_hour_utc"`
+	Status          string    `json:"status"`
+	NeedsReinstall  bool      `json:"needs_reinstall"`
+	CheckedAt       time.Time `json:"checked_at"`
+}
+
+// diurnalFit is a least-squares fit of T(t) = m + c*t + a*cos(ωt) + b*sin(ωt)
+type diurnalFit struct {
+	amplitude float64
+	peakHour  float64 // hour of day (UTC) of the temperature maximum
+}
+
+func fitDiurnal(readings []SensorReading) (diurnalFit, bool) {
+	if len(readings) < depthCheckMinSamples {
+		return diurnalFit{}, false
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Timestamp.Before(readings[j].Timestamp) })
+	if readings[len(readings)-1].Timestamp.Sub(readings[0].Timestamp) < depthCheckMinSpan {
+		return diurnalFit{}, false
+	}
+
+	// Normal equations for [m, c, a, b]; time in hours since the first UTC midnight
+	origin := readings[0].Timestamp.UTC().Truncate(24 * time.Hour)
+	var ata [4][4]float64
+	var atb [4]float64
+	for _, r := range readings {
+		t := r.Timestamp.Sub(origin).Hours()
+		row := [4]float64{1, t, math.Cos(diurnalOmegaPerHour * t), math.Sin(diurnalOmegaPerHour * t)}
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				ata[i][j] += row[i] * row[j]
+			}
+			atb[i] += row[i] * r.TempSurface
+		}
+	}
+
+	coef, ok := solve4(ata, atb)
+	if !ok {
+		return diurnalFit{}, false
+	}
+	a, b := coef[2], coef[3]
+	peak := math.Atan2(b, a) / diurnalOmegaPerHour
+	if peak < 0 {
+		peak += 24
+	}
+	return diurnalFit{amplitude: math.Hypot(a, b), peakHour: peak}, true
+}
+
+// solve4 solves a 4x4 linear system by Gaussian elimination with partial pivoting.
+func solve4(a [4][4]float64, b [4]float64) ([4]float64, bool) {
+	for col := 0; col < 4; col++ {
+		pivot := col
+		for r := col + 1; r < 4; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return [4]float64{}, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for r := col + 1; r < 4; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c < 4; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	var x [4]float64
+	for r := 3; r >= 0; r-- {
+		sum := b[r]
+		for c := r + 1; c < 4; c++ {
+			sum -= a[r][c] * x[c]
+		}
+		x[r] = sum / a[r][r]
+	}
+	return x, true
+}
+
+// wrapHours maps an hour difference into [-12, 12)
+func wrapHours(h float64) float64 {
+	h = math.Mod(h+12, 24)
+	if h < 0 {
+		h += 24
+	}
+	return h - 12
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// verifyInstallDepths runs the depth check for all recently installed probes.
+func (ep *EdgeProcessor) verifyInstallDepths(now time.Time) []DepthCheck {
+	installs := ep.SensorInstalls()
+	if len(installs) == 0 {
+		return nil
+	}
+
+	history, err := ep.fetchRecentSensors(depthCheckHistory)
+	if err != nil {
+		ep.logger.Error("Failed to fetch sensor history for depth check", "component", "depth_check", "error", err)
+		return nil
+	}
+	bySensor := make(map[string][]SensorReading)
+	for _, r := range history {
+		bySensor[r.SensorID] = append(bySensor[r.SensorID], r)
+	}
+
+	d := ep.config.SoilDampingDepthCm
+	if d <= 0 {
+		d = defaultDampingDepthCm
+	}
+	newWindow := time.Duration(ep.config.NewInstallDays) * 24 * time.Hour
+	if newWindow <= 0 {
+		newWindow = defaultNewInstallDays * 24 * time.Hour
+	}
+
+	// Established probes define the field's surface wave (A0, peak hour at z=0)
+	surfaceAmps := make([]float64, 0)
+	surfacePeaks := make([]float64, 0)
+	candidates := make([]SensorInstall, 0)
+	for _, inst := range installs {
+		if inst.DepthCm <= 0 {
+			continue // no declared depth to verify against
+		}
+		if now.Sub(inst.InstalledAt) < newWindow {
+			candidates = append(candidates, inst)
+			continue
+		}
+		if prev, ok := ep.depthChecks[inst.SensorID]; ok && prev.NeedsReinstall {
+			continue
+		}
+		fit, ok := fitDiurnal(bySensor[inst.SensorID])
+		if !ok || fit.amplitude <= 0 {
+			continue
+		}
+		surfaceAmps = append(surfaceAmps, fit.amplitude*math.Exp(inst.DepthCm/d))
+		surfacePeaks = append(surfacePeaks, fit.peakHour-inst.DepthCm/(d*diurnalOmegaPerHour))
+	}
+
+	results := make([]DepthCheck, 0, len(candidates))
+	for _, inst := range candidates {
+		check := DepthCheck{
+			SensorID:        inst.SensorID,
+			DeclaredDepthCm: inst.DepthCm,
+			CheckedAt:       now,
+		}
+
+		fit, ok := fitDiurnal(bySensor[inst.SensorID])
+		switch {
+		case !ok || fit.amplitude <= 0:
+			check.Status = DepthInsufficientData
+		case len(surfaceAmps) == 0:
+			check.Status = DepthNoReference
+			check.AmplitudeC = fit.amplitude
+			check.PeakHourUTC = fit.peakHour
+		default:
+			check.AmplitudeC = fit.amplitude
+			check.PeakHourUTC = fit.peakHour
+
+			a0 := median(surfaceAmps)
+			depthFromAmp := d * math.Log(a0/fit.amplitude)
+			depthFromLag := wrapHours(fit.peakHour-median(surfacePeaks)) * d * diurnalOmegaPerHour
+			check.InferredDepthCm = math.Max((depthFromAmp+depthFromLag)/2, 0)
+
+			tolerance := math.Max(minDepthToleranceCm, relativeDepthTolerance*inst.DepthCm)
+			switch diff := check.InferredDepthCm - inst.DepthCm; {
+			case diff < -tolerance:
+				check.Status = DepthTooShallow
+				check.NeedsReinstall = true
+			case diff > tolerance:
+				check.Status = DepthTooDeep
+				check.NeedsReinstall = true
+			default:
+				check.Status = DepthOK
+			}
+		}
+
+		if check.NeedsReinstall {
+			ep.logger.Warn("Sensor flagged for re-installation", "component", "depth_check",
+				"sensor_id", check.SensorID, "declared_depth_cm", check.DeclaredDepthCm,
+				"inferred_depth_cm", check.InferredDepthCm, "status", check.Status)
+		}
+		ep.stateMu.Lock()
+		ep.depthChecks[inst.SensorID] = check
+		ep.stateMu.Unlock()
+		results = append(results, check)
+	}
+
+	return results
+}
+
+// maybeVerifyInstallDepths rate-limits depth verification to depthCheckInterval.
+func (ep *EdgeProcessor) maybeVerifyInstallDepths() {
+	now := time.Now()
+	if now.Sub(ep.lastDepthCheck) < depthCheckInterval {
+		return
+	}
+	ep.lastDepthCheck = now
+	ep.verifyInstallDepths(now)
+}
+
+// DepthChecks returns a snapshot of the latest verification results.
+func (ep *EdgeProcessor) DepthChecks() []DepthCheck {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	checks := make([]DepthCheck, 0, len(ep.depthChecks))
+	for _, c := range ep.depthChecks {
+		checks = append(checks, c)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].SensorID < checks[j].SensorID })
+	return checks
+}
+
+// excludeMisinstalledSensors drops readings from probes flagged for re-installation.
+func (ep *EdgeProcessor) excludeMisinstalledSensors(sensors []SensorReading) []SensorReading {
+	if len(ep.depthChecks) == 0 {
+		return sensors
+	}
+	kept := make([]SensorReading, 0, len(sensors))
+	for _, s := range sensors {
+		if check, ok := ep.depthChecks[s.SensorID]; ok && check.NeedsReinstall {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept
+}
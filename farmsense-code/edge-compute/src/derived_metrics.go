@@ -0,0 +1,149 @@
+// Derived Metrics - per-cell metrics computed from the interpolated values
+// Once a cell's sensor variables are estimated, each DerivedMetric in the
+// registry computes from them, in registration order, so a metric can use
+// the ones before it. Water deficit, stress index and irrigation need are
+// built in and always run; the rest of the pipeline (zones, alerts, VRI)
+// depends on them. Optional metrics run only on fields that list them in
+// derived_metrics (or a fields entry's derived_metrics on a gateway) and
+// write to the cell's Variables, so they sync, export and show up in the
+// GeoJSON like any extra channel with no changes elsewhere:
+//   - growing_degree_days: gdd_rate_c_day, the degree-days a day at the
+//     cell's temperature accrues above gdd_base_c
+//   - chill_hours: chill_rate, 1 while the cell is in the 0–7.2 °C chill
+//     band, so summing it over time gives chill hours
+// Both are rates, because cycles aren't evenly spaced (event triggers,
+// backfill steps); accumulate them over time downstream. New metrics
+// register once at init with RegisterDerivedMetric.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// DerivedMetric computes one metric for a cell. Cells are computed in
+// parallel, so Compute must be safe for concurrent use.
+type DerivedMetric struct {
+	Name     string
+	Optional bool // run only on fields listing it in derived_metrics
+	Compute  func(ep *EdgeProcessor, cell *VirtualGridPoint)
+}
+
+// Derived metrics
+const (
+	MetricWaterDeficit      = "water_deficit"
+	MetricStressIndex       = "stress_index"
+	MetricIrrigationNeed    = "irrigation_need"
+	MetricGrowingDegreeDays = "growing_degree_days"
+	MetricChillHours        = "chill_hours"
+)
+
+// Optional metric variables
+const (
+	VarGDDRate   = "gdd_rate_c_day"
+	VarChillRate = "chill_rate"
+)
+
+const (
+	defaultGDDBaseC = 10.0
+	chillMinC       = 0.0
+	chillMaxC       = 7.2
+)
+
+var derivedMetrics = []DerivedMetric{
+	{
+		Name: MetricWaterDeficit,
+		Compute: func(ep *EdgeProcessor, cell *VirtualGridPoint) {
+			cell.WaterDeficit = ep.calculateWaterDeficit(cell.MoistureSurface, cell.MoistureRoot)
+			if vwc, ok := ep.profileRootZoneVWC(*cell); ok {
+				// Depth layers cover the actual root horizon
+				cell.WaterDeficit = ep.rootZoneDeficit(vwc)
+			}
+		},
+	},
+	{
+		Name: MetricStressIndex,
+		Compute: func(ep *EdgeProcessor, cell *VirtualGridPoint) {
+			cell.StressIndex = ep.calculateStressIndex(cell.MoistureSurface, cell.Temperature)
+		},
+	},
+	{
+		Name: MetricIrrigationNeed,
+		Compute: func(ep *EdgeProcessor, cell *VirtualGridPoint) {
+			cell.IrrigationNeed = ep.classifyIrrigationNeed(cell.WaterDeficit, cell.StressIndex)
+		},
+	},
+	{
+		Name:     MetricGrowingDegreeDays,
+		Optional: true,
+		Compute: func(ep *EdgeProcessor, cell *VirtualGridPoint) {
+			base := ep.config.GDDBaseC
+			if base <= 0 {
+				base = defaultGDDBaseC
+			}
+			cell.setVariable(VarGDDRate, math.Max(cell.Temperature-base, 0))
+		},
+	},
+	{
+		Name:     MetricChillHours,
+		Optional: true,
+		Compute: func(ep *EdgeProcessor, cell *VirtualGridPoint) {
+			chill := 0.0
+			if cell.Temperature >= chillMinC && cell.Temperature <= chillMaxC {
+				chill = 1
+			}
+			cell.setVariable(VarChillRate, chill)
+		},
+	},
+}
+
+// RegisterDerivedMetric adds a metric after the registered ones, or
+// replaces the one with its name in place. Call from init; the registry
+// isn't guarded for concurrent change.
+func RegisterDerivedMetric(m DerivedMetric) {
+	for i, existing := range derivedMetrics {
+		if existing.Name == m.Name {
+			derivedMetrics[i] = m
+			return
+		}
+	}
+	derivedMetrics = append(derivedMetrics, m)
+}
+
+// checkDerivedMetrics rejects names that aren't optional registered metrics.
+func checkDerivedMetrics(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, m := range derivedMetrics {
+			if m.Name == name {
+				if !m.Optional {
+					return fmt.Errorf("%s is built in and always computed", name)
+				}
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown metric %q", name)
+		}
+	}
+	return nil
+}
+
+// deriveMetrics runs the field's metrics on an interpolated cell.
+func (ep *EdgeProcessor) deriveMetrics(cell *VirtualGridPoint) {
+	for _, m := range derivedMetrics {
+		if m.Optional && !containsString(ep.config.DerivedMetrics, m.Name) {
+			continue
+		}
+		m.Compute(ep, cell)
+	}
+}
+
+// setVariable stores an extra per-cell value.
+func (p *VirtualGridPoint) setVariable(name string, value float64) {
+	if p.Variables == nil {
+		p.Variables = make(map[string]float64)
+	}
+	p.Variables[name] = value
+}
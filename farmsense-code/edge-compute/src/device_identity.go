@@ -0,0 +1,477 @@
+// Device Identity - hardware-bound device IDs and provisioning
+// A device_id in the config travels with the SD card, so a cloned card
+// gives two gateways the same identity and they overwrite each other's
+// grids, commands and registry row. The identity is tied to the board
+// instead:
+//
+//   - The hardware ID is a fingerprint of the CPU serial (/proc/cpuinfo,
+//     or the device tree's serial-number) and the MAC address of the
+//     first physical network interface. Neither is copied with a card.
+//   - Without device_id in the config, the device ID is the provisioned
+//     one, or edge_ plus the first 12 hex digits of the hardware ID.
+//   - The provision subcommand claims a one-time token from
+//     edge_provisioning_tokens (migration 028), generates an Ed25519 key,
+//     signs "farmsense-provision-v1|device_id|hardware_id|public_key|
+//     token_sha256" and records the device's hardware ID, public key and
+//     signature in edge_device_identities. The key is kept in
+//     device_identity.json (device_identity_path, next to the local
+//     cache by default) along with the hardware ID it was made on.
+//
+// Every cloud connection check then looks the device ID up in
+// edge_device_identities. The cloud handle stays offline, so nothing
+// syncs and results queue locally, while the row belongs to other
+// hardware (each sighting is recorded in edge_identity_conflicts) or its
+// key is not ours, and with require_provisioning while there is no row
+// at all. A gateway that passes signs "farmsense-identity-v1|device_id|
+// hardware_id|unix time" into the row every identityAttestInterval so the
+// backend can verify it against the public key. A card cloned from a
+// provisioned gateway carries its identity file, but the file's hardware
+// ID doesn't match the new board, so it is ignored.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	deviceIdentityFile     = "device_identity.json"
+	provisionSignPrefix    = "farmsense-provision-v1"
+	identitySignPrefix     = "farmsense-identity-v1"
+	identityAttestInterval = 15 * time.Minute
+	provisionTimeout       = 30 * time.Second
+)
+
+// Hardware sources, variables so another board can point elsewhere
+var (
+	cpuInfoPath          = "/proc/cpuinfo"
+	deviceTreeSerialPath = "/sys/firmware/devicetree/base/serial-number"
+	netClassPath         = "/sys/class/net"
+)
+
+// DeviceIdentity is the provisioned identity kept on the device.
+type DeviceIdentity struct {
+	DeviceID      string    `json:"device_id"`
+	HardwareID    string    `json:"hardware_id"`
+	PublicKey     string    `json:"public_key"`  // base64 Ed25519
+	PrivateKey    string    `json:"private_key"` // base64 Ed25519 seed
+	ProvisionedAt time.Time `json:"provisioned_at"`
+}
+
+var (
+	hardwareIDOnce  sync.Once
+	hardwareIDValue string
+	hardwareIDErr   error
+)
+
+// hardwareID returns this board's fingerprint, read once per process.
+func hardwareID() (string, error) {
+	hardwareIDOnce.Do(func() {
+		serial := cpuSerial()
+		mac := primaryMAC()
+		if serial == "" && mac == "" {
+			hardwareIDErr = fmt.Errorf("no CPU serial or network interface MAC found")
+			return
+		}
+		sum := sha256.Sum256([]byte("cpu=" + serial + ";mac=" + mac))
+		hardwareIDValue = hex.EncodeToString(sum[:16])
+	})
+	return hardwareIDValue, hardwareIDErr
+}
+
+// cpuSerial reads the SoC serial number, empty when the board has none.
+func cpuSerial() string {
+	if f, err := os.Open(cpuInfoPath); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if ok && strings.TrimSpace(key) == "Serial" {
+				if serial := strings.TrimLeft(strings.TrimSpace(value), "0"); serial != "" {
+					return serial
+				}
+			}
+		}
+	}
+	if data, err := os.ReadFile(deviceTreeSerialPath); err == nil {
+		return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+	}
+	return ""
+}
+
+// primaryMAC is the address of the first physical interface by name;
+// virtual interfaces (bridges, VPNs, containers) have no device link.
+func primaryMAC() string {
+	entries, err := os.ReadDir(netClassPath)
+	if err != nil {
+		return ""
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(netClassPath, name, "device")); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(netClassPath, name, "address"))
+		if err != nil {
+			continue
+		}
+		if mac := strings.TrimSpace(string(data)); mac != "" && mac != "00:00:00:00:00:00" {
+			return mac
+		}
+	}
+	return ""
+}
+
+// derivedDeviceID is the device ID of unprovisioned hardware.
+func derivedDeviceID(hw string) string {
+	return "edge_" + hw[:12]
+}
+
+func (c EdgeConfig) deviceIdentityPath() string {
+	if c.DeviceIdentityPath != "" {
+		return c.DeviceIdentityPath
+	}
+	return filepath.Join(filepath.Dir(c.LocalCacheDB), deviceIdentityFile)
+}
+
+// loadDeviceIdentity reads the identity file, nil when there is none or
+// it was made on other hardware.
+func loadDeviceIdentity(c EdgeConfig, hw string) (*DeviceIdentity, error) {
+	data, err := os.ReadFile(c.deviceIdentityPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device identity: %v", err)
+	}
+	var id DeviceIdentity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("invalid device identity %s: %v", c.deviceIdentityPath(), err)
+	}
+	if id.HardwareID != hw {
+		slog.Error("Device identity was provisioned on other hardware (cloned card?), ignoring it",
+			"component", "identity", "path", c.deviceIdentityPath(), "device_id", id.DeviceID)
+		return nil, nil
+	}
+	return &id, nil
+}
+
+// resolveDeviceID fills in an unset device_id from the provisioned
+// identity or the hardware.
+func resolveDeviceID(c *EdgeConfig) error {
+	if c.DeviceID != "" {
+		return nil
+	}
+	hw, err := hardwareID()
+	if err != nil {
+		return fmt.Errorf("device_id is not set and the hardware has no identity: %v", err)
+	}
+	id, err := loadDeviceIdentity(*c, hw)
+	if err != nil {
+		return err
+	}
+	if id != nil {
+		c.DeviceID = id.DeviceID
+	} else {
+		c.DeviceID = derivedDeviceID(hw)
+	}
+	return nil
+}
+
+func (id *DeviceIdentity) sign(message string) (string, error) {
+	seed, err := base64.StdEncoding.DecodeString(id.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return "", fmt.Errorf("invalid device identity key")
+	}
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), []byte(message))
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// IdentityStatus is the gate's state, reported by the status command.
+type IdentityStatus struct {
+	DeviceID   string    `json:"device_id"`
+	HardwareID string    `json:"hardware_id,omitempty"`
+	State      string    `json:"state"` // unchecked | verified | unprovisioned | conflict | key_mismatch
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at,omitempty"`
+}
+
+// identityGate holds the cloud handle offline for devices whose identity
+// the cloud doesn't recognize.
+type identityGate struct {
+	deviceID   string
+	hardwareID string
+	identity   *DeviceIdentity // nil = not provisioned on this hardware
+	require    bool
+
+	mu         sync.Mutex
+	status     IdentityStatus
+	attestedAt time.Time
+	logger     *slog.Logger
+}
+
+// newIdentityGate returns nil when there is nothing to check: hardware
+// without an ID and provisioning not required.
+func newIdentityGate(c EdgeConfig, deviceID string) (*identityGate, error) {
+	g := &identityGate{
+		deviceID: deviceID,
+		require:  c.RequireProvisioning,
+		status:   IdentityStatus{DeviceID: deviceID, State: "unchecked"},
+		logger:   slog.With("component", "identity", "device_id", deviceID),
+	}
+	hw, err := hardwareID()
+	if err != nil {
+		if c.RequireProvisioning {
+			return nil, fmt.Errorf("require_provisioning needs a hardware ID: %v", err)
+		}
+		return nil, nil
+	}
+	g.hardwareID, g.status.HardwareID = hw, hw
+	if g.identity, err = loadDeviceIdentity(c, hw); err != nil {
+		return nil, err
+	}
+	if g.identity != nil && g.identity.DeviceID != deviceID {
+		g.logger.Warn("Device identity is for another device_id, treating the device as unprovisioned",
+			"provisioned_as", g.identity.DeviceID)
+		g.identity = nil
+	}
+	return g, nil
+}
+
+// verify checks the device's row in edge_device_identities; an error
+// keeps the cloud handle offline.
+func (g *identityGate) verify(ctx context.Context, db *sql.DB) error {
+	var hw, publicKey string
+	err := db.QueryRowContext(ctx, `
+		SELECT hardware_id, public_key FROM edge_device_identities
+		WHERE device_external_id = $1 AND revoked_at IS NULL
+	`, g.deviceID).Scan(&hw, &publicKey)
+	switch {
+	case err == sql.ErrNoRows:
+		if g.require {
+			return g.set("unprovisioned", fmt.Errorf("device %s is not provisioned; run the provision command with a token", g.deviceID))
+		}
+		g.set("unprovisioned", nil)
+		return nil
+	case err != nil:
+		if g.require {
+			return g.set("unchecked", fmt.Errorf("failed to check device identity: %v", err))
+		}
+		// Clouds without migration 028 keep working
+		g.logger.Debug("Device identity not checked", "error", err)
+		return nil
+	case hw != g.hardwareID:
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO edge_identity_conflicts (device_external_id, hardware_id)
+			VALUES ($1, $2)
+			ON CONFLICT (device_external_id, hardware_id) DO UPDATE
+			SET last_seen_at = NOW(), sightings = edge_identity_conflicts.sightings + 1
+		`, g.deviceID, g.hardwareID); err != nil {
+			g.logger.Warn("Failed to record identity conflict", "error", err)
+		}
+		return g.set("conflict", fmt.Errorf("device %s is provisioned to other hardware (cloned card?); provision this gateway with its own token", g.deviceID))
+	case g.identity == nil || g.identity.PublicKey != publicKey:
+		return g.set("key_mismatch", fmt.Errorf("device %s is provisioned with a key this gateway doesn't hold; provision it again", g.deviceID))
+	}
+
+	g.set("verified", nil)
+	if now := time.Now(); now.Sub(g.attestedAt) >= identityAttestInterval {
+		sig, err := g.identity.sign(identityMessage(g.deviceID, g.hardwareID, now))
+		if err != nil {
+			return g.set("key_mismatch", err)
+		}
+		if _, err := db.ExecContext(ctx, `
+			UPDATE edge_device_identities
+			SET last_seen_at = NOW(), last_signed_at = $2, last_signature = $3
+			WHERE device_external_id = $1
+		`, g.deviceID, now.UTC().Truncate(time.Second), sig); err != nil {
+			g.logger.Warn("Failed to attest device identity", "error", err)
+		} else {
+			g.attestedAt = now
+		}
+	}
+	return nil
+}
+
+// set records the gate's state, logging changes, and returns err.
+func (g *identityGate) set(state string, err error) error {
+	g.mu.Lock()
+	changed := g.status.State != state
+	g.status.State = state
+	g.status.Error = ""
+	if err != nil {
+		g.status.Error = err.Error()
+	}
+	g.status.CheckedAt = time.Now()
+	g.mu.Unlock()
+	if changed {
+		if err != nil {
+			g.logger.Error("Cloud sync blocked", "state", state, "error", err)
+		} else {
+			g.logger.Info("Device identity checked", "state", state)
+		}
+	}
+	return err
+}
+
+func (g *identityGate) Status() IdentityStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status
+}
+
+func identityMessage(deviceID, hw string, at time.Time) string {
+	return strings.Join([]string{identitySignPrefix, deviceID, hw, strconv.FormatInt(at.Unix(), 10)}, "|")
+}
+
+func provisionMessage(deviceID, hw, publicKey, tokenHash string) string {
+	return strings.Join([]string{provisionSignPrefix, deviceID, hw, publicKey, tokenHash}, "|")
+}
+
+// provisionDevice claims the token, records a new key for this hardware
+// in the cloud and writes the identity file.
+func provisionDevice(config EdgeConfig, token, deviceID string) (*DeviceIdentity, error) {
+	hw, err := hardwareID()
+	if err != nil {
+		return nil, fmt.Errorf("cannot provision without a hardware ID: %v", err)
+	}
+	dsn, err := cloudDSN(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud connection settings: %v", err)
+	}
+	if dsn == "" {
+		return nil, fmt.Errorf("provisioning needs database_url")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+
+	sum := sha256.Sum256([]byte(token))
+	tokenHash := hex.EncodeToString(sum[:])
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the cloud: %v", err)
+	}
+	defer tx.Rollback()
+
+	var tokenDevice sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		UPDATE edge_provisioning_tokens
+		SET used_at = NOW(), used_by_hardware_id = $2
+		WHERE token_sha256 = $1 AND used_at IS NULL AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING device_external_id
+	`, tokenHash, hw).Scan(&tokenDevice)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("provisioning token is unknown, used, revoked or expired")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim provisioning token: %v", err)
+	}
+	switch {
+	case tokenDevice.Valid && deviceID != "" && deviceID != tokenDevice.String:
+		return nil, fmt.Errorf("token is for device %s, not %s", tokenDevice.String, deviceID)
+	case tokenDevice.Valid:
+		deviceID = tokenDevice.String
+	case deviceID == "":
+		deviceID = config.DeviceID
+	}
+
+	var current string
+	err = tx.QueryRowContext(ctx, `
+		SELECT hardware_id FROM edge_device_identities
+		WHERE device_external_id = $1 AND revoked_at IS NULL
+		FOR UPDATE
+	`, deviceID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read device identity: %v", err)
+	}
+	if err == nil && current != hw {
+		return nil, fmt.Errorf("device %s is already provisioned to other hardware; revoke it or provision under another -device-id", deviceID)
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %v", err)
+	}
+	id := &DeviceIdentity{
+		DeviceID:      deviceID,
+		HardwareID:    hw,
+		PublicKey:     base64.StdEncoding.EncodeToString(public),
+		PrivateKey:    base64.StdEncoding.EncodeToString(private.Seed()),
+		ProvisionedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	sig, err := id.sign(provisionMessage(deviceID, hw, id.PublicKey, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+
+	// One live identity per board: a gateway provisioned under a new ID
+	// gives up its old one
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE edge_device_identities SET revoked_at = NOW()
+		WHERE hardware_id = $1 AND device_external_id <> $2 AND revoked_at IS NULL
+	`, hw, deviceID); err != nil {
+		return nil, fmt.Errorf("failed to release previous identity: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO edge_device_identities
+			(device_external_id, hardware_id, public_key, provision_token_sha256, provision_signature, provisioned_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (device_external_id) DO UPDATE SET
+			hardware_id            = EXCLUDED.hardware_id,
+			public_key             = EXCLUDED.public_key,
+			provision_token_sha256 = EXCLUDED.provision_token_sha256,
+			provision_signature    = EXCLUDED.provision_signature,
+			provisioned_at         = EXCLUDED.provisioned_at,
+			revoked_at             = NULL,
+			last_signed_at         = NULL,
+			last_signature         = NULL
+	`, deviceID, hw, id.PublicKey, tokenHash, sig, id.ProvisionedAt); err != nil {
+		return nil, fmt.Errorf("failed to record device identity: %v", err)
+	}
+
+	// Written before the commit, so a key the cloud knows is never lost
+	path := config.deviceIdentityPath()
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write device identity: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to commit provisioning: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("provisioned, but failed to install %s (rename %s there by hand): %v", path, tmp, err)
+	}
+	return id, nil
+}
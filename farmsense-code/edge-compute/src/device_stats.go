@@ -0,0 +1,146 @@
+// Device Stats - host resource figures for fleet heartbeats
+// Read straight from procfs/sysfs so nothing extra has to be installed on
+// the Pi or Jetson. Every figure is best effort: a value that can't be read
+// (container without /sys/class/thermal, non-Linux dev machine) is left
+// out of the heartbeat rather than reported as zero.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const thermalZonePath = "/sys/class/thermal/thermal_zone0/temp"
+
+// DeviceStats is one heartbeat's resource snapshot.
+type DeviceStats struct {
+	CPUPercent    *float64 `json:"cpu_percent,omitempty"` // busy share since the previous heartbeat
+	Load1         *float64 `json:"load_1m,omitempty"`
+	MemUsedPct    *float64 `json:"mem_used_pct,omitempty"`
+	DiskFreeBytes *uint64  `json:"disk_free_bytes,omitempty"` // filesystem holding the local cache
+	DiskUsedPct   *float64 `json:"disk_used_pct,omitempty"`
+	TempC         *float64 `json:"temp_c,omitempty"` // SoC temperature
+	UptimeSec     *float64 `json:"uptime_sec,omitempty"`
+}
+
+// cpuTimes is the aggregate line of /proc/stat.
+type cpuTimes struct {
+	busy, total uint64
+}
+
+func readCPUTimes() (cpuTimes, bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, false
+	}
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return cpuTimes{}, false
+	}
+	var t cpuTimes
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return cpuTimes{}, false
+		}
+		t.total += v
+		if i != 3 && i != 4 { // idle, iowait
+			t.busy += v
+		}
+	}
+	return t, true
+}
+
+// readFirstFloat parses the first whitespace-separated number in a file.
+func readFirstFloat(path string) (float64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	return v, err == nil
+}
+
+func readMemUsedPct() (float64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	var total, available float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if total <= 0 {
+		return 0, false
+	}
+	return 100 * (total - available) / total, true
+}
+
+// collectDeviceStats reads the host figures. prev is the CPU counters from
+// the previous call and is updated in place.
+func collectDeviceStats(diskPath string, prev *cpuTimes) DeviceStats {
+	var s DeviceStats
+	if now, ok := readCPUTimes(); ok {
+		if prev.total > 0 && now.total > prev.total {
+			pct := 100 * float64(now.busy-prev.busy) / float64(now.total-prev.total)
+			s.CPUPercent = &pct
+		}
+		*prev = now
+	}
+	if v, ok := readFirstFloat("/proc/loadavg"); ok {
+		s.Load1 = &v
+	}
+	if v, ok := readMemUsedPct(); ok {
+		s.MemUsedPct = &v
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(diskPath, &fs); err == nil && fs.Blocks > 0 {
+		free := uint64(fs.Bavail) * uint64(fs.Bsize)
+		used := 100 * float64(fs.Blocks-fs.Bfree) / float64(fs.Blocks)
+		s.DiskFreeBytes = &free
+		s.DiskUsedPct = &used
+	}
+	if v, ok := readFirstFloat(thermalZonePath); ok {
+		v /= 1000 // millidegrees
+		s.TempC = &v
+	}
+	if v, ok := readFirstFloat("/proc/uptime"); ok {
+		s.UptimeSec = &v
+	}
+	return s
+}
+
+// hardwareModel reads the board name from the device tree (Raspberry Pi,
+// Jetson), e.g. "Raspberry Pi 4 Model B Rev 1.4".
+func hardwareModel() string {
+	data, err := os.ReadFile("/proc/device-tree/model")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+}
@@ -0,0 +1,1451 @@
+// Edge API Server
+// Local HTTP API for the edge grid processor. With api_tls_cert set it is
+// served over HTTPS; every endpoint but /healthz, /readyz and the UI's
+// static files requires the credentials described in tls_auth.go when any
+// are configured. Agronomic endpoints (the grid, sensors, fields, zones,
+// trends, prescriptions, trace and alerts) take ?units=metric|imperial,
+// defaulting to the field's units setting (units.go), and ?field_id= on
+// multi-field gateways; tenant credentials reach only their own fields and
+// none of the device endpoints (tenancy.go). Endpoints that change state
+// need the operator or admin role (api_rbac.go).
+//
+// Endpoints:
+//   GET /ui/      — installer status page: grid heatmap, probes, sync and alerts (web_ui.go; / redirects here)
+//   GET /healthz  — liveness: main compute loop is not stuck
+//   GET /readyz   — readiness: local cache reachable and a grid has been computed
+//   GET /metrics  — Prometheus gauges (cycle age, cloud link, LOOCV accuracy)
+//   GET /grid/latest.geojson — latest grid as a FeatureCollection of cell squares with all properties (?exclude_flags=extrapolated,... drops flagged cells)
+//   GET /grid/map.png — PNG heatmap of the latest grid over the whole field (?variable=&width=&min=&max=; map_tiles.go)
+//   GET /tiles/<variable>/{z}/{x}/{y}.png — XYZ heatmap tiles of the latest grid for offline maps (?min=&max=)
+//   GET /grid/accuracy — per-cycle leave-one-out RMSE/MAE/bias by variable
+//   GET /grid/shadow — shadow interpolation vs live per cycle and variable, with a roll-up (?from=&to= RFC3339, default the last 30 days; shadow_interpolation.go)
+//   GET /grid/history — paginated grid history from the local cache (?from=&to=&bbox=&zone_id=&layers=&aggregate=hourly|daily&limit=&cursor=; grid_history_api.go)
+//   GET /grid/history/cycles — recorded cycle times and cell counts (?from=&to=)
+//   GET /grid/batches — recent compute/backfill batches with algorithm version, sync state and late-reading supersession (?limit=50)
+//   GET /grid/attribution — per-probe influence over the latest grid (?grid_id= or ?sensor_id= adds per-cell weights)
+//   POST /grid/backfill?from=&to= — recompute a historical window (RFC3339; &step=15m to resample)
+//   GET  /grid/backfill — progress of the latest backfill
+//   GET /sensors/depth-checks — install depth verification results
+//   GET /sensors/registry — per-probe install depth, soil texture, install date and offsets in effect
+//   GET /time     — reference clock state (trusted, source, offset)
+//   GET /sync/status — cloud link, unsynced grid batches, readings waiting to be forwarded and the local grid epoch
+//   GET /storage  — free space on the cache's filesystem, storage level and last vacuum
+//   POST /commands?command= — run recompute, sync or resync on the main loop and wait for it
+//   PUT  /config  — replace the config file with the body (validated first; admin), applied by the config watcher
+//   GET /fleet    — registry/heartbeat state, host stats and recent fleet commands
+//   GET /update   — OTA state (running version, trial, rejected releases)
+//   GET /sensors/health — per-probe health scores, lowest first
+//   GET /sensors/maintenance — battery forecasts and planned field visits
+//   GET /trace    — journey of one reading (?trace_id= or ?sensor_id=&timestamp=)
+//   GET /alerts   — recent alerts (?kind= to filter)
+//   POST /alerts/ack?alert_id= — acknowledge an alert as the caller
+//   GET /audit    — config changes, commands, irrigation actuations and alert acks, oldest first (?from=&to=, &kind=, &after_id=, &limit=500; audit_log.go)
+//   GET /fields/trafficability — go/no-go summary (?layer=true adds per-cell index)
+//   GET /trends/drydown?grid_id= — a cell's moisture history and drydown fit (?window=168h)
+//   GET /trends/wilting — days-until-wilting per cell, soonest first (?window=168h)
+//   GET /prescriptions/vri — VRI prescription zip (?format=shapefile|isoxml; ?format=json for zones only)
+//   GET /fields/crop — today's growth stage, Kc and ETc
+//   GET /fields/rain — rain state, current/last event and per-zone rainfall
+//   GET /fields/forecast — root moisture forecast: weather days used and per-zone irrigate-by (moisture_forecast.go)
+//   GET  /fields/lifecycle — season state, this season's events and archived seasons (field_lifecycle.go)
+//   POST /fields/lifecycle — record planting, mid_season, harvest or fallow (JSON body: state, date, crop_type, stages, note)
+//   GET /fields/schedule — per-field compute staleness on multi-field gateways
+//   GET /peer/state — this device's fields, last cycles, watched peers and spec hash (polled by peers)
+//   GET /peer/fields — field specs a peer takes over with when this device fails
+//   GET /peer/grid?field_id= — a field's latest cells that neighbor fields may borrow (neighbor_fields.go)
+//   GET /peers    — peer reachability and the fields covered for failed peers
+//   GET /zones/flow-health — per-zone emitter clog assessment
+//   POST /zones/flow-baseline/reset?zone_id= — relearn a zone's flow signature after maintenance
+//   GET /zones/stats — latest cycle's per-management-zone moisture, stress and deficit volume, with run times for irrigation_hardware
+//   GET /zones/uniformity — per-set distribution uniformity (?zone_id= to filter)
+//   GET /zones/anomalies — classified SPC anomaly episodes, newest first (?hours=72, &zone_id=, &class=; zone_anomaly.go)
+//   GET /zones/water-budget — per-zone season water balance vs measured deficit (?season=; &daily=true adds days, &zone_id= filters them)
+//   GET /zones/irrigation-events — controller and pulse meter runs (?hours=72, &zone_id=) with pulse meter counters
+//   GET  /lorawan/devices — per-device uplink decode counters
+//   GET  /serial/sensors — per-sensor serial poll counters
+//   GET  /weather/stations — per-station weather poll counters
+//   GET  /weather/observations — the field's station observations (?from=&to= RFC3339, default the last week; &station_id=; weather_stations.go)
+//   GET  /captures — packet captures and their state
+//   POST /captures/start — record raw broker traffic (?topic=&sensor_id=&duration=10m&max_bytes=)
+//   POST /captures/stop?capture_id= — end a capture early
+//   GET  /captures/file?capture_id= — download a finished capture (JSON lines)
+//   GET  /debug/pprof/ — Go runtime profiles for go tool pprof, admin only and only with credentials configured (profiling.go)
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localCommandTimeout bounds a /commands request; a cycle can outlast the
+// server's write timeout.
+const localCommandTimeout = 5 * time.Minute
+
+const maxConfigBytes = 1 << 20
+
+// EdgeAPIServer exposes the EdgeProcessor over HTTP.
+type EdgeAPIServer struct {
+	processor  *EdgeProcessor
+	scheduler  *FieldScheduler     // nil on single-field devices
+	uplinks    *UplinkIngestor     // nil without LoRaWAN ingest
+	serial     *SerialIngestor     // nil without serial probes
+	weather    *WeatherIngestor    // nil without weather stations
+	irrigation *IrrigationIngestor // nil without irrigation event ingest
+	fleet      *FleetClient        // nil with fleet management disabled
+	updater    *Updater            // nil without OTA updates
+	peers      *PeerMonitor        // nil without peer failover
+	auth       *APIAuth            // nil = open
+	tls        *tls.Config         // nil = plain HTTP
+	configPath string              // empty = PUT /config unavailable
+	port       int
+}
+
+func NewEdgeAPIServer(processor *EdgeProcessor, port int) *EdgeAPIServer {
+	return &EdgeAPIServer{
+		processor: processor,
+		port:      port,
+	}
+}
+
+// Start registers all HTTP handlers and begins listening.
+func (s *EdgeAPIServer) Start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleRoot)
+	mux.Handle("/ui/", webUIHandler())
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", deviceScoped(s.handleMetrics))
+	mux.HandleFunc("/grid/latest.geojson", s.fieldScoped((*EdgeAPIServer).handleGridGeoJSON))
+	mux.HandleFunc("/grid/map.png", s.fieldScoped((*EdgeAPIServer).handleFieldMap))
+	mux.HandleFunc("/tiles/", s.fieldScoped((*EdgeAPIServer).handleTile))
+	mux.HandleFunc("/grid/accuracy", s.fieldScoped((*EdgeAPIServer).handleAccuracy))
+	mux.HandleFunc("/grid/shadow", s.fieldScoped((*EdgeAPIServer).handleShadow))
+	mux.HandleFunc("/grid/attribution", s.fieldScoped((*EdgeAPIServer).handleAttribution))
+	mux.HandleFunc("/grid/batches", s.fieldScoped((*EdgeAPIServer).handleGridBatches))
+	mux.HandleFunc("/grid/history", s.fieldScoped((*EdgeAPIServer).handleGridHistory))
+	mux.HandleFunc("/grid/history/cycles", s.fieldScoped((*EdgeAPIServer).handleGridHistoryCycles))
+	mux.HandleFunc("/grid/backfill", writesRequire(RoleOperator, s.fieldScoped((*EdgeAPIServer).handleBackfill)))
+	mux.HandleFunc("/sensors/depth-checks", s.fieldScoped((*EdgeAPIServer).handleDepthChecks))
+	mux.HandleFunc("/sensors/registry", s.fieldScoped((*EdgeAPIServer).handleSensorRegistry))
+	mux.HandleFunc("/sensors/health", s.fieldScoped((*EdgeAPIServer).handleSensorHealth))
+	mux.HandleFunc("/sensors/maintenance", s.fieldScoped((*EdgeAPIServer).handleSensorMaintenance))
+	mux.HandleFunc("/time", deviceScoped(s.handleClock))
+	mux.HandleFunc("/sync/status", deviceScoped(s.handleSyncStatus))
+	mux.HandleFunc("/storage", deviceScoped(s.handleStorage))
+	mux.HandleFunc("/fleet", deviceScoped(s.handleFleet))
+	mux.HandleFunc("/commands", requireRole(RoleOperator, deviceScoped(s.handleLocalCommand)))
+	mux.HandleFunc("/config", requireRole(RoleAdmin, deviceScoped(s.handleConfig)))
+	mux.HandleFunc("/update", deviceScoped(s.handleUpdate))
+	mux.HandleFunc("/trace", s.fieldScoped((*EdgeAPIServer).handleTrace))
+	mux.HandleFunc("/alerts", s.handleAlerts)
+	mux.HandleFunc("/alerts/ack", requireRole(RoleOperator, s.handleAlertAck))
+	mux.HandleFunc("/audit", s.fieldScoped((*EdgeAPIServer).handleAudit))
+	mux.HandleFunc("/fields/trafficability", s.fieldScoped((*EdgeAPIServer).handleTrafficability))
+	mux.HandleFunc("/fields/schedule", s.handleFieldSchedule)
+	mux.HandleFunc("/fields/crop", s.fieldScoped((*EdgeAPIServer).handleCropDay))
+	mux.HandleFunc("/fields/rain", s.fieldScoped((*EdgeAPIServer).handleRain))
+	mux.HandleFunc("/fields/forecast", s.fieldScoped((*EdgeAPIServer).handleForecast))
+	mux.HandleFunc("/fields/lifecycle", writesRequire(RoleOperator, s.fieldScoped((*EdgeAPIServer).handleLifecycle)))
+	mux.HandleFunc("/peer/state", deviceScoped(s.handlePeerState))
+	mux.HandleFunc("/peer/fields", deviceScoped(s.handlePeerFields))
+	mux.HandleFunc("/peer/grid", s.fieldScoped((*EdgeAPIServer).handlePeerGrid))
+	mux.HandleFunc("/peers", deviceScoped(s.handlePeers))
+	mux.HandleFunc("/prescriptions/vri", s.fieldScoped((*EdgeAPIServer).handleVRIPrescription))
+	mux.HandleFunc("/trends/drydown", s.fieldScoped((*EdgeAPIServer).handleDrydown))
+	mux.HandleFunc("/trends/wilting", s.fieldScoped((*EdgeAPIServer).handleWiltingOutlook))
+	mux.HandleFunc("/zones/flow-health", s.fieldScoped((*EdgeAPIServer).handleZoneFlowHealth))
+	mux.HandleFunc("/zones/flow-baseline/reset", requireRole(RoleOperator, s.fieldScoped((*EdgeAPIServer).handleFlowBaselineReset)))
+	mux.HandleFunc("/zones/uniformity", s.fieldScoped((*EdgeAPIServer).handleUniformity))
+	mux.HandleFunc("/zones/anomalies", s.fieldScoped((*EdgeAPIServer).handleZoneAnomalies))
+	mux.HandleFunc("/zones/stats", s.fieldScoped((*EdgeAPIServer).handleZoneStats))
+	mux.HandleFunc("/zones/water-budget", s.fieldScoped((*EdgeAPIServer).handleWaterBudget))
+	mux.HandleFunc("/zones/irrigation-events", s.fieldScoped((*EdgeAPIServer).handleIrrigationEvents))
+	mux.HandleFunc("/lorawan/devices", deviceScoped(s.handleLoRaWANDevices))
+	mux.HandleFunc("/serial/sensors", deviceScoped(s.handleSerialSensors))
+	mux.HandleFunc("/weather/stations", deviceScoped(s.handleWeatherStations))
+	mux.HandleFunc("/weather/observations", s.fieldScoped((*EdgeAPIServer).handleWeatherObservations))
+	mux.HandleFunc("/captures", deviceScoped(s.handleCaptures))
+	mux.HandleFunc("/captures/start", requireRole(RoleAdmin, deviceScoped(s.handleCaptureStart)))
+	mux.HandleFunc("/captures/stop", requireRole(RoleAdmin, deviceScoped(s.handleCaptureStop)))
+	mux.HandleFunc("/captures/file", requireRole(RoleAdmin, deviceScoped(s.handleCaptureFile)))
+	s.registerPprof(mux)
+
+	addr := fmt.Sprintf(":%d", s.port)
+	slog.Info("HTTP server listening", "component", "edge_api", "addr", addr)
+
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      s.auth.Wrap(mux, append([]string{"/healthz", "/readyz"}, webUIPaths...)...),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		TLSConfig:    s.tls,
+	}
+
+	var err error
+	if s.tls != nil {
+		err = srv.ListenAndServeTLS("", "") // certificate comes from TLSConfig.GetCertificate
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		slog.Error("HTTP server failed", "component", "edge_api", "error", err)
+		os.Exit(1)
+	}
+}
+
+// handleRoot sends a browser pointed at the device to the UI.
+func (s *EdgeAPIServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/ui/", http.StatusFound)
+}
+
+// handleHealthz reports whether the main loop is still iterating.
+func (s *EdgeAPIServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	health := s.processor.health
+	stall := health.SinceHeartbeat()
+
+	status := http.StatusOK
+	state := "ok"
+	if !health.Alive(s.processor.maxLoopStall()) {
+		status = http.StatusServiceUnavailable
+		state = "stalled"
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"status":            state,
+		"device_id":         s.processor.deviceID,
+		"since_heartbeat_s": stall.Seconds(),
+		"uptime_s":          time.Since(health.startedAt).Seconds(),
+	})
+}
+
+// handleReadyz reports whether the processor can serve grid data.
+func (s *EdgeAPIServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	reasons := make([]string, 0)
+
+	if err := s.processor.localDB.PingContext(r.Context()); err != nil {
+		reasons = append(reasons, fmt.Sprintf("local cache unavailable: %v", err))
+	}
+	lastCycle := s.processor.health.LastCycle()
+	if lastCycle.IsZero() {
+		reasons = append(reasons, "no grid computed yet")
+	}
+
+	status := http.StatusOK
+	state := "ready"
+	if len(reasons) > 0 {
+		status = http.StatusServiceUnavailable
+		state = "not_ready"
+	}
+
+	body := map[string]interface{}{
+		"status":    state,
+		"device_id": s.processor.deviceID,
+		"online":    s.processor.isOnline.Load(),
+		"reasons":   reasons,
+	}
+	if !lastCycle.IsZero() {
+		body["last_cycle"] = lastCycle.UTC()
+	}
+	writeJSON(w, status, body)
+}
+
+func (s *EdgeAPIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.processor.WriteMetrics(w)
+}
+
+func (s *EdgeAPIServer) handleAccuracy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cycles": s.processor.Accuracy()})
+}
+
+func (s *EdgeAPIServer) handleShadow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, err := historyRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	comparisons, summary, err := s.processor.ShadowComparisons(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if summary == nil {
+		summary = []ShadowSummary{}
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{
+		"algorithm":   s.processor.config.ShadowInterpolator,
+		"summary":     summary,
+		"comparisons": comparisons,
+	})
+}
+
+func (s *EdgeAPIServer) handleGridBatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultBatchListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	batches, err := s.processor.GridBatches(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"algorithm_version": gridAlgorithmVersion, "batches": batches})
+}
+
+// handleAttribution reports which probes drive the latest grid; with
+// grid_id or sensor_id it adds the matching cells' per-probe weights
+// (grid_id=all for every cell).
+func (s *EdgeAPIServer) handleAttribution(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := map[string]interface{}{"sensors": s.processor.SensorInfluences()}
+	gridID, sensorID := r.URL.Query().Get("grid_id"), r.URL.Query().Get("sensor_id")
+	if gridID != "" || sensorID != "" {
+		if gridID == "all" {
+			gridID = ""
+		}
+		resp["cells"] = s.processor.CellAttributions(gridID, sensorID)
+	}
+	s.writeData(w, r, http.StatusOK, resp)
+}
+
+// handleDepthChecks lists probes and whether they need re-installation.
+func (s *EdgeAPIServer) handleDepthChecks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, s.processor.DepthChecks())
+}
+
+func (s *EdgeAPIServer) handleClock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.processor.clock.Status())
+}
+
+// handleSyncStatus reports the cloud upload backlog.
+func (s *EdgeAPIServer) handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := s.processor.SyncStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *EdgeAPIServer) handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := s.processor.StorageStatus()
+	if status == nil {
+		http.Error(w, "storage not checked yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *EdgeAPIServer) handleSensorHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{"sensors": s.processor.SensorHealth()})
+}
+
+// handleSensorMaintenance reports the latest maintenance plan: forecasts
+// soonest dead first, visits soonest due first.
+func (s *EdgeAPIServer) handleSensorMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	plan := s.processor.MaintenancePlan()
+	if plan == nil {
+		plan = &MaintenancePlan{Forecasts: []BatteryForecast{}, Visits: []MaintenanceVisit{}}
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{
+		"planned_at": plan.PlannedAt,
+		"forecasts":  plan.Forecasts,
+		"visits":     plan.Visits,
+	})
+}
+
+// handleTrace reports where a reading is and which grid points used it.
+func (s *EdgeAPIServer) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	traceID := q.Get("trace_id")
+	if traceID == "" {
+		sensorID := q.Get("sensor_id")
+		ts, err := time.Parse(time.RFC3339Nano, q.Get("timestamp"))
+		if sensorID == "" || err != nil {
+			http.Error(w, "provide trace_id, or sensor_id and RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		traceID = traceIDFor(sensorID, ts)
+	}
+
+	trace, ok := s.processor.tracer.Get(traceID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("trace %s not found (never ingested or older than retention)", traceID), http.StatusNotFound)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, trace)
+}
+
+// handleAlerts lists recent alerts, newest first; a tenant sees its own
+// fields' alerts only.
+func (s *EdgeAPIServer) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	alerts := s.processor.alerts.List(r.URL.Query().Get("kind"))
+	if p := principalOf(r); p.tenant != "" {
+		fields := s.visibleFields(p)
+		visible := alerts[:0]
+		for _, a := range alerts {
+			if fields[a.FieldID] {
+				visible = append(visible, a)
+			}
+		}
+		alerts = visible
+	}
+	s.writeData(w, r, http.StatusOK, alerts)
+}
+
+// handleAlertAck acknowledges ?alert_id= as the caller.
+func (s *EdgeAPIServer) handleAlertAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("alert_id")
+	p := principalOf(r)
+	a, ok := s.processor.alerts.Get(id)
+	if !ok || (p.tenant != "" && !s.visibleFields(p)[a.FieldID]) {
+		http.Error(w, "unknown alert "+id, http.StatusNotFound)
+		return
+	}
+	first := a.AcknowledgedAt == nil
+	a, _ = s.processor.alerts.Acknowledge(id, p.name())
+	if first {
+		proc := s.processor
+		for _, fp := range s.processors() {
+			if fp.config.FieldID == a.FieldID {
+				proc = fp
+			}
+		}
+		proc.auditAlertAck(a)
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// handleZoneFlowHealth reports per-zone flow signature status.
+func (s *EdgeAPIServer) handleZoneFlowHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, s.processor.ZoneFlowHealth())
+}
+
+// handleFlowBaselineReset forgets a zone's learned flow signature.
+func (s *EdgeAPIServer) handleFlowBaselineReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	zoneID := r.URL.Query().Get("zone_id")
+	if zoneID == "" {
+		http.Error(w, "missing required parameter: zone_id", http.StatusBadRequest)
+		return
+	}
+	s.processor.ResetFlowBaseline(zoneID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reset", "zone_id": zoneID})
+}
+
+// trafficCell is one cell of the trafficability map layer.
+type trafficCell struct {
+	GridID      string  `json:"grid_id"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Index       float64 `json:"trafficability_index"`
+	Trafficable bool    `json:"trafficable"`
+}
+
+// handleTrafficability returns the field go/no-go and optionally the map layer.
+func (s *EdgeAPIServer) handleTrafficability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	summary := s.processor.TrafficabilitySummary()
+	if summary == nil {
+		http.Error(w, "no grid computed yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	body := map[string]interface{}{"summary": summary}
+	if r.URL.Query().Get("layer") == "true" {
+		grid := s.processor.LatestGrid()
+		layer := make([]trafficCell, 0, len(grid))
+		for _, p := range grid {
+			layer = append(layer, trafficCell{
+				GridID:      p.GridID,
+				Latitude:    p.Latitude,
+				Longitude:   p.Longitude,
+				Index:       p.Trafficability,
+				Trafficable: p.Trafficable,
+			})
+		}
+		body["layer"] = layer
+	}
+	s.writeData(w, r, http.StatusOK, body)
+}
+
+// trendWindow parses the optional ?window= duration.
+func trendWindow(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("window must be a positive Go duration like 168h")
+	}
+	return d, nil
+}
+
+func (s *EdgeAPIServer) handleDrydown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gridID := r.URL.Query().Get("grid_id")
+	if gridID == "" {
+		http.Error(w, "grid_id is required", http.StatusBadRequest)
+		return
+	}
+	window, err := trendWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	curve, err := s.processor.DrydownCurve(gridID, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(curve.Samples) == 0 {
+		http.Error(w, "no history for grid_id", http.StatusNotFound)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, curve)
+}
+
+func (s *EdgeAPIServer) handleWiltingOutlook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window, err := trendWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cells, err := s.processor.WiltingOutlook(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{"cells": cells})
+}
+
+// handleVRIPrescription exports the latest grid as a VRI prescription.
+func (s *EdgeAPIServer) handleVRIPrescription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rx, err := s.processor.BuildPrescription(s.processor.LatestGrid())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = PrescriptionShapefile
+	}
+	if format == "json" {
+		s.writeData(w, r, http.StatusOK, rx)
+		return
+	}
+	if format != PrescriptionShapefile && format != PrescriptionISOXML {
+		http.Error(w, "format must be shapefile, isoxml or json", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("%s_vri_%s_%s.zip", rx.FieldID, format, rx.CreatedAt.UTC().Format("20060102T1504"))))
+	if err := WritePrescriptionZip(w, rx, format); err != nil {
+		slog.Error("Prescription export failed", "component", "edge_api", "error", err)
+	}
+}
+
+func (s *EdgeAPIServer) handleCropDay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	day := s.processor.CropDay()
+	if day == nil {
+		http.Error(w, "no crop model configured or no cycle run yet", http.StatusNotFound)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, day)
+}
+
+// handleForecast serves the latest moisture forecast and zone outlook.
+func (s *EdgeAPIServer) handleForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fc := s.processor.Forecast()
+	if fc == nil {
+		http.Error(w, "no forecast yet", http.StatusNotFound)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, fc)
+}
+
+func (s *EdgeAPIServer) handleRain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := s.processor.RainStatus()
+	if status == nil {
+		http.Error(w, "no cycle run yet", http.StatusNotFound)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, status)
+}
+
+// handleFieldSchedule reports per-field staleness and missed windows.
+func (s *EdgeAPIServer) handleFieldSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.scheduler == nil {
+		http.Error(w, "not a multi-field gateway", http.StatusNotFound)
+		return
+	}
+	status := s.scheduler.Status()
+	if p := principalOf(r); p.tenant != "" {
+		visible := status[:0]
+		for _, f := range status {
+			if f.TenantID == p.tenant {
+				visible = append(visible, f)
+			}
+		}
+		status = visible
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"fields": status})
+}
+
+func (s *EdgeAPIServer) handlePeerState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.peers == nil {
+		http.Error(w, "peer failover not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.peers.State())
+}
+
+func (s *EdgeAPIServer) handlePeerFields(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.peers == nil {
+		http.Error(w, "peer failover not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.peers.FieldSpecs())
+}
+
+func (s *EdgeAPIServer) handlePeerGrid(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.processor.NeighborGrid())
+}
+
+func (s *EdgeAPIServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.peers == nil {
+		http.Error(w, "peer failover not configured", http.StatusNotFound)
+		return
+	}
+	peers, adopted := s.peers.Status()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"peers": peers, "adopted_fields": adopted})
+}
+
+func (s *EdgeAPIServer) handleUniformity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{
+		"results": s.processor.Uniformity(r.URL.Query().Get("zone_id")),
+	})
+}
+
+func (s *EdgeAPIServer) handleSensorRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{"sensors": s.processor.SensorInstalls()})
+}
+
+func (s *EdgeAPIServer) handleGridGeoJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	points := s.processor.LatestGrid()
+	if len(points) == 0 {
+		http.Error(w, "no grid computed yet", http.StatusServiceUnavailable)
+		return
+	}
+	exclude, err := parseQualityFlags(r.URL.Query().Get("exclude_flags"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	points = withoutQualityFlags(points, exclude)
+	units, err := s.processor.unitsFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fc, err := s.processor.BuildGeoJSON(points, units)
+	if errors.Is(err, errNoGeographicGrid) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("X-Units", units)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(fc)
+}
+
+// handleTile serves /tiles/<variable>/{z}/{x}/{y}.png.
+func (s *EdgeAPIServer) handleTile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tiles/"), "/")
+	if len(parts) != 4 || !strings.HasSuffix(parts[3], ".png") {
+		http.NotFound(w, r)
+		return
+	}
+	variable := parts[0]
+	var z, x, y int
+	coords := []*int{&z, &x, &y}
+	for i, p := range []string{parts[1], parts[2], strings.TrimSuffix(parts[3], ".png")} {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		*coords[i] = n
+	}
+	ramp, err := tileRampParam(r, variable)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, cycle, err := s.processor.Tile(variable, z, x, y, ramp)
+	s.writePNG(w, r, data, cycle, err)
+}
+
+// handleFieldMap serves a static heatmap of the whole field.
+func (s *EdgeAPIServer) handleFieldMap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	variable := r.URL.Query().Get("variable")
+	if variable == "" {
+		variable = "moisture_root"
+	}
+	width := 0
+	if v := r.URL.Query().Get("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "width must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+	ramp, err := tileRampParam(r, variable)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, cycle, err := s.processor.FieldMap(variable, width, ramp)
+	s.writePNG(w, r, data, cycle, err)
+}
+
+// tileRampParam reads ?min=&max=, nil when neither is given.
+func tileRampParam(r *http.Request, variable string) (*tileRamp, error) {
+	q := r.URL.Query()
+	if q.Get("min") == "" && q.Get("max") == "" {
+		return nil, nil
+	}
+	ramp := defaultTileRamp(variable)
+	for _, p := range []struct {
+		name string
+		dst  *float64
+	}{{"min", &ramp.dry}, {"max", &ramp.wet}} {
+		if v := q.Get(p.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", p.name)
+			}
+			*p.dst = f
+		}
+	}
+	return &ramp, nil
+}
+
+// writePNG sends a rendered map, tagged with its cycle so viewers can
+// revalidate instead of refetching.
+func (s *EdgeAPIServer) writePNG(w http.ResponseWriter, r *http.Request, data []byte, cycle time.Time, err error) {
+	switch {
+	case errors.Is(err, errNoGeographicGrid):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNoGridHistory):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	etag := `"` + strconv.FormatInt(cycle.Unix(), 10) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Last-Modified", cycle.Format(http.TimeFormat))
+	w.Write(data)
+}
+
+// handleConfig replaces the config file. The new config is validated as
+// the watcher would load it and written beside the file, then renamed into
+// place for the watcher to apply; settings that need a restart are listed.
+func (s *EdgeAPIServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.configPath == "" {
+		http.Error(w, "running without a config file", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigBytes))
+	if err != nil {
+		http.Error(w, "failed to read config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	tmp := s.configPath + ".api-tmp" + filepath.Ext(s.configPath) // JSON is valid YAML
+	if err := os.WriteFile(tmp, body, 0600); err != nil {
+		http.Error(w, "failed to write config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updated, err := LoadEdgeConfig(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := os.Rename(tmp, s.configPath); err != nil {
+		os.Remove(tmp)
+		http.Error(w, "failed to replace config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.processor.stateMu.Lock()
+	restart := restartOnlyChanges(s.processor.config, updated)
+	s.processor.configActor = principalOf(r).name() // the reload is audited as this user
+	s.processor.stateMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "written", "restart_required": restart})
+}
+
+// handleLocalCommand runs an operator command, e.g. from compute-once or
+// sync-now on the same host.
+func (s *EdgeAPIServer) handleLocalCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	command := r.URL.Query().Get("command")
+	switch command {
+	case FleetCommandRecompute, FleetCommandSync, FleetCommandResync:
+	default:
+		http.Error(w, "command must be recompute, sync or resync", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), localCommandTimeout)
+	defer cancel()
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(localCommandTimeout))
+	if err := s.processor.RunLocalCommand(ctx, command, principalOf(r).name()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"command": command, "status": "done"})
+}
+
+func (s *EdgeAPIServer) handleZoneStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{"zones": s.processor.ZoneStats()})
+}
+
+func (s *EdgeAPIServer) handleWaterBudget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	season := r.URL.Query().Get("season")
+	if season == "" {
+		season = s.processor.waterSeason(s.processor.clock.Now())
+	}
+	zones, err := s.processor.WaterBudget(season)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{"season": season, "zones": zones}
+	if r.URL.Query().Get("daily") == "true" {
+		days, err := s.processor.WaterBudgetDays(season, r.URL.Query().Get("zone_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp["days"] = days
+	}
+	s.writeData(w, r, http.StatusOK, resp)
+}
+
+func (s *EdgeAPIServer) handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		lifecycle, err := s.processor.Lifecycle()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.writeData(w, r, http.StatusOK, lifecycle)
+	case http.MethodPost:
+		var event FieldLifecycleEvent
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&event); err != nil {
+			http.Error(w, "invalid lifecycle event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		recorded, err := s.processor.RecordLifecycleEvent(event, principalOf(r).name())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, recorded)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *EdgeAPIServer) handleIrrigationEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hours := 72.0
+	if v := r.URL.Query().Get("hours"); v != "" {
+		h, err := strconv.ParseFloat(v, 64)
+		if err != nil || h <= 0 {
+			http.Error(w, "hours must be a positive number", http.StatusBadRequest)
+			return
+		}
+		hours = h
+	}
+	now := s.processor.clock.Now()
+	events, err := s.processor.IrrigationEvents(now.Add(-time.Duration(hours*float64(time.Hour))),
+		now.Add(s.processor.irrigationLookahead()), r.URL.Query().Get("zone_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{"events": events}
+	if s.irrigation != nil {
+		meters, received := s.irrigation.Status()
+		resp["pulse_meters"] = meters
+		resp["controller_events"] = received
+	}
+	s.writeData(w, r, http.StatusOK, resp)
+}
+
+func (s *EdgeAPIServer) handleZoneAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	hours := 72.0
+	if v := q.Get("hours"); v != "" {
+		h, err := strconv.ParseFloat(v, 64)
+		if err != nil || h <= 0 {
+			http.Error(w, "hours must be a positive number", http.StatusBadRequest)
+			return
+		}
+		hours = h
+	}
+	switch q.Get("class") {
+	case "", AnomalyFieldEvent, AnomalySensorFault, AnomalyUnconfirmed:
+	default:
+		http.Error(w, "class must be field_event, sensor_fault or unconfirmed", http.StatusBadRequest)
+		return
+	}
+	from := s.processor.clock.Now().Add(-time.Duration(hours * float64(time.Hour)))
+	anomalies, err := s.processor.ZoneAnomalies(from, q.Get("zone_id"), q.Get("class"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{"anomalies": anomalies})
+}
+
+// handleAudit pages through the field's audit log; next_after_id is set
+// when a full page came back.
+func (s *EdgeAPIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := historyRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultAuditLookback)
+	}
+	switch q.Get("kind") {
+	case "", AuditConfig, AuditCommand, AuditActuation, AuditAlertAck:
+	default:
+		http.Error(w, "kind must be config, command, actuation or alert_ack", http.StatusBadRequest)
+		return
+	}
+	var afterID int64
+	if v := q.Get("after_id"); v != "" {
+		if afterID, err = strconv.ParseInt(v, 10, 64); err != nil || afterID < 0 {
+			http.Error(w, "after_id must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAuditLimit {
+			http.Error(w, fmt.Sprintf("limit must be in [1, %d]", maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := s.processor.AuditLog(from, to, q.Get("kind"), afterID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{"from": from.UTC(), "to": to.UTC(), "entries": entries}
+	if len(entries) == limit {
+		resp["next_after_id"] = entries[len(entries)-1].ID
+	}
+	s.writeData(w, r, http.StatusOK, resp)
+}
+
+// historyRange reads ?from= and ?to= (RFC3339), zero when absent.
+func historyRange(q url.Values) (from, to time.Time, err error) {
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("from must be an RFC3339 time")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("to must be an RFC3339 time")
+		}
+	}
+	return from, to, nil
+}
+
+func (s *EdgeAPIServer) handleGridHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var req GridHistoryQuery
+	var err error
+	if req.From, req.To, err = historyRange(q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("bbox"); v != "" {
+		if req.BBox, err = parseBBox(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("layers"); v != "" {
+		req.Layers = strings.Split(v, ",")
+	}
+	if v := q.Get("limit"); v != "" {
+		if req.Limit, err = strconv.Atoi(v); err != nil || req.Limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	req.ZoneID, req.Aggregate, req.Cursor = q.Get("zone_id"), q.Get("aggregate"), q.Get("cursor")
+	if err := req.normalize(s.processor.clock.Now().UTC(), s.processor.config.ManagementZones); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.processor.GridHistory(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeData(w, r, http.StatusOK, page)
+}
+
+func (s *EdgeAPIServer) handleGridHistoryCycles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, err := historyRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.IsZero() {
+		to = s.processor.clock.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultGridHistoryWindow)
+	}
+	cycles, err := s.processor.GridHistoryCycles(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cycles": cycles})
+}
+
+func (s *EdgeAPIServer) handleBackfill(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := s.processor.BackfillStatus()
+		if status == nil {
+			http.Error(w, "no backfill has run", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case http.MethodPost:
+		q := r.URL.Query()
+		var req BackfillRequest
+		var err error
+		if req.From, err = time.Parse(time.RFC3339, q.Get("from")); err != nil {
+			http.Error(w, "from must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		if req.To, err = time.Parse(time.RFC3339, q.Get("to")); err != nil {
+			http.Error(w, "to must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		if v := q.Get("step"); v != "" {
+			if req.Step, err = time.ParseDuration(v); err != nil {
+				http.Error(w, "step must be a Go duration like 15m", http.StatusBadRequest)
+				return
+			}
+		}
+		status, err := s.processor.StartBackfill(req)
+		if errors.Is(err, errBackfillRunning) {
+			writeJSON(w, http.StatusConflict, status)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *EdgeAPIServer) handleLoRaWANDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.uplinks == nil {
+		http.Error(w, "LoRaWAN ingest not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"devices": s.uplinks.Status()})
+}
+
+func (s *EdgeAPIServer) handleSerialSensors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.serial == nil {
+		http.Error(w, "serial ingest not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sensors": s.serial.Status()})
+}
+
+func (s *EdgeAPIServer) handleWeatherStations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.weather == nil {
+		http.Error(w, "weather stations not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stations": s.weather.Status()})
+}
+
+func (s *EdgeAPIServer) handleWeatherObservations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := historyRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	obs, err := s.processor.WeatherObservations(from, to, q.Get("station_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if obs == nil {
+		obs = []WeatherObservation{}
+	}
+	s.writeData(w, r, http.StatusOK, map[string]interface{}{"observations": obs})
+}
+
+func (s *EdgeAPIServer) handleFleet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.fleet == nil {
+		http.Error(w, "fleet management disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.fleet.Status())
+}
+
+func (s *EdgeAPIServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.updater == nil {
+		http.Error(w, "OTA updates not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.updater.Status())
+}
+
+func (s *EdgeAPIServer) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"captures": s.processor.captures.List()})
+}
+
+// handleCaptureStart begins a bounded capture for a sensor or topic.
+func (s *EdgeAPIServer) handleCaptureStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	req := CaptureRequest{Topic: q.Get("topic"), SensorID: q.Get("sensor_id")}
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "duration must be a Go duration like 10m", http.StatusBadRequest)
+			return
+		}
+		req.Duration = d
+	}
+	if v := q.Get("max_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "max_bytes must be an integer", http.StatusBadRequest)
+			return
+		}
+		req.MaxBytes = n
+	}
+
+	info, err := s.processor.captures.Start(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, info)
+}
+
+func (s *EdgeAPIServer) handleCaptureStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info, err := s.processor.captures.Stop(r.URL.Query().Get("capture_id"), "stopped via API")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *EdgeAPIServer) handleCaptureFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("capture_id")
+	path, err := s.processor.captures.FinishedPath(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".jsonl"))
+	http.ServeFile(w, r, path)
+}
+
+// writeData writes an agronomic response in the unit system the request
+// asked for.
+func (s *EdgeAPIServer) writeData(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	units, err := s.processor.unitsFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if units == UnitsImperial {
+		if body, err = toImperial(body); err != nil {
+			http.Error(w, fmt.Sprintf("failed to convert units: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("X-Units", units)
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
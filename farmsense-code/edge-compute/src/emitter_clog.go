@@ -0,0 +1,332 @@
+// Emitter Clog Detection - per-zone flow signature monitoring
+// Pressure-compensated drip emitters deliver near-constant flow across
+// their regulation range, so a zone's steady-state flow during an
+// irrigation set should stay flat all season. We learn each zone's normal
+// flow from its first irrigation sets, then track the steady-state flow of
+// every later set. A gradual decline at normal pressure means emitters are
+// clogging; a decline together with pressure below the regulation range
+// points at a plugged filter or supply problem instead.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	clogCheckInterval    = 12 * time.Hour
+	clogHistoryWindow    = 30 * 24 * time.Hour
+	clogBaselineSets     = 5
+	clogRecentSets       = 3
+	clogMinSetSamples    = 5
+	clogSetGap           = 10 * time.Minute
+	clogMinFlowLPM       = 0.5
+	defaultClogWarnPct   = 10.0
+	defaultClogCritPct   = 25.0
+	clogTransientTrimPct = 0.2
+)
+
+// Alert kinds raised by this detector
+const (
+	AlertEmitterClogging  = "emitter_clogging"
+	AlertFilterOrPressure = "filter_or_pressure"
+)
+
+// FlowZone maps an irrigation zone to its flow meter.
+type FlowZone struct {
+	ZoneID         string  `json:"zone_id"`
+	MeterID        string  `json:"meter_id"`
+	MinPressureKPa float64 `json:"min_pressure_kpa"` // Lower bound of the emitters' PC regulation range (0 = unknown)
+
+	Boundary [][2]float64 `json:"boundary,omitempty"` // Zone outline as [lon, lat] pairs, for uniformity estimation
+}
+
+// FlowReading is one flow meter sample.
+type FlowReading struct {
+	MeterID     string    `json:"meter_id"`
+	Timestamp   time.Time `json:"timestamp"`
+	FlowLPM     float64   `json:"flow_lpm"`
+	PressureKPa float64   `json:"pressure_kpa"`
+}
+
+// irrigationSet is the steady-state signature of one contiguous run.
+type irrigationSet struct {
+	Start       time.Time
+	End         time.Time
+	FlowLPM     float64
+	PressureKPa float64
+}
+
+// FlowBaseline is the learned normal flow signature of a zone.
+type FlowBaseline struct {
+	FlowLPM     float64   `json:"flow_lpm"`
+	PressureKPa float64   `json:"pressure_kpa"`
+	LearnedAt   time.Time `json:"learned_at"`
+}
+
+// ZoneFlowHealth summarizes the latest clog assessment for a zone.
+type ZoneFlowHealth struct {
+	ZoneID          string        `json:"zone_id"`
+	Baseline        *FlowBaseline `json:"baseline,omitempty"`
+	RecentFlowLPM   float64       `json:"recent_flow_lpm"`
+	RecentPressure  float64       `json:"recent_pressure_kpa"`
+	CapacityLossPct float64       `json:"capacity_loss_pct"`
+	TrendPctPerWeek float64       `json:"trend_pct_per_week"`
+	SetsObserved    int           `json:"sets_observed"`
+	Status          string        `json:"status"` // learning | ok | emitter_clogging | filter_or_pressure
+	CheckedAt       time.Time     `json:"checked_at"`
+}
+
+// fetchFlowReadings loads flow meter samples for the field.
+func (ep *EdgeProcessor) fetchFlowReadings(window time.Duration) ([]FlowReading, error) {
+	query := `
+		SELECT meter_id, timestamp, flow_lpm, COALESCE(pressure_kpa, 0)
+		FROM zone_flow_readings
+		WHERE field_id = $1
+		  AND timestamp > $2
+		ORDER BY timestamp ASC
+	`
+
+	db := ep.cloud.DB()
+	if db == nil {
+		db = ep.localDB
+	}
+
+	rows, err := db.Query(query, ep.config.FieldID, time.Now().Add(-window))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := make([]FlowReading, 0)
+	for rows.Next() {
+		var r FlowReading
+		if err := rows.Scan(&r.MeterID, &r.Timestamp, &r.FlowLPM, &r.PressureKPa); err != nil {
+			ep.logger.Warn("Flow row scan error", "component", "emitter_clog", "error", err)
+			continue
+		}
+		readings = append(readings, r)
+	}
+	return readings, nil
+}
+
+// segmentIrrigationSets splits a meter's samples into contiguous runs and
+// reduces each to its steady-state flow, trimming fill and drain transients.
+func segmentIrrigationSets(readings []FlowReading) []irrigationSet {
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Timestamp.Before(readings[j].Timestamp) })
+
+	sets := make([]irrigationSet, 0)
+	current := make([]FlowReading, 0)
+	flush := func() {
+		if len(current) >= clogMinSetSamples {
+			trim := int(float64(len(current)) * clogTransientTrimPct)
+			steady := current[trim : len(current)-trim]
+			flows := make([]float64, len(steady))
+			pressures := make([]float64, len(steady))
+			for i, r := range steady {
+				flows[i] = r.FlowLPM
+				pressures[i] = r.PressureKPa
+			}
+			sets = append(sets, irrigationSet{
+				Start:       current[0].Timestamp,
+				End:         current[len(current)-1].Timestamp,
+				FlowLPM:     median(flows),
+				PressureKPa: median(pressures),
+			})
+		}
+		current = current[:0]
+	}
+
+	for _, r := range readings {
+		if r.FlowLPM < clogMinFlowLPM {
+			flush()
+			continue
+		}
+		if len(current) > 0 && r.Timestamp.Sub(current[len(current)-1].Timestamp) > clogSetGap {
+			flush()
+		}
+		current = append(current, r)
+	}
+	flush()
+	return sets
+}
+
+// assessZoneFlow compares recent sets to the zone's learned baseline.
+func (ep *EdgeProcessor) assessZoneFlow(zone FlowZone, sets []irrigationSet, now time.Time) ZoneFlowHealth {
+	health := ZoneFlowHealth{ZoneID: zone.ZoneID, SetsObserved: len(sets), Status: "learning", CheckedAt: now}
+
+	ep.stateMu.RLock()
+	baseline, learned := ep.flowBaselines[zone.ZoneID]
+	resetAt := ep.flowBaselineResetAt[zone.ZoneID]
+	ep.stateMu.RUnlock()
+
+	// After a reset, relearn only from sets run since the maintenance visit
+	if !resetAt.IsZero() {
+		kept := make([]irrigationSet, 0, len(sets))
+		for _, s := range sets {
+			if s.Start.After(resetAt) {
+				kept = append(kept, s)
+			}
+		}
+		sets = kept
+		health.SetsObserved = len(sets)
+	}
+
+	if !learned {
+		if len(sets) < clogBaselineSets+clogRecentSets {
+			return health
+		}
+		flows := make([]float64, clogBaselineSets)
+		pressures := make([]float64, clogBaselineSets)
+		for i := 0; i < clogBaselineSets; i++ {
+			flows[i] = sets[i].FlowLPM
+			pressures[i] = sets[i].PressureKPa
+		}
+		baseline = FlowBaseline{FlowLPM: median(flows), PressureKPa: median(pressures), LearnedAt: now}
+		ep.stateMu.Lock()
+		ep.flowBaselines[zone.ZoneID] = baseline
+		ep.stateMu.Unlock()
+	}
+	health.Baseline = &baseline
+	if len(sets) < clogRecentSets || baseline.FlowLPM <= 0 {
+		return health
+	}
+
+	recent := sets[len(sets)-clogRecentSets:]
+	flows := make([]float64, len(recent))
+	pressures := make([]float64, len(recent))
+	for i, s := range recent {
+		flows[i] = s.FlowLPM
+		pressures[i] = s.PressureKPa
+	}
+	health.RecentFlowLPM = median(flows)
+	health.RecentPressure = median(pressures)
+	health.CapacityLossPct = math.Max((baseline.FlowLPM-health.RecentFlowLPM)/baseline.FlowLPM*100, 0)
+	health.TrendPctPerWeek = flowTrendPctPerWeek(sets, baseline.FlowLPM)
+
+	warnPct := ep.config.ClogWarnPct
+	if warnPct <= 0 {
+		warnPct = defaultClogWarnPct
+	}
+	// Only a sustained decline counts; a single short set shouldn't alert
+	if health.CapacityLossPct < warnPct || health.TrendPctPerWeek >= 0 {
+		health.Status = "ok"
+		return health
+	}
+
+	if zone.MinPressureKPa > 0 && health.RecentPressure > 0 && health.RecentPressure < zone.MinPressureKPa {
+		health.Status = AlertFilterOrPressure
+	} else {
+		health.Status = AlertEmitterClogging
+	}
+	return health
+}
+
+// flowTrendPctPerWeek is the least-squares slope of steady flow vs time,
+// expressed as % of baseline per week.
+func flowTrendPctPerWeek(sets []irrigationSet, baseline float64) float64 {
+	if len(sets) < 2 {
+		return 0
+	}
+	t0 := sets[0].Start
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range sets {
+		x := s.Start.Sub(t0).Hours() / (24 * 7)
+		y := s.FlowLPM / baseline * 100
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(sets))
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denom
+}
+
+// checkEmitterClogging assesses every configured flow zone and raises
+// maintenance alerts for zones losing capacity.
+func (ep *EdgeProcessor) checkEmitterClogging(now time.Time) {
+	if len(ep.config.FlowZones) == 0 {
+		return
+	}
+
+	readings, err := ep.fetchFlowReadings(clogHistoryWindow)
+	if err != nil {
+		ep.logger.Error("Failed to fetch flow readings", "component", "emitter_clog", "error", err)
+		return
+	}
+	byMeter := make(map[string][]FlowReading)
+	for _, r := range readings {
+		byMeter[r.MeterID] = append(byMeter[r.MeterID], r)
+	}
+
+	critPct := ep.config.ClogCriticalPct
+	if critPct <= 0 {
+		critPct = defaultClogCritPct
+	}
+
+	for _, zone := range ep.config.FlowZones {
+		health := ep.assessZoneFlow(zone, segmentIrrigationSets(byMeter[zone.MeterID]), now)
+
+		ep.stateMu.Lock()
+		ep.zoneFlowHealth[zone.ZoneID] = health
+		ep.stateMu.Unlock()
+
+		if health.Status != AlertEmitterClogging && health.Status != AlertFilterOrPressure {
+			continue
+		}
+		severity := SeverityWarning
+		if health.CapacityLossPct >= critPct {
+			severity = SeverityCritical
+		}
+		message := "Steady-state flow declining at normal pressure; inspect and flush emitters"
+		if health.Status == AlertFilterOrPressure {
+			message = "Flow and pressure both low; inspect filters and supply pressure"
+		}
+		ep.alerts.Raise(Alert{
+			Kind:     health.Status,
+			Severity: severity,
+			FieldID:  ep.config.FieldID,
+			Subject:  zone.ZoneID,
+			Message:  message,
+			Value:    health.CapacityLossPct,
+		})
+	}
+}
+
+// maybeCheckEmitterClogging rate-limits clog detection to clogCheckInterval.
+func (ep *EdgeProcessor) maybeCheckEmitterClogging() {
+	now := time.Now()
+	if now.Sub(ep.lastClogCheck) < clogCheckInterval {
+		return
+	}
+	ep.lastClogCheck = now
+	ep.checkEmitterClogging(now)
+}
+
+// ZoneFlowHealth returns a snapshot of the latest per-zone assessments.
+func (ep *EdgeProcessor) ZoneFlowHealth() []ZoneFlowHealth {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	out := make([]ZoneFlowHealth, 0, len(ep.zoneFlowHealth))
+	for _, h := range ep.zoneFlowHealth {
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ZoneID < out[j].ZoneID })
+	return out
+}
+
+// ResetFlowBaseline forgets a zone's learned signature, e.g. after the
+// crew has flushed lines or replaced emitters.
+func (ep *EdgeProcessor) ResetFlowBaseline(zoneID string) {
+	ep.stateMu.Lock()
+	defer ep.stateMu.Unlock()
+	delete(ep.flowBaselines, zoneID)
+	delete(ep.zoneFlowHealth, zoneID)
+	ep.flowBaselineResetAt[zoneID] = time.Now()
+}
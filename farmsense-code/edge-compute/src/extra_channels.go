@@ -0,0 +1,160 @@
+// Extra Channels - vendor-specific reading channels
+// Probes report more than the grid models: soil oxygen, dendrometer
+// growth, leaf wetness. A reading's Extras carry those channels by name
+// next to its registered Channels, so they flow through ingestion instead
+// of being dropped: stored as a JSON object in the local cache (extras),
+// forwarded to and read back from the cloud's extras JSONB column
+// (migration 024), mirrored, and returned by /sensors.
+//
+// Codecs fill DecodedUplink.Extras directly. Devices whose network server
+// decodes the payload (a TTN payload formatter's decoded_payload, a
+// ChirpStack codec's object) get extras from extra_channels rules, each
+// naming an extra and where to find it:
+//
+//	{"name": "soil_oxygen_pct", "source": "o2", "codec": "dragino_lse01"}
+//	{"name": "trunk_um", "source": "dendro.0.position", "scale": 1000}
+//	{"name": "leaf_wetness", "source": "wet", "interpolate": true}
+//
+// source is a dotted path into the decoded object (array elements by
+// index); numbers, numeric strings and booleans (1/0) are accepted, then
+// value × scale + offset. A rule's name is also an import column
+// (reading_import.go).
+//
+// Extras are carried, not gridded. interpolate registers the channel as a
+// sensor variable, so it is estimated into each cell's Variables like
+// soil_ec; a plugin does the same with RegisterSensorVariable and a name,
+// whose default Read finds the value in Channels or Extras.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExtraChannelRule extracts one extra channel from decoded uplinks.
+type ExtraChannelRule struct {
+	Name        string  `json:"name"`        // Extras key, e.g. soil_oxygen_pct
+	Source      string  `json:"source"`      // Dotted path in the network server's decoded payload (default: name)
+	Codec       string  `json:"codec"`       // Only devices with this codec (default: every device)
+	Scale       float64 `json:"scale"`       // Multiplier (default 1)
+	Offset      float64 `json:"offset"`      // Added after scaling
+	Interpolate bool    `json:"interpolate"` // Grid it into each cell's variables
+}
+
+var extraChannelNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// extraVariables are the sensor variables registered for interpolated
+// extras, so they still count as extras rather than channels.
+var extraVariables = make(map[string]bool)
+
+// registerExtraChannels adds the interpolated rules to the sensor variable
+// registry. Call once at startup, before any processor runs.
+func registerExtraChannels(rules []ExtraChannelRule) {
+	for _, r := range rules {
+		if r.Interpolate && !extraVariables[r.Name] {
+			extraVariables[r.Name] = true
+			RegisterSensorVariable(SensorVariable{Name: r.Name})
+		}
+	}
+}
+
+// isRegisteredChannel reports whether name belongs in a reading's
+// Channels rather than its Extras.
+func isRegisteredChannel(name string) bool {
+	if extraVariables[name] {
+		return false
+	}
+	for _, v := range sensorVariables {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExtraChannels validates extra_channels rules.
+func checkExtraChannels(rules []ExtraChannelRule) error {
+	seen := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		if !extraChannelNamePattern.MatchString(r.Name) {
+			return fmt.Errorf("[%d]: name %q must be lower-case letters, digits and underscores", i, r.Name)
+		}
+		if isRegisteredChannel(r.Name) {
+			return fmt.Errorf("[%d]: %s is a registered channel", i, r.Name)
+		}
+		if r.Codec != "" && lookupPayloadCodec(r.Codec) == nil {
+			return fmt.Errorf("[%d]: unknown codec %q", i, r.Codec)
+		}
+		key := r.Codec + "/" + r.Name
+		if seen[key] {
+			return fmt.Errorf("[%d]: %s is extracted twice", i, r.Name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// extractExtras applies the rules for codec to a network server's decoded
+// payload, adding what they find to extras.
+func extractExtras(rules []ExtraChannelRule, codec string, decoded map[string]interface{}, extras map[string]float64) map[string]float64 {
+	if len(decoded) == 0 {
+		return extras
+	}
+	for _, r := range rules {
+		if r.Codec != "" && r.Codec != codec {
+			continue
+		}
+		source := r.Source
+		if source == "" {
+			source = r.Name
+		}
+		v, ok := decodedNumber(decoded, source)
+		if !ok {
+			continue
+		}
+		scale := r.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		if extras == nil {
+			extras = make(map[string]float64)
+		}
+		extras[r.Name] = v*scale + r.Offset
+	}
+	return extras
+}
+
+// decodedNumber looks up a dotted path in a decoded JSON object.
+func decodedNumber(decoded map[string]interface{}, path string) (float64, bool) {
+	var node interface{} = decoded
+	for _, key := range strings.Split(path, ".") {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return 0, false
+			}
+			node = n[i]
+		default:
+			return 0, false
+		}
+	}
+	switch v := node.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
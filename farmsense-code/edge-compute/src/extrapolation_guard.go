@@ -0,0 +1,349 @@
+// Extrapolation Guard - cells beyond the probes
+// IDW and RBF give a cell 300 m past the last probe that probe's reading,
+// and the confidence score doesn't know the cell is outside the network.
+// Each cycle, right after interpolation, the guard works out the probes'
+// coverage, sets quality flag extrapolated on every cell outside it
+// (quality_flags.go), and treats the cells more than
+// extrapolation_buffer_m (default grid_resolution_m) outside as
+// extrapolation_policy says:
+//
+//	flag       nothing more (the default)
+//	suppress   drop the cell from the cycle, like a cell without enough
+//	           sensors
+//	inflate    scale Confidence by b/(b+d), d metres past coverage and b the
+//	           buffer, so the confidence gate and consumers discount it
+//	zone_mean  replace moisture, temperature and variables with the mean of
+//	           the covered cells of its management zone (or of the field
+//	           outside zones) and recompute the derived metrics
+//
+// Coverage is the convex hull of the cycle's probes. extrapolation_alpha_m
+// narrows it to an alpha shape: the probes, and the sides and triangles
+// among a cell's nearest source probes that are no longer than alpha, so
+// the gap between two clusters of probes isn't covered. A cell on a probe
+// is always covered. fields entries can set their own
+// extrapolation_policy and extrapolation_alpha_m. Logical (greenhouse)
+// grids have no geometry and are left alone.
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+)
+
+// Extrapolation policies
+const (
+	ExtrapolationFlag     = "flag"
+	ExtrapolationSuppress = "suppress"
+	ExtrapolationInflate  = "inflate"
+	ExtrapolationZoneMean = "zone_mean"
+)
+
+// alphaMaxProbes bounds the source probes a cell's alpha shape is built
+// from; the nearest ones decide whether it is bracketed.
+const alphaMaxProbes = 12
+
+func validExtrapolationPolicy(policy string) bool {
+	switch policy {
+	case "", ExtrapolationFlag, ExtrapolationSuppress, ExtrapolationInflate, ExtrapolationZoneMean:
+		return true
+	}
+	return false
+}
+
+func (c EdgeConfig) extrapolationBuffer() float64 {
+	if c.ExtrapolationBufferM <= 0 {
+		return c.GridResolution
+	}
+	return c.ExtrapolationBufferM
+}
+
+// sensorCoverage is the area a cycle's probes cover.
+type sensorCoverage struct {
+	hull   []orb.Point          // convex hull, counterclockwise
+	alphaM float64              // > 0: alpha shape instead of the hull
+	probes map[string]orb.Point // by sensor ID
+}
+
+func newSensorCoverage(sensors []SensorReading, alphaM float64) *sensorCoverage {
+	c := &sensorCoverage{hull: sensorHull(sensors), alphaM: alphaM, probes: make(map[string]orb.Point, len(sensors))}
+	for _, s := range sensors {
+		c.probes[s.SensorID] = orb.Point{s.Longitude, s.Latitude}
+	}
+	return c
+}
+
+// beyond is how many metres p lies outside the coverage; 0 inside.
+func (c *sensorCoverage) beyond(p VirtualGridPoint) float64 {
+	if onProbe(p) {
+		return 0
+	}
+	at := orb.Point{p.Longitude, p.Latitude}
+	if c.alphaM > 0 {
+		return c.beyondAlpha(p, at)
+	}
+	if insideHull(c.hull, at) {
+		return 0
+	}
+	local := make([]orb.Point, len(c.hull))
+	for i, v := range c.hull {
+		local[i] = localMeters(at, v)
+	}
+	d := math.Inf(1)
+	for i := range local {
+		d = math.Min(d, segmentDistance(local[i], local[(i+1)%len(local)]))
+	}
+	return d
+}
+
+// beyondAlpha measures p against the alpha shape of its source probes.
+func (c *sensorCoverage) beyondAlpha(p VirtualGridPoint, at orb.Point) float64 {
+	local := make([]orb.Point, 0, len(p.SourceSensors))
+	for _, id := range p.SourceSensors {
+		if pos, ok := c.probes[id]; ok {
+			local = append(local, localMeters(at, pos))
+		}
+	}
+	sort.Slice(local, func(i, j int) bool { return planarNorm(local[i]) < planarNorm(local[j]) })
+	if len(local) > alphaMaxProbes {
+		local = local[:alphaMaxProbes]
+	}
+	if len(local) == 0 {
+		return math.Inf(1)
+	}
+
+	d := planarNorm(local[0])
+	for i := range local {
+		for j := i + 1; j < len(local); j++ {
+			if planarDist(local[i], local[j]) > c.alphaM {
+				continue
+			}
+			d = math.Min(d, segmentDistance(local[i], local[j]))
+			for k := j + 1; k < len(local); k++ {
+				if planarDist(local[i], local[k]) > c.alphaM || planarDist(local[j], local[k]) > c.alphaM {
+					continue
+				}
+				if insideTriangle(local[i], local[j], local[k]) {
+					return 0
+				}
+			}
+		}
+	}
+	return d
+}
+
+// onProbe reports whether a probe sits on the cell.
+func onProbe(p VirtualGridPoint) bool {
+	return len(p.attribution) > 0 && p.attribution[0].Distance == 0
+}
+
+// localMeters places p in metres east and north of origin.
+func localMeters(origin, p orb.Point) orb.Point {
+	return orb.Point{
+		(p[0] - origin[0]) * metersPerDegreeLat * math.Cos(origin[1]*math.Pi/180),
+		(p[1] - origin[1]) * metersPerDegreeLat,
+	}
+}
+
+func planarNorm(p orb.Point) float64 { return math.Hypot(p[0], p[1]) }
+
+func planarDist(a, b orb.Point) float64 { return math.Hypot(a[0]-b[0], a[1]-b[1]) }
+
+// segmentDistance is the distance from the origin to segment ab.
+func segmentDistance(a, b orb.Point) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	l2 := dx*dx + dy*dy
+	if l2 == 0 {
+		return planarNorm(a)
+	}
+	t := math.Max(0, math.Min(1, -(a[0]*dx+a[1]*dy)/l2))
+	return math.Hypot(a[0]+t*dx, a[1]+t*dy)
+}
+
+// insideTriangle reports whether the origin is inside or on triangle abc.
+func insideTriangle(a, b, c orb.Point) bool {
+	var o orb.Point
+	d1, d2, d3 := hullCross(a, b, o), hullCross(b, c, o), hullCross(c, a, o)
+	neg := d1 < 0 || d2 < 0 || d3 < 0
+	pos := d1 > 0 || d2 > 0 || d3 > 0
+	return !(neg && pos)
+}
+
+// sensorHull is the convex hull of the probes' positions, counterclockwise
+// (Andrew's monotone chain); fewer than three points when they span no
+// area.
+func sensorHull(sensors []SensorReading) []orb.Point {
+	pts := make([]orb.Point, 0, len(sensors))
+	for _, s := range sensors {
+		pts = append(pts, orb.Point{s.Longitude, s.Latitude})
+	}
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i][0] != pts[j][0] {
+			return pts[i][0] < pts[j][0]
+		}
+		return pts[i][1] < pts[j][1]
+	})
+	if len(pts) < 3 {
+		return pts
+	}
+	hull := make([]orb.Point, 0, 2*len(pts))
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for k := range pts {
+			p := pts[k]
+			if pass == 1 {
+				p = pts[len(pts)-1-k]
+			}
+			for len(hull) >= start+2 && hullCross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		hull = hull[:len(hull)-1] // the last point starts the other chain
+	}
+	return hull
+}
+
+// hullCross is the z component of (b-a)×(c-a); positive for a left turn.
+func hullCross(a, b, c orb.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// insideHull reports whether p is inside or on a counterclockwise hull.
+func insideHull(hull []orb.Point, p orb.Point) bool {
+	if len(hull) < 3 {
+		return false
+	}
+	for i := range hull {
+		if hullCross(hull[i], hull[(i+1)%len(hull)], p) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// applyExtrapolationGuard flags the cells outside the probes' coverage and
+// applies the field's policy to those past the buffer; suppressed cells
+// are left out of the returned grid.
+func (ep *EdgeProcessor) applyExtrapolationGuard(points []VirtualGridPoint, sensors []SensorReading) []VirtualGridPoint {
+	if ep.config.LogicalGrid != nil || len(points) == 0 {
+		return points
+	}
+	coverage := newSensorCoverage(sensors, ep.config.ExtrapolationAlphaM)
+	buffer := ep.config.extrapolationBuffer()
+	policy := ep.config.ExtrapolationPolicy
+
+	beyond := make([]float64, len(points))
+	far := 0
+	for i := range points {
+		beyond[i] = coverage.beyond(points[i])
+		if beyond[i] > 0 {
+			points[i].QualityFlags |= QualityExtrapolated
+		}
+		if beyond[i] > buffer {
+			far++
+		}
+	}
+	if far == 0 || policy == "" || policy == ExtrapolationFlag {
+		return points
+	}
+
+	switch policy {
+	case ExtrapolationSuppress:
+		kept := points[:0]
+		for i, p := range points {
+			if beyond[i] <= buffer {
+				kept = append(kept, p)
+			}
+		}
+		points = kept
+	case ExtrapolationInflate:
+		for i := range points {
+			if beyond[i] > buffer {
+				points[i].Confidence *= buffer / (buffer + beyond[i])
+			}
+		}
+	case ExtrapolationZoneMean:
+		far = ep.fillFromZoneMeans(points, beyond, buffer)
+	}
+	ep.cycleLog.Info("Guarded cells beyond sensor coverage", "component", "extrapolation",
+		"policy", policy, "cells", far, "buffer_m", buffer)
+	return points
+}
+
+// cellMeans accumulates the interpolated values of covered cells.
+type cellMeans struct {
+	surface, root, temp float64
+	vars                map[string]float64
+	varN                map[string]int
+	n                   int
+}
+
+func (m *cellMeans) add(p VirtualGridPoint) {
+	m.surface += p.MoistureSurface
+	m.root += p.MoistureRoot
+	m.temp += p.Temperature
+	for k, v := range p.Variables {
+		if m.vars == nil {
+			m.vars, m.varN = make(map[string]float64), make(map[string]int)
+		}
+		m.vars[k] += v
+		m.varN[k]++
+	}
+	m.n++
+}
+
+func (m *cellMeans) fill(p *VirtualGridPoint) {
+	n := float64(m.n)
+	p.MoistureSurface, p.MoistureRoot, p.Temperature = m.surface/n, m.root/n, m.temp/n
+	p.Variables = nil
+	for k, v := range m.vars {
+		p.setVariable(k, v/float64(m.varN[k]))
+	}
+}
+
+// fillFromZoneMeans replaces the cells past buffer with their zone's (or
+// the field's) covered mean and returns how many it replaced; cells with
+// nothing covered to take from are left as interpolated.
+func (ep *EdgeProcessor) fillFromZoneMeans(points []VirtualGridPoint, beyond []float64, buffer float64) int {
+	zoneOf := func(p VirtualGridPoint) int {
+		if ep.zones == nil {
+			return -1
+		}
+		return ep.zones.zoneOf(p)
+	}
+	var field cellMeans
+	zones := make(map[int]*cellMeans)
+	for i, p := range points {
+		if beyond[i] > 0 {
+			continue
+		}
+		field.add(p)
+		if idx := zoneOf(p); idx >= 0 {
+			if zones[idx] == nil {
+				zones[idx] = &cellMeans{}
+			}
+			zones[idx].add(p)
+		}
+	}
+
+	filled := 0
+	for i := range points {
+		if beyond[i] <= buffer {
+			continue
+		}
+		m := zones[zoneOf(points[i])]
+		if m == nil {
+			m = &field
+		}
+		if m.n == 0 {
+			continue
+		}
+		m.fill(&points[i])
+		ep.deriveMetrics(&points[i])
+		filled++
+	}
+	return filled
+}
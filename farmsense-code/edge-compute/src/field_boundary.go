@@ -0,0 +1,160 @@
+// Field Boundary - field outlines with holes and exclusion zones
+// Few fields are rectangles. field_boundary is the field's outline as
+// GeoJSON: a Polygon, a MultiPolygon for a field in several parts, or a
+// Feature or FeatureCollection of them. Interior rings are holes (a pond,
+// a farmstead). The grid spans the outline's bounding box and only cells
+// whose center is inside it are computed; the rest never exist, so they
+// are not uploaded, mapped, or counted in zone stats. Changing the
+// outline moves the grid origin, and with it every cell ID, so it needs a
+// restart.
+//
+// exclusion_zones cut further areas out without editing the outline:
+//
+//	{"name": "farmstead", "kind": "building", "boundary": [[lon, lat], ...]}
+//
+// kind is free text (building, pond, buffer_strip). They apply with or
+// without field_boundary and can change live. A management zone that
+// contains a pond therefore has the pond's cells missing from its area,
+// means and stressed share rather than diluting them.
+//
+// Without field_boundary the grid keeps its built-in extent.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// FieldBoundary is a field outline: polygons, each an exterior ring
+// followed by its holes, as [lon, lat] pairs.
+type FieldBoundary struct {
+	Polygons [][][][2]float64
+}
+
+// ExclusionZone is an area inside the field that is not cropped.
+type ExclusionZone struct {
+	Name     string       `json:"name"`
+	Kind     string       `json:"kind,omitempty"` // building, pond, buffer_strip, ...
+	Boundary [][2]float64 `json:"boundary"`       // Outline as [lon, lat] pairs
+}
+
+// UnmarshalJSON reads a GeoJSON Polygon, MultiPolygon, Feature or
+// FeatureCollection.
+func (b *FieldBoundary) UnmarshalJSON(data []byte) error {
+	polygons, err := parseFieldPolygons(data)
+	if err != nil {
+		return err
+	}
+	b.Polygons = polygons
+	return nil
+}
+
+// MarshalJSON writes the outline as a GeoJSON MultiPolygon.
+func (b FieldBoundary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": b.Polygons})
+}
+
+// parseFieldPolygons collects every polygon (holes included) in a GeoJSON
+// geometry, Feature or FeatureCollection.
+func parseFieldPolygons(data []byte) ([][][][2]float64, error) {
+	var doc struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometry    json.RawMessage `json:"geometry"`
+		Features    []struct {
+			Geometry json.RawMessage `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	var polygons [][][][2]float64
+	switch doc.Type {
+	case "Polygon":
+		var rings [][][2]float64
+		if err := json.Unmarshal(doc.Coordinates, &rings); err != nil {
+			return nil, fmt.Errorf("invalid polygon coordinates: %v", err)
+		}
+		polygons = [][][][2]float64{rings}
+	case "MultiPolygon":
+		if err := json.Unmarshal(doc.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid multipolygon coordinates: %v", err)
+		}
+	case "Feature":
+		return parseFieldPolygons(doc.Geometry)
+	case "FeatureCollection":
+		for i, f := range doc.Features {
+			p, err := parseFieldPolygons(f.Geometry)
+			if err != nil {
+				return nil, fmt.Errorf("feature %d: %v", i, err)
+			}
+			polygons = append(polygons, p...)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type %q (Polygon, MultiPolygon, Feature or FeatureCollection)", doc.Type)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("no polygons")
+	}
+	for i, rings := range polygons {
+		if len(rings) == 0 {
+			return nil, fmt.Errorf("polygon %d has no rings", i)
+		}
+		for j, ring := range rings {
+			if len(ring) < 3 {
+				return nil, fmt.Errorf("polygon %d ring %d needs at least 3 points", i, j)
+			}
+		}
+	}
+	return polygons, nil
+}
+
+// contains reports whether a point is inside one of the polygons and
+// outside its holes.
+func (b *FieldBoundary) contains(lon, lat float64) bool {
+	for _, rings := range b.Polygons {
+		if !pointInRing(lon, lat, rings[0]) {
+			continue
+		}
+		inHole := false
+		for _, hole := range rings[1:] {
+			if pointInRing(lon, lat, hole) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// extent returns the outline's bounding box.
+func (b *FieldBoundary) extent() (minLon, minLat, maxLon, maxLat float64) {
+	minLon, minLat = math.Inf(1), math.Inf(1)
+	maxLon, maxLat = math.Inf(-1), math.Inf(-1)
+	for _, rings := range b.Polygons {
+		for _, pt := range rings[0] {
+			minLon, maxLon = math.Min(minLon, pt[0]), math.Max(maxLon, pt[0])
+			minLat, maxLat = math.Min(minLat, pt[1]), math.Max(maxLat, pt[1])
+		}
+	}
+	return minLon, minLat, maxLon, maxLat
+}
+
+// inField reports whether a cell center is part of the cropped field:
+// inside field_boundary (when set) and outside every exclusion zone.
+func (c EdgeConfig) inField(lon, lat float64) bool {
+	if c.FieldBoundary != nil && !c.FieldBoundary.contains(lon, lat) {
+		return false
+	}
+	for _, z := range c.ExclusionZones {
+		if pointInRing(lon, lat, z.Boundary) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,547 @@
+// Field Lifecycle - seasons, crop rotation and fallow
+// Without lifecycle events the model runs the same all year: the config's
+// crop curve from its planting_date, and one water budget season per
+// planting date or calendar year. POST /fields/lifecycle records what
+// happened in the field instead, and the model follows it from that day:
+//
+//	planting    a season starts (crop_type, optional stages): the crop
+//	            curve starts on the day, the water budget restarts from the
+//	            measured deficit under the new season, and a season still
+//	            open is archived first (replanting)
+//	mid_season  the crop reached full cover; the curve is shifted so its
+//	            mid-season stage starts on the day
+//	harvest     the season ends and is archived; there is no crop water
+//	            use and irrigation recommendations are suppressed
+//	fallow      the field is left idle, after a harvest or instead of one
+//	            (an open season is archived as abandoned)
+//
+// While harvested or fallow every cell's and zone's irrigation_need is
+// none and irrigate-by is cleared, so VRI prescriptions come out empty and
+// no zone is reported neglected. Moisture and deficit are still computed
+// and the water budget books rain and drainage under a fallow-<date>
+// season. A planted crop takes its salinity settings from the config's
+// crop block.
+//
+// Events are kept in the local field_lifecycle table and the state at a
+// time is derived from them, so backfills and explain runs see the season
+// that applied then. An archived season is a field_seasons row with its
+// crop, dates and each zone's water budget totals. Both tables are upserted
+// to the cloud tables of the same names (migration 029) at each sync.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Lifecycle states
+const (
+	LifecyclePlanting  = "planting"
+	LifecycleMidSeason = "mid_season"
+	LifecycleHarvest   = "harvest"
+	LifecycleFallow    = "fallow"
+)
+
+const lifecycleDate = "2006-01-02"
+
+// FieldLifecycleEvent is one recorded transition.
+type FieldLifecycleEvent struct {
+	ID         int64           `json:"id"`
+	State      string          `json:"state"`               // planting | mid_season | harvest | fallow
+	Date       string          `json:"date"`                // YYYY-MM-DD it happened (default today)
+	CropType   string          `json:"crop_type,omitempty"` // planting: the new crop
+	Stages     *CropStageCurve `json:"stages,omitempty"`    // planting: overrides the built-in curve
+	Note       string          `json:"note,omitempty"`
+	Season     string          `json:"season"`
+	RecordedBy string          `json:"recorded_by,omitempty"`
+	RecordedAt time.Time       `json:"recorded_at"`
+}
+
+// FieldSeason is an archived season.
+type FieldSeason struct {
+	Season     string            `json:"season"`
+	CropType   string            `json:"crop_type"`
+	StartDate  string            `json:"start_date"`
+	EndDate    string            `json:"end_date"`
+	EndState   string            `json:"end_state"` // harvest | fallow (abandoned) | planting (replanted)
+	Zones      []ZoneWaterBudget `json:"zones"`
+	ArchivedAt time.Time         `json:"archived_at"`
+}
+
+// FieldLifecycle is the field's standing as exposed by the API.
+type FieldLifecycle struct {
+	State      string                `json:"state"` // empty = no events, the config's crop year-round
+	Season     string                `json:"season,omitempty"`
+	Since      string                `json:"since,omitempty"`
+	Crop       *CropModel            `json:"crop,omitempty"`
+	Suppressed bool                  `json:"irrigation_suppressed"`
+	Events     []FieldLifecycleEvent `json:"events"`
+	Seasons    []FieldSeason         `json:"seasons"`
+}
+
+// seasonState is the lifecycle evaluated at one time.
+type seasonState struct {
+	state  string
+	season string
+	since  string
+	start  string     // first day of the season
+	crop   *CropModel // nil while harvested or fallow
+}
+
+// suppresses reports whether irrigation recommendations are off.
+func (s seasonState) suppresses() bool {
+	return s.state == LifecycleHarvest || s.state == LifecycleFallow
+}
+
+func (s seasonState) open() bool {
+	return s.state == LifecyclePlanting || s.state == LifecycleMidSeason
+}
+
+// initLifecycleSchema creates the local lifecycle and season tables.
+func initLifecycleSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS field_lifecycle (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			field_id    TEXT    NOT NULL,
+			state       TEXT    NOT NULL,
+			date        TEXT    NOT NULL,
+			crop_type   TEXT,
+			stages      TEXT,
+			note        TEXT,
+			season      TEXT    NOT NULL,
+			recorded_by TEXT,
+			recorded_at INTEGER NOT NULL,
+			synced      INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS field_lifecycle_field ON field_lifecycle (field_id, date);
+		CREATE TABLE IF NOT EXISTS field_seasons (
+			field_id    TEXT    NOT NULL,
+			season      TEXT    NOT NULL,
+			crop_type   TEXT,
+			start_date  TEXT    NOT NULL,
+			end_date    TEXT    NOT NULL,
+			end_state   TEXT    NOT NULL,
+			zones       TEXT    NOT NULL,
+			archived_at INTEGER NOT NULL,
+			synced      INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (field_id, season)
+		);
+	`)
+	return err
+}
+
+// loadLifecycle restores the field's events from the local table.
+func (ep *EdgeProcessor) loadLifecycle() error {
+	rows, err := ep.localDB.Query(`
+		SELECT id, state, date, COALESCE(crop_type, ''), COALESCE(stages, ''), COALESCE(note, ''), season,
+		       COALESCE(recorded_by, ''), recorded_at
+		FROM field_lifecycle WHERE field_id = ? ORDER BY date, id
+	`, ep.config.FieldID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	events := make([]FieldLifecycleEvent, 0)
+	for rows.Next() {
+		var e FieldLifecycleEvent
+		var stages string
+		var recorded int64
+		if err := rows.Scan(&e.ID, &e.State, &e.Date, &e.CropType, &stages, &e.Note, &e.Season, &e.RecordedBy, &recorded); err != nil {
+			return err
+		}
+		if stages != "" {
+			e.Stages = new(CropStageCurve)
+			if err := json.Unmarshal([]byte(stages), e.Stages); err != nil {
+				return fmt.Errorf("invalid stages in lifecycle event %d: %v", e.ID, err)
+			}
+		}
+		e.RecordedAt = time.Unix(recorded, 0).UTC()
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	ep.stateMu.Lock()
+	ep.lifecycle = events
+	ep.stateMu.Unlock()
+	return nil
+}
+
+// replayLifecycle evaluates events (oldest first) up to and including
+// day; configCrop supplies the salinity settings.
+func replayLifecycle(events []FieldLifecycleEvent, day string, configCrop *CropModel) seasonState {
+	var s seasonState
+	for _, e := range events {
+		if e.Date > day {
+			break
+		}
+		switch e.State {
+		case LifecyclePlanting:
+			crop := &CropModel{CropType: e.CropType, PlantingDate: e.Date, Stages: e.Stages}
+			if configCrop != nil {
+				crop.SalinityThresholdDSm, crop.SalinitySlopePct = configCrop.SalinityThresholdDSm, configCrop.SalinitySlopePct
+			}
+			s = seasonState{crop: crop, start: e.Date}
+		case LifecycleMidSeason:
+			if s.crop == nil {
+				continue
+			}
+			curve, err := s.crop.curve()
+			if err != nil {
+				continue
+			}
+			mid, _ := time.Parse(lifecycleDate, e.Date)
+			shifted := *s.crop
+			shifted.PlantingDate = mid.AddDate(0, 0, -(curve.InitialDays + curve.DevelopmentDays)).Format(lifecycleDate)
+			s.crop = &shifted
+		case LifecycleHarvest, LifecycleFallow:
+			if s.state != LifecycleHarvest {
+				s.start = e.Date
+			}
+			s.crop = nil
+		}
+		s.state, s.season, s.since = e.State, e.Season, e.Date
+	}
+	return s
+}
+
+// seasonAt is the lifecycle at t; its state is empty without events then.
+func (ep *EdgeProcessor) seasonAt(t time.Time) seasonState {
+	ep.stateMu.RLock()
+	events := ep.lifecycle
+	ep.stateMu.RUnlock()
+	return replayLifecycle(events, t.UTC().Format(lifecycleDate), ep.config.Crop)
+}
+
+// cropModelAt is the crop growing at t: the lifecycle's once it has
+// events, otherwise the config's.
+func (ep *EdgeProcessor) cropModelAt(t time.Time) *CropModel {
+	if s := ep.seasonAt(t); s.state != "" {
+		return s.crop
+	}
+	return ep.config.Crop
+}
+
+// nextSeasonName names the season an event starts, or "" when the event
+// continues the current one.
+func nextSeasonName(current seasonState, e FieldLifecycleEvent) string {
+	switch {
+	case e.State == LifecyclePlanting:
+		return e.Date
+	case e.State == LifecycleMidSeason, e.State == LifecycleFallow && current.state == LifecycleHarvest:
+		return current.season
+	default:
+		return "fallow-" + e.Date
+	}
+}
+
+// RecordLifecycleEvent validates and stores a transition, archiving the
+// season it closes.
+func (ep *EdgeProcessor) RecordLifecycleEvent(e FieldLifecycleEvent, by string) (FieldLifecycleEvent, error) {
+	now := ep.clock.Now().UTC()
+	if e.Date == "" {
+		e.Date = now.Format(lifecycleDate)
+	}
+	date, err := time.Parse(lifecycleDate, e.Date)
+	if err != nil {
+		return e, fmt.Errorf("invalid date %q: want YYYY-MM-DD", e.Date)
+	}
+	if date.After(now) {
+		return e, fmt.Errorf("date %s is in the future", e.Date)
+	}
+
+	ep.lifecycleMu.Lock()
+	defer ep.lifecycleMu.Unlock()
+	ep.stateMu.RLock()
+	events := ep.lifecycle
+	ep.stateMu.RUnlock()
+	current := replayLifecycle(events, "9999-12-31", ep.config.Crop)
+	if current.since != "" && e.Date < current.since {
+		return e, fmt.Errorf("date %s is before the current %s state (%s)", e.Date, current.state, current.since)
+	}
+	switch e.State {
+	case LifecyclePlanting:
+		if _, err := (&CropModel{CropType: e.CropType, Stages: e.Stages}).curve(); err != nil {
+			return e, err
+		}
+	case LifecycleMidSeason:
+		if current.crop == nil {
+			return e, fmt.Errorf("mid_season needs a planted crop (state is %q)", current.state)
+		}
+	case LifecycleHarvest:
+		if !current.open() {
+			return e, fmt.Errorf("harvest needs a planted crop (state is %q)", current.state)
+		}
+	case LifecycleFallow:
+		if current.state == LifecycleFallow {
+			return e, fmt.Errorf("field is already fallow since %s", current.since)
+		}
+	default:
+		return e, fmt.Errorf("state must be planting, mid_season, harvest or fallow (got %q)", e.State)
+	}
+	if e.State != LifecyclePlanting {
+		e.CropType, e.Stages = "", nil
+	}
+	e.Season = nextSeasonName(current, e)
+	e.RecordedBy = by
+	e.RecordedAt = time.Now().UTC().Truncate(time.Second)
+
+	if current.open() && e.State != LifecycleMidSeason {
+		if err := ep.archiveSeason(current, e); err != nil {
+			return e, err
+		}
+	}
+	var stages interface{}
+	if e.Stages != nil {
+		data, err := json.Marshal(e.Stages)
+		if err != nil {
+			return e, err
+		}
+		stages = string(data)
+	}
+	res, err := ep.localDB.Exec(`
+		INSERT INTO field_lifecycle (field_id, state, date, crop_type, stages, note, season, recorded_by, recorded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ep.config.FieldID, e.State, e.Date, nullString(e.CropType), stages, nullString(e.Note), e.Season,
+		nullString(by), e.RecordedAt.Unix())
+	if err != nil {
+		return e, fmt.Errorf("failed to store lifecycle event: %v", err)
+	}
+	e.ID, _ = res.LastInsertId()
+
+	updated := append(append(make([]FieldLifecycleEvent, 0, len(events)+1), events...), e)
+	sort.SliceStable(updated, func(i, j int) bool { return updated[i].Date < updated[j].Date })
+	ep.stateMu.Lock()
+	ep.lifecycle = updated
+	ep.stateMu.Unlock()
+	ep.logger.Info("Field lifecycle changed", "component", "lifecycle", "state", e.State, "date", e.Date,
+		"season", e.Season, "crop_type", e.CropType, "by", by)
+	return e, nil
+}
+
+// archiveSeason records the closing season's crop, dates and zone water
+// budget totals.
+func (ep *EdgeProcessor) archiveSeason(s seasonState, closing FieldLifecycleEvent) error {
+	zones, err := ep.WaterBudget(s.season)
+	if err != nil {
+		return fmt.Errorf("failed to total the season's water budget: %v", err)
+	}
+	data, err := json.Marshal(zones)
+	if err != nil {
+		return err
+	}
+	cropType := ""
+	if s.crop != nil {
+		cropType = s.crop.CropType
+	}
+	if _, err := ep.localDB.Exec(`
+		INSERT INTO field_seasons (field_id, season, crop_type, start_date, end_date, end_state, zones, archived_at, synced)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)
+		ON CONFLICT (field_id, season) DO UPDATE SET
+			crop_type = excluded.crop_type, start_date = excluded.start_date, end_date = excluded.end_date,
+			end_state = excluded.end_state, zones = excluded.zones, archived_at = excluded.archived_at, synced = 0
+	`, ep.config.FieldID, s.season, nullString(cropType), s.start, closing.Date, closing.State, string(data),
+		time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to archive season %s: %v", s.season, err)
+	}
+	ep.logger.Info("Archived season", "component", "lifecycle", "season", s.season, "crop_type", cropType,
+		"zones", len(zones))
+	return nil
+}
+
+// Seasons returns the field's archived seasons, newest first.
+func (ep *EdgeProcessor) Seasons() ([]FieldSeason, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT season, COALESCE(crop_type, ''), start_date, end_date, end_state, zones, archived_at
+		FROM field_seasons WHERE field_id = ? ORDER BY start_date DESC
+	`, ep.config.FieldID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query seasons: %v", err)
+	}
+	defer rows.Close()
+	out := make([]FieldSeason, 0)
+	for rows.Next() {
+		var s FieldSeason
+		var zones string
+		var archived int64
+		if err := rows.Scan(&s.Season, &s.CropType, &s.StartDate, &s.EndDate, &s.EndState, &zones, &archived); err != nil {
+			return nil, fmt.Errorf("failed to read seasons: %v", err)
+		}
+		if err := json.Unmarshal([]byte(zones), &s.Zones); err != nil {
+			return nil, fmt.Errorf("invalid zones in season %s: %v", s.Season, err)
+		}
+		s.ArchivedAt = time.Unix(archived, 0).UTC()
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// Lifecycle returns the field's current standing, events of the current
+// season and archived seasons.
+func (ep *EdgeProcessor) Lifecycle() (FieldLifecycle, error) {
+	s := ep.seasonAt(ep.clock.Now())
+	out := FieldLifecycle{State: s.state, Season: s.season, Since: s.since, Crop: s.crop, Suppressed: s.suppresses(),
+		Events: make([]FieldLifecycleEvent, 0)}
+	ep.stateMu.RLock()
+	for _, e := range ep.lifecycle {
+		if e.Date >= s.start {
+			out.Events = append(out.Events, e)
+		}
+	}
+	ep.stateMu.RUnlock()
+	var err error
+	out.Seasons, err = ep.Seasons()
+	return out, err
+}
+
+// applyLifecycle clears irrigation recommendations from the cycle's cells
+// while the field is harvested or fallow.
+func (ep *EdgeProcessor) applyLifecycle(points []VirtualGridPoint, at time.Time) {
+	s := ep.seasonAt(at)
+	if !s.suppresses() {
+		return
+	}
+	for i := range points {
+		points[i].IrrigationNeed = "none"
+		points[i].IrrigateBy = nil
+	}
+	if fc := ep.cycleForecast; fc != nil && fc.GeneratedAt.Equal(at) { // this cycle's, not a published one
+		fc.CellsIrrigateBy = 0
+	}
+	ep.cycleLog.Debug("Irrigation recommendations suppressed", "component", "lifecycle", "state", s.state, "since", s.since)
+}
+
+// applyLifecycleZones does the same for zones, before their irrigation
+// status is assessed.
+func (ep *EdgeProcessor) applyLifecycleZones(stats []ZoneStats, at time.Time) {
+	if !ep.seasonAt(at).suppresses() {
+		return
+	}
+	for i := range stats {
+		stats[i].IrrigationNeed = "none"
+	}
+}
+
+// syncLifecycle upserts unsynced lifecycle events and archived seasons to
+// the cloud, leaving them flagged while offline.
+func (ep *EdgeProcessor) syncLifecycle() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT id, state, date, COALESCE(crop_type, ''), COALESCE(stages, ''), COALESCE(note, ''), season,
+		       COALESCE(recorded_by, ''), recorded_at
+		FROM field_lifecycle WHERE field_id = ? AND synced = 0
+	`, ep.config.FieldID)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read unsynced lifecycle events", "component", "lifecycle", "error", err)
+		return
+	}
+	type pendingEvent struct {
+		FieldLifecycleEvent
+		stages   string
+		recorded int64
+	}
+	events := make([]pendingEvent, 0)
+	for rows.Next() {
+		var p pendingEvent
+		if err := rows.Scan(&p.ID, &p.State, &p.Date, &p.CropType, &p.stages, &p.Note, &p.Season, &p.RecordedBy, &p.recorded); err != nil {
+			rows.Close()
+			ep.cycleLog.Error("Failed to read unsynced lifecycle events", "component", "lifecycle", "error", err)
+			return
+		}
+		events = append(events, p)
+	}
+	rows.Close()
+	seasons, err := ep.localDB.Query(`
+		SELECT season, COALESCE(crop_type, ''), start_date, end_date, end_state, zones, archived_at
+		FROM field_seasons WHERE field_id = ? AND synced = 0
+	`, ep.config.FieldID)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read unsynced seasons", "component", "lifecycle", "error", err)
+		return
+	}
+	type pendingSeason struct {
+		FieldSeason
+		zones    string
+		archived int64
+	}
+	archived := make([]pendingSeason, 0)
+	for seasons.Next() {
+		var p pendingSeason
+		if err := seasons.Scan(&p.Season, &p.CropType, &p.StartDate, &p.EndDate, &p.EndState, &p.zones, &p.archived); err != nil {
+			seasons.Close()
+			ep.cycleLog.Error("Failed to read unsynced seasons", "component", "lifecycle", "error", err)
+			return
+		}
+		archived = append(archived, p)
+	}
+	seasons.Close()
+	if len(events) == 0 && len(archived) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	defer tx.Rollback()
+	for _, p := range events {
+		var stages interface{}
+		if p.stages != "" {
+			stages = p.stages
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO field_lifecycle_events
+				(field_id, event_uid, state, event_date, crop_type, stages, note, season, recorded_by,
+				 recorded_at, edge_device_id)
+			VALUES ($1, $2, $3, $4, $5, $6::jsonb, $7, $8, $9, $10, $11)
+			ON CONFLICT (field_id, event_uid) DO NOTHING
+		`, ep.config.FieldID, fmt.Sprintf("%s:%d", ep.deviceID, p.ID), p.State, p.Date, nullString(p.CropType), stages,
+			nullString(p.Note), p.Season, nullString(p.RecordedBy), time.Unix(p.recorded, 0).UTC(), ep.deviceID); err != nil {
+			ep.cycleLog.Warn("Lifecycle upload failed, keeping events queued", "component", "lifecycle", "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+	}
+	for _, p := range archived {
+		if _, err := tx.Exec(`
+			INSERT INTO field_seasons
+				(field_id, season, crop_type, start_date, end_date, end_state, zones, archived_at, edge_device_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7::jsonb, $8, $9)
+			ON CONFLICT (field_id, season) DO UPDATE SET
+				crop_type = EXCLUDED.crop_type, start_date = EXCLUDED.start_date, end_date = EXCLUDED.end_date,
+				end_state = EXCLUDED.end_state, zones = EXCLUDED.zones, archived_at = EXCLUDED.archived_at,
+				edge_device_id = EXCLUDED.edge_device_id
+		`, ep.config.FieldID, p.Season, nullString(p.CropType), p.StartDate, p.EndDate, p.EndState, p.zones,
+			time.Unix(p.archived, 0).UTC(), ep.deviceID); err != nil {
+			ep.cycleLog.Warn("Season upload failed, keeping seasons queued", "component", "lifecycle", "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+
+	for _, p := range events {
+		if _, err := ep.localDB.Exec(`UPDATE field_lifecycle SET synced = 1 WHERE id = ?`, p.ID); err != nil {
+			ep.cycleLog.Warn("Failed to mark lifecycle event synced", "component", "lifecycle", "error", err)
+		}
+	}
+	for _, p := range archived {
+		if _, err := ep.localDB.Exec(`
+			UPDATE field_seasons SET synced = 1 WHERE field_id = ? AND season = ? AND archived_at = ?
+		`, ep.config.FieldID, p.Season, p.archived); err != nil {
+			ep.cycleLog.Warn("Failed to mark season synced", "component", "lifecycle", "error", err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Field Scheduler - weighted fair compute scheduling for multi-field gateways
+// A gateway serving many fields may not have the CPU to run every field's
+// cycle on time. Each field's processor hands its compute timing to the
+// scheduler, which grants cycles to at most MaxConcurrentCycles fields at
+// once:
+//   - a field whose staleness is about to exceed its max staleness bound
+//     runs first (earliest deadline)
+//   - otherwise due fields share CPU by weight (stride scheduling: a field's
+//     pass grows by cycle time / weight, lowest pass runs next)
+//   - a field is due at each of its wall-clock slots (compute_schedule.go),
+//     and its cycle is stamped with the slot; one with a sensor event
+//     pending (compute_triggers.go) is due before then
+//
+// A field that completes a cycle past its bound has missed its window;
+// repeated misses raise an alert so the gateway can be resized or fields
+// moved to a peer.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	schedulerTick             = 5 * time.Second
+	defaultFieldWeight        = 1.0
+	defaultMaxStalenessFactor = 3 // × compute interval
+	fieldStarvationAlertAfter = 3 // consecutive missed windows
+)
+
+// AlertFieldStarved is raised when a field repeatedly misses its window.
+const AlertFieldStarved = "field_starved"
+
+// FieldSchedule sets a field's share of gateway compute.
+type FieldSchedule struct {
+	FieldID         string  `json:"field_id"`
+	TenantID        string  `json:"tenant_id"`         // Owner of this field (default: the gateway's tenant_id)
+	Weight          float64 `json:"weight"`            // Relative priority (default 1)
+	MaxStalenessSec int     `json:"max_staleness_sec"` // Longest acceptable gap between cycles (default 3× compute interval)
+
+	Anisotropy *Anisotropy `json:"anisotropy,omitempty"` // Overrides the gateway-wide row direction for this field
+	Crop       *CropModel  `json:"crop,omitempty"`       // Overrides the gateway-wide crop model for this field
+
+	DerivedMetrics []string `json:"derived_metrics,omitempty"` // Overrides the gateway-wide optional metrics for this field
+
+	ExtrapolationPolicy string  `json:"extrapolation_policy,omitempty"`  // Overrides the gateway-wide extrapolation_policy for this field
+	ExtrapolationAlphaM float64 `json:"extrapolation_alpha_m,omitempty"` // Overrides the gateway-wide extrapolation_alpha_m for this field
+}
+
+// computeGrant lets a processor run one cycle; it closes done when finished.
+type computeGrant struct {
+	done chan struct{}
+	slot time.Time // schedule slot the cycle is for; zero = off schedule
+}
+
+// FieldScheduleStatus is the per-field scheduling state exposed by the API.
+type FieldScheduleStatus struct {
+	FieldID           string    `json:"field_id"`
+	TenantID          string    `json:"tenant_id,omitempty"`
+	Weight            float64   `json:"weight"`
+	StalenessSec      float64   `json:"staleness_sec"`
+	MaxStalenessSec   float64   `json:"max_staleness_sec"`
+	LastCompletedAt   time.Time `json:"last_completed_at"`
+	LastDurationSec   float64   `json:"last_duration_sec"`
+	Runs              int       `json:"runs"`
+	MissedWindows     int       `json:"missed_windows"`
+	ConsecutiveMisses int       `json:"consecutive_misses"`
+	Running           bool      `json:"running"`
+}
+
+type scheduledField struct {
+	processor *EdgeProcessor
+	grants    chan computeGrant
+	weight    float64
+	maxStale  time.Duration // 0 = derive from compute interval
+	nextSlot  time.Time     // next schedule slot to grant
+	pass      float64
+	status    FieldScheduleStatus
+}
+
+// FieldScheduler grants compute cycles across a gateway's fields.
+type FieldScheduler struct {
+	mu            sync.Mutex
+	fields        []*scheduledField
+	maxConcurrent int
+	running       int
+	started       time.Time
+	alerts        *AlertLog
+	logger        *slog.Logger
+}
+
+func NewFieldScheduler(maxConcurrent int, alerts *AlertLog) *FieldScheduler {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	return &FieldScheduler{
+		maxConcurrent: maxConcurrent,
+		alerts:        alerts,
+		logger:        slog.With("component", "scheduler"),
+	}
+}
+
+// Add puts a processor under the scheduler. Call before processor.Run.
+func (s *FieldScheduler) Add(processor *EdgeProcessor, sched FieldSchedule) {
+	weight := sched.Weight
+	if weight <= 0 {
+		weight = defaultFieldWeight
+	}
+	f := &scheduledField{
+		processor: processor,
+		grants:    make(chan computeGrant),
+		weight:    weight,
+		maxStale:  time.Duration(sched.MaxStalenessSec) * time.Second,
+		nextSlot:  processor.computeSchedule().upcoming(time.Now()),
+		status:    FieldScheduleStatus{FieldID: processor.config.FieldID, TenantID: processor.config.TenantID, Weight: weight},
+	}
+	processor.computeGrants = f.grants
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// New fields start level with the least-served one so they can't
+	// monopolize the gateway to "catch up"
+	for i, other := range s.fields {
+		if i == 0 || other.pass < f.pass {
+			f.pass = other.pass
+		}
+	}
+	s.fields = append(s.fields, f)
+}
+
+func (f *scheduledField) maxStaleness() time.Duration {
+	if f.maxStale > 0 {
+		return f.maxStale
+	}
+	return defaultMaxStalenessFactor * f.processor.computeInterval()
+}
+
+// Run schedules until the process exits.
+func (s *FieldScheduler) Run() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	s.mu.Lock()
+	s.started = time.Now()
+	s.mu.Unlock()
+	for {
+		s.dispatch(time.Now())
+		<-ticker.C
+	}
+}
+
+// dispatch grants cycles to due fields while concurrency allows.
+func (s *FieldScheduler) dispatch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.running < s.maxConcurrent {
+		f := s.next(now)
+		if f == nil {
+			return
+		}
+		var slot time.Time
+		if sched := f.processor.computeSchedule(); sched.due(f.nextSlot, now) {
+			slot, f.nextSlot = f.nextSlot, sched.upcoming(now)
+		}
+		f.status.Running = true
+		s.running++
+		go s.runCycle(f, slot)
+	}
+}
+
+// next picks the due field with the nearest deadline if any is at risk,
+// otherwise the due field with the lowest pass.
+func (s *FieldScheduler) next(now time.Time) *scheduledField {
+	var urgent, fair *scheduledField
+	var urgentSlack time.Duration
+	for _, f := range s.fields {
+		if f.status.Running {
+			continue
+		}
+		last := f.status.LastCompletedAt
+		never := last.IsZero()
+		if never {
+			// Never run: due as soon as the scheduler starts
+			last = s.started.Add(-f.processor.computeInterval())
+		}
+		staleness := now.Sub(last)
+		if !never && !f.processor.computeSchedule().due(f.nextSlot, now) && !f.processor.eventDue() {
+			continue
+		}
+
+		// At risk if the remaining slack won't cover one more cycle
+		slack := f.maxStaleness() - staleness
+		cycle := time.Duration(f.status.LastDurationSec * float64(time.Second))
+		if slack <= cycle+schedulerTick && (urgent == nil || slack < urgentSlack) {
+			urgent, urgentSlack = f, slack
+		}
+		if fair == nil || f.pass < fair.pass {
+			fair = f
+		}
+	}
+	if urgent != nil {
+		return urgent
+	}
+	return fair
+}
+
+func (s *FieldScheduler) runCycle(f *scheduledField, slot time.Time) {
+	started := time.Now()
+	grant := computeGrant{done: make(chan struct{}), slot: slot}
+	f.grants <- grant
+	<-grant.done
+	finished := time.Now()
+
+	s.mu.Lock()
+	prev := f.status.LastCompletedAt
+	if prev.IsZero() {
+		prev = s.started
+	}
+	f.status.Running = false
+	f.status.Runs++
+	f.status.LastDurationSec = finished.Sub(started).Seconds()
+	f.status.LastCompletedAt = finished
+	f.pass += f.status.LastDurationSec / f.weight
+	s.running--
+
+	maxStale := f.maxStaleness()
+	missed := finished.Sub(prev) > maxStale
+	if missed {
+		f.status.MissedWindows++
+		f.status.ConsecutiveMisses++
+	} else {
+		f.status.ConsecutiveMisses = 0
+	}
+	consecutive := f.status.ConsecutiveMisses
+	s.mu.Unlock()
+
+	if missed {
+		s.logger.Warn("Field missed its staleness window", "field_id", f.status.FieldID,
+			"gap_sec", finished.Sub(prev).Seconds(), "max_staleness_sec", maxStale.Seconds())
+	}
+	if consecutive > 0 && consecutive%fieldStarvationAlertAfter == 0 {
+		s.alerts.Raise(Alert{
+			Kind:     AlertFieldStarved,
+			Severity: SeverityWarning,
+			FieldID:  f.status.FieldID,
+			Subject:  f.status.FieldID,
+			Message:  fmt.Sprintf("Field missed its %s staleness window %d times in a row; gateway is overloaded", maxStale, consecutive),
+			Value:    float64(consecutive),
+		})
+	}
+
+	// Hand the freed slot to the next field straight away
+	s.dispatch(time.Now())
+}
+
+// Processors returns the processors of every scheduled field.
+func (s *FieldScheduler) Processors() []*EdgeProcessor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*EdgeProcessor, 0, len(s.fields))
+	for _, f := range s.fields {
+		out = append(out, f.processor)
+	}
+	return out
+}
+
+// Status returns per-field scheduling state, stalest first.
+func (s *FieldScheduler) Status() []FieldScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	out := make([]FieldScheduleStatus, 0, len(s.fields))
+	for _, f := range s.fields {
+		st := f.status
+		st.MaxStalenessSec = f.maxStaleness().Seconds()
+		if !st.LastCompletedAt.IsZero() {
+			st.StalenessSec = now.Sub(st.LastCompletedAt).Seconds()
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StalenessSec > out[j].StalenessSec })
+	return out
+}
+
+// gatewayFieldConfig is the config an extra gateway field runs with: the
+// gateway's, with the field's own ID, anisotropy and crop.
+func gatewayFieldConfig(config EdgeConfig, fs FieldSchedule) EdgeConfig {
+	fieldConfig := config
+	fieldConfig.FieldID = fs.FieldID
+	if fs.TenantID != "" {
+		fieldConfig.TenantID = fs.TenantID
+	}
+	if fs.Anisotropy != nil {
+		fieldConfig.Anisotropy = fs.Anisotropy
+	}
+	if fs.Crop != nil {
+		fieldConfig.Crop = fs.Crop
+	}
+	if fs.DerivedMetrics != nil {
+		fieldConfig.DerivedMetrics = fs.DerivedMetrics
+	}
+	if fs.ExtrapolationPolicy != "" {
+		fieldConfig.ExtrapolationPolicy = fs.ExtrapolationPolicy
+	}
+	if fs.ExtrapolationAlphaM > 0 {
+		fieldConfig.ExtrapolationAlphaM = fs.ExtrapolationAlphaM
+	}
+	return fieldConfig
+}
+
+// startGatewayFields puts primary and one processor per extra configured
+// field under a scheduler. Extra fields share the primary's config (and
+// alert log) with their own field_id; hot reloads reach the primary only.
+func startGatewayFields(config EdgeConfig, primary *EdgeProcessor) (*FieldScheduler, error) {
+	scheduler := NewFieldScheduler(config.MaxConcurrentCycles, primary.alerts)
+	primarySched := FieldSchedule{FieldID: config.FieldID}
+	extra := make([]*EdgeProcessor, 0, len(config.Fields))
+
+	for _, fs := range config.Fields {
+		if fs.FieldID == config.FieldID {
+			primarySched = fs
+			continue
+		}
+		p, err := NewEdgeProcessor(gatewayFieldConfig(config, fs), config.DeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize field %s: %v", fs.FieldID, err)
+		}
+		p.alerts = primary.alerts
+		p.clock = primary.clock
+		scheduler.Add(p, fs)
+		extra = append(extra, p)
+	}
+	scheduler.Add(primary, primarySched)
+
+	for _, p := range extra {
+		go p.Run()
+	}
+	go scheduler.Run()
+	slog.Info("Gateway scheduling fields", "component", "scheduler", "fields", len(extra)+1,
+		"max_concurrent_cycles", scheduler.maxConcurrent)
+	return scheduler, nil
+}
@@ -0,0 +1,494 @@
+// Fleet Client - device registration, heartbeats and the command queue
+// On the first tick with a cloud link the device upserts itself into the
+// devices table (external_id = device_id) with its hardware model, app
+// version and assigned fields. Every tick after that it refreshes
+// last_communication and latest_telemetry with host resource stats, then
+// claims pending rows from device_commands; with command_channel listen a
+// NOTIFY for the device claims them at once (command_channel.go). Commands
+// run on the processor's main loop, one at a time in queue order:
+//   - recompute:   run a grid cycle now
+//   - resync:      full grid snapshot next upload, replay cached raw readings
+//   - sync:        flush the offline queues now
+//   - reboot:      flush the sync queue, then reboot the host
+//   - backfill:    recompute a window (params from, to, step)
+//   - diagnostics: upload logs, config and local cache stats
+//   - log_level:   change the log level for a while (params level, duration)
+//
+// A command claimed by a process that then died stays "running"; the next
+// boot marks it failed, except a reboot, which dying is the success of.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// appVersion is set at build time: -ldflags "-X main.appVersion=1.4.2"
+var appVersion = "dev"
+
+const (
+	defaultFleetHeartbeat = 60 * time.Second
+	fleetTimeout          = 15 * time.Second
+	fleetCommandBatch     = 10
+	fleetCommandHistory   = 20
+)
+
+// Fleet commands
+const (
+	FleetCommandReboot    = "reboot"
+	FleetCommandResync    = "resync"
+	FleetCommandRecompute = "recompute"
+	FleetCommandSync      = "sync"
+	FleetCommandBackfill  = "backfill"
+	FleetCommandDiagnose  = "diagnostics"
+	FleetCommandLogLevel  = "log_level"
+	FleetCommandProfile   = "profile"
+)
+
+var rebootCommand = []string{"systemctl", "reboot"}
+
+// FleetCommand is one claimed row from device_commands.
+type FleetCommand struct {
+	ID        int64
+	Command   string
+	Params    json.RawMessage // device_commands.params; empty when none
+	CreatedBy string          // device_commands.created_by, or the local API user
+	CreatedAt time.Time
+	done      chan error // the main loop's result
+}
+
+// FleetCommandRecord is a command's outcome as exposed by the API.
+type FleetCommandRecord struct {
+	ID          int64     `json:"id"`
+	Command     string    `json:"command"`
+	Status      string    `json:"status"`
+	Result      string    `json:"result,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// FleetStatus is the client's state exposed by the API.
+type FleetStatus struct {
+	DeviceID        string               `json:"device_id"`
+	HardwareModel   string               `json:"hardware_model"`
+	AppVersion      string               `json:"app_version"`
+	Registered      bool                 `json:"registered"`
+	RegisteredAt    time.Time            `json:"registered_at,omitempty"`
+	LastHeartbeatAt time.Time            `json:"last_heartbeat_at,omitempty"`
+	LastError       string               `json:"last_error,omitempty"`
+	Stats           DeviceStats          `json:"stats"`
+	Commands        []FleetCommandRecord `json:"commands"` // most recent first
+}
+
+// FleetClient keeps the device's row in the cloud registry current.
+type FleetClient struct {
+	deviceID  string
+	fieldID   string
+	fieldIDs  []string
+	model     string
+	diskPath  string
+	interval  time.Duration
+	cloud     *CloudConnManager
+	health    *HealthState
+	commands  chan FleetCommand
+	wake      chan struct{} // a NOTIFY for this device arrived
+	listenDSN string        // empty = poll on the heartbeat only
+	startedAt time.Time
+	cpu       cpuTimes
+	recovered bool // interrupted commands from a previous boot settled
+
+	mu      sync.Mutex
+	status  FleetStatus
+	pending []FleetCommandRecord // outcomes not yet written to the cloud
+	logger  *slog.Logger
+}
+
+func NewFleetClient(config EdgeConfig, cloud *CloudConnManager, health *HealthState) *FleetClient {
+	interval := time.Duration(config.FleetHeartbeatSec) * time.Second
+	if interval <= 0 {
+		interval = defaultFleetHeartbeat
+	}
+	model := config.HardwareModel
+	if model == "" {
+		model = hardwareModel()
+	}
+	if model == "" {
+		model = runtime.GOOS + "/" + runtime.GOARCH
+	}
+
+	fieldIDs := []string{config.FieldID}
+	for _, fs := range config.Fields {
+		if fs.FieldID != config.FieldID {
+			fieldIDs = append(fieldIDs, fs.FieldID)
+		}
+	}
+
+	listenDSN := ""
+	if config.CommandChannel != CommandChannelPoll {
+		listenDSN = cloud.dsn
+	}
+
+	return &FleetClient{
+		deviceID:  config.DeviceID,
+		fieldID:   config.FieldID,
+		fieldIDs:  fieldIDs,
+		model:     model,
+		diskPath:  filepath.Dir(config.LocalCacheDB),
+		interval:  interval,
+		cloud:     cloud,
+		health:    health,
+		commands:  make(chan FleetCommand),
+		wake:      make(chan struct{}, 1),
+		listenDSN: listenDSN,
+		startedAt: time.Now(),
+		status:    FleetStatus{DeviceID: config.DeviceID, HardwareModel: model, AppVersion: appVersion},
+		logger:    slog.With("component", "fleet"),
+	}
+}
+
+// Commands delivers claimed commands to the main loop. The receiver must
+// send the result on the command's done channel.
+func (fc *FleetClient) Commands() <-chan FleetCommand {
+	return fc.commands
+}
+
+// Run registers, heartbeats and polls for commands until the process
+// exits, polling early when the listener wakes it.
+func (fc *FleetClient) Run() {
+	if fc.listenDSN != "" {
+		go fc.listen()
+	}
+	ticker := time.NewTicker(fc.interval)
+	defer ticker.Stop()
+	for {
+		fc.tick()
+		select {
+		case <-ticker.C:
+		case <-fc.wake:
+		}
+	}
+}
+
+func (fc *FleetClient) tick() {
+	db := fc.cloud.DB()
+	if db == nil {
+		return // offline; try again next tick
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fleetTimeout)
+	defer cancel()
+
+	fc.mu.Lock()
+	registered := fc.status.Registered
+	fc.mu.Unlock()
+	if !registered {
+		if err := fc.register(ctx, db); err != nil {
+			fc.fail("Device registration failed", err)
+			return
+		}
+	}
+	if err := fc.heartbeat(ctx, db); err != nil {
+		fc.fail("Heartbeat failed", err)
+		return
+	}
+	if err := fc.flushResults(ctx, db); err != nil {
+		fc.fail("Failed to record command results", err)
+		return
+	}
+	if err := fc.pollCommands(ctx, db); err != nil {
+		fc.fail("Command poll failed", err)
+		return
+	}
+
+	fc.mu.Lock()
+	fc.status.LastError = ""
+	fc.mu.Unlock()
+}
+
+func (fc *FleetClient) fail(msg string, err error) {
+	fc.logger.Warn(msg, "error", err)
+	fc.mu.Lock()
+	fc.status.LastError = err.Error()
+	fc.mu.Unlock()
+}
+
+// register upserts the device row, merging our registration block into
+// any config the control plane keeps there (e.g. signed_edge_config).
+func (fc *FleetClient) register(ctx context.Context, db *sql.DB) error {
+	hw, _ := hardwareID()
+	registration, err := json.Marshal(map[string]interface{}{
+		"hardware_id":    hw,
+		"hardware_model": fc.model,
+		"app_version":    appVersion,
+		"go_version":     runtime.Version(),
+		"os":             runtime.GOOS,
+		"arch":           runtime.GOARCH,
+		"fields":         fc.fieldIDs,
+		"booted_at":      fc.startedAt.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO devices (id, external_id, field_id, device_type, vendor, model, status,
+		                     last_communication, config, created_at)
+		VALUES (gen_random_uuid(), $1, $2, 'DHU', 'FarmSense', $3, 'active',
+		        NOW(), jsonb_build_object('registration', $4::jsonb)::json, NOW())
+		ON CONFLICT (external_id) DO UPDATE SET
+			field_id           = EXCLUDED.field_id,
+			model              = EXCLUDED.model,
+			status             = 'active',
+			last_communication = NOW(),
+			config             = (COALESCE(devices.config::jsonb, '{}'::jsonb)
+			                      || jsonb_build_object('registration', $4::jsonb))::json
+	`, fc.deviceID, fc.fieldID, fc.model, string(registration))
+	if err != nil {
+		return fmt.Errorf("failed to upsert device: %v", err)
+	}
+
+	if !fc.recovered {
+		// Whatever was running when this process started was interrupted
+		if _, err := db.ExecContext(ctx, `
+			UPDATE device_commands
+			SET status       = CASE WHEN command = 'reboot' THEN 'done' ELSE 'failed' END,
+			    result       = CASE WHEN command = 'reboot' THEN 'rebooted' ELSE 'interrupted by restart' END,
+			    completed_at = NOW()
+			WHERE device_external_id = $1 AND status = 'running'
+		`, fc.deviceID); err != nil {
+			return fmt.Errorf("failed to settle interrupted commands: %v", err)
+		}
+		fc.recovered = true
+	}
+
+	fc.mu.Lock()
+	fc.status.Registered = true
+	fc.status.RegisteredAt = time.Now()
+	fc.mu.Unlock()
+	fc.logger.Info("Device registered", "model", fc.model, "version", appVersion, "fields", fc.fieldIDs)
+	return nil
+}
+
+// heartbeat refreshes last_communication and latest_telemetry. A device
+// row deleted from the registry is re-created on the next tick.
+func (fc *FleetClient) heartbeat(ctx context.Context, db *sql.DB) error {
+	stats := collectDeviceStats(fc.diskPath, &fc.cpu)
+	telemetry := map[string]interface{}{
+		"stats":              stats,
+		"app_version":        appVersion,
+		"process_uptime_sec": time.Since(fc.startedAt).Seconds(),
+		"reported_at":        time.Now().UTC(),
+	}
+	if last := fc.health.LastCycle(); !last.IsZero() {
+		telemetry["last_cycle_at"] = last.UTC()
+	}
+	body, err := json.Marshal(telemetry)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE devices
+		SET last_communication = NOW(), status = 'active', latest_telemetry = $2::jsonb::json
+		WHERE external_id = $1
+	`, fc.deviceID, string(body))
+	if err != nil {
+		return fmt.Errorf("failed to update device: %v", err)
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		fc.status.Registered = false
+		return fmt.Errorf("device %s missing from registry", fc.deviceID)
+	}
+	fc.status.LastHeartbeatAt = time.Now()
+	fc.status.Stats = stats
+	return nil
+}
+
+// pollCommands claims this device's pending commands and hands them to
+// the main loop in queue order.
+func (fc *FleetClient) pollCommands(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE device_commands
+		SET status = 'running', started_at = NOW()
+		WHERE id IN (
+			SELECT id FROM device_commands
+			WHERE device_external_id = $1 AND status = 'pending'
+			ORDER BY created_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, command, COALESCE(params::text, ''), created_at, COALESCE(created_by, '')
+	`, fc.deviceID, fleetCommandBatch)
+	if err != nil {
+		return fmt.Errorf("failed to claim commands: %v", err)
+	}
+	defer rows.Close()
+
+	claimed := make([]FleetCommand, 0)
+	for rows.Next() {
+		var cmd FleetCommand
+		var params string
+		if err := rows.Scan(&cmd.ID, &cmd.Command, &params, &cmd.CreatedAt, &cmd.CreatedBy); err != nil {
+			return fmt.Errorf("failed to read command: %v", err)
+		}
+		if params != "" {
+			cmd.Params = json.RawMessage(params)
+		}
+		cmd.done = make(chan error, 1)
+		claimed = append(claimed, cmd)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(claimed) == 0 {
+		return nil
+	}
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].CreatedAt.Before(claimed[j].CreatedAt) })
+
+	// The main loop may be mid-cycle; don't hold up the next heartbeat
+	go fc.execute(claimed)
+	return nil
+}
+
+// execute runs claimed commands one at a time through the main loop.
+func (fc *FleetClient) execute(claimed []FleetCommand) {
+	for _, cmd := range claimed {
+		fc.logger.Info("Running fleet command", "command", cmd.Command, "command_id", cmd.ID)
+		fc.commands <- cmd
+		err := <-cmd.done
+		if err == nil && cmd.Command == FleetCommandReboot {
+			// Success is never reported from here: the next boot marks it done
+			err = reboot()
+		}
+
+		rec := FleetCommandRecord{ID: cmd.ID, Command: cmd.Command, Status: "done", CreatedAt: cmd.CreatedAt, CompletedAt: time.Now()}
+		if err != nil {
+			rec.Status = "failed"
+			rec.Result = err.Error()
+			fc.logger.Error("Fleet command failed", "command", cmd.Command, "command_id", cmd.ID, "error", err)
+		}
+		fc.mu.Lock()
+		fc.pending = append(fc.pending, rec)
+		fc.status.Commands = append([]FleetCommandRecord{rec}, fc.status.Commands...)
+		if len(fc.status.Commands) > fleetCommandHistory {
+			fc.status.Commands = fc.status.Commands[:fleetCommandHistory]
+		}
+		fc.mu.Unlock()
+	}
+}
+
+func reboot() error {
+	out, err := exec.Command(rebootCommand[0], rebootCommand[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(rebootCommand, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// flushResults writes finished commands' outcomes to the queue. Outcomes
+// that can't be written stay pending for the next tick.
+func (fc *FleetClient) flushResults(ctx context.Context, db *sql.DB) error {
+	fc.mu.Lock()
+	pending := append([]FleetCommandRecord(nil), fc.pending...)
+	fc.mu.Unlock()
+
+	written := 0
+	var err error
+	for _, rec := range pending {
+		if _, err = db.ExecContext(ctx, `
+			UPDATE device_commands SET status = $2, result = $3, completed_at = $4 WHERE id = $1
+		`, rec.ID, rec.Status, rec.Result, rec.CompletedAt.UTC()); err != nil {
+			err = fmt.Errorf("failed to record command %d: %v", rec.ID, err)
+			break
+		}
+		written++
+	}
+
+	fc.mu.Lock()
+	fc.pending = fc.pending[written:]
+	fc.mu.Unlock()
+	return err
+}
+
+// Status returns the client's registration, heartbeat and command state.
+func (fc *FleetClient) Status() FleetStatus {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	st := fc.status
+	st.Commands = append([]FleetCommandRecord(nil), fc.status.Commands...)
+	return st
+}
+
+// ManageFleet subscribes the main loop to fleet commands.
+func (ep *EdgeProcessor) ManageFleet(fc *FleetClient) {
+	ep.fleetCommands = fc.Commands()
+	go fc.Run()
+}
+
+// RunLocalCommand runs a command on the main loop for a local operator
+// and waits for its result.
+func (ep *EdgeProcessor) RunLocalCommand(ctx context.Context, command, actor string) error {
+	cmd := FleetCommand{Command: command, CreatedAt: time.Now(), CreatedBy: actor, done: make(chan error, 1)}
+	select {
+	case ep.localCommands <- cmd:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runFleetCommand executes a command on the main loop and audits it.
+func (ep *EdgeProcessor) runFleetCommand(cmd FleetCommand) error {
+	err := ep.dispatchFleetCommand(cmd)
+	ep.auditCommand(cmd, err)
+	return err
+}
+
+func (ep *EdgeProcessor) dispatchFleetCommand(cmd FleetCommand) error {
+	switch cmd.Command {
+	case FleetCommandRecompute:
+		ep.computeVirtualGrid()
+		return nil
+	case FleetCommandResync:
+		// Forget what the cloud acknowledged so the next upload is a full
+		// snapshot, and replay cached readings; the cloud drops duplicates.
+		ep.differ = NewGridDiffer()
+		if _, err := ep.localDB.Exec(`DELETE FROM sync_state WHERE name = ?`, ep.readingWatermarkKey()); err != nil {
+			return fmt.Errorf("failed to reset raw reading watermark: %v", err)
+		}
+		ep.syncToCloud()
+		return nil
+	case FleetCommandSync:
+		ep.syncToCloud()
+		return nil
+	case FleetCommandReboot:
+		ep.syncToCloud() // don't lose the offline queue
+		return nil
+	case FleetCommandBackfill:
+		return ep.remoteBackfill(cmd)
+	case FleetCommandDiagnose:
+		return ep.uploadDiagnostics(cmd)
+	case FleetCommandLogLevel:
+		return ep.remoteLogLevel(cmd)
+	case FleetCommandProfile:
+		return ep.captureProfile(cmd)
+	}
+	return fmt.Errorf("unknown command %q", cmd.Command)
+}
@@ -0,0 +1,120 @@
+// GeoJSON Export - grid cells as a FeatureCollection
+// Each cell becomes a Polygon feature covering its full grid square (the
+// same square the VRI prescription uses), with every computed field of
+// the cell as properties under its JSON name, so Leaflet or Mapbox can
+// style the field map straight from the file. Served at
+// /grid/latest.geojson and, with geojson_export_path set, rewritten after
+// every cycle (written beside the target and renamed into place, so a web
+// server never hands out half a file). Properties are converted for
+// imperial units like the API's (units.go); the file follows the field's
+// units setting. quality lists the names of the cell's quality_flags
+// (quality_flags.go), for styles that can't test bits.
+//
+// Logical (greenhouse) grids have no coordinates and aren't exported.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// GeoJSONFeatureCollection is an RFC 7946 feature collection.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// GeoJSONFeature is one grid cell.
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   GeoJSONPolygon         `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONPolygon is a polygon geometry, exterior ring only.
+type GeoJSONPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+var errNoGeographicGrid = errors.New("GeoJSON needs a geographic grid")
+
+// cellSquare is the grid square centered on p.
+func (ep *EdgeProcessor) cellSquare(p VirtualGridPoint) cellBounds {
+	res := ep.config.GridResolution
+	if res <= 0 {
+		res = 20.0
+	}
+	halfLat := res / 2 / metersPerDegreeLat
+	halfLon := res / 2 / (metersPerDegreeLat * math.Cos(p.Latitude*math.Pi/180))
+	return cellBounds{
+		p.Longitude - halfLon, p.Latitude - halfLat,
+		p.Longitude + halfLon, p.Latitude + halfLat,
+	}
+}
+
+// BuildGeoJSON converts grid points into a feature collection in the given
+// unit system.
+func (ep *EdgeProcessor) BuildGeoJSON(points []VirtualGridPoint, units string) (*GeoJSONFeatureCollection, error) {
+	if ep.config.LogicalGrid != nil {
+		return nil, errNoGeographicGrid
+	}
+	fc := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]GeoJSONFeature, 0, len(points))}
+	for _, p := range points {
+		// Round-trip through JSON so properties always match the grid API
+		raw, err := json.Marshal(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode cell %s: %v", p.GridID, err)
+		}
+		var props map[string]interface{}
+		if err := json.Unmarshal(raw, &props); err != nil {
+			return nil, fmt.Errorf("failed to encode cell %s: %v", p.GridID, err)
+		}
+		if units == UnitsImperial {
+			props = imperialValue(props).(map[string]interface{})
+		}
+		props["quality"] = p.QualityFlags.Names()
+
+		b := ep.cellSquare(p)
+		ring := [][2]float64{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}
+		fc.Features = append(fc.Features, GeoJSONFeature{
+			Type:       "Feature",
+			ID:         p.GridID,
+			Geometry:   GeoJSONPolygon{Type: "Polygon", Coordinates: [][][2]float64{ring}},
+			Properties: props,
+		})
+	}
+	return fc, nil
+}
+
+// exportGeoJSON rewrites geojson_export_path with the cycle's grid.
+func (ep *EdgeProcessor) exportGeoJSON(points []VirtualGridPoint) {
+	path := ep.config.GeoJSONExportPath
+	if path == "" || ep.config.LogicalGrid != nil || ep.exportsPaused() || ep.throttled() {
+		return
+	}
+	if err := ep.writeGeoJSONFile(path, points); err != nil {
+		ep.cycleLog.Warn("GeoJSON export failed", "component", "geojson", "path", path, "error", err)
+	}
+}
+
+func (ep *EdgeProcessor) writeGeoJSONFile(path string, points []VirtualGridPoint) error {
+	fc, err := ep.BuildGeoJSON(points, ep.config.Units)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return fmt.Errorf("failed to encode GeoJSON: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write GeoJSON: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
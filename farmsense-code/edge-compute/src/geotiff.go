@@ -0,0 +1,140 @@
+// GeoTIFF - minimal single-band GeoTIFF writer for grid rasters
+// Writes an uncompressed little-endian TIFF with one float32 sample per
+// pixel in a single strip, georeferenced in WGS84 (EPSG:4326) by a tie
+// point on the top-left pixel's outer corner and a pixel scale. Pixels
+// without data hold geoTIFFNoData, declared in the GDAL_NODATA tag so QGIS
+// and GDAL leave them transparent.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	tiffASCII  = 2
+	tiffShort  = 3
+	tiffLong   = 4
+	tiffDouble = 12
+
+	geoTIFFNoData = -9999
+)
+
+// geoRaster is a north-up grid of cell values in WGS84 degrees.
+type geoRaster struct {
+	cols, rows       int
+	west, north      float64 // outer corner of the top-left pixel
+	lonStep, latStep float64
+	values           []float64 // row-major from the north edge; NaN = no data
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte // inline when 4 bytes or less
+}
+
+func writeGeoTIFF(w io.Writer, r geoRaster) error {
+	if r.cols <= 0 || r.rows <= 0 || len(r.values) != r.cols*r.rows {
+		return fmt.Errorf("raster is %dx%d with %d values", r.cols, r.rows, len(r.values))
+	}
+	le := binary.LittleEndian
+	shorts := func(vs ...uint16) []byte {
+		b := make([]byte, 2*len(vs))
+		for i, v := range vs {
+			le.PutUint16(b[2*i:], v)
+		}
+		return b
+	}
+	longs := func(vs ...uint32) []byte {
+		b := make([]byte, 4*len(vs))
+		for i, v := range vs {
+			le.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	doubles := func(vs ...float64) []byte {
+		b := make([]byte, 8*len(vs))
+		for i, v := range vs {
+			le.PutUint64(b[8*i:], math.Float64bits(v))
+		}
+		return b
+	}
+	nodata := []byte(fmt.Sprintf("%d\x00", geoTIFFNoData))
+	geoKeys := shorts(
+		1, 1, 0, 3, // directory version, revision, key count
+		1024, 0, 1, 2, // GTModelType: geographic
+		1025, 0, 1, 1, // GTRasterType: pixel is area
+		2048, 0, 1, 4326, // GeographicType: WGS84
+	)
+
+	const stripOffsets = 5 // index of the entry filled in once the layout is known
+	entries := []tiffEntry{
+		{256, tiffLong, 1, longs(uint32(r.cols))},                    // ImageWidth
+		{257, tiffLong, 1, longs(uint32(r.rows))},                    // ImageLength
+		{258, tiffShort, 1, shorts(32)},                              // BitsPerSample
+		{259, tiffShort, 1, shorts(1)},                               // Compression: none
+		{262, tiffShort, 1, shorts(1)},                               // PhotometricInterpretation: BlackIsZero
+		{273, tiffLong, 1, nil},                                      // StripOffsets
+		{277, tiffShort, 1, shorts(1)},                               // SamplesPerPixel
+		{278, tiffLong, 1, longs(uint32(r.rows))},                    // RowsPerStrip
+		{279, tiffLong, 1, longs(uint32(4 * len(r.values)))},         // StripByteCounts
+		{284, tiffShort, 1, shorts(1)},                               // PlanarConfiguration: chunky
+		{339, tiffShort, 1, shorts(3)},                               // SampleFormat: IEEE float
+		{33550, tiffDouble, 3, doubles(r.lonStep, r.latStep, 0)},     // ModelPixelScale
+		{33922, tiffDouble, 6, doubles(0, 0, 0, r.west, r.north, 0)}, // ModelTiepoint
+		{34735, tiffShort, 16, geoKeys},                              // GeoKeyDirectory
+		{42113, tiffASCII, uint32(len(nodata)), nodata},              // GDAL_NODATA
+	}
+
+	// Header, IFD, out-of-line values (word aligned), then the pixels
+	offset := 8 + 2 + 12*len(entries) + 4
+	valueOffsets := make([]int, len(entries))
+	for i, e := range entries {
+		if len(e.data) > 4 {
+			valueOffsets[i] = offset
+			offset += len(e.data) + len(e.data)%2
+		}
+	}
+	entries[stripOffsets].data = longs(uint32(offset))
+
+	var buf bytes.Buffer
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8))
+	binary.Write(&buf, le, uint16(len(entries)))
+	for i, e := range entries {
+		binary.Write(&buf, le, e.tag)
+		binary.Write(&buf, le, e.typ)
+		binary.Write(&buf, le, e.count)
+		if len(e.data) > 4 {
+			binary.Write(&buf, le, uint32(valueOffsets[i]))
+			continue
+		}
+		var inline [4]byte
+		copy(inline[:], e.data)
+		buf.Write(inline[:])
+	}
+	binary.Write(&buf, le, uint32(0)) // no further IFDs
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			buf.Write(e.data)
+			if len(e.data)%2 == 1 {
+				buf.WriteByte(0)
+			}
+		}
+	}
+	for _, v := range r.values {
+		if math.IsNaN(v) {
+			v = geoTIFFNoData
+		}
+		binary.Write(&buf, le, math.Float32bits(float32(v)))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,218 @@
+// GPU Interpolation - Jetson sidecar for large-field neighbor search
+// Finding each cell's probes within search radius is cells × probes
+// distance evaluations, and on fields past ~20k cells it is what pushes a
+// cycle beyond compute_interval_sec on the CPU. On a Jetson that search is
+// handed to the farmsense-gpu-interp sidecar (edge-compute/gpu-sidecar),
+// which evaluates the whole distance matrix with CUDA and answers over a
+// unix socket:
+//
+//	POST /neighbors  {cells, sensors ([lon, lat]), search_radius_m, anisotropy}
+//	              →  {offsets, sensors, distances}   cell i's neighbors are
+//	                                                 [offsets[i], offsets[i+1])
+//
+// The sidecar applies the same distance as neighborsWithin (orb's
+// equirectangular geo.Distance, under 1 m is on the cell, anisotropy
+// rescaling), so every interpolator, attribution and the depth-layer fill
+// run unchanged on its neighbor lists.
+//
+// interpolation_backend picks the path: cpu never uses the sidecar, gpu
+// always tries it, and auto (the default) uses it on a Jetson once the
+// grid reaches gpu_min_cells. A sidecar that fails or is missing costs one
+// cycle's attempt; the cycle is computed on the CPU and the sidecar is not
+// tried again for gpuRetryInterval.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interpolation backends
+const (
+	InterpBackendAuto = "auto"
+	InterpBackendCPU  = "cpu"
+	InterpBackendGPU  = "gpu"
+)
+
+const (
+	defaultGPUSidecarSocket = "/run/farmsense/gpu-interp.sock"
+	defaultGPUMinCells      = 20000
+	gpuSidecarTimeout       = 30 * time.Second
+	gpuRetryInterval        = 5 * time.Minute
+	jetsonModelPath         = "/proc/device-tree/model"
+	tegraReleasePath        = "/etc/nv_tegra_release"
+)
+
+var (
+	jetsonOnce sync.Once
+	jetson     bool
+)
+
+// onJetson reports whether this is an NVIDIA Jetson (L4T).
+func onJetson() bool {
+	jetsonOnce.Do(func() {
+		if _, err := os.Stat(tegraReleasePath); err == nil {
+			jetson = true
+			return
+		}
+		model, err := os.ReadFile(jetsonModelPath)
+		jetson = err == nil && strings.Contains(string(model), "Jetson")
+	})
+	return jetson
+}
+
+type gpuNeighborRequest struct {
+	Cells         [][2]float64 `json:"cells"`
+	Sensors       [][2]float64 `json:"sensors"`
+	SearchRadiusM float64      `json:"search_radius_m"`
+	Anisotropy    *Anisotropy  `json:"anisotropy,omitempty"`
+}
+
+type gpuNeighborResponse struct {
+	Offsets   []int     `json:"offsets"`
+	Sensors   []int     `json:"sensors"`
+	Distances []float64 `json:"distances"`
+}
+
+// gpuSidecar is the client for one sidecar socket. Run goroutine only.
+type gpuSidecar struct {
+	socket    string
+	client    *http.Client
+	downUntil time.Time // don't retry before this after a failure
+	active    bool      // last cycle used it (for logging transitions)
+}
+
+func newGPUSidecar(socket string) *gpuSidecar {
+	return &gpuSidecar{
+		socket: socket,
+		client: &http.Client{
+			Timeout: gpuSidecarTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// neighbors asks the sidecar for every cell's neighbor list.
+func (g *gpuSidecar) neighbors(req gpuNeighborRequest) (*gpuNeighborResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode neighbor request: %v", err)
+	}
+	resp, err := g.client.Post("http://gpu-interp/neighbors", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach GPU sidecar at %s: %v", g.socket, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GPU sidecar returned %s", resp.Status)
+	}
+	var out gpuNeighborResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode GPU sidecar response: %v", err)
+	}
+	if len(out.Offsets) != len(req.Cells)+1 || len(out.Sensors) != len(out.Distances) ||
+		out.Offsets[0] != 0 || out.Offsets[len(req.Cells)] != len(out.Sensors) {
+		return nil, fmt.Errorf("GPU sidecar returned %d offsets and %d neighbors for %d cells",
+			len(out.Offsets), len(out.Sensors), len(req.Cells))
+	}
+	for i := 1; i < len(out.Offsets); i++ {
+		if out.Offsets[i] < out.Offsets[i-1] {
+			return nil, fmt.Errorf("GPU sidecar returned decreasing offsets at cell %d", i-1)
+		}
+	}
+	for _, idx := range out.Sensors {
+		if idx < 0 || idx >= len(req.Sensors) {
+			return nil, fmt.Errorf("GPU sidecar returned sensor index %d of %d", idx, len(req.Sensors))
+		}
+	}
+	return &out, nil
+}
+
+// gpuBackend returns the sidecar to use for a grid of cells, or nil for
+// the CPU.
+func (ep *EdgeProcessor) gpuBackend(cells int) *gpuSidecar {
+	switch ep.config.InterpolationBackend {
+	case InterpBackendCPU:
+		return nil
+	case InterpBackendGPU:
+	default:
+		minCells := ep.config.GPUMinCells
+		if minCells <= 0 {
+			minCells = defaultGPUMinCells
+		}
+		if !onJetson() || cells < minCells {
+			return nil
+		}
+	}
+	socket := ep.config.GPUSidecarSocket
+	if socket == "" {
+		socket = defaultGPUSidecarSocket
+	}
+	if ep.gpu == nil || ep.gpu.socket != socket {
+		ep.gpu = newGPUSidecar(socket)
+	}
+	if time.Now().Before(ep.gpu.downUntil) {
+		return nil
+	}
+	return ep.gpu
+}
+
+// gpuNeighborsWithin is neighborsWithin for every grid point at once, on
+// the sidecar. nil means use the CPU this cycle.
+func (ep *EdgeProcessor) gpuNeighborsWithin(g *gpuSidecar, gridPoints []gridPoint, sensors []SensorReading) [][]sensorNeighbor {
+	req := gpuNeighborRequest{
+		Cells:         make([][2]float64, len(gridPoints)),
+		Sensors:       make([][2]float64, len(sensors)),
+		SearchRadiusM: ep.config.SearchRadius,
+	}
+	if an := ep.config.Anisotropy; an != nil && an.Ratio > 1 {
+		req.Anisotropy = an
+	}
+	for i, gp := range gridPoints {
+		req.Cells[i] = [2]float64{gp.Point.Lon(), gp.Point.Lat()}
+	}
+	for i, s := range sensors {
+		req.Sensors[i] = [2]float64{s.Longitude, s.Latitude}
+	}
+
+	start := time.Now()
+	resp, err := g.neighbors(req)
+	if err != nil {
+		g.downUntil = time.Now().Add(gpuRetryInterval)
+		g.active = false
+		ep.cycleLog.Warn("GPU interpolation unavailable, using the CPU", "component", "gpu_interp",
+			"error", err, "retry_in", gpuRetryInterval.String())
+		return nil
+	}
+	if !g.active {
+		ep.cycleLog.Info("Using GPU sidecar for neighbor search", "component", "gpu_interp",
+			"socket", g.socket, "cells", len(gridPoints))
+		g.active = true
+	}
+
+	neighbors := make([][]sensorNeighbor, len(gridPoints))
+	for i := range gridPoints {
+		from, to := resp.Offsets[i], resp.Offsets[i+1]
+		neighbors[i] = make([]sensorNeighbor, 0, to-from)
+		for j := from; j < to; j++ {
+			neighbors[i] = append(neighbors[i], sensorNeighbor{sensor: sensors[resp.Sensors[j]], distance: resp.Distances[j]})
+		}
+	}
+	ep.cycleLog.Debug("GPU neighbor search", "component", "gpu_interp", "cells", len(gridPoints),
+		"neighbors", len(resp.Sensors), "duration_s", time.Since(start).Seconds())
+	return neighbors
+}
@@ -0,0 +1,285 @@
+// Grid Batches - immutable batch IDs and algorithm versions for cycles
+// Every compute cycle (and every backfill recompute) is a batch: a random
+// UUID and the gridAlgorithmVersion of the code that produced it are
+// stamped on each cell, and the batch is recorded in grid_batches locally
+// and in the cloud. A cell row is then traceable to exactly one run, and a
+// recompute of the same timestamp is a second batch beside the first
+// rather than rows mixed into it.
+//
+// Uploads are idempotent per cell. The Postgres/TimescaleDB store
+// registers each batch in the upload transaction and upserts its cells on
+// (grid_id, timestamp, batch_id), so a retry after a lost acknowledgement
+// (or a queued batch sent twice) adds nothing, and a batch that only
+// partly reached the cloud gets its missing cells (see sync_reconcile.go
+// for the checks around it). The HTTP ingest carries batch_id per point and X-Batch-IDs for the same
+// purpose; InfluxDB overwrites identical points on its own. The local row
+// is marked synced once the cloud acknowledges the batch.
+//
+// Bump gridAlgorithmVersion whenever the algorithm changes what a cycle
+// produces from the same readings and config.
+
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	gridAlgorithmVersion  = "edge-grid-1"
+	defaultBatchListLimit = 50
+)
+
+// Batch kinds
+const (
+	BatchKindCompute  = "compute"
+	BatchKindBackfill = "backfill"
+)
+
+// GridBatch is one cycle's output as a unit.
+type GridBatch struct {
+	BatchID          string     `json:"batch_id"`
+	CycleAt          time.Time  `json:"cycle_at"`
+	ComputedAt       time.Time  `json:"computed_at"`
+	AlgorithmVersion string     `json:"algorithm_version"`
+	ConfigVersion    string     `json:"config_version,omitempty"`
+	Kind             string     `json:"kind"`
+	Cells            int        `json:"cells"`
+	SyncedAt         *time.Time `json:"synced_at,omitempty"`
+	SupersededAt     *time.Time `json:"superseded_at,omitempty"` // late readings arrived for its window (late_readings.go)
+}
+
+// newBatchID returns a random (version 4) UUID.
+func newBatchID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Never expected; a time-derived ID is still unique per device
+		return fmt.Sprintf("00000000-0000-4000-8000-%012x", time.Now().UnixNano()&0xffffffffffff)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// initBatchSchema creates the batch table and the history batch column.
+func initBatchSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS grid_batches (
+			batch_id          TEXT    PRIMARY KEY,
+			field_id          TEXT    NOT NULL,
+			cycle_at          INTEGER NOT NULL,
+			computed_at       INTEGER NOT NULL,
+			algorithm_version TEXT    NOT NULL,
+			config_version    TEXT,
+			kind              TEXT    NOT NULL,
+			cells             INTEGER NOT NULL,
+			synced_at         INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS grid_batches_field_time ON grid_batches (field_id, cycle_at);
+	`)
+	if err != nil {
+		return err
+	}
+	for _, col := range []struct{ name, decl string }{
+		{"reading_mark", "INTEGER"},
+		{"superseded_at", "INTEGER"},
+		{"superseded_synced", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := ensureLocalColumn(db, "grid_batches", col.name, col.decl); err != nil {
+			return err
+		}
+	}
+	return ensureLocalColumn(db, "grid_history", "batch_id", "TEXT")
+}
+
+// stampBatch opens a batch for one cycle's cells and stamps them with it.
+func (ep *EdgeProcessor) stampBatch(points []VirtualGridPoint, kind string, cycleAt time.Time) {
+	batchID := newBatchID()
+	configVersion := ""
+	for i := range points {
+		points[i].BatchID = batchID
+		points[i].AlgorithmVersion = gridAlgorithmVersion
+		configVersion = points[i].ConfigVersion
+	}
+	if _, err := ep.localDB.Exec(`
+		INSERT INTO grid_batches (batch_id, field_id, cycle_at, computed_at, algorithm_version, config_version, kind, cells,
+			reading_mark)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, batchID, ep.config.FieldID, cycleAt.Unix(), time.Now().Unix(), gridAlgorithmVersion,
+		configVersion, kind, len(points), ep.readingMark); err != nil {
+		ep.cycleLog.Warn("Failed to record grid batch", "component", "batches", "batch_id", batchID, "error", err)
+	}
+}
+
+// batchIDs returns the distinct batches among points, in order.
+func batchIDs(points []VirtualGridPoint) []string {
+	seen := make(map[string]bool)
+	ids := make([]string, 0, 1)
+	for _, p := range points {
+		if p.BatchID != "" && !seen[p.BatchID] {
+			seen[p.BatchID] = true
+			ids = append(ids, p.BatchID)
+		}
+	}
+	return ids
+}
+
+// markBatchesSynced records the cloud's acknowledgement of batches.
+func (ep *EdgeProcessor) markBatchesSynced(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	args := []interface{}{time.Now().Unix()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	if _, err := ep.localDB.Exec(`UPDATE grid_batches SET synced_at = ? WHERE synced_at IS NULL AND batch_id IN (`+
+		placeholders+`)`, args...); err != nil {
+		ep.cycleLog.Warn("Failed to mark grid batches synced", "component", "batches", "error", err)
+	}
+}
+
+// GridBatches returns the field's most recent batches, newest first.
+func (ep *EdgeProcessor) GridBatches(limit int) ([]GridBatch, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT batch_id, cycle_at, computed_at, algorithm_version, COALESCE(config_version, ''), kind, cells, synced_at,
+		       superseded_at
+		FROM grid_batches
+		WHERE field_id = ?
+		ORDER BY computed_at DESC, cycle_at DESC
+		LIMIT ?
+	`, ep.config.FieldID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grid batches: %v", err)
+	}
+	defer rows.Close()
+
+	batches := make([]GridBatch, 0)
+	for rows.Next() {
+		var b GridBatch
+		var cycleAt, computedAt int64
+		var syncedAt, supersededAt sql.NullInt64
+		if err := rows.Scan(&b.BatchID, &cycleAt, &computedAt, &b.AlgorithmVersion, &b.ConfigVersion,
+			&b.Kind, &b.Cells, &syncedAt, &supersededAt); err != nil {
+			return nil, fmt.Errorf("failed to read grid batch: %v", err)
+		}
+		b.CycleAt = time.Unix(cycleAt, 0).UTC()
+		b.ComputedAt = time.Unix(computedAt, 0).UTC()
+		if syncedAt.Valid {
+			t := time.Unix(syncedAt.Int64, 0).UTC()
+			b.SyncedAt = &t
+		}
+		if supersededAt.Valid {
+			t := time.Unix(supersededAt.Int64, 0).UTC()
+			b.SupersededAt = &t
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// pruneGridBatches drops batch records older than the history cutoff.
+func (ep *EdgeProcessor) pruneGridBatches(cutoff int64) {
+	if _, err := ep.localDB.Exec(`DELETE FROM grid_batches WHERE field_id = ? AND cycle_at < ?`,
+		ep.config.FieldID, cutoff); err != nil {
+		ep.logger.Error("Failed to prune grid batches", "component", "batches", "error", err)
+	}
+}
+
+// registerCloudBatches inserts the upload's batches into the cloud
+// grid_batches table inside tx. A batch already registered keeps its row,
+// with cells raised if this upload carries more of them.
+func registerCloudBatches(tx *sql.Tx, points []VirtualGridPoint) error {
+	type batchRow struct {
+		first VirtualGridPoint
+		cells int
+	}
+	batches := make(map[string]*batchRow)
+	for _, p := range points {
+		if p.BatchID == "" {
+			continue
+		}
+		if b := batches[p.BatchID]; b != nil {
+			b.cells++
+		} else {
+			batches[p.BatchID] = &batchRow{first: p, cells: 1}
+		}
+	}
+
+	for id, b := range batches {
+		_, err := tx.Exec(`
+			INSERT INTO grid_batches (batch_id, field_id, edge_device_id, cycle_at, algorithm_version,
+				config_version, computation_mode, cells, tenant_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (batch_id) DO UPDATE SET cells = GREATEST(grid_batches.cells, EXCLUDED.cells)
+		`, id, b.first.FieldID, b.first.EdgeDeviceID, b.first.Timestamp, b.first.AlgorithmVersion,
+			nullString(b.first.ConfigVersion), b.first.ComputationMode, b.cells, nullString(b.first.TenantID))
+		if err != nil {
+			return fmt.Errorf("failed to register grid batch %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// SyncStatus is the device's upload backlog, for the local UI.
+type SyncStatus struct {
+	Online          bool       `json:"online"`
+	CloudStore      string     `json:"cloud_store"`
+	LastCycle       *time.Time `json:"last_cycle,omitempty"`
+	UnsyncedBatches int        `json:"unsynced_batches"`
+	UnsyncedCells   int        `json:"unsynced_cells"`
+	LastSyncedAt    *time.Time `json:"last_synced_at,omitempty"`
+	CloudHighWater  *time.Time `json:"cloud_high_water,omitempty"` // latest cycle the cloud acknowledged
+	QueuedReadings  int        `json:"queued_readings"`            // local readings not yet forwarded
+	LocalEpoch      *GridEpoch `json:"local_epoch,omitempty"`      // latest batch committed locally (grid_epochs.go)
+}
+
+// SyncStatus reports what is still waiting for the cloud.
+func (ep *EdgeProcessor) SyncStatus() (SyncStatus, error) {
+	ep.stateMu.RLock()
+	s := SyncStatus{Online: ep.isOnline.Load(), CloudStore: cloudStoreKind(ep.config)}
+	ep.stateMu.RUnlock()
+	if last := ep.health.LastCycle(); !last.IsZero() {
+		last = last.UTC()
+		s.LastCycle = &last
+	}
+
+	var syncedAt sql.NullInt64
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(CASE WHEN synced_at IS NULL THEN 1 END),
+		       COALESCE(SUM(CASE WHEN synced_at IS NULL THEN cells END), 0),
+		       MAX(synced_at)
+		FROM grid_batches
+		WHERE field_id = ?
+	`, ep.config.FieldID).Scan(&s.UnsyncedBatches, &s.UnsyncedCells, &syncedAt); err != nil {
+		return s, fmt.Errorf("failed to query grid batches: %v", err)
+	}
+	if syncedAt.Valid {
+		t := time.Unix(syncedAt.Int64, 0).UTC()
+		s.LastSyncedAt = &t
+	}
+
+	highWater, err := ep.cloudHighWater()
+	if err != nil {
+		return s, fmt.Errorf("failed to read sync high-water mark: %v", err)
+	}
+	s.CloudHighWater = highWater
+	if s.LocalEpoch, err = ep.LocalEpoch(); err != nil {
+		return s, err
+	}
+
+	mark, err := ep.readingWatermark()
+	if err != nil {
+		return s, fmt.Errorf("failed to read reading watermark: %v", err)
+	}
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(*) FROM soil_sensor_readings WHERE rowid > ? AND field_id = ? AND origin = ?
+	`, mark, ep.config.FieldID, ReadingOriginLocal).Scan(&s.QueuedReadings); err != nil {
+		return s, fmt.Errorf("failed to count queued readings: %v", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,134 @@
+// Grid Diff - change-only cloud upload
+// Most cells barely move between 15-minute cycles, so re-uploading the
+// whole grid wastes cellular data. The differ remembers what the cloud last
+// acknowledged for every cell and selects only cells that are new or whose
+// values moved past the configured thresholds. A full snapshot is sent
+// periodically (and after a restart) so cells that dropped out of coverage
+// or drifted below threshold never stay stale in the cloud for long. The
+// local cache always receives the complete grid.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultDiffMoistureDelta = 0.005 // m³/m³
+	defaultDiffTempDelta     = 0.5   // °C
+	defaultDiffDeficitDelta  = 2.0   // mm
+	defaultFullSnapshotEvery = 6 * time.Hour
+)
+
+type diffThresholds struct {
+	moisture float64
+	temp     float64
+	deficit  float64
+}
+
+// GridDiffer tracks the last cloud-acknowledged value of each cell. It is
+// used only from the processor's main loop.
+type GridDiffer struct {
+	uploaded map[string]VirtualGridPoint
+	lastFull time.Time
+}
+
+func NewGridDiffer() *GridDiffer {
+	return &GridDiffer{uploaded: make(map[string]VirtualGridPoint)}
+}
+
+// changed reports whether p differs meaningfully from what the cloud has.
+func (d *GridDiffer) changed(p VirtualGridPoint, t diffThresholds) bool {
+	prev, ok := d.uploaded[p.GridID]
+	if !ok {
+		return true
+	}
+	return math.Abs(p.MoistureSurface-prev.MoistureSurface) >= t.moisture ||
+		math.Abs(p.MoistureRoot-prev.MoistureRoot) >= t.moisture ||
+		math.Abs(p.Temperature-prev.Temperature) >= t.temp ||
+		math.Abs(p.WaterDeficit-prev.WaterDeficit) >= t.deficit ||
+		p.IrrigationNeed != prev.IrrigationNeed ||
+		p.RainState != prev.RainState ||
+		p.NeedFlag != prev.NeedFlag ||
+		p.Trafficable != prev.Trafficable
+}
+
+// Select returns the points to upload this cycle and whether they are a
+// full snapshot.
+func (d *GridDiffer) Select(points []VirtualGridPoint, t diffThresholds, fullEvery time.Duration, now time.Time) ([]VirtualGridPoint, bool) {
+	if len(d.uploaded) == 0 || now.Sub(d.lastFull) >= fullEvery {
+		d.lastFull = now
+		return points, true
+	}
+	out := make([]VirtualGridPoint, 0)
+	for _, p := range points {
+		if d.changed(p, t) {
+			out = append(out, p)
+		}
+	}
+	return out, false
+}
+
+// Commit records points as acknowledged by the cloud. A queued batch
+// flushed after a newer direct upload doesn't roll the baseline back.
+func (d *GridDiffer) Commit(points []VirtualGridPoint) {
+	for _, p := range points {
+		if prev, ok := d.uploaded[p.GridID]; ok && p.Timestamp.Before(prev.Timestamp) {
+			continue
+		}
+		d.uploaded[p.GridID] = p
+	}
+}
+
+// diffThresholds reads the change thresholds from config.
+func (ep *EdgeProcessor) diffThresholds() diffThresholds {
+	t := diffThresholds{
+		moisture: ep.config.DiffMoistureDelta,
+		temp:     ep.config.DiffTempDelta,
+		deficit:  ep.config.DiffDeficitDelta,
+	}
+	if t.moisture <= 0 {
+		t.moisture = defaultDiffMoistureDelta
+	}
+	if t.temp <= 0 {
+		t.temp = defaultDiffTempDelta
+	}
+	if t.deficit <= 0 {
+		t.deficit = defaultDiffDeficitDelta
+	}
+	return t
+}
+
+// selectForUpload narrows a cycle's grid to the cells the cloud needs.
+func (ep *EdgeProcessor) selectForUpload(points []VirtualGridPoint) []VirtualGridPoint {
+	if !ep.config.SyncChangesOnly {
+		return points
+	}
+	fullEvery := time.Duration(ep.config.FullSnapshotSec) * time.Second
+	if fullEvery <= 0 {
+		fullEvery = defaultFullSnapshotEvery
+	}
+
+	selected, full := ep.differ.Select(points, ep.diffThresholds(), fullEvery, time.Now())
+	if !full {
+		ep.tracer.RecordPoints(skippedPoints(points, selected), TraceSyncSkipped, "unchanged since last upload")
+	}
+	ep.cycleLog.Info("Grid diff", "changed", len(selected), "total", len(points), "full_snapshot", full)
+	return selected
+}
+
+// skippedPoints returns the points in all that aren't in selected.
+func skippedPoints(all, selected []VirtualGridPoint) []VirtualGridPoint {
+	keep := make(map[string]bool, len(selected))
+	for _, p := range selected {
+		keep[p.GridID] = true
+	}
+	out := make([]VirtualGridPoint, 0, len(all)-len(selected))
+	for _, p := range all {
+		if !keep[p.GridID] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
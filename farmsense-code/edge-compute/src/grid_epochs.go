@@ -0,0 +1,162 @@
+// Grid Epochs - all-or-nothing grid writes and a visible epoch marker
+// Dashboards must never show a grid that is half this cycle and half the
+// last one, so a cycle's batch lands everywhere whole or not at all.
+//
+// Locally its cells are written to grid_history in one transaction (one
+// row when grid_history_format is packed). When that fails the batch is
+// abandoned: its grid_batches record is dropped, nothing is uploaded, and
+// the previous grid stays the latest on the API, MQTT and the UI. Once it
+// has committed, the field's local epoch advances: grid_epochs holds a
+// counter, the batch and its cycle time, shown as local_epoch in
+// GET /sync/status.
+//
+// The Postgres/TimescaleDB store writes an upload's cells, its batches,
+// the high-water mark (sync_reconcile.go) and the field's epoch
+// (grid_epochs, migration 033) in one transaction. Dashboards read
+// virtual_sensor_grid_current, which takes each cell's latest row at or
+// before the epoch's cycle, so they show the last complete cycle; with
+// sync_changes_only an unchanged cell keeps its last uploaded row, as in
+// the grid itself. InfluxDB has no transactions: a grid_epoch point is
+// written once all of a write's cells are accepted, and queries should
+// stop at it. The HTTP ingest receives each upload as one request and is
+// expected to apply it whole.
+//
+// Epochs only move forward. A backfilled cycle replaces its history
+// without moving the local epoch; in the cloud it moves the epoch only if
+// it is newer than the epoch's cycle.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const influxEpochMeasure = "grid_epoch"
+
+// GridEpoch is the latest batch of a field committed in full.
+type GridEpoch struct {
+	Epoch       int64     `json:"epoch"`
+	BatchID     string    `json:"batch_id"`
+	CycleAt     time.Time `json:"cycle_at"`
+	Cells       int       `json:"cells"`
+	CommittedAt time.Time `json:"committed_at"`
+}
+
+func initEpochSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS grid_epochs (
+			field_id     TEXT    PRIMARY KEY,
+			epoch        INTEGER NOT NULL,
+			batch_id     TEXT    NOT NULL,
+			cycle_at     INTEGER NOT NULL,
+			cells        INTEGER NOT NULL,
+			committed_at INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// advanceLocalEpoch records points' batch as the field's local epoch.
+func (ep *EdgeProcessor) advanceLocalEpoch(points []VirtualGridPoint) error {
+	heads := epochHeads(points)
+	h, ok := heads[ep.config.FieldID]
+	if !ok {
+		return nil
+	}
+	_, err := ep.localDB.Exec(`
+		INSERT INTO grid_epochs (field_id, epoch, batch_id, cycle_at, cells, committed_at)
+		VALUES (?, 1, ?, ?, ?, ?)
+		ON CONFLICT (field_id) DO UPDATE SET
+			epoch = grid_epochs.epoch + 1, batch_id = excluded.batch_id, cycle_at = excluded.cycle_at,
+			cells = excluded.cells, committed_at = excluded.committed_at
+		WHERE excluded.cycle_at >= grid_epochs.cycle_at
+	`, ep.config.FieldID, h.first.BatchID, h.first.Timestamp.Unix(), h.cells, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to advance grid epoch: %v", err)
+	}
+	return nil
+}
+
+// LocalEpoch returns the field's local epoch, nil before the first cycle.
+func (ep *EdgeProcessor) LocalEpoch() (*GridEpoch, error) {
+	var e GridEpoch
+	var cycleAt, committedAt int64
+	err := ep.localDB.QueryRow(`
+		SELECT epoch, batch_id, cycle_at, cells, committed_at FROM grid_epochs WHERE field_id = ?
+	`, ep.config.FieldID).Scan(&e.Epoch, &e.BatchID, &cycleAt, &e.Cells, &committedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grid epoch: %v", err)
+	}
+	e.CycleAt = time.Unix(cycleAt, 0).UTC()
+	e.CommittedAt = time.Unix(committedAt, 0).UTC()
+	return &e, nil
+}
+
+// abandonBatches drops the local records of batches that never landed.
+func (ep *EdgeProcessor) abandonBatches(ids []string) {
+	for _, id := range ids {
+		if _, err := ep.localDB.Exec(`DELETE FROM grid_batches WHERE batch_id = ?`, id); err != nil {
+			ep.cycleLog.Warn("Failed to drop abandoned grid batch", "component", "batches", "batch_id", id, "error", err)
+		}
+	}
+}
+
+// epochHead is the newest batch of one field in an upload.
+type epochHead struct {
+	first VirtualGridPoint
+	cells int
+}
+
+// epochHeads returns each field's newest batch among points.
+func epochHeads(points []VirtualGridPoint) map[string]*epochHead {
+	heads := make(map[string]*epochHead)
+	for _, p := range points {
+		if p.BatchID == "" {
+			continue
+		}
+		h := heads[p.FieldID]
+		switch {
+		case h == nil || p.Timestamp.After(h.first.Timestamp):
+			heads[p.FieldID] = &epochHead{first: p, cells: 1}
+		case p.BatchID == h.first.BatchID:
+			h.cells++
+		}
+	}
+	return heads
+}
+
+// advanceCloudEpoch moves the uploaded fields' epochs inside tx.
+func advanceCloudEpoch(tx *sql.Tx, points []VirtualGridPoint) error {
+	for field, h := range epochHeads(points) {
+		if _, err := tx.Exec(`
+			INSERT INTO grid_epochs (field_id, epoch, batch_id, edge_device_id, cycle_at, cells, committed_at)
+			VALUES ($1, 1, $2, $3, $4, $5, now())
+			ON CONFLICT (field_id) DO UPDATE SET
+				epoch = grid_epochs.epoch + 1, batch_id = EXCLUDED.batch_id, edge_device_id = EXCLUDED.edge_device_id,
+				cycle_at = EXCLUDED.cycle_at, cells = EXCLUDED.cells, committed_at = now()
+			WHERE EXCLUDED.cycle_at > grid_epochs.cycle_at
+		`, field, h.first.BatchID, h.first.EdgeDeviceID, h.first.Timestamp, h.cells); err != nil {
+			return fmt.Errorf("failed to advance grid epoch: %v", err)
+		}
+	}
+	return nil
+}
+
+// influxEpochLines encodes a grid_epoch point per uploaded field.
+func influxEpochLines(points []VirtualGridPoint) []byte {
+	var b bytes.Buffer
+	for field, h := range epochHeads(points) {
+		b.WriteString(influxEpochMeasure)
+		writeInfluxTag(&b, "field_id", field)
+		writeInfluxTag(&b, "tenant_id", h.first.TenantID)
+		writeInfluxTag(&b, "edge_device_id", h.first.EdgeDeviceID)
+		fmt.Fprintf(&b, ` batch_id="%s",cells=%di %d`+"\n", h.first.BatchID, h.cells, h.first.Timestamp.UnixMilli())
+	}
+	return b.Bytes()
+}
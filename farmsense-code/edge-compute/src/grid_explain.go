@@ -0,0 +1,510 @@
+// Grid Explain - why a cell reads what it reads
+// compute-once -explain runs a cycle's pipeline as of now (or -at): fetch,
+// install-depth exclusion, probe normalization, interpolation, extrapolation
+// guard, rain hold, confidence gate, salinity and trend layers. Instead of storing, syncing
+// or publishing anything it writes a JSON report:
+//
+//   - every reading in the window, raw and normalized, or why it was left
+//     out (failed QC in the local cache, probe flagged for re-installation)
+//   - per cell, the probes considered with their geodesic and effective
+//     distances and IDW weights, the probes rejected and why (outside
+//     search_radius_m, superseded by a probe on the cell), each variable's
+//     samples, interpolator and estimate (per sensor class and fused, with
+//     sensor_classes), with a microclimate model the temperature samples
+//     as residuals and the offset added back, the root-zone moisture the
+//     deficit was taken from, the cell straight out of interpolation, the
+//     final cell, and what the later stages changed
+//
+// -cell (grid ID) or -lat/-lon (nearest cell) narrow the cells to one,
+// which is what you want on a large field. The report is computed in its
+// own process from the cloud or local cache, so it doesn't see a running
+// daemon's rain-event hold. Logical (greenhouse) grids aren't covered:
+// their neighbors are adjacency hops, and the per-cell detail here is
+// geographic.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+// Rejection reasons
+const (
+	ExplainOutsideRadius  = "outside_search_radius"
+	ExplainCoincident     = "superseded_by_coincident_sensor"
+	ExplainNeedsReinstall = "needs_reinstall"
+)
+
+// ExplainOptions selects what to explain. A zero At means now; with
+// neither GridID nor Near every cell is reported.
+type ExplainOptions struct {
+	At     time.Time
+	GridID string
+	Near   *orb.Point
+}
+
+// GridExplanation is the explain report.
+type GridExplanation struct {
+	GeneratedAt       time.Time         `json:"generated_at"`
+	At                time.Time         `json:"at"`
+	FieldID           string            `json:"field_id"`
+	ConfigVersion     string            `json:"config_version"`
+	SearchRadiusM     float64           `json:"search_radius_m"`
+	IDWPower          float64           `json:"idw_power"`
+	MinSensors        int               `json:"min_sensors"`
+	MinNeedConfidence float64           `json:"min_need_confidence"`
+	RBFBasis          string            `json:"rbf_basis,omitempty"` // set when the cycle interpolated by RBF
+	Crop              *CropDay          `json:"crop,omitempty"`
+	Sensors           []ExplainedSensor `json:"sensors"`
+	Skipped           string            `json:"skipped,omitempty"` // why no grid was computed
+	CellsTotal        int               `json:"cells_total"`
+	CellsDropped      int               `json:"cells_dropped"` // without enough coverage
+	Cells             []ExplainedCell   `json:"cells"`
+}
+
+// ExplainValues are a reading's interpolated channels.
+type ExplainValues struct {
+	MoistureSurface float64 `json:"moisture_surface"`
+	MoistureRoot    float64 `json:"moisture_root"`
+	TempSurface     float64 `json:"temp_surface"`
+}
+
+// ExplainedSensor is one reading in the cycle's window.
+type ExplainedSensor struct {
+	SensorID   string         `json:"sensor_id"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Latitude   float64        `json:"latitude"`
+	Longitude  float64        `json:"longitude"`
+	Raw        ExplainValues  `json:"raw"`
+	Normalized *ExplainValues `json:"normalized,omitempty"` // when the sensor registry adjusted it
+	Rejected   string         `json:"rejected,omitempty"`   // why the cycle left it out
+}
+
+// ExplainedNeighbor is a probe a cell was interpolated from.
+type ExplainedNeighbor struct {
+	SensorID  string    `json:"sensor_id"`
+	Timestamp time.Time `json:"timestamp"`
+	GeodesicM float64   `json:"geodesic_m"`
+	DistanceM float64   `json:"distance_m"` // as interpolated (anisotropy applied)
+	Weight    float64   `json:"weight"`     // normalized IDW weight
+}
+
+// ExplainedRejection is a probe a cell was not interpolated from.
+type ExplainedRejection struct {
+	SensorID  string    `json:"sensor_id"`
+	Timestamp time.Time `json:"timestamp"`
+	DistanceM float64   `json:"distance_m"`
+	Reason    string    `json:"reason"`
+}
+
+// ExplainedSample is one probe's value for a variable.
+type ExplainedSample struct {
+	SensorID  string   `json:"sensor_id"`
+	Class     string   `json:"class,omitempty"`
+	DistanceM float64  `json:"distance_m"`
+	Value     float64  `json:"value"`
+	Weight    *float64 `json:"weight,omitempty"` // weighted-mean interpolators only
+}
+
+// ExplainedVariable is one variable's estimate at a cell.
+type ExplainedVariable struct {
+	Name         string            `json:"name"`
+	Interpolator string            `json:"interpolator"`
+	Samples      []ExplainedSample `json:"samples"`
+	NotReporting []string          `json:"not_reporting,omitempty"` // considered probes without the variable
+	Passes       []ExplainedPass   `json:"passes,omitempty"`        // per sensor class, when classes are fused
+	Estimate     *float64          `json:"estimate,omitempty"`
+	Microclimate *float64          `json:"microclimate_c,omitempty"` // temperature offset added to the residual estimate (microclimate.go)
+}
+
+// ExplainedPass is one sensor class's estimate before fusion.
+type ExplainedPass struct {
+	Class        string  `json:"class"` // "" = unclassed probes
+	Interpolator string  `json:"interpolator"`
+	Estimate     float64 `json:"estimate"` // bias-corrected
+	Bias         float64 `json:"bias"`     // offset from sensor_class_reference
+	Share        float64 `json:"share"`    // weight in the fused estimate
+}
+
+// ExplainedCell is how one cell got its values.
+type ExplainedCell struct {
+	GridID       string               `json:"grid_id"`
+	Latitude     float64              `json:"latitude"`
+	Longitude    float64              `json:"longitude"`
+	Considered   []ExplainedNeighbor  `json:"considered"`
+	Rejected     []ExplainedRejection `json:"rejected"`
+	Coincident   string               `json:"coincident_sensor,omitempty"` // probe on the cell, used as is
+	Dropped      string               `json:"dropped,omitempty"`           // why the cell has no value
+	Variables    []ExplainedVariable  `json:"variables,omitempty"`
+	RootZoneVWC  *float64             `json:"root_zone_vwc,omitempty"`
+	DeficitFrom  string               `json:"deficit_from,omitempty"` // depth_profile | surface_root_mean
+	Interpolated *VirtualGridPoint    `json:"interpolated,omitempty"` // straight out of interpolation
+	Final        *VirtualGridPoint    `json:"final,omitempty"`        // after the later stages
+	Adjustments  []string             `json:"adjustments,omitempty"`
+}
+
+// ExplainGrid runs the pipeline for one cycle without storing anything and
+// reports how the selected cells were computed.
+func (ep *EdgeProcessor) ExplainGrid(opts ExplainOptions) (*GridExplanation, error) {
+	if ep.config.LogicalGrid != nil {
+		return nil, fmt.Errorf("explain covers geographic grids only")
+	}
+	ep.cycleLog = ep.logger.With("cycle_id", newCycleID(), "cycle", "explain")
+	liveCrop := ep.cycleCrop
+	defer func() {
+		ep.cycleLog = ep.logger
+		ep.cycleCrop = liveCrop
+	}()
+
+	at := opts.At
+	from, to := at.Add(-backfillSensorWindow), at
+	if at.IsZero() {
+		at = ep.clock.Now()
+		from, to = at.Add(-15*time.Minute), at.Add(maxFutureReadingSkew)
+	}
+	fetched, err := ep.fetchSensorsBetween(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch readings: %v", err)
+	}
+
+	report := &GridExplanation{
+		GeneratedAt:       time.Now().UTC(),
+		At:                at,
+		FieldID:           ep.config.FieldID,
+		ConfigVersion:     ep.remoteConfig.VersionTag(),
+		SearchRadiusM:     ep.config.SearchRadius,
+		IDWPower:          ep.config.IDWPower,
+		MinSensors:        ep.config.MinSensors,
+		MinNeedConfidence: ep.config.minNeedConfidence(),
+		Cells:             make([]ExplainedCell, 0),
+	}
+
+	ep.maybeSyncSensorRegistry()
+	ep.maybeVerifyInstallDepths()
+	sensors := ep.excludeMisinstalledSensors(fetched)
+	raw := make([]ExplainValues, len(sensors))
+	for i, s := range sensors {
+		raw[i] = explainValues(s)
+	}
+	ep.normalizeReadings(sensors)
+	report.Sensors = ep.explainSensors(fetched, sensors, raw)
+	if flagged, err := ep.flaggedReadings(from, to); err != nil {
+		ep.cycleLog.Warn("Failed to list readings that failed QC", "component", "explain", "error", err)
+	} else {
+		report.Sensors = append(report.Sensors, flagged...)
+	}
+
+	gridPoints := ep.generateGridPoints()
+	report.CellsTotal = len(gridPoints)
+	selected, err := ep.explainSelection(gridPoints, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(sensors) < ep.config.MinSensors {
+		report.Skipped = fmt.Sprintf("%d sensors in the window, min_sensors is %d", len(sensors), ep.config.MinSensors)
+		report.CellsDropped = len(gridPoints)
+		return report, nil
+	}
+
+	ep.cycleCrop = ep.cropDayAt(at)
+	report.Crop = ep.cycleCrop
+	points := ep.interpolateField(sensors)
+	if len(ep.cycleRBF) > 0 {
+		report.RBFBasis = ep.rbfBasis()
+	}
+	interpolated := make(map[string]VirtualGridPoint, len(points))
+	for _, p := range points {
+		interpolated[p.GridID] = p
+	}
+	points = ep.applyExtrapolationGuard(points, sensors)
+	ep.applyRainState(points)
+	ep.applyIrrigationMask(points)
+	ep.applyConfidenceGate(points)
+	ep.applyQualityFlags(points, sensors, at)
+	ep.applySalinity(points)
+	ep.applyTrendLayers(points, at)
+	ep.applyLifecycle(points, at)
+	final := make(map[string]VirtualGridPoint, len(points))
+	for _, p := range points {
+		final[p.GridID] = p
+	}
+	report.CellsDropped = len(gridPoints) - len(points)
+
+	residuals := ep.detrendTemperatures(sensors) // as interpolated with a microclimate model
+	for _, gp := range selected {
+		report.Cells = append(report.Cells, ep.explainCell(gp, residuals, interpolated, final))
+	}
+	return report, nil
+}
+
+func explainValues(s SensorReading) ExplainValues {
+	return ExplainValues{MoistureSurface: s.MoistureSurface, MoistureRoot: s.MoistureRoot, TempSurface: s.TempSurface}
+}
+
+// explainSensors lists the fetched readings; kept is the normalized subset
+// the cycle interpolates, raw its values before normalization.
+func (ep *EdgeProcessor) explainSensors(fetched, kept []SensorReading, raw []ExplainValues) []ExplainedSensor {
+	out := make([]ExplainedSensor, 0, len(fetched))
+	k := 0
+	for _, s := range fetched {
+		e := ExplainedSensor{SensorID: s.SensorID, Timestamp: s.Timestamp, Latitude: s.Latitude, Longitude: s.Longitude}
+		// kept is fetched in order with the re-install exclusions taken out
+		if k < len(kept) && kept[k].SensorID == s.SensorID && kept[k].Timestamp.Equal(s.Timestamp) {
+			e.Raw = raw[k]
+			if v := explainValues(kept[k]); v != raw[k] {
+				e.Normalized = &v
+			}
+			k++
+		} else {
+			e.Raw = explainValues(s)
+			e.Rejected = ExplainNeedsReinstall
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// flaggedReadings lists the window's readings in the local cache that
+// failed QC, which the cycle never fetches.
+func (ep *EdgeProcessor) flaggedReadings(from, to time.Time) ([]ExplainedSensor, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT sensor_id, timestamp, latitude, longitude, moisture_surface, moisture_root, temp_surface, quality_flag
+		FROM soil_sensor_readings
+		WHERE field_id = $1 AND timestamp > $2 AND timestamp <= $3 AND quality_flag != 'valid'
+		ORDER BY timestamp DESC
+	`, ep.config.FieldID, readingTimestamp(from), readingTimestamp(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]ExplainedSensor, 0)
+	for rows.Next() {
+		var e ExplainedSensor
+		var flag string
+		if err := rows.Scan(&e.SensorID, &e.Timestamp, &e.Latitude, &e.Longitude,
+			&e.Raw.MoistureSurface, &e.Raw.MoistureRoot, &e.Raw.TempSurface, &flag); err != nil {
+			return nil, err
+		}
+		e.Rejected = "quality_flag:" + flag
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// explainSelection picks the cells to report.
+func (ep *EdgeProcessor) explainSelection(gridPoints []gridPoint, opts ExplainOptions) ([]gridPoint, error) {
+	switch {
+	case opts.GridID != "":
+		for _, gp := range gridPoints {
+			if ep.generateGridID(gp) == opts.GridID {
+				return []gridPoint{gp}, nil
+			}
+		}
+		return nil, fmt.Errorf("no cell %s in the field's grid", opts.GridID)
+	case opts.Near != nil:
+		if len(gridPoints) == 0 {
+			return nil, nil
+		}
+		best, bestDistance := 0, -1.0
+		for i, gp := range gridPoints {
+			if d := geo.Distance(gp.Point, *opts.Near); bestDistance < 0 || d < bestDistance {
+				best, bestDistance = i, d
+			}
+		}
+		return gridPoints[best : best+1], nil
+	}
+	return gridPoints, nil
+}
+
+// explainCell retraces interpolatePoint and blendNeighbors for one cell.
+func (ep *EdgeProcessor) explainCell(gp gridPoint, sensors []SensorReading, interpolated, final map[string]VirtualGridPoint) ExplainedCell {
+	cell := ExplainedCell{
+		GridID:     ep.generateGridID(gp),
+		Latitude:   gp.Lat(),
+		Longitude:  gp.Lon(),
+		Considered: make([]ExplainedNeighbor, 0),
+		Rejected:   make([]ExplainedRejection, 0),
+	}
+
+	neighbors := make([]sensorNeighbor, 0)
+	for _, s := range sensors {
+		distance := ep.sensorDistance(gp.Point, s)
+		if distance > ep.config.SearchRadius {
+			cell.Rejected = append(cell.Rejected, ExplainedRejection{
+				SensorID: s.SensorID, Timestamp: s.Timestamp, DistanceM: distance, Reason: ExplainOutsideRadius,
+			})
+			continue
+		}
+		neighbors = append(neighbors, sensorNeighbor{sensor: s, distance: distance})
+	}
+	for i, n := range neighbors {
+		if n.distance != 0 {
+			continue
+		}
+		cell.Coincident = n.sensor.SensorID
+		for j, other := range neighbors {
+			if j != i {
+				cell.Rejected = append(cell.Rejected, ExplainedRejection{
+					SensorID: other.sensor.SensorID, Timestamp: other.sensor.Timestamp, DistanceM: other.distance, Reason: ExplainCoincident,
+				})
+			}
+		}
+		neighbors = []sensorNeighbor{n}
+		break
+	}
+
+	samples := make([]NeighborSample, len(neighbors))
+	for i, n := range neighbors {
+		samples[i] = NeighborSample{Distance: n.distance}
+	}
+	weights := ep.idw().Weights(samples)
+	for i, n := range neighbors {
+		cell.Considered = append(cell.Considered, ExplainedNeighbor{
+			SensorID:  n.sensor.SensorID,
+			Timestamp: n.sensor.Timestamp,
+			GeodesicM: geo.Distance(gp.Point, orb.Point{n.sensor.Longitude, n.sensor.Latitude}),
+			DistanceM: n.distance,
+			Weight:    weights[i],
+		})
+	}
+	if cell.Coincident == "" && len(neighbors) < ep.config.MinSensors {
+		cell.Dropped = fmt.Sprintf("%d sensors within %.0f m, min_sensors is %d",
+			len(neighbors), ep.config.SearchRadius, ep.config.MinSensors)
+		return cell
+	}
+
+	cell.Variables = ep.explainVariables(gp.Point, neighbors)
+	if p, ok := interpolated[cell.GridID]; ok {
+		cell.Interpolated = &p
+		vwc, from := (p.MoistureSurface+p.MoistureRoot)/2, "surface_root_mean"
+		if v, ok := ep.profileRootZoneVWC(p); ok {
+			vwc, from = v, "depth_profile"
+		}
+		cell.RootZoneVWC, cell.DeficitFrom = &vwc, from
+	}
+	if p, ok := final[cell.GridID]; ok {
+		cell.Final = &p
+	}
+	cell.Adjustments = explainAdjustments(cell.Interpolated, cell.Final, ep.config.minNeedConfidence())
+	return cell
+}
+
+// explainVariables retraces estimateVariables.
+func (ep *EdgeProcessor) explainVariables(point orb.Point, neighbors []sensorNeighbor) []ExplainedVariable {
+	out := make([]ExplainedVariable, 0, len(sensorVariables))
+	for _, v := range sensorVariables {
+		ev := ExplainedVariable{Name: v.Name, Samples: make([]ExplainedSample, 0, len(neighbors))}
+		samples := make([]NeighborSample, 0, len(neighbors))
+		classes := make([]string, 0, len(neighbors))
+		for _, n := range neighbors {
+			value, ok := v.Read(n.sensor)
+			if !ok {
+				ev.NotReporting = append(ev.NotReporting, n.sensor.SensorID)
+				continue
+			}
+			samples = append(samples, NeighborSample{Distance: n.distance, Value: value})
+			classes = append(classes, n.sensor.class)
+			ev.Samples = append(ev.Samples, ExplainedSample{
+				SensorID: n.sensor.SensorID, Class: n.sensor.class, DistanceM: n.distance, Value: value,
+			})
+		}
+		if len(samples) == 0 {
+			continue
+		}
+
+		if len(ep.config.SensorClasses) > 0 {
+			out = append(out, ep.explainClassFusion(point, v, ev, samples, classes))
+			continue
+		}
+		if m := ep.cycleRBF[v.Name]; m != nil {
+			// Fitted over every probe, so there are no per-neighbor weights
+			ev.Interpolator = "rbf_" + ep.rbfBasis()
+			value := m.At(point)
+			ev.Estimate = &value
+			out = append(out, ev)
+			continue
+		}
+		var interp Interpolator = ep.idw()
+		if v.Interpolator != nil {
+			interp = v.Interpolator
+		}
+		ev.Interpolator = interp.Name()
+		if weighter, ok := interp.(SampleWeighter); ok {
+			for i, w := range weighter.Weights(samples) {
+				w := w
+				ev.Samples[i].Weight = &w
+			}
+		}
+		if value, ok := interp.Estimate(samples); ok {
+			ev.Estimate = &value
+		}
+		out = append(out, ev)
+	}
+	if ep.cycleMicro != nil {
+		for i := range out {
+			if out[i].Name != VarTemperature || out[i].Estimate == nil {
+				continue
+			}
+			offset := ep.cycleMicro.offset(point.Lon(), point.Lat())
+			estimate := *out[i].Estimate + offset
+			out[i].Microclimate, out[i].Estimate = &offset, &estimate
+		}
+	}
+	return out
+}
+
+// explainClassFusion fills in ev from one pass per sensor class.
+func (ep *EdgeProcessor) explainClassFusion(point orb.Point, v SensorVariable, ev ExplainedVariable, samples []NeighborSample, classes []string) ExplainedVariable {
+	ev.Interpolator = "class_fusion"
+	passes := ep.classPasses(point, v, samples, classes, ep.cycleRBF)
+	for i, share := range passShares(passes) {
+		p := passes[i]
+		pass := ExplainedPass{Class: p.class, Interpolator: ep.idw().Name(), Estimate: p.estimate, Bias: p.bias, Share: share}
+		if ep.cycleRBF[classVariableKey(p.class, v.Name)] != nil {
+			pass.Interpolator = "rbf_" + ep.rbfBasis()
+		} else if v.Interpolator != nil {
+			pass.Interpolator = v.Interpolator.Name()
+		}
+		ev.Passes = append(ev.Passes, pass)
+	}
+	var interp Interpolator = ep.idw()
+	if v.Interpolator != nil {
+		interp = v.Interpolator
+	}
+	if weighter, ok := interp.(SampleWeighter); ok {
+		for i, w := range ep.fusedWeights(point, v, weighter, samples, classes) {
+			w := w
+			ev.Samples[i].Weight = &w
+		}
+	}
+	if value, ok := fusePasses(passes); ok {
+		ev.Estimate = &value
+	}
+	return ev
+}
+
+// explainAdjustments describes what the stages after interpolation changed.
+func explainAdjustments(before, after *VirtualGridPoint, minConfidence float64) []string {
+	if before == nil || after == nil {
+		return nil
+	}
+	out := make([]string, 0)
+	if after.IrrigationNeed != before.IrrigationNeed {
+		reason := "held at its pre-rain level during a rain event"
+		if after.NeedFlag == NeedFlagLowConfidence {
+			reason = fmt.Sprintf("confidence %.2f is below min_need_confidence %.2f, deferred to the zone", after.Confidence, minConfidence)
+		}
+		out = append(out, fmt.Sprintf("irrigation_need %s -> %s: %s", before.IrrigationNeed, after.IrrigationNeed, reason))
+	}
+	if after.LeachingFraction > 0 {
+		out = append(out, fmt.Sprintf("leaching fraction %.2f added for salinity", after.LeachingFraction))
+	}
+	if after.TrendCycles > 0 {
+		out = append(out, fmt.Sprintf("trend layers fitted over %d cycles", after.TrendCycles))
+	}
+	return out
+}
@@ -0,0 +1,297 @@
+// Grid Export - cycles from the local grid history as files
+// Backs the export subcommand: the cycles recorded in the local grid
+// history (either grid_history_format, grid_packing.go) since a cutoff (or just the latest) are written to a
+// directory, so a tech can pull maps off a gateway without the cloud.
+//
+//	geotiff  one single-band raster per cycle of the chosen variable,
+//	         <field_id>_<variable>_<20060102T150405Z>.tif
+//	csv      one file with every cell of every cycle,
+//	         <field_id>_grid_<first>_<last>.csv
+//	tiles    PNG heatmap tiles of the newest cycle in XYZ layout,
+//	         <variable>/{z}/{x}/{y}.png (map_tiles.go)
+//
+// Logical (greenhouse) grids have no coordinates and can only go to CSV.
+// CSV rows end with the cell's quality_flags (quality_flags.go; 0 for
+// history recorded before them). Trend layers missing from a cell (too few cycles, not drying, or history
+// recorded before they existed) are nodata in GeoTIFF and empty in CSV.
+// With imperial units (units.go) values are converted and the CSV columns
+// and GeoTIFF file names carry the imperial names, e.g. water_deficit_in.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const exportTimeFormat = "20060102T150405Z"
+
+// Export formats
+const (
+	ExportFormatGeoTIFF = "geotiff"
+	ExportFormatCSV     = "csv"
+	ExportFormatTiles   = "tiles"
+)
+
+// exportVariables are the grid_history columns that can be exported.
+var exportVariables = []string{"moisture_surface", "moisture_root", "temperature", "water_deficit_mm",
+	"drydown_rate_mm_day", "temp_trend_c_day", "hours_to_refill"}
+
+// historyCell is one cell of one recorded cycle.
+type historyCell struct {
+	GridID    string
+	Timestamp time.Time
+	Values    [7]float64 // in exportVariables order; NaN = no value
+	Flags     QualityFlags
+}
+
+// ExportRequest selects what the export subcommand writes.
+type ExportRequest struct {
+	Format   string
+	Since    time.Time // zero = the latest cycle only
+	Variable string    // geotiff band or tile layer (default moisture_root)
+	Units    string    // metric | imperial (default: the field's units)
+	OutDir   string
+	MinZoom  int // tiles only (default 14)
+	MaxZoom  int // tiles only (default 19)
+}
+
+// exportBand is a variable's index in exportVariables, or -1.
+func exportBand(variable string) int {
+	for i, v := range exportVariables {
+		if v == variable {
+			return i
+		}
+	}
+	return -1
+}
+
+// fetchGridHistory returns the recorded cycles since the cutoff, oldest
+// first; a zero cutoff returns the latest cycle.
+func (ep *EdgeProcessor) fetchGridHistory(since time.Time) (map[time.Time][]historyCell, error) {
+	if ep.packedHistory() {
+		from := since.Unix()
+		if since.IsZero() {
+			var last sql.NullInt64
+			if err := ep.localDB.QueryRow(`SELECT MAX(timestamp) FROM grid_history_packed WHERE field_id = ?`,
+				ep.config.FieldID).Scan(&last); err != nil {
+				return nil, fmt.Errorf("failed to query grid history: %v", err)
+			}
+			from = last.Int64
+		}
+		cycles := make(map[time.Time][]historyCell)
+		err := ep.eachPackedCycle(from, math.MaxInt64, func(c historyCycle) error {
+			cycles[c.at] = c.cells
+			return nil
+		})
+		return cycles, err
+	}
+	query := `
+		SELECT grid_id, timestamp, moisture_surface, moisture_root, temperature, water_deficit_mm,
+			drydown_rate_mm_day, temp_trend_c_day, hours_to_refill, COALESCE(quality_flags, 0)
+		FROM grid_history
+		WHERE field_id = ? AND timestamp >= ?
+		ORDER BY timestamp, grid_id
+	`
+	args := []interface{}{ep.config.FieldID, since.Unix()}
+	if since.IsZero() {
+		query = `
+			SELECT grid_id, timestamp, moisture_surface, moisture_root, temperature, water_deficit_mm,
+				drydown_rate_mm_day, temp_trend_c_day, hours_to_refill, COALESCE(quality_flags, 0)
+			FROM grid_history
+			WHERE field_id = ? AND timestamp = (SELECT MAX(timestamp) FROM grid_history WHERE field_id = ?)
+			ORDER BY grid_id
+		`
+		args = []interface{}{ep.config.FieldID, ep.config.FieldID}
+	}
+	rows, err := ep.localDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+
+	cycles := make(map[time.Time][]historyCell)
+	for rows.Next() {
+		var c historyCell
+		var ts int64
+		var layers [3]sql.NullFloat64
+		if err := rows.Scan(&c.GridID, &ts, &c.Values[0], &c.Values[1], &c.Values[2], &c.Values[3],
+			&layers[0], &layers[1], &layers[2], &c.Flags); err != nil {
+			return nil, fmt.Errorf("failed to read grid history: %v", err)
+		}
+		for i, l := range layers {
+			c.Values[4+i] = math.NaN()
+			if l.Valid {
+				c.Values[4+i] = l.Float64
+			}
+		}
+		c.Timestamp = time.Unix(ts, 0).UTC()
+		cycles[c.Timestamp] = append(cycles[c.Timestamp], c)
+	}
+	return cycles, rows.Err()
+}
+
+// ExportGridHistory writes the requested cycles and returns the files
+// written.
+func (ep *EdgeProcessor) ExportGridHistory(req ExportRequest) ([]string, error) {
+	if req.OutDir == "" {
+		req.OutDir = "."
+	}
+	if req.Variable == "" {
+		req.Variable = "moisture_root"
+	}
+	if req.Units == "" {
+		req.Units = ep.config.Units
+	}
+	if !validUnits(req.Units) {
+		return nil, fmt.Errorf("units must be %s or %s", UnitsMetric, UnitsImperial)
+	}
+	band := exportBand(req.Variable)
+	if band < 0 {
+		return nil, fmt.Errorf("unknown variable %q (one of %v)", req.Variable, exportVariables)
+	}
+	if (req.Format == ExportFormatGeoTIFF || req.Format == ExportFormatTiles) && ep.config.LogicalGrid != nil {
+		return nil, fmt.Errorf("%s needs a geographic grid", req.Format)
+	}
+	if req.Format == ExportFormatTiles {
+		if req.MinZoom <= 0 {
+			req.MinZoom = defaultMinTileZoom
+		}
+		if req.MaxZoom <= 0 {
+			req.MaxZoom = defaultMaxTileZoom
+		}
+		if req.MinZoom > req.MaxZoom || req.MaxZoom > maxTileZoom {
+			return nil, fmt.Errorf("zooms must satisfy min <= max <= %d (got %d-%d)", maxTileZoom, req.MinZoom, req.MaxZoom)
+		}
+	}
+
+	cycles, err := ep.fetchGridHistory(req.Since)
+	if err != nil {
+		return nil, err
+	}
+	if len(cycles) == 0 {
+		return nil, fmt.Errorf("no grid history for field %s in the local cache", ep.config.FieldID)
+	}
+	times := make([]time.Time, 0, len(cycles))
+	for t := range cycles {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	if err := os.MkdirAll(req.OutDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", req.OutDir, err)
+	}
+	switch req.Format {
+	case ExportFormatGeoTIFF:
+		name, conv := req.Variable, unitRule{scale: 1}
+		if req.Units == UnitsImperial {
+			name, conv = imperialColumn(req.Variable)
+		}
+		files := make([]string, 0, len(times))
+		for _, t := range times {
+			path := filepath.Join(req.OutDir, fmt.Sprintf("%s_%s_%s.tif", ep.config.FieldID, name, t.Format(exportTimeFormat)))
+			if err := ep.writeCycleGeoTIFF(path, cycles[t], band, conv); err != nil {
+				return files, err
+			}
+			files = append(files, path)
+		}
+		return files, nil
+	case ExportFormatCSV:
+		path := filepath.Join(req.OutDir, fmt.Sprintf("%s_grid_%s_%s.csv", ep.config.FieldID,
+			times[0].Format(exportTimeFormat), times[len(times)-1].Format(exportTimeFormat)))
+		if err := writeHistoryCSV(path, times, cycles, req.Units); err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	case ExportFormatTiles:
+		// Colors come from fixed metric ranges, so units don't apply
+		r := ep.cycleRaster(cycles[times[len(times)-1]], band, unitRule{scale: 1})
+		return writeTilePyramid(filepath.Join(req.OutDir, req.Variable), r, defaultTileRamp(req.Variable), req.MinZoom, req.MaxZoom)
+	}
+	return nil, fmt.Errorf("unknown format %q (geotiff, csv or tiles)", req.Format)
+}
+
+// writeCycleGeoTIFF writes one cycle's raster.
+func (ep *EdgeProcessor) writeCycleGeoTIFF(path string, cells []historyCell, band int, conv unitRule) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	if err := writeGeoTIFF(f, ep.cycleRaster(cells, band, conv)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+// cycleRaster rasterizes one cycle onto the field's grid.
+func (ep *EdgeProcessor) cycleRaster(cells []historyCell, band int, conv unitRule) geoRaster {
+	g := ep.gridLayout()
+	r := geoRaster{
+		cols:    g.cols,
+		rows:    g.rows,
+		west:    g.minLon - g.lonStep/2,
+		north:   g.minLat + (float64(g.rows)-0.5)*g.latStep,
+		lonStep: g.lonStep,
+		latStep: g.latStep,
+		values:  make([]float64, g.cols*g.rows),
+	}
+	for i := range r.values {
+		r.values[i] = math.NaN()
+	}
+	for _, c := range cells {
+		row, col, ok := ep.parseGridID(c.GridID)
+		if !ok || row >= g.rows || col >= g.cols {
+			continue // legacy or out-of-layout ID
+		}
+		r.values[(g.rows-1-row)*g.cols+col] = c.Values[band]*conv.scale + conv.offset // raster rows run north to south
+	}
+	return r
+}
+
+func writeHistoryCSV(path string, times []time.Time, cycles map[time.Time][]historyCell, units string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	header := []string{"grid_id", "timestamp"}
+	convs := make([]unitRule, len(exportVariables))
+	for i, v := range exportVariables {
+		name, conv := v, unitRule{scale: 1}
+		if units == UnitsImperial {
+			name, conv = imperialColumn(v)
+		}
+		header = append(header, name)
+		convs[i] = conv
+	}
+	header = append(header, "quality_flags")
+	w := csv.NewWriter(f)
+	w.Write(header)
+	for _, t := range times {
+		for _, c := range cycles[t] {
+			rec := []string{c.GridID, t.Format(time.RFC3339)}
+			for i, v := range c.Values {
+				if math.IsNaN(v) {
+					rec = append(rec, "")
+					continue
+				}
+				rec = append(rec, strconv.FormatFloat(v*convs[i].scale+convs[i].offset, 'f', -1, 64))
+			}
+			rec = append(rec, strconv.FormatUint(uint64(c.Flags), 10))
+			w.Write(rec)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,438 @@
+// Grid History API - filtered, paginated slices of the local grid history
+// Third-party tools pull history from the local cache (either
+// grid_history_format, grid_packing.go) rather than the latest grid:
+//
+//	from, to  RFC3339 range, [from, to) (default the last 24 hours)
+//	bbox      minLon,minLat,maxLon,maxLat; cells whose center is inside
+//	zone_id   cells of one management zone (first zone containing the center)
+//	layers    comma-separated exportVariables and quality_flags (default all)
+//	aggregate hourly or daily (UTC buckets): per cell, the mean of each
+//	          layer over the bucket's cycles and the union of their flags
+//	limit     cycles (or buckets) per page, default 24, at most 500
+//	cursor    next_cursor from the previous page
+//
+// Pages run oldest first. Cells are positioned from their stable IDs
+// (grid_ids.go), so logical (greenhouse) grids have no coordinates and
+// match no bbox or zone. /grid/history/cycles lists the recorded cycles
+// and their cell counts in a range, to plan a pull without the cells.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGridHistoryWindow = 24 * time.Hour
+	defaultGridHistoryLimit  = 24
+	maxGridHistoryLimit      = 500
+)
+
+// Grid history aggregates
+const (
+	HistoryAggregateHourly = "hourly"
+	HistoryAggregateDaily  = "daily"
+)
+
+// GridHistoryQuery selects a page of grid history.
+type GridHistoryQuery struct {
+	From, To  time.Time
+	BBox      *[4]float64 // minLon, minLat, maxLon, maxLat; nil = whole field
+	ZoneID    string
+	Layers    []string // empty = every layer
+	Aggregate string   // "" = every cycle, hourly or daily
+	Limit     int
+	Cursor    string
+}
+
+// GridHistoryCell is one cell of one cycle or bucket. Layers left out of
+// the query, or without a value, are omitted.
+type GridHistoryCell struct {
+	GridID           string        `json:"grid_id"`
+	Latitude         *float64      `json:"latitude,omitempty"`
+	Longitude        *float64      `json:"longitude,omitempty"`
+	Samples          int           `json:"samples,omitempty"` // cycles averaged, aggregates only
+	MoistureSurface  *float64      `json:"moisture_surface,omitempty"`
+	MoistureRoot     *float64      `json:"moisture_root,omitempty"`
+	Temperature      *float64      `json:"temperature,omitempty"`
+	WaterDeficitMM   *float64      `json:"water_deficit_mm,omitempty"`
+	DrydownRateMMDay *float64      `json:"drydown_rate_mm_day,omitempty"`
+	TempTrendCDay    *float64      `json:"temp_trend_c_day,omitempty"`
+	HoursToRefill    *float64      `json:"hours_to_refill,omitempty"`
+	QualityFlags     *QualityFlags `json:"quality_flags,omitempty"`
+}
+
+// GridHistoryCycle is a recorded cycle, or an aggregate bucket starting at
+// Timestamp.
+type GridHistoryCycle struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Cycles    int               `json:"cycles,omitempty"` // cycles in the bucket, aggregates only
+	Cells     []GridHistoryCell `json:"cells"`
+}
+
+// GridHistoryPage is one page of a grid history query.
+type GridHistoryPage struct {
+	From       time.Time          `json:"from"`
+	To         time.Time          `json:"to"`
+	Aggregate  string             `json:"aggregate,omitempty"`
+	Layers     []string           `json:"layers"`
+	Cycles     []GridHistoryCycle `json:"cycles"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// GridHistoryStamp is a recorded cycle's time and size.
+type GridHistoryStamp struct {
+	Timestamp time.Time `json:"timestamp"`
+	Cells     int       `json:"cells"`
+}
+
+// historyLayers are the selectable layers: exportVariables, then flags.
+var historyLayers = append(append([]string{}, exportVariables...), "quality_flags")
+
+// normalize fills defaults and validates q.
+func (q *GridHistoryQuery) normalize(now time.Time, zones []ManagementZone) error {
+	if q.To.IsZero() {
+		q.To = now
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-defaultGridHistoryWindow)
+	}
+	if !q.From.Before(q.To) {
+		return fmt.Errorf("from must be before to")
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultGridHistoryLimit
+	}
+	if q.Limit < 0 || q.Limit > maxGridHistoryLimit {
+		return fmt.Errorf("limit must be in [1, %d]", maxGridHistoryLimit)
+	}
+	switch q.Aggregate {
+	case "", HistoryAggregateHourly, HistoryAggregateDaily:
+	default:
+		return fmt.Errorf("aggregate must be hourly or daily (got %q)", q.Aggregate)
+	}
+	if len(q.Layers) == 0 {
+		q.Layers = historyLayers
+	}
+	for _, l := range q.Layers {
+		if !containsString(historyLayers, l) {
+			return fmt.Errorf("unknown layer %q (one of %v)", l, historyLayers)
+		}
+	}
+	if b := q.BBox; b != nil && (b[0] > b[2] || b[1] > b[3]) {
+		return fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	if q.ZoneID != "" {
+		found := false
+		for _, z := range zones {
+			found = found || z.ZoneID == q.ZoneID
+		}
+		if !found {
+			return fmt.Errorf("unknown zone_id %q", q.ZoneID)
+		}
+	}
+	if q.Cursor != "" {
+		ts, err := strconv.ParseInt(q.Cursor, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cursor")
+		}
+		q.From = time.Unix(ts, 0).UTC()
+	}
+	return nil
+}
+
+// parseBBox reads minLon,minLat,maxLon,maxLat.
+func parseBBox(s string) (*[4]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	var b [4]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+		b[i] = v
+	}
+	return &b, nil
+}
+
+// bucketStart is the aggregate bucket a cycle falls in.
+func bucketStart(ts int64, aggregate string) int64 {
+	switch aggregate {
+	case HistoryAggregateHourly:
+		return ts - ts%3600
+	case HistoryAggregateDaily:
+		return ts - ts%86400
+	}
+	return ts
+}
+
+// GridHistoryCycles returns the field's recorded cycle times in [from,
+// to), oldest first, with their cell counts.
+func (ep *EdgeProcessor) GridHistoryCycles(from, to time.Time) ([]GridHistoryStamp, error) {
+	query := `
+		SELECT timestamp, COUNT(*) FROM grid_history
+		WHERE field_id = ? AND timestamp >= ? AND timestamp < ?
+		GROUP BY timestamp ORDER BY timestamp
+	`
+	if ep.packedHistory() {
+		query = `
+			SELECT timestamp, cells FROM grid_history_packed
+			WHERE field_id = ? AND timestamp >= ? AND timestamp < ?
+			ORDER BY timestamp
+		`
+	}
+	rows, err := ep.localDB.Query(query, ep.config.FieldID, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+
+	stamps := make([]GridHistoryStamp, 0)
+	for rows.Next() {
+		var ts int64
+		var s GridHistoryStamp
+		if err := rows.Scan(&ts, &s.Cells); err != nil {
+			return nil, fmt.Errorf("failed to read grid history: %v", err)
+		}
+		s.Timestamp = time.Unix(ts, 0).UTC()
+		stamps = append(stamps, s)
+	}
+	return stamps, rows.Err()
+}
+
+// eachHistoryCycle calls fn with each recorded cycle in [from, to], oldest
+// first, in either history format.
+func (ep *EdgeProcessor) eachHistoryCycle(from, to int64, fn func(historyCycle) error) error {
+	if ep.packedHistory() {
+		return ep.eachPackedCycle(from, to, fn)
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT grid_id, timestamp, moisture_surface, moisture_root, temperature, water_deficit_mm,
+			drydown_rate_mm_day, temp_trend_c_day, hours_to_refill, COALESCE(quality_flags, 0)
+		FROM grid_history
+		WHERE field_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp, grid_id
+	`, ep.config.FieldID, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+
+	var c historyCycle
+	for rows.Next() {
+		var cell historyCell
+		var ts int64
+		var layers [3]sql.NullFloat64
+		if err := rows.Scan(&cell.GridID, &ts, &cell.Values[0], &cell.Values[1], &cell.Values[2], &cell.Values[3],
+			&layers[0], &layers[1], &layers[2], &cell.Flags); err != nil {
+			return fmt.Errorf("failed to read grid history: %v", err)
+		}
+		for i, l := range layers {
+			cell.Values[4+i] = math.NaN()
+			if l.Valid {
+				cell.Values[4+i] = l.Float64
+			}
+		}
+		cell.Timestamp = time.Unix(ts, 0).UTC()
+		if len(c.cells) > 0 && !cell.Timestamp.Equal(c.at) {
+			if err := fn(c); err != nil {
+				return err
+			}
+			c = historyCycle{}
+		}
+		c.at = cell.Timestamp
+		c.cells = append(c.cells, cell)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(c.cells) > 0 {
+		return fn(c)
+	}
+	return nil
+}
+
+// historyCellFilter returns the cell's position and whether it passes the
+// query's bbox and zone.
+func (ep *EdgeProcessor) historyCellFilter(q GridHistoryQuery) func(gridID string) (lat, lon float64, positioned, ok bool) {
+	layout := ep.gridLayout()
+	var zone *ManagementZone
+	for i := range ep.config.ManagementZones {
+		if ep.config.ManagementZones[i].ZoneID == q.ZoneID {
+			zone = &ep.config.ManagementZones[i]
+		}
+	}
+	return func(gridID string) (float64, float64, bool, bool) {
+		row, col, parsed := ep.parseGridID(gridID)
+		if !parsed {
+			return 0, 0, false, q.BBox == nil && zone == nil
+		}
+		p := layout.point(row, col)
+		lon, lat := p.X(), p.Y()
+		if b := q.BBox; b != nil && (lon < b[0] || lat < b[1] || lon > b[2] || lat > b[3]) {
+			return lat, lon, true, false
+		}
+		if zone != nil && !pointInRing(lon, lat, zone.Boundary) {
+			return lat, lon, true, false
+		}
+		return lat, lon, true, true
+	}
+}
+
+// GridHistory returns a page of the local grid history.
+func (ep *EdgeProcessor) GridHistory(q GridHistoryQuery) (GridHistoryPage, error) {
+	if err := q.normalize(ep.clock.Now().UTC(), ep.config.ManagementZones); err != nil {
+		return GridHistoryPage{}, err
+	}
+	page := GridHistoryPage{From: q.From, To: q.To, Aggregate: q.Aggregate, Layers: q.Layers, Cycles: []GridHistoryCycle{}}
+	stamps, err := ep.GridHistoryCycles(q.From, q.To)
+	if err != nil {
+		return page, err
+	}
+
+	// Page by bucket: the range ends before the first cycle of the bucket
+	// after the limit, which is where the next page starts.
+	buckets := 0
+	last := int64(-1)
+	var pageEnd int64
+	for _, s := range stamps {
+		ts := s.Timestamp.Unix()
+		if b := bucketStart(ts, q.Aggregate); b != last {
+			if buckets == q.Limit {
+				page.NextCursor = strconv.FormatInt(ts, 10)
+				break
+			}
+			buckets++
+			last = b
+		}
+		pageEnd = ts
+	}
+	if buckets == 0 {
+		return page, nil
+	}
+
+	want := make([]bool, len(historyLayers))
+	for _, l := range q.Layers {
+		want[indexOf(historyLayers, l)] = true
+	}
+	filter := ep.historyCellFilter(q)
+	type cellAcc struct {
+		sums    [7]float64
+		counts  [7]int
+		flags   QualityFlags
+		samples int
+	}
+	var bucket *GridHistoryCycle
+	var accs map[string]*cellAcc
+	flush := func() {
+		if bucket == nil || q.Aggregate == "" {
+			return
+		}
+		ids := make([]string, 0, len(accs))
+		for id := range accs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			a := accs[id]
+			var cell historyCell
+			cell.GridID, cell.Flags = id, a.flags
+			for i := range cell.Values {
+				cell.Values[i] = math.NaN()
+				if a.counts[i] > 0 {
+					cell.Values[i] = a.sums[i] / float64(a.counts[i])
+				}
+			}
+			out, ok := historyCellOut(cell, want, filter)
+			if ok {
+				out.Samples = a.samples
+				bucket.Cells = append(bucket.Cells, out)
+			}
+		}
+		page.Cycles = append(page.Cycles, *bucket)
+	}
+
+	err = ep.eachHistoryCycle(stamps[0].Timestamp.Unix(), pageEnd, func(c historyCycle) error {
+		if q.Aggregate == "" {
+			out := GridHistoryCycle{Timestamp: c.at, Cells: make([]GridHistoryCell, 0, len(c.cells))}
+			for _, cell := range c.cells {
+				if hc, ok := historyCellOut(cell, want, filter); ok {
+					out.Cells = append(out.Cells, hc)
+				}
+			}
+			page.Cycles = append(page.Cycles, out)
+			return nil
+		}
+		start := time.Unix(bucketStart(c.at.Unix(), q.Aggregate), 0).UTC()
+		if bucket == nil || !bucket.Timestamp.Equal(start) {
+			flush()
+			bucket = &GridHistoryCycle{Timestamp: start, Cells: []GridHistoryCell{}}
+			accs = make(map[string]*cellAcc)
+		}
+		bucket.Cycles++
+		for _, cell := range c.cells {
+			a := accs[cell.GridID]
+			if a == nil {
+				a = &cellAcc{}
+				accs[cell.GridID] = a
+			}
+			a.samples++
+			a.flags |= cell.Flags
+			for i, v := range cell.Values {
+				if !math.IsNaN(v) {
+					a.sums[i] += v
+					a.counts[i]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return page, err
+	}
+	flush()
+	return page, nil
+}
+
+// historyCellOut renders a cell with the wanted layers, or false when the
+// filter drops it.
+func historyCellOut(cell historyCell, want []bool, filter func(string) (float64, float64, bool, bool)) (GridHistoryCell, bool) {
+	lat, lon, positioned, ok := filter(cell.GridID)
+	if !ok {
+		return GridHistoryCell{}, false
+	}
+	out := GridHistoryCell{GridID: cell.GridID}
+	if positioned {
+		out.Latitude, out.Longitude = float64Ptr(lat), float64Ptr(lon)
+	}
+	fields := []**float64{&out.MoistureSurface, &out.MoistureRoot, &out.Temperature, &out.WaterDeficitMM,
+		&out.DrydownRateMMDay, &out.TempTrendCDay, &out.HoursToRefill}
+	for i, f := range fields {
+		if want[i] && !math.IsNaN(cell.Values[i]) {
+			*f = float64Ptr(cell.Values[i])
+		}
+	}
+	if want[len(fields)] {
+		flags := cell.Flags
+		out.QualityFlags = &flags
+	}
+	return out, true
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,181 @@
+// Grid IDs - stable cell identifiers
+// Cells are identified by their row and column from the field origin
+// (<field_id>_r012_c034), and positioned from that index, so an ID names
+// the same square every cycle and on every device. Earlier releases
+// formatted each cell's accumulated float coordinates into the ID
+// (<field_id>_37.77490_-122.41940), which drifted with rounding and broke
+// time-series joins.
+//
+// legacyGridIDMap regenerates the old IDs exactly as they were produced,
+// so history can be carried over: the local trend history is rewritten on
+// startup, and -migrate-grid-ids publishes the mapping to the cloud
+// grid_id_map table and rewrites the field's stored cloud cells.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/paulmach/orb"
+)
+
+// gridPoint is a cell center with its index from the field origin.
+type gridPoint struct {
+	orb.Point
+	Row, Col int
+}
+
+// gridLayout is the field's geographic grid.
+type gridLayout struct {
+	minLat, maxLat, minLon, maxLon float64
+	latStep, lonStep               float64
+	rows, cols                     int
+}
+
+func (ep *EdgeProcessor) gridLayout() gridLayout {
+	// 20m or 10m resolution
+	res := ep.config.GridResolution
+	if res <= 0 {
+		res = 20.0
+	}
+
+	g := gridLayout{minLat: 37.7749, maxLat: 37.7800, minLon: -122.4194, maxLon: -122.4100}
+	if b := ep.config.FieldBoundary; b != nil {
+		g.minLon, g.minLat, g.maxLon, g.maxLat = b.extent()
+	}
+
+	// Convert resolution in meters to approximate degrees
+	g.latStep = res / metersPerDegreeLat
+	g.lonStep = res / (metersPerDegreeLat * math.Cos(g.minLat*math.Pi/180.0))
+	g.rows = int(math.Floor((g.maxLat-g.minLat)/g.latStep+1e-9)) + 1
+	g.cols = int(math.Floor((g.maxLon-g.minLon)/g.lonStep+1e-9)) + 1
+	return g
+}
+
+func (g gridLayout) point(row, col int) orb.Point {
+	return orb.Point{g.minLon + float64(col)*g.lonStep, g.minLat + float64(row)*g.latStep}
+}
+
+// parseGridID returns the row and column of one of the field's stable
+// cell IDs.
+func (ep *EdgeProcessor) parseGridID(id string) (row, col int, ok bool) {
+	rest := strings.TrimPrefix(id, ep.config.FieldID+"_")
+	if rest == id {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscanf(rest, "r%d_c%d", &row, &col); err != nil {
+		return 0, 0, false
+	}
+	return row, col, true
+}
+
+// GridIDMapping pairs a cell's legacy ID with its stable one.
+type GridIDMapping struct {
+	LegacyGridID string `json:"legacy_grid_id"`
+	GridID       string `json:"grid_id"`
+}
+
+// legacyGridIDMap reproduces the coordinate-formatted IDs of earlier
+// releases, walking the grid the way they did.
+func (ep *EdgeProcessor) legacyGridIDMap() []GridIDMapping {
+	g := ep.gridLayout()
+	out := make([]GridIDMapping, 0, g.rows*g.cols)
+	r := 0
+	for lat := g.minLat; lat <= g.maxLat; lat += g.latStep {
+		c := 0
+		for lon := g.minLon; lon <= g.maxLon; lon += g.lonStep {
+			out = append(out, GridIDMapping{
+				LegacyGridID: fmt.Sprintf("%s_%.5f_%.5f", ep.config.FieldID, lat, lon),
+				GridID:       ep.generateGridID(gridPoint{Row: r, Col: c}),
+			})
+			c++
+		}
+		r++
+	}
+	return out
+}
+
+// migrateLocalGridIDs rewrites legacy IDs in the local trend history.
+func (ep *EdgeProcessor) migrateLocalGridIDs() error {
+	if ep.config.LogicalGrid != nil {
+		return nil
+	}
+	var legacy int
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(*) FROM grid_history WHERE field_id = ? AND grid_id NOT LIKE ? ESCAPE '\'
+	`, ep.config.FieldID, escapeLike(ep.config.FieldID)+`\_r%`).Scan(&legacy); err != nil {
+		return err
+	}
+	if legacy == 0 {
+		return nil
+	}
+
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range ep.legacyGridIDMap() {
+		if _, err := tx.Exec(`UPDATE grid_history SET grid_id = ? WHERE field_id = ? AND grid_id = ?`,
+			m.GridID, ep.config.FieldID, m.LegacyGridID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ep.logger.Info("Migrated local grid history to stable cell IDs", "component", "trends", "rows", legacy)
+	return nil
+}
+
+// MigrateCloudGridIDs publishes the legacy ID mapping and rewrites the
+// field's cloud cells to stable IDs. Returns the rows rewritten.
+func (ep *EdgeProcessor) MigrateCloudGridIDs() (int64, error) {
+	if ep.config.LogicalGrid != nil {
+		return 0, fmt.Errorf("logical grids already use stable IDs")
+	}
+	db := ep.cloud.DB()
+	if db == nil {
+		return 0, fmt.Errorf("cloud database unavailable")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin grid ID migration: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO grid_id_map (field_id, legacy_grid_id, grid_id) VALUES ($1, $2, $3)
+		ON CONFLICT (field_id, legacy_grid_id) DO UPDATE SET grid_id = EXCLUDED.grid_id
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare grid ID mapping: %v", err)
+	}
+	defer stmt.Close()
+	for _, m := range ep.legacyGridIDMap() {
+		if _, err := stmt.Exec(ep.config.FieldID, m.LegacyGridID, m.GridID); err != nil {
+			return 0, fmt.Errorf("failed to insert grid ID mapping: %v", err)
+		}
+	}
+
+	res, err := tx.Exec(`
+		UPDATE `+cloudGridTable+` g SET grid_id = m.grid_id
+		FROM grid_id_map m
+		WHERE g.field_id = $1 AND m.field_id = g.field_id AND m.legacy_grid_id = g.grid_id
+	`, ep.config.FieldID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite cloud grid IDs: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit grid ID migration: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// escapeLike escapes LIKE wildcards in s (with \ as the escape).
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
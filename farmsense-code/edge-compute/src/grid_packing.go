@@ -0,0 +1,656 @@
+// Grid Packing - compressed local grid history
+// A row per cell per cycle with seven float64 layers is ~100 MB a month
+// for a 1,200-cell field at 15-minute cycles. grid_history_format packed
+// stores each cycle as one row of grid_history_packed instead, the cells
+// encoded as:
+//
+//   - per-layer quantization at the compact sync format's precision
+//     (sync_encoding.go): moisture ×1e4, temperature ×1e2, deficit ×1e1,
+//     trend rates ×1e2, hours to refill ×1e1, quality flags as is
+//   - each value as a varint delta against the same cell in the previous
+//     cycle, which between two cycles is mostly zero
+//   - grid IDs only when the cycle's cells differ from the previous one's
+//   - zstd over the frame
+//
+// A chain starts with a keyframe (no previous cycle) and runs for up to
+// packChainLength cycles, so decoding any cycle replays at most a day of
+// frames. Recomputing a cycle (backfill) re-encodes its chain, and
+// retention drops whole chains, so up to a chain older than
+// trend_retention_days is kept. Every history reader (trends, trend
+// layers, export, tiles, backfill, status) decodes transparently; only
+// the stored precision differs from the rows format, which keeps full
+// float64.
+//
+// Changing grid_history_format converts the field's existing history at
+// the next start.
+//
+// Frame (before zstd):
+//
+//	version byte, flags byte (1 = grid IDs follow), uvarint cell count,
+//	[uvarint length + grid ID]... when flagged, sorted by grid ID,
+//	then per layer in exportVariables order plus quality_flags, a varint
+//	per cell: the quantized value (0 = no value, else q<<1|1) minus the
+//	previous cycle's for that cell (0 when it had none)
+
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Grid history formats
+const (
+	GridHistoryRows   = "rows"
+	GridHistoryPacked = "packed"
+)
+
+const (
+	packFormatVersion = 1
+	packChainLength   = 96 // cycles per keyframe, a day at 15 minutes
+	packFlagGridIDs   = 1
+	packLayers        = 8 // exportVariables + quality_flags
+)
+
+// packScales quantize the exportVariables layers.
+var packScales = []float64{scaleMoisture, scaleMoisture, scaleTemp, scaleDeficit,
+	scaleRate, scaleRate, scaleHours}
+
+var (
+	packCodecOnce sync.Once
+	packEncoder   *zstd.Encoder
+	packDecoder   *zstd.Decoder
+)
+
+func packCodec() (*zstd.Encoder, *zstd.Decoder) {
+	packCodecOnce.Do(func() {
+		packEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		packDecoder, _ = zstd.NewReader(nil)
+	})
+	return packEncoder, packDecoder
+}
+
+func validGridHistoryFormat(format string) bool {
+	return format == "" || format == GridHistoryRows || format == GridHistoryPacked
+}
+
+func (ep *EdgeProcessor) packedHistory() bool {
+	return ep.config.GridHistoryFormat == GridHistoryPacked
+}
+
+// historyTable is the table holding the field's grid history, for
+// queries on field_id and timestamp alone.
+func (ep *EdgeProcessor) historyTable() string {
+	if ep.packedHistory() {
+		return "grid_history_packed"
+	}
+	return "grid_history"
+}
+
+// historyCycle is one recorded cycle.
+type historyCycle struct {
+	at      time.Time
+	batchID string
+	cells   []historyCell // sorted by grid ID
+}
+
+// packedTail is the last cycle written, so appends don't decode the chain.
+type packedTail struct {
+	cycle    historyCycle
+	keyframe int64
+	frames   int
+}
+
+func initPackedHistorySchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS grid_history_packed (
+			field_id  TEXT    NOT NULL,
+			timestamp INTEGER NOT NULL,
+			keyframe  INTEGER NOT NULL,
+			batch_id  TEXT,
+			cells     INTEGER NOT NULL,
+			data      BLOB    NOT NULL,
+			PRIMARY KEY (field_id, timestamp)
+		);
+	`)
+	return err
+}
+
+// historyCycleOf turns a cycle's points into history cells.
+func historyCycleOf(at time.Time, points []VirtualGridPoint) historyCycle {
+	c := historyCycle{at: at, cells: make([]historyCell, 0, len(points))}
+	layer := func(v *float64) float64 {
+		if v == nil {
+			return math.NaN()
+		}
+		return *v
+	}
+	for _, p := range points {
+		if c.batchID == "" {
+			c.batchID = p.BatchID
+		}
+		c.cells = append(c.cells, historyCell{
+			GridID:    p.GridID,
+			Timestamp: at,
+			Values: [7]float64{p.MoistureSurface, p.MoistureRoot, p.Temperature, p.WaterDeficit,
+				layer(p.DrydownRate), layer(p.TempTrend), layer(p.HoursToRefill)},
+			Flags: p.QualityFlags,
+		})
+	}
+	sort.Slice(c.cells, func(i, j int) bool { return c.cells[i].GridID < c.cells[j].GridID })
+	return c
+}
+
+// packValue quantizes one layer of a cell.
+func packValue(c historyCell, layer int) int64 {
+	if layer == len(exportVariables) {
+		return int64(c.Flags)
+	}
+	v := c.Values[layer]
+	if math.IsNaN(v) {
+		return 0
+	}
+	return fixed(v, packScales[layer])<<1 | 1
+}
+
+func unpackValue(c *historyCell, layer int, q int64) {
+	switch {
+	case layer == len(exportVariables):
+		c.Flags = QualityFlags(q)
+	case q == 0:
+		c.Values[layer] = math.NaN()
+	default:
+		c.Values[layer] = float64(q>>1) / packScales[layer]
+	}
+}
+
+// previousIndex maps each cell to its index in prev, or -1.
+func previousIndex(cells []historyCell, prev *historyCycle) ([]int, bool) {
+	idx := make([]int, len(cells))
+	same := prev != nil && len(prev.cells) == len(cells)
+	for i := range cells {
+		idx[i] = -1
+		if same && prev.cells[i].GridID != cells[i].GridID {
+			same = false
+		}
+	}
+	if same {
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx, true
+	}
+	if prev != nil {
+		at := make(map[string]int, len(prev.cells))
+		for i, p := range prev.cells {
+			at[p.GridID] = i
+		}
+		for i, c := range cells {
+			if j, ok := at[c.GridID]; ok {
+				idx[i] = j
+			}
+		}
+	}
+	return idx, false
+}
+
+// encodePackedFrame encodes c against prev (nil for a keyframe).
+func encodePackedFrame(c historyCycle, prev *historyCycle) []byte {
+	idx, same := previousIndex(c.cells, prev)
+	var flags byte
+	if !same {
+		flags |= packFlagGridIDs
+	}
+	b := []byte{packFormatVersion, flags}
+	b = binary.AppendUvarint(b, uint64(len(c.cells)))
+	if !same {
+		for _, cell := range c.cells {
+			b = binary.AppendUvarint(b, uint64(len(cell.GridID)))
+			b = append(b, cell.GridID...)
+		}
+	}
+	for layer := 0; layer < packLayers; layer++ {
+		for i, cell := range c.cells {
+			var base int64
+			if idx[i] >= 0 {
+				base = packValue(prev.cells[idx[i]], layer)
+			}
+			b = binary.AppendVarint(b, packValue(cell, layer)-base)
+		}
+	}
+	enc, _ := packCodec()
+	return enc.EncodeAll(b, nil)
+}
+
+// decodePackedFrame decodes a frame recorded at at against prev.
+func decodePackedFrame(data []byte, at time.Time, prev *historyCycle) (historyCycle, error) {
+	_, dec := packCodec()
+	b, err := dec.DecodeAll(data, nil)
+	if err != nil {
+		return historyCycle{}, fmt.Errorf("failed to decompress grid frame: %v", err)
+	}
+	if len(b) < 2 || b[0] != packFormatVersion {
+		return historyCycle{}, fmt.Errorf("unknown grid frame version")
+	}
+	flags, pos := b[1], 2
+	uvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(b[pos:])
+		pos += n
+		return v, n > 0
+	}
+	n, ok := uvarint()
+	if !ok || n > uint64(len(b)) {
+		return historyCycle{}, fmt.Errorf("corrupt grid frame header")
+	}
+
+	c := historyCycle{at: at, cells: make([]historyCell, n)}
+	switch {
+	case flags&packFlagGridIDs != 0:
+		for i := range c.cells {
+			l, ok := uvarint()
+			if !ok || pos+int(l) > len(b) {
+				return historyCycle{}, fmt.Errorf("corrupt grid frame IDs")
+			}
+			c.cells[i].GridID = string(b[pos : pos+int(l)])
+			pos += int(l)
+		}
+	case prev == nil || len(prev.cells) != len(c.cells):
+		return historyCycle{}, fmt.Errorf("grid frame refers to a missing previous cycle")
+	default:
+		for i := range c.cells {
+			c.cells[i].GridID = prev.cells[i].GridID
+		}
+	}
+	idx, _ := previousIndex(c.cells, prev)
+	for layer := 0; layer < packLayers; layer++ {
+		for i := range c.cells {
+			d, m := binary.Varint(b[pos:])
+			if m <= 0 {
+				return historyCycle{}, fmt.Errorf("corrupt grid frame values")
+			}
+			pos += m
+			if idx[i] >= 0 {
+				d += packValue(prev.cells[idx[i]], layer)
+			}
+			unpackValue(&c.cells[i], layer, d)
+		}
+	}
+	for i := range c.cells {
+		c.cells[i].Timestamp = at
+	}
+	return c, nil
+}
+
+// eachPackedCycle decodes the field's packed cycles with timestamps in
+// [from, to], oldest first, replaying each chain from its keyframe.
+func (ep *EdgeProcessor) eachPackedCycle(from, to int64, fn func(historyCycle) error) error {
+	rows, err := ep.localDB.Query(`
+		SELECT timestamp, keyframe, COALESCE(batch_id, ''), data FROM grid_history_packed
+		WHERE field_id = ? AND timestamp <= ? AND timestamp >= COALESCE((
+			SELECT MAX(keyframe) FROM grid_history_packed WHERE field_id = ? AND keyframe <= ?
+		), ?)
+		ORDER BY timestamp
+	`, ep.config.FieldID, to, ep.config.FieldID, from, from)
+	if err != nil {
+		return fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+
+	var prev *historyCycle
+	for rows.Next() {
+		var ts, keyframe int64
+		var batchID string
+		var data []byte
+		if err := rows.Scan(&ts, &keyframe, &batchID, &data); err != nil {
+			return fmt.Errorf("failed to read grid history: %v", err)
+		}
+		if ts == keyframe {
+			prev = nil
+		}
+		c, err := decodePackedFrame(data, time.Unix(ts, 0).UTC(), prev)
+		if err != nil {
+			return fmt.Errorf("grid history at %d: %v", ts, err)
+		}
+		c.batchID = batchID
+		prev = &c
+		if ts >= from {
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// packedRecentCycles is fetchRecentCycles over packed history.
+func (ep *EdgeProcessor) packedRecentCycles(n int, cycleAt time.Time) (map[string][]trendSample, error) {
+	before := cycleAt.Unix()
+	var first sql.NullInt64
+	if err := ep.localDB.QueryRow(`
+		SELECT MIN(timestamp) FROM (
+			SELECT timestamp FROM grid_history_packed
+			WHERE field_id = ? AND timestamp < ?
+			ORDER BY timestamp DESC
+			LIMIT ?
+		)
+	`, ep.config.FieldID, before, n).Scan(&first); err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	byCell := make(map[string][]trendSample)
+	if !first.Valid {
+		return byCell, nil
+	}
+	from := first.Int64
+	if earliest := cycleAt.Add(-trendLayerMaxSpan).Unix(); earliest > from {
+		from = earliest
+	}
+	err := ep.eachPackedCycle(from, before-1, func(c historyCycle) error {
+		for _, cell := range c.cells {
+			byCell[cell.GridID] = append(byCell[cell.GridID], trendSample{at: c.at, root: cell.Values[1], temp: cell.Values[2]})
+		}
+		return nil
+	})
+	return byCell, err
+}
+
+// appendPackedCycle records a cycle after the field's last one; anything
+// else goes through replacePackedCycle.
+func (ep *EdgeProcessor) appendPackedCycle(c historyCycle) error {
+	tail, err := ep.loadPackedTail()
+	if err != nil {
+		return err
+	}
+	if tail != nil && !c.at.After(tail.cycle.at) {
+		return ep.replacePackedCycle(c)
+	}
+	var prev *historyCycle
+	keyframe := c.at.Unix()
+	if tail != nil && tail.frames < packChainLength {
+		prev, keyframe = &tail.cycle, tail.keyframe
+	}
+	if _, err := ep.localDB.Exec(`
+		INSERT INTO grid_history_packed (field_id, timestamp, keyframe, batch_id, cells, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ep.config.FieldID, c.at.Unix(), keyframe, nullString(c.batchID), len(c.cells),
+		encodePackedFrame(c, prev)); err != nil {
+		return fmt.Errorf("failed to insert grid history: %v", err)
+	}
+	frames := 1
+	if prev != nil {
+		frames = tail.frames + 1
+	}
+	ep.packTail = &packedTail{cycle: c, keyframe: keyframe, frames: frames}
+	return nil
+}
+
+// loadPackedTail returns the last cycle written, decoding it after a
+// restart; nil when the field has no packed history.
+func (ep *EdgeProcessor) loadPackedTail() (*packedTail, error) {
+	if ep.packTail != nil {
+		return ep.packTail, nil
+	}
+	var last, keyframe sql.NullInt64
+	if err := ep.localDB.QueryRow(`
+		SELECT MAX(timestamp), MAX(keyframe) FROM grid_history_packed WHERE field_id = ?
+	`, ep.config.FieldID).Scan(&last, &keyframe); err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	if !last.Valid {
+		return nil, nil
+	}
+	tail := &packedTail{keyframe: keyframe.Int64}
+	err := ep.eachPackedCycle(last.Int64, last.Int64, func(c historyCycle) error {
+		tail.cycle = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ep.localDB.QueryRow(`
+		SELECT COUNT(*) FROM grid_history_packed WHERE field_id = ? AND keyframe = ?
+	`, ep.config.FieldID, tail.keyframe).Scan(&tail.frames); err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	ep.packTail = tail
+	return tail, nil
+}
+
+// prunePackedHistory drops chains that end before the cutoff: everything
+// older than the last keyframe at or before it.
+func (ep *EdgeProcessor) prunePackedHistory(cutoff int64) (sql.Result, error) {
+	res, err := ep.localDB.Exec(`
+		DELETE FROM grid_history_packed WHERE field_id = ? AND keyframe < (
+			SELECT MAX(keyframe) FROM grid_history_packed WHERE field_id = ? AND keyframe <= ?
+		)
+	`, ep.config.FieldID, ep.config.FieldID, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune grid history: %v", err)
+	}
+	return res, nil
+}
+
+// replacePackedCycle swaps the cycle at c.at (adding it if there was none,
+// dropping it if c has no cells) and re-encodes the chain it falls in.
+func (ep *EdgeProcessor) replacePackedCycle(c historyCycle) error {
+	at := c.at.Unix()
+	var keyframe sql.NullInt64
+	if err := ep.localDB.QueryRow(`
+		SELECT MAX(keyframe) FROM grid_history_packed WHERE field_id = ? AND keyframe <= ?
+	`, ep.config.FieldID, at).Scan(&keyframe); err != nil {
+		return fmt.Errorf("failed to query grid history: %v", err)
+	}
+
+	chain := make([]historyCycle, 0)
+	if keyframe.Valid {
+		var next sql.NullInt64
+		if err := ep.localDB.QueryRow(`
+			SELECT MIN(keyframe) FROM grid_history_packed WHERE field_id = ? AND keyframe > ?
+		`, ep.config.FieldID, keyframe.Int64).Scan(&next); err != nil {
+			return fmt.Errorf("failed to query grid history: %v", err)
+		}
+		end := int64(math.MaxInt64)
+		if next.Valid {
+			end = next.Int64 - 1
+		}
+		err := ep.eachPackedCycle(keyframe.Int64, end, func(old historyCycle) error {
+			if old.at.Unix() != at {
+				chain = append(chain, old)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.cells) > 0 {
+		chain = append(chain, c)
+		sort.Slice(chain, func(i, j int) bool { return chain[i].at.Before(chain[j].at) })
+	}
+
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin grid history rewrite: %v", err)
+	}
+	defer tx.Rollback()
+	if keyframe.Valid {
+		if _, err := tx.Exec(`DELETE FROM grid_history_packed WHERE field_id = ? AND keyframe = ?`,
+			ep.config.FieldID, keyframe.Int64); err != nil {
+			return fmt.Errorf("failed to clear grid history: %v", err)
+		}
+	}
+	var prev *historyCycle
+	for i := range chain {
+		if _, err := tx.Exec(`
+			INSERT INTO grid_history_packed (field_id, timestamp, keyframe, batch_id, cells, data)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, ep.config.FieldID, chain[i].at.Unix(), chain[0].at.Unix(), nullString(chain[i].batchID),
+			len(chain[i].cells), encodePackedFrame(chain[i], prev)); err != nil {
+			return fmt.Errorf("failed to insert grid history: %v", err)
+		}
+		prev = &chain[i]
+	}
+	ep.packTail = nil
+	return tx.Commit()
+}
+
+// convertGridHistory moves the field's local history into the configured
+// grid_history_format, a cycle (rows to packed) or chain (packed to rows)
+// at a time, so an interrupted conversion resumes at the next start.
+func (ep *EdgeProcessor) convertGridHistory() error {
+	if err := initPackedHistorySchema(ep.localDB); err != nil {
+		return err
+	}
+	if ep.packedHistory() {
+		return ep.packRowHistory()
+	}
+	return ep.unpackHistory()
+}
+
+func (ep *EdgeProcessor) packRowHistory() error {
+	stamps, err := ep.localInt64s(`SELECT DISTINCT timestamp FROM grid_history WHERE field_id = ? ORDER BY timestamp`)
+	if err != nil {
+		return err
+	}
+	for _, ts := range stamps {
+		c, err := ep.rowHistoryCycle(ts)
+		if err != nil {
+			return err
+		}
+		if err := ep.appendPackedCycle(c); err != nil {
+			return err
+		}
+		if _, err := ep.localDB.Exec(`DELETE FROM grid_history WHERE field_id = ? AND timestamp = ?`,
+			ep.config.FieldID, ts); err != nil {
+			return fmt.Errorf("failed to clear grid history: %v", err)
+		}
+	}
+	if len(stamps) > 0 {
+		ep.logger.Info("Packed local grid history", "component", "trends", "cycles", len(stamps))
+	}
+	return nil
+}
+
+// rowHistoryCycle reads one cycle from the rows format.
+func (ep *EdgeProcessor) rowHistoryCycle(ts int64) (historyCycle, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT grid_id, moisture_surface, moisture_root, temperature, water_deficit_mm,
+			drydown_rate_mm_day, temp_trend_c_day, hours_to_refill, COALESCE(quality_flags, 0),
+			COALESCE(batch_id, '')
+		FROM grid_history
+		WHERE field_id = ? AND timestamp = ?
+		ORDER BY grid_id
+	`, ep.config.FieldID, ts)
+	if err != nil {
+		return historyCycle{}, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+
+	c := historyCycle{at: time.Unix(ts, 0).UTC()}
+	for rows.Next() {
+		cell := historyCell{Timestamp: c.at}
+		var layers [3]sql.NullFloat64
+		var batchID string
+		if err := rows.Scan(&cell.GridID, &cell.Values[0], &cell.Values[1], &cell.Values[2], &cell.Values[3],
+			&layers[0], &layers[1], &layers[2], &cell.Flags, &batchID); err != nil {
+			return historyCycle{}, fmt.Errorf("failed to read grid history: %v", err)
+		}
+		for i, l := range layers {
+			cell.Values[4+i] = math.NaN()
+			if l.Valid {
+				cell.Values[4+i] = l.Float64
+			}
+		}
+		if c.batchID == "" {
+			c.batchID = batchID
+		}
+		c.cells = append(c.cells, cell)
+	}
+	return c, rows.Err()
+}
+
+func (ep *EdgeProcessor) unpackHistory() error {
+	keyframes, err := ep.localInt64s(`SELECT DISTINCT keyframe FROM grid_history_packed WHERE field_id = ? ORDER BY keyframe`)
+	if err != nil {
+		return err
+	}
+	for i, kf := range keyframes {
+		end := int64(math.MaxInt64)
+		if i+1 < len(keyframes) {
+			end = keyframes[i+1] - 1
+		}
+		var chain []historyCycle
+		if err := ep.eachPackedCycle(kf, end, func(c historyCycle) error {
+			chain = append(chain, c)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, c := range chain {
+			if err := ep.appendTrendHistory(historyPoints(ep.config.FieldID, c)); err != nil {
+				return err
+			}
+		}
+		if _, err := ep.localDB.Exec(`DELETE FROM grid_history_packed WHERE field_id = ? AND keyframe = ?`,
+			ep.config.FieldID, kf); err != nil {
+			return fmt.Errorf("failed to clear grid history: %v", err)
+		}
+	}
+	if len(keyframes) > 0 {
+		ep.logger.Info("Unpacked local grid history", "component", "trends", "chains", len(keyframes))
+	}
+	return nil
+}
+
+// historyPoints turns a decoded cycle back into the points the rows
+// format stores.
+func historyPoints(fieldID string, c historyCycle) []VirtualGridPoint {
+	layer := func(v float64) *float64 {
+		if math.IsNaN(v) {
+			return nil
+		}
+		return &v
+	}
+	points := make([]VirtualGridPoint, len(c.cells))
+	for i, cell := range c.cells {
+		points[i] = VirtualGridPoint{
+			GridID:          cell.GridID,
+			FieldID:         fieldID,
+			Timestamp:       c.at,
+			MoistureSurface: cell.Values[0],
+			MoistureRoot:    cell.Values[1],
+			Temperature:     cell.Values[2],
+			WaterDeficit:    cell.Values[3],
+			DrydownRate:     layer(cell.Values[4]),
+			TempTrend:       layer(cell.Values[5]),
+			HoursToRefill:   layer(cell.Values[6]),
+			QualityFlags:    cell.Flags,
+			BatchID:         c.batchID,
+		}
+	}
+	return points
+}
+
+// localInt64s runs a single-column query on the field.
+func (ep *EdgeProcessor) localInt64s(query string) ([]int64, error) {
+	rows, err := ep.localDB.Query(query, ep.config.FieldID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+	out := make([]int64, 0)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("failed to read grid history: %v", err)
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
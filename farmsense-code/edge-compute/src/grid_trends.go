@@ -0,0 +1,321 @@
+// Grid Trends - per-cell moisture history and drydown curves
+// Every computed cell is appended to a history table in the local cache so
+// agronomists can see trajectories, not just the latest snapshot. For one
+// cell the drydown curve is the run of samples since its last wetting
+// event (irrigation or rain shows up as a moisture rise). Root-zone
+// moisture over that run is fitted with a simple exponential decay,
+// θ(t) = θ0 · e^(−k·t), by least squares on ln θ, and extrapolated to the
+// wilting point to estimate days until the crop starts to wilt.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	defaultTrendRetentionDays = 90
+	defaultTrendWindow        = 7 * 24 * time.Hour
+	trendPruneInterval        = time.Hour
+	drydownWettingRiseVWC     = 0.01 // rise that marks a wetting event
+	drydownMinSamples         = 4
+	drydownMaxDaysToWilting   = 60.0 // beyond this the fit says "not soon"
+)
+
+// DrydownSample is one cycle's moisture for a cell.
+type DrydownSample struct {
+	Timestamp       time.Time `json:"timestamp"`
+	MoistureSurface float64   `json:"moisture_surface"`
+	MoistureRoot    float64   `json:"moisture_root"`
+}
+
+// DrydownCurve is a cell's moisture trajectory and the fitted decay.
+type DrydownCurve struct {
+	GridID           string          `json:"grid_id"`
+	Samples          []DrydownSample `json:"samples,omitempty"`
+	DrydownStart     time.Time       `json:"drydown_start"`
+	DrydownSamples   int             `json:"drydown_samples"`
+	DecayPerDay      float64         `json:"decay_per_day"` // k in θ0·e^(−k·t)
+	FitR2            float64         `json:"fit_r2"`
+	CurrentVWC       float64         `json:"current_vwc"`
+	WiltingPointVWC  float64         `json:"wilting_point_vwc"`
+	DaysUntilWilting *float64        `json:"days_until_wilting"` // nil = not drying or too few samples
+}
+
+// initTrendSchema creates the history table in the local cache.
+func (ep *EdgeProcessor) initTrendSchema() error {
+	_, err := ep.localDB.Exec(`
+		CREATE TABLE IF NOT EXISTS grid_history (
+			field_id         TEXT    NOT NULL,
+			grid_id          TEXT    NOT NULL,
+			timestamp        INTEGER NOT NULL,
+			moisture_surface REAL,
+			moisture_root    REAL,
+			temperature      REAL,
+			water_deficit_mm REAL
+		);
+		CREATE INDEX IF NOT EXISTS grid_history_cell ON grid_history (field_id, grid_id, timestamp);
+	`)
+	if err != nil {
+		return err
+	}
+	for _, col := range []string{"drydown_rate_mm_day", "temp_trend_c_day", "hours_to_refill"} {
+		if err := ensureLocalColumn(ep.localDB, "grid_history", col, "REAL"); err != nil {
+			return err
+		}
+	}
+	return ensureLocalColumn(ep.localDB, "grid_history", "quality_flags", "INTEGER")
+}
+
+// appendTrendHistory adds one cycle's cells to the history table.
+func (ep *EdgeProcessor) appendTrendHistory(points []VirtualGridPoint) error {
+	if ep.packedHistory() {
+		if len(points) == 0 {
+			return nil
+		}
+		return ep.appendPackedCycle(historyCycleOf(points[0].Timestamp, points))
+	}
+	return ep.writeHistoryRows(points, nil)
+}
+
+// writeHistoryRows inserts points into grid_history in one transaction,
+// first clearing the cycle at replace unless it is nil.
+func (ep *EdgeProcessor) writeHistoryRows(points []VirtualGridPoint, replace *time.Time) error {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin history insert: %v", err)
+	}
+	if replace != nil {
+		if _, err := tx.Exec(`DELETE FROM grid_history WHERE field_id = ? AND timestamp = ?`,
+			ep.config.FieldID, replace.Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to clear grid history: %v", err)
+		}
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO grid_history (field_id, grid_id, timestamp, moisture_surface, moisture_root, temperature,
+			water_deficit_mm, batch_id, drydown_rate_mm_day, temp_trend_c_day, hours_to_refill, quality_flags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prepare history insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, p := range points {
+		if _, err := stmt.Exec(p.FieldID, p.GridID, p.Timestamp.Unix(),
+			p.MoistureSurface, p.MoistureRoot, p.Temperature, p.WaterDeficit, nullString(p.BatchID),
+			p.DrydownRate, p.TempTrend, p.HoursToRefill, int64(p.QualityFlags)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert history for %s: %v", p.GridID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// maybePruneTrendHistory drops history past the retention window.
+func (ep *EdgeProcessor) maybePruneTrendHistory() {
+	now := time.Now()
+	if now.Sub(ep.lastTrendPrune) < trendPruneInterval {
+		return
+	}
+	ep.lastTrendPrune = now
+
+	days := ep.retentionDays(ep.config.TrendRetentionDays, defaultTrendRetentionDays)
+	cutoff := now.AddDate(0, 0, -days).Unix()
+	var res sql.Result
+	var err error
+	if ep.packedHistory() {
+		res, err = ep.prunePackedHistory(cutoff)
+	} else {
+		res, err = ep.localDB.Exec(`DELETE FROM grid_history WHERE field_id = ? AND timestamp < ?`, ep.config.FieldID, cutoff)
+	}
+	if err != nil {
+		ep.logger.Error("Failed to prune grid history", "component", "trends", "error", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		ep.logger.Debug("Pruned grid history", "component", "trends", "rows", n)
+	}
+	ep.pruneGridBatches(cutoff)
+
+	zoneCutoff := now.AddDate(0, 0, -ep.retentionDays(ep.config.ZoneRetentionDays, defaultZoneRetentionDays)).Unix()
+	if _, err := ep.localDB.Exec(`DELETE FROM zone_stats WHERE field_id = ? AND timestamp < ?`, ep.config.FieldID, zoneCutoff); err != nil {
+		ep.logger.Error("Failed to prune zone stats", "component", "zones", "error", err)
+	}
+}
+
+// fetchTrendSamples returns the field's history since a cutoff, per cell
+// and oldest first. gridID narrows it to one cell.
+func (ep *EdgeProcessor) fetchTrendSamples(gridID string, since time.Time) (map[string][]DrydownSample, error) {
+	if ep.packedHistory() {
+		byCell := make(map[string][]DrydownSample)
+		err := ep.eachPackedCycle(since.Unix(), math.MaxInt64, func(c historyCycle) error {
+			for _, cell := range c.cells {
+				if gridID == "" || cell.GridID == gridID {
+					byCell[cell.GridID] = append(byCell[cell.GridID], DrydownSample{Timestamp: c.at,
+						MoistureSurface: cell.Values[0], MoistureRoot: cell.Values[1]})
+				}
+			}
+			return nil
+		})
+		return byCell, err
+	}
+	query := `
+		SELECT grid_id, timestamp, moisture_surface, moisture_root
+		FROM grid_history
+		WHERE field_id = ?
+		  AND timestamp >= ?
+		  AND (? = '' OR grid_id = ?)
+		ORDER BY grid_id, timestamp
+	`
+	rows, err := ep.localDB.Query(query, ep.config.FieldID, since.Unix(), gridID, gridID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byCell := make(map[string][]DrydownSample)
+	for rows.Next() {
+		var id string
+		var ts int64
+		var s DrydownSample
+		if err := rows.Scan(&id, &ts, &s.MoistureSurface, &s.MoistureRoot); err != nil {
+			return nil, err
+		}
+		s.Timestamp = time.Unix(ts, 0).UTC()
+		byCell[id] = append(byCell[id], s)
+	}
+	return byCell, rows.Err()
+}
+
+// drydownStartIndex finds the first sample after the last wetting event.
+func drydownStartIndex(samples []DrydownSample) int {
+	for i := len(samples) - 1; i > 0; i-- {
+		if samples[i].MoistureRoot-samples[i-1].MoistureRoot >= drydownWettingRiseVWC {
+			return i
+		}
+	}
+	return 0
+}
+
+// fitDrydown fits ln θ = a − k·t over samples and returns k (per day),
+// R² of the log fit and the fitted θ at the last sample.
+func fitDrydown(samples []DrydownSample) (float64, float64, float64, bool) {
+	t0 := samples[0].Timestamp
+	n := 0.0
+	var sumT, sumY, sumTT, sumTY float64
+	ys := make([]float64, 0, len(samples))
+	ts := make([]float64, 0, len(samples))
+	for _, s := range samples {
+		if s.MoistureRoot <= 0 {
+			continue
+		}
+		t := s.Timestamp.Sub(t0).Hours() / 24
+		y := math.Log(s.MoistureRoot)
+		ts, ys = append(ts, t), append(ys, y)
+		n++
+		sumT += t
+		sumY += y
+		sumTT += t * t
+		sumTY += t * y
+	}
+	denom := n*sumTT - sumT*sumT
+	if n < drydownMinSamples || denom <= 0 {
+		return 0, 0, 0, false
+	}
+	slope := (n*sumTY - sumT*sumY) / denom
+	intercept := (sumY - slope*sumT) / n
+
+	meanY := sumY / n
+	var ssRes, ssTot float64
+	for i := range ys {
+		pred := intercept + slope*ts[i]
+		ssRes += (ys[i] - pred) * (ys[i] - pred)
+		ssTot += (ys[i] - meanY) * (ys[i] - meanY)
+	}
+	r2 := 0.0
+	if ssTot > 0 {
+		r2 = 1 - ssRes/ssTot
+	}
+	current := math.Exp(intercept + slope*ts[len(ts)-1])
+	return -slope, r2, current, true
+}
+
+// drydownCurve fits a cell's samples (oldest first).
+func drydownCurve(gridID string, samples []DrydownSample) DrydownCurve {
+	curve := DrydownCurve{GridID: gridID, Samples: samples, WiltingPointVWC: wiltingPointVWC}
+	if len(samples) == 0 {
+		return curve
+	}
+	curve.CurrentVWC = samples[len(samples)-1].MoistureRoot
+
+	run := samples[drydownStartIndex(samples):]
+	curve.DrydownStart = run[0].Timestamp
+	curve.DrydownSamples = len(run)
+
+	k, r2, current, ok := fitDrydown(run)
+	if !ok {
+		return curve
+	}
+	curve.DecayPerDay = k
+	curve.FitR2 = r2
+	if k <= 0 {
+		return curve
+	}
+	days := 0.0
+	if current > wiltingPointVWC {
+		days = math.Log(current/wiltingPointVWC) / k
+	}
+	if days <= drydownMaxDaysToWilting {
+		curve.DaysUntilWilting = &days
+	}
+	return curve
+}
+
+// DrydownCurve returns one cell's moisture history over window and its fit.
+func (ep *EdgeProcessor) DrydownCurve(gridID string, window time.Duration) (DrydownCurve, error) {
+	if window <= 0 {
+		window = defaultTrendWindow
+	}
+	byCell, err := ep.fetchTrendSamples(gridID, time.Now().Add(-window))
+	if err != nil {
+		return DrydownCurve{}, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	return drydownCurve(gridID, byCell[gridID]), nil
+}
+
+// WiltingOutlook fits every cell over window and returns the curves
+// (without samples) soonest-to-wilt first.
+func (ep *EdgeProcessor) WiltingOutlook(window time.Duration) ([]DrydownCurve, error) {
+	if window <= 0 {
+		window = defaultTrendWindow
+	}
+	byCell, err := ep.fetchTrendSamples("", time.Now().Add(-window))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+
+	out := make([]DrydownCurve, 0, len(byCell))
+	for id, samples := range byCell {
+		curve := drydownCurve(id, samples)
+		curve.Samples = nil
+		out = append(out, curve)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].DaysUntilWilting, out[j].DaysUntilWilting
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && *a != *b {
+			return *a < *b
+		}
+		return out[i].GridID < out[j].GridID
+	})
+	return out, nil
+}
@@ -0,0 +1,118 @@
+// Edge Health - liveness/readiness state and systemd watchdog integration
+// The compute loop records a heartbeat on every iteration. The watchdog only
+// pings systemd while that heartbeat is fresh, so a loop stuck on a blocked
+// DB query stops the pings and systemd restarts the process.
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// How often the main loop wakes up just to prove it isn't stuck
+const heartbeatInterval = 10 * time.Second
+
+// HealthState is shared between the compute loop and the HTTP probes.
+type HealthState struct {
+	lastHeartbeat atomic.Int64 // unix nanos, main loop iteration
+	lastCycle     atomic.Int64 // unix nanos, last completed grid computation
+	startedAt     time.Time
+	logger        *slog.Logger
+}
+
+func NewHealthState() *HealthState {
+	h := &HealthState{startedAt: time.Now(), logger: slog.With("component", "health")}
+	h.Beat()
+	return h
+}
+
+// Beat marks the main loop as alive.
+func (h *HealthState) Beat() {
+	h.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// CycleCompleted marks a successful grid computation.
+func (h *HealthState) CycleCompleted() {
+	h.lastCycle.Store(time.Now().UnixNano())
+}
+
+func (h *HealthState) SinceHeartbeat() time.Duration {
+	return time.Since(time.Unix(0, h.lastHeartbeat.Load()))
+}
+
+// LastCycle returns the time of the last completed cycle (zero if none yet).
+func (h *HealthState) LastCycle() time.Time {
+	ns := h.lastCycle.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Alive reports whether the main loop has checked in within maxStall.
+func (h *HealthState) Alive(maxStall time.Duration) bool {
+	return h.SinceHeartbeat() <= maxStall
+}
+
+// sdNotify sends a state string to systemd's notify socket.
+// It is a no-op when not running under systemd (NOTIFY_SOCKET unset).
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract namespace sockets are advertised with a leading '@'
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns half the systemd watchdog timeout, or 0 if the
+// watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// RunWatchdog pings systemd while the main loop heartbeat is fresh.
+// Once the loop stalls for longer than maxStall the pings stop and systemd
+// kills and restarts the service after WatchdogSec.
+func (h *HealthState) RunWatchdog(maxStall time.Duration) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	h.logger.Info("systemd watchdog enabled", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !h.Alive(maxStall) {
+			h.logger.Error("Main loop stalled, withholding watchdog ping", "stalled_for", h.SinceHeartbeat().String())
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			h.logger.Warn("Watchdog ping failed", "error", err)
+		}
+	}
+}
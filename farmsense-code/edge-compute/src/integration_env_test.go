@@ -0,0 +1,383 @@
+//go:build integration
+
+// Integration Environment - dockerized cloud database and broker
+// TestMain starts what a gateway talks to, once for the whole suite, with
+// testcontainers: TimescaleDB with PostGIS as the cloud database, brought
+// up to date by running testdata/integration/000_base_schema.sql (the
+// backend models' tables) and every database/migrations file in order as
+// init scripts, and a Mosquitto broker standing in for the LoRaWAN
+// network server's. FARMSENSE_IT_POSTGRES_IMAGE and
+// FARMSENSE_IT_MQTT_IMAGE override the images.
+//
+// Probes report through a test codec (integrationCodec): surface and root
+// VWC ×10000 and temperature ×100, big-endian int16s, so seeded values
+// survive the uplink exactly. Each test gets its own field, device, local
+// cache and topics, so tests don't see each other's data.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	defaultITPostgresImage = "timescale/timescaledb-ha:pg15"
+	defaultITMQTTImage     = "eclipse-mosquitto:2"
+	integrationCodec       = "integration_probe"
+	itPublishPrefix        = "farmsense-it"
+	itStartupTimeout       = 3 * time.Minute
+	itWaitTimeout          = 30 * time.Second
+)
+
+// itEnv is the running environment, set up by TestMain.
+var itEnv struct {
+	dsn       string // cloud database, as database_url
+	brokerURL string
+	cloud     *sql.DB // the test's own connection, for seeding and assertions
+}
+
+func TestMain(m *testing.M) {
+	// Cloud timestamps are without time zone; gateways run in UTC
+	time.Local = time.UTC
+	RegisterPayloadCodec(integrationCodec, decodeIntegrationProbe)
+	stop, err := startIntegrationEnv(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start integration environment: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// startIntegrationEnv starts the containers and returns a function that
+// stops them.
+func startIntegrationEnv(ctx context.Context) (func(), error) {
+	scripts, err := filepath.Glob("../../database/migrations/*.sql")
+	if err != nil || len(scripts) == 0 {
+		return nil, fmt.Errorf("no migrations found: %v", err)
+	}
+	sort.Strings(scripts)
+	scripts = append([]string{"testdata/integration/000_base_schema.sql"}, scripts...)
+
+	pg, err := tcpostgres.Run(ctx, envOr("FARMSENSE_IT_POSTGRES_IMAGE", defaultITPostgresImage),
+		tcpostgres.WithDatabase("farmsense"),
+		tcpostgres.WithUsername("postgres"),
+		tcpostgres.WithPassword("integration"),
+		tcpostgres.WithInitScripts(scripts...),
+		testcontainers.WithWaitStrategy(wait.ForLog("database system is ready to accept connections").
+			WithOccurrence(2).WithStartupTimeout(itStartupTimeout)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start database: %v", err)
+	}
+	stop := func() { pg.Terminate(context.Background()) }
+
+	broker, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        envOr("FARMSENSE_IT_MQTT_IMAGE", defaultITMQTTImage),
+			ExposedPorts: []string{"1883/tcp"},
+			Cmd:          []string{"mosquitto", "-c", "/mosquitto-no-auth.conf"},
+			WaitingFor:   wait.ForListeningPort("1883/tcp").WithStartupTimeout(itStartupTimeout),
+		},
+		Started: true,
+	})
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to start broker: %v", err)
+	}
+	stop = func() {
+		broker.Terminate(context.Background())
+		pg.Terminate(context.Background())
+	}
+
+	if itEnv.dsn, err = pg.ConnectionString(ctx, "sslmode=disable"); err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to get database address: %v", err)
+	}
+	if itEnv.brokerURL, err = broker.PortEndpoint(ctx, "1883/tcp", "tcp"); err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to get broker address: %v", err)
+	}
+	if itEnv.cloud, err = sql.Open("postgres", itEnv.dsn); err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := itEnv.cloud.PingContext(ctx); err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to reach database: %v", err)
+	}
+	return func() {
+		itEnv.cloud.Close()
+		stop()
+	}, nil
+}
+
+// decodeIntegrationProbe decodes the test codec's 6-byte payload.
+func decodeIntegrationProbe(fPort int, payload []byte) (DecodedUplink, error) {
+	if len(payload) != 6 {
+		return DecodedUplink{}, fmt.Errorf("integration probe payload is %d bytes, want 6", len(payload))
+	}
+	return DecodedUplink{
+		MoistureSurface: float64(int16(binary.BigEndian.Uint16(payload[0:]))) / 10000,
+		MoistureRoot:    float64(int16(binary.BigEndian.Uint16(payload[2:]))) / 10000,
+		TempSurface:     float64(int16(binary.BigEndian.Uint16(payload[4:]))) / 100,
+	}, nil
+}
+
+// itProbe is a seeded probe at a grid node.
+type itProbe struct {
+	devEUI               string
+	row, col             int
+	surface, root, tempC float64 // what it reports
+}
+
+func (p itProbe) payload() []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b[0:], uint16(int16(p.surface*10000+0.5)))
+	binary.BigEndian.PutUint16(b[2:], uint16(int16(p.root*10000+0.5)))
+	binary.BigEndian.PutUint16(b[4:], uint16(int16(p.tempC*100+0.5)))
+	return b
+}
+
+// planeRoot is the seeded root-zone moisture field: a plane over the grid.
+func planeRoot(row, col int) float64 { return 0.20 + 0.003*float64(row) + 0.001*float64(col) }
+
+func planeTemp(col int) float64 { return 18 + 0.05*float64(col) }
+
+// planeProbes lays a 3×3 lattice of probes on the plane, inside the grid
+// so its edge rows and columns are extrapolated.
+func planeProbes(prefix string) []itProbe {
+	probes := make([]itProbe, 0, 9)
+	for i, row := range []int{2, 14, 26} {
+		for j, col := range []int{2, 20, 38} {
+			root := planeRoot(row, col)
+			probes = append(probes, itProbe{
+				devEUI: fmt.Sprintf("%s%02d%02d", prefix, i, j),
+				row:    row, col: col,
+				surface: root - 0.03, root: root, tempC: planeTemp(col),
+			})
+		}
+	}
+	return probes
+}
+
+// newIntegrationProcessor builds a processor for fieldID against the
+// environment, with probes registered as LoRaWAN devices and the field
+// split into west and east management zones. The cloud link isn't
+// checked until connectCloud.
+func newIntegrationProcessor(t *testing.T, fieldID string, probes []itProbe, edit func(*EdgeConfig)) *EdgeProcessor {
+	t.Helper()
+	config := DefaultEdgeConfig()
+	config.FieldID = fieldID
+	config.DeviceID = "it-edge-" + fieldID
+	config.DatabaseURL = itEnv.dsn
+	config.LocalCacheDB = filepath.Join(t.TempDir(), "cache.db")
+	config.TrustSystemClock = true
+	config.SearchRadius = 600
+	config.RBFBasis = RBFThinPlate
+	config.RBFMaxSensors = len(probes) + 1
+	config.MQTTBrokerURL = itEnv.brokerURL
+	config.MQTTPublishPrefix = itPublishPrefix
+
+	g := (&EdgeProcessor{config: config}).gridLayout()
+	split := g.minLon + 20.5*g.lonStep
+	pad := 0.001
+	config.ManagementZones = []ManagementZone{
+		{ZoneID: "west", Boundary: [][2]float64{{g.minLon - pad, g.minLat - pad}, {split, g.minLat - pad},
+			{split, g.maxLat + pad}, {g.minLon - pad, g.maxLat + pad}, {g.minLon - pad, g.minLat - pad}}},
+		{ZoneID: "east", Boundary: [][2]float64{{split, g.minLat - pad}, {g.maxLon + pad, g.minLat - pad},
+			{g.maxLon + pad, g.maxLat + pad}, {split, g.maxLat + pad}, {split, g.minLat - pad}}},
+	}
+	for _, p := range probes {
+		pt := g.point(p.row, p.col)
+		config.LoRaWANDevices = append(config.LoRaWANDevices, LoRaWANDevice{
+			DevEUI: p.devEUI, Codec: integrationCodec, Latitude: pt[1], Longitude: pt[0],
+		})
+	}
+	if edit != nil {
+		edit(&config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	ep, err := NewEdgeProcessor(config, config.DeviceID)
+	if err != nil {
+		t.Fatalf("failed to create processor: %v", err)
+	}
+	t.Cleanup(func() { ep.localDB.Close() })
+	seedField(t, ep)
+	return ep
+}
+
+// seedField records the field and its boundary (the grid's extent) in the
+// cloud.
+func seedField(t *testing.T, ep *EdgeProcessor) {
+	t.Helper()
+	g := ep.gridLayout()
+	boundary := fmt.Sprintf("POLYGON((%[1]f %[3]f, %[2]f %[3]f, %[2]f %[4]f, %[1]f %[4]f, %[1]f %[3]f))",
+		g.minLon, g.maxLon, g.minLat, g.maxLat)
+	if _, err := itEnv.cloud.Exec(`
+		INSERT INTO fields (field_id, farm_id, field_name, boundary)
+		VALUES ($1, 'farm_it', $1, ST_GeomFromText($2, 4326))
+		ON CONFLICT (field_id) DO UPDATE SET boundary = EXCLUDED.boundary
+	`, ep.config.FieldID, boundary); err != nil {
+		t.Fatalf("failed to seed field: %v", err)
+	}
+}
+
+// connectCloud brings the processor's cloud link up now, as the
+// connection manager's first check would.
+func connectCloud(t *testing.T, ep *EdgeProcessor) {
+	t.Helper()
+	if err := ep.cloud.check(); err != nil {
+		t.Fatalf("failed to connect to cloud: %v", err)
+	}
+	if !ep.store.Available() {
+		t.Fatal("cloud store unavailable after connecting")
+	}
+}
+
+// startIngest subscribes the processor's LoRaWAN ingest to the broker.
+func startIngest(t *testing.T, ep *EdgeProcessor) {
+	t.Helper()
+	in := NewUplinkIngestor(ep.config, ep.localDB, ep.clock)
+	if err := in.Start(); err != nil {
+		t.Fatalf("failed to start ingest: %v", err)
+	}
+	t.Cleanup(func() { in.client.Disconnect(250) })
+}
+
+// newTestMQTTClient connects a test client to the broker.
+func newTestMQTTClient(t *testing.T, name string) mqtt.Client {
+	t.Helper()
+	client, err := newMQTTClient(EdgeConfig{MQTTBrokerURL: itEnv.brokerURL}, "farmsense-it-"+name)
+	if err != nil {
+		t.Fatalf("failed to connect to broker: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+	return client
+}
+
+// publishUplinks sends one ChirpStack uplink per probe, received at, and
+// waits until ingest has stored them all.
+func publishUplinks(t *testing.T, ep *EdgeProcessor, probes []itProbe, at time.Time) {
+	t.Helper()
+	before := localReadingCount(t, ep)
+	client := newTestMQTTClient(t, "uplinks-"+ep.config.FieldID)
+	for i, p := range probes {
+		up := map[string]interface{}{
+			"time":       at.UTC(),
+			"deviceInfo": map[string]string{"devEui": p.devEUI},
+			"fCnt":       uint32(at.Unix()) + uint32(i),
+			"fPort":      2,
+			"data":       p.payload(),
+		}
+		body, err := json.Marshal(up)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := client.Publish(fmt.Sprintf("application/it/device/%s/event/up", p.devEUI), 1, false, body)
+		if !token.WaitTimeout(itWaitTimeout) || token.Error() != nil {
+			t.Fatalf("failed to publish uplink for %s: %v", p.devEUI, token.Error())
+		}
+	}
+	waitFor(t, "uplinks stored", func() bool { return localReadingCount(t, ep) >= before+len(probes) })
+}
+
+func localReadingCount(t *testing.T, ep *EdgeProcessor) int {
+	t.Helper()
+	var n int
+	if err := ep.localDB.QueryRow(`SELECT COUNT(*) FROM soil_sensor_readings WHERE field_id = ?`,
+		ep.config.FieldID).Scan(&n); err != nil {
+		t.Fatalf("failed to count local readings: %v", err)
+	}
+	return n
+}
+
+// waitFor polls cond until it holds or itWaitTimeout passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(itWaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// cloudCell is a grid row as the cloud stored it.
+type cloudCell struct {
+	batchID             string
+	latitude, longitude float64
+	moistureRoot        float64
+	confidence          float64
+	qualityFlags        QualityFlags
+	timestamp           time.Time
+}
+
+// cloudGrid reads the field's grid rows from the cloud, by grid ID and
+// batch.
+func cloudGrid(t *testing.T, fieldID string) map[string]map[string]cloudCell {
+	t.Helper()
+	rows, err := itEnv.cloud.Query(`
+		SELECT grid_id, batch_id::text, ST_Y(location), ST_X(location), moisture_root, confidence,
+		       quality_flags, timestamp
+		FROM virtual_sensor_grid_20m WHERE field_id = $1
+	`, fieldID)
+	if err != nil {
+		t.Fatalf("failed to query cloud grid: %v", err)
+	}
+	defer rows.Close()
+	grid := make(map[string]map[string]cloudCell)
+	for rows.Next() {
+		var id string
+		var c cloudCell
+		var flags int64
+		if err := rows.Scan(&id, &c.batchID, &c.latitude, &c.longitude, &c.moistureRoot, &c.confidence,
+			&flags, &c.timestamp); err != nil {
+			t.Fatalf("failed to read cloud grid: %v", err)
+		}
+		c.qualityFlags = QualityFlags(flags)
+		if grid[c.batchID] == nil {
+			grid[c.batchID] = make(map[string]cloudCell)
+		}
+		grid[c.batchID][id] = c
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("failed to read cloud grid: %v", err)
+	}
+	return grid
+}
+
+func cloudCount(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := itEnv.cloud.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("failed to count: %v", err)
+	}
+	return n
+}
@@ -0,0 +1,225 @@
+//go:build integration
+
+// Integration Tests - uplinks to cloud grid, end to end
+// Run from this directory with Docker available:
+//
+//	go test -tags=integration -run Integration -v ./...
+//
+// Each test seeds probes on a plane (root VWC linear in row and column)
+// and publishes their uplinks to the broker, so readings take the
+// gateway's real path: LoRaWAN ingest into the local cache, forwarding to
+// the cloud, fetch, registry normalization and interpolation. The thin
+// plate RBF carries an affine trend, so every cell must read the plane
+// back; a probe whose reading is off by a calibration offset only lands
+// on the plane if the offset was applied. The grid the cloud stores must
+// match the cycle's cell for cell, and repeated syncs must not duplicate
+// it. The environment is in integration_env_test.go.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	itPlaneTolerance = 1e-4 // VWC; the plane is exact in row/column, the RBF fits in metres
+	itProbeOffsetVWC = 0.02
+)
+
+// offsetCenterProbe makes the lattice's center probe read
+// itProbeOffsetVWC low and returns its sensor ID.
+func offsetCenterProbe(probes []itProbe) string {
+	center := &probes[len(probes)/2]
+	center.surface -= itProbeOffsetVWC
+	center.root -= itProbeOffsetVWC
+	return center.devEUI
+}
+
+// assertPlane checks every cell against the seeded plane, and the
+// extrapolated flag on the cells clearly inside and outside the probes'
+// hull (rows 2–26, columns 2–38).
+func assertPlane(t *testing.T, ep *EdgeProcessor, grid []VirtualGridPoint) {
+	t.Helper()
+	g := ep.gridLayout()
+	if len(grid) != g.rows*g.cols {
+		t.Fatalf("grid has %d cells, want %d", len(grid), g.rows*g.cols)
+	}
+	for _, p := range grid {
+		row, col, ok := ep.parseGridID(p.GridID)
+		if !ok {
+			t.Fatalf("unparseable grid ID %q", p.GridID)
+		}
+		if want := planeRoot(row, col); math.Abs(p.MoistureRoot-want) > itPlaneTolerance {
+			t.Errorf("%s: moisture_root %.5f, want %.5f", p.GridID, p.MoistureRoot, want)
+		}
+		if want := planeRoot(row, col) - 0.03; math.Abs(p.MoistureSurface-want) > itPlaneTolerance {
+			t.Errorf("%s: moisture_surface %.5f, want %.5f", p.GridID, p.MoistureSurface, want)
+		}
+		extrapolated := p.QualityFlags&QualityExtrapolated != 0
+		switch {
+		case row < 2 || row > 26 || col < 2 || col > 38:
+			if !extrapolated {
+				t.Errorf("%s outside the probes is not flagged extrapolated", p.GridID)
+			}
+		case row > 2 && row < 26 && col > 2 && col < 38:
+			if extrapolated {
+				t.Errorf("%s inside the probes is flagged extrapolated", p.GridID)
+			}
+		}
+	}
+}
+
+// assertCloudMatches checks that the cloud holds exactly the cycle's cells
+// under its batch.
+func assertCloudMatches(t *testing.T, ep *EdgeProcessor, grid []VirtualGridPoint) {
+	t.Helper()
+	batch := grid[0].BatchID
+	cells := cloudGrid(t, ep.config.FieldID)[batch]
+	if len(cells) != len(grid) {
+		t.Fatalf("cloud has %d cells for batch %s, want %d", len(cells), batch, len(grid))
+	}
+	for _, p := range grid {
+		c, ok := cells[p.GridID]
+		switch {
+		case !ok:
+			t.Errorf("%s missing from the cloud", p.GridID)
+		case c.moistureRoot != p.MoistureRoot || c.confidence != p.Confidence || c.qualityFlags != p.QualityFlags:
+			t.Errorf("%s: cloud has root %v confidence %v flags %d, cycle %v %v %d", p.GridID,
+				c.moistureRoot, c.confidence, c.qualityFlags, p.MoistureRoot, p.Confidence, p.QualityFlags)
+		case math.Abs(c.latitude-p.Latitude) > 1e-9 || math.Abs(c.longitude-p.Longitude) > 1e-9:
+			t.Errorf("%s: cloud location %v,%v, cycle %v,%v", p.GridID, c.latitude, c.longitude, p.Latitude, p.Longitude)
+		case !c.timestamp.Equal(p.Timestamp.Truncate(time.Microsecond)):
+			t.Errorf("%s: cloud timestamp %v, cycle %v", p.GridID, c.timestamp, p.Timestamp)
+		}
+	}
+}
+
+// TestIntegrationComputeAndSync runs an online gateway: readings go up,
+// the sensor registry comes down, and the cycle's grid, zone stats and
+// MQTT summary come out.
+func TestIntegrationComputeAndSync(t *testing.T) {
+	const fieldID = "it_online"
+	probes := planeProbes("a1")
+	offsetID := offsetCenterProbe(probes)
+	ep := newIntegrationProcessor(t, fieldID, probes, nil)
+	if _, err := itEnv.cloud.Exec(`
+		INSERT INTO sensor_registry (sensor_id, field_id, moisture_offset_vwc) VALUES ($1, $2, $3)
+	`, offsetID, fieldID, itProbeOffsetVWC); err != nil {
+		t.Fatalf("failed to seed sensor registry: %v", err)
+	}
+	connectCloud(t, ep)
+	startIngest(t, ep)
+	ep.publisher.Start()
+
+	publishUplinks(t, ep, probes, time.Now().Add(-time.Minute))
+	ep.syncToCloud()
+	if n := cloudCount(t, `SELECT COUNT(*) FROM soil_sensor_readings WHERE field_id = $1`, fieldID); n != len(probes) {
+		t.Fatalf("cloud has %d readings, want %d", n, len(probes))
+	}
+
+	ep.computeVirtualGrid()
+	grid := ep.LatestGrid()
+	assertPlane(t, ep, grid)
+	assertCloudMatches(t, ep, grid)
+
+	// Zones split the field between them
+	zoneCells := cloudCount(t, `SELECT COALESCE(SUM(cells), 0) FROM zone_stats WHERE field_id = $1`, fieldID)
+	if zones := cloudCount(t, `SELECT COUNT(*) FROM zone_stats WHERE field_id = $1`, fieldID); zones != 2 || zoneCells != len(grid) {
+		t.Errorf("cloud zone stats: %d zones with %d cells, want 2 with %d", zones, zoneCells, len(grid))
+	}
+
+	// Results are retained on the broker for late subscribers
+	summaries := make(chan GridSummary, 1)
+	client := newTestMQTTClient(t, "summary-"+fieldID)
+	token := client.Subscribe(itPublishPrefix+"/"+fieldID+"/summary", 1, func(_ mqtt.Client, msg mqtt.Message) {
+		var s GridSummary
+		if json.Unmarshal(msg.Payload(), &s) == nil {
+			select {
+			case summaries <- s:
+			default:
+			}
+		}
+	})
+	if !token.WaitTimeout(itWaitTimeout) || token.Error() != nil {
+		t.Fatalf("failed to subscribe to summary: %v", token.Error())
+	}
+	select {
+	case s := <-summaries:
+		if s.Cells != len(grid) || s.Zones != 2 {
+			t.Errorf("summary reports %d cells in %d zones, want %d in 2", s.Cells, s.Zones, len(grid))
+		}
+	case <-time.After(itWaitTimeout):
+		t.Error("no summary published")
+	}
+
+	// A sync with nothing new changes nothing
+	ep.syncToCloud()
+	if n := cloudCount(t, `SELECT COUNT(*) FROM virtual_sensor_grid_20m WHERE field_id = $1`, fieldID); n != len(grid) {
+		t.Errorf("cloud has %d cells after a second sync, want %d", n, len(grid))
+	}
+}
+
+// TestIntegrationOfflineQueue computes while the cloud is unreachable,
+// from the local cache with sensor_installs, then reconnects: the queued
+// readings and grid must arrive once, and the next cycle goes straight up.
+func TestIntegrationOfflineQueue(t *testing.T) {
+	const fieldID = "it_offline"
+	probes := planeProbes("b1")
+	offsetID := offsetCenterProbe(probes)
+	ep := newIntegrationProcessor(t, fieldID, probes, func(c *EdgeConfig) {
+		c.SensorInstalls = []SensorInstall{{SensorID: offsetID, MoistureOffsetVWC: itProbeOffsetVWC}}
+	})
+	startIngest(t, ep)
+
+	publishUplinks(t, ep, probes, time.Now().Add(-2*time.Minute))
+	ep.computeVirtualGrid()
+	offline := ep.LatestGrid()
+	assertPlane(t, ep, offline)
+	if len(ep.pendingSync) != len(offline) {
+		t.Fatalf("%d cells queued while offline, want %d", len(ep.pendingSync), len(offline))
+	}
+	if n := cloudCount(t, `SELECT COUNT(*) FROM virtual_sensor_grid_20m WHERE field_id = $1`, fieldID); n != 0 {
+		t.Fatalf("cloud has %d cells before reconnecting", n)
+	}
+
+	connectCloud(t, ep)
+	ep.syncToCloud()
+	if len(ep.pendingSync) != 0 {
+		t.Errorf("%d cells still queued after sync", len(ep.pendingSync))
+	}
+	assertCloudMatches(t, ep, offline)
+	if n := cloudCount(t, `SELECT COUNT(*) FROM soil_sensor_readings WHERE field_id = $1`, fieldID); n != len(probes) {
+		t.Errorf("cloud has %d readings after forwarding, want %d", n, len(probes))
+	}
+
+	// Replaying the forward and the upload duplicates nothing
+	if _, err := ep.localDB.Exec(`DELETE FROM sync_state WHERE name = ?`, ep.readingWatermarkKey()); err != nil {
+		t.Fatal(err)
+	}
+	ep.queueForSync(offline)
+	ep.syncToCloud()
+	if n := cloudCount(t, `SELECT COUNT(*) FROM soil_sensor_readings WHERE field_id = $1`, fieldID); n != len(probes) {
+		t.Errorf("cloud has %d readings after a replayed forward, want %d", n, len(probes))
+	}
+	if n := cloudCount(t, `SELECT COUNT(*) FROM virtual_sensor_grid_20m WHERE field_id = $1`, fieldID); n != len(offline) {
+		t.Errorf("cloud has %d cells after a replayed upload, want %d", n, len(offline))
+	}
+
+	// Online now: the next cycle reads the forwarded readings from the
+	// cloud and stores its grid directly
+	ep.computeVirtualGrid()
+	online := ep.LatestGrid()
+	assertPlane(t, ep, online)
+	if online[0].BatchID == offline[0].BatchID {
+		t.Fatal("second cycle reused the first cycle's batch")
+	}
+	assertCloudMatches(t, ep, online)
+	if batches := len(cloudGrid(t, fieldID)); batches != 2 {
+		t.Errorf("cloud has %d batches, want 2", batches)
+	}
+}
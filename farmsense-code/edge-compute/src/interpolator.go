@@ -0,0 +1,167 @@
+// Interpolator - named sensor variables and pluggable spatial estimators
+// Every channel the grid carries is a SensorVariable: how to read it from
+// a SensorReading, how to write it to a VirtualGridPoint, and which
+// Interpolator estimates it between probes. Moisture and temperature are
+// built in and land in their existing struct fields; new channels (EC,
+// pH, proximal NDVI...) register once at init and travel in the reading's
+// Channels map and the cell's Variables map, with no changes here or to
+// either struct. A vendor extra (extra_channels.go) registered by name is
+// read from the reading's Extras.
+
+package main
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+// NeighborSample is one probe's value for a variable at some distance
+// from the cell being estimated. Distance 0 means the probe is on the cell.
+type NeighborSample struct {
+	Distance float64
+	Value    float64
+}
+
+// Interpolator estimates a variable at a cell from nearby samples. Cells
+// are interpolated in parallel, so Estimate must be safe for concurrent use.
+type Interpolator interface {
+	Name() string
+	Estimate(samples []NeighborSample) (float64, bool)
+}
+
+// SensorVariable is one interpolated channel.
+type SensorVariable struct {
+	Name         string
+	Read         func(SensorReading) (float64, bool) // false = probe doesn't report it
+	Write        func(*VirtualGridPoint, float64)
+	Interpolator Interpolator // nil = the processor's IDW
+}
+
+// Built-in variables
+const (
+	VarMoistureSurface = "moisture_surface"
+	VarMoistureRoot    = "moisture_root"
+	VarTemperature     = "temperature"
+)
+
+var sensorVariables = []SensorVariable{
+	{
+		Name:  VarMoistureSurface,
+		Read:  func(s SensorReading) (float64, bool) { return s.MoistureSurface, !s.noSurface },
+		Write: func(p *VirtualGridPoint, v float64) { p.MoistureSurface = v },
+	},
+	{
+		Name:  VarMoistureRoot,
+		Read:  func(s SensorReading) (float64, bool) { return s.MoistureRoot, !s.noRoot },
+		Write: func(p *VirtualGridPoint, v float64) { p.MoistureRoot = v },
+	},
+	{
+		Name:  VarTemperature,
+		Read:  func(s SensorReading) (float64, bool) { return s.TempSurface, true },
+		Write: func(p *VirtualGridPoint, v float64) { p.Temperature = v },
+	},
+}
+
+// RegisterSensorVariable adds a channel to every grid cell. Read and Write
+// default to the reading's Channels (else Extras) and the cell's Variables
+// under name.
+// Call from init; the variable list isn't guarded for concurrent change.
+func RegisterSensorVariable(v SensorVariable) {
+	name := v.Name
+	if v.Read == nil {
+		v.Read = func(s SensorReading) (float64, bool) {
+			if value, ok := s.Channels[name]; ok {
+				return value, true
+			}
+			value, ok := s.Extras[name]
+			return value, ok
+		}
+	}
+	if v.Write == nil {
+		v.Write = func(p *VirtualGridPoint, value float64) { p.setVariable(name, value) }
+	}
+	for i, existing := range sensorVariables {
+		if existing.Name == name {
+			sensorVariables[i] = v
+			return
+		}
+	}
+	sensorVariables = append(sensorVariables, v)
+}
+
+// IDWInterpolator is inverse distance weighting: weight = 1/distance^power.
+type IDWInterpolator struct {
+	Power float64
+}
+
+func (IDWInterpolator) Name() string { return "idw" }
+
+func (idw IDWInterpolator) Estimate(samples []NeighborSample) (float64, bool) {
+	total, sum := 0.0, 0.0
+	for _, s := range samples {
+		if s.Distance == 0 {
+			return s.Value, true
+		}
+		w := 1.0 / math.Pow(s.Distance, idw.Power)
+		total += w
+		sum += w * s.Value
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return sum / total, true
+}
+
+// idw is the processor's default interpolator, at shadow_idw_power during
+// an IDW shadow pass.
+func (ep *EdgeProcessor) idw() IDWInterpolator {
+	if ep.shadowMode == ShadowIDW && ep.config.ShadowIDWPower > 0 {
+		return IDWInterpolator{Power: ep.config.ShadowIDWPower}
+	}
+	return IDWInterpolator{Power: ep.config.IDWPower}
+}
+
+// estimateVariables writes every registered variable to cell.
+func (ep *EdgeProcessor) estimateVariables(cell *VirtualGridPoint, neighbors []sensorNeighbor) {
+	point := orb.Point{cell.Longitude, cell.Latitude}
+	samples := make([]NeighborSample, 0, len(neighbors))
+	classes := make([]string, 0, len(neighbors))
+	for _, v := range sensorVariables {
+		samples, classes = samples[:0], classes[:0]
+		for _, n := range neighbors {
+			if value, ok := v.Read(n.sensor); ok {
+				samples = append(samples, NeighborSample{Distance: n.distance, Value: value})
+				classes = append(classes, n.sensor.class)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		if value, ok := ep.estimateVariable(point, v, samples, classes, ep.cycleRBF); ok {
+			v.Write(cell, value)
+		}
+	}
+}
+
+// estimateVariable estimates v at point from samples, one pass per sensor
+// class fused when sensor_classes are set (sensor_classes.go). models are
+// the RBF surfaces to use, by classVariableKey.
+func (ep *EdgeProcessor) estimateVariable(point orb.Point, v SensorVariable, samples []NeighborSample, classes []string, models map[string]*rbfModel) (float64, bool) {
+	if len(ep.config.SensorClasses) > 0 {
+		return fusePasses(ep.classPasses(point, v, samples, classes, models))
+	}
+	return ep.estimatePass(point, v, "", samples, models)
+}
+
+// estimatePass estimates v at point from one class's samples.
+func (ep *EdgeProcessor) estimatePass(point orb.Point, v SensorVariable, class string, samples []NeighborSample, models map[string]*rbfModel) (float64, bool) {
+	if m := models[classVariableKey(class, v.Name)]; m != nil {
+		return m.At(point), true
+	}
+	var interp Interpolator = ep.idw()
+	if v.Interpolator != nil {
+		interp = v.Interpolator
+	}
+	return interp.Estimate(samples)
+}
@@ -0,0 +1,150 @@
+// Irrigation Detection - masking cells under an active irrigation pass
+// A pivot or a set wets a strip of the field at a time. Until the water
+// has redistributed, the probes it crossed read far wetter than the rest
+// of their zone: the zone's mean deficit and stress drop, so the part the
+// pass hasn't reached yet looks fine, and the wetted probes disagree with
+// their neighbors enough to be scored as faulty.
+//
+// Each cycle, a probe whose surface moisture rose by irrigation_rise_vwc
+// since its previous reading (within rainRiseMaxGap), while the cycle
+// isn't raining, is marked as under a pass for irrigation_mask_hours
+// (rain wets every probe at once, is left to rain_detection.go and clears
+// the marks). A cell gets irrigation_state "irrigating" while marked
+// probes carry at least irrigation_mask_share of its interpolation weight
+// (attribution.go, or an equal share per source probe for other
+// interpolators). Masked cells keep their own values and need, but:
+//   - zone means, stressed area and the zone's irrigation need are taken
+//     over the unmasked cells (masked_cells on the zone stats; a zone
+//     masked throughout keeps all its cells). The deficit volume still
+//     counts every cell, it's water the zone is short of.
+//   - marked probes skip the sensor health neighbor check and aren't used
+//     as anyone's neighbors.
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	defaultIrrigationRiseVWC   = 0.03
+	defaultIrrigationMaskHours = 12.0
+	defaultIrrigationMaskShare = 0.5
+)
+
+// IrrigationStateActive tags cells masked by a recent pass.
+const IrrigationStateActive = "irrigating"
+
+// irrigationTracker holds pass detection state between cycles (Run
+// goroutine only).
+type irrigationTracker struct {
+	prevSurface map[string]sensorSample // sensor_id -> latest surface reading
+	wettedAt    map[string]time.Time    // sensor_id -> last rise
+}
+
+func newIrrigationTracker() *irrigationTracker {
+	return &irrigationTracker{
+		prevSurface: make(map[string]sensorSample),
+		wettedAt:    make(map[string]time.Time),
+	}
+}
+
+func (c EdgeConfig) irrigationMask() time.Duration {
+	h := c.IrrigationMaskHours
+	if h <= 0 {
+		h = defaultIrrigationMaskHours
+	}
+	return time.Duration(h * float64(time.Hour))
+}
+
+// updateIrrigationPasses marks probes whose surface moisture jumped this
+// cycle and expires old marks. sensors is newest first; call after
+// updateRain.
+func (ep *EdgeProcessor) updateIrrigationPasses(sensors []SensorReading, now time.Time) {
+	it := ep.irrigation
+	rise := ep.config.IrrigationRiseVWC
+	if rise <= 0 {
+		rise = defaultIrrigationRiseVWC
+	}
+	raining := ep.rain.state == RainStateRaining
+
+	seen := make(map[string]bool, len(sensors))
+	started := 0
+	for _, s := range sensors {
+		if seen[s.SensorID] || s.noSurface {
+			continue
+		}
+		seen[s.SensorID] = true
+		if prev, ok := it.prevSurface[s.SensorID]; ok && !raining && s.Timestamp.After(prev.at) &&
+			s.Timestamp.Sub(prev.at) <= rainRiseMaxGap && s.MoistureSurface-prev.value >= rise {
+			if _, marked := it.wettedAt[s.SensorID]; !marked {
+				started++
+			}
+			it.wettedAt[s.SensorID] = now
+		}
+		it.prevSurface[s.SensorID] = sensorSample{value: s.MoistureSurface, at: s.Timestamp}
+	}
+
+	mask := ep.config.irrigationMask()
+	for id, at := range it.wettedAt {
+		if raining || now.Sub(at) > mask {
+			delete(it.wettedAt, id)
+		}
+	}
+	if started > 0 {
+		ep.cycleLog.Info("Irrigation pass detected", "component", "irrigation", "probes", started,
+			"under_pass", len(it.wettedAt), "mask_hours", mask.Hours())
+	}
+}
+
+// underPass reports whether a probe is marked as under a pass.
+func (ep *EdgeProcessor) underPass(sensorID string) bool {
+	_, ok := ep.irrigation.wettedAt[sensorID]
+	return ok
+}
+
+// wettedShare is the share of a cell's estimate that comes from probes
+// under a pass.
+func (ep *EdgeProcessor) wettedShare(p VirtualGridPoint) float64 {
+	if len(p.attribution) > 0 {
+		share := 0.0
+		for _, c := range p.attribution {
+			if ep.underPass(c.SensorID) {
+				share += c.Weight
+			}
+		}
+		return share
+	}
+	if len(p.SourceSensors) == 0 {
+		return 0
+	}
+	wetted := 0
+	for _, id := range p.SourceSensors {
+		if ep.underPass(id) {
+			wetted++
+		}
+	}
+	return float64(wetted) / float64(len(p.SourceSensors))
+}
+
+// applyIrrigationMask tags the cells a recent pass dominates.
+func (ep *EdgeProcessor) applyIrrigationMask(points []VirtualGridPoint) {
+	if len(ep.irrigation.wettedAt) == 0 {
+		return
+	}
+	minShare := ep.config.IrrigationMaskShare
+	if minShare <= 0 {
+		minShare = defaultIrrigationMaskShare
+	}
+	masked := 0
+	for i := range points {
+		if ep.wettedShare(points[i]) >= minShare {
+			points[i].IrrigationState = IrrigationStateActive
+			masked++
+		}
+	}
+	if masked > 0 {
+		ep.cycleLog.Info("Masked cells under an irrigation pass", "component", "irrigation", "cells", masked,
+			"probes", len(ep.irrigation.wettedAt))
+	}
+}
@@ -0,0 +1,784 @@
+// Irrigation Events - controller runs and pulse flow meters
+// The water budget and the zone stats need to know when a zone was
+// actually watered, not just what the probes read afterwards. Irrigation
+// runs come in two ways and land in the local irrigation_events table:
+//   - controllers publish their runs on irrigation_event_topic as JSON
+//     ({"event_id", "zone_id", "state": scheduled|running|completed|
+//     cancelled, "started_at", "ended_at", "volume_l", "applied_mm"}); a
+//     repeated event_id updates the run, so a controller can announce a
+//     schedule, then its start and its end;
+//   - pulse flow meters (pulse_meters) report a running pulse total, either
+//     published by a counter module on the meter's mqtt_topic
+//     ({"count": n, "timestamp": ...}) or read from a Modbus TCP counter
+//     every pulse_poll_sec (function 0x03, two holding registers from
+//     modbus_register, high word first). Pulses × liters_per_pulse is the
+//     volume; flow after a gap of clogSetGap starts a run, no flow for as
+//     long completes it, and a count that goes backwards is a counter reset.
+//     Runs open when the processor stopped are completed at their last flow
+//     on start, since the pulses in between can't be attributed.
+//
+// The water budget books local runs for zones without a flow_zones meter,
+// prorated like controller logs already in the cloud. Completed runs are
+// upserted to the cloud irrigation_events table by event_uid (migration
+// 025) with this device's ID, which the budget's cloud query skips so a
+// run isn't booked twice.
+//
+// With either source configured, each zone's stats carry its irrigation
+// status, so a stressed zone that is about to be watered is told apart
+// from one nobody is watering: running while a run is on, scheduled with a
+// run due within irrigation_lookahead_hours, watered after a run that ended
+// within irrigation_neglect_hours, and neglected when its need is high or
+// critical and none of those hold. A zone turning neglected raises
+// zone_neglected.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Irrigation event states
+const (
+	IrrigationScheduled = "scheduled"
+	IrrigationRunning   = "running"
+	IrrigationCompleted = "completed"
+	IrrigationCancelled = "cancelled"
+)
+
+// Irrigation event sources
+const (
+	IrrigationSourceController = "controller"
+	IrrigationSourcePulseMeter = "pulse_meter"
+)
+
+// Zone irrigation statuses
+const (
+	ZoneIrrigationRunning   = "running"
+	ZoneIrrigationScheduled = "scheduled"
+	ZoneIrrigationWatered   = "watered"
+	ZoneIrrigationNeglected = "neglected"
+)
+
+// AlertZoneNeglected is raised when a thirsty zone has no recent or
+// upcoming run.
+const AlertZoneNeglected = "zone_neglected"
+
+const (
+	defaultPulsePollSec             = 30
+	defaultIrrigationLookaheadHours = 12.0
+	defaultIrrigationNeglectHours   = 48.0
+	pulseRunGap                     = clogSetGap
+	modbusTimeout                   = 5 * time.Second
+	defaultModbusUnit               = 1
+)
+
+// PulseMeter is a pulse-output flow meter on a zone's supply line.
+type PulseMeter struct {
+	MeterID        string  `json:"meter_id"`
+	ZoneID         string  `json:"zone_id"`
+	FieldID        string  `json:"field_id"` // default: field_id
+	LitersPerPulse float64 `json:"liters_per_pulse"`
+	MQTTTopic      string  `json:"mqtt_topic"`      // Pulse totals from a counter module
+	ModbusAddr     string  `json:"modbus_addr"`     // host:port of a Modbus TCP counter
+	ModbusUnit     int     `json:"modbus_unit"`     // Unit ID (default 1)
+	ModbusRegister int     `json:"modbus_register"` // First of the two holding registers with the count
+}
+
+// IrrigationEvent is one run of a zone, planned or observed.
+type IrrigationEvent struct {
+	EventID   string     `json:"event_id"`
+	FieldID   string     `json:"field_id"`
+	ZoneID    string     `json:"zone_id"`
+	State     string     `json:"state"`
+	StartedAt time.Time  `json:"started_at"`         // planned start of a scheduled run
+	EndedAt   *time.Time `json:"ended_at,omitempty"` // last flow of a running one
+	VolumeL   float64    `json:"volume_l,omitempty"`
+	AppliedMM float64    `json:"applied_mm,omitempty"`
+	Source    string     `json:"source"`
+}
+
+// PulseMeterStatus is per-meter ingest state exposed by the API.
+type PulseMeterStatus struct {
+	MeterID      string    `json:"meter_id"`
+	ZoneID       string    `json:"zone_id"`
+	Count        uint32    `json:"count"`
+	Samples      int       `json:"samples"`
+	Errors       int       `json:"errors"`
+	Running      bool      `json:"running"`
+	RunLiters    float64   `json:"run_liters,omitempty"`
+	LastSampleAt time.Time `json:"last_sample_at"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// irrigationEventsEnabled reports whether this device ingests runs itself.
+func irrigationEventsEnabled(c EdgeConfig) bool {
+	return c.IrrigationEventTopic != "" || len(c.PulseMeters) > 0
+}
+
+// validIrrigationState reports whether a controller event state is known.
+func validIrrigationState(state string) bool {
+	switch state {
+	case IrrigationScheduled, IrrigationRunning, IrrigationCompleted, IrrigationCancelled:
+		return true
+	}
+	return false
+}
+
+// initIrrigationEventsSchema creates the local irrigation events table.
+func initIrrigationEventsSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS irrigation_events (
+			event_id   TEXT    NOT NULL,
+			field_id   TEXT    NOT NULL,
+			zone_id    TEXT    NOT NULL,
+			state      TEXT    NOT NULL,
+			started_at INTEGER NOT NULL,
+			ended_at   INTEGER,
+			volume_l   REAL,
+			applied_mm REAL,
+			source     TEXT    NOT NULL,
+			updated_at INTEGER NOT NULL,
+			synced     INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (field_id, event_id)
+		);
+		CREATE INDEX IF NOT EXISTS irrigation_events_zone ON irrigation_events (field_id, zone_id, started_at);
+	`)
+	return err
+}
+
+// storeIrrigationEvent inserts or updates a run, queueing it for upload.
+func storeIrrigationEvent(db *sql.DB, e IrrigationEvent, now time.Time) error {
+	var ended interface{}
+	if e.EndedAt != nil {
+		ended = e.EndedAt.Unix()
+	}
+	_, err := db.Exec(`
+		INSERT INTO irrigation_events
+			(event_id, field_id, zone_id, state, started_at, ended_at, volume_l, applied_mm, source, updated_at, synced)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)
+		ON CONFLICT (field_id, event_id) DO UPDATE SET
+			zone_id = excluded.zone_id, state = excluded.state, started_at = excluded.started_at,
+			ended_at = excluded.ended_at, volume_l = excluded.volume_l, applied_mm = excluded.applied_mm,
+			source = excluded.source, updated_at = excluded.updated_at, synced = 0
+	`, e.EventID, e.FieldID, e.ZoneID, e.State, e.StartedAt.Unix(), ended, e.VolumeL, e.AppliedMM, e.Source, now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store irrigation event: %v", err)
+	}
+	return nil
+}
+
+// IrrigationIngestor records controller runs and pulse meter runs in the
+// local cache.
+type IrrigationIngestor struct {
+	config  EdgeConfig
+	localDB *sql.DB
+	clock   *ReferenceClock
+	client  mqtt.Client
+	poll    time.Duration
+
+	mu       sync.Mutex
+	meters   map[string]*pulseMeterState
+	received int // controller events stored
+	logger   *slog.Logger
+}
+
+// pulseMeterState is one meter's counter and open run (guarded by mu).
+type pulseMeterState struct {
+	meter  PulseMeter
+	status PulseMeterStatus
+	seen   bool // count holds a sample
+	last   time.Time
+	run    *IrrigationEvent
+	flowAt time.Time // last sample with pulses in the open run
+}
+
+func NewIrrigationIngestor(config EdgeConfig, localDB *sql.DB, clock *ReferenceClock) *IrrigationIngestor {
+	poll := config.PulsePollSec
+	if poll <= 0 {
+		poll = defaultPulsePollSec
+	}
+	in := &IrrigationIngestor{
+		config:  config,
+		localDB: localDB,
+		clock:   clock,
+		poll:    time.Duration(poll) * time.Second,
+		meters:  make(map[string]*pulseMeterState, len(config.PulseMeters)),
+		logger:  slog.With("component", "irrigation_events"),
+	}
+	for _, m := range config.PulseMeters {
+		if m.FieldID == "" {
+			m.FieldID = config.FieldID
+		}
+		if m.ModbusUnit <= 0 {
+			m.ModbusUnit = defaultModbusUnit
+		}
+		in.meters[m.MeterID] = &pulseMeterState{meter: m, status: PulseMeterStatus{MeterID: m.MeterID, ZoneID: m.ZoneID}}
+	}
+	return in
+}
+
+// Start closes runs left open by the last run of the processor, subscribes
+// to the controller and pulse topics and starts polling.
+func (in *IrrigationIngestor) Start() error {
+	if err := initIrrigationEventsSchema(in.localDB); err != nil {
+		return fmt.Errorf("failed to create irrigation events table: %v", err)
+	}
+	now := in.clock.Now()
+	if _, err := in.localDB.Exec(`
+		UPDATE irrigation_events SET state = ?, updated_at = ?, synced = 0
+		WHERE source = ? AND state = ?
+	`, IrrigationCompleted, now.Unix(), IrrigationSourcePulseMeter, IrrigationRunning); err != nil {
+		return fmt.Errorf("failed to close open pulse meter runs: %v", err)
+	}
+
+	topics := make([]string, 0, len(in.meters)+1)
+	if in.config.IrrigationEventTopic != "" {
+		topics = append(topics, in.config.IrrigationEventTopic)
+	}
+	for _, st := range in.meters {
+		if st.meter.MQTTTopic != "" && !containsString(topics, st.meter.MQTTTopic) {
+			topics = append(topics, st.meter.MQTTTopic)
+		}
+	}
+	if len(topics) > 0 {
+		client, err := newMQTTClient(in.config, "farmsense-irrigation-"+in.config.DeviceID)
+		if err != nil {
+			return err
+		}
+		for _, topic := range topics {
+			token := client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+				in.handle(msg.Topic(), msg.Payload())
+			})
+			if !token.WaitTimeout(mqttConnectTimeout) {
+				client.Disconnect(250)
+				return fmt.Errorf("timed out subscribing to %s", topic)
+			}
+			if err := token.Error(); err != nil {
+				client.Disconnect(250)
+				return fmt.Errorf("failed to subscribe to %s: %v", topic, err)
+			}
+		}
+		in.client = client
+	}
+	if len(in.meters) > 0 {
+		go in.pollLoop()
+	}
+	in.logger.Info("Irrigation event ingest started", "topic", in.config.IrrigationEventTopic, "pulse_meters", len(in.meters))
+	return nil
+}
+
+// handle routes a message to the meter publishing on its topic, or treats
+// it as a controller event.
+func (in *IrrigationIngestor) handle(topic string, body []byte) {
+	for _, st := range in.meters {
+		if st.meter.MQTTTopic != "" && mqttTopicMatches(st.meter.MQTTTopic, topic) {
+			in.handlePulses(st.meter.MeterID, body)
+			return
+		}
+	}
+	if err := in.handleControllerEvent(body); err != nil {
+		in.logger.Warn("Dropping irrigation event", "topic", topic, "error", err)
+	}
+}
+
+// controllerEvent is a controller's run announcement.
+type controllerEvent struct {
+	EventID   string     `json:"event_id"`
+	ZoneID    string     `json:"zone_id"`
+	FieldID   string     `json:"field_id"`
+	State     string     `json:"state"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+	VolumeL   float64    `json:"volume_l"`
+	AppliedMM float64    `json:"applied_mm"`
+}
+
+func (in *IrrigationIngestor) handleControllerEvent(body []byte) error {
+	var ce controllerEvent
+	if err := json.Unmarshal(body, &ce); err != nil {
+		return fmt.Errorf("invalid irrigation event: %v", err)
+	}
+	if ce.State == "started" {
+		ce.State = IrrigationRunning
+	}
+	switch {
+	case ce.EventID == "" || ce.ZoneID == "":
+		return fmt.Errorf("irrigation event needs event_id and zone_id")
+	case !validIrrigationState(ce.State):
+		return fmt.Errorf("unknown irrigation event state %q", ce.State)
+	case ce.StartedAt.IsZero():
+		return fmt.Errorf("irrigation event %s needs started_at", ce.EventID)
+	}
+	now := in.clock.Now()
+	if ce.FieldID == "" {
+		ce.FieldID = in.config.FieldID
+	}
+	prev, err := storedRunState(in.localDB, ce.FieldID, ce.EventID)
+	if err != nil {
+		return fmt.Errorf("failed to read irrigation event %s: %v", ce.EventID, err)
+	}
+	if ce.State == IrrigationCompleted && ce.EndedAt == nil {
+		ce.EndedAt = &now
+	}
+	e := IrrigationEvent{EventID: ce.EventID, FieldID: ce.FieldID, ZoneID: ce.ZoneID, State: ce.State,
+		StartedAt: ce.StartedAt.UTC(), EndedAt: ce.EndedAt, VolumeL: ce.VolumeL, AppliedMM: ce.AppliedMM,
+		Source: IrrigationSourceController}
+	if err := storeIrrigationEvent(in.localDB, e, now); err != nil {
+		return err
+	}
+	if e.State != prev {
+		in.auditRun(IrrigationSourceController, e, prev, now)
+	}
+	in.mu.Lock()
+	in.received++
+	in.mu.Unlock()
+	return nil
+}
+
+// pulsePayload is a counter module's report.
+type pulsePayload struct {
+	Count     *uint32    `json:"count"`
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+func (in *IrrigationIngestor) handlePulses(meterID string, body []byte) {
+	var p pulsePayload
+	err := json.Unmarshal(body, &p)
+	if err == nil && p.Count == nil {
+		err = fmt.Errorf("pulse report needs count")
+	}
+	if err != nil {
+		in.recordError(meterID, err)
+		return
+	}
+	at := in.clock.Now()
+	if p.Timestamp != nil {
+		at = p.Timestamp.UTC()
+	}
+	in.pulseSample(meterID, *p.Count, at)
+}
+
+// pollLoop reads the Modbus counters and completes runs whose flow
+// stopped, for MQTT meters too, whose modules may report only on change.
+func (in *IrrigationIngestor) pollLoop() {
+	ticker := time.NewTicker(in.poll)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, st := range in.meters {
+			m := st.meter
+			if m.ModbusAddr == "" {
+				continue
+			}
+			count, err := readModbusCounter(m.ModbusAddr, byte(m.ModbusUnit), uint16(m.ModbusRegister))
+			if err != nil {
+				in.recordError(m.MeterID, err)
+				continue
+			}
+			in.pulseSample(m.MeterID, count, in.clock.Now())
+		}
+		in.closeIdleRuns(in.clock.Now())
+	}
+}
+
+// pulseSample books a counter reading, opening, extending or completing
+// the meter's run.
+func (in *IrrigationIngestor) pulseSample(meterID string, count uint32, at time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	st := in.meters[meterID]
+	st.status.Samples++
+	st.status.LastSampleAt = at
+	prev, prevAt, seen := st.status.Count, st.last, st.seen
+	st.status.Count, st.last, st.seen = count, at, true
+	if !seen || !at.After(prevAt) {
+		return
+	}
+	delta := count - prev
+	if count < prev {
+		delta = count // counter reset
+	}
+
+	if delta == 0 {
+		if st.run != nil && at.Sub(st.flowAt) >= pulseRunGap {
+			in.completeRun(st, at)
+		}
+		return
+	}
+	if st.run != nil && at.Sub(st.flowAt) >= pulseRunGap {
+		in.completeRun(st, at)
+	}
+	opened := st.run == nil
+	if opened {
+		// Flow began somewhere since the previous sample
+		start := prevAt
+		if at.Sub(start) > in.poll {
+			start = at.Add(-in.poll)
+		}
+		st.run = &IrrigationEvent{
+			EventID:   fmt.Sprintf("%s-%d", meterID, start.Unix()),
+			FieldID:   st.meter.FieldID,
+			ZoneID:    st.meter.ZoneID,
+			State:     IrrigationRunning,
+			StartedAt: start,
+			Source:    IrrigationSourcePulseMeter,
+		}
+	}
+	st.flowAt = at
+	ended := at
+	st.run.EndedAt = &ended
+	st.run.VolumeL += float64(delta) * st.meter.LitersPerPulse
+	st.status.Running, st.status.RunLiters = true, st.run.VolumeL
+	if err := storeIrrigationEvent(in.localDB, *st.run, at); err != nil {
+		st.status.Errors++
+		st.status.LastError = err.Error()
+	} else if opened {
+		in.auditRun("pulse_meter:"+st.meter.MeterID, *st.run, "", at)
+	}
+}
+
+// closeIdleRuns completes runs with no flow for pulseRunGap.
+func (in *IrrigationIngestor) closeIdleRuns(now time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, st := range in.meters {
+		if st.run != nil && now.Sub(st.flowAt) >= pulseRunGap {
+			in.completeRun(st, now)
+		}
+	}
+}
+
+// completeRun stores the meter's open run as completed at its last flow
+// (mu held).
+func (in *IrrigationIngestor) completeRun(st *pulseMeterState, now time.Time) {
+	run := *st.run
+	run.State = IrrigationCompleted
+	st.run = nil
+	st.status.Running, st.status.RunLiters = false, 0
+	if err := storeIrrigationEvent(in.localDB, run, now); err != nil {
+		st.status.Errors++
+		st.status.LastError = err.Error()
+		return
+	}
+	in.auditRun("pulse_meter:"+st.meter.MeterID, run, IrrigationRunning, now)
+	in.logger.Info("Pulse meter run completed", "meter_id", st.meter.MeterID, "zone_id", run.ZoneID,
+		"volume_l", run.VolumeL, "minutes", run.EndedAt.Sub(run.StartedAt).Minutes())
+}
+
+func (in *IrrigationIngestor) recordError(meterID string, err error) {
+	in.mu.Lock()
+	st := in.meters[meterID]
+	st.status.Errors++
+	st.status.LastError = err.Error()
+	in.mu.Unlock()
+	in.logger.Warn("Pulse meter read failed", "meter_id", meterID, "error", err)
+}
+
+// Status returns per-meter counters and the number of controller events
+// stored.
+func (in *IrrigationIngestor) Status() ([]PulseMeterStatus, int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := make([]PulseMeterStatus, 0, len(in.meters))
+	for _, st := range in.meters {
+		out = append(out, st.status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MeterID < out[j].MeterID })
+	return out, in.received
+}
+
+// mqttTopicMatches reports whether topic matches an MQTT filter with + and
+// # wildcards.
+func mqttTopicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// readModbusCounter reads a 32-bit count from two holding registers over
+// Modbus TCP, high word first.
+func readModbusCounter(addr string, unit byte, register uint16) (uint32, error) {
+	conn, err := net.DialTimeout("tcp", addr, modbusTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to Modbus counter %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(modbusTimeout))
+
+	// MBAP header (transaction 1, protocol 0, 6 bytes follow), then
+	// read holding registers: function 3, start, quantity 2
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], 1)
+	binary.BigEndian.PutUint16(req[4:], 6)
+	req[6], req[7] = unit, 0x03
+	binary.BigEndian.PutUint16(req[8:], register)
+	binary.BigEndian.PutUint16(req[10:], 2)
+	if _, err := conn.Write(req); err != nil {
+		return 0, fmt.Errorf("failed to send Modbus request: %v", err)
+	}
+
+	resp := make([]byte, 9)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return 0, fmt.Errorf("failed to read Modbus response: %v", err)
+	}
+	if resp[7] == 0x83 {
+		return 0, fmt.Errorf("Modbus exception %d reading register %d", resp[8], register)
+	}
+	if resp[7] != 0x03 || resp[8] != 4 {
+		return 0, fmt.Errorf("unexpected Modbus response (function %d, %d bytes)", resp[7], resp[8])
+	}
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return 0, fmt.Errorf("failed to read Modbus registers: %v", err)
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// IrrigationEvents returns the field's runs that started or are planned
+// within [from, to], oldest first, optionally for one zone.
+func (ep *EdgeProcessor) IrrigationEvents(from, to time.Time, zoneID string) ([]IrrigationEvent, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT event_id, zone_id, state, started_at, ended_at, COALESCE(volume_l, 0), COALESCE(applied_mm, 0), source
+		FROM irrigation_events
+		WHERE field_id = ? AND started_at >= ? AND started_at <= ? AND (? = '' OR zone_id = ?)
+		ORDER BY started_at
+	`, ep.config.FieldID, from.Unix(), to.Unix(), zoneID, zoneID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]IrrigationEvent, 0)
+	for rows.Next() {
+		e := IrrigationEvent{FieldID: ep.config.FieldID}
+		var started int64
+		var ended sql.NullInt64
+		if err := rows.Scan(&e.EventID, &e.ZoneID, &e.State, &started, &ended, &e.VolumeL, &e.AppliedMM, &e.Source); err != nil {
+			return nil, err
+		}
+		e.StartedAt = time.Unix(started, 0).UTC()
+		if ended.Valid {
+			t := time.Unix(ended.Int64, 0).UTC()
+			e.EndedAt = &t
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// localIrrigationRuns returns the zone's observed runs overlapping
+// (from, to].
+func (ep *EdgeProcessor) localIrrigationRuns(zoneID string, from, to time.Time) ([]irrigationRun, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT started_at, ended_at, COALESCE(applied_mm, 0), COALESCE(volume_l, 0)
+		FROM irrigation_events
+		WHERE field_id = ? AND zone_id = ? AND state IN (?, ?)
+		  AND ended_at > ? AND started_at <= ?
+	`, ep.config.FieldID, zoneID, IrrigationRunning, IrrigationCompleted, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]irrigationRun, 0)
+	for rows.Next() {
+		var r irrigationRun
+		var start, end int64
+		if err := rows.Scan(&start, &end, &r.mm, &r.liters); err != nil {
+			return nil, err
+		}
+		r.start, r.end = time.Unix(start, 0), time.Unix(end, 0)
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// irrigationLookahead is how far ahead a scheduled run counts; safe to
+// call from other goroutines.
+func (ep *EdgeProcessor) irrigationLookahead() time.Duration {
+	ep.stateMu.RLock()
+	hours := ep.config.IrrigationLookaheadHours
+	ep.stateMu.RUnlock()
+	if hours <= 0 {
+		hours = defaultIrrigationLookaheadHours
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// applyIrrigationStatus sets each zone's irrigation status from the local
+// runs and raises zone_neglected for zones that just became neglected.
+func (ep *EdgeProcessor) applyIrrigationStatus(stats []ZoneStats, now time.Time) {
+	if !irrigationEventsEnabled(ep.config) {
+		return
+	}
+	lookahead := ep.irrigationLookahead()
+	neglect := ep.config.IrrigationNeglectHours
+	if neglect <= 0 {
+		neglect = defaultIrrigationNeglectHours
+	}
+	events, err := ep.IrrigationEvents(now.Add(-time.Duration(neglect*float64(time.Hour))), now.Add(lookahead), "")
+	if err != nil {
+		ep.cycleLog.Warn("Failed to read irrigation events", "component", "irrigation_events", "error", err)
+		return
+	}
+	type zoneRuns struct {
+		running    bool
+		last, next *time.Time
+	}
+	byZone := make(map[string]*zoneRuns)
+	for i := range events {
+		e := &events[i]
+		z := byZone[e.ZoneID]
+		if z == nil {
+			z = &zoneRuns{}
+			byZone[e.ZoneID] = z
+		}
+		switch e.State {
+		case IrrigationRunning:
+			z.running = true
+		case IrrigationScheduled:
+			switch {
+			case e.StartedAt.After(now):
+				if z.next == nil || e.StartedAt.Before(*z.next) {
+					z.next = &e.StartedAt
+				}
+			case e.EndedAt != nil && e.EndedAt.After(now):
+				z.running = true // the controller hasn't reported it started
+			}
+		case IrrigationCompleted:
+			if e.EndedAt != nil && (z.last == nil || e.EndedAt.After(*z.last)) {
+				z.last = e.EndedAt
+			}
+		}
+	}
+
+	for i := range stats {
+		s := &stats[i]
+		z := byZone[s.ZoneID]
+		if z == nil {
+			z = &zoneRuns{}
+		}
+		s.LastIrrigatedAt, s.NextIrrigationAt = z.last, z.next
+		switch {
+		case z.running:
+			s.IrrigationStatus = ZoneIrrigationRunning
+		case z.next != nil:
+			s.IrrigationStatus = ZoneIrrigationScheduled
+		case z.last != nil:
+			s.IrrigationStatus = ZoneIrrigationWatered
+		case irrigationNeedRank[s.IrrigationNeed] >= irrigationNeedRank["high"]:
+			s.IrrigationStatus = ZoneIrrigationNeglected
+		}
+
+		wasNeglected := ep.neglectedZones[s.ZoneID]
+		ep.neglectedZones[s.ZoneID] = s.IrrigationStatus == ZoneIrrigationNeglected
+		if s.IrrigationStatus != ZoneIrrigationNeglected || wasNeglected {
+			continue
+		}
+		severity := SeverityWarning
+		if s.IrrigationNeed == "critical" {
+			severity = SeverityCritical
+		}
+		ep.alerts.Raise(Alert{
+			Kind:     AlertZoneNeglected,
+			Severity: severity,
+			FieldID:  ep.config.FieldID,
+			Subject:  s.ZoneID,
+			Message: fmt.Sprintf("Zone needs water and has had no run in %.0f h and none scheduled in the next %.0f h",
+				neglect, lookahead.Hours()),
+			Value: s.WaterDeficitMeanMM,
+		})
+	}
+}
+
+// syncIrrigationEvents upserts completed runs to the cloud, leaving them
+// queued while it's unreachable.
+func (ep *EdgeProcessor) syncIrrigationEvents() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT event_id, zone_id, started_at, ended_at, COALESCE(volume_l, 0), COALESCE(applied_mm, 0), source, updated_at
+		FROM irrigation_events
+		WHERE field_id = ? AND state = ? AND synced = 0 AND ended_at IS NOT NULL
+	`, ep.config.FieldID, IrrigationCompleted)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read unsynced irrigation events", "component", "irrigation_events", "error", err)
+		return
+	}
+	type pending struct {
+		IrrigationEvent
+		started, ended, updated int64
+	}
+	batch := make([]pending, 0)
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.EventID, &p.ZoneID, &p.started, &p.ended, &p.VolumeL, &p.AppliedMM, &p.Source,
+			&p.updated); err != nil {
+			rows.Close()
+			ep.cycleLog.Error("Failed to read unsynced irrigation events", "component", "irrigation_events", "error", err)
+			return
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	defer tx.Rollback()
+	for _, p := range batch {
+		if _, err := tx.Exec(`
+			INSERT INTO irrigation_events
+				(field_id, zone_id, started_at, ended_at, applied_mm, volume_l, source, event_uid, edge_device_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (field_id, event_uid) DO UPDATE SET
+				zone_id = EXCLUDED.zone_id, started_at = EXCLUDED.started_at, ended_at = EXCLUDED.ended_at,
+				applied_mm = EXCLUDED.applied_mm, volume_l = EXCLUDED.volume_l, source = EXCLUDED.source,
+				edge_device_id = EXCLUDED.edge_device_id
+		`, ep.config.FieldID, p.ZoneID, time.Unix(p.started, 0).UTC(), time.Unix(p.ended, 0).UTC(),
+			p.AppliedMM, p.VolumeL, p.Source, p.EventID, ep.deviceID); err != nil {
+			ep.cycleLog.Warn("Irrigation event upload failed, keeping events queued", "component", "irrigation_events", "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+
+	// Events updated since they were read stay queued
+	for _, p := range batch {
+		if _, err := ep.localDB.Exec(`
+			UPDATE irrigation_events SET synced = 1 WHERE field_id = ? AND event_id = ? AND updated_at = ?
+		`, ep.config.FieldID, p.EventID, p.updated); err != nil {
+			ep.cycleLog.Warn("Failed to mark irrigation events synced", "component", "irrigation_events", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Irrigation Hardware - zone deficits as run times for the installed system
+// irrigation_hardware describes what waters each management zone, so a
+// zone's deficit can be handed to the irrigator as "run 2:45" rather than
+// "short 11 mm". The application rate comes from application_rate_mm_h
+// when it was measured, otherwise from the layout:
+//
+//	drip, micro_sprinkler  emitter_flow_lph / (emitter_spacing_m × lateral_spacing_m)
+//	pivot_sector, flood    system_flow_lpm × 60 / zone area
+//
+// (L/h over one m² is one mm/h). The gross depth is the zone's mean
+// deficit, plus its leaching fraction on saline soil, over the application
+// efficiency (default by type, the pivot's from vri_efficiency), and the
+// run time is gross depth over rate, rounded up to the minute and split
+// into sets no longer than max_set_hours. Only
+// zones whose irrigation need is medium or worse get a run time, so rain
+// suppression carries through to the recommendation.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Irrigation hardware types
+const (
+	HardwareDrip           = "drip"
+	HardwareMicroSprinkler = "micro_sprinkler"
+	HardwarePivotSector    = "pivot_sector"
+	HardwareFlood          = "flood"
+)
+
+// Default application efficiency (net ÷ gross) by type; pivots use
+// vri_efficiency.
+var defaultHardwareEfficiency = map[string]float64{
+	HardwareDrip:           0.90,
+	HardwareMicroSprinkler: 0.80,
+	HardwareFlood:          0.60,
+}
+
+// IrrigationHardware is the system installed in one management zone.
+type IrrigationHardware struct {
+	ZoneID             string  `json:"zone_id"`
+	Type               string  `json:"type"`                  // drip | micro_sprinkler | pivot_sector | flood
+	ApplicationRateMMH float64 `json:"application_rate_mm_h"` // Measured rate; overrides the one derived from the layout
+	EmitterFlowLPH     float64 `json:"emitter_flow_lph"`      // drip / micro_sprinkler: flow per emitter or head
+	EmitterSpacingM    float64 `json:"emitter_spacing_m"`     // Along the line
+	LateralSpacingM    float64 `json:"lateral_spacing_m"`     // Between lines or head rows
+	SystemFlowLPM      float64 `json:"system_flow_lpm"`       // pivot_sector / flood: flow delivered to the zone
+	Efficiency         float64 `json:"efficiency"`            // Net ÷ gross (default by type)
+	MaxSetHours        float64 `json:"max_set_hours"`         // Longest single run; longer needs are split into sets (0 = no limit)
+}
+
+// applicationRate returns the hardware's rate in mm/h over a zone of
+// areaM2, or 0 when it can't be derived.
+func (h IrrigationHardware) applicationRate(areaM2 float64) float64 {
+	if h.ApplicationRateMMH > 0 {
+		return h.ApplicationRateMMH
+	}
+	switch h.Type {
+	case HardwareDrip, HardwareMicroSprinkler:
+		if h.EmitterSpacingM > 0 && h.LateralSpacingM > 0 {
+			return h.EmitterFlowLPH / (h.EmitterSpacingM * h.LateralSpacingM)
+		}
+	case HardwarePivotSector, HardwareFlood:
+		if areaM2 > 0 {
+			return h.SystemFlowLPM * 60 / areaM2
+		}
+	}
+	return 0
+}
+
+// derivable reports whether a rate can be worked out from the settings.
+func (h IrrigationHardware) derivable() bool {
+	if h.ApplicationRateMMH > 0 {
+		return true
+	}
+	switch h.Type {
+	case HardwareDrip, HardwareMicroSprinkler:
+		return h.EmitterFlowLPH > 0 && h.EmitterSpacingM > 0 && h.LateralSpacingM > 0
+	case HardwarePivotSector, HardwareFlood:
+		return h.SystemFlowLPM > 0
+	}
+	return false
+}
+
+func (ep *EdgeProcessor) hardwareEfficiency(h IrrigationHardware) float64 {
+	if h.Efficiency > 0 {
+		return h.Efficiency
+	}
+	if h.Type == HardwarePivotSector {
+		if ep.config.VRIEfficiency > 0 {
+			return ep.config.VRIEfficiency
+		}
+		return defaultVRIEfficiency
+	}
+	return defaultHardwareEfficiency[h.Type]
+}
+
+// formatRuntime renders minutes as h:mm.
+func formatRuntime(minutes float64) string {
+	m := int(math.Ceil(minutes))
+	return fmt.Sprintf("%d:%02d", m/60, m%60)
+}
+
+// applyZoneRuntimes fills each zone's run time recommendation for its
+// installed hardware.
+func (ep *EdgeProcessor) applyZoneRuntimes(stats []ZoneStats) {
+	if len(ep.config.IrrigationHardware) == 0 {
+		return
+	}
+	byZone := make(map[string]IrrigationHardware, len(ep.config.IrrigationHardware))
+	for _, h := range ep.config.IrrigationHardware {
+		byZone[h.ZoneID] = h
+	}
+	for i := range stats {
+		s := &stats[i]
+		h, ok := byZone[s.ZoneID]
+		if !ok {
+			continue
+		}
+		s.HardwareType = h.Type
+		rate := h.applicationRate(s.AreaM2)
+		s.ApplicationRateMMH = rate
+		if irrigationNeedRank[s.IrrigationNeed] < irrigationNeedRank["medium"] || s.WaterDeficitMeanMM <= 0 {
+			s.Runtime = formatRuntime(0)
+			continue
+		}
+		if rate <= 0 {
+			ep.cycleLog.Warn("No application rate for zone hardware", "component", "zones", "zone_id", s.ZoneID, "type", h.Type)
+			continue
+		}
+		s.GrossDepthMM = leachedDepth(s.WaterDeficitMeanMM, s.LeachingFraction) / ep.hardwareEfficiency(h)
+		s.RuntimeMinutes = math.Ceil(s.GrossDepthMM / rate * 60)
+		s.Runtime = formatRuntime(s.RuntimeMinutes)
+		s.Sets = 1
+		if h.MaxSetHours > 0 {
+			s.Sets = int(math.Ceil(s.RuntimeMinutes / (h.MaxSetHours * 60)))
+		}
+	}
+}
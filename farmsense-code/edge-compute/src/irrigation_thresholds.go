@@ -0,0 +1,98 @@
+// Irrigation Thresholds - management allowed depletion by crop and stage
+// With a crop model, irrigation_need grades the projected depletion
+// against readily available water, RAW = MAD × TAW. MAD (management
+// allowed depletion) defaults to the crop curve's FAO-56 depletion
+// fraction p at every stage, but growers manage away from it: almonds are
+// run drier into hull split, lettuce is kept near field capacity through
+// heading. irrigation_thresholds sets MAD per crop and growth stage, and
+// arrives with the rest of the config from the control-plane overlay:
+//
+//	"irrigation_thresholds": [
+//	  {"crop_type": "almonds", "mad_pct": 50},
+//	  {"crop_type": "almonds", "stage": "late_season", "mad_pct": 65},
+//	  {"crop_type": "lettuce", "mad_pct": 25, "breakpoints": [0.4, 0.7, 1.0, 1.2]}
+//	]
+//
+// A row for the crop's current stage beats its stage-less row, which beats
+// p. breakpoints are the depletion ÷ RAW ratios where need becomes low,
+// medium, high and critical (default 0.5, 0.8, 1.0, 1.3). Without a crop
+// model the fixed absolute-mm breakpoints still apply.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// defaultNeedBreakpoints grades depletion ÷ RAW into low, medium, high, critical.
+var defaultNeedBreakpoints = []float64{0.5, 0.8, 1.0, 1.3}
+
+// NeedThreshold is one row of the thresholds table.
+type NeedThreshold struct {
+	CropType    string    `json:"crop_type"`
+	Stage       string    `json:"stage,omitempty"`       // Growth stage; empty = every stage
+	MADPct      float64   `json:"mad_pct"`               // Management allowed depletion, % of TAW
+	Breakpoints []float64 `json:"breakpoints,omitempty"` // depletion ÷ RAW for low, medium, high, critical
+}
+
+var growthStages = []string{StagePrePlant, StageInitial, StageDevelopment, StageMid, StageLate, StagePostHarvest}
+
+// needThresholdFor finds the row for a crop at a stage, nil when none.
+func needThresholdFor(table []NeedThreshold, cropType, stage string) *NeedThreshold {
+	var general *NeedThreshold
+	for i := range table {
+		t := &table[i]
+		if t.CropType != cropType {
+			continue
+		}
+		if t.Stage == stage {
+			return t
+		}
+		if t.Stage == "" {
+			general = t
+		}
+	}
+	return general
+}
+
+// applyNeedThreshold replaces the curve's MAD on day with the table's.
+func applyNeedThreshold(day *CropDay, table []NeedThreshold) {
+	t := needThresholdFor(table, day.CropType, day.Stage)
+	if t == nil {
+		return
+	}
+	if t.MADPct > 0 {
+		day.MADPct = t.MADPct
+		day.RAWMM = t.MADPct / 100 * day.TAWMM
+	}
+	if len(t.Breakpoints) > 0 {
+		day.NeedBreakpoints = t.Breakpoints
+	}
+	day.ThresholdSource = "config"
+}
+
+// validateNeedThresholds checks the table's rows.
+func validateNeedThresholds(table []NeedThreshold) error {
+	seen := make(map[string]bool)
+	for i, t := range table {
+		if t.CropType == "" {
+			return fmt.Errorf("row %d: crop_type is required", i)
+		}
+		if t.Stage != "" && !containsString(growthStages, t.Stage) {
+			return fmt.Errorf("row %d: unknown stage %q", i, t.Stage)
+		}
+		key := t.CropType + "/" + t.Stage
+		if seen[key] {
+			return fmt.Errorf("row %d: duplicate row for %s", i, key)
+		}
+		seen[key] = true
+		if t.MADPct < 0 || t.MADPct > 100 {
+			return fmt.Errorf("row %d: mad_pct must be 0-100 (got %g)", i, t.MADPct)
+		}
+		if len(t.Breakpoints) > 0 && (len(t.Breakpoints) != 4 || !sort.Float64sAreSorted(t.Breakpoints) || t.Breakpoints[0] <= 0) {
+			return fmt.Errorf("row %d: breakpoints must be 4 ascending positive ratios", i)
+		}
+	}
+	return nil
+}
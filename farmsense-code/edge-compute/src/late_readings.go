@@ -0,0 +1,320 @@
+// Late Readings - duplicate readings and readings that miss their cycle
+// Gateways retransmit and LoRa uplinks arrive twice or minutes late. A
+// reading is identified by (sensor_id, timestamp): the local cache keeps
+// one row per key (lorawan_ingest.go counts the rest as duplicates on
+// /lorawan/devices), a retransmitted frame with a later receive time is
+// recognized by its frame counter, and a cycle's readings are deduplicated
+// on the key once more after the fetch, because the cloud table has no
+// such constraint.
+//
+// A reading that lands after a cycle whose sensor window covers it was
+// missing from that cycle. Each batch records the local reading rowid
+// high-water its fetch could see (reading_mark), so at the start of every
+// cycle the readings decoded on this gateway since the last check are
+// matched against the batches whose window they fall in and that couldn't
+// have seen them. Those batches are marked superseded (superseded_at in
+// /grid/batches, propagated to the cloud's grid_batches once the batch is
+// there, Postgres stores only), and with late_reading_policy recompute,
+// the default, their cycles are recomputed as a targeted backfill once no
+// other backfill is running; queued readings are forwarded first so a
+// recompute against the cloud sees them. supersede only marks, ignore
+// does neither. Readings older than late_reading_max_hours (imports of
+// logger history) are left to an explicit backfill.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Late reading policies
+const (
+	LateReadingRecompute = "recompute"
+	LateReadingSupersede = "supersede"
+	LateReadingIgnore    = "ignore"
+)
+
+const (
+	defaultLateReadingMaxHours = 24.0
+	lateReadingScanLimit       = 5000 // rows per check; the rest wait for the next cycle
+	loraRetransmitWindow       = time.Hour
+)
+
+// lateReadingTracker holds the late reading check's state (Run goroutine
+// only).
+type lateReadingTracker struct {
+	scanned int64          // last local reading rowid checked
+	started bool           // scanned has been initialized
+	pending map[int64]bool // cycle_at (unix) waiting for a recompute
+}
+
+func newLateReadingTracker() *lateReadingTracker {
+	return &lateReadingTracker{pending: make(map[int64]bool)}
+}
+
+// validLateReadingPolicy reports whether a policy is recognized; empty is
+// recompute.
+func validLateReadingPolicy(policy string) bool {
+	switch policy {
+	case "", LateReadingRecompute, LateReadingSupersede, LateReadingIgnore:
+		return true
+	}
+	return false
+}
+
+// dedupeReadings drops repeats of (sensor_id, timestamp), keeping the
+// first, and returns how many it dropped.
+func dedupeReadings(sensors []SensorReading) ([]SensorReading, int) {
+	type key struct {
+		sensorID string
+		at       int64
+	}
+	seen := make(map[key]bool, len(sensors))
+	kept := sensors[:0]
+	for _, s := range sensors {
+		k := key{s.SensorID, s.Timestamp.UnixNano()}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		kept = append(kept, s)
+	}
+	return kept, len(sensors) - len(kept)
+}
+
+// localReadingMark is the newest local reading rowid.
+func (ep *EdgeProcessor) localReadingMark() int64 {
+	var mark int64
+	if err := ep.localDB.QueryRow(`SELECT COALESCE(MAX(rowid), 0) FROM soil_sensor_readings`).Scan(&mark); err != nil {
+		ep.cycleLog.Warn("Failed to read local reading high-water", "component", "late_readings", "error", err)
+	}
+	return mark
+}
+
+// lateReading is a local reading checked against earlier batches.
+type lateReading struct {
+	rowID int64
+	at    time.Time
+}
+
+// lateBatch is a batch a late reading may have missed.
+type lateBatch struct {
+	id      string
+	cycleAt time.Time
+	mark    int64
+}
+
+// checkLateReadings supersedes the batches readings arrived too late for
+// and queues their recompute. Call at the start of a cycle, before its
+// readings are fetched.
+func (ep *EdgeProcessor) checkLateReadings() {
+	policy := ep.config.LateReadingPolicy
+	lt := ep.lateReadings
+	if policy == LateReadingIgnore {
+		return
+	}
+	if !lt.started {
+		lt.scanned, lt.started = ep.localReadingMark(), true
+		return
+	}
+
+	mark := ep.localReadingMark()
+	late, err := ep.readingsBetween(lt.scanned, mark)
+	if err != nil {
+		ep.cycleLog.Warn("Failed to check for late readings", "component", "late_readings", "error", err)
+		return
+	}
+	if len(late) == lateReadingScanLimit {
+		mark = late[len(late)-1].rowID
+	}
+	var affected []lateBatch
+	if len(late) > 0 {
+		if affected, err = ep.batchesMissing(late); err != nil {
+			// The scan stays put, so these readings are matched next cycle
+			ep.cycleLog.Warn("Failed to match late readings to cycles", "component", "late_readings", "error", err)
+			return
+		}
+	}
+	lt.scanned = mark
+	if len(affected) > 0 {
+		ep.supersedeBatches(affected)
+		if policy != LateReadingSupersede {
+			for _, b := range affected {
+				lt.pending[b.cycleAt.Unix()] = true
+			}
+		}
+		ep.cycleLog.Info("Late readings superseded earlier cycles", "component", "late_readings",
+			"readings", len(late), "batches", len(affected), "policy", ep.lateReadingPolicy())
+	}
+	ep.maybeRecomputeLate()
+}
+
+func (ep *EdgeProcessor) lateReadingPolicy() string {
+	if ep.config.LateReadingPolicy == "" {
+		return LateReadingRecompute
+	}
+	return ep.config.LateReadingPolicy
+}
+
+// readingsBetween returns this gateway's own recent readings with rowids
+// in (after, upTo].
+func (ep *EdgeProcessor) readingsBetween(after, upTo int64) ([]lateReading, error) {
+	maxHours := ep.config.LateReadingMaxHours
+	if maxHours <= 0 {
+		maxHours = defaultLateReadingMaxHours
+	}
+	cutoff := ep.clock.Now().Add(-time.Duration(maxHours * float64(time.Hour)))
+	rows, err := ep.localDB.Query(`
+		SELECT rowid, timestamp FROM soil_sensor_readings
+		WHERE rowid > ? AND rowid <= ? AND field_id = ? AND origin = ? AND timestamp >= ?
+		ORDER BY rowid
+		LIMIT ?
+	`, after, upTo, ep.config.FieldID, ReadingOriginLocal, readingTimestamp(cutoff), lateReadingScanLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]lateReading, 0)
+	for rows.Next() {
+		var r lateReading
+		if err := rows.Scan(&r.rowID, &r.at); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// batchesMissing returns the live batches whose sensor window holds a late
+// reading their fetch couldn't see.
+func (ep *EdgeProcessor) batchesMissing(late []lateReading) ([]lateBatch, error) {
+	from, to := late[0].at, late[0].at
+	for _, r := range late {
+		if r.at.Before(from) {
+			from = r.at
+		}
+		if r.at.After(to) {
+			to = r.at
+		}
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT batch_id, cycle_at, reading_mark FROM grid_batches
+		WHERE field_id = ? AND superseded_at IS NULL AND reading_mark IS NOT NULL
+		  AND cycle_at >= ? AND cycle_at <= ?
+	`, ep.config.FieldID, from.Unix(), to.Add(backfillSensorWindow).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]lateBatch, 0)
+	for rows.Next() {
+		var b lateBatch
+		var cycleAt int64
+		if err := rows.Scan(&b.id, &cycleAt, &b.mark); err != nil {
+			return nil, err
+		}
+		b.cycleAt = time.Unix(cycleAt, 0).UTC()
+		for _, r := range late {
+			if r.rowID > b.mark && r.at.After(b.cycleAt.Add(-backfillSensorWindow)) && !r.at.After(b.cycleAt) {
+				out = append(out, b)
+				break
+			}
+		}
+	}
+	return out, rows.Err()
+}
+
+// supersedeBatches marks batches as replaced by a later view of their
+// readings.
+func (ep *EdgeProcessor) supersedeBatches(batches []lateBatch) {
+	args := []interface{}{time.Now().Unix()}
+	for _, b := range batches {
+		args = append(args, b.id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batches)), ", ")
+	if _, err := ep.localDB.Exec(`UPDATE grid_batches SET superseded_at = ? WHERE batch_id IN (`+
+		placeholders+`)`, args...); err != nil {
+		ep.cycleLog.Warn("Failed to mark grid batches superseded", "component", "late_readings", "error", err)
+	}
+}
+
+// maybeRecomputeLate starts a backfill of the cycles late readings
+// superseded, unless another backfill holds the slot.
+func (ep *EdgeProcessor) maybeRecomputeLate() {
+	lt := ep.lateReadings
+	if len(lt.pending) == 0 || ep.backfill != nil {
+		return
+	}
+	cycles := make([]time.Time, 0, len(lt.pending))
+	for at := range lt.pending {
+		cycles = append(cycles, time.Unix(at, 0).UTC())
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i].Before(cycles[j]) })
+
+	ep.forwardRawReadings()
+	status, err := ep.StartBackfill(BackfillRequest{From: cycles[0], To: cycles[len(cycles)-1], Cycles: cycles})
+	if errors.Is(err, errBackfillRunning) {
+		return
+	}
+	if err != nil {
+		ep.cycleLog.Warn("Failed to start late reading recompute", "component", "late_readings", "error", err)
+		return
+	}
+	lt.pending = make(map[int64]bool)
+	ep.cycleLog.Info("Recomputing cycles with late readings", "component", "late_readings",
+		"backfill_id", status.ID, "cycles", len(cycles))
+}
+
+// syncSupersededBatches copies superseded marks to the cloud for batches
+// it already has.
+func (ep *EdgeProcessor) syncSupersededBatches() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	marks, err := ep.supersededToSync()
+	if err != nil {
+		ep.cycleLog.Warn("Failed to read superseded batches", "component", "late_readings", "error", err)
+		return
+	}
+	for id, at := range marks {
+		if _, err := db.Exec(`UPDATE grid_batches SET superseded_at = $2 WHERE batch_id = $1 AND superseded_at IS NULL`,
+			id, at); err != nil {
+			ep.cycleLog.Warn("Failed to upload superseded batch", "component", "late_readings", "batch_id", id, "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+		if _, err := ep.localDB.Exec(`UPDATE grid_batches SET superseded_synced = 1 WHERE batch_id = ?`, id); err != nil {
+			ep.cycleLog.Warn("Failed to record superseded upload", "component", "late_readings", "batch_id", id, "error", err)
+		}
+	}
+}
+
+// supersededToSync returns synced batches whose superseded mark hasn't
+// reached the cloud.
+func (ep *EdgeProcessor) supersededToSync() (map[string]time.Time, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT batch_id, superseded_at FROM grid_batches
+		WHERE field_id = ? AND superseded_at IS NOT NULL AND superseded_synced = 0 AND synced_at IS NOT NULL
+	`, ep.config.FieldID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	marks := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var at int64
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		marks[id] = time.Unix(at, 0).UTC()
+	}
+	return marks, rows.Err()
+}
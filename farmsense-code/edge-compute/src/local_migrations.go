@@ -0,0 +1,400 @@
+// Local Migrations - versioned schema upgrades for the local cache
+// Each feature creates its tables with CREATE TABLE IF NOT EXISTS in its
+// init...Schema, and adds columns with ensureLocalColumn. That covers new
+// tables and columns, not a change to an existing one: a column's type or
+// meaning, a new key, a table split, a rewrite of stored values. Those are
+// migrations here: numbered steps of up and down SQL appended to
+// localMigrations and never edited after a release.
+//
+// The cache's version is PRAGMA user_version (kept through encryption and
+// re-keying). NewEdgeProcessor migrates the cache before any init
+// function runs:
+//
+//	new cache    stamped with the latest version; the init functions
+//	             create the current layout
+//	older cache  copied beside itself (local_cache_db.v<version>.bak, the
+//	             newest local_migration_backups kept), then migrated up
+//	newer cache  after a firmware downgrade: copied, then rolled back with
+//	             the down SQL the newer build recorded in
+//	             local_schema_migrations, so the older build reads it
+//
+// Every step runs in one transaction with its version bump, so a crash or
+// a failed statement leaves the cache at the last good version. A failed
+// migration, or no room for the backup, is logged and the processor starts
+// on the layout it has: readings keep being cached and nothing is lost, and
+// the next start tries again. A step with up SQL and no down SQL can't be
+// rolled back; a downgrade across one is refused and needs a backup.
+//
+// migrate-cache runs the same engine by hand: -dry-run prints the plan and
+// its SQL, -to N rolls back (before flashing firmware older than this
+// engine, which wouldn't) and -restore puts a backup back with the daemon
+// stopped. A backup is a copy of the file, under the key the cache had
+// when it was taken.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLocalMigrationBackups = 2
+	localBackupSuffix            = ".bak"
+)
+
+// localMigration is one schema step. Release order is version order.
+type localMigration struct {
+	version int
+	name    string
+	up      string
+	down    string // "" with up set: irreversible
+}
+
+// localMigrations is every step since versioning began.
+var localMigrations = []localMigration{
+	{version: 1, name: "baseline"}, // the layout the init functions built before versioning
+}
+
+func latestLocalSchema() int {
+	return localMigrations[len(localMigrations)-1].version
+}
+
+// MigrationStep is one step of a plan.
+type MigrationStep struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"` // up or down
+	SQL       string `json:"sql,omitempty"`
+}
+
+// MigrationPlan takes the cache from its version to Target.
+type MigrationPlan struct {
+	Path    string          `json:"path"`
+	Current int             `json:"current"`
+	Target  int             `json:"target"`
+	New     bool            `json:"new"` // no tables yet: stamped, nothing run
+	Backup  string          `json:"backup,omitempty"`
+	Steps   []MigrationStep `json:"steps"`
+	Blocked string          `json:"blocked,omitempty"` // why the plan can't run
+}
+
+func initMigrationSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS local_schema_migrations (
+			version     INTEGER PRIMARY KEY,
+			name        TEXT    NOT NULL,
+			down_sql    TEXT    NOT NULL,
+			reversible  INTEGER NOT NULL,
+			applied_at  INTEGER NOT NULL,
+			app_version TEXT    NOT NULL
+		);
+	`)
+	return err
+}
+
+// migrateLocalCache brings the cache at path to this build's version.
+func migrateLocalCache(db *sql.DB, path string, backups int) error {
+	plan, err := planLocalMigration(db, path, latestLocalSchema())
+	if err != nil {
+		return err
+	}
+	return applyLocalMigration(db, plan, backups)
+}
+
+// planLocalMigration works out the steps from the cache's version to
+// target, without changing anything.
+func planLocalMigration(db *sql.DB, path string, target int) (MigrationPlan, error) {
+	plan := MigrationPlan{Path: path, Target: target, Steps: []MigrationStep{}}
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&plan.Current); err != nil {
+		return plan, fmt.Errorf("failed to read cache version: %v", err)
+	}
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`).Scan(&tables); err != nil {
+		return plan, fmt.Errorf("failed to read cache tables: %v", err)
+	}
+	plan.New = tables == 0 && plan.Current == 0
+	if plan.New || plan.Current == target {
+		return plan, nil
+	}
+	plan.Backup = localBackupPath(path, plan.Current)
+
+	if plan.Current < target {
+		for _, m := range localMigrations {
+			if m.version > plan.Current && m.version <= target {
+				plan.Steps = append(plan.Steps, MigrationStep{Version: m.version, Name: m.name, Direction: "up", SQL: strings.TrimSpace(m.up)})
+			}
+		}
+		return plan, nil
+	}
+
+	// Down: the newer build left its steps' down SQL in the cache
+	recorded := make(map[int]MigrationStep)
+	irreversible := make(map[int]bool)
+	rows, err := db.Query(`SELECT version, name, down_sql, reversible FROM local_schema_migrations WHERE version > ?`, target)
+	if err != nil {
+		return plan, fmt.Errorf("failed to read recorded migrations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s MigrationStep
+		var reversible bool
+		if err := rows.Scan(&s.Version, &s.Name, &s.SQL, &reversible); err != nil {
+			return plan, fmt.Errorf("failed to read recorded migrations: %v", err)
+		}
+		s.Direction = "down"
+		recorded[s.Version] = s
+		irreversible[s.Version] = !reversible
+	}
+	if err := rows.Err(); err != nil {
+		return plan, err
+	}
+	for v := plan.Current; v > target; v-- {
+		s, ok := recorded[v]
+		switch {
+		case !ok:
+			plan.Blocked = fmt.Sprintf("version %d left no record to roll back with; restore a backup", v)
+		case irreversible[v]:
+			plan.Blocked = fmt.Sprintf("version %d (%s) can't be rolled back; restore a backup", v, s.Name)
+		}
+		if plan.Blocked != "" {
+			plan.Steps = []MigrationStep{}
+			return plan, nil
+		}
+		plan.Steps = append(plan.Steps, s)
+	}
+	return plan, nil
+}
+
+// applyLocalMigration runs plan: a new cache is stamped, an existing one
+// backed up and stepped one transaction at a time.
+func applyLocalMigration(db *sql.DB, plan MigrationPlan, backups int) error {
+	logger := slog.With("component", "local_migrations", "path", plan.Path)
+	if plan.Blocked != "" {
+		return fmt.Errorf("cannot migrate local cache from version %d to %d: %s", plan.Current, plan.Target, plan.Blocked)
+	}
+	if err := initMigrationSchema(db); err != nil {
+		return fmt.Errorf("failed to create migration record: %v", err)
+	}
+	if plan.New {
+		if err := stampLocalSchema(db, plan.Target); err != nil {
+			return fmt.Errorf("failed to stamp local cache version: %v", err)
+		}
+		logger.Debug("New local cache stamped", "version", plan.Target)
+		return nil
+	}
+	if len(plan.Steps) == 0 {
+		return nil
+	}
+
+	if err := backupLocalCache(db, plan.Path, plan.Backup); err != nil {
+		return fmt.Errorf("failed to back up local cache before migrating: %v", err)
+	}
+	logger.Info("Local cache backed up", "backup", plan.Backup, "version", plan.Current)
+	pruneLocalBackups(plan.Path, backups)
+
+	for _, s := range plan.Steps {
+		start := time.Now()
+		if err := runMigrationStep(db, s); err != nil {
+			return fmt.Errorf("local cache migration %d (%s, %s) failed, cache left at version %d: %v",
+				s.Version, s.Name, s.Direction, stepFrom(s), err)
+		}
+		logger.Info("Local cache migrated", "version", s.Version, "name", s.Name,
+			"direction", s.Direction, "duration", time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// stepFrom is the version the cache is at before s.
+func stepFrom(s MigrationStep) int {
+	if s.Direction == "up" {
+		return s.Version - 1
+	}
+	return s.Version
+}
+
+// runMigrationStep applies one step, its record and its version bump in a
+// single transaction.
+func runMigrationStep(db *sql.DB, s MigrationStep) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.SQL != "" {
+		if _, err := tx.Exec(s.SQL); err != nil {
+			return err
+		}
+	}
+	version := s.Version
+	if s.Direction == "up" {
+		if err := recordMigration(tx, migrationByVersion(s.Version)); err != nil {
+			return err
+		}
+	} else {
+		version--
+		if _, err := tx.Exec(`DELETE FROM local_schema_migrations WHERE version = ?`, s.Version); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`PRAGMA user_version = ` + strconv.Itoa(version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrationByVersion(version int) localMigration {
+	for _, m := range localMigrations {
+		if m.version == version {
+			return m
+		}
+	}
+	return localMigration{version: version}
+}
+
+func recordMigration(tx *sql.Tx, m localMigration) error {
+	reversible := m.down != "" || m.up == ""
+	_, err := tx.Exec(`
+		INSERT OR REPLACE INTO local_schema_migrations (version, name, down_sql, reversible, applied_at, app_version)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, m.version, m.name, strings.TrimSpace(m.down), reversible, time.Now().Unix(), appVersion)
+	return err
+}
+
+// stampLocalSchema marks a new cache as built at version, recording every
+// step so a later downgrade can roll them back.
+func stampLocalSchema(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range localMigrations {
+		if m.version > version {
+			break
+		}
+		if err := recordMigration(tx, m); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`PRAGMA user_version = ` + strconv.Itoa(version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func localBackupPath(path string, version int) string {
+	return fmt.Sprintf("%s.v%d%s", path, version, localBackupSuffix)
+}
+
+// backupLocalCache copies the cache file to backup under a read
+// transaction, so no write lands halfway through the copy. The copy needs
+// the cache's size free on the card.
+func backupLocalCache(db *sql.DB, path, backup string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if free, _, err := diskFree(filepath.Dir(path)); err == nil && free < uint64(fi.Size())+uint64(fi.Size())/10 {
+		return fmt.Errorf("%d bytes free, the backup needs %d", free, fi.Size())
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master`).Scan(&n); err != nil {
+		return err
+	}
+	return copyFileAtomic(path, backup)
+}
+
+// copyFileAtomic copies src to dst through a temporary file, synced before
+// it replaces dst.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// localBackups lists path's migration backups, newest first.
+func localBackups(path string) []string {
+	matches, _ := filepath.Glob(path + ".v*" + localBackupSuffix)
+	modified := make(map[string]time.Time, len(matches))
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil {
+			modified[m] = fi.ModTime()
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return modified[matches[i]].After(modified[matches[j]]) })
+	return matches
+}
+
+// pruneLocalBackups keeps the newest keep backups of path.
+func pruneLocalBackups(path string, keep int) {
+	if keep <= 0 {
+		keep = defaultLocalMigrationBackups
+	}
+	for i, backup := range localBackups(path) {
+		if i < keep {
+			continue
+		}
+		if err := os.Remove(backup); err != nil {
+			slog.Warn("Failed to remove old cache backup", "component", "local_migrations", "backup", backup, "error", err)
+		}
+	}
+}
+
+// restoreLocalCache puts backup in place of the cache at path. Nothing may
+// have the cache open.
+func restoreLocalCache(path, backup string) error {
+	if _, err := os.Stat(backup); err != nil {
+		return err
+	}
+	if err := copyFileAtomic(backup, path); err != nil {
+		return fmt.Errorf("failed to replace local cache: %v", err)
+	}
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+	return nil
+}
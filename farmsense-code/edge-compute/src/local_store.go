@@ -0,0 +1,103 @@
+// Local Store - SQLite driver selection for the local cache
+// The cache can run on any of three database/sql SQLite drivers, each
+// compiled in by its own file:
+//
+//	modernc    modernc.org/sqlite, pure Go (sqlite_modernc.go; in every
+//	           build unless -tags no_modernc), so CGO_ENABLED=0
+//	           cross-compiles for ARM gateways work
+//	mattn      github.com/mattn/go-sqlite3, cgo (sqlite_mattn.go; with
+//	           -tags sqlite_mattn and cgo enabled), faster on the Jetson
+//	sqlcipher  github.com/mutecomm/go-sqlcipher, mattn with SQLCipher built
+//	           in (sqlite_sqlcipher.go; -tags sqlcipher and cgo, which
+//	           replaces mattn), the only one that opens an encrypted cache
+//	           (cache_encryption.go)
+//
+// local_cache_driver picks one; auto (the default) takes sqlcipher, then
+// mattn, when it is in the build and modernc otherwise. modernc is opened with
+// _time_format=sqlite so it writes timestamps in the same text form as
+// mattn, and a cache written by one can be read by the other.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Local cache drivers
+const (
+	LocalDriverAuto    = "auto"
+	LocalDriverModernc = "modernc"
+	LocalDriverMattn   = "mattn"
+
+	LocalDriverSQLCipher = "sqlcipher"
+)
+
+// localDriver is a SQLite driver compiled into this build.
+type localDriver struct {
+	sqlName  string                               // database/sql driver name
+	dsn      func(path string) string             // cache path to connection string
+	keyedDSN func(path string, key []byte) string // the same, opened under key; nil without encryption
+}
+
+// localDrivers is filled by the driver files' init functions.
+var localDrivers = map[string]localDriver{}
+
+// localDriverNames lists the drivers in this build.
+func localDriverNames() []string {
+	names := make([]string, 0, len(localDrivers))
+	for name := range localDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveLocalDriver maps local_cache_driver to a compiled-in driver.
+func resolveLocalDriver(name string) (string, error) {
+	if name == "" || name == LocalDriverAuto {
+		for _, pref := range []string{LocalDriverSQLCipher, LocalDriverMattn, LocalDriverModernc} {
+			if _, ok := localDrivers[pref]; ok {
+				return pref, nil
+			}
+		}
+		return "", fmt.Errorf("no SQLite driver in this build")
+	}
+	if _, ok := localDrivers[name]; !ok {
+		return "", fmt.Errorf("local_cache_driver %q is not in this build (have %s)", name,
+			strings.Join(localDriverNames(), ", "))
+	}
+	return name, nil
+}
+
+// dsnWithParam appends a query parameter to a SQLite path or URI.
+func dsnWithParam(path, param string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + param
+	}
+	return path + "?" + param
+}
+
+// openLocalCache opens the SQLite cache with the configured driver, under
+// its key when local_cache_encryption is on.
+func openLocalCache(config EdgeConfig, deviceID string) (*sql.DB, string, error) {
+	name, err := resolveLocalDriver(config.LocalCacheDriver)
+	if err != nil {
+		return nil, "", err
+	}
+	d := localDrivers[name]
+	if config.cacheEncrypted() {
+		db, err := openEncryptedCache(config, deviceID, d)
+		return db, name, err
+	}
+	if exists, plaintext, err := cacheFileState(config.LocalCacheDB); err == nil && exists && !plaintext {
+		return nil, "", fmt.Errorf("%s is not a plaintext SQLite database (encrypted? set local_cache_encryption and its key source)", config.LocalCacheDB)
+	}
+	db, err := sql.Open(d.sqlName, d.dsn(config.LocalCacheDB))
+	if err != nil {
+		return nil, "", err
+	}
+	return db, name, nil
+}
@@ -0,0 +1,184 @@
+// Structured Logging - leveled slog output for the fleet log collector
+// JSON by default so the collector can index field_id / cycle_id /
+// component without regexes. Recurring warnings and errors (e.g. the cloud
+// link being down for a day) are rate-limited: the first occurrence is
+// logged, repeats within the window are counted and summarized on the next
+// emission instead of flooding the SD card. The last recentLogLines
+// lines are also kept in memory for diagnostics uploads.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogRepeatWindow = 5 * time.Minute
+	recentLogLines         = 1000
+)
+
+// logLevel is shared by all handlers so config reloads can change it live.
+var logLevel = new(slog.LevelVar)
+
+// recentLogs holds the latest output lines of the process-wide logger.
+var recentLogs = &logRing{size: recentLogLines}
+
+// setupLogging installs the process-wide slog default from config.
+func setupLogging(config EdgeConfig, w io.Writer) *slog.Logger {
+	logLevel.Set(parseLogLevel(config.LogLevel))
+	opts := &slog.HandlerOptions{Level: logLevel}
+	w = io.MultiWriter(w, recentLogs)
+
+	var handler slog.Handler
+	if strings.EqualFold(config.LogFormat, "text") {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+
+	window := time.Duration(config.LogRepeatWindowSec) * time.Second
+	if window <= 0 {
+		window = defaultLogRepeatWindow
+	}
+	logger := slog.New(newRepeatLimitHandler(handler, window))
+	slog.SetDefault(logger)
+	return logger
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// validLogLevel reports whether parseLogLevel knows level.
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
+// logRing keeps the last size lines written to it. slog handlers write
+// one record per call.
+type logRing struct {
+	mu    sync.Mutex
+	size  int
+	lines []string
+	next  int
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	r.mu.Lock()
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, line)
+	} else {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % r.size
+	}
+	r.mu.Unlock()
+	return len(p), nil
+}
+
+// Tail returns up to n lines, oldest first.
+func (r *logRing) Tail(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ordered := append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// newCycleID returns a short random ID correlating all log lines of one
+// compute or sync cycle.
+func newCycleID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// repeatLimitHandler suppresses identical WARN/ERROR messages within a window.
+type repeatLimitHandler struct {
+	next   slog.Handler
+	window time.Duration
+	state  *repeatState // shared by handlers derived via WithAttrs/WithGroup
+}
+
+type repeatState struct {
+	mu      sync.Mutex
+	entries map[string]*repeatEntry
+}
+
+type repeatEntry struct {
+	lastEmitted time.Time
+	suppressed  int
+}
+
+func newRepeatLimitHandler(next slog.Handler, window time.Duration) *repeatLimitHandler {
+	return &repeatLimitHandler{
+		next:   next,
+		window: window,
+		state:  &repeatState{entries: make(map[string]*repeatEntry)},
+	}
+}
+
+func (h *repeatLimitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *repeatLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+
+	key := r.Level.String() + "|" + r.Message
+	h.state.mu.Lock()
+	entry, ok := h.state.entries[key]
+	if !ok {
+		entry = &repeatEntry{}
+		h.state.entries[key] = entry
+	}
+	if ok && r.Time.Sub(entry.lastEmitted) < h.window {
+		entry.suppressed++
+		h.state.mu.Unlock()
+		return nil
+	}
+	suppressed := entry.suppressed
+	entry.suppressed = 0
+	entry.lastEmitted = r.Time
+	h.state.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed_repeats", suppressed))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *repeatLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &repeatLimitHandler{next: h.next.WithAttrs(attrs), window: h.window, state: h.state}
+}
+
+func (h *repeatLimitHandler) WithGroup(name string) slog.Handler {
+	return &repeatLimitHandler{next: h.next.WithGroup(name), window: h.window, state: h.state}
+}
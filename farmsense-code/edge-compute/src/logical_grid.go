@@ -0,0 +1,161 @@
+// Logical Grid - greenhouse and indoor zones without GPS
+// A bay is laid out as rows × benches rather than lat/lon, and sensors are
+// placed by cell in config. Distance between cells is the number of
+// adjacency hops (4-connected, walking around blocked cells such as
+// walkways or partitions), so moisture doesn't "leak" through a wall the
+// way straight-line distance would let it. Output is the same
+// VirtualGridPoint as the field grid, so QC, derived metrics, alerting and
+// sync run unchanged; Row/Bench identify the cell and lat/lon stay zero.
+
+package main
+
+import "fmt"
+
+const defaultLogicalMaxHops = 3
+
+// LogicalGrid describes a greenhouse bay or indoor zone.
+type LogicalGrid struct {
+	ZoneID  string          `json:"zone_id"`  // Bay/house identifier used in grid IDs
+	Rows    int             `json:"rows"`     // Rows are numbered 1..Rows
+	Benches int             `json:"benches"`  // Benches per row, numbered 1..Benches
+	Blocked []LogicalCell   `json:"blocked"`  // Cells interpolation can't pass through
+	Sensors []LogicalSensor `json:"sensors"`  // Sensor placements by cell
+	MaxHops int             `json:"max_hops"` // Furthest sensor that contributes to a cell (default 3)
+}
+
+// LogicalCell is a row/bench coordinate.
+type LogicalCell struct {
+	Row   int `json:"row"`
+	Bench int `json:"bench"`
+}
+
+// LogicalSensor places a sensor on a cell.
+type LogicalSensor struct {
+	SensorID string `json:"sensor_id"`
+	Row      int    `json:"row"`
+	Bench    int    `json:"bench"`
+}
+
+func (g *LogicalGrid) contains(c LogicalCell) bool {
+	return c.Row >= 1 && c.Row <= g.Rows && c.Bench >= 1 && c.Bench <= g.Benches
+}
+
+func (g *LogicalGrid) index(c LogicalCell) int {
+	return (c.Row-1)*g.Benches + (c.Bench - 1)
+}
+
+func (g *LogicalGrid) cellAt(i int) LogicalCell {
+	return LogicalCell{Row: i/g.Benches + 1, Bench: i%g.Benches + 1}
+}
+
+// hopDistances runs a BFS from start and returns the hop count to every
+// cell, or -1 where the cell is blocked, unreachable or beyond maxHops.
+func (g *LogicalGrid) hopDistances(start LogicalCell, blocked []bool, maxHops int) []int {
+	dist := make([]int, g.Rows*g.Benches)
+	for i := range dist {
+		dist[i] = -1
+	}
+	if !g.contains(start) || blocked[g.index(start)] {
+		return dist
+	}
+
+	dist[g.index(start)] = 0
+	queue := []LogicalCell{start}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		d := dist[g.index(c)]
+		if d == maxHops {
+			continue
+		}
+		for _, next := range []LogicalCell{
+			{c.Row - 1, c.Bench}, {c.Row + 1, c.Bench},
+			{c.Row, c.Bench - 1}, {c.Row, c.Bench + 1},
+		} {
+			if !g.contains(next) {
+				continue
+			}
+			i := g.index(next)
+			if blocked[i] || dist[i] >= 0 {
+				continue
+			}
+			dist[i] = d + 1
+			queue = append(queue, next)
+		}
+	}
+	return dist
+}
+
+// generateLogicalGridID builds a stable ID from the bay and cell.
+func (ep *EdgeProcessor) generateLogicalGridID(g *LogicalGrid, c LogicalCell) string {
+	return fmt.Sprintf("%s_%s_r%03d_b%03d", ep.config.FieldID, g.ZoneID, c.Row, c.Bench)
+}
+
+// interpolateLogicalGrid interpolates every open cell of g by IDW over
+// adjacency hops, dropping cells without enough coverage.
+func (ep *EdgeProcessor) interpolateLogicalGrid(g *LogicalGrid, sensors []SensorReading) []VirtualGridPoint {
+	maxHops := g.MaxHops
+	if maxHops <= 0 {
+		maxHops = defaultLogicalMaxHops
+	}
+
+	blocked := make([]bool, g.Rows*g.Benches)
+	for _, c := range g.Blocked {
+		if g.contains(c) {
+			blocked[g.index(c)] = true
+		}
+	}
+
+	placements := make(map[string]LogicalCell, len(g.Sensors))
+	for _, s := range g.Sensors {
+		placements[s.SensorID] = LogicalCell{Row: s.Row, Bench: s.Bench}
+	}
+
+	// One BFS per occupied cell, shared by every reading from it
+	distances := make(map[LogicalCell][]int)
+	unplaced := 0
+	for _, s := range sensors {
+		c, ok := placements[s.SensorID]
+		if !ok {
+			unplaced++
+			continue
+		}
+		if _, done := distances[c]; !done {
+			distances[c] = g.hopDistances(c, blocked, maxHops)
+		}
+	}
+	if unplaced > 0 {
+		ep.cycleLog.Debug("Readings from sensors without a logical placement ignored", "readings", unplaced)
+	}
+
+	virtualPoints := make([]VirtualGridPoint, 0, len(blocked))
+	for i := range blocked {
+		if blocked[i] {
+			continue
+		}
+		neighbors := make([]sensorNeighbor, 0)
+		for _, s := range sensors {
+			c, ok := placements[s.SensorID]
+			if !ok {
+				continue
+			}
+			if hops := distances[c][i]; hops >= 0 {
+				neighbors = append(neighbors, sensorNeighbor{sensor: s, distance: float64(hops)})
+			}
+		}
+
+		c := g.cellAt(i)
+		cell := VirtualGridPoint{
+			GridID:          ep.generateLogicalGridID(g, c),
+			Row:             c.Row,
+			Bench:           c.Bench,
+			ComputationMode: "edge_logical",
+		}
+		if vp := ep.blendNeighbors(cell, neighbors); vp != nil {
+			virtualPoints = append(virtualPoints, *vp)
+		}
+	}
+
+	ep.cycleLog.Debug("Interpolated logical grid", "zone_id", g.ZoneID, "cells", len(virtualPoints))
+	return virtualPoints
+}
@@ -0,0 +1,151 @@
+// Cross-Validation - leave-one-out accuracy of each cycle's interpolation
+// Every cycle, each probe's location is predicted from the other probes
+// with the same neighbor search and interpolators the grid uses, and the
+// prediction is compared with what the probe actually read. RMSE, MAE and
+// bias per variable are an honest accuracy figure for the cycle, unlike
+// Confidence, which only reflects sensor count and spread. The root-zone
+// moisture RMSE is stamped on every grid point of the batch; the full
+// breakdown is served at /grid/accuracy and /metrics.
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+const accuracyHistorySize = 96 // one day of 15-minute cycles
+
+// VariableAccuracy is the LOOCV error for one variable.
+type VariableAccuracy struct {
+	Variable string  `json:"variable"`
+	RMSE     float64 `json:"rmse"`
+	MAE      float64 `json:"mae"`
+	Bias     float64 `json:"bias"` // mean(predicted − observed)
+	N        int     `json:"n"`    // probes that could be predicted
+}
+
+// CycleAccuracy is one cycle's cross-validation result.
+type CycleAccuracy struct {
+	CycleTime time.Time          `json:"cycle_time"`
+	Sensors   int                `json:"sensors"`
+	Variables []VariableAccuracy `json:"variables"`
+}
+
+// rootRMSE returns the root-zone moisture RMSE, or NaN if unknown.
+func (a *CycleAccuracy) rootRMSE() float64 {
+	for _, v := range a.Variables {
+		if v.Variable == VarMoistureRoot && v.N > 0 {
+			return v.RMSE
+		}
+	}
+	return math.NaN()
+}
+
+// crossValidate predicts each sensor from the others.
+func (ep *EdgeProcessor) crossValidate(sensors []SensorReading, cycleTime time.Time) *CycleAccuracy {
+	if ep.config.LogicalGrid != nil {
+		return nil // adjacency grids have no coordinates to predict at
+	}
+	type errSum struct {
+		sq, abs, bias float64
+		n             int
+	}
+	sums := make([]errSum, len(sensorVariables))
+	ep.leaveOneOut(sensors, func(_, vi int, e float64) {
+		sums[vi].sq += e * e
+		sums[vi].abs += math.Abs(e)
+		sums[vi].bias += e
+		sums[vi].n++
+	})
+
+	acc := &CycleAccuracy{CycleTime: cycleTime, Sensors: len(sensors), Variables: make([]VariableAccuracy, 0, len(sums))}
+	for vi, s := range sums {
+		va := VariableAccuracy{Variable: sensorVariables[vi].Name, N: s.n}
+		if s.n > 0 {
+			n := float64(s.n)
+			va.RMSE = math.Sqrt(s.sq / n)
+			va.MAE = s.abs / n
+			va.Bias = s.bias / n
+		}
+		acc.Variables = append(acc.Variables, va)
+	}
+	return acc
+}
+
+// leaveOneOut predicts each of sensors from the others and passes every
+// prediction's error (predicted − observed) to each with the held sensor's
+// index and the variable's index in sensorVariables.
+func (ep *EdgeProcessor) leaveOneOut(sensors []SensorReading, each func(held, vi int, e float64)) {
+	sensors = ep.detrendTemperatures(sensors) // the offsets cancel in the error
+	others := make([]SensorReading, 0, len(sensors))
+	samples := make([]NeighborSample, 0, len(sensors))
+	classes := make([]string, 0, len(sensors))
+
+	for i, held := range sensors {
+		others = others[:0]
+		others = append(others, sensors[:i]...)
+		others = append(others, sensors[i+1:]...)
+		neighbors := ep.neighborsWithin(orb.Point{held.Longitude, held.Latitude}, others)
+		if len(neighbors) < ep.config.MinSensors {
+			continue
+		}
+		var surfaces map[string]*rbfModel
+		if ep.cycleRBF != nil {
+			surfaces = ep.fitRBFModels(others)
+		}
+
+		for vi, v := range sensorVariables {
+			observed, ok := v.Read(held)
+			if !ok {
+				continue
+			}
+			samples, classes = samples[:0], classes[:0]
+			for _, n := range neighbors {
+				if value, ok := v.Read(n.sensor); ok {
+					samples = append(samples, NeighborSample{Distance: n.distance, Value: value})
+					classes = append(classes, n.sensor.class)
+				}
+			}
+			if len(samples) == 0 {
+				continue
+			}
+			predicted, ok := ep.estimateVariable(orb.Point{held.Longitude, held.Latitude}, v, samples, classes, surfaces)
+			if !ok {
+				continue
+			}
+			each(i, vi, predicted-observed)
+		}
+	}
+}
+
+// recordAccuracy cross-validates the cycle, stamps the batch and keeps
+// the result for the API.
+func (ep *EdgeProcessor) recordAccuracy(sensors []SensorReading, points []VirtualGridPoint, cycleTime time.Time) {
+	acc := ep.crossValidate(sensors, cycleTime)
+	if acc == nil {
+		return
+	}
+	if rmse := acc.rootRMSE(); !math.IsNaN(rmse) {
+		for i := range points {
+			points[i].LOOCVRMSE = rmse
+		}
+		ep.cycleLog.Debug("Interpolation cross-validated", "component", "loocv", "root_rmse_vwc", rmse)
+	}
+
+	ep.stateMu.Lock()
+	ep.accuracy = append(ep.accuracy, *acc)
+	if len(ep.accuracy) > accuracyHistorySize {
+		ep.accuracy = ep.accuracy[len(ep.accuracy)-accuracyHistorySize:]
+	}
+	ep.stateMu.Unlock()
+}
+
+// Accuracy returns recent cycles' cross-validation results, oldest first.
+func (ep *EdgeProcessor) Accuracy() []CycleAccuracy {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return append([]CycleAccuracy(nil), ep.accuracy...)
+}
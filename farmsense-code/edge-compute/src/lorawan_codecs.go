@@ -0,0 +1,165 @@
+// LoRaWAN Codecs - vendor payload decoders for soil probe uplinks
+// Each codec turns one uplink's FRMPayload into a partial reading;
+// location, sensor ID and timestamp come from the device registry and the
+// network server envelope. Supported out of the box:
+//   - dragino_lse01: Dragino LSE01 soil moisture/EC/temperature node
+//   - sentek:        Sentek Drill & Drop on a LoRaWAN logger, multi-depth
+//   - teralytic:     Teralytic soil probe, three moisture depths
+//
+// Further vendors register with RegisterPayloadCodec at init time.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DecodedUplink is the sensor data carried in one payload.
+type DecodedUplink struct {
+	MoistureSurface float64            // m³/m³
+	MoistureRoot    float64            // m³/m³
+	TempSurface     float64            // °C
+	BatteryVoltage  float64            // V, 0 = not reported
+	Profile         []DepthReading     // multi-depth probes, shallowest first
+	Channels        map[string]float64 // registered extra variables, e.g. soil_ec
+	Extras          map[string]float64 // vendor-specific channels (extra_channels.go)
+}
+
+// Sentek Drill & Drop sensor depths
+const (
+	sentekFirstDepthCm   = 5.0
+	sentekDepthSpacingCm = 10.0
+)
+
+// PayloadCodec decodes a raw uplink payload received on fPort.
+type PayloadCodec func(fPort int, payload []byte) (DecodedUplink, error)
+
+var (
+	codecMu       sync.RWMutex
+	payloadCodecs = map[string]PayloadCodec{
+		"dragino_lse01": decodeDraginoLSE01,
+		"sentek":        decodeSentek,
+		"teralytic":     decodeTeralytic,
+	}
+)
+
+// RegisterPayloadCodec adds or replaces a named codec.
+func RegisterPayloadCodec(name string, codec PayloadCodec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	payloadCodecs[name] = codec
+}
+
+// lookupPayloadCodec returns the named codec, or nil.
+func lookupPayloadCodec(name string) PayloadCodec {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	return payloadCodecs[name]
+}
+
+// payloadCodecNames lists registered codecs for validation messages.
+func payloadCodecNames() []string {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	names := make([]string, 0, len(payloadCodecs))
+	for name := range payloadCodecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decodeDraginoLSE01 decodes the LSE01 11-byte status uplink (fPort 2):
+// battery mV (14 bits), DS18B20 temp, soil moisture %×100, soil temp
+// °C×100, EC µS/cm, flags. The probe sits at one depth, so surface and
+// root moisture are the same reading; EC becomes the soil_ec channel.
+func decodeDraginoLSE01(fPort int, payload []byte) (DecodedUplink, error) {
+	if fPort != 2 {
+		return DecodedUplink{}, fmt.Errorf("lse01: ignoring fPort %d", fPort)
+	}
+	if len(payload) < 11 {
+		return DecodedUplink{}, fmt.Errorf("lse01: payload is %d bytes, want 11", len(payload))
+	}
+	batteryMV := binary.BigEndian.Uint16(payload[0:2]) & 0x3FFF
+	moisture := float64(binary.BigEndian.Uint16(payload[4:6])) / 100 / 100
+	soilTemp := float64(int16(binary.BigEndian.Uint16(payload[6:8]))) / 100
+	ecUSCm := float64(binary.BigEndian.Uint16(payload[8:10]))
+	return DecodedUplink{
+		MoistureSurface: moisture,
+		MoistureRoot:    moisture,
+		TempSurface:     soilTemp,
+		BatteryVoltage:  float64(batteryMV) / 1000,
+		Channels:        map[string]float64{VarSoilEC: ecUSCm / 1000},
+	}, nil
+}
+
+// decodeSentek decodes the logger's multi-depth frame: depth count, then
+// per depth (shallowest first) moisture %×100 and temperature °C×100,
+// then battery mV. The shallowest depth is surface moisture, the mean of
+// the rest is root-zone moisture. Depths aren't in the frame; the profile
+// assumes the standard 10 cm spacing from 5 cm (devices can set depths_cm).
+func decodeSentek(_ int, payload []byte) (DecodedUplink, error) {
+	if len(payload) < 1 {
+		return DecodedUplink{}, fmt.Errorf("sentek: empty payload")
+	}
+	depths := int(payload[0])
+	want := 1 + depths*4 + 2
+	if depths == 0 || len(payload) < want {
+		return DecodedUplink{}, fmt.Errorf("sentek: payload is %d bytes for %d depths, want %d", len(payload), depths, want)
+	}
+
+	var out DecodedUplink
+	rootSum := 0.0
+	for i := 0; i < depths; i++ {
+		off := 1 + i*4
+		moisture := float64(binary.BigEndian.Uint16(payload[off:off+2])) / 100 / 100
+		temp := float64(int16(binary.BigEndian.Uint16(payload[off+2:off+4]))) / 100
+		out.Profile = append(out.Profile, DepthReading{
+			DepthCm:     sentekFirstDepthCm + float64(i)*sentekDepthSpacingCm,
+			Moisture:    float64Ptr(moisture),
+			Temperature: float64Ptr(temp),
+		})
+		if i == 0 {
+			out.MoistureSurface = moisture
+			out.TempSurface = temp
+			continue
+		}
+		rootSum += moisture
+	}
+	out.MoistureRoot = out.MoistureSurface
+	if depths > 1 {
+		out.MoistureRoot = rootSum / float64(depths-1)
+	}
+	out.BatteryVoltage = float64(binary.BigEndian.Uint16(payload[want-2:want])) / 1000
+	return out, nil
+}
+
+// decodeTeralytic decodes the probe's measurement uplink (fPort 10):
+// moisture at 15/30/60 cm as m³/m³×1000, soil temperature °C×100 at 15 cm,
+// battery as 20 mV steps.
+func decodeTeralytic(fPort int, payload []byte) (DecodedUplink, error) {
+	if fPort != 10 {
+		return DecodedUplink{}, fmt.Errorf("teralytic: ignoring fPort %d", fPort)
+	}
+	if len(payload) < 9 {
+		return DecodedUplink{}, fmt.Errorf("teralytic: payload is %d bytes, want 9", len(payload))
+	}
+	m15 := float64(binary.BigEndian.Uint16(payload[0:2])) / 1000
+	m30 := float64(binary.BigEndian.Uint16(payload[2:4])) / 1000
+	m60 := float64(binary.BigEndian.Uint16(payload[4:6])) / 1000
+	temp := float64(int16(binary.BigEndian.Uint16(payload[6:8]))) / 100
+	return DecodedUplink{
+		MoistureSurface: m15,
+		MoistureRoot:    (m30 + m60) / 2,
+		TempSurface:     temp,
+		BatteryVoltage:  float64(payload[8]) * 0.02,
+		Profile: []DepthReading{
+			{DepthCm: 15, Moisture: float64Ptr(m15), Temperature: float64Ptr(temp)},
+			{DepthCm: 30, Moisture: float64Ptr(m30)},
+			{DepthCm: 60, Moisture: float64Ptr(m60)},
+		},
+	}, nil
+}
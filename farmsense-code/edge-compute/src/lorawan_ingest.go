@@ -0,0 +1,381 @@
+// LoRaWAN Ingest - network-server uplinks straight into the local cache
+// Subscribes to ChirpStack v4 or The Things Stack v3 application uplinks
+// on the local broker, looks the device up in lorawan_devices, decodes the
+// payload with the device's codec and inserts a SensorReading into the
+// local soil_sensor_readings table. This replaces the separate decoder
+// service that used to run alongside the processor on the Pi.
+// Redelivered uplinks (QoS 1, network server retries) are dropped by the
+// (sensor_id, timestamp) key, and a retransmitted frame received later is
+// dropped by its frame counter (late_readings.go). extra_channels rules add
+// vendor channels from the network server's decoded payload to the
+// codec's (extra_channels.go).
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Network servers
+const (
+	NetworkServerChirpStack = "chirpstack"
+	NetworkServerTTN        = "ttn"
+)
+
+const (
+	defaultTTNUplinkTopic = "v3/+/devices/+/up"
+	maxPlausibleVWC       = 0.65
+)
+
+// LoRaWANDevice maps a network-server device to a probe.
+type LoRaWANDevice struct {
+	DevEUI    string    `json:"dev_eui"`
+	SensorID  string    `json:"sensor_id"` // default: dev_eui
+	FieldID   string    `json:"field_id"`  // default: field_id
+	Codec     string    `json:"codec"`     // dragino_lse01 | sentek | teralytic | registered codec
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	DepthsCm  []float64 `json:"depths_cm,omitempty"` // Profile depths, shallowest first (default: codec's)
+}
+
+// LoRaWANDeviceStatus is per-device ingest state exposed by the API.
+type LoRaWANDeviceStatus struct {
+	DevEUI       string    `json:"dev_eui"`
+	SensorID     string    `json:"sensor_id"`
+	Codec        string    `json:"codec"`
+	Uplinks      int       `json:"uplinks"`
+	Stored       int       `json:"stored"`
+	Duplicates   int       `json:"duplicates"` // redeliveries and retransmitted frames dropped
+	DecodeErrors int       `json:"decode_errors"`
+	LastUplinkAt time.Time `json:"last_uplink_at"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Network server envelopes (only the fields we need)
+type chirpstackUplink struct {
+	Time       *time.Time `json:"time"`
+	DeviceInfo struct {
+		DevEUI string `json:"devEui"`
+	} `json:"deviceInfo"`
+	FCnt   uint32                 `json:"fCnt"`
+	FPort  int                    `json:"fPort"`
+	Data   []byte                 `json:"data"`
+	Object map[string]interface{} `json:"object"` // device profile codec output
+}
+
+type ttnUplink struct {
+	EndDeviceIDs struct {
+		DevEUI string `json:"dev_eui"`
+	} `json:"end_device_ids"`
+	ReceivedAt    time.Time `json:"received_at"`
+	UplinkMessage struct {
+		FCnt           uint32                 `json:"f_cnt"`
+		FPort          int                    `json:"f_port"`
+		FRMPayload     []byte                 `json:"frm_payload"`
+		DecodedPayload map[string]interface{} `json:"decoded_payload"` // payload formatter output
+		ReceivedAt     time.Time              `json:"received_at"`
+	} `json:"uplink_message"`
+}
+
+// localSensorQuery is fetchRecentSensors against the SQLite cache, which
+// stores plain coordinates instead of a PostGIS location.
+const localSensorQuery = `
+	SELECT sensor_id, timestamp, latitude, longitude,
+	       moisture_surface, moisture_root, temp_surface,
+	       battery_voltage, quality_flag, vertical_profile, channels, extras
+	FROM soil_sensor_readings
+	WHERE field_id = $1
+	  AND timestamp > $2
+	  AND timestamp <= $3
+	  AND quality_flag = 'valid'
+	ORDER BY timestamp DESC
+`
+
+// initLocalReadingsSchema creates the local sensor readings table.
+func initLocalReadingsSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS soil_sensor_readings (
+			sensor_id        TEXT     NOT NULL,
+			field_id         TEXT     NOT NULL,
+			timestamp        DATETIME NOT NULL,
+			latitude         REAL,
+			longitude        REAL,
+			moisture_surface REAL,
+			moisture_root    REAL,
+			temp_surface     REAL,
+			battery_voltage  REAL,
+			quality_flag     TEXT     NOT NULL DEFAULT 'valid',
+			origin           TEXT     NOT NULL DEFAULT 'local',
+			vertical_profile TEXT,
+			channels         TEXT,
+			extras           TEXT,
+			UNIQUE (sensor_id, timestamp)
+		);
+		CREATE INDEX IF NOT EXISTS soil_sensor_readings_field_time ON soil_sensor_readings (field_id, timestamp);
+	`)
+	if err != nil {
+		return err
+	}
+	if err := ensureReadingsOrigin(db); err != nil {
+		return err
+	}
+	if err := ensureLocalColumn(db, "soil_sensor_readings", "vertical_profile", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureLocalColumn(db, "soil_sensor_readings", "channels", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureLocalColumn(db, "soil_sensor_readings", "extras", "TEXT"); err != nil {
+		return err
+	}
+	return ensureLocalColumn(db, "soil_sensor_readings", "f_cnt", "INTEGER")
+}
+
+// UplinkIngestor decodes LoRaWAN uplinks into the local cache.
+type UplinkIngestor struct {
+	config  EdgeConfig
+	localDB *sql.DB
+	devices map[string]LoRaWANDevice // lower-case DevEUI
+	clock   *ReferenceClock
+	client  mqtt.Client
+	topic   string
+
+	mu     sync.Mutex
+	status map[string]*LoRaWANDeviceStatus
+	logger *slog.Logger
+}
+
+func NewUplinkIngestor(config EdgeConfig, localDB *sql.DB, clock *ReferenceClock) *UplinkIngestor {
+	topic := config.MQTTUplinkTopic
+	if topic == "" {
+		topic = defaultMQTTUplinkTopic
+		if config.LoRaWANNetworkServer == NetworkServerTTN {
+			topic = defaultTTNUplinkTopic
+		}
+	}
+	in := &UplinkIngestor{
+		config:  config,
+		localDB: localDB,
+		clock:   clock,
+		devices: make(map[string]LoRaWANDevice, len(config.LoRaWANDevices)),
+		topic:   topic,
+		status:  make(map[string]*LoRaWANDeviceStatus, len(config.LoRaWANDevices)),
+		logger:  slog.With("component", "lorawan"),
+	}
+	for _, d := range config.LoRaWANDevices {
+		eui := strings.ToLower(d.DevEUI)
+		if d.SensorID == "" {
+			d.SensorID = eui
+		}
+		if d.FieldID == "" {
+			d.FieldID = config.FieldID
+		}
+		in.devices[eui] = d
+		in.status[eui] = &LoRaWANDeviceStatus{DevEUI: eui, SensorID: d.SensorID, Codec: d.Codec}
+	}
+	return in
+}
+
+// Start connects to the broker and subscribes to uplinks.
+func (in *UplinkIngestor) Start() error {
+	if err := initLocalReadingsSchema(in.localDB); err != nil {
+		return fmt.Errorf("failed to create local readings table: %v", err)
+	}
+	client, err := newMQTTClient(in.config, "farmsense-ingest-"+in.config.DeviceID)
+	if err != nil {
+		return err
+	}
+	token := client.Subscribe(in.topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		in.handle(msg.Topic(), msg.Payload())
+	})
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		client.Disconnect(250)
+		return fmt.Errorf("timed out subscribing to %s", in.topic)
+	}
+	if err := token.Error(); err != nil {
+		client.Disconnect(250)
+		return fmt.Errorf("failed to subscribe to %s: %v", in.topic, err)
+	}
+	in.client = client
+	in.logger.Info("LoRaWAN ingest started", "topic", in.topic, "network_server", in.networkServer(),
+		"devices", len(in.devices))
+	return nil
+}
+
+func (in *UplinkIngestor) networkServer() string {
+	if in.config.LoRaWANNetworkServer == "" {
+		return NetworkServerChirpStack
+	}
+	return in.config.LoRaWANNetworkServer
+}
+
+// uplinkEnvelope is what ingest needs from a network server's uplink.
+type uplinkEnvelope struct {
+	devEUI  string
+	fCnt    uint32 // 0 = not given (ChirpStack omits a zero counter)
+	fPort   int
+	payload []byte
+	decoded map[string]interface{} // network server's decoded payload, if any
+	at      time.Time              // receive time, zero if not given
+}
+
+// parseEnvelope extracts DevEUI, frame counter, fPort, payload, decoded
+// payload and receive time.
+func (in *UplinkIngestor) parseEnvelope(body []byte) (uplinkEnvelope, error) {
+	if in.networkServer() == NetworkServerTTN {
+		var up ttnUplink
+		if err := json.Unmarshal(body, &up); err != nil {
+			return uplinkEnvelope{}, fmt.Errorf("invalid TTN uplink: %v", err)
+		}
+		at := up.UplinkMessage.ReceivedAt
+		if at.IsZero() {
+			at = up.ReceivedAt
+		}
+		return uplinkEnvelope{devEUI: up.EndDeviceIDs.DevEUI, fCnt: up.UplinkMessage.FCnt, fPort: up.UplinkMessage.FPort,
+			payload: up.UplinkMessage.FRMPayload, decoded: up.UplinkMessage.DecodedPayload, at: at}, nil
+	}
+
+	var up chirpstackUplink
+	if err := json.Unmarshal(body, &up); err != nil {
+		return uplinkEnvelope{}, fmt.Errorf("invalid ChirpStack uplink: %v", err)
+	}
+	env := uplinkEnvelope{devEUI: up.DeviceInfo.DevEUI, fCnt: up.FCnt, fPort: up.FPort, payload: up.Data,
+		decoded: up.Object}
+	if up.Time != nil {
+		env.at = *up.Time
+	}
+	return env, nil
+}
+
+// handle decodes and stores one uplink.
+func (in *UplinkIngestor) handle(topic string, body []byte) {
+	env, err := in.parseEnvelope(body)
+	if err != nil {
+		in.logger.Warn("Dropping uplink", "topic", topic, "error", err)
+		return
+	}
+	eui, at := strings.ToLower(env.devEUI), env.at
+	device, ok := in.devices[eui]
+	if !ok {
+		in.logger.Debug("Uplink from unregistered device", "dev_eui", eui)
+		return
+	}
+	if at.IsZero() {
+		at = in.clock.Now()
+	} else {
+		in.clock.ObserveGateway(at, time.Now())
+	}
+
+	decoded, err := func() (DecodedUplink, error) {
+		codec := lookupPayloadCodec(device.Codec)
+		if codec == nil {
+			return DecodedUplink{}, fmt.Errorf("unknown codec %q", device.Codec)
+		}
+		return codec(env.fPort, env.payload)
+	}()
+	stored := false
+	if err == nil {
+		decoded.Extras = extractExtras(in.config.ExtraChannels, device.Codec, env.decoded, decoded.Extras)
+		stored, err = storeDecodedReading(in.localDB, in.clock, device, readingTimestamp(at), env.fCnt, decoded)
+	}
+
+	in.mu.Lock()
+	st := in.status[eui]
+	st.Uplinks++
+	st.LastUplinkAt = at
+	switch {
+	case err != nil:
+		st.DecodeErrors++
+		st.LastError = err.Error()
+	case stored:
+		st.Stored++
+		st.LastError = ""
+	default:
+		st.Duplicates++
+	}
+	in.mu.Unlock()
+
+	if err != nil {
+		in.logger.Warn("Uplink not stored", "dev_eui", eui, "sensor_id", device.SensorID, "error", err)
+	}
+}
+
+// storeDecodedReading inserts a decoded reading, flagging untrustworthy
+// timestamps and physically implausible values. It reports false for a
+// reading already stored: the same (sensor_id, timestamp), or the same
+// frame counter within loraRetransmitWindow. Serial probes (serial_ingest.go)
+// store through it too, with no frame counter.
+func storeDecodedReading(db *sql.DB, clock *ReferenceClock, device LoRaWANDevice, at time.Time, fCnt uint32, d DecodedUplink) (bool, error) {
+	flag := clock.readingQuality(at)
+	if d.MoistureSurface < 0 || d.MoistureSurface > maxPlausibleVWC || d.MoistureRoot < 0 || d.MoistureRoot > maxPlausibleVWC {
+		flag = "out_of_range"
+	}
+	if len(device.DepthsCm) > 0 {
+		if len(device.DepthsCm) != len(d.Profile) {
+			return false, fmt.Errorf("depths_cm lists %d depths, payload has %d", len(device.DepthsCm), len(d.Profile))
+		}
+		for i := range d.Profile {
+			d.Profile[i].DepthCm = device.DepthsCm[i]
+		}
+	}
+	profile, err := encodeProfile(d.Profile)
+	if err != nil {
+		return false, err
+	}
+	channels, err := encodeChannels(d.Channels)
+	if err != nil {
+		return false, err
+	}
+	extras, err := encodeChannels(d.Extras)
+	if err != nil {
+		return false, err
+	}
+
+	var fCntArg interface{}
+	if fCnt > 0 {
+		fCntArg = fCnt
+		var seen int
+		if err := db.QueryRow(`
+			SELECT COUNT(*) FROM soil_sensor_readings
+			WHERE sensor_id = ? AND f_cnt = ? AND timestamp >= ? AND timestamp <= ?
+		`, device.SensorID, fCnt, readingTimestamp(at.Add(-loraRetransmitWindow)), at).Scan(&seen); err != nil {
+			return false, fmt.Errorf("failed to check for a retransmitted frame: %v", err)
+		}
+		if seen > 0 {
+			return false, nil
+		}
+	}
+	res, err := db.Exec(`
+		INSERT OR IGNORE INTO soil_sensor_readings
+			(sensor_id, field_id, timestamp, latitude, longitude, moisture_surface, moisture_root,
+			 temp_surface, battery_voltage, quality_flag, vertical_profile, channels, extras, f_cnt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, device.SensorID, device.FieldID, at, device.Latitude, device.Longitude,
+		d.MoistureSurface, d.MoistureRoot, d.TempSurface, d.BatteryVoltage, flag, profile, channels, extras, fCntArg)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert reading: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Status returns per-device ingest counters.
+func (in *UplinkIngestor) Status() []LoRaWANDeviceStatus {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := make([]LoRaWANDeviceStatus, 0, len(in.status))
+	for _, st := range in.status {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DevEUI < out[j].DevEUI })
+	return out
+}
@@ -0,0 +1,504 @@
+// Maintenance Schedule - battery forecasts and grouped field visits
+// Health scoring (sensor_health.go) warns when a battery is about to cross
+// its cutoff; crews need weeks of notice, and one trip per probe wastes
+// most of the day driving. Every few hours each probe's battery_voltage
+// over the last battery_history_days (default 30) is reduced to daily
+// medians, which hides the daily temperature swing, and a discharge
+// curve is fitted to them: a straight line, or a parabola once there
+// are two weeks of days and the decline is visibly speeding up (the knee
+// at the end of a pack's plateau). Where the curve crosses
+// battery_cutoff_v is the probe's forecast dead-by time.
+//
+// Probes forecast dead within maintenance_horizon_days (default 42), and
+// probes whose health score is below sensor_health_alert_score, are
+// planned into visits. The probe due soonest opens a visit, due
+// maintenance_lead_days (default 7) before its cutoff; every other
+// planned probe within maintenance_visit_radius_m (default 250) of it
+// joins, so its pack is swapped early rather than on a trip of its own.
+// Unhealthy probes are due now. Probes without a known position each get
+// a visit.
+//
+// GET /sensors/maintenance serves the forecasts and visits. Each plan
+// replaces the field's rows in the cloud sensor_maintenance_visits table
+// (migration 034) and adds the forecasts to sensor_health.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+const (
+	maintenancePlanInterval   = 6 * time.Hour
+	defaultBatteryHistoryDays = 30
+	defaultMaintenanceHorizon = 42
+	defaultMaintenanceLead    = 7
+	defaultMaintenanceRadiusM = 250.0
+	minBatteryDays            = 5
+	minQuadraticBatteryDays   = 14
+	quadraticGainRMSE         = 0.8   // parabola must cut the line's RMSE to this share
+	maxBatteryForecastDays    = 730.0 // beyond this the pack is not meaningfully declining
+)
+
+// Battery discharge models
+const (
+	BatteryModelLinear    = "linear"
+	BatteryModelQuadratic = "quadratic"
+)
+
+// Maintenance reasons
+const (
+	MaintenanceBattery = "battery"
+	MaintenanceHealth  = "health"
+)
+
+// BatteryForecast is one probe's fitted discharge curve.
+type BatteryForecast struct {
+	SensorID     string     `json:"sensor_id"`
+	Voltage      float64    `json:"voltage"`         // latest daily median
+	SlopeVPerDay float64    `json:"slope_v_per_day"` // at the latest day
+	Model        string     `json:"model"`
+	Days         int        `json:"days"` // daily medians fitted
+	RMSEV        float64    `json:"rmse_v"`
+	DaysLeft     *float64   `json:"days_left,omitempty"` // nil = not declining toward the cutoff
+	WeeksLeft    *float64   `json:"weeks_left,omitempty"`
+	DeadBy       *time.Time `json:"dead_by,omitempty"`
+}
+
+// MaintenanceStop is one probe on a visit.
+type MaintenanceStop struct {
+	SensorID  string     `json:"sensor_id"`
+	Reason    string     `json:"reason"` // battery | health
+	DeadBy    *time.Time `json:"dead_by,omitempty"`
+	Issues    []string   `json:"issues,omitempty"`
+	Latitude  float64    `json:"latitude,omitempty"`
+	Longitude float64    `json:"longitude,omitempty"`
+}
+
+// MaintenanceVisit is one trip to the field.
+type MaintenanceVisit struct {
+	VisitID   string            `json:"visit_id"`
+	DueBy     time.Time         `json:"due_by"`
+	Latitude  float64           `json:"latitude,omitempty"` // first probe's position
+	Longitude float64           `json:"longitude,omitempty"`
+	Stops     []MaintenanceStop `json:"stops"`
+}
+
+// MaintenancePlan is the field's latest forecasts and visits.
+type MaintenancePlan struct {
+	PlannedAt time.Time          `json:"planned_at"`
+	Forecasts []BatteryForecast  `json:"forecasts"`
+	Visits    []MaintenanceVisit `json:"visits"`
+}
+
+// batterySample is one voltage reading with where it was sent from.
+type batterySample struct {
+	at       time.Time
+	voltage  float64
+	lat, lon float64
+}
+
+const cloudBatteryQuery = `
+	SELECT sensor_id, timestamp, COALESCE(battery_voltage, 0),
+	       COALESCE(ST_Y(location::geometry), 0), COALESCE(ST_X(location::geometry), 0)
+	FROM soil_sensor_readings
+	WHERE field_id = $1 AND timestamp > $2
+	ORDER BY timestamp
+`
+
+const localBatteryQuery = `
+	SELECT sensor_id, timestamp, COALESCE(battery_voltage, 0), COALESCE(latitude, 0), COALESCE(longitude, 0)
+	FROM soil_sensor_readings
+	WHERE field_id = ? AND timestamp > ?
+	ORDER BY timestamp
+`
+
+// batteryHistory returns each probe's readings since a cutoff, oldest
+// first, from the cloud or else the local cache.
+func (ep *EdgeProcessor) batteryHistory(since time.Time) (map[string][]batterySample, error) {
+	var rows *sql.Rows
+	var err error
+	if db := ep.cloud.DB(); db != nil {
+		if rows, err = db.Query(cloudBatteryQuery, ep.config.FieldID, since); err != nil {
+			ep.logger.Warn("Cloud battery history query failed, using local cache", "component", "maintenance", "error", err)
+			ep.cloud.ReportFailure(err)
+		}
+	}
+	if rows == nil {
+		if rows, err = ep.localDB.Query(localBatteryQuery, ep.config.FieldID, readingTimestamp(since)); err != nil {
+			return nil, fmt.Errorf("failed to query battery history: %v", err)
+		}
+	}
+	defer rows.Close()
+
+	out := make(map[string][]batterySample)
+	for rows.Next() {
+		var id string
+		var s batterySample
+		if err := rows.Scan(&id, &s.at, &s.voltage, &s.lat, &s.lon); err != nil {
+			return nil, fmt.Errorf("failed to read battery history: %v", err)
+		}
+		out[id] = append(out[id], s)
+	}
+	return out, rows.Err()
+}
+
+// dailyMedians reduces voltage samples to one median per UTC day, at noon.
+func dailyMedians(samples []batterySample) ([]time.Time, []float64) {
+	byDay := make(map[time.Time][]float64)
+	for _, s := range samples {
+		if s.voltage > 0 {
+			day := s.at.UTC().Truncate(24 * time.Hour)
+			byDay[day] = append(byDay[day], s.voltage)
+		}
+	}
+	days := make([]time.Time, 0, len(byDay))
+	for d := range byDay {
+		days = append(days, d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	values := make([]float64, len(days))
+	for i, d := range days {
+		v := byDay[d]
+		sort.Float64s(v)
+		if n := len(v); n%2 == 1 {
+			values[i] = v[n/2]
+		} else {
+			values[i] = (v[n/2-1] + v[n/2]) / 2
+		}
+		days[i] = d.Add(12 * time.Hour)
+	}
+	return days, values
+}
+
+// fitPolynomial least-squares fits v ≈ Σ coef[k]·t^k for k < terms (2 or
+// 3) and returns the coefficients and RMSE.
+func fitPolynomial(t, v []float64, terms int) ([]float64, float64, bool) {
+	var m [3][4]float64
+	for i := range t {
+		pow := [5]float64{1, t[i], t[i] * t[i], t[i] * t[i] * t[i], t[i] * t[i] * t[i] * t[i]}
+		for r := 0; r < terms; r++ {
+			for c := 0; c < terms; c++ {
+				m[r][c] += pow[r+c]
+			}
+			m[r][terms] += pow[r] * v[i]
+		}
+	}
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < terms; col++ {
+		pivot := col
+		for r := col + 1; r < terms; r++ {
+			if math.Abs(m[r][col]) > math.Abs(m[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, 0, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for r := 0; r < terms; r++ {
+			if r == col {
+				continue
+			}
+			f := m[r][col] / m[col][col]
+			for c := col; c <= terms; c++ {
+				m[r][c] -= f * m[col][c]
+			}
+		}
+	}
+	coef := make([]float64, terms)
+	for k := range coef {
+		coef[k] = m[k][terms] / m[k][k]
+	}
+	var sq float64
+	for i := range t {
+		d := v[i] - evalPolynomial(coef, t[i])
+		sq += d * d
+	}
+	return coef, math.Sqrt(sq / float64(len(t))), true
+}
+
+func evalPolynomial(coef []float64, t float64) float64 {
+	v := 0.0
+	for k := len(coef) - 1; k >= 0; k-- {
+		v = v*t + coef[k]
+	}
+	return v
+}
+
+// forecastBattery fits a probe's discharge curve; false with too few days
+// of voltage.
+func forecastBattery(id string, samples []batterySample, cutoff float64) (BatteryForecast, bool) {
+	days, values := dailyMedians(samples)
+	if len(days) < minBatteryDays {
+		return BatteryForecast{}, false
+	}
+	t := make([]float64, len(days))
+	for i, d := range days {
+		t[i] = d.Sub(days[0]).Hours() / 24
+	}
+	coef, rmse, ok := fitPolynomial(t, values, 2)
+	if !ok {
+		return BatteryForecast{}, false
+	}
+	f := BatteryForecast{SensorID: id, Voltage: values[len(values)-1], Model: BatteryModelLinear, Days: len(days)}
+	if len(days) >= minQuadraticBatteryDays {
+		if q, qRMSE, ok := fitPolynomial(t, values, 3); ok && q[2] < 0 && qRMSE < rmse*quadraticGainRMSE {
+			coef, rmse, f.Model = q, qRMSE, BatteryModelQuadratic
+		}
+	}
+	f.RMSEV = rmse
+
+	last := t[len(t)-1]
+	slope := coef[1]
+	if len(coef) == 3 {
+		slope += 2 * coef[2] * last
+	}
+	f.SlopeVPerDay = slope
+	now := evalPolynomial(coef, last)
+
+	var left float64
+	switch {
+	case now <= cutoff:
+		left = 0
+	case len(coef) == 2:
+		if slope >= 0 {
+			return f, true
+		}
+		left = (now - cutoff) / -slope
+	default:
+		// Later root of c·t² + b·t + (a − cutoff) = 0; c < 0, so one lies past last
+		a, b, c := coef[0]-cutoff, coef[1], coef[2]
+		root := (-b - math.Sqrt(b*b-4*c*a)) / (2 * c)
+		left = root - last
+	}
+	if left > maxBatteryForecastDays || math.IsNaN(left) {
+		return f, true
+	}
+	weeks := left / 7
+	deadBy := days[len(days)-1].Add(time.Duration(left * 24 * float64(time.Hour))).Truncate(time.Second)
+	f.DaysLeft, f.WeeksLeft, f.DeadBy = &left, &weeks, &deadBy
+	return f, true
+}
+
+// planVisits groups probes needing attention into field visits.
+func planVisits(stops []MaintenanceStop, due map[string]time.Time, radiusM float64) []MaintenanceVisit {
+	sort.SliceStable(stops, func(i, j int) bool {
+		return due[stops[i].SensorID].Before(due[stops[j].SensorID])
+	})
+	located := func(s MaintenanceStop) bool { return s.Latitude != 0 || s.Longitude != 0 }
+	assigned := make([]bool, len(stops))
+	visits := make([]MaintenanceVisit, 0)
+	for i, seed := range stops {
+		if assigned[i] {
+			continue
+		}
+		assigned[i] = true
+		at := due[seed.SensorID]
+		v := MaintenanceVisit{
+			VisitID:   fmt.Sprintf("%s-%s", at.Format("20060102"), seed.SensorID),
+			DueBy:     at,
+			Latitude:  seed.Latitude,
+			Longitude: seed.Longitude,
+			Stops:     []MaintenanceStop{seed},
+		}
+		if located(seed) {
+			center := orb.Point{seed.Longitude, seed.Latitude}
+			for j := i + 1; j < len(stops); j++ {
+				if !assigned[j] && located(stops[j]) &&
+					geo.Distance(center, orb.Point{stops[j].Longitude, stops[j].Latitude}) <= radiusM {
+					assigned[j] = true
+					v.Stops = append(v.Stops, stops[j])
+				}
+			}
+		}
+		visits = append(visits, v)
+	}
+	return visits
+}
+
+// planMaintenance forecasts batteries and plans visits for the field.
+func (ep *EdgeProcessor) planMaintenance(now time.Time) (MaintenancePlan, error) {
+	historyDays := ep.config.BatteryHistoryDays
+	if historyDays <= 0 {
+		historyDays = defaultBatteryHistoryDays
+	}
+	horizon := ep.config.MaintenanceHorizonDays
+	if horizon <= 0 {
+		horizon = defaultMaintenanceHorizon
+	}
+	lead := ep.config.MaintenanceLeadDays
+	if lead <= 0 {
+		lead = defaultMaintenanceLead
+	}
+	radius := ep.config.MaintenanceRadiusM
+	if radius <= 0 {
+		radius = defaultMaintenanceRadiusM
+	}
+	cutoff := ep.config.BatteryCutoffV
+	if cutoff <= 0 {
+		cutoff = defaultBatteryCutoffV
+	}
+	alertScore := ep.config.SensorHealthAlertScore
+	if alertScore <= 0 {
+		alertScore = defaultSensorHealthAlert
+	}
+
+	history, err := ep.batteryHistory(now.AddDate(0, 0, -historyDays))
+	if err != nil {
+		return MaintenancePlan{}, err
+	}
+	plan := MaintenancePlan{PlannedAt: now.UTC(), Forecasts: make([]BatteryForecast, 0, len(history))}
+	stops := make(map[string]*MaintenanceStop)
+	due := make(map[string]time.Time)
+	stopFor := func(id string) *MaintenanceStop {
+		s := stops[id]
+		if s == nil {
+			s = &MaintenanceStop{SensorID: id}
+			if samples := history[id]; len(samples) > 0 {
+				s.Latitude, s.Longitude = samples[len(samples)-1].lat, samples[len(samples)-1].lon
+			}
+			stops[id] = s
+		}
+		return s
+	}
+
+	limit := now.AddDate(0, 0, horizon)
+	for id, samples := range history {
+		f, ok := forecastBattery(id, samples, cutoff)
+		if !ok {
+			continue
+		}
+		plan.Forecasts = append(plan.Forecasts, f)
+		if f.DeadBy == nil || f.DeadBy.After(limit) {
+			continue
+		}
+		s := stopFor(id)
+		s.Reason, s.DeadBy = MaintenanceBattery, f.DeadBy
+		at := f.DeadBy.AddDate(0, 0, -lead)
+		if at.Before(now) {
+			at = now
+		}
+		due[id] = at.UTC()
+	}
+	for _, h := range ep.SensorHealth() {
+		if h.Score >= alertScore {
+			continue
+		}
+		s := stopFor(h.SensorID)
+		if s.Reason == "" {
+			s.Reason = MaintenanceHealth
+		}
+		s.Issues = h.Issues
+		due[h.SensorID] = now.UTC()
+	}
+	sort.Slice(plan.Forecasts, func(i, j int) bool {
+		a, b := plan.Forecasts[i].DeadBy, plan.Forecasts[j].DeadBy
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		return plan.Forecasts[i].SensorID < plan.Forecasts[j].SensorID
+	})
+
+	list := make([]MaintenanceStop, 0, len(stops))
+	for _, s := range stops {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SensorID < list[j].SensorID })
+	plan.Visits = planVisits(list, due, radius)
+	return plan, nil
+}
+
+// maybePlanMaintenance re-plans every maintenancePlanInterval, after
+// health scoring, and syncs the plan.
+func (ep *EdgeProcessor) maybePlanMaintenance() {
+	now := time.Now()
+	if now.Sub(ep.lastMaintenancePlan) < maintenancePlanInterval {
+		return
+	}
+	ep.lastMaintenancePlan = now
+	plan, err := ep.planMaintenance(now)
+	if err != nil {
+		ep.logger.Error("Failed to plan sensor maintenance", "component", "maintenance", "error", err)
+		return
+	}
+	ep.stateMu.Lock()
+	ep.maintenancePlan = &plan
+	ep.stateMu.Unlock()
+	ep.logger.Info("Planned sensor maintenance", "component", "maintenance",
+		"forecasts", len(plan.Forecasts), "visits", len(plan.Visits))
+
+	if err := ep.syncMaintenancePlan(plan); err != nil {
+		ep.logger.Warn("Maintenance plan not synced, retrying next plan", "component", "maintenance", "error", err)
+	}
+}
+
+// MaintenancePlan returns the latest plan, nil before the first one.
+func (ep *EdgeProcessor) MaintenancePlan() *MaintenancePlan {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return ep.maintenancePlan
+}
+
+// syncMaintenancePlan replaces the field's visits in the cloud and adds
+// the battery forecasts to sensor_health.
+func (ep *EdgeProcessor) syncMaintenancePlan(plan MaintenancePlan) error {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return fmt.Errorf("cloud offline")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return fmt.Errorf("failed to begin maintenance upload: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM sensor_maintenance_visits WHERE field_id = $1`, ep.config.FieldID); err != nil {
+		return fmt.Errorf("failed to clear maintenance visits: %v", err)
+	}
+	for _, v := range plan.Visits {
+		stops, err := json.Marshal(v.Stops)
+		if err != nil {
+			return fmt.Errorf("failed to encode visit %s: %v", v.VisitID, err)
+		}
+		var lat, lon interface{}
+		if v.Latitude != 0 || v.Longitude != 0 {
+			lat, lon = v.Latitude, v.Longitude
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO sensor_maintenance_visits
+				(field_id, visit_id, due_by, latitude, longitude, stops, planned_at, edge_device_id)
+			VALUES ($1, $2, $3, $4, $5, $6::jsonb, $7, $8)
+		`, ep.config.FieldID, v.VisitID, v.DueBy, lat, lon, string(stops), plan.PlannedAt, ep.deviceID); err != nil {
+			return fmt.Errorf("failed to insert maintenance visit %s: %v", v.VisitID, err)
+		}
+	}
+	for _, f := range plan.Forecasts {
+		var deadBy interface{}
+		if f.DeadBy != nil {
+			deadBy = *f.DeadBy
+		}
+		if _, err := tx.Exec(`
+			UPDATE sensor_health SET battery_dead_by = $2, battery_slope_v_day = $3, battery_model = $4
+			WHERE sensor_id = $1
+		`, f.SensorID, deadBy, f.SlopeVPerDay, f.Model); err != nil {
+			return fmt.Errorf("failed to update battery forecast for %s: %v", f.SensorID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return fmt.Errorf("failed to commit maintenance upload: %v", err)
+	}
+	return nil
+}
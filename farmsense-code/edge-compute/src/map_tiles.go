@@ -0,0 +1,371 @@
+// Map Tiles - offline PNG heatmaps of the latest grid
+// Renders the latest cycle in the local grid history as PNG heatmaps, so
+// the embedded UI and an offline GIS viewer can show the field with no
+// internet tile server:
+//
+//	GET /tiles/<variable>/{z}/{x}/{y}.png  256×256 XYZ (Web Mercator) tiles,
+//	                                       transparent off the field
+//	GET /grid/map.png                      the whole field (?variable=&width=)
+//	export -format tiles                   the tile pyramid over the field for
+//	                                       -min-zoom..-max-zoom, written as
+//	                                       <out>/<variable>/{z}/{x}/{y}.png
+//
+// QGIS and most web maps take the /tiles URL as an XYZ source. Variables
+// are the grid_history columns export offers. Colors run dry (orange) to
+// wet (blue) like the UI heatmap, over a fixed range per variable so tiles
+// rendered at different zooms and cycles match; ?min=&max= override it.
+// Rendered tiles are kept under tile_cache_dir, keyed by cycle; a new cycle
+// replaces the field's cache. Logical (greenhouse) grids have no map.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	tileSize           = 256
+	maxTileZoom        = 22
+	tileAlpha          = 200
+	defaultTileDir     = "/data/tiles"
+	defaultMapWidth    = 600
+	maxMapWidth        = 2048
+	defaultMinTileZoom = 14
+	defaultMaxTileZoom = 19
+)
+
+var errNoGridHistory = errors.New("no grid history in the local cache yet")
+
+// tileRanges are the values at the dry and wet ends of each variable's
+// ramp; dry is above wet where more means drier.
+var tileRanges = map[string][2]float64{
+	"moisture_surface":    {0.05, 0.45},
+	"moisture_root":       {0.05, 0.45},
+	"temperature":         {40, 0},
+	"water_deficit_mm":    {60, 0},
+	"drydown_rate_mm_day": {8, 0},
+	"temp_trend_c_day":    {3, -3},
+	"hours_to_refill":     {0, 168},
+}
+
+// tileRamp maps values onto the heatmap colors.
+type tileRamp struct {
+	dry, wet float64
+}
+
+func defaultTileRamp(variable string) tileRamp {
+	r := tileRanges[variable]
+	return tileRamp{dry: r[0], wet: r[1]}
+}
+
+// color is the ramp's color for v: hue 30° (orange) to 220° (blue).
+func (r tileRamp) color(v float64) color.NRGBA {
+	t := 0.5
+	if r.wet != r.dry {
+		t = math.Max(0, math.Min(1, (v-r.dry)/(r.wet-r.dry)))
+	}
+	red, green, blue := hslToRGB(30+t*190, 0.65, 0.45)
+	return color.NRGBA{R: red, G: green, B: blue, A: tileAlpha}
+}
+
+func hslToRGB(h, s, l float64) (uint8, uint8, uint8) {
+	c := (1 - math.Abs(2*l-1)) * s
+	hp := h / 60
+	x := c * (1 - math.Abs(math.Mod(hp, 2)-1))
+	var r, g, b float64
+	switch {
+	case hp < 1:
+		r, g = c, x
+	case hp < 2:
+		r, g = x, c
+	case hp < 3:
+		g, b = c, x
+	case hp < 4:
+		g, b = x, c
+	case hp < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := l - c/2
+	return uint8(math.Round((r + m) * 255)), uint8(math.Round((g + m) * 255)), uint8(math.Round((b + m) * 255))
+}
+
+// at is the raster value at a point, NaN off the grid or without data.
+func (r geoRaster) at(lon, lat float64) float64 {
+	col := int(math.Floor((lon - r.west) / r.lonStep))
+	row := int(math.Floor((r.north - lat) / r.latStep))
+	if col < 0 || col >= r.cols || row < 0 || row >= r.rows {
+		return math.NaN()
+	}
+	return r.values[row*r.cols+col]
+}
+
+// tileLon and tileLat are the XYZ tile coordinate t's longitude and
+// latitude at zoom z; fractional t is inside a tile.
+func tileLon(t float64, z int) float64 {
+	return t/math.Exp2(float64(z))*360 - 180
+}
+
+func tileLat(t float64, z int) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*t/math.Exp2(float64(z))))) * 180 / math.Pi
+}
+
+// tileXY is the tile holding a point at zoom z.
+func tileXY(lon, lat float64, z int) (int, int) {
+	n := math.Exp2(float64(z))
+	x := int(math.Floor((lon + 180) / 360 * n))
+	latRad := lat * math.Pi / 180
+	y := int(math.Floor((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n))
+	clamp := func(v int) int { return int(math.Max(0, math.Min(n-1, float64(v)))) }
+	return clamp(x), clamp(y)
+}
+
+// tileBounds are the tiles covering the raster at zoom z.
+func (r geoRaster) tileBounds(z int) (x0, y0, x1, y1 int) {
+	x0, y0 = tileXY(r.west, r.north, z)
+	x1, y1 = tileXY(r.west+float64(r.cols)*r.lonStep, r.north-float64(r.rows)*r.latStep, z)
+	return
+}
+
+// renderTile draws tile z/x/y; false when no cell with data falls in it.
+func renderTile(r geoRaster, ramp tileRamp, z, x, y int) (*image.NRGBA, bool) {
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	lons := make([]float64, tileSize)
+	for px := range lons {
+		lons[px] = tileLon(float64(x)+(float64(px)+0.5)/tileSize, z)
+	}
+	painted := false
+	for py := 0; py < tileSize; py++ {
+		lat := tileLat(float64(y)+(float64(py)+0.5)/tileSize, z)
+		if lat > r.north || lat < r.north-float64(r.rows)*r.latStep {
+			continue
+		}
+		for px, lon := range lons {
+			if v := r.at(lon, lat); !math.IsNaN(v) {
+				img.SetNRGBA(px, py, ramp.color(v))
+				painted = true
+			}
+		}
+	}
+	return img, painted
+}
+
+// renderFieldMap draws the whole raster width pixels wide, with equal
+// metres per pixel both ways.
+func renderFieldMap(r geoRaster, ramp tileRamp, width int) *image.NRGBA {
+	midLat := r.north - float64(r.rows)*r.latStep/2
+	aspect := (float64(r.rows) * r.latStep) / (float64(r.cols) * r.lonStep * math.Cos(midLat*math.Pi/180))
+	height := int(math.Max(1, math.Round(float64(width)*aspect)))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for py := 0; py < height; py++ {
+		row := py * r.rows / height
+		for px := 0; px < width; px++ {
+			if v := r.values[row*r.cols+px*r.cols/width]; !math.IsNaN(v) {
+				img.SetNRGBA(px, py, ramp.color(v))
+			}
+		}
+	}
+	return img
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	emptyTileOnce sync.Once
+	emptyTile     []byte
+)
+
+// emptyTilePNG is a fully transparent tile.
+func emptyTilePNG() []byte {
+	emptyTileOnce.Do(func() {
+		emptyTile, _ = encodePNG(image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize)))
+	})
+	return emptyTile
+}
+
+// tileCache holds the latest cycle's rasters for the API.
+type tileCache struct {
+	mu      sync.Mutex
+	cycle   time.Time
+	cells   []historyCell
+	rasters map[string]geoRaster // by variable
+}
+
+func newTileCache() *tileCache {
+	return &tileCache{rasters: make(map[string]geoRaster)}
+}
+
+// latestCycleRaster returns the latest recorded cycle's raster of a
+// variable and the cycle's time.
+func (ep *EdgeProcessor) latestCycleRaster(variable string) (geoRaster, time.Time, error) {
+	band := exportBand(variable)
+	if band < 0 {
+		return geoRaster{}, time.Time{}, fmt.Errorf("unknown variable %q (one of %v)", variable, exportVariables)
+	}
+	if ep.config.LogicalGrid != nil {
+		return geoRaster{}, time.Time{}, errNoGeographicGrid
+	}
+	var latest sql.NullInt64
+	if err := ep.localDB.QueryRow(fmt.Sprintf(`SELECT MAX(timestamp) FROM %s WHERE field_id = ?`, ep.historyTable()),
+		ep.config.FieldID).Scan(&latest); err != nil {
+		return geoRaster{}, time.Time{}, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	if !latest.Valid {
+		return geoRaster{}, time.Time{}, errNoGridHistory
+	}
+	cycle := time.Unix(latest.Int64, 0).UTC()
+
+	tc := ep.tiles
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if !tc.cycle.Equal(cycle) {
+		cycles, err := ep.fetchGridHistory(time.Time{})
+		if err != nil {
+			return geoRaster{}, time.Time{}, err
+		}
+		tc.cycle, tc.cells, tc.rasters = cycle, cycles[cycle], make(map[string]geoRaster)
+	}
+	r, ok := tc.rasters[variable]
+	if !ok {
+		r = ep.cycleRaster(tc.cells, band, unitRule{scale: 1})
+		tc.rasters[variable] = r
+	}
+	return r, cycle, nil
+}
+
+// tileCacheDir is where the field's rendered tiles are kept.
+func (ep *EdgeProcessor) tileCacheDir() string {
+	dir := ep.config.TileCacheDir
+	if dir == "" {
+		dir = defaultTileDir
+	}
+	return filepath.Join(dir, ep.config.FieldID)
+}
+
+// Tile returns the PNG for tile z/x/y of the latest cycle and the cycle's
+// time. A nil ramp uses the variable's default range, whose tiles are
+// cached on disk.
+func (ep *EdgeProcessor) Tile(variable string, z, x, y int, ramp *tileRamp) ([]byte, time.Time, error) {
+	if z < 0 || z > maxTileZoom || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, time.Time{}, fmt.Errorf("no tile %d/%d/%d", z, x, y)
+	}
+	r, cycle, err := ep.latestCycleRaster(variable)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if x0, y0, x1, y1 := r.tileBounds(z); x < x0 || x > x1 || y < y0 || y > y1 {
+		return emptyTilePNG(), cycle, nil
+	}
+
+	var path string
+	if ramp == nil {
+		def := defaultTileRamp(variable)
+		ramp = &def
+		path = filepath.Join(ep.tileCacheDir(), strconv.FormatInt(cycle.Unix(), 10), variable,
+			strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+		if data, err := os.ReadFile(path); err == nil {
+			return data, cycle, nil
+		}
+	}
+	img, painted := renderTile(r, *ramp, z, x, y)
+	if !painted {
+		return emptyTilePNG(), cycle, nil
+	}
+	data, err := encodePNG(img)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if path != "" {
+		ep.cacheTile(path, cycle, data)
+	}
+	return data, cycle, nil
+}
+
+// cacheTile stores a rendered tile, dropping earlier cycles' tiles.
+func (ep *EdgeProcessor) cacheTile(path string, cycle time.Time, data []byte) {
+	root := ep.tileCacheDir()
+	current := strconv.FormatInt(cycle.Unix(), 10)
+	if entries, err := os.ReadDir(root); err == nil {
+		for _, e := range entries {
+			if e.Name() != current {
+				os.RemoveAll(filepath.Join(root, e.Name()))
+			}
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		ep.logger.Debug("Failed to cache map tile", "component", "tiles", "path", path, "error", err)
+	}
+}
+
+// FieldMap returns a PNG of the whole field for the latest cycle.
+func (ep *EdgeProcessor) FieldMap(variable string, width int, ramp *tileRamp) ([]byte, time.Time, error) {
+	if width <= 0 {
+		width = defaultMapWidth
+	}
+	if width > maxMapWidth {
+		return nil, time.Time{}, fmt.Errorf("width must be at most %d", maxMapWidth)
+	}
+	r, cycle, err := ep.latestCycleRaster(variable)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if ramp == nil {
+		def := defaultTileRamp(variable)
+		ramp = &def
+	}
+	data, err := encodePNG(renderFieldMap(r, *ramp, width))
+	return data, cycle, err
+}
+
+// writeTilePyramid writes the tiles over the field for zooms minZoom to
+// maxZoom under dir and returns the files written.
+func writeTilePyramid(dir string, r geoRaster, ramp tileRamp, minZoom, maxZoom int) ([]string, error) {
+	files := make([]string, 0)
+	for z := minZoom; z <= maxZoom; z++ {
+		x0, y0, x1, y1 := r.tileBounds(z)
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				img, painted := renderTile(r, ramp, z, x, y)
+				if !painted {
+					continue
+				}
+				data, err := encodePNG(img)
+				if err != nil {
+					return files, err
+				}
+				path := filepath.Join(dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return files, fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+				}
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					return files, fmt.Errorf("failed to write %s: %v", path, err)
+				}
+				files = append(files, path)
+			}
+		}
+	}
+	return files, nil
+}
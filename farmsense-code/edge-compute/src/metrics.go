@@ -0,0 +1,96 @@
+// Metrics - Prometheus text exposition for the local API
+// Hand-written gauges in the text format (version 0.0.4) so the node
+// exporter's scraper or a fleet Prometheus can pull edge state without a
+// client library on the device.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricLabels renders {k="v",...} in key order.
+func metricLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricWriter writes gauges, emitting HELP/TYPE once per name.
+type metricWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func (m *metricWriter) gauge(name, help string, labels map[string]string, value float64) {
+	if !m.seen[name] {
+		m.seen[name] = true
+		fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	fmt.Fprintf(m.w, "%s%s %g\n", name, metricLabels(labels), value)
+}
+
+// WriteMetrics writes the processor's gauges.
+func (ep *EdgeProcessor) WriteMetrics(w io.Writer) {
+	m := &metricWriter{w: w, seen: make(map[string]bool)}
+	field := map[string]string{"field_id": ep.config.FieldID}
+
+	if last := ep.health.LastCycle(); !last.IsZero() {
+		m.gauge("farmsense_last_cycle_age_seconds", "Seconds since the last completed grid cycle.", field, time.Since(last).Seconds())
+	}
+	m.gauge("farmsense_grid_points", "Grid points in the latest cycle.", field, float64(len(ep.LatestGrid())))
+
+	online := 0.0
+	if ep.isOnline.Load() {
+		online = 1
+	}
+	m.gauge("farmsense_cloud_online", "1 when the cloud database is reachable.", field, online)
+
+	if t := ep.ThrottleState(); t != nil {
+		m.gauge("farmsense_throttle_level", "Resource governor level: 0 normal, 1 throttled, 2 critical.", field, governorLevelValue(t.Level))
+		m.gauge("farmsense_interpolation_workers", "Goroutines interpolating cells at the current throttle level.", field, float64(t.Workers))
+		m.gauge("farmsense_effective_cpus", "CPUs available to the process (affinity and cgroup quota).", field, float64(t.EffectiveCPUs))
+		deferred := 0.0
+		if t.ExportsDeferred {
+			deferred = 1
+		}
+		m.gauge("farmsense_exports_deferred", "1 while non-critical exports wait out a throttle.", field, deferred)
+		if t.TempC != nil {
+			m.gauge("farmsense_soc_temperature_celsius", "SoC temperature at the last governor check.", field, *t.TempC)
+		}
+		if t.LoadPerCPU != nil {
+			m.gauge("farmsense_load_per_cpu", "1-minute load average per available CPU.", field, *t.LoadPerCPU)
+		}
+	}
+
+	history := ep.Accuracy()
+	if len(history) == 0 {
+		return
+	}
+	latest := history[len(history)-1]
+	for _, v := range latest.Variables {
+		if v.N == 0 {
+			continue
+		}
+		labels := map[string]string{"field_id": ep.config.FieldID, "variable": v.Variable}
+		m.gauge("farmsense_loocv_rmse", "Leave-one-out RMSE of the latest cycle's interpolation.", labels, v.RMSE)
+		m.gauge("farmsense_loocv_mae", "Leave-one-out MAE of the latest cycle's interpolation.", labels, v.MAE)
+		m.gauge("farmsense_loocv_bias", "Leave-one-out mean error (predicted - observed) of the latest cycle.", labels, v.Bias)
+		m.gauge("farmsense_loocv_sensors", "Probes predicted in the latest cycle's cross-validation.", labels, float64(v.N))
+	}
+}
@@ -0,0 +1,325 @@
+// Microclimate - terrain, canopy and water terms on interpolated temperature
+// Three thermometers interpolated by distance alone put the coldest cell
+// next to the coldest probe. On a still, clear night cold air drains
+// downhill and pools in the hollow with no probe in it, and that is where
+// the frost lands first.
+//
+// With any of microclimate_terrain, canopy_zones or water_bodies set, each
+// geographic cycle models temperature as a smooth field plus a local
+// offset:
+//
+//   - elevation, interpolated from the surveyed microclimate_terrain
+//     points, times lapse_rate_day_c_per_m by day (default -0.0065, the
+//     standard lapse rate) and inversion_night_c_per_m at night (default
+//     0.05, so hollows run colder)
+//   - canopy cover (0–1) of the first canopy_zones entry containing the
+//     point, times canopy_day_c (default -1.0, shade) or canopy_night_c
+//     (default 1.0, trapped long-wave)
+//   - proximity to the nearest water_bodies outline, water_day_c (default
+//     -0.5) or water_night_c (default 1.0) at the shore, fading linearly to
+//     nothing at water_range_m (default 150). Pond exclusion_zones are not
+//     taken as water on their own; list them here too.
+//
+// Day and night blend across civil twilight by the sun's elevation at the
+// probes' centroid and the cycle time (no equation of time, so up to a
+// quarter of an hour off). Each probe's offset is subtracted from its
+// temperature before anything is fitted (sensor class biases, RBF
+// surfaces), the residuals are interpolated, and the cell's own offset is
+// added back before derived metrics, so GDD, chill and stress see it.
+// Cross-validation and explain use the same residuals. The offset applied
+// is on each cell as the microclimate_offset_c variable. Logical grids are
+// left alone.
+//
+// frost_alert_c and heat_alert_c open an event when the coldest cell falls
+// to or the hottest rises to the threshold, raising one alert on the cell;
+// the event is held, without re-alerting, until every cell has been
+// temp_event_hysteresis_c (default 1) clear of it for temp_event_hold_min
+// (default 60), and closing raises an info alert with the extreme and how
+// long it lasted. A weather station's air temperature from the last half
+// hour (weather_stations.go) counts as a cell named station:<id>. Events
+// are held in memory; a restart mid-event opens it again.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+// CanopyZone is an area under a partial canopy.
+type CanopyZone struct {
+	Name     string       `json:"name"`
+	Cover    float64      `json:"cover"`    // Canopy cover fraction (0–1)
+	Boundary [][2]float64 `json:"boundary"` // Outline as [lon, lat] pairs
+}
+
+// WaterBody is open water that moderates nearby air temperature.
+type WaterBody struct {
+	Name     string       `json:"name"`
+	Boundary [][2]float64 `json:"boundary"` // Shoreline as [lon, lat] pairs
+}
+
+// Alert kinds
+const (
+	AlertFrost = "frost"
+	AlertHeat  = "heat"
+)
+
+// VarMicroclimateOffset is the offset added to a cell's temperature.
+const VarMicroclimateOffset = "microclimate_offset_c"
+
+const (
+	defaultLapseRateDay     = -0.0065
+	defaultInversionNight   = 0.05
+	defaultCanopyDayC       = -1.0
+	defaultCanopyNightC     = 1.0
+	defaultWaterDayC        = -0.5
+	defaultWaterNightC      = 1.0
+	defaultWaterRangeM      = 150.0
+	defaultTempEventHoldMin = 60
+	defaultTempHysteresisC  = 1.0
+	civilTwilightDeg        = 6.0
+)
+
+// microclimateModel is one cycle's offset field.
+type microclimateModel struct {
+	config EdgeConfig
+	night  float64 // 0 = day coefficients, 1 = night
+}
+
+// microclimateEnabled reports whether any microclimate input is set.
+func (c EdgeConfig) microclimateEnabled() bool {
+	return len(c.MicroclimateTerrain) > 0 || len(c.CanopyZones) > 0 || len(c.WaterBodies) > 0
+}
+
+// microclimateAt returns the cycle's model, nil when unconfigured or
+// without probes to place the sun.
+func (ep *EdgeProcessor) microclimateAt(sensors []SensorReading, at time.Time) *microclimateModel {
+	if !ep.config.microclimateEnabled() || len(sensors) == 0 {
+		return nil
+	}
+	var lon, lat float64
+	for _, s := range sensors {
+		lon += s.Longitude
+		lat += s.Latitude
+	}
+	n := float64(len(sensors))
+	elevation := solarElevation(lat/n, lon/n, at)
+	return &microclimateModel{
+		config: ep.config,
+		night:  math.Max(0, math.Min(1, -elevation/civilTwilightDeg)),
+	}
+}
+
+// solarElevation is the sun's approximate elevation in degrees.
+func solarElevation(lat, lon float64, at time.Time) float64 {
+	at = at.UTC()
+	rad := math.Pi / 180
+	declination := 23.44 * math.Sin(2*math.Pi*float64(284+at.YearDay())/365)
+	solarHours := float64(at.Hour()) + float64(at.Minute())/60 + lon/15
+	hourAngle := 15 * (solarHours - 12)
+	sin := math.Sin(lat*rad)*math.Sin(declination*rad) +
+		math.Cos(lat*rad)*math.Cos(declination*rad)*math.Cos(hourAngle*rad)
+	return math.Asin(math.Max(-1, math.Min(1, sin))) / rad
+}
+
+// blend picks between a day and a night coefficient, each defaulting when
+// unset.
+func (m *microclimateModel) blend(day, night, defaultDay, defaultNight float64) float64 {
+	if day == 0 {
+		day = defaultDay
+	}
+	if night == 0 {
+		night = defaultNight
+	}
+	return day*(1-m.night) + night*m.night
+}
+
+// offset is the modelled temperature offset at a point in °C.
+func (m *microclimateModel) offset(lon, lat float64) float64 {
+	c := m.config
+	total := 0.0
+	if elevation, ok := terrainElevation(c.MicroclimateTerrain, lon, lat); ok {
+		total += elevation * m.blend(c.LapseRateDayCPerM, c.InversionNightCPerM, defaultLapseRateDay, defaultInversionNight)
+	}
+	for _, z := range c.CanopyZones {
+		if pointInRing(lon, lat, z.Boundary) {
+			total += z.Cover * m.blend(c.CanopyDayC, c.CanopyNightC, defaultCanopyDayC, defaultCanopyNightC)
+			break
+		}
+	}
+	if len(c.WaterBodies) > 0 {
+		rangeM := c.WaterRangeM
+		if rangeM <= 0 {
+			rangeM = defaultWaterRangeM
+		}
+		if d := waterDistance(c.WaterBodies, lon, lat); d < rangeM {
+			total += (1 - d/rangeM) * m.blend(c.WaterDayC, c.WaterNightC, defaultWaterDayC, defaultWaterNightC)
+		}
+	}
+	return total
+}
+
+// terrainElevation interpolates the surveyed elevation at a point by
+// inverse distance squared.
+func terrainElevation(terrain [][3]float64, lon, lat float64) (float64, bool) {
+	if len(terrain) == 0 {
+		return 0, false
+	}
+	origin := orb.Point{lon, lat}
+	total, sum := 0.0, 0.0
+	for _, t := range terrain {
+		d := planarNorm(localMeters(origin, orb.Point{t[0], t[1]}))
+		if d < 1 {
+			return t[2], true
+		}
+		w := 1 / (d * d)
+		total += w
+		sum += w * t[2]
+	}
+	return sum / total, true
+}
+
+// waterDistance is the distance in metres from a point to the nearest
+// shoreline, 0 on the water.
+func waterDistance(bodies []WaterBody, lon, lat float64) float64 {
+	origin := orb.Point{lon, lat}
+	best := math.Inf(1)
+	for _, b := range bodies {
+		if pointInRing(lon, lat, b.Boundary) {
+			return 0
+		}
+		for i := range b.Boundary {
+			a, c := b.Boundary[i], b.Boundary[(i+1)%len(b.Boundary)]
+			d := segmentDistance(localMeters(origin, orb.Point{a[0], a[1]}), localMeters(origin, orb.Point{c[0], c[1]}))
+			best = math.Min(best, d)
+		}
+	}
+	return best
+}
+
+// detrendTemperatures returns a copy of sensors with the cycle's
+// microclimate offset taken off each temperature.
+func (ep *EdgeProcessor) detrendTemperatures(sensors []SensorReading) []SensorReading {
+	if ep.cycleMicro == nil {
+		return sensors
+	}
+	out := make([]SensorReading, len(sensors))
+	for i, s := range sensors {
+		s.TempSurface -= ep.cycleMicro.offset(s.Longitude, s.Latitude)
+		out[i] = s
+	}
+	return out
+}
+
+// retrendTemperature adds the cell's offset back to its residual
+// temperature.
+func (ep *EdgeProcessor) retrendTemperature(cell *VirtualGridPoint) {
+	if ep.cycleMicro == nil {
+		return
+	}
+	offset := ep.cycleMicro.offset(cell.Longitude, cell.Latitude)
+	cell.Temperature += offset
+	cell.setVariable(VarMicroclimateOffset, offset)
+}
+
+// temperatureEvent is an open frost or heat event.
+type temperatureEvent struct {
+	startedAt  time.Time
+	clearSince time.Time // zero while a cell is within the hysteresis band
+	extreme    float64
+	gridID     string
+}
+
+// checkTemperatureEvents opens, holds and closes frost and heat events
+// from the cycle's extreme cells.
+func (ep *EdgeProcessor) checkTemperatureEvents(points []VirtualGridPoint, at time.Time) {
+	if len(points) == 0 {
+		return
+	}
+	candidates := append(points[:len(points):len(points)], ep.stationTemperatures(at)...)
+	coldest, hottest := candidates[0], candidates[0]
+	for _, p := range candidates[1:] {
+		if p.Temperature < coldest.Temperature {
+			coldest = p
+		}
+		if p.Temperature > hottest.Temperature {
+			hottest = p
+		}
+	}
+	if ep.config.FrostAlertC != nil {
+		ep.trackTemperatureEvent(AlertFrost, coldest, *ep.config.FrostAlertC, -1, at)
+	}
+	if ep.config.HeatAlertC != nil {
+		ep.trackTemperatureEvent(AlertHeat, hottest, *ep.config.HeatAlertC, 1, at)
+	}
+}
+
+// trackTemperatureEvent advances one kind's event; sign is -1 for frost
+// (below the threshold is a breach) and 1 for heat.
+func (ep *EdgeProcessor) trackTemperatureEvent(kind string, cell VirtualGridPoint, threshold, sign float64, at time.Time) {
+	hysteresis := ep.config.TempEventHysteresisC
+	if hysteresis <= 0 {
+		hysteresis = defaultTempHysteresisC
+	}
+	holdMin := ep.config.TempEventHoldMin
+	if holdMin <= 0 {
+		holdMin = defaultTempEventHoldMin
+	}
+	label := "Frost"
+	if kind == AlertHeat {
+		label = "Heat"
+	}
+	excess := sign * (cell.Temperature - threshold) // >= 0 is a breach
+	ev := ep.tempEvents[kind]
+
+	if excess >= 0 {
+		if ev == nil {
+			ev = &temperatureEvent{startedAt: at, extreme: cell.Temperature, gridID: cell.GridID}
+			ep.tempEvents[kind] = ev
+			ep.alerts.Raise(Alert{
+				Kind:     kind,
+				Severity: SeverityWarning,
+				FieldID:  ep.config.FieldID,
+				Subject:  cell.GridID,
+				Message:  fmt.Sprintf("%s event: cell at %.1f °C against a %.1f °C threshold", label, cell.Temperature, threshold),
+				Value:    cell.Temperature,
+			})
+			ep.cycleLog.Warn("Temperature event opened", "component", "microclimate", "kind", kind,
+				"grid_id", cell.GridID, "temperature_c", cell.Temperature, "threshold_c", threshold)
+		}
+		if sign*(cell.Temperature-ev.extreme) > 0 {
+			ev.extreme, ev.gridID = cell.Temperature, cell.GridID
+		}
+		ev.clearSince = time.Time{}
+		return
+	}
+	if ev == nil {
+		return
+	}
+	if -excess < hysteresis {
+		ev.clearSince = time.Time{}
+		return
+	}
+	if ev.clearSince.IsZero() {
+		ev.clearSince = at
+	}
+	if at.Sub(ev.clearSince) < time.Duration(holdMin)*time.Minute {
+		return
+	}
+	delete(ep.tempEvents, kind)
+	lasted := ev.clearSince.Sub(ev.startedAt)
+	ep.alerts.Raise(Alert{
+		Kind:     kind,
+		Severity: SeverityInfo,
+		FieldID:  ep.config.FieldID,
+		Subject:  ev.gridID,
+		Message:  fmt.Sprintf("%s event over after %s; extreme %.1f °C", label, lasted.Round(time.Minute), ev.extreme),
+		Value:    ev.extreme,
+	})
+	ep.cycleLog.Info("Temperature event closed", "component", "microclimate", "kind", kind,
+		"grid_id", ev.gridID, "extreme_c", ev.extreme, "lasted_min", lasted.Minutes())
+}
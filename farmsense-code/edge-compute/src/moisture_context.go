@@ -0,0 +1,298 @@
+// Moisture Context - a cell's root moisture against its own history
+// 0.22 VWC is plenty on one cell and a stressed crop on its sandy
+// neighbour. Each cell also carries where its current root moisture sits
+// in its own record, from the local archive:
+//
+//	moisture_root_pct_30d         percentile (0-100) among the cell's daily
+//	moisture_root_pct_90d         means over the previous 30 and 90 days
+//	moisture_root_last_season     the cell's mean over the same week last
+//	                              season (the 7 days centred 52 weeks back,
+//	                              so weekdays line up)
+//	moisture_root_vs_last_season  current minus that mean
+//
+// Daily means are kept per cell in cell_moisture_daily, aggregated once a
+// day from grid_history for every finished day of the last 90 that isn't
+// there yet, so the archive outlives grid_history's shorter retention:
+// moisture_context_retention_days (default 400) keeps last season's week.
+// Days are the gateway's local days and the current day is never part of
+// its own context. A percentile needs a quarter of its window's days and
+// the last-season mean three days of its week; until then they are nil. A
+// backfill that rewrites a day's history drops that day's means, and the
+// next day's rebuild aggregates them again.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	defaultMoistureContextRetention = 400
+	moistureContextShortDays        = 30
+	moistureContextLongDays         = 90
+	moistureContextMinFraction      = 0.25 // of a window's days, for a percentile
+	lastSeasonOffsetDays            = 364  // 52 weeks
+	lastSeasonHalfWidthDays         = 3
+	lastSeasonMinDays               = 3
+	moistureDayFormat               = "2006-01-02"
+)
+
+// moistureContext is the archive behind one day's cycles.
+type moistureContext struct {
+	day   time.Time // local midnight
+	cells map[string]*cellMoistureContext
+}
+
+// cellMoistureContext is one cell's daily means, sorted.
+type cellMoistureContext struct {
+	short, long []float64
+	lastSeason  *float64
+}
+
+func initMoistureContextSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS cell_moisture_daily (
+			field_id      TEXT    NOT NULL,
+			day           TEXT    NOT NULL,
+			grid_id       TEXT    NOT NULL,
+			moisture_root REAL    NOT NULL,
+			cycles        INTEGER NOT NULL,
+			PRIMARY KEY (field_id, day, grid_id)
+		);
+	`)
+	return err
+}
+
+func localDay(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// applyMoistureContext sets each cell's percentile and last-season context.
+func (ep *EdgeProcessor) applyMoistureContext(points []VirtualGridPoint, at time.Time) {
+	ctx, err := ep.loadMoistureContext(localDay(at))
+	if err != nil {
+		ep.cycleLog.Warn("Moisture context skipped", "component", "moisture_context", "error", err)
+		return
+	}
+	for i := range points {
+		p := &points[i]
+		c := ctx.cells[p.GridID]
+		if c == nil {
+			continue
+		}
+		p.MoisturePct30d = percentileOf(c.short, p.MoistureRoot, moistureContextShortDays)
+		p.MoisturePct90d = percentileOf(c.long, p.MoistureRoot, moistureContextLongDays)
+		if c.lastSeason != nil {
+			mean, diff := *c.lastSeason, p.MoistureRoot-*c.lastSeason
+			p.MoistureLastSeason, p.MoistureVsLastSeason = &mean, &diff
+		}
+	}
+}
+
+// percentileOf is v's mid-rank percentile in sorted, nil with fewer than
+// the window's minimum days.
+func percentileOf(sorted []float64, v float64, windowDays int) *float64 {
+	if float64(len(sorted)) < moistureContextMinFraction*float64(windowDays) {
+		return nil
+	}
+	below := sort.SearchFloat64s(sorted, v)
+	equal := sort.Search(len(sorted)-below, func(i int) bool { return sorted[below+i] > v })
+	pct := (float64(below) + float64(equal)/2) / float64(len(sorted)) * 100
+	return &pct
+}
+
+// loadMoistureContext returns the archive for cycles on day, rebuilding
+// it when the day changes.
+func (ep *EdgeProcessor) loadMoistureContext(day time.Time) (*moistureContext, error) {
+	if ep.moistureCtx != nil && ep.moistureCtx.day.Equal(day) {
+		return ep.moistureCtx, nil
+	}
+	if err := ep.archiveDailyMoisture(day); err != nil {
+		return nil, err
+	}
+	ep.pruneDailyMoisture()
+
+	longFrom := day.AddDate(0, 0, -moistureContextLongDays)
+	shortFrom := day.AddDate(0, 0, -moistureContextShortDays)
+	season := day.AddDate(0, 0, -lastSeasonOffsetDays)
+	seasonFrom, seasonTo := season.AddDate(0, 0, -lastSeasonHalfWidthDays), season.AddDate(0, 0, lastSeasonHalfWidthDays)
+	rows, err := ep.localDB.Query(`
+		SELECT grid_id, day, moisture_root FROM cell_moisture_daily
+		WHERE field_id = ? AND ((day >= ? AND day < ?) OR (day >= ? AND day <= ?))
+	`, ep.config.FieldID, longFrom.Format(moistureDayFormat), day.Format(moistureDayFormat),
+		seasonFrom.Format(moistureDayFormat), seasonTo.Format(moistureDayFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily moisture: %v", err)
+	}
+	defer rows.Close()
+
+	short := shortFrom.Format(moistureDayFormat)
+	long := longFrom.Format(moistureDayFormat)
+	type seasonSum struct {
+		sum float64
+		n   int
+	}
+	seasons := make(map[string]*seasonSum)
+	ctx := &moistureContext{day: day, cells: make(map[string]*cellMoistureContext)}
+	for rows.Next() {
+		var gridID, d string
+		var root float64
+		if err := rows.Scan(&gridID, &d, &root); err != nil {
+			return nil, fmt.Errorf("failed to read daily moisture: %v", err)
+		}
+		c := ctx.cells[gridID]
+		if c == nil {
+			c = &cellMoistureContext{}
+			ctx.cells[gridID] = c
+		}
+		if d >= long {
+			c.long = append(c.long, root)
+			if d >= short {
+				c.short = append(c.short, root)
+			}
+			continue
+		}
+		s := seasons[gridID]
+		if s == nil {
+			s = &seasonSum{}
+			seasons[gridID] = s
+		}
+		s.sum += root
+		s.n++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for gridID, c := range ctx.cells {
+		sort.Float64s(c.short)
+		sort.Float64s(c.long)
+		if s := seasons[gridID]; s != nil && s.n >= lastSeasonMinDays {
+			mean := s.sum / float64(s.n)
+			c.lastSeason = &mean
+		}
+	}
+	ep.moistureCtx = ctx
+	return ctx, nil
+}
+
+// archiveDailyMoisture aggregates grid_history into daily means for the
+// finished days of the long window before day that have none yet.
+func (ep *EdgeProcessor) archiveDailyMoisture(day time.Time) error {
+	from := day.AddDate(0, 0, -moistureContextLongDays)
+	rows, err := ep.localDB.Query(`
+		SELECT DISTINCT day FROM cell_moisture_daily WHERE field_id = ? AND day >= ? AND day < ?
+	`, ep.config.FieldID, from.Format(moistureDayFormat), day.Format(moistureDayFormat))
+	if err != nil {
+		return fmt.Errorf("failed to query archived days: %v", err)
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read archived days: %v", err)
+		}
+		have[d] = true
+	}
+	rows.Close()
+
+	// Consecutive missing days are read in one pass
+	for d := from; d.Before(day); {
+		if have[d.Format(moistureDayFormat)] {
+			d = d.AddDate(0, 0, 1)
+			continue
+		}
+		end := d
+		for end.Before(day) && !have[end.Format(moistureDayFormat)] {
+			end = end.AddDate(0, 0, 1)
+		}
+		if err := ep.archiveDays(d, end); err != nil {
+			return err
+		}
+		d = end
+	}
+	return nil
+}
+
+// archiveDays writes the daily means of the history in [from, to).
+func (ep *EdgeProcessor) archiveDays(from, to time.Time) error {
+	type daySum struct {
+		sum float64
+		n   int
+	}
+	sums := make(map[[2]string]*daySum)
+	err := ep.eachHistoryCycle(from.Unix(), to.Unix()-1, func(c historyCycle) error {
+		d := localDay(c.at).Format(moistureDayFormat)
+		for _, cell := range c.cells {
+			root := cell.Values[1] // moisture_root
+			if math.IsNaN(root) {
+				continue
+			}
+			key := [2]string{d, cell.GridID}
+			s := sums[key]
+			if s == nil {
+				s = &daySum{}
+				sums[key] = s
+			}
+			s.sum += root
+			s.n++
+		}
+		return nil
+	})
+	if err != nil || len(sums) == 0 {
+		return err
+	}
+
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO cell_moisture_daily (field_id, day, grid_id, moisture_root, cycles) VALUES (?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, s := range sums {
+		if _, err := stmt.Exec(ep.config.FieldID, key[0], key[1], s.sum/float64(s.n), s.n); err != nil {
+			return fmt.Errorf("failed to archive daily moisture: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ep.cycleLog.Debug("Archived daily moisture", "component", "moisture_context",
+		"from", from.Format(moistureDayFormat), "to", to.Format(moistureDayFormat), "cells", len(sums))
+	return nil
+}
+
+// pruneDailyMoisture drops means past the retention window.
+func (ep *EdgeProcessor) pruneDailyMoisture() {
+	days := ep.retentionDays(ep.config.MoistureContextRetentionDays, defaultMoistureContextRetention)
+	cutoff := localDay(time.Now()).AddDate(0, 0, -days).Format(moistureDayFormat)
+	if _, err := ep.localDB.Exec(`DELETE FROM cell_moisture_daily WHERE field_id = ? AND day < ?`,
+		ep.config.FieldID, cutoff); err != nil {
+		ep.cycleLog.Warn("Failed to prune daily moisture", "component", "moisture_context", "error", err)
+	}
+}
+
+// forgetDailyMoisture drops the means of the day at falls on after its
+// history is rewritten, so the next rebuild aggregates them again.
+func (ep *EdgeProcessor) forgetDailyMoisture(at time.Time) {
+	d := localDay(at)
+	if _, err := ep.localDB.Exec(`DELETE FROM cell_moisture_daily WHERE field_id = ? AND day = ?`,
+		ep.config.FieldID, d.Format(moistureDayFormat)); err != nil {
+		ep.cycleLog.Warn("Failed to clear daily moisture", "component", "moisture_context", "error", err)
+		return
+	}
+	if ep.moistureCtx != nil && ep.moistureCtx.day.After(d) {
+		ep.moistureCtx = nil
+	}
+}
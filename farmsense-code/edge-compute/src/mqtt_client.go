@@ -0,0 +1,46 @@
+// MQTT Client - shared broker connection settings
+// Sensor traffic reaches the gateway over the local MQTT broker (the
+// LoRaWAN network server publishes uplinks there). Components that talk to
+// the broker build their client here so credentials and timeouts stay in
+// one place.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttConnectTimeout     = 10 * time.Second
+	defaultMQTTUplinkTopic = "application/+/device/+/event/up" // ChirpStack v4 uplinks
+)
+
+// newMQTTClient connects to the configured broker.
+func newMQTTClient(config EdgeConfig, clientID string) (mqtt.Client, error) {
+	if config.MQTTBrokerURL == "" {
+		return nil, errors.New("no MQTT broker configured (mqtt_broker_url)")
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.MQTTBrokerURL).
+		SetClientID(clientID).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetAutoReconnect(true)
+	if config.MQTTUsername != "" {
+		opts.SetUsername(config.MQTTUsername)
+		opts.SetPassword(config.MQTTPassword)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker %s", config.MQTTBrokerURL)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %v", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,160 @@
+// MQTT Publish - cycle results for on-farm consumers
+// Pump controllers and HMIs on the farm network can follow the edge's
+// results on the local broker instead of querying the database. With
+// mqtt_publish_prefix set, every cycle publishes (JSON, QoS 1, retained so
+// a subscriber that connects later gets the latest state at once):
+//
+//	<prefix>/<field_id>/zones/<zone_id>  one management zone's stats
+//	<prefix>/<field_id>/summary          cycle time, cell count and need counts
+//	<prefix>/<field_id>/grid             every cell (with mqtt_publish_grid)
+//	<prefix>/<field_id>/alerts/<kind>    each alert as it is raised
+//
+// Messages go through a bounded queue drained by one goroutine, so a slow
+// or unreachable broker never stalls the compute loop or an alert
+// detector; when the queue is full the message is dropped and counted.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttPublishQueueSize  = 256
+	mqttPublishQoS        = 1
+	mqttPublishRetryDelay = 30 * time.Second
+)
+
+// GridSummary is the per-cycle field summary on <prefix>/<field_id>/summary.
+type GridSummary struct {
+	FieldID    string         `json:"field_id"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Cells      int            `json:"cells"`
+	NeedCounts map[string]int `json:"need_counts"`
+	RainState  string         `json:"rain_state,omitempty"`
+	Zones      int            `json:"zones"`
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// ResultPublisher publishes cycle results to the local broker.
+type ResultPublisher struct {
+	config  EdgeConfig
+	prefix  string // <prefix>/<field_id>
+	queue   chan mqttMessage
+	dropped atomic.Int64
+	logger  *slog.Logger
+}
+
+// newResultPublisher returns the config's publisher, or nil when
+// publishing is off.
+func newResultPublisher(config EdgeConfig) *ResultPublisher {
+	if config.MQTTPublishPrefix == "" || config.MQTTBrokerURL == "" {
+		return nil
+	}
+	return &ResultPublisher{
+		config: config,
+		prefix: strings.TrimSuffix(config.MQTTPublishPrefix, "/") + "/" + config.FieldID,
+		queue:  make(chan mqttMessage, mqttPublishQueueSize),
+		logger: slog.With("component", "mqtt_publish", "field_id", config.FieldID),
+	}
+}
+
+// Start connects in the background and publishes queued messages.
+func (p *ResultPublisher) Start() {
+	go p.run()
+}
+
+func (p *ResultPublisher) run() {
+	clientID := fmt.Sprintf("farmsense-publish-%s-%s", p.config.DeviceID, p.config.FieldID)
+	var client mqtt.Client
+	for client == nil {
+		c, err := newMQTTClient(p.config, clientID)
+		if err != nil {
+			p.logger.Warn("MQTT publish broker unavailable, retrying", "error", err, "retry_in", mqttPublishRetryDelay)
+			time.Sleep(mqttPublishRetryDelay)
+			continue
+		}
+		client = c
+	}
+	p.logger.Info("Publishing results over MQTT", "prefix", p.prefix)
+
+	for msg := range p.queue {
+		token := client.Publish(msg.topic, mqttPublishQoS, true, msg.payload)
+		if !token.WaitTimeout(mqttConnectTimeout) {
+			p.logger.Warn("MQTT publish timed out", "topic", msg.topic)
+			continue
+		}
+		if err := token.Error(); err != nil {
+			p.logger.Warn("MQTT publish failed", "topic", msg.topic, "error", err)
+		}
+	}
+}
+
+// publish queues v as JSON on <prefix>/<field_id>/<suffix>.
+func (p *ResultPublisher) publish(suffix string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		p.logger.Error("Failed to encode MQTT message", "topic", suffix, "error", err)
+		return
+	}
+	select {
+	case p.queue <- mqttMessage{topic: p.prefix + "/" + suffix, payload: payload}:
+	default:
+		if n := p.dropped.Add(1); n == 1 || n%100 == 0 {
+			p.logger.Warn("MQTT publish queue full, dropping messages", "dropped", n)
+		}
+	}
+}
+
+// PublishAlert publishes an alert under its kind.
+func (p *ResultPublisher) PublishAlert(a Alert) {
+	p.publish("alerts/"+topicLevel(a.Kind), a)
+}
+
+// publishResults publishes the cycle's zone stats, summary and optionally
+// the full grid.
+func (ep *EdgeProcessor) publishResults(points []VirtualGridPoint, stats []ZoneStats, at time.Time) {
+	p := ep.publisher
+	if p == nil {
+		return
+	}
+	for _, s := range stats {
+		p.publish("zones/"+topicLevel(s.ZoneID), s)
+	}
+	p.publish("summary", ep.gridSummary(points, stats, at))
+	if ep.config.MQTTPublishGrid && !ep.throttled() { // per-cell output waits out a throttle
+		p.publish("grid", points)
+	}
+}
+
+// gridSummary counts a cycle's cells by irrigation need.
+func (ep *EdgeProcessor) gridSummary(points []VirtualGridPoint, stats []ZoneStats, at time.Time) GridSummary {
+	summary := GridSummary{
+		FieldID:    ep.config.FieldID,
+		Timestamp:  at,
+		Cells:      len(points),
+		NeedCounts: make(map[string]int),
+		RainState:  ep.rain.state,
+		Zones:      len(stats),
+	}
+	for _, pt := range points {
+		summary.NeedCounts[pt.IrrigationNeed]++
+	}
+	return summary
+}
+
+// topicLevel makes an ID safe as a single topic level.
+func topicLevel(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
@@ -0,0 +1,244 @@
+// Neighbor Fields - adjacent fields' grids as low-weight virtual sensors
+// A narrow field with few probes has edge cells that only see probes far
+// inside it. When the field next door is computed by this gateway or a
+// peer device (peer_failover.go), its latest cells along the shared edge
+// are good evidence too: each neighbor_fields entry names such a field,
+//
+//	{"field_id": "north-40"}                        another field on this gateway
+//	{"field_id": "east-12", "device_id": "edge-07"} a peer's field, over GET /peer/grid
+//
+// and every cycle its cells within neighbor_band_m outside this field's
+// grid become virtual sensors at the cell centers. A virtual sensor's
+// inverse-distance weight is its entry's weight (default 0.25) times the
+// cell's confidence, applied by stretching its distance, so it can shade
+// an estimate but not outvote a probe. It is only used by cells that have
+// at least one real probe within search_radius_m, never counts as on the
+// cell, and is left out of QC, RBF fits, class biases, LOOCV and the
+// extrapolation guard: those judge this field's probes.
+//
+// A neighbor is skipped (with a warning) when its soil_texture differs
+// from this field's, or its grid is more than neighbor_max_age_min from
+// the cycle time (default 60; backfilled cycles never borrow).
+// Neighbor cells that are extrapolated, stale or themselves borrowed from
+// a neighbor are never offered, so two fields can't feed each other.
+// Cells that used virtual sensors carry the neighbor_inputs quality flag
+// (quality_flags.go); their source_sensors list only real probes.
+//
+// Entries whose field_id is the processor's own are ignored, so a gateway
+// whose fields share one config can list each of them.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultNeighborWeight    = 0.25
+	defaultNeighborMaxAgeMin = 60
+	peerGridMaxBytes         = 4 << 20
+	neighborSensorPrefix     = "neighbor:"
+)
+
+// NeighborField is an adjacent field whose grid edge feeds this one.
+type NeighborField struct {
+	FieldID  string  `json:"field_id"`
+	DeviceID string  `json:"device_id,omitempty"` // peer computing it (default: this gateway)
+	Weight   float64 `json:"weight,omitempty"`    // IDW weight relative to a probe (default 0.25)
+}
+
+// NeighborGridCell is one cell a field offers its neighbors.
+type NeighborGridCell struct {
+	GridID          string  `json:"grid_id"`
+	Latitude        float64 `json:"latitude"`
+	Longitude       float64 `json:"longitude"`
+	MoistureSurface float64 `json:"moisture_surface"`
+	MoistureRoot    float64 `json:"moisture_root"`
+	Temperature     float64 `json:"temperature"`
+	Confidence      float64 `json:"confidence"`
+}
+
+// NeighborGrid is a field's latest cells as offered to neighbors.
+type NeighborGrid struct {
+	FieldID     string             `json:"field_id"`
+	SoilTexture string             `json:"soil_texture"`
+	Timestamp   time.Time          `json:"timestamp"`
+	Cells       []NeighborGridCell `json:"cells"`
+}
+
+// neighborGridSource finds neighbor grids on this gateway or its peers.
+type neighborGridSource struct {
+	processors func() []*EdgeProcessor
+	peers      *PeerMonitor // nil without peer failover
+}
+
+// UseNeighborGrids lets the processor read neighbor_fields from the
+// gateway's other fields and, with peers non-nil, from peer devices.
+func (ep *EdgeProcessor) UseNeighborGrids(processors func() []*EdgeProcessor, peers *PeerMonitor) {
+	ep.neighborSource.Store(&neighborGridSource{processors: processors, peers: peers})
+}
+
+// grid fetches one neighbor's grid.
+func (src *neighborGridSource) grid(n NeighborField, ownDevice string) (NeighborGrid, error) {
+	if n.DeviceID == "" || n.DeviceID == ownDevice {
+		for _, p := range src.processors() {
+			if p.config.FieldID == n.FieldID {
+				return p.NeighborGrid(), nil
+			}
+		}
+		return NeighborGrid{}, fmt.Errorf("field %s is not computed on this gateway", n.FieldID)
+	}
+	if src.peers == nil {
+		return NeighborGrid{}, fmt.Errorf("field %s is on peer %s but peer failover is not configured", n.FieldID, n.DeviceID)
+	}
+	return src.peers.NeighborGrid(n.DeviceID, n.FieldID)
+}
+
+// NeighborGrid is the latest grid's cells a neighbor may borrow.
+func (ep *EdgeProcessor) NeighborGrid() NeighborGrid {
+	grid := ep.LatestGrid()
+	out := NeighborGrid{FieldID: ep.config.FieldID, SoilTexture: ep.config.SoilTexture, Cells: make([]NeighborGridCell, 0, len(grid))}
+	if ep.config.LogicalGrid != nil {
+		return out // no coordinates to share
+	}
+	for _, p := range grid {
+		if p.QualityFlags&(QualityExtrapolated|QualityStaleInputs|QualityNeighborInputs) != 0 {
+			continue
+		}
+		out.Timestamp = p.Timestamp
+		out.Cells = append(out.Cells, NeighborGridCell{
+			GridID:          p.GridID,
+			Latitude:        p.Latitude,
+			Longitude:       p.Longitude,
+			MoistureSurface: p.MoistureSurface,
+			MoistureRoot:    p.MoistureRoot,
+			Temperature:     p.Temperature,
+			Confidence:      p.Confidence,
+		})
+	}
+	return out
+}
+
+// NeighborGrid fetches a peer's field grid over the peer API.
+func (m *PeerMonitor) NeighborGrid(deviceID, fieldID string) (NeighborGrid, error) {
+	m.mu.Lock()
+	p, ok := m.peers[deviceID]
+	var base string
+	if ok {
+		base = p.URL
+	}
+	m.mu.Unlock()
+	if !ok {
+		return NeighborGrid{}, fmt.Errorf("unknown peer %s", deviceID)
+	}
+	var grid NeighborGrid
+	if err := m.request(base, "/peer/grid?field_id="+url.QueryEscape(fieldID), peerGridMaxBytes, &grid); err != nil {
+		return NeighborGrid{}, err
+	}
+	return grid, nil
+}
+
+// distanceOutsideGrid is how far a point lies outside the field's grid
+// extent in metres, 0 inside it.
+func distanceOutsideGrid(g gridLayout, lat, lon float64) float64 {
+	dLat := math.Max(math.Max(g.minLat-lat, lat-g.maxLat), 0) * metersPerDegreeLat
+	dLon := math.Max(math.Max(g.minLon-lon, lon-g.maxLon), 0) * metersPerDegreeLat * math.Cos(lat*math.Pi/180)
+	return math.Hypot(dLat, dLon)
+}
+
+// neighborSensors turns the neighbor fields' edge cells into virtual
+// sensors for this cycle.
+func (ep *EdgeProcessor) neighborSensors() []SensorReading {
+	src := ep.neighborSource.Load()
+	if src == nil || len(ep.config.NeighborFields) == 0 || ep.config.LogicalGrid != nil {
+		return nil
+	}
+	layout := ep.gridLayout()
+	band := ep.config.NeighborBandM
+	if band <= 0 {
+		band = ep.config.SearchRadius
+	}
+	maxAge := time.Duration(ep.config.NeighborMaxAgeMin) * time.Minute
+	if maxAge <= 0 {
+		maxAge = defaultNeighborMaxAgeMin * time.Minute
+	}
+	now := ep.cycleTime()
+
+	var virtual []SensorReading
+	for _, n := range ep.config.NeighborFields {
+		if n.FieldID == ep.config.FieldID {
+			continue
+		}
+		logger := ep.cycleLog.With("component", "neighbor_fields", "neighbor_field_id", n.FieldID)
+		grid, err := src.grid(n, ep.deviceID)
+		if err != nil {
+			logger.Warn("Neighbor field grid unavailable", "error", err)
+			continue
+		}
+		if grid.SoilTexture != ep.config.SoilTexture {
+			logger.Warn("Skipping neighbor field with a different soil texture", "soil_texture", grid.SoilTexture)
+			continue
+		}
+		// Backfilled cycles are past, so the neighbor's latest grid is too far off
+		if age := now.Sub(grid.Timestamp); len(grid.Cells) == 0 || age > maxAge || age < -maxAge {
+			logger.Debug("Skipping neighbor field without a grid near the cycle time", "timestamp", grid.Timestamp)
+			continue
+		}
+		weight := n.Weight
+		if weight <= 0 {
+			weight = defaultNeighborWeight
+		}
+		used := 0
+		for _, c := range grid.Cells {
+			d := distanceOutsideGrid(layout, c.Latitude, c.Longitude)
+			if d == 0 || d > band || c.Confidence <= 0 {
+				continue
+			}
+			virtual = append(virtual, SensorReading{
+				SensorID:        neighborSensorPrefix + n.FieldID + ":" + c.GridID,
+				Timestamp:       grid.Timestamp,
+				Latitude:        c.Latitude,
+				Longitude:       c.Longitude,
+				MoistureSurface: c.MoistureSurface,
+				MoistureRoot:    c.MoistureRoot,
+				TempSurface:     c.Temperature,
+				QualityFlag:     "valid",
+				virtualWeight:   weight * math.Min(c.Confidence, 1),
+			})
+			used++
+		}
+		logger.Debug("Borrowing neighbor field edge cells", "cells", used)
+	}
+	return virtual
+}
+
+// weightVirtualNeighbors stretches virtual sensors' distances so their
+// IDW weight is scaled by their virtual weight, and drops them when the
+// cell has no real probe in reach. It reports whether any were kept.
+func (ep *EdgeProcessor) weightVirtualNeighbors(neighbors []sensorNeighbor) ([]sensorNeighbor, bool) {
+	probes, virtual := 0, 0
+	for _, n := range neighbors {
+		if n.sensor.virtualWeight > 0 {
+			virtual++
+		} else {
+			probes++
+		}
+	}
+	if virtual == 0 {
+		return neighbors, false
+	}
+	out := make([]sensorNeighbor, 0, len(neighbors))
+	for _, n := range neighbors {
+		if n.sensor.virtualWeight > 0 {
+			if probes == 0 {
+				continue
+			}
+			n.distance = math.Max(n.distance, 1) * math.Pow(n.sensor.virtualWeight, -1/ep.config.IDWPower)
+		}
+		out = append(out, n)
+	}
+	return out, probes > 0
+}
@@ -0,0 +1,627 @@
+// Notifications - alert delivery to phones, inboxes and other systems
+// The alert log (alerts.go) keeps what the detectors raise; a grower who
+// isn't watching the local API or the broker hears about it through
+// notification_channels, each one of:
+//
+//	twilio     SMS through the Twilio Messages API (account_sid, from, to
+//	           numbers; the auth token as secret)
+//	gsm_modem  SMS through an AT-command GSM modem on a serial port
+//	           (device, to numbers), for farms without internet; the port's
+//	           line settings are left as the system set them (USB modems
+//	           ignore them, set a UART up with stty)
+//	smtp       email (smtp_host host:port, from, to addresses; username and
+//	           the password as secret when the server wants a login);
+//	           STARTTLS when the server offers it
+//	telegram   bot messages to the chat IDs in to (the bot token as secret)
+//	webhook    the notification as JSON POSTed to url, signed with
+//	           X-FarmSense-Signature: sha256=<HMAC of the body> when a secret
+//	           is set
+//
+// secret_env names an environment variable to read the secret from
+// instead of the config file. notification_rules route alerts to
+// channels: an alert goes to the channels of every rule whose kinds (empty
+// = all), field_ids (empty = all) and min_severity (default warning) it
+// matches, once per channel. A rule's quiet_hours (start and end as HH:MM
+// in its timezone, default the gateway's) hold its non-critical alerts
+// (all of them with hold_critical) and send what was held as one digest
+// per channel when they end.
+//
+// Delivery runs on its own goroutine behind a bounded queue, like MQTT
+// publishing, so a slow SMTP server never stalls a detector; a failed
+// send is retried once and then logged and counted.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Notification channel types
+const (
+	NotifyTwilio   = "twilio"
+	NotifyGSMModem = "gsm_modem"
+	NotifySMTP     = "smtp"
+	NotifyTelegram = "telegram"
+	NotifyWebhook  = "webhook"
+)
+
+const (
+	notifyQueueSize     = 128
+	notifySendTimeout   = 30 * time.Second
+	notifyRetryDelay    = 10 * time.Second
+	notifyQuietCheck    = time.Minute
+	smsMaxChars         = 160  // one GSM-7 message from the modem
+	twilioMaxChars      = 1600 // Twilio's concatenated limit
+	defaultTwilioAPI    = "https://api.twilio.com"
+	defaultTelegramAPI  = "https://api.telegram.org"
+	defaultNotifyMinSev = SeverityWarning
+)
+
+// NotificationChannel is one configured delivery channel.
+type NotificationChannel struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`        // twilio | gsm_modem | smtp | telegram | webhook
+	To         []string `json:"to"`          // phone numbers, email addresses or Telegram chat IDs
+	From       string   `json:"from"`        // Twilio sender number or email From address
+	Secret     string   `json:"secret"`      // Twilio auth token, SMTP password, Telegram bot token or webhook HMAC key
+	SecretEnv  string   `json:"secret_env"`  // Environment variable holding the secret instead
+	AccountSID string   `json:"account_sid"` // twilio
+	Device     string   `json:"device"`      // gsm_modem serial port, e.g. /dev/ttyUSB2
+	SMTPHost   string   `json:"smtp_host"`   // smtp host:port
+	Username   string   `json:"username"`    // smtp login (default from)
+	URL        string   `json:"url"`         // webhook target; for twilio and telegram, overrides the API base
+}
+
+// NotificationRule routes matching alerts to channels.
+type NotificationRule struct {
+	Kinds       []string    `json:"kinds"`        // Alert kinds (empty = all)
+	FieldIDs    []string    `json:"field_ids"`    // Fields (empty = all)
+	MinSeverity string      `json:"min_severity"` // info | warning | critical (default warning)
+	Channels    []string    `json:"channels"`     // Channel names
+	QuietHours  *QuietHours `json:"quiet_hours"`
+}
+
+// QuietHours is a daily window in which a rule's alerts are held.
+type QuietHours struct {
+	Start        string `json:"start"`         // HH:MM
+	End          string `json:"end"`           // HH:MM; before start = overnight
+	Timezone     string `json:"timezone"`      // IANA zone (default the gateway's local time)
+	HoldCritical bool   `json:"hold_critical"` // Hold critical alerts too
+}
+
+// Notification is what a channel delivers: one alert, or a digest of the
+// alerts held during quiet hours.
+type Notification struct {
+	Subject string  `json:"subject"`
+	Text    string  `json:"text"`
+	Alerts  []Alert `json:"alerts"`
+}
+
+// Notifier delivers notifications over one channel.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+func severityRank(severity string) int {
+	switch severity {
+	case SeverityInfo:
+		return 0
+	case SeverityWarning:
+		return 1
+	case SeverityCritical:
+		return 2
+	}
+	return -1
+}
+
+// secret returns the channel's secret, from the environment if so named.
+func (c NotificationChannel) secret() string {
+	if c.SecretEnv != "" {
+		return os.Getenv(c.SecretEnv)
+	}
+	return c.Secret
+}
+
+// validate reports what the channel is missing for its type.
+func (c NotificationChannel) validate() error {
+	need := func(ok bool, what string) error {
+		if !ok {
+			return fmt.Errorf("%s channel needs %s", c.Type, what)
+		}
+		return nil
+	}
+	var err error
+	switch c.Type {
+	case NotifyTwilio:
+		err = need(c.AccountSID != "" && c.From != "" && len(c.To) > 0, "account_sid, from and to")
+	case NotifyGSMModem:
+		err = need(c.Device != "" && len(c.To) > 0, "device and to")
+	case NotifySMTP:
+		err = need(c.SMTPHost != "" && c.From != "" && len(c.To) > 0, "smtp_host, from and to")
+		if err == nil {
+			_, _, err = net.SplitHostPort(c.SMTPHost)
+		}
+	case NotifyTelegram:
+		err = need(len(c.To) > 0, "to")
+	case NotifyWebhook:
+		err = need(c.URL != "", "url")
+	default:
+		return fmt.Errorf("unknown type %q (twilio, gsm_modem, smtp, telegram or webhook)", c.Type)
+	}
+	if err == nil && (c.Type == NotifyTwilio || c.Type == NotifyTelegram) {
+		err = need(c.Secret != "" || c.SecretEnv != "", "secret or secret_env")
+	}
+	return err
+}
+
+// parseClock reads HH:MM as minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// quietWindow is a parsed QuietHours.
+type quietWindow struct {
+	start, end   int // minutes after midnight
+	loc          *time.Location
+	holdCritical bool
+}
+
+func newQuietWindow(q *QuietHours) (*quietWindow, error) {
+	if q == nil {
+		return nil, nil
+	}
+	w := &quietWindow{loc: time.Local, holdCritical: q.HoldCritical}
+	var err error
+	if w.start, err = parseClock(q.Start); err != nil {
+		return nil, fmt.Errorf("start: %v", err)
+	}
+	if w.end, err = parseClock(q.End); err != nil {
+		return nil, fmt.Errorf("end: %v", err)
+	}
+	if q.Timezone != "" {
+		if w.loc, err = time.LoadLocation(q.Timezone); err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	return w, nil
+}
+
+// quiet reports whether t falls in the window.
+func (w *quietWindow) quiet(t time.Time) bool {
+	local := t.In(w.loc)
+	m := local.Hour()*60 + local.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// notifyRoute is a parsed NotificationRule.
+type notifyRoute struct {
+	kinds, fields map[string]bool
+	minRank       int
+	channels      []string
+	quiet         *quietWindow
+}
+
+func (r *notifyRoute) matches(a Alert) bool {
+	return (len(r.kinds) == 0 || r.kinds[a.Kind]) && (len(r.fields) == 0 || r.fields[a.FieldID]) &&
+		severityRank(a.Severity) >= r.minRank
+}
+
+// AlertNotifier routes raised alerts to the configured channels.
+type AlertNotifier struct {
+	channels map[string]Notifier
+	routes   []*notifyRoute
+	queue    chan Alert
+	held     map[*notifyRoute]map[string][]Alert // by route, then channel
+	dropped  atomic.Int64
+	failed   atomic.Int64
+	logger   *slog.Logger
+}
+
+// newAlertNotifier returns the config's notifier, or nil without
+// notification rules.
+func newAlertNotifier(config EdgeConfig) (*AlertNotifier, error) {
+	if len(config.NotificationRules) == 0 {
+		return nil, nil
+	}
+	n := &AlertNotifier{
+		channels: make(map[string]Notifier, len(config.NotificationChannels)),
+		queue:    make(chan Alert, notifyQueueSize),
+		held:     make(map[*notifyRoute]map[string][]Alert),
+		logger:   slog.With("component", "notify", "field_id", config.FieldID),
+	}
+	for _, c := range config.NotificationChannels {
+		n.channels[c.Name] = newNotifier(c)
+	}
+	for i, rule := range config.NotificationRules {
+		r := &notifyRoute{kinds: stringSet(rule.Kinds), fields: stringSet(rule.FieldIDs), channels: rule.Channels}
+		r.minRank = severityRank(rule.MinSeverity)
+		if rule.MinSeverity == "" {
+			r.minRank = severityRank(defaultNotifyMinSev)
+		}
+		quiet, err := newQuietWindow(rule.QuietHours)
+		if err != nil {
+			return nil, fmt.Errorf("notification_rules[%d].quiet_hours: %v", i, err)
+		}
+		r.quiet = quiet
+		n.routes = append(n.routes, r)
+	}
+	return n, nil
+}
+
+func stringSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, s := range list {
+		set[s] = true
+	}
+	return set
+}
+
+func newNotifier(c NotificationChannel) Notifier {
+	switch c.Type {
+	case NotifyTwilio:
+		return &twilioNotifier{channel: c, client: &http.Client{}}
+	case NotifyGSMModem:
+		return &gsmModemNotifier{channel: c}
+	case NotifySMTP:
+		return &smtpNotifier{channel: c}
+	case NotifyTelegram:
+		return &telegramNotifier{channel: c, client: &http.Client{}}
+	}
+	return &webhookNotifier{channel: c, client: &http.Client{}}
+}
+
+// Start delivers queued alerts in the background.
+func (n *AlertNotifier) Start() {
+	go n.run()
+}
+
+// Enqueue queues an alert for routing; it never blocks (AlertLog.OnRaise).
+func (n *AlertNotifier) Enqueue(a Alert) {
+	select {
+	case n.queue <- a:
+	default:
+		if d := n.dropped.Add(1); d == 1 || d%100 == 0 {
+			n.logger.Warn("Notification queue full, dropping alerts", "dropped", d)
+		}
+	}
+}
+
+func (n *AlertNotifier) run() {
+	ticker := time.NewTicker(notifyQuietCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case a := <-n.queue:
+			n.route(a, time.Now())
+		case now := <-ticker.C:
+			n.releaseHeld(now)
+		}
+	}
+}
+
+// route sends an alert to every matching channel once, or holds it for
+// the rules in their quiet hours.
+func (n *AlertNotifier) route(a Alert, now time.Time) {
+	// A channel gets the alert now if any matching rule lets it through;
+	// otherwise the first rule holding it keeps it for the digest.
+	channels := make([]string, 0)
+	send := make(map[string]bool)
+	holder := make(map[string]*notifyRoute)
+	for _, r := range n.routes {
+		if !r.matches(a) {
+			continue
+		}
+		hold := r.quiet != nil && r.quiet.quiet(now) && (a.Severity != SeverityCritical || r.quiet.holdCritical)
+		for _, ch := range r.channels {
+			if _, seen := send[ch]; !seen {
+				channels = append(channels, ch)
+				send[ch] = false
+			}
+			if !hold {
+				send[ch] = true
+			} else if holder[ch] == nil {
+				holder[ch] = r
+			}
+		}
+	}
+	for _, ch := range channels {
+		if send[ch] {
+			n.send(ch, alertNotification(a))
+			continue
+		}
+		r := holder[ch]
+		if n.held[r] == nil {
+			n.held[r] = make(map[string][]Alert)
+		}
+		n.held[r][ch] = append(n.held[r][ch], a)
+	}
+}
+
+// releaseHeld sends a digest of what each rule held once its quiet hours
+// are over.
+func (n *AlertNotifier) releaseHeld(now time.Time) {
+	for r, byChannel := range n.held {
+		if r.quiet.quiet(now) {
+			continue
+		}
+		for ch, alerts := range byChannel {
+			n.send(ch, digestNotification(alerts))
+		}
+		delete(n.held, r)
+	}
+}
+
+func (n *AlertNotifier) send(channel string, msg Notification) {
+	notifier := n.channels[channel]
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), notifySendTimeout)
+		err := notifier.Notify(ctx, msg)
+		cancel()
+		if err == nil {
+			n.logger.Debug("Notification sent", "channel", channel, "alerts", len(msg.Alerts))
+			return
+		}
+		if attempt == 1 {
+			n.failed.Add(1)
+			n.logger.Warn("Notification failed", "channel", channel, "subject", msg.Subject, "error", err)
+			return
+		}
+		time.Sleep(notifyRetryDelay)
+	}
+}
+
+// Failed counts notifications given up on.
+func (n *AlertNotifier) Failed() int64 {
+	return n.failed.Load()
+}
+
+func alertNotification(a Alert) Notification {
+	subject := fmt.Sprintf("[FarmSense] %s: %s on %s", a.Severity, a.Kind, a.FieldID)
+	if a.Subject != "" {
+		subject += "/" + a.Subject
+	}
+	text := fmt.Sprintf("%s\n%s at %s", a.Message, a.Kind, a.RaisedAt.Format("2006-01-02 15:04 MST"))
+	return Notification{Subject: subject, Text: text, Alerts: []Alert{a}}
+}
+
+func digestNotification(alerts []Alert) Notification {
+	var b strings.Builder
+	for _, a := range alerts {
+		fmt.Fprintf(&b, "%s %s %s: %s\n", a.RaisedAt.Format("15:04"), a.Severity, a.FieldID, a.Message)
+	}
+	return Notification{
+		Subject: fmt.Sprintf("[FarmSense] %d alerts held during quiet hours", len(alerts)),
+		Text:    strings.TrimSuffix(b.String(), "\n"),
+		Alerts:  alerts,
+	}
+}
+
+// smsText is a notification as one SMS body of at most max characters.
+func smsText(n Notification, max int) string {
+	text := n.Subject + "\n" + n.Text
+	if len(n.Alerts) == 1 {
+		a := n.Alerts[0]
+		text = fmt.Sprintf("%s %s: %s", a.Severity, a.FieldID, a.Message)
+	}
+	if r := []rune(text); len(r) > max {
+		text = string(r[:max-1]) + "…"
+	}
+	return text
+}
+
+// doNotifyRequest sends req and fails on a non-2xx answer.
+func doNotifyRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// twilioNotifier sends SMS through Twilio.
+type twilioNotifier struct {
+	channel NotificationChannel
+	client  *http.Client
+}
+
+func (t *twilioNotifier) Notify(ctx context.Context, n Notification) error {
+	base := t.channel.URL
+	if base == "" {
+		base = defaultTwilioAPI
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", strings.TrimSuffix(base, "/"), url.PathEscape(t.channel.AccountSID))
+	body := smsText(n, twilioMaxChars)
+	for _, to := range t.channel.To {
+		form := url.Values{"To": {to}, "From": {t.channel.From}, "Body": {body}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(t.channel.AccountSID, t.channel.secret())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := doNotifyRequest(t.client, req); err != nil {
+			return fmt.Errorf("failed to send SMS to %s: %v", to, err)
+		}
+	}
+	return nil
+}
+
+// telegramNotifier sends bot messages.
+type telegramNotifier struct {
+	channel NotificationChannel
+	client  *http.Client
+}
+
+func (t *telegramNotifier) Notify(ctx context.Context, n Notification) error {
+	base := t.channel.URL
+	if base == "" {
+		base = defaultTelegramAPI
+	}
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimSuffix(base, "/"), t.channel.secret())
+	for _, chat := range t.channel.To {
+		payload, err := json.Marshal(map[string]string{"chat_id": chat, "text": n.Subject + "\n" + n.Text})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := doNotifyRequest(t.client, req); err != nil {
+			return fmt.Errorf("failed to message chat %s: %v", chat, err)
+		}
+	}
+	return nil
+}
+
+// webhookNotifier POSTs the notification as JSON.
+type webhookNotifier struct {
+	channel NotificationChannel
+	client  *http.Client
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.channel.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := w.channel.secret(); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		req.Header.Set("X-FarmSense-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return doNotifyRequest(w.client, req)
+}
+
+// smtpNotifier sends email.
+type smtpNotifier struct {
+	channel NotificationChannel
+}
+
+func (s *smtpNotifier) Notify(ctx context.Context, n Notification) error {
+	c := s.channel
+	host, _, err := net.SplitHostPort(c.SMTPHost)
+	if err != nil {
+		return fmt.Errorf("invalid smtp_host: %v", err)
+	}
+	user := c.Username
+	if user == "" {
+		user = c.From
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", c.From, strings.Join(c.To, ", "),
+		n.Subject, time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n") + "\r\n")
+
+	var auth smtp.Auth
+	if secret := c.secret(); secret != "" {
+		auth = smtp.PlainAuth("", user, secret, host)
+	}
+
+	// net/smtp has no context; bound it with a goroutine
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(c.SMTPHost, auth, c.From, c.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send email: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send email: %v", ctx.Err())
+	}
+}
+
+// gsmModemNotifier sends SMS with AT commands; one conversation with the
+// modem at a time.
+type gsmModemNotifier struct {
+	channel NotificationChannel
+	mu      sync.Mutex
+}
+
+func (g *gsmModemNotifier) Notify(ctx context.Context, n Notification) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	port, err := os.OpenFile(g.channel.Device, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open modem: %v", err)
+	}
+	defer port.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		port.SetDeadline(deadline) // not every tty driver supports it
+	}
+
+	text := smsText(n, smsMaxChars)
+	if err := modemCommand(port, "AT+CMGF=1\r", "OK"); err != nil {
+		return fmt.Errorf("modem text mode: %v", err)
+	}
+	for _, to := range g.channel.To {
+		if err := modemCommand(port, fmt.Sprintf("AT+CMGS=\"%s\"\r", to), ">"); err != nil {
+			return fmt.Errorf("failed to send SMS to %s: %v", to, err)
+		}
+		if err := modemCommand(port, text+"\x1a", "OK"); err != nil {
+			return fmt.Errorf("failed to send SMS to %s: %v", to, err)
+		}
+	}
+	return nil
+}
+
+// modemCommand writes cmd and reads until want or an error response.
+func modemCommand(port io.ReadWriter, cmd, want string) error {
+	if _, err := io.WriteString(port, cmd); err != nil {
+		return err
+	}
+	var resp []byte
+	buf := make([]byte, 256)
+	for {
+		n, err := port.Read(buf)
+		resp = append(resp, buf[:n]...)
+		switch s := string(resp); {
+		case strings.Contains(s, want):
+			return nil
+		case strings.Contains(s, "ERROR"):
+			return fmt.Errorf("modem answered %q", strings.TrimSpace(s))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,434 @@
+// Object Store - grid batches as files in S3-compatible storage
+// cloud_store s3 uploads grid batches to a bucket instead of a database,
+// for deployments that won't expose Postgres to the internet. Anything
+// speaking the S3 API works: AWS S3, MinIO, Ceph, and Google Cloud
+// Storage through its interoperability endpoint
+// (https://storage.googleapis.com with an HMAC key). Requests are signed
+// with AWS Signature V4; object_store_access_key and the secret
+// (FARMSENSE_OBJECT_STORE_SECRET_KEY) come from the bucket's owner.
+//
+// Each batch is one gzip-compressed object:
+//
+//	<prefix>/<field_id>/<yyyy>/<mm>/<dd>/<20060102T150405Z>_<batch_id>.<format>.gz
+//
+// in object_store_format geojson (default; a FeatureCollection of cell
+// squares with the grid API's properties, metric units) or ndjson (one
+// cell per line as the grid API returns it, the only choice for logical
+// grids). Parquet is not written: there is no Parquet encoder in the
+// build.
+//
+// A batch is only visible once it is in a manifest. After its objects
+// land, each day's manifest.json next to them lists every batch of that
+// day (batch_id, cycle_at, key, cells, bytes, sha256), and
+// <prefix>/<field_id>/latest.json names the field's newest batch, the
+// object-store counterpart of the grid epoch (grid_epochs.go): readers
+// start there and never see a half-written cycle. An upload that fails
+// part way is retried whole; objects are keyed by batch, so a retry
+// overwrites what it left. Only one device should write a field's prefix.
+//
+// Zone stats, fleet state and the other cloud tables still need the
+// Postgres connection; without database_url only grid batches leave the
+// device.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CloudStoreS3 uploads batches to S3-compatible object storage.
+const CloudStoreS3 = "s3"
+
+// Object store formats
+const (
+	ObjectFormatGeoJSON = "geojson"
+	ObjectFormatNDJSON  = "ndjson"
+)
+
+const (
+	defaultObjectRegion = "us-east-1"
+	defaultObjectPrefix = "farmsense"
+	objectManifestName  = "manifest.json"
+	objectLatestName    = "latest.json"
+)
+
+// ObjectManifestEntry is one batch listed in a day's manifest.
+type ObjectManifestEntry struct {
+	BatchID  string    `json:"batch_id"`
+	CycleAt  time.Time `json:"cycle_at"`
+	Key      string    `json:"key"`
+	Format   string    `json:"format"`
+	Cells    int       `json:"cells"`
+	Bytes    int       `json:"bytes"`
+	SHA256   string    `json:"sha256"`
+	DeviceID string    `json:"edge_device_id"`
+}
+
+// ObjectManifest lists a field's batches for one UTC day.
+type ObjectManifest struct {
+	FieldID   string                `json:"field_id"`
+	Date      string                `json:"date"` // 2006-01-02
+	UpdatedAt time.Time             `json:"updated_at"`
+	Batches   []ObjectManifestEntry `json:"batches"` // by cycle_at
+}
+
+// ObjectLatest is latest.json: the field's newest complete batch.
+type ObjectLatest struct {
+	FieldID string `json:"field_id"`
+	ObjectManifestEntry
+	Manifest  string    `json:"manifest"` // key of the batch's day manifest
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// objectStore writes batches to a bucket over the S3 API.
+type objectStore struct {
+	ep        *EdgeProcessor
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	pathStyle bool
+	format    string
+	accessKey string
+	secretKey string
+}
+
+func newObjectStore(ep *EdgeProcessor) (*objectStore, error) {
+	c := ep.config
+	if c.ObjectStoreBucket == "" || c.ObjectStoreAccessKey == "" || c.ObjectStoreSecretKey == "" {
+		return nil, fmt.Errorf("cloud_store s3 needs object_store_bucket, object_store_access_key and FARMSENSE_OBJECT_STORE_SECRET_KEY")
+	}
+	s := &objectStore{
+		ep:        ep,
+		region:    c.ObjectStoreRegion,
+		bucket:    c.ObjectStoreBucket,
+		prefix:    strings.Trim(c.ObjectStorePrefix, "/"),
+		pathStyle: c.ObjectStorePathStyle,
+		format:    c.ObjectStoreFormat,
+		accessKey: c.ObjectStoreAccessKey,
+		secretKey: c.ObjectStoreSecretKey,
+	}
+	if s.region == "" {
+		s.region = defaultObjectRegion
+	}
+	if s.prefix == "" {
+		s.prefix = defaultObjectPrefix
+	}
+	if s.format == "" {
+		s.format = ObjectFormatGeoJSON
+		if c.LogicalGrid != nil {
+			s.format = ObjectFormatNDJSON
+		}
+	}
+	endpoint := c.ObjectStoreEndpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid object_store_endpoint %q", endpoint)
+	}
+	s.endpoint = u
+	return s, nil
+}
+
+func (s *objectStore) Name() string    { return CloudStoreS3 }
+func (s *objectStore) Available() bool { return true }
+
+// StoreGrid uploads each batch, then the day manifests, then latest.json.
+func (s *objectStore) StoreGrid(points []VirtualGridPoint) error {
+	type batchKey struct{ field, batch string }
+	batches := make(map[batchKey][]VirtualGridPoint)
+	for _, p := range points {
+		k := batchKey{p.FieldID, p.BatchID}
+		batches[k] = append(batches[k], p)
+	}
+	keys := make([]batchKey, 0, len(batches))
+	for k := range batches {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return batches[keys[i]][0].Timestamp.Before(batches[keys[j]][0].Timestamp)
+	})
+
+	type dayKey struct{ field, date string }
+	days := make(map[dayKey][]ObjectManifestEntry)
+	dayOrder := make([]dayKey, 0)
+	uploaded := make(map[batchKey]ObjectManifestEntry, len(keys))
+	for _, k := range keys {
+		entry, err := s.putBatch(k.field, k.batch, batches[k])
+		if err != nil {
+			return err
+		}
+		uploaded[k] = entry
+		d := dayKey{k.field, entry.CycleAt.Format("2006-01-02")}
+		if _, ok := days[d]; !ok {
+			dayOrder = append(dayOrder, d)
+		}
+		days[d] = append(days[d], entry)
+	}
+	for _, d := range dayOrder {
+		if err := s.updateManifest(d.field, d.date, days[d]); err != nil {
+			return err
+		}
+	}
+
+	// Only once every batch is listed (grid_epochs.go)
+	for field, h := range epochHeads(points) {
+		if err := s.advanceLatest(field, uploaded[batchKey{field, h.first.BatchID}]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dayDir is where a field's batches for a date (2006-01-02) live.
+func (s *objectStore) dayDir(field, date string) string {
+	return s.prefix + "/" + field + "/" + strings.ReplaceAll(date, "-", "/")
+}
+
+// advanceLatest points latest.json at entry unless it already names a
+// newer cycle, so a backfill never moves it back.
+func (s *objectStore) advanceLatest(field string, entry ObjectManifestEntry) error {
+	key := s.prefix + "/" + field + "/" + objectLatestName
+	body, found, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if found {
+		var current ObjectLatest
+		if json.Unmarshal(body, &current) == nil && current.CycleAt.After(entry.CycleAt) {
+			return nil
+		}
+	}
+	data, err := json.Marshal(ObjectLatest{
+		FieldID:             field,
+		ObjectManifestEntry: entry,
+		Manifest:            s.dayDir(field, entry.CycleAt.Format("2006-01-02")) + "/" + objectManifestName,
+		UpdatedAt:           time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
+	}
+	return s.put(key, data, "application/json", "")
+}
+
+// putBatch encodes and uploads one batch's cells.
+func (s *objectStore) putBatch(field, batchID string, points []VirtualGridPoint) (ObjectManifestEntry, error) {
+	var raw []byte
+	var err error
+	ext := s.format
+	switch s.format {
+	case ObjectFormatGeoJSON:
+		var fc *GeoJSONFeatureCollection
+		if fc, err = s.ep.BuildGeoJSON(points, UnitsMetric); err == nil {
+			raw, err = json.Marshal(fc)
+		}
+	case ObjectFormatNDJSON:
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		for _, p := range points {
+			if err = enc.Encode(p); err != nil {
+				break
+			}
+		}
+		raw = b.Bytes()
+	default:
+		err = fmt.Errorf("unknown object_store_format %q", s.format)
+	}
+	if err != nil {
+		return ObjectManifestEntry{}, fmt.Errorf("failed to encode batch %s: %v", batchID, err)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		return ObjectManifestEntry{}, fmt.Errorf("failed to compress batch %s: %v", batchID, err)
+	}
+	at := points[0].Timestamp.UTC()
+	name := at.Format("20060102T150405Z")
+	if batchID != "" {
+		name += "_" + batchID
+	}
+	key := fmt.Sprintf("%s/%s.%s.gz", s.dayDir(field, at.Format("2006-01-02")), name, ext)
+	contentType := "application/geo+json"
+	if s.format == ObjectFormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	if err := s.put(key, gz.Bytes(), contentType, "gzip"); err != nil {
+		return ObjectManifestEntry{}, err
+	}
+	sum := sha256.Sum256(gz.Bytes())
+	return ObjectManifestEntry{
+		BatchID:  batchID,
+		CycleAt:  at,
+		Key:      key,
+		Format:   s.format,
+		Cells:    len(points),
+		Bytes:    gz.Len(),
+		SHA256:   hex.EncodeToString(sum[:]),
+		DeviceID: points[0].EdgeDeviceID,
+	}, nil
+}
+
+// updateManifest merges entries into a field's manifest for date,
+// replacing re-sent batches.
+func (s *objectStore) updateManifest(field, date string, entries []ObjectManifestEntry) error {
+	key := s.dayDir(field, date) + "/" + objectManifestName
+	m := ObjectManifest{}
+	body, found, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := json.Unmarshal(body, &m); err != nil {
+			return fmt.Errorf("failed to read manifest %s: %v", key, err)
+		}
+	}
+	m.FieldID, m.Date = field, date
+	m.UpdatedAt = time.Now().UTC()
+	for _, e := range entries {
+		replaced := false
+		for i := range m.Batches {
+			if m.Batches[i].Key == e.Key {
+				m.Batches[i], replaced = e, true
+			}
+		}
+		if !replaced {
+			m.Batches = append(m.Batches, e)
+		}
+	}
+	sort.SliceStable(m.Batches, func(i, j int) bool { return m.Batches[i].CycleAt.Before(m.Batches[j].CycleAt) })
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest %s: %v", key, err)
+	}
+	return s.put(key, data, "application/json", "")
+}
+
+// objectURL is key's URL, virtual-hosted or path style.
+func (s *objectStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	path := "/" + awsURIEscape(key)
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = path, path
+	return &u
+}
+
+func (s *objectStore) put(key string, body []byte, contentType, encoding string) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build upload of %s: %v", key, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	s.sign(req, body, time.Now())
+	resp, err := syncHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload of %s returned HTTP %d: %s", key, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// get fetches key; found is false when it doesn't exist.
+func (s *objectStore) get(key string) (body []byte, found bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to build fetch of %s: %v", key, err)
+	}
+	s.sign(req, nil, time.Now())
+	resp, err := syncHTTPClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("fetch of %s returned HTTP %d", key, resp.StatusCode)
+	}
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		return nil, false, fmt.Errorf("failed to fetch %s: %v", key, err)
+	}
+	return body, true, nil
+}
+
+// sign adds an AWS Signature V4 Authorization header for service s3.
+func (s *objectStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+s.secretKey), day)
+	key = mac(key, s.region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	signature := hex.EncodeToString(mac(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+// awsURIEscape percent-encodes a key as SigV4 expects: everything but
+// unreserved characters, keeping the slashes.
+func awsURIEscape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
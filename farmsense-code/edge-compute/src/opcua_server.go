@@ -0,0 +1,299 @@
+// OPC UA Server - zone results for SCADA
+// Pump stations and irrigation SCADA speak OPC UA, not MQTT or REST. With
+// opcua_port set the device runs a read-only OPC UA server (gopcua) whose
+// namespace urn:farmsense:edge holds, under Objects/FarmSense, one folder
+// per field on the device:
+//
+//	Fields/<field_id>/LastCycleAt, CloudOnline, RainState
+//	Fields/<field_id>/Grid/Cells, CellsNone ... CellsCritical
+//	Fields/<field_id>/Zones/<zone_id>/MoistureRootMean, WaterDeficitMM,
+//	    StressedAreaPct, IrrigationNeed, IrrigationStatus, IrrigateBy,
+//	    RuntimeMinutes, Runtime, GrossDepthMM, Sets, UpdatedAt
+//	Fields/<field_id>/Alerts/Unacknowledged, UnacknowledgedCritical,
+//	    LastKind, LastSeverity, LastSubject, LastMessage, LastRaisedAt
+//
+// Node IDs are fixed strings such as
+// fields/<field_id>/zones/<zone_id>/runtime_min, so HMI tags survive
+// restarts and device swaps. Values are refreshed from each field's latest
+// state every opcua_refresh_sec and a change notification is sent for
+// every value that moved, so clients can subscribe (monitored items)
+// instead of polling. A zone that drops out of the config keeps its last
+// values; UpdatedAt tells a stale zone apart.
+//
+// Sessions are anonymous and nothing is writable. Without a certificate
+// only the None security policy is offered; with opcua_cert_file and
+// opcua_key_file (PEM, RSA) Basic256Sha256 sign and sign & encrypt are
+// added, and opcua_secure_only drops None.
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/server"
+	"github.com/gopcua/opcua/ua"
+)
+
+const (
+	opcuaNamespace         = "urn:farmsense:edge"
+	defaultOPCUARefreshSec = 5
+)
+
+// irrigationNeedLevels are the cell need classes counted under Grid.
+var irrigationNeedLevels = []string{"none", "low", "medium", "high", "critical"}
+
+// OPCUAServer mirrors the fields' latest results into OPC UA nodes.
+type OPCUAServer struct {
+	config     EdgeConfig
+	processors func() []*EdgeProcessor
+	srv        *server.Server
+	ns         *server.NodeNameSpace
+	root       *server.Node
+	folders    map[string]*server.Node
+	vars       map[string]*opcuaVar
+	logger     *slog.Logger
+}
+
+type opcuaVar struct {
+	node  *server.Node
+	value interface{}
+}
+
+// NewOPCUAServer builds the server from the config; processors lists the
+// fields to expose and is called at every refresh.
+func NewOPCUAServer(config EdgeConfig, processors func() []*EdgeProcessor) (*OPCUAServer, error) {
+	host := config.OPCUAHost
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	opts := []server.Option{
+		server.EndPoint(host, config.OPCUAPort),
+		server.ServerName("FarmSense Edge " + config.DeviceID),
+		server.ManufacturerName("FarmSense"),
+		server.ProductName("FarmSense Edge"),
+		server.SoftwareVersion(appVersion),
+		server.EnableAuthMode(ua.UserTokenTypeAnonymous),
+	}
+	if config.OPCUACertFile != "" {
+		cert, key, err := loadOPCUAKeyPair(config.OPCUACertFile, config.OPCUAKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts,
+			server.Certificate(cert),
+			server.PrivateKey(key),
+			server.EnableSecurity("Basic256Sha256", ua.MessageSecurityModeSign),
+			server.EnableSecurity("Basic256Sha256", ua.MessageSecurityModeSignAndEncrypt),
+		)
+	}
+	if config.OPCUACertFile == "" || !config.OPCUASecureOnly {
+		opts = append(opts, server.EnableSecurity("None", ua.MessageSecurityModeNone))
+	}
+
+	s := &OPCUAServer{
+		config:     config,
+		processors: processors,
+		srv:        server.New(opts...),
+		folders:    make(map[string]*server.Node),
+		vars:       make(map[string]*opcuaVar),
+		logger:     slog.With("component", "opcua"),
+	}
+	s.ns = server.NewNodeNameSpace(s.srv, opcuaNamespace)
+	objects, err := s.srv.Namespace(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the OPC UA base namespace: %v", err)
+	}
+	s.root = server.NewFolderNode(ua.NewStringNodeID(s.ns.ID(), "farmsense"), "FarmSense")
+	s.ns.AddNode(s.root)
+	objects.Objects().AddRef(s.root, id.Organizes, true)
+	return s, nil
+}
+
+// loadOPCUAKeyPair reads a PEM certificate (returned as DER) and its RSA key.
+func loadOPCUAKeyPair(certFile, keyFile string) ([]byte, *rsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read opcua_cert_file: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("opcua_cert_file %s holds no PEM certificate", certFile)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read opcua_key_file: %v", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("opcua_key_file %s holds no PEM key", keyFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes); err == nil {
+		return block.Bytes, key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse opcua_key_file: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("opcua_key_file must hold an RSA key for Basic256Sha256")
+	}
+	return block.Bytes, key, nil
+}
+
+// Start listens and refreshes node values in the background.
+func (s *OPCUAServer) Start(ctx context.Context) error {
+	s.refresh()
+	if err := s.srv.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start OPC UA server: %v", err)
+	}
+	s.logger.Info("OPC UA server listening", "port", s.config.OPCUAPort, "secure_only", s.config.OPCUASecureOnly)
+	go s.run(ctx)
+	return nil
+}
+
+func (s *OPCUAServer) run(ctx context.Context) {
+	interval := time.Duration(s.config.OPCUARefreshSec) * time.Second
+	if interval <= 0 {
+		interval = defaultOPCUARefreshSec * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.srv.Close(); err != nil {
+				s.logger.Warn("OPC UA server close failed", "error", err)
+			}
+			return
+		case <-ticker.C:
+			s.refresh()
+		}
+	}
+}
+
+// refresh copies every field's latest state into the nodes (run goroutine
+// and Start only).
+func (s *OPCUAServer) refresh() {
+	for _, ep := range s.processors() {
+		field := s.folder(s.root, "fields/"+ep.config.FieldID, ep.config.FieldID)
+		path := "fields/" + ep.config.FieldID
+
+		grid := ep.LatestGrid()
+		var lastCycle time.Time
+		if len(grid) > 0 {
+			lastCycle = grid[0].Timestamp
+		}
+		rainState := ""
+		if rain := ep.RainStatus(); rain != nil {
+			rainState = rain.State
+		}
+		s.set(field, path+"/last_cycle_at", "LastCycleAt", lastCycle)
+		s.set(field, path+"/cloud_online", "CloudOnline", ep.isOnline.Load())
+		s.set(field, path+"/rain_state", "RainState", rainState)
+
+		gridFolder := s.folder(field, path+"/grid", "Grid")
+		counts := make(map[string]int32, len(irrigationNeedLevels))
+		for _, p := range grid {
+			counts[p.IrrigationNeed]++
+		}
+		s.set(gridFolder, path+"/grid/cells", "Cells", int32(len(grid)))
+		for _, level := range irrigationNeedLevels {
+			s.set(gridFolder, path+"/grid/cells_"+level, "Cells"+strings.ToUpper(level[:1])+level[1:], counts[level])
+		}
+
+		zones := s.folder(field, path+"/zones", "Zones")
+		for _, z := range ep.ZoneStats() {
+			zp := path + "/zones/" + z.ZoneID
+			name := z.Name
+			if name == "" {
+				name = z.ZoneID
+			}
+			zone := s.folder(zones, zp, name)
+			var irrigateBy time.Time
+			if z.IrrigateBy != nil {
+				irrigateBy = *z.IrrigateBy
+			}
+			s.set(zone, zp+"/moisture_root_mean", "MoistureRootMean", z.MoistureRootMean)
+			s.set(zone, zp+"/water_deficit_mm", "WaterDeficitMM", z.WaterDeficitMeanMM)
+			s.set(zone, zp+"/stressed_area_pct", "StressedAreaPct", z.StressedAreaPct)
+			s.set(zone, zp+"/irrigation_need", "IrrigationNeed", z.IrrigationNeed)
+			s.set(zone, zp+"/irrigation_status", "IrrigationStatus", z.IrrigationStatus)
+			s.set(zone, zp+"/irrigate_by", "IrrigateBy", irrigateBy)
+			s.set(zone, zp+"/runtime_min", "RuntimeMinutes", z.RuntimeMinutes)
+			s.set(zone, zp+"/runtime", "Runtime", z.Runtime)
+			s.set(zone, zp+"/gross_depth_mm", "GrossDepthMM", z.GrossDepthMM)
+			s.set(zone, zp+"/sets", "Sets", int32(z.Sets))
+			s.set(zone, zp+"/updated_at", "UpdatedAt", z.Timestamp)
+		}
+
+		alerts := s.folder(field, path+"/alerts", "Alerts")
+		var open, critical int32
+		var last Alert
+		for _, a := range ep.alerts.List("") {
+			if a.FieldID != "" && a.FieldID != ep.config.FieldID {
+				continue
+			}
+			if a.AcknowledgedAt == nil {
+				open++
+				if a.Severity == SeverityCritical {
+					critical++
+				}
+			}
+			if a.RaisedAt.After(last.RaisedAt) {
+				last = a
+			}
+		}
+		s.set(alerts, path+"/alerts/unacknowledged", "Unacknowledged", open)
+		s.set(alerts, path+"/alerts/unacknowledged_critical", "UnacknowledgedCritical", critical)
+		s.set(alerts, path+"/alerts/last_kind", "LastKind", last.Kind)
+		s.set(alerts, path+"/alerts/last_severity", "LastSeverity", last.Severity)
+		s.set(alerts, path+"/alerts/last_subject", "LastSubject", last.Subject)
+		s.set(alerts, path+"/alerts/last_message", "LastMessage", last.Message)
+		s.set(alerts, path+"/alerts/last_raised_at", "LastRaisedAt", last.RaisedAt)
+	}
+}
+
+// folder returns the folder node for path, creating it under parent.
+func (s *OPCUAServer) folder(parent *server.Node, path, name string) *server.Node {
+	if n, ok := s.folders[path]; ok {
+		return n
+	}
+	n := server.NewFolderNode(ua.NewStringNodeID(s.ns.ID(), path), name)
+	s.ns.AddNode(n)
+	parent.AddRef(n, id.Organizes, true)
+	s.folders[path] = n
+	return n
+}
+
+// set updates a variable node, creating it under parent, and notifies
+// subscribers when the value changed.
+func (s *OPCUAServer) set(parent *server.Node, path, name string, value interface{}) {
+	v, ok := s.vars[path]
+	if !ok {
+		n := server.NewVariableNode(ua.NewStringNodeID(s.ns.ID(), path), name, value)
+		s.ns.AddNode(n)
+		parent.AddRef(n, id.HasComponent, true)
+		s.vars[path] = &opcuaVar{node: n, value: value}
+		return
+	}
+	if t, ok := value.(time.Time); ok {
+		if prev, ok := v.value.(time.Time); ok && prev.Equal(t) {
+			return
+		}
+	} else if v.value == value {
+		return
+	}
+	v.value = value
+	v.node.SetAttribute(ua.AttributeIDValue, server.DataValueFromValue(value))
+	s.ns.ChangeNotification(v.node.ID())
+}
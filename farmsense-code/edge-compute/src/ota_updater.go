@@ -0,0 +1,495 @@
+// OTA Updater - signed self-update of the edge binary
+// The release server publishes a manifest in the same signed envelope
+// remote config uses. Its payload names a version, a sequence number that
+// only ever increases, and one artifact (URL, SHA-256, size) per
+// architecture. The updater polls the manifest, and when it finds a newer
+// sequence for this device's architecture it downloads the binary next to
+// the running one, checks size and hash against the signed manifest, keeps
+// the current binary as <binary>.prev and renames the new one into place,
+// which is atomic on the same filesystem. The main loop then flushes its
+// sync queue and exits with exitCodeUpdated; systemd starts the new binary.
+//
+// A freshly installed binary is on trial until it has run a grid cycle and
+// stayed up for updateTrialPeriod. Every boot during the trial is counted
+// in <binary>.ota.json before the config is even loaded, so a binary that
+// crashes, fails validation or stalls the watchdog is rolled back to
+// <binary>.prev after maxTrialBoots and its version is never reinstalled.
+//
+// Manifest payload:
+//
+//	{"version": "1.4.2", "sequence": 42, "released_at": "...",
+//	 "artifacts": {"arm64": {"url": "...", "sha256": "...", "size": 123}, "armv7": {...}}}
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpdateCheck   = 6 * time.Hour
+	updateTrialPeriod    = 10 * time.Minute
+	updateConfirmPoll    = time.Minute
+	maxTrialBoots        = 3
+	manifestMaxBytes     = 1 << 20
+	manifestTimeout      = 30 * time.Second
+	artifactTimeout      = 15 * time.Minute
+	exitCodeUpdated      = 75 // restart requested; see RestartForceExitStatus in the unit
+	updateStateSuffix    = ".ota.json"
+	previousBinarySuffix = ".prev"
+)
+
+// ReleaseManifest is the signed payload.
+type ReleaseManifest struct {
+	Version    string                     `json:"version"`
+	Sequence   int64                      `json:"sequence"`
+	ReleasedAt time.Time                  `json:"released_at"`
+	Artifacts  map[string]ReleaseArtifact `json:"artifacts"` // by releaseArch()
+}
+
+// ReleaseArtifact is one architecture's binary.
+type ReleaseArtifact struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// updateState is persisted next to the binary so it survives a config
+// that no longer loads.
+type updateState struct {
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version,omitempty"`
+	Sequence        int64     `json:"sequence"`
+	InstalledAt     time.Time `json:"installed_at,omitempty"`
+	Trial           bool      `json:"trial"`
+	TrialBoots      int       `json:"trial_boots"`
+	Rejected        []string  `json:"rejected,omitempty"` // versions rolled back
+}
+
+func (st *updateState) rejected(version string) bool {
+	for _, v := range st.Rejected {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateStatus is the updater's state exposed by the API.
+type UpdateStatus struct {
+	RunningVersion string    `json:"running_version"`
+	Arch           string    `json:"arch"`
+	Sequence       int64     `json:"sequence"`
+	Trial          bool      `json:"trial"`
+	TrialBoots     int       `json:"trial_boots"`
+	Rejected       []string  `json:"rejected,omitempty"`
+	LastCheckAt    time.Time `json:"last_check_at,omitempty"`
+	LatestVersion  string    `json:"latest_version,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// releaseArch is the manifest key for this build: arm64, armv7, amd64...
+func releaseArch() string {
+	if runtime.GOARCH == "arm" {
+		return "armv7"
+	}
+	return runtime.GOARCH
+}
+
+func loadUpdateState(path string) (updateState, error) {
+	var st updateState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("invalid update state %s: %v", path, err)
+	}
+	return st, nil
+}
+
+func saveUpdateState(path string, st updateState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// executablePath is the running binary with symlinks resolved, so the
+// swap replaces the file rather than the link.
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// CheckUpdateBoot counts a boot of a binary on trial and rolls it back
+// after maxTrialBoots. Call first thing in main; it exits the process
+// after a rollback so systemd starts the restored binary.
+func CheckUpdateBoot() {
+	bin, err := executablePath()
+	if err != nil {
+		return
+	}
+	statePath := bin + updateStateSuffix
+	st, err := loadUpdateState(statePath)
+	if err != nil {
+		slog.Warn("Ignoring update state", "component", "ota", "error", err)
+		return
+	}
+	if !st.Trial {
+		return
+	}
+
+	st.TrialBoots++
+	if st.TrialBoots <= maxTrialBoots {
+		if err := saveUpdateState(statePath, st); err != nil {
+			slog.Warn("Failed to record trial boot", "component", "ota", "error", err)
+		}
+		slog.Info("Booting updated binary on trial", "component", "ota", "version", st.Version, "boot", st.TrialBoots)
+		return
+	}
+
+	prev := bin + previousBinarySuffix
+	if err := os.Rename(prev, bin); err != nil {
+		// Nothing to go back to; stop counting and keep running
+		slog.Error("Rollback impossible, keeping updated binary", "component", "ota", "version", st.Version, "error", err)
+		st.Trial = false
+		saveUpdateState(statePath, st)
+		return
+	}
+	slog.Error("Updated binary crash-looped, rolled back", "component", "ota",
+		"bad_version", st.Version, "restored_version", st.PreviousVersion, "boots", st.TrialBoots-1)
+	st.Rejected = append(st.Rejected, st.Version)
+	st.Version = st.PreviousVersion
+	st.PreviousVersion = ""
+	st.Trial = false
+	st.TrialBoots = 0
+	if err := saveUpdateState(statePath, st); err != nil {
+		slog.Error("Failed to record rollback", "component", "ota", "error", err)
+	}
+	os.Exit(exitCodeUpdated)
+}
+
+// Updater polls the release manifest and installs newer binaries.
+type Updater struct {
+	binPath     string
+	statePath   string
+	manifestURL string
+	deviceID    string
+	publicKey   ed25519.PublicKey
+	interval    time.Duration
+	health      *HealthState
+	startedAt   time.Time
+	client      *http.Client
+	ready       chan string
+
+	mu     sync.Mutex
+	state  updateState
+	status UpdateStatus
+	logger *slog.Logger
+}
+
+func NewUpdater(config EdgeConfig, health *HealthState) (*Updater, error) {
+	key, err := parseEd25519Key("update_public_key", config.UpdatePublicKey)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := executablePath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate running binary: %v", err)
+	}
+	statePath := bin + updateStateSuffix
+	st, err := loadUpdateState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if st.Version == "" {
+		st.Version = appVersion
+	}
+
+	interval := time.Duration(config.UpdateCheckSec) * time.Second
+	if interval <= 0 {
+		interval = defaultUpdateCheck
+	}
+	u := &Updater{
+		binPath:     bin,
+		statePath:   statePath,
+		manifestURL: config.UpdateManifestURL,
+		deviceID:    config.DeviceID,
+		publicKey:   key,
+		interval:    interval,
+		health:      health,
+		startedAt:   time.Now(),
+		client:      &http.Client{},
+		ready:       make(chan string, 1),
+		state:       st,
+		logger:      slog.With("component", "ota"),
+	}
+	u.status = UpdateStatus{RunningVersion: appVersion, Arch: releaseArch()}
+	return u, nil
+}
+
+// Ready delivers the version just installed; the receiver should flush
+// and exit with exitCodeUpdated.
+func (u *Updater) Ready() <-chan string {
+	return u.ready
+}
+
+// Run confirms a trial binary once it is healthy and checks for releases
+// until the process exits.
+func (u *Updater) Run() {
+	confirm := time.NewTicker(updateConfirmPoll)
+	defer confirm.Stop()
+	check := time.NewTicker(u.interval)
+	defer check.Stop()
+
+	u.maybeConfirm()
+	u.check()
+	for {
+		select {
+		case <-confirm.C:
+			u.maybeConfirm()
+		case <-check.C:
+			u.check()
+		}
+	}
+}
+
+// maybeConfirm ends the trial once the new binary has completed a cycle
+// and stayed up long enough.
+func (u *Updater) maybeConfirm() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.state.Trial {
+		return
+	}
+	if time.Since(u.startedAt) < updateTrialPeriod || u.health.LastCycle().Before(u.startedAt) {
+		return
+	}
+	u.state.Trial = false
+	u.state.TrialBoots = 0
+	if err := saveUpdateState(u.statePath, u.state); err != nil {
+		u.logger.Error("Failed to confirm update", "error", err)
+		u.state.Trial = true // retry next poll
+		return
+	}
+	u.logger.Info("Update confirmed healthy", "version", u.state.Version)
+}
+
+func (u *Updater) check() {
+	err := u.checkOnce()
+	u.mu.Lock()
+	u.status.LastCheckAt = time.Now()
+	if err != nil {
+		u.status.LastError = err.Error()
+	} else {
+		u.status.LastError = ""
+	}
+	u.mu.Unlock()
+	if err != nil {
+		u.logger.Warn("Update check failed", "error", err)
+	}
+}
+
+func (u *Updater) checkOnce() error {
+	manifest, err := u.fetchManifest()
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.status.LatestVersion = manifest.Version
+	st := u.state
+	u.mu.Unlock()
+
+	if st.Trial {
+		return nil // one update at a time
+	}
+	if manifest.Sequence <= st.Sequence || manifest.Version == appVersion {
+		return nil
+	}
+	if st.rejected(manifest.Version) {
+		u.logger.Debug("Skipping rolled-back release", "version", manifest.Version)
+		return nil
+	}
+	artifact, ok := manifest.Artifacts[releaseArch()]
+	if !ok {
+		return fmt.Errorf("release %s has no %s artifact", manifest.Version, releaseArch())
+	}
+
+	u.logger.Info("Installing update", "version", manifest.Version, "sequence", manifest.Sequence, "arch", releaseArch())
+	if err := u.install(artifact); err != nil {
+		return fmt.Errorf("failed to install %s: %v", manifest.Version, err)
+	}
+
+	u.mu.Lock()
+	u.state = updateState{
+		Version:         manifest.Version,
+		PreviousVersion: appVersion,
+		Sequence:        manifest.Sequence,
+		InstalledAt:     time.Now().UTC(),
+		Trial:           true,
+		Rejected:        st.Rejected,
+	}
+	err = saveUpdateState(u.statePath, u.state)
+	u.mu.Unlock()
+	if err != nil {
+		// Without the trial record a bad binary couldn't be rolled back
+		if restoreErr := os.Rename(u.binPath+previousBinarySuffix, u.binPath); restoreErr != nil {
+			u.logger.Error("Failed to restore previous binary", "error", restoreErr)
+		}
+		return fmt.Errorf("failed to record update state: %v", err)
+	}
+
+	select {
+	case u.ready <- manifest.Version:
+	default:
+	}
+	return nil
+}
+
+// fetchManifest downloads and verifies the release manifest.
+func (u *Updater) fetchManifest() (*ReleaseManifest, error) {
+	req, err := http.NewRequest(http.MethodGet, u.manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Device-ID", u.deviceID)
+	req.Header.Set("X-App-Version", appVersion)
+	req.Header.Set("X-Arch", releaseArch())
+	client := *u.client
+	client.Timeout = manifestTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release server returned HTTP %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, manifestMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := openSignedEnvelope(raw, u.publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("manifest rejected: %v", err)
+	}
+	var manifest ReleaseManifest
+	if err := json.Unmarshal(payload, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Version == "" || manifest.Sequence <= 0 {
+		return nil, errors.New("manifest needs version and a positive sequence")
+	}
+	return &manifest, nil
+}
+
+// install downloads the artifact beside the running binary, verifies it
+// and swaps it in, keeping the current binary as the rollback target.
+func (u *Updater) install(artifact ReleaseArtifact) error {
+	want, err := hex.DecodeString(artifact.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid artifact sha256 %q", artifact.SHA256)
+	}
+
+	client := *u.client
+	client.Timeout = artifactTimeout
+	resp, err := client.Get(artifact.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("artifact download returned HTTP %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(u.binPath), filepath.Base(u.binPath)+".new-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	hash := sha256.New()
+	limit := artifact.Size
+	if limit <= 0 {
+		limit = 1 << 30
+	}
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, limit+1))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	if artifact.Size > 0 && n != artifact.Size {
+		return fmt.Errorf("downloaded %d bytes, manifest says %d", n, artifact.Size)
+	}
+	if got := hash.Sum(nil); hex.EncodeToString(got) != strings.ToLower(artifact.SHA256) {
+		return fmt.Errorf("sha256 mismatch: got %x", got)
+	}
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return err
+	}
+
+	// Hard-link the running binary as .prev so there's never a moment
+	// without a binary at binPath, then replace it atomically.
+	prev := u.binPath + previousBinarySuffix
+	if err := os.Remove(prev); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(u.binPath, prev); err != nil {
+		return fmt.Errorf("failed to keep previous binary: %v", err)
+	}
+	if err := os.Rename(tmpPath, u.binPath); err != nil {
+		return fmt.Errorf("failed to swap binary: %v", err)
+	}
+	return nil
+}
+
+// Status returns the updater's state.
+func (u *Updater) Status() UpdateStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st := u.status
+	st.Sequence = u.state.Sequence
+	st.Trial = u.state.Trial
+	st.TrialBoots = u.state.TrialBoots
+	st.Rejected = append([]string(nil), u.state.Rejected...)
+	return st
+}
+
+// ApplyUpdates subscribes the main loop to installed updates.
+func (ep *EdgeProcessor) ApplyUpdates(u *Updater) {
+	ep.updateReady = u.Ready()
+	go u.Run()
+}
@@ -0,0 +1,356 @@
+// Packet Capture - on-demand recording of raw sensor traffic
+// When new probe firmware decodes wrong, support needs the exact bytes the
+// probe sent. A capture subscribes to the broker (a topic filter, the
+// uplink topic by default), keeps messages that mention the requested
+// sensor (DevEUI or sensor ID, in the topic or payload), and writes them
+// to a JSON-lines file under the capture directory until its duration or
+// size budget runs out. Captures are started, stopped and downloaded
+// through the local API.
+//
+// File format, one object per line:
+//
+//	{"received_at": "...", "topic": "...", "qos": 0, "retained": false, "payload_b64": "..."}
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultCaptureDir      = "/data/captures"
+	defaultCaptureDuration = 10 * time.Minute
+	maxCaptureDuration     = time.Hour
+	defaultCaptureBytes    = 5 << 20
+	maxCaptureBytes        = 50 << 20
+	maxActiveCaptures      = 2
+	maxStoredCaptures      = 20
+)
+
+// Capture states
+const (
+	CaptureRunning  = "running"
+	CaptureFinished = "finished"
+	CaptureFailed   = "failed"
+)
+
+// CaptureRequest is what the API asks to record.
+type CaptureRequest struct {
+	Topic    string        `json:"topic"`     // MQTT filter (default: uplink topic)
+	SensorID string        `json:"sensor_id"` // Keep only messages mentioning this ID (empty = all)
+	Duration time.Duration `json:"duration"`
+	MaxBytes int64         `json:"max_bytes"`
+}
+
+// CaptureInfo describes a capture and its file.
+type CaptureInfo struct {
+	ID         string    `json:"capture_id"`
+	Topic      string    `json:"topic"`
+	SensorID   string    `json:"sensor_id,omitempty"`
+	State      string    `json:"state"`
+	StopReason string    `json:"stop_reason,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	EndsBy     time.Time `json:"ends_by"`
+	StoppedAt  time.Time `json:"stopped_at,omitempty"`
+	Messages   int       `json:"messages"`
+	Bytes      int64     `json:"bytes"`
+	MaxBytes   int64     `json:"max_bytes"`
+}
+
+type capturedMessage struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Topic      string    `json:"topic"`
+	QoS        byte      `json:"qos"`
+	Retained   bool      `json:"retained"`
+	Payload    string    `json:"payload_b64"`
+}
+
+type packetCapture struct {
+	info   CaptureInfo
+	client mqtt.Client
+	file   *os.File
+	out    *bufio.Writer
+	timer  *time.Timer
+	match  []byte
+}
+
+// PacketCaptureManager runs bounded captures against the broker.
+type PacketCaptureManager struct {
+	mu        sync.Mutex
+	config    EdgeConfig
+	dir       string
+	captures  map[string]*packetCapture
+	seq       int
+	suspended string // why new captures are refused (empty = allowed)
+	logger    *slog.Logger
+}
+
+func NewPacketCaptureManager(config EdgeConfig) *PacketCaptureManager {
+	dir := config.CaptureDir
+	if dir == "" {
+		dir = defaultCaptureDir
+	}
+	return &PacketCaptureManager{
+		config:   config,
+		dir:      dir,
+		captures: make(map[string]*packetCapture),
+		logger:   slog.With("component", "capture"),
+	}
+}
+
+// Start begins a capture and returns immediately.
+func (m *PacketCaptureManager) Start(req CaptureRequest) (CaptureInfo, error) {
+	if req.Topic == "" {
+		req.Topic = m.config.MQTTUplinkTopic
+		if req.Topic == "" {
+			req.Topic = defaultMQTTUplinkTopic
+		}
+	}
+	if req.Duration <= 0 {
+		req.Duration = defaultCaptureDuration
+	}
+	if req.Duration > maxCaptureDuration {
+		return CaptureInfo{}, fmt.Errorf("duration is capped at %s", maxCaptureDuration)
+	}
+	if req.MaxBytes <= 0 {
+		req.MaxBytes = defaultCaptureBytes
+	}
+	if req.MaxBytes > maxCaptureBytes {
+		return CaptureInfo{}, fmt.Errorf("max_bytes is capped at %d", maxCaptureBytes)
+	}
+
+	m.mu.Lock()
+	if m.suspended != "" {
+		m.mu.Unlock()
+		return CaptureInfo{}, fmt.Errorf("captures are paused: %s", m.suspended)
+	}
+	active := 0
+	for _, c := range m.captures {
+		if c.info.State == CaptureRunning {
+			active++
+		}
+	}
+	if active >= maxActiveCaptures {
+		m.mu.Unlock()
+		return CaptureInfo{}, fmt.Errorf("%d captures already running", active)
+	}
+	m.pruneLocked()
+
+	if err := os.MkdirAll(m.dir, 0750); err != nil {
+		m.mu.Unlock()
+		return CaptureInfo{}, fmt.Errorf("failed to create capture dir: %v", err)
+	}
+	m.seq++
+	now := time.Now()
+	id := fmt.Sprintf("cap_%s_%d", now.UTC().Format("20060102T150405"), m.seq)
+	file, err := os.OpenFile(m.pathFor(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		m.mu.Unlock()
+		return CaptureInfo{}, fmt.Errorf("failed to create capture file: %v", err)
+	}
+
+	c := &packetCapture{
+		info: CaptureInfo{
+			ID:        id,
+			Topic:     req.Topic,
+			SensorID:  req.SensorID,
+			State:     CaptureRunning,
+			StartedAt: now,
+			EndsBy:    now.Add(req.Duration),
+			MaxBytes:  req.MaxBytes,
+		},
+		file:  file,
+		out:   bufio.NewWriter(file),
+		match: bytes.ToLower([]byte(req.SensorID)),
+	}
+	m.captures[id] = c
+	m.mu.Unlock()
+
+	// Connect and subscribe without holding the lock: the broker may
+	// deliver retained messages to record() before the SUBACK.
+	fail := func(err error) (CaptureInfo, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if c.info.State == CaptureRunning {
+			m.finishLocked(c, CaptureFailed, err.Error())
+		}
+		return c.info, err
+	}
+	client, err := newMQTTClient(m.config, m.config.DeviceID+"-"+id)
+	if err != nil {
+		return fail(err)
+	}
+	m.mu.Lock()
+	c.client = client
+	m.mu.Unlock()
+
+	token := client.Subscribe(req.Topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		m.record(id, msg)
+	})
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return fail(fmt.Errorf("timed out subscribing to %s", req.Topic))
+	}
+	if err := token.Error(); err != nil {
+		return fail(fmt.Errorf("failed to subscribe to %s: %v", req.Topic, err))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.info.State == CaptureRunning {
+		c.timer = time.AfterFunc(req.Duration, func() { m.Stop(id, "duration reached") })
+	}
+
+	m.logger.Info("Capture started", "capture_id", id, "topic", req.Topic, "sensor_id", req.SensorID,
+		"duration", req.Duration.String(), "max_bytes", req.MaxBytes)
+	return c.info, nil
+}
+
+// record appends one message if it matches the capture's sensor filter.
+func (m *PacketCaptureManager) record(id string, msg mqtt.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.captures[id]
+	if !ok || c.info.State != CaptureRunning {
+		return
+	}
+	if len(c.match) > 0 &&
+		!bytes.Contains(bytes.ToLower([]byte(msg.Topic())), c.match) &&
+		!bytes.Contains(bytes.ToLower(msg.Payload()), c.match) {
+		return
+	}
+
+	line, err := json.Marshal(capturedMessage{
+		ReceivedAt: time.Now(),
+		Topic:      msg.Topic(),
+		QoS:        msg.Qos(),
+		Retained:   msg.Retained(),
+		Payload:    base64.StdEncoding.EncodeToString(msg.Payload()),
+	})
+	if err != nil {
+		return
+	}
+	if c.info.Bytes+int64(len(line))+1 > c.info.MaxBytes {
+		m.finishLocked(c, CaptureFinished, "size limit reached")
+		return
+	}
+	c.out.Write(line)
+	c.out.WriteByte('\n')
+	c.info.Bytes += int64(len(line)) + 1
+	c.info.Messages++
+}
+
+// Stop ends a running capture. Stopping a finished capture is a no-op.
+func (m *PacketCaptureManager) Stop(id, reason string) (CaptureInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.captures[id]
+	if !ok {
+		return CaptureInfo{}, fmt.Errorf("capture %s not found", id)
+	}
+	if c.info.State == CaptureRunning {
+		m.finishLocked(c, CaptureFinished, reason)
+	}
+	return c.info, nil
+}
+
+func (m *PacketCaptureManager) finishLocked(c *packetCapture, state, reason string) {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	// Unsubscribe/disconnect without waiting: we may be inside the
+	// client's own message callback.
+	if c.client != nil {
+		c.client.Unsubscribe(c.info.Topic)
+		go c.client.Disconnect(250)
+	}
+
+	flushErr := c.out.Flush()
+	closeErr := c.file.Close()
+	if err := errors.Join(flushErr, closeErr); err != nil && state != CaptureFailed {
+		state, reason = CaptureFailed, fmt.Sprintf("failed to write capture file: %v", err)
+	}
+
+	c.info.State = state
+	c.info.StopReason = reason
+	c.info.StoppedAt = time.Now()
+	m.logger.Info("Capture stopped", "capture_id", c.info.ID, "state", state, "reason", reason,
+		"messages", c.info.Messages, "bytes", c.info.Bytes)
+}
+
+// Suspend stops running captures and refuses new ones until called with
+// an empty reason.
+func (m *PacketCaptureManager) Suspend(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.suspended = reason
+	if reason == "" {
+		return
+	}
+	for _, c := range m.captures {
+		if c.info.State == CaptureRunning {
+			m.finishLocked(c, CaptureFinished, reason)
+		}
+	}
+}
+
+// pruneLocked deletes the oldest finished captures beyond maxStoredCaptures.
+func (m *PacketCaptureManager) pruneLocked() {
+	finished := make([]*packetCapture, 0)
+	for _, c := range m.captures {
+		if c.info.State != CaptureRunning {
+			finished = append(finished, c)
+		}
+	}
+	if len(finished) < maxStoredCaptures {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].info.StartedAt.Before(finished[j].info.StartedAt) })
+	for _, c := range finished[:len(finished)-maxStoredCaptures+1] {
+		os.Remove(m.pathFor(c.info.ID))
+		delete(m.captures, c.info.ID)
+	}
+}
+
+// List returns all known captures, newest first.
+func (m *PacketCaptureManager) List() []CaptureInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]CaptureInfo, 0, len(m.captures))
+	for _, c := range m.captures {
+		out = append(out, c.info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+// FinishedPath returns the file of a finished capture for download.
+func (m *PacketCaptureManager) FinishedPath(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.captures[id]
+	if !ok || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("capture %s not found", id)
+	}
+	if c.info.State == CaptureRunning {
+		return "", fmt.Errorf("capture %s is still running", id)
+	}
+	return m.pathFor(id), nil
+}
+
+func (m *PacketCaptureManager) pathFor(id string) string {
+	return filepath.Join(m.dir, id+".jsonl")
+}
@@ -0,0 +1,812 @@
+// Peer Failover - neighbouring edge devices cover for each other's fields
+// Devices on adjacent fields list each other in peers (or find each other
+// with peer_discovery, a JSON beacon multicast on the LAN every check) and
+// poll each other's local API every peer_check_sec:
+//
+//	GET /peer/state   device, its fields with their last cycle, the peers it
+//	                  watches and a hash of its field specs
+//	GET /peer/fields  the field specs: each field's config (grid, sensors,
+//	                  crop, zones...) without secrets or device settings
+//
+// Specs are cached in the local cache whenever a peer's hash changes and
+// published to the cloud edge_field_specs table, so a device that never
+// reached a peer on the LAN can still pull its specs from the cloud.
+//
+// A peer unreachable for peer_failover_after_sec has failed. Of this
+// device and the live peers that also watch it, the one with the lowest
+// device_id takes over, unless a live peer already reports covering those
+// fields: it starts one processor per field from the spec, with its own
+// cloud, cache and device settings, computing from the readings the cloud
+// (or its own LoRaWAN ingest) has. Adopted fields run on their own compute
+// timer, outside the gateway scheduler, and don't publish on MQTT. When
+// the owner answers again and has completed a cycle of a field since, the
+// field is handed back and its processor stopped. Both changes raise an
+// alert. Uploads from either device are separate grid batches.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPeerCheckSec       = 60
+	defaultPeerFailoverSec    = 900
+	peerRequestTimeout        = 10 * time.Second
+	peerBeaconGroup           = "239.255.70.83:5356"
+	peerBeaconMaxBytes        = 1024
+	peerStateMaxBytes         = 1 << 20
+	peerSpecsMaxBytes         = 16 << 20
+	peerSpecHashLen           = 16
+	peerFieldSpecsTable       = "peer_field_specs"
+	cloudPeerFieldSpecsTable  = "edge_field_specs"
+	peerAdoptedComputeMinSecs = 60
+)
+
+// Peer failover alerts
+const (
+	AlertPeerFailover = "peer_failover"
+	AlertPeerHandback = "peer_handback"
+)
+
+// PeerDevice is a statically configured failover peer.
+type PeerDevice struct {
+	DeviceID string `json:"device_id"`
+	URL      string `json:"url"` // Peer's local API base, e.g. https://10.0.4.12:8081
+}
+
+// PeerField is one field a device computes.
+type PeerField struct {
+	FieldID     string    `json:"field_id"`
+	LastCycleAt time.Time `json:"last_cycle_at"`
+	AdoptedFrom string    `json:"adopted_from,omitempty"` // owner, when covering for a failed peer
+}
+
+// PeerState is what a device tells its peers.
+type PeerState struct {
+	DeviceID string      `json:"device_id"`
+	Fields   []PeerField `json:"fields"`
+	Watching []string    `json:"watching"`
+	SpecHash string      `json:"spec_hash"`
+}
+
+// PeerFieldSpecs is a device's field configs for peers to take over.
+type PeerFieldSpecs struct {
+	DeviceID string       `json:"device_id"`
+	SpecHash string       `json:"spec_hash"`
+	Fields   []EdgeConfig `json:"fields"`
+}
+
+type peerBeacon struct {
+	DeviceID string `json:"device_id"`
+	URL      string `json:"url"`
+}
+
+// PeerStatus is this device's view of one peer.
+type PeerStatus struct {
+	DeviceID     string     `json:"device_id"`
+	URL          string     `json:"url"`
+	Discovered   bool       `json:"discovered"` // from a LAN beacon rather than peers
+	LastSeen     time.Time  `json:"last_seen,omitempty"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Failed       bool       `json:"failed"`
+	CachedSpecs  int        `json:"cached_specs"`
+	State        *PeerState `json:"state,omitempty"`
+
+	specHash    string
+	recoveredAt time.Time
+}
+
+// AdoptedField is a peer's field this device is computing.
+type AdoptedField struct {
+	FieldID string    `json:"field_id"`
+	From    string    `json:"from_device_id"`
+	Since   time.Time `json:"since"`
+
+	processor *EdgeProcessor
+}
+
+// PeerMonitor watches the peers and runs the fields of failed ones.
+type PeerMonitor struct {
+	primary   *EdgeProcessor
+	scheduler *FieldScheduler // nil on single-field devices
+	config    EdgeConfig
+	selfURL   string
+	apiKey    string
+	client    *http.Client
+	logger    *slog.Logger
+
+	mu        sync.Mutex
+	peers     map[string]*PeerStatus
+	adopted   map[string]*AdoptedField // by field_id
+	published string                   // spec hash last stored in the cloud
+}
+
+// NewPeerMonitor builds the monitor for the configured peers.
+func NewPeerMonitor(config EdgeConfig, primary *EdgeProcessor, scheduler *FieldScheduler) (*PeerMonitor, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.PeerCACert != "" {
+		pem, err := os.ReadFile(config.PeerCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read peer_ca_cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("peer_ca_cert has no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	apiKey := config.PeerAPIKey
+	if apiKey == "" && len(config.APIKeys) > 0 {
+		apiKey = config.APIKeys[0] // fleets usually share one key
+	}
+	selfURL := config.PeerAdvertiseURL
+	if selfURL == "" {
+		selfURL = defaultPeerURL(config)
+	}
+
+	m := &PeerMonitor{
+		primary:   primary,
+		scheduler: scheduler,
+		config:    config,
+		selfURL:   selfURL,
+		apiKey:    apiKey,
+		client: &http.Client{
+			Timeout:   peerRequestTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		logger:  primary.logger.With("component", "peers"),
+		peers:   make(map[string]*PeerStatus),
+		adopted: make(map[string]*AdoptedField),
+	}
+	for _, p := range config.Peers {
+		m.peers[p.DeviceID] = &PeerStatus{DeviceID: p.DeviceID, URL: strings.TrimRight(p.URL, "/")}
+	}
+	if err := m.initSpecCache(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// defaultPeerURL is this device's API on its first non-loopback IPv4
+// address.
+func defaultPeerURL(config EdgeConfig) string {
+	scheme := "http"
+	if config.APITLSCert != "" {
+		scheme = "https"
+	}
+	host := "127.0.0.1"
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				host = ipnet.IP.String()
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, config.APIHTTPPort)
+}
+
+func (m *PeerMonitor) initSpecCache() error {
+	_, err := m.primary.localDB.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + peerFieldSpecsTable + ` (
+			device_id  TEXT    NOT NULL,
+			field_id   TEXT    NOT NULL,
+			spec       TEXT    NOT NULL,
+			spec_hash  TEXT    NOT NULL,
+			fetched_at INTEGER NOT NULL,
+			PRIMARY KEY (device_id, field_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create peer spec cache: %v", err)
+	}
+	return nil
+}
+
+// Start runs the checks and, with peer_discovery, the LAN beacon.
+func (m *PeerMonitor) Start() {
+	if m.config.PeerDiscovery {
+		go m.listenBeacons()
+	}
+	go m.run()
+	m.logger.Info("Peer failover enabled", "peers", len(m.config.Peers), "discovery", m.config.PeerDiscovery,
+		"advertise_url", m.selfURL)
+}
+
+func (m *PeerMonitor) checkInterval() time.Duration {
+	sec := m.config.PeerCheckSec
+	if sec <= 0 {
+		sec = defaultPeerCheckSec
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func (m *PeerMonitor) failoverAfter() time.Duration {
+	sec := m.config.PeerFailoverAfterSec
+	if sec <= 0 {
+		sec = defaultPeerFailoverSec
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func (m *PeerMonitor) run() {
+	ticker := time.NewTicker(m.checkInterval())
+	defer ticker.Stop()
+	for {
+		m.check(time.Now())
+		<-ticker.C
+	}
+}
+
+// check is one round: announce, publish specs, poll peers, then fail over
+// and hand back.
+func (m *PeerMonitor) check(now time.Time) {
+	if m.config.PeerDiscovery {
+		m.sendBeacon()
+	}
+	m.publishSpecs()
+
+	m.mu.Lock()
+	peers := make([]*PeerStatus, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	m.mu.Unlock()
+
+	for _, p := range peers {
+		state, err := m.fetchState(p.URL)
+		m.mu.Lock()
+		if err != nil {
+			if p.FailingSince == nil {
+				p.FailingSince = &now
+			}
+			p.LastError = err.Error()
+			m.mu.Unlock()
+			continue
+		}
+		if state.DeviceID != p.DeviceID {
+			p.LastError = fmt.Sprintf("peer at %s is %s", p.URL, state.DeviceID)
+			m.mu.Unlock()
+			continue
+		}
+		if p.Failed {
+			p.recoveredAt = now
+			m.logger.Info("Peer is back", "peer", p.DeviceID)
+		}
+		p.Failed = false
+		p.FailingSince = nil
+		p.LastError = ""
+		p.LastSeen = now
+		p.State = state
+		refresh := state.SpecHash != p.specHash
+		m.mu.Unlock()
+
+		if refresh {
+			if err := m.refreshSpecs(p); err != nil {
+				m.logger.Warn("Failed to fetch peer field specs", "peer", p.DeviceID, "error", err)
+			}
+		}
+	}
+
+	m.failOver(now)
+	m.handBack()
+}
+
+// request GETs a peer API path into out.
+func (m *PeerMonitor) request(base, path string, limit int64, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, base+path, nil)
+	if err != nil {
+		return fmt.Errorf("invalid peer URL %s: %v", base, err)
+	}
+	if m.apiKey != "" {
+		req.Header.Set("X-API-Key", m.apiKey)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach peer: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, limit)).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode peer response: %v", err)
+	}
+	return nil
+}
+
+func (m *PeerMonitor) fetchState(base string) (*PeerState, error) {
+	var state PeerState
+	if err := m.request(base, "/peer/state", peerStateMaxBytes, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// refreshSpecs fetches a peer's field specs and caches them.
+func (m *PeerMonitor) refreshSpecs(p *PeerStatus) error {
+	var specs PeerFieldSpecs
+	if err := m.request(p.URL, "/peer/fields", peerSpecsMaxBytes, &specs); err != nil {
+		return err
+	}
+	if specs.DeviceID != p.DeviceID {
+		return fmt.Errorf("specs are for %s", specs.DeviceID)
+	}
+	if err := m.cacheSpecs(specs); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	p.specHash = specs.SpecHash
+	p.CachedSpecs = len(specs.Fields)
+	m.mu.Unlock()
+	return nil
+}
+
+// cacheSpecs replaces a peer's specs in the local cache.
+func (m *PeerMonitor) cacheSpecs(specs PeerFieldSpecs) error {
+	tx, err := m.primary.localDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin spec cache update: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM `+peerFieldSpecsTable+` WHERE device_id = ?`, specs.DeviceID); err != nil {
+		return fmt.Errorf("failed to clear cached specs: %v", err)
+	}
+	for _, f := range specs.Fields {
+		spec, err := json.Marshal(f)
+		if err != nil {
+			return fmt.Errorf("failed to encode spec for %s: %v", f.FieldID, err)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO `+peerFieldSpecsTable+` (device_id, field_id, spec, spec_hash, fetched_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, specs.DeviceID, f.FieldID, string(spec), specs.SpecHash, time.Now().Unix()); err != nil {
+			return fmt.Errorf("failed to cache spec for %s: %v", f.FieldID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// cachedSpecs returns a peer's cached field specs.
+func (m *PeerMonitor) cachedSpecs(deviceID string) ([]EdgeConfig, error) {
+	rows, err := m.primary.localDB.Query(`SELECT spec FROM `+peerFieldSpecsTable+` WHERE device_id = ? ORDER BY field_id`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cached specs: %v", err)
+	}
+	defer rows.Close()
+	return decodeSpecRows(rows)
+}
+
+// cloudSpecs pulls a peer's field specs from the cloud.
+func (m *PeerMonitor) cloudSpecs(deviceID string) ([]EdgeConfig, error) {
+	db := m.primary.cloud.DB()
+	if !m.primary.isOnline.Load() || db == nil {
+		return nil, fmt.Errorf("cloud offline")
+	}
+	rows, err := db.Query(`SELECT spec FROM `+cloudPeerFieldSpecsTable+` WHERE device_id = $1 ORDER BY field_id`, deviceID)
+	if err != nil {
+		m.primary.cloud.ReportFailure(err)
+		return nil, fmt.Errorf("failed to query cloud specs: %v", err)
+	}
+	defer rows.Close()
+	return decodeSpecRows(rows)
+}
+
+func decodeSpecRows(rows *sql.Rows) ([]EdgeConfig, error) {
+	specs := make([]EdgeConfig, 0)
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("failed to read spec: %v", err)
+		}
+		var c EdgeConfig
+		if err := json.Unmarshal([]byte(raw), &c); err != nil {
+			return nil, fmt.Errorf("failed to decode spec: %v", err)
+		}
+		specs = append(specs, c)
+	}
+	return specs, rows.Err()
+}
+
+// FieldSpecs returns this device's own fields as handoff specs.
+func (m *PeerMonitor) FieldSpecs() PeerFieldSpecs {
+	fields := []EdgeConfig{handoffSpec(m.config)}
+	for _, fs := range m.config.Fields {
+		if fs.FieldID != m.config.FieldID {
+			fields = append(fields, handoffSpec(gatewayFieldConfig(m.config, fs)))
+		}
+	}
+	specs := PeerFieldSpecs{DeviceID: m.primary.deviceID, Fields: fields}
+	raw, _ := json.Marshal(fields)
+	sum := sha256.Sum256(raw)
+	specs.SpecHash = hex.EncodeToString(sum[:])[:peerSpecHashLen]
+	return specs
+}
+
+// handoffSpecKeys are the settings that belong to a field rather than the
+// device. Handoff specs carry only these; everything else (identity,
+// stores, credentials, I/O, services, logging) is the running device's.
+var handoffSpecKeys = []string{
+	"field_id", "tenant_id", "grid_resolution_m", "idw_power", "search_radius_m", "min_sensors",
+	"sync_interval_sec", "compute_interval_sec", "event_trigger_delta_vwc", "event_check_sec",
+	"event_min_spacing_sec", "compute_schedule", "compute_jitter_sec", "crop", "irrigation_thresholds",
+	"forecast_provider", "forecast_url", "forecast_days", "forecast_refresh_min", "derived_metrics",
+	"gdd_base_c", "trend_retention_days", "trend_layer_cycles", "sensor_cache_days",
+	"reading_retention_days", "zone_retention_days", "vri_rate_step_mm", "vri_max_depth_mm",
+	"vri_efficiency", "units", "anisotropy",
+	"irrigation_water_ec_dsm", "soil_ec_factor", "salinity_threshold_dsm", "max_leaching_fraction",
+	"rbf_basis", "rbf_max_sensors", "rbf_smoothing", "rbf_shape_m",
+	"sensor_classes", "sensor_class_reference", "neighbor_fields", "neighbor_band_m", "neighbor_max_age_min",
+	"reading_half_life_min", "reading_half_life_irrigating_min",
+	"microclimate_terrain", "canopy_zones", "water_bodies", "lapse_rate_day_c_per_m",
+	"inversion_night_c_per_m", "canopy_day_c", "canopy_night_c", "water_day_c", "water_night_c",
+	"water_range_m", "frost_alert_c", "heat_alert_c", "temp_event_hysteresis_c", "temp_event_hold_min",
+	"shadow_interpolator", "shadow_idw_power", "kriging_range_m", "kriging_nugget",
+	"shadow_retention_days", "moisture_context_retention_days", "late_reading_policy", "late_reading_max_hours",
+	"sensor_installs", "soil_damping_depth_cm", "new_install_days", "sensor_report_interval_sec",
+	"battery_cutoff_v", "sensor_health_alert_score", "battery_history_days",
+	"maintenance_horizon_days", "maintenance_lead_days", "maintenance_visit_radius_m",
+	"field_boundary", "exclusion_zones", "management_zones", "irrigation_hardware", "flow_zones",
+	"clog_warn_pct", "clog_critical_pct", "uniformity_drop_pct",
+	"anomaly_ewma_lambda", "anomaly_limit_sigma", "anomaly_cusum_h", "anomaly_warmup_cycles",
+	"rain_gauges", "rain_drain_hours", "rain_min_mm", "rain_rise_vwc", "rain_rise_sensor_pct",
+	"irrigation_rise_vwc", "irrigation_mask_hours", "irrigation_mask_share",
+	"min_need_confidence", "extrapolation_policy", "extrapolation_buffer_m", "extrapolation_alpha_m",
+	"soil_texture", "traffic_go_pct", "logical_grid",
+	"sync_changes_only", "diff_moisture_delta", "diff_temp_delta_c", "diff_deficit_delta_mm",
+	"full_snapshot_sec", "sync_reconcile_min_cells", "weather_stations",
+	"irrigation_lookahead_hours", "irrigation_neglect_hours",
+}
+
+// handoffSpec is a field's config cut down to handoffSpecKeys, with the
+// weather station keys cleared.
+func handoffSpec(c EdgeConfig) EdgeConfig {
+	spec := withFieldSettings(EdgeConfig{}, c)
+	stations := make([]WeatherStation, len(spec.WeatherStations))
+	for i, s := range spec.WeatherStations {
+		s.WeatherLinkAPIKey = ""
+		stations[i] = s
+	}
+	spec.WeatherStations = stations
+	return spec
+}
+
+// adoptedFieldConfig runs a peer's field spec with this device's own
+// connection, cache and device settings. Everything a second processor
+// mustn't start again (API ports, MQTT, LoRaWAN, gateway fields, exports)
+// stays off.
+func adoptedFieldConfig(own, spec EdgeConfig) EdgeConfig {
+	c := withFieldSettings(own, spec)
+	c.APIHTTPPort = 0
+	c.AllianceHTTPPort = 0
+	c.MQTTBrokerURL, c.MQTTPublishPrefix = "", ""
+	c.LoRaWANDevices = nil
+	c.Fields = nil
+	c.Peers, c.PeerDiscovery = nil, false
+	c.GeoJSONExportPath = ""
+	c.Simulation = nil
+	if c.ComputeInterval < peerAdoptedComputeMinSecs {
+		c.ComputeInterval = peerAdoptedComputeMinSecs
+	}
+	if c.SyncInterval <= 0 {
+		c.SyncInterval = own.SyncInterval
+	}
+	return c
+}
+
+// withFieldSettings returns base with its handoffSpecKeys settings taken
+// from field.
+func withFieldSettings(base, field EdgeConfig) EdgeConfig {
+	keys := make(map[string]bool, len(handoffSpecKeys))
+	for _, key := range handoffSpecKeys {
+		keys[key] = true
+	}
+	dst, src := reflect.ValueOf(&base).Elem(), reflect.ValueOf(field)
+	for i := 0; i < dst.NumField(); i++ {
+		name, _, _ := strings.Cut(dst.Type().Field(i).Tag.Get("json"), ",")
+		if keys[name] {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return base
+}
+
+// publishSpecs stores this device's specs in the cloud when they changed.
+func (m *PeerMonitor) publishSpecs() {
+	specs := m.FieldSpecs()
+	m.mu.Lock()
+	current := m.published == specs.SpecHash
+	m.mu.Unlock()
+	db := m.primary.cloud.DB()
+	if current || !m.primary.isOnline.Load() || db == nil {
+		return
+	}
+
+	err := func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM `+cloudPeerFieldSpecsTable+` WHERE device_id = $1`, specs.DeviceID); err != nil {
+			return err
+		}
+		for _, f := range specs.Fields {
+			spec, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO `+cloudPeerFieldSpecsTable+` (device_id, field_id, spec, spec_hash, updated_at)
+				VALUES ($1, $2, $3, $4, now())
+			`, specs.DeviceID, f.FieldID, string(spec), specs.SpecHash); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		m.logger.Warn("Failed to publish field specs", "error", err)
+		m.primary.cloud.ReportFailure(err)
+		return
+	}
+	m.mu.Lock()
+	m.published = specs.SpecHash
+	m.mu.Unlock()
+	m.logger.Info("Published field specs for peers", "fields", len(specs.Fields), "spec_hash", specs.SpecHash)
+}
+
+// failOver takes over the fields of peers that stayed unreachable, when
+// this device is the one that should.
+func (m *PeerMonitor) failOver(now time.Time) {
+	m.mu.Lock()
+	due := make([]string, 0)
+	for id, p := range m.peers {
+		if p.FailingSince != nil && !p.Failed && now.Sub(*p.FailingSince) >= m.failoverAfter() {
+			due = append(due, id)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(due)
+
+	for _, id := range due {
+		if !m.shouldCover(id) {
+			continue
+		}
+		specs, err := m.cachedSpecs(id)
+		if err == nil && len(specs) == 0 {
+			specs, err = m.cloudSpecs(id)
+		}
+		if err != nil || len(specs) == 0 {
+			m.logger.Warn("Peer failed but its field specs are unavailable", "peer", id, "error", err)
+			continue
+		}
+		m.mu.Lock()
+		m.peers[id].Failed = true
+		m.mu.Unlock()
+		for _, spec := range specs {
+			m.adopt(id, spec, now)
+		}
+	}
+}
+
+// shouldCover reports whether this device is the one to take over a
+// failed peer: nobody live covers it yet and no live peer watching it has
+// a lower device_id.
+func (m *PeerMonitor) shouldCover(failed string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	self := m.primary.deviceID
+	for id, p := range m.peers {
+		if id == failed || p.FailingSince != nil || p.State == nil {
+			continue
+		}
+		for _, f := range p.State.Fields {
+			if f.AdoptedFrom == failed {
+				return false
+			}
+		}
+		for _, w := range p.State.Watching {
+			if w == failed && id < self {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// adopt starts computing one of a failed peer's fields.
+func (m *PeerMonitor) adopt(from string, spec EdgeConfig, now time.Time) {
+	if m.servesField(spec.FieldID) {
+		return
+	}
+	config := adoptedFieldConfig(m.config, spec)
+	if err := config.Validate(); err != nil {
+		m.logger.Warn("Peer field spec invalid", "peer", from, "field_id", spec.FieldID, "error", err)
+		return
+	}
+	p, err := NewEdgeProcessor(config, m.primary.deviceID)
+	if err != nil {
+		m.logger.Error("Failed to start peer field", "peer", from, "field_id", spec.FieldID, "error", err)
+		return
+	}
+	p.alerts = m.primary.alerts
+	p.clock = m.primary.clock
+	p.adoptedFrom = from
+	p.stop = make(chan struct{})
+	go p.Run()
+
+	m.mu.Lock()
+	m.adopted[spec.FieldID] = &AdoptedField{FieldID: spec.FieldID, From: from, Since: now, processor: p}
+	m.mu.Unlock()
+	m.logger.Warn("Covering field for failed peer", "peer", from, "field_id", spec.FieldID)
+	m.primary.alerts.Raise(Alert{
+		Kind:     AlertPeerFailover,
+		Severity: SeverityWarning,
+		FieldID:  spec.FieldID,
+		Subject:  from,
+		Message:  fmt.Sprintf("Peer %s unreachable for %s; %s is computing field %s", from, m.failoverAfter(), m.primary.deviceID, spec.FieldID),
+	})
+}
+
+// servesField reports whether this device already computes fieldID.
+func (m *PeerMonitor) servesField(fieldID string) bool {
+	if fieldID == m.config.FieldID {
+		return true
+	}
+	for _, fs := range m.config.Fields {
+		if fs.FieldID == fieldID {
+			return true
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.adopted[fieldID] != nil
+}
+
+// handBack stops covering fields whose owner is back and has computed
+// them again since.
+func (m *PeerMonitor) handBack() {
+	m.mu.Lock()
+	release := make([]*AdoptedField, 0)
+	for id, a := range m.adopted {
+		owner := m.peers[a.From]
+		if owner == nil || owner.FailingSince != nil || owner.State == nil {
+			continue
+		}
+		for _, f := range owner.State.Fields {
+			if f.FieldID == id && f.AdoptedFrom == "" && f.LastCycleAt.After(owner.recoveredAt) {
+				release = append(release, a)
+				delete(m.adopted, id)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, a := range release {
+		a.processor.Stop()
+		m.logger.Info("Handed field back to peer", "peer", a.From, "field_id", a.FieldID)
+		m.primary.alerts.Raise(Alert{
+			Kind:     AlertPeerHandback,
+			Severity: SeverityInfo,
+			FieldID:  a.FieldID,
+			Subject:  a.From,
+			Message:  fmt.Sprintf("Peer %s is computing field %s again", a.From, a.FieldID),
+		})
+	}
+}
+
+// State is this device's PeerState.
+func (m *PeerMonitor) State() PeerState {
+	state := PeerState{DeviceID: m.primary.deviceID, SpecHash: m.FieldSpecs().SpecHash}
+	if m.scheduler != nil {
+		for _, st := range m.scheduler.Status() {
+			state.Fields = append(state.Fields, PeerField{FieldID: st.FieldID, LastCycleAt: st.LastCompletedAt})
+		}
+	} else {
+		state.Fields = append(state.Fields, PeerField{FieldID: m.config.FieldID, LastCycleAt: m.primary.health.LastCycle()})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.adopted {
+		state.Fields = append(state.Fields, PeerField{FieldID: a.FieldID, LastCycleAt: a.processor.health.LastCycle(), AdoptedFrom: a.From})
+	}
+	for id := range m.peers {
+		state.Watching = append(state.Watching, id)
+	}
+	sort.Strings(state.Watching)
+	return state
+}
+
+// Status returns the peers and the fields adopted from them.
+func (m *PeerMonitor) Status() ([]PeerStatus, []AdoptedField) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]PeerStatus, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].DeviceID < peers[j].DeviceID })
+	adopted := make([]AdoptedField, 0, len(m.adopted))
+	for _, a := range m.adopted {
+		adopted = append(adopted, *a)
+	}
+	sort.Slice(adopted, func(i, j int) bool { return adopted[i].FieldID < adopted[j].FieldID })
+	return peers, adopted
+}
+
+// sendBeacon announces this device on the LAN.
+func (m *PeerMonitor) sendBeacon() {
+	addr, err := net.ResolveUDPAddr("udp4", peerBeaconGroup)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		m.logger.Debug("Peer beacon not sent", "error", err)
+		return
+	}
+	defer conn.Close()
+	msg, _ := json.Marshal(peerBeacon{DeviceID: m.primary.deviceID, URL: m.selfURL})
+	if _, err := conn.Write(msg); err != nil {
+		m.logger.Debug("Peer beacon not sent", "error", err)
+	}
+}
+
+// listenBeacons adds devices announcing themselves on the LAN as peers.
+func (m *PeerMonitor) listenBeacons() {
+	addr, err := net.ResolveUDPAddr("udp4", peerBeaconGroup)
+	if err != nil {
+		m.logger.Error("Invalid peer beacon group", "error", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		m.logger.Error("Peer discovery unavailable", "error", err)
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, peerBeaconMaxBytes)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			m.logger.Warn("Peer beacon read failed", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		var b peerBeacon
+		if json.Unmarshal(buf[:n], &b) != nil || b.DeviceID == "" || b.DeviceID == m.primary.deviceID {
+			continue
+		}
+		if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		m.mu.Lock()
+		if p := m.peers[b.DeviceID]; p == nil {
+			m.peers[b.DeviceID] = &PeerStatus{DeviceID: b.DeviceID, URL: strings.TrimRight(b.URL, "/"), Discovered: true}
+			m.logger.Info("Discovered peer", "peer", b.DeviceID, "url", b.URL)
+		} else if p.Discovered {
+			p.URL = strings.TrimRight(b.URL, "/") // DHCP may have moved it
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,504 @@
+// Probe Placement - where the next probes should go
+// The suggest-probes subcommand answers "we have budget for N more
+// probes, where?" for the install crew. It replays up to a week of cycles
+// (the recorded grid_history cycle times, at most placementMaxCycles of
+// them) through the same leave-one-out cross-validation the live cycle runs
+// (loocv.go), so every existing probe gets the root-zone moisture error the
+// network makes where it stands without it.
+//
+// Error grows with distance to the nearest probe. The model behind the
+// suggestions is an exponential variogram whose range is search_radius_m:
+// the predicted variance at a cell d metres from its nearest probe is
+// s·(1 − e^(−3d/R)), where the sill s is how variable the soil is there.
+// Each probe's sill comes from its LOOCV error and the distance to its
+// nearest neighbour in that cycle, and a cell's sill is the inverse-distance
+// mean of the probes'. Probes are then placed one at a time on the grid
+// cells inside the field boundary:
+//
+//	variance  (default) the cell that removes the most predicted variance
+//	          summed over the field
+//	coverage  the cell that brings the most cells up to min_sensors probes
+//	          within search_radius_m, ties broken by variance
+//
+// Without any cross-validated errors (too few probes in every cycle) the
+// sill is the same everywhere and the suggestions fill the largest gaps.
+// A suggestion is never closer than one grid cell to a probe. The field
+// boundary is the -boundary GeoJSON file, else the cloud fields row's,
+// else the grid's extent. Distances are straight-line metres; anisotropy
+// (anisotropy.go) is not considered. The output is a GeoJSON FeatureCollection of Points (the
+// suggestions in order, then the existing probes) plus the boundary, with
+// a placement summary as a foreign member.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+// Placement objectives
+const (
+	PlacementVariance = "variance"
+	PlacementCoverage = "coverage"
+)
+
+const (
+	defaultPlacementWindow = 7 * 24 * time.Hour
+	placementMaxCycles     = 96
+	placementMinGamma      = 0.1 // floor on a probe's variogram value, so neighbours a few metres apart don't blow up its sill
+)
+
+// PlacementOptions configures a probe placement suggestion.
+type PlacementOptions struct {
+	Probes    int
+	Objective string        // variance (default) or coverage
+	Window    time.Duration // history to cross-validate; default 7 days
+	Boundary  [][2]float64  // field outline as [lon, lat]; nil = cloud, then grid extent
+}
+
+// PlacementSummary describes how the suggestions were made.
+type PlacementSummary struct {
+	FieldID             string    `json:"field_id"`
+	GeneratedAt         time.Time `json:"generated_at"`
+	Objective           string    `json:"objective"`
+	BoundarySource      string    `json:"boundary_source"` // file, config (field_boundary), cloud or grid_extent
+	Cycles              int       `json:"cycles"`          // cycles cross-validated
+	ErrorSamples        int       `json:"error_samples"`   // probe predictions they gave
+	ExistingProbes      int       `json:"existing_probes"`
+	SuggestedProbes     int       `json:"suggested_probes"`
+	CandidateCells      int       `json:"candidate_cells"`
+	LOOCVRMSE           float64   `json:"loocv_rmse_vwc,omitempty"` // root moisture, over the window
+	PredictedRMSEBefore float64   `json:"predicted_rmse_vwc_before,omitempty"`
+	PredictedRMSEAfter  float64   `json:"predicted_rmse_vwc_after,omitempty"`
+	VarianceReduction   float64   `json:"variance_reduction_pct"`
+	CoveredPctBefore    float64   `json:"covered_pct_before"` // cells with min_sensors probes in search_radius_m
+	CoveredPctAfter     float64   `json:"covered_pct_after"`
+}
+
+// PlacementGeoJSON is the suggestion as an RFC 7946 feature collection.
+type PlacementGeoJSON struct {
+	Type      string             `json:"type"`
+	Placement PlacementSummary   `json:"placement"`
+	Features  []PlacementFeature `json:"features"`
+}
+
+// PlacementFeature is a suggested probe, an existing probe or the boundary.
+type PlacementFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   PlacementGeometry      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// PlacementGeometry is a Point or Polygon geometry.
+type PlacementGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// placementProbe is an existing probe and its cross-validated error.
+type placementProbe struct {
+	id       string
+	at       orb.Point
+	seen     time.Time
+	sq, sill float64 // sums over its predictions
+	n        int
+}
+
+// placementCell is a candidate cell, in metres from the grid origin.
+type placementCell struct {
+	gridPoint
+	x, y    float64
+	sill    float64
+	nearest float64 // metres to the nearest probe so far
+	count   int     // probes within search_radius_m
+}
+
+func validPlacementObjective(objective string) bool {
+	return objective == "" || objective == PlacementVariance || objective == PlacementCoverage
+}
+
+// SuggestProbePlacement suggests where opts.Probes additional probes
+// would improve the field's grid most.
+func (ep *EdgeProcessor) SuggestProbePlacement(opts PlacementOptions) (*PlacementGeoJSON, error) {
+	if ep.config.LogicalGrid != nil {
+		return nil, fmt.Errorf("probe placement covers geographic grids only")
+	}
+	if opts.Probes < 1 {
+		return nil, fmt.Errorf("the number of probes must be at least 1")
+	}
+	if !validPlacementObjective(opts.Objective) {
+		return nil, fmt.Errorf("unknown objective %q (variance or coverage)", opts.Objective)
+	}
+	if opts.Objective == "" {
+		opts.Objective = PlacementVariance
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultPlacementWindow
+	}
+
+	summary := PlacementSummary{
+		FieldID:     ep.config.FieldID,
+		GeneratedAt: time.Now().UTC(),
+		Objective:   opts.Objective,
+	}
+	ring, source := ep.placementBoundary(opts.Boundary)
+	summary.BoundarySource = source
+
+	now := ep.clock.Now()
+	probes, cycles, err := ep.probeErrorHistory(now.Add(-opts.Window), now)
+	if err != nil {
+		return nil, err
+	}
+	if len(probes) == 0 {
+		return nil, fmt.Errorf("no probe readings in the last %s", opts.Window)
+	}
+	summary.Cycles = cycles
+	summary.ExistingProbes = len(probes)
+
+	g := ep.gridLayout()
+	origin := g.point(0, 0)
+	res := ep.config.GridResolution
+	if res <= 0 {
+		res = 20.0
+	}
+	radius := ep.config.SearchRadius
+	sill, rmse, samples := placementSills(probes, radius)
+	summary.ErrorSamples = samples
+	if samples > 0 {
+		summary.LOOCVRMSE = rmse
+	}
+
+	cells := make([]placementCell, 0)
+	for _, gp := range ep.generateGridPoints() {
+		if !pointInRing(gp.Point[0], gp.Point[1], ring) {
+			continue
+		}
+		local := localMeters(origin, gp.Point)
+		c := placementCell{gridPoint: gp, x: local[0], y: local[1], sill: sill(gp.Point), nearest: math.Inf(1)}
+		for _, p := range probes {
+			d := planarDist(local, localMeters(origin, p.at))
+			c.nearest = math.Min(c.nearest, d)
+			if d <= radius {
+				c.count++
+			}
+		}
+		cells = append(cells, c)
+	}
+	if len(cells) == 0 {
+		return nil, fmt.Errorf("no grid cells inside the field boundary")
+	}
+	summary.CandidateCells = len(cells)
+
+	gamma := func(d float64) float64 { return 1 - math.Exp(-3*d/radius) }
+	fieldVariance := func() (v float64, covered int) {
+		for _, c := range cells {
+			v += c.sill * gamma(c.nearest)
+			if c.count >= ep.config.MinSensors {
+				covered++
+			}
+		}
+		return v, covered
+	}
+	before, coveredBefore := fieldVariance()
+
+	features := make([]PlacementFeature, 0, opts.Probes+len(probes)+1)
+	for rank := 1; rank <= opts.Probes; rank++ {
+		best, bestGain, bestReduction := -1, -1, 0.0
+		for i, q := range cells {
+			if q.nearest <= res {
+				continue
+			}
+			gain, reduction := 0, 0.0
+			for _, c := range cells {
+				d := math.Hypot(c.x-q.x, c.y-q.y)
+				if d < c.nearest {
+					reduction += c.sill * (gamma(c.nearest) - gamma(d))
+				}
+				if d <= radius && c.count == ep.config.MinSensors-1 {
+					gain++
+				}
+			}
+			if opts.Objective == PlacementVariance {
+				gain = 0
+			}
+			if gain > bestGain || (gain == bestGain && reduction > bestReduction) {
+				best, bestGain, bestReduction = i, gain, reduction
+			}
+		}
+		if best < 0 {
+			ep.logger.Warn("No room for more probes at least a grid cell from the others",
+				"component", "placement", "suggested", rank-1)
+			break
+		}
+
+		q := cells[best]
+		props := map[string]interface{}{
+			"role":                   "suggested",
+			"rank":                   rank,
+			"grid_id":                ep.generateGridID(q.gridPoint),
+			"nearest_probe_m":        math.Round(q.nearest*10) / 10,
+			"variance_reduction_pct": percentOf(bestReduction, before),
+		}
+		if samples > 0 {
+			props["predicted_rmse_vwc"] = math.Sqrt(q.sill * gamma(q.nearest))
+		}
+		if opts.Objective == PlacementCoverage {
+			props["newly_covered_cells"] = bestGain
+		}
+		features = append(features, PlacementFeature{
+			Type:       "Feature",
+			ID:         fmt.Sprintf("suggested_%d", rank),
+			Geometry:   PlacementGeometry{Type: "Point", Coordinates: [2]float64{q.Point[0], q.Point[1]}},
+			Properties: props,
+		})
+		for i := range cells {
+			d := math.Hypot(cells[i].x-q.x, cells[i].y-q.y)
+			cells[i].nearest = math.Min(cells[i].nearest, d)
+			if d <= radius {
+				cells[i].count++
+			}
+		}
+		summary.SuggestedProbes++
+	}
+	after, coveredAfter := fieldVariance()
+
+	summary.VarianceReduction = percentOf(before-after, before)
+	summary.CoveredPctBefore = percentOf(float64(coveredBefore), float64(len(cells)))
+	summary.CoveredPctAfter = percentOf(float64(coveredAfter), float64(len(cells)))
+	if samples > 0 {
+		summary.PredictedRMSEBefore = math.Sqrt(before / float64(len(cells)))
+		summary.PredictedRMSEAfter = math.Sqrt(after / float64(len(cells)))
+	}
+
+	for _, p := range probes {
+		props := map[string]interface{}{"role": "existing", "sensor_id": p.id, "last_seen": p.seen}
+		if p.n > 0 {
+			props["loocv_rmse_vwc"] = math.Sqrt(p.sq / float64(p.n))
+			props["loocv_predictions"] = p.n
+		}
+		features = append(features, PlacementFeature{
+			Type:       "Feature",
+			ID:         p.id,
+			Geometry:   PlacementGeometry{Type: "Point", Coordinates: [2]float64{p.at[0], p.at[1]}},
+			Properties: props,
+		})
+	}
+	features = append(features, PlacementFeature{
+		Type:       "Feature",
+		ID:         ep.config.FieldID,
+		Geometry:   PlacementGeometry{Type: "Polygon", Coordinates: [][][2]float64{closedRing(ring)}},
+		Properties: map[string]interface{}{"role": "boundary", "source": source},
+	})
+
+	ep.logger.Info("Suggested probe placement", "component", "placement", "objective", opts.Objective,
+		"suggested", summary.SuggestedProbes, "existing", len(probes), "cycles", cycles,
+		"variance_reduction_pct", summary.VarianceReduction)
+	return &PlacementGeoJSON{Type: "FeatureCollection", Placement: summary, Features: features}, nil
+}
+
+// probeErrorHistory cross-validates the cycles in (from, to] and returns
+// the probes seen, at their latest positions, with their root moisture
+// errors, and how many cycles were cross-validated.
+func (ep *EdgeProcessor) probeErrorHistory(from, to time.Time) ([]*placementProbe, int, error) {
+	cycles, err := ep.historyTimestamps(from, to)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read grid history: %v", err)
+	}
+	if len(cycles) == 0 {
+		step := time.Duration(ep.config.ComputeInterval) * time.Second
+		if step <= 0 {
+			step = backfillSensorWindow
+		}
+		for at := to; at.After(from); at = at.Add(-step) {
+			cycles = append(cycles, at)
+		}
+	}
+	if len(cycles) > placementMaxCycles {
+		sampled := make([]time.Time, placementMaxCycles)
+		for i := range sampled {
+			sampled[i] = cycles[i*len(cycles)/placementMaxCycles]
+		}
+		cycles = sampled
+	}
+
+	rootVar := -1
+	for vi, v := range sensorVariables {
+		if v.Name == VarMoistureRoot {
+			rootVar = vi
+		}
+	}
+	radius := ep.config.SearchRadius
+	liveRBF := ep.cycleRBF
+	defer func() { ep.cycleRBF = liveRBF }()
+
+	byID := make(map[string]*placementProbe)
+	validated := 0
+	for _, at := range cycles {
+		sensors, err := ep.fetchSensorsBetween(at.Add(-backfillSensorWindow), at)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to fetch readings: %v", err)
+		}
+		sensors = ep.excludeMisinstalledSensors(sensors)
+		ep.normalizeReadings(sensors)
+		for _, s := range sensors {
+			p := byID[s.SensorID]
+			if p == nil {
+				p = &placementProbe{id: s.SensorID}
+				byID[s.SensorID] = p
+			}
+			if !s.Timestamp.Before(p.seen) {
+				p.at, p.seen = orb.Point{s.Longitude, s.Latitude}, s.Timestamp
+			}
+		}
+		if len(sensors) <= ep.config.MinSensors {
+			continue
+		}
+
+		nearest := make([]float64, len(sensors))
+		for i, s := range sensors {
+			nearest[i] = math.Inf(1)
+			for j, o := range sensors {
+				if i != j {
+					nearest[i] = math.Min(nearest[i], planarNorm(localMeters(orb.Point{s.Longitude, s.Latitude}, orb.Point{o.Longitude, o.Latitude})))
+				}
+			}
+		}
+		ep.cycleRBF = ep.fitRBFModels(sensors)
+		validated++
+		ep.leaveOneOut(sensors, func(held, vi int, e float64) {
+			if vi != rootVar {
+				return
+			}
+			p := byID[sensors[held].SensorID]
+			p.sq += e * e
+			p.sill += e * e / math.Max(1-math.Exp(-3*nearest[held]/radius), placementMinGamma)
+			p.n++
+		})
+	}
+
+	probes := make([]*placementProbe, 0, len(byID))
+	for _, p := range byID {
+		probes = append(probes, p)
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].id < probes[j].id })
+	return probes, validated, nil
+}
+
+// placementSills returns the sill at a point, the probes' pooled LOOCV
+// RMSE and how many errors it came from. With no errors every point has
+// sill 1.
+func placementSills(probes []*placementProbe, radius float64) (func(orb.Point) float64, float64, int) {
+	var sq float64
+	n := 0
+	known := make([]*placementProbe, 0, len(probes))
+	for _, p := range probes {
+		if p.n > 0 {
+			sq += p.sq
+			n += p.n
+			known = append(known, p)
+		}
+	}
+	if n == 0 {
+		return func(orb.Point) float64 { return 1 }, 0, 0
+	}
+	return func(at orb.Point) float64 {
+		var sum, weights float64
+		for _, p := range known {
+			d := planarNorm(localMeters(at, p.at))
+			if d < 1 {
+				return p.sill / float64(p.n)
+			}
+			w := 1 / (d * d)
+			sum += w * p.sill / float64(p.n)
+			weights += w
+		}
+		return sum / weights
+	}, math.Sqrt(sq / float64(n)), n
+}
+
+// placementBoundary returns the field outline to place probes in and
+// where it came from.
+func (ep *EdgeProcessor) placementBoundary(given [][2]float64) ([][2]float64, string) {
+	if len(given) >= 3 {
+		return given, "file"
+	}
+	if ep.config.FieldBoundary != nil {
+		return ep.gridExtentRing(), "config" // the grid cells are already clipped to it
+	}
+	if db := ep.cloud.DB(); db != nil {
+		var text string
+		err := db.QueryRow(`SELECT ST_AsGeoJSON(boundary) FROM fields WHERE field_id = $1`, ep.config.FieldID).Scan(&text)
+		if err == nil {
+			var ring [][2]float64
+			if ring, err = parseBoundaryGeoJSON([]byte(text)); err == nil {
+				return ring, "cloud"
+			}
+		}
+		ep.logger.Warn("No field boundary in the cloud, using the grid extent", "component", "placement", "error", err)
+	}
+	return ep.gridExtentRing(), "grid_extent"
+}
+
+// gridExtentRing is the grid's extent as a ring, half a cell out so the
+// edge cells are inside it.
+func (ep *EdgeProcessor) gridExtentRing() [][2]float64 {
+	g := ep.gridLayout()
+	minLon, minLat := g.minLon-g.lonStep/2, g.minLat-g.latStep/2
+	maxLon, maxLat := g.maxLon+g.lonStep/2, g.maxLat+g.latStep/2
+	return [][2]float64{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}}
+}
+
+// parseBoundaryGeoJSON reads the exterior ring of a Polygon, or of the
+// first Polygon in a Feature or FeatureCollection.
+func parseBoundaryGeoJSON(data []byte) ([][2]float64, error) {
+	var doc struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometry    json.RawMessage `json:"geometry"`
+		Features    []struct {
+			Geometry json.RawMessage `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	switch doc.Type {
+	case "Polygon":
+		var rings [][][2]float64
+		if err := json.Unmarshal(doc.Coordinates, &rings); err != nil || len(rings) == 0 || len(rings[0]) < 3 {
+			return nil, fmt.Errorf("polygon needs an exterior ring of at least 3 points")
+		}
+		return rings[0], nil
+	case "Feature":
+		return parseBoundaryGeoJSON(doc.Geometry)
+	case "FeatureCollection":
+		for _, f := range doc.Features {
+			if ring, err := parseBoundaryGeoJSON(f.Geometry); err == nil {
+				return ring, nil
+			}
+		}
+		return nil, fmt.Errorf("no polygon feature")
+	}
+	return nil, fmt.Errorf("unsupported GeoJSON type %q (Polygon, Feature or FeatureCollection)", doc.Type)
+}
+
+// closedRing returns ring with its first point repeated at the end.
+func closedRing(ring [][2]float64) [][2]float64 {
+	if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+		return append(append([][2]float64(nil), ring...), ring[0])
+	}
+	return ring
+}
+
+func percentOf(part, whole float64) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return math.Round(part/whole*1000) / 10
+}
@@ -0,0 +1,242 @@
+// Profiling - Go runtime profiles from devices in the field
+// Some devices take many times longer per cycle in the field than on the
+// bench, and the reason (a slow SD card, a huge registry, GC pressure)
+// only shows in a profile taken on the device itself. Two ways to get one:
+//
+// The local API serves net/http/pprof under /debug/pprof/ (index,
+// cmdline, profile, symbol, trace and the named profiles such as heap and
+// goroutine) to device admins, so `go tool pprof` can point straight at a
+// gateway on the farm network. It is only served when the API requires
+// credentials: with an open API every caller is admin. profile and trace
+// may run past the server's 10 s write timeout, up to maxProfileDuration.
+//
+// The profile fleet command captures on the device and sends the result
+// up the sync channel, for devices nobody can reach directly:
+//
+//	profile  {"kind": "cpu", "seconds": 30}
+//	         CPU profile over the next seconds (default 30, at most 300)
+//	         {"kind": "cpu", "cycle": true}
+//	         CPU profile of one compute cycle run for it
+//	         {"kind": "heap"}
+//	         also allocs and goroutine
+//
+// Captures are queued in the local profile_captures table and uploaded to
+// device_profiles (migration 032) by the next sync, then dropped locally.
+// At most profileQueueMax wait while offline; the oldest go first.
+// Profiles cover the whole process, not just the field that ran the
+// command.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// Profile kinds
+const (
+	ProfileKindCPU       = "cpu"
+	ProfileKindHeap      = "heap"
+	ProfileKindAllocs    = "allocs"
+	ProfileKindGoroutine = "goroutine"
+)
+
+const (
+	defaultProfileSeconds = 30
+	maxProfileDuration    = 5 * time.Minute
+	profileQueueMax       = 10
+	profileWriteSlack     = 10 * time.Second
+)
+
+// registerPprof serves net/http/pprof to device admins.
+func (s *EdgeAPIServer) registerPprof(mux *http.ServeMux) {
+	if s.auth == nil {
+		return
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return requireRole(RoleAdmin, deviceScoped(h))
+	}
+	mux.HandleFunc("/debug/pprof/", admin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", admin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", admin(extendWriteDeadline(pprof.Profile, defaultProfileSeconds)))
+	mux.HandleFunc("/debug/pprof/symbol", admin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", admin(extendWriteDeadline(pprof.Trace, 1)))
+}
+
+// extendWriteDeadline lets a handler that samples for ?seconds= (def when
+// absent) write its response once the sampling is over.
+func extendWriteDeadline(h http.HandlerFunc, def int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seconds := def
+		if v, err := strconv.Atoi(r.URL.Query().Get("seconds")); err == nil && v > 0 {
+			seconds = v
+		}
+		d := time.Duration(seconds) * time.Second
+		if d > maxProfileDuration {
+			http.Error(w, fmt.Sprintf("seconds must be at most %d", int(maxProfileDuration.Seconds())), http.StatusBadRequest)
+			return
+		}
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + profileWriteSlack))
+		h(w, r)
+	}
+}
+
+func initProfileSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS profile_captures (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			field_id    TEXT    NOT NULL,
+			kind        TEXT    NOT NULL,
+			command_id  INTEGER,
+			captured_at INTEGER NOT NULL,
+			duration_ms INTEGER NOT NULL,
+			data        BLOB    NOT NULL
+		);
+	`)
+	return err
+}
+
+// captureProfile answers a profile command. A timed CPU profile samples
+// in the background so the main loop keeps running; everything else is
+// captured before returning.
+func (ep *EdgeProcessor) captureProfile(cmd FleetCommand) error {
+	var p struct {
+		Kind    string `json:"kind"`
+		Seconds int    `json:"seconds"`
+		Cycle   bool   `json:"cycle"`
+	}
+	if err := decodeCommandParams(cmd, &p); err != nil {
+		return err
+	}
+	switch p.Kind {
+	case ProfileKindCPU:
+	case ProfileKindHeap, ProfileKindAllocs, ProfileKindGoroutine:
+		if p.Seconds != 0 || p.Cycle {
+			return fmt.Errorf("seconds and cycle only apply to cpu profiles")
+		}
+	default:
+		return fmt.Errorf("unknown profile kind %q", p.Kind)
+	}
+	if p.Seconds == 0 {
+		p.Seconds = defaultProfileSeconds
+	}
+	d := time.Duration(p.Seconds) * time.Second
+	if d < 0 || d > maxProfileDuration {
+		return fmt.Errorf("seconds must be between 1 and %d", int(maxProfileDuration.Seconds()))
+	}
+
+	if p.Kind != ProfileKindCPU {
+		if p.Kind == ProfileKindHeap {
+			runtime.GC() // heap profiles describe the last GC
+		}
+		var buf bytes.Buffer
+		if err := rpprof.Lookup(p.Kind).WriteTo(&buf, 0); err != nil {
+			return fmt.Errorf("failed to write %s profile: %v", p.Kind, err)
+		}
+		return ep.queueProfile(cmd, p.Kind, time.Now(), 0, buf.Bytes())
+	}
+
+	var buf bytes.Buffer
+	if err := rpprof.StartCPUProfile(&buf); err != nil {
+		return fmt.Errorf("failed to start cpu profile: %v", err) // another is running, e.g. from /debug/pprof
+	}
+	started := time.Now()
+	if p.Cycle {
+		ep.computeVirtualGrid()
+		rpprof.StopCPUProfile()
+		return ep.queueProfile(cmd, p.Kind, started, time.Since(started), buf.Bytes())
+	}
+	go func() {
+		time.Sleep(d)
+		rpprof.StopCPUProfile()
+		if err := ep.queueProfile(cmd, p.Kind, started, time.Since(started), buf.Bytes()); err != nil {
+			ep.logger.Error("Failed to queue cpu profile", "component", "profiling", "command_id", cmd.ID, "error", err)
+		}
+	}()
+	return nil
+}
+
+// queueProfile stores a capture for the next sync, dropping the oldest
+// beyond profileQueueMax.
+func (ep *EdgeProcessor) queueProfile(cmd FleetCommand, kind string, at time.Time, took time.Duration, data []byte) error {
+	var commandID interface{}
+	if cmd.ID > 0 {
+		commandID = cmd.ID
+	}
+	if _, err := ep.localDB.Exec(`
+		INSERT INTO profile_captures (field_id, kind, command_id, captured_at, duration_ms, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ep.config.FieldID, kind, commandID, at.Unix(), took.Milliseconds(), data); err != nil {
+		return fmt.Errorf("failed to store %s profile: %v", kind, err)
+	}
+	if _, err := ep.localDB.Exec(`
+		DELETE FROM profile_captures WHERE field_id = ? AND id NOT IN (
+			SELECT id FROM profile_captures WHERE field_id = ? ORDER BY id DESC LIMIT ?
+		)
+	`, ep.config.FieldID, ep.config.FieldID, profileQueueMax); err != nil {
+		ep.logger.Warn("Failed to trim queued profiles", "component", "profiling", "error", err)
+	}
+	ep.logger.Info("Captured profile", "component", "profiling", "command_id", cmd.ID, "kind", kind,
+		"duration", took, "bytes", len(data))
+	return nil
+}
+
+// syncProfiles uploads queued profiles to device_profiles.
+func (ep *EdgeProcessor) syncProfiles() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT id, kind, command_id, captured_at, duration_ms, data
+		FROM profile_captures WHERE field_id = ? ORDER BY id
+	`, ep.config.FieldID)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read queued profiles", "component", "profiling", "error", err)
+		return
+	}
+	type pendingProfile struct {
+		id, capturedAt, durationMs int64
+		kind                       string
+		commandID                  sql.NullInt64
+		data                       []byte
+	}
+	profiles := make([]pendingProfile, 0)
+	for rows.Next() {
+		var p pendingProfile
+		if err := rows.Scan(&p.id, &p.kind, &p.commandID, &p.capturedAt, &p.durationMs, &p.data); err != nil {
+			rows.Close()
+			ep.cycleLog.Error("Failed to read queued profiles", "component", "profiling", "error", err)
+			return
+		}
+		profiles = append(profiles, p)
+	}
+	rows.Close()
+
+	// One at a time: a profile can be megabytes over a slow uplink
+	for _, p := range profiles {
+		var commandID interface{}
+		if p.commandID.Valid {
+			commandID = p.commandID.Int64
+		}
+		if _, err := db.Exec(`
+			INSERT INTO device_profiles
+				(device_external_id, command_id, kind, captured_at, duration_ms, app_version, profile)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, ep.deviceID, commandID, p.kind, time.Unix(p.capturedAt, 0).UTC(), p.durationMs, appVersion, p.data); err != nil {
+			ep.cycleLog.Warn("Profile upload failed, keeping it queued", "component", "profiling", "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+		if _, err := ep.localDB.Exec(`DELETE FROM profile_captures WHERE id = ?`, p.id); err != nil {
+			ep.cycleLog.Warn("Failed to drop uploaded profile", "component", "profiling", "error", err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Quality Flags - per-cell interpolation caveats
+// Confidence folds sensor count and spread into one number; consumers
+// filtering a map need to know why a cell is doubtful. Each cell carries
+// quality_flags, a bitfield completed after the confidence gate:
+//
+//	1  extrapolated     outside the cycle's probe coverage, set by the
+//	                    extrapolation guard (geographic grids,
+//	                    extrapolation_guard.go)
+//	2  dominant_sensor  one probe carries over 80% of the cell's weight,
+//	                    unless it sits on the cell (weighted-mean
+//	                    interpolators, attribution.go)
+//	4  stale_inputs     a source reading is older than twice
+//	                    sensor_report_interval_sec at the cycle time
+//	8  low_confidence   Confidence below min_need_confidence
+//	16 neighbor_inputs  low-weight virtual sensors from a neighbor field's
+//	                    grid shaded the estimate (neighbor_fields.go)
+//
+// A cell without caveats has 0. The flags go wherever the cell goes: the
+// API and MQTT cell JSON, the GeoJSON (with the names as quality), the
+// local grid history and its CSV export, and the cloud grid's
+// quality_flags column (migration 026). /grid/latest.geojson takes
+// ?exclude_flags=extrapolated,stale_inputs to drop cells with any of them.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QualityFlags is a cell's set of interpolation caveats.
+type QualityFlags uint32
+
+// Quality flags
+const (
+	QualityExtrapolated QualityFlags = 1 << iota
+	QualityDominantSensor
+	QualityStaleInputs
+	QualityLowConfidence
+	QualityNeighborInputs
+)
+
+const dominantSensorShare = 0.8
+
+// qualityFlagNames are the flags' names, in bit order.
+var qualityFlagNames = []struct {
+	flag QualityFlags
+	name string
+}{
+	{QualityExtrapolated, "extrapolated"},
+	{QualityDominantSensor, "dominant_sensor"},
+	{QualityStaleInputs, "stale_inputs"},
+	{QualityLowConfidence, "low_confidence"},
+	{QualityNeighborInputs, "neighbor_inputs"},
+}
+
+// Names lists the set flags, in bit order.
+func (f QualityFlags) Names() []string {
+	names := make([]string, 0)
+	for _, q := range qualityFlagNames {
+		if f&q.flag != 0 {
+			names = append(names, q.name)
+		}
+	}
+	return names
+}
+
+// parseQualityFlags reads a comma-separated list of flag names.
+func parseQualityFlags(list string) (QualityFlags, error) {
+	var flags QualityFlags
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, q := range qualityFlagNames {
+			if q.name == name {
+				flags |= q.flag
+				known = true
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("unknown quality flag %q", name)
+		}
+	}
+	return flags, nil
+}
+
+// withoutQualityFlags returns the cells with none of flags set.
+func withoutQualityFlags(points []VirtualGridPoint, flags QualityFlags) []VirtualGridPoint {
+	if flags == 0 {
+		return points
+	}
+	kept := make([]VirtualGridPoint, 0, len(points))
+	for _, p := range points {
+		if p.QualityFlags&flags == 0 {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// applyQualityFlags sets every cell's quality flags from the cycle's
+// readings at its time, keeping the extrapolation guard's flag.
+func (ep *EdgeProcessor) applyQualityFlags(points []VirtualGridPoint, sensors []SensorReading, at time.Time) {
+	interval := time.Duration(ep.config.SensorReportIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = defaultSensorReportInterval
+	}
+	staleBefore := at.Add(-2 * interval)
+	readAt := make(map[string]time.Time, len(sensors))
+	for _, s := range sensors {
+		if t, ok := readAt[s.SensorID]; !ok || s.Timestamp.After(t) {
+			readAt[s.SensorID] = s.Timestamp
+		}
+	}
+	minConf := ep.config.minNeedConfidence()
+
+	for i := range points {
+		p := &points[i]
+		flags := p.QualityFlags & (QualityExtrapolated | QualityNeighborInputs)
+		if len(p.attribution) > 0 && !onProbe(*p) && p.attribution[0].Weight > dominantSensorShare {
+			flags |= QualityDominantSensor
+		}
+		for _, id := range p.SourceSensors {
+			if t, ok := readAt[id]; ok && t.Before(staleBefore) {
+				flags |= QualityStaleInputs
+				break
+			}
+		}
+		if p.Confidence < minConf {
+			flags |= QualityLowConfidence
+		}
+		p.QualityFlags = flags
+	}
+}
@@ -0,0 +1,350 @@
+// Rain Detection - rain events and irrigation-need suppression
+// Rain is detected each cycle from tipping-bucket gauges (rain_gauge_readings,
+// tips × mm_per_tip since the previous cycle) or, without a gauge or when
+// it misses a shower, from surface moisture jumping at most sensors at once;
+// irrigation wets one zone at a time, rain wets the whole field.
+//
+// While it rains and for rain_drain_hours after the last rain, cycles are
+// tagged rain_state "raining" or "draining" and no cell or zone may be
+// graded a more urgent irrigation need than it had before the event: the
+// profile is still redistributing, surface probes read saturated and
+// transient, and an escalation then would trigger a set the rain made
+// unnecessary. Gauge rainfall is recorded per management zone (the mean of
+// the gauges inside the zone, the field mean otherwise) on the zone stats
+// of each cycle and as event totals.
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	defaultMMPerTip          = 0.2
+	defaultRainDrainHours    = 24.0
+	defaultRainMinMM         = 1.0
+	defaultRainRiseVWC       = 0.03
+	defaultRainRiseSensorPct = 60.0
+	rainRiseMinSensors       = 3
+	rainRiseMaxGap           = 2 * time.Hour // older previous readings don't count as a rise
+)
+
+// Cycle rain states
+const (
+	RainStateRaining  = "raining"
+	RainStateDraining = "draining"
+)
+
+// Rain detection sources
+const (
+	RainSourceGauge        = "gauge"
+	RainSourceMoistureRise = "moisture_rise"
+)
+
+// RainGauge is a tipping-bucket gauge reporting into rain_gauge_readings.
+type RainGauge struct {
+	GaugeID   string  `json:"gauge_id"`
+	MMPerTip  float64 `json:"mm_per_tip"` // Bucket calibration (default 0.2)
+	Latitude  float64 `json:"latitude"`   // Location for per-zone totals (0/0 = field-wide)
+	Longitude float64 `json:"longitude"`
+}
+
+// RainEvent is one rain event, from the first wet cycle to the end of its
+// drain-down window.
+type RainEvent struct {
+	Sources       []string           `json:"sources"`
+	StartedAt     time.Time          `json:"started_at"`
+	LastRainAt    time.Time          `json:"last_rain_at"`
+	SuppressUntil time.Time          `json:"suppress_until"`
+	TotalMM       float64            `json:"total_mm"` // gauge mean; 0 when only detected from moisture
+	ZoneMM        map[string]float64 `json:"zone_mm,omitempty"`
+}
+
+// RainStatus is the field's current rain state for the API.
+type RainStatus struct {
+	State     string     `json:"state"` // raining | draining | "" (dry)
+	Event     *RainEvent `json:"event,omitempty"`
+	CheckedAt time.Time  `json:"checked_at"`
+}
+
+// rainTracker holds detection state between cycles (main loop only).
+type rainTracker struct {
+	event        *RainEvent
+	lastCheck    time.Time
+	prevSurface  map[string]sensorSample // sensor_id -> latest surface reading
+	preNeed      map[string]string       // grid_id -> need before the event
+	preZoneNeed  map[string]string       // zone_id -> need before the event
+	cycleZoneMM  map[string]float64      // this cycle's gauge rain per zone
+	cycleFieldMM float64
+	state        string
+}
+
+type sensorSample struct {
+	value float64
+	at    time.Time
+}
+
+func newRainTracker() *rainTracker {
+	return &rainTracker{prevSurface: make(map[string]sensorSample)}
+}
+
+func (c EdgeConfig) rainDrain() time.Duration {
+	h := c.RainDrainHours
+	if h <= 0 {
+		h = defaultRainDrainHours
+	}
+	return time.Duration(h * float64(time.Hour))
+}
+
+// fetchGaugeTips returns each gauge's tip count in (from, to].
+func (ep *EdgeProcessor) fetchGaugeTips(from, to time.Time) (map[string]float64, error) {
+	query := `
+		SELECT gauge_id, COALESCE(SUM(tip_count), 0)
+		FROM rain_gauge_readings
+		WHERE field_id = $1
+		  AND timestamp > $2
+		  AND timestamp <= $3
+		GROUP BY gauge_id
+	`
+
+	db := ep.cloud.DB()
+	if db == nil {
+		db = ep.localDB
+	}
+
+	rows, err := db.Query(query, ep.config.FieldID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tips := make(map[string]float64)
+	for rows.Next() {
+		var id string
+		var n float64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		tips[id] = n
+	}
+	return tips, rows.Err()
+}
+
+// gaugeRain converts tips to mm per configured gauge. Unknown gauges are
+// ignored; gauges that reported nothing count as 0.
+func gaugeRain(gauges []RainGauge, tips map[string]float64) map[string]float64 {
+	mm := make(map[string]float64, len(gauges))
+	for _, g := range gauges {
+		perTip := g.MMPerTip
+		if perTip <= 0 {
+			perTip = defaultMMPerTip
+		}
+		mm[g.GaugeID] = tips[g.GaugeID] * perTip
+	}
+	return mm
+}
+
+// zoneRain assigns rain to each zone: the mean of the gauges inside it,
+// or the field mean when none are.
+func zoneRain(zones []ManagementZone, gauges []RainGauge, mm map[string]float64, fieldMM float64) map[string]float64 {
+	out := make(map[string]float64, len(zones))
+	for _, z := range zones {
+		sum, n := 0.0, 0
+		for _, g := range gauges {
+			if (g.Latitude != 0 || g.Longitude != 0) && pointInRing(g.Longitude, g.Latitude, z.Boundary) {
+				sum += mm[g.GaugeID]
+				n++
+			}
+		}
+		if n > 0 {
+			out[z.ZoneID] = sum / float64(n)
+		} else {
+			out[z.ZoneID] = fieldMM
+		}
+	}
+	return out
+}
+
+// moistureRiseDetected reports whether most sensors' surface moisture rose
+// by rain_rise_vwc since their previous reading, and records the latest
+// readings for the next cycle. sensors is newest first.
+func (rt *rainTracker) moistureRiseDetected(c EdgeConfig, sensors []SensorReading) bool {
+	rise := c.RainRiseVWC
+	if rise <= 0 {
+		rise = defaultRainRiseVWC
+	}
+	pct := c.RainRiseSensorPct
+	if pct <= 0 {
+		pct = defaultRainRiseSensorPct
+	}
+
+	compared, rising := 0, 0
+	seen := make(map[string]bool, len(sensors))
+	for _, s := range sensors {
+		if seen[s.SensorID] || s.noSurface {
+			continue
+		}
+		seen[s.SensorID] = true
+		if prev, ok := rt.prevSurface[s.SensorID]; ok && s.Timestamp.After(prev.at) && s.Timestamp.Sub(prev.at) <= rainRiseMaxGap {
+			compared++
+			if s.MoistureSurface-prev.value >= rise {
+				rising++
+			}
+		}
+		rt.prevSurface[s.SensorID] = sensorSample{value: s.MoistureSurface, at: s.Timestamp}
+	}
+	return compared >= rainRiseMinSensors && 100*float64(rising)/float64(compared) >= pct
+}
+
+// updateRain runs detection for the cycle at now and advances the event.
+func (ep *EdgeProcessor) updateRain(sensors []SensorReading, now time.Time) {
+	rt := ep.rain
+	from := rt.lastCheck
+	if interval := time.Duration(ep.config.ComputeInterval) * time.Second; from.IsZero() || now.Sub(from) > 2*interval {
+		from = now.Add(-interval)
+	}
+	rt.lastCheck = now
+
+	var sources []string
+	rt.cycleFieldMM, rt.cycleZoneMM = 0, nil
+	if len(ep.config.RainGauges) > 0 {
+		tips, err := ep.fetchGaugeTips(from, now)
+		if err != nil {
+			ep.cycleLog.Warn("Rain gauge query failed", "component", "rain", "error", err)
+		} else {
+			mm := gaugeRain(ep.config.RainGauges, tips)
+			for _, v := range mm {
+				rt.cycleFieldMM += v
+			}
+			rt.cycleFieldMM /= float64(len(mm))
+			rt.cycleZoneMM = zoneRain(ep.config.ManagementZones, ep.config.RainGauges, mm, rt.cycleFieldMM)
+
+			minMM := ep.config.RainMinMM
+			if minMM <= 0 {
+				minMM = defaultRainMinMM
+			}
+			if rt.cycleFieldMM >= minMM {
+				sources = append(sources, RainSourceGauge)
+			}
+		}
+	}
+	if rt.moistureRiseDetected(ep.config, sensors) {
+		sources = append(sources, RainSourceMoistureRise)
+	}
+
+	if len(sources) > 0 {
+		if rt.event == nil || now.After(rt.event.SuppressUntil) {
+			ep.startRainEvent(now)
+		}
+		ev := rt.event
+		ev.LastRainAt = now
+		ev.SuppressUntil = now.Add(ep.config.rainDrain())
+		for _, s := range sources {
+			if !containsString(ev.Sources, s) {
+				ev.Sources = append(ev.Sources, s)
+			}
+		}
+	}
+	if ev := rt.event; ev != nil && !now.After(ev.SuppressUntil) {
+		ev.TotalMM += rt.cycleFieldMM
+		for zoneID, mm := range rt.cycleZoneMM {
+			ev.ZoneMM[zoneID] += mm
+		}
+	}
+
+	prevState := rt.state
+	switch {
+	case len(sources) > 0:
+		rt.state = RainStateRaining
+	case rt.event != nil && !now.After(rt.event.SuppressUntil):
+		rt.state = RainStateDraining
+	default:
+		rt.state = ""
+		rt.preNeed, rt.preZoneNeed = nil, nil
+	}
+	if rt.state != prevState {
+		ep.cycleLog.Info("Rain state changed", "component", "rain", "state", rt.state, "previous", prevState,
+			"sources", sources, "cycle_mm", rt.cycleFieldMM)
+	}
+
+	status := RainStatus{State: rt.state, CheckedAt: now}
+	if rt.event != nil {
+		ev := *rt.event
+		ev.Sources = append([]string(nil), ev.Sources...)
+		ev.ZoneMM = make(map[string]float64, len(rt.event.ZoneMM))
+		for k, v := range rt.event.ZoneMM {
+			ev.ZoneMM[k] = v
+		}
+		status.Event = &ev
+	}
+	ep.stateMu.Lock()
+	ep.rainStatus = &status
+	ep.stateMu.Unlock()
+}
+
+// startRainEvent opens an event and snapshots the needs graded before it,
+// from the previous cycle.
+func (ep *EdgeProcessor) startRainEvent(now time.Time) {
+	rt := ep.rain
+	rt.event = &RainEvent{StartedAt: now, ZoneMM: make(map[string]float64)}
+	rt.preNeed = make(map[string]string)
+	for _, p := range ep.LatestGrid() {
+		rt.preNeed[p.GridID] = p.IrrigationNeed
+	}
+	rt.preZoneNeed = make(map[string]string)
+	for _, z := range ep.ZoneStats() {
+		rt.preZoneNeed[z.ZoneID] = z.IrrigationNeed
+	}
+	ep.cycleLog.Info("Rain event started", "component", "rain", "drain_hours", ep.config.rainDrain().Hours())
+}
+
+// applyRainState tags the cycle and holds irrigation need at its pre-rain
+// level while the event lasts.
+func (ep *EdgeProcessor) applyRainState(points []VirtualGridPoint) {
+	rt := ep.rain
+	if rt.state == "" {
+		return
+	}
+	held := 0
+	for i := range points {
+		points[i].RainState = rt.state
+		if before, ok := rt.preNeed[points[i].GridID]; ok && irrigationNeedRank[points[i].IrrigationNeed] > irrigationNeedRank[before] {
+			points[i].IrrigationNeed = before
+			held++
+		}
+	}
+	if held > 0 {
+		ep.cycleLog.Info("Held irrigation need at pre-rain level", "component", "rain", "cells", held, "state", rt.state)
+	}
+}
+
+// applyZoneRain records this cycle's rain on zone stats and applies the
+// same escalation hold to zones.
+func (ep *EdgeProcessor) applyZoneRain(stats []ZoneStats) {
+	rt := ep.rain
+	for i := range stats {
+		stats[i].RainfallMM = rt.cycleZoneMM[stats[i].ZoneID]
+		if rt.state == "" {
+			continue
+		}
+		if before, ok := rt.preZoneNeed[stats[i].ZoneID]; ok && irrigationNeedRank[stats[i].IrrigationNeed] > irrigationNeedRank[before] {
+			stats[i].IrrigationNeed = before
+		}
+	}
+}
+
+// RainStatus returns the latest rain state, or nil before the first cycle.
+func (ep *EdgeProcessor) RainStatus() *RainStatus {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return ep.rainStatus
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
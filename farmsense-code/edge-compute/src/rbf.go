@@ -0,0 +1,273 @@
+// RBF Interpolation - radial basis functions for sparsely probed fields
+// With only a handful of probes IDW flattens into plateaus around each one:
+// every cell near a probe takes that probe's value and the gradient between
+// probes is squeezed into a narrow band. When a cycle has fewer than
+// rbf_max_sensors probes (default 6), each built-in or registered variable
+// without its own Interpolator is instead fitted once over the whole field
+// with a radial basis function plus an affine trend,
+//
+//	f(x) = Σ wᵢ·φ(‖x − xᵢ‖) + a₀ + a₁·east + a₂·north,   Σ wᵢ = Σ wᵢ·eastᵢ = Σ wᵢ·northᵢ = 0
+//
+// and every cell is evaluated from that surface. rbf_basis picks φ:
+//
+//	thin_plate    r²·ln r (default; smoothest bending, no shape parameter)
+//	multiquadric  √(r² + ε²)
+//	gaussian      exp(−(r/ε)²)
+//
+// with ε = rbf_shape_m, default the mean nearest-probe spacing. Distances
+// are the IDW ones (anisotropy included) and are taken in units of that
+// spacing, which keeps the system well conditioned. rbf_smoothing adds λ
+// to the kernel diagonal: 0 passes exactly through every probe, larger
+// values trade the probes' own values for a smoother surface. A variable
+// reported by fewer than three probes, or whose system is singular (probes
+// in a line), stays on IDW.
+//
+// Only the estimate changes: cells still need min_sensors probes within
+// search_radius_m, and confidence and attribution use the IDW weights.
+// Leave-one-out accuracy refits the surface without the held-out probe.
+// With sensor_classes each class is fitted over its own probes.
+// Adjacency (logical) grids have no coordinates and always use IDW.
+//
+// A shadow interpolation (shadow_interpolation.go) swaps the basis for the
+// duration of its pass: an rbf_* shadow fits at any probe count, and a
+// kriging shadow fits the same system with an exponential covariance
+// exp(−3r/range) as kernel and its nugget as λ.
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+// RBF basis functions
+const (
+	RBFThinPlate    = "thin_plate"
+	RBFMultiquadric = "multiquadric"
+	RBFGaussian     = "gaussian"
+	RBFOff          = "off"
+)
+
+const (
+	defaultRBFMaxSensors = 6
+	rbfMinSamples        = 3
+)
+
+// rbfSample is a probe position and value.
+type rbfSample struct {
+	at    orb.Point
+	value float64
+}
+
+// rbfModel is a fitted surface for one variable.
+type rbfModel struct {
+	basis   string
+	scale   float64 // length unit for distances (m)
+	shape   float64 // ε in scale units
+	origin  orb.Point
+	centers []orb.Point
+	weights []float64
+	affine  [3]float64
+	dist    func(a, b orb.Point) float64
+}
+
+// rbfBasis returns the configured basis, "" when RBF is off. During a
+// shadow pass it is the shadow's.
+func (ep *EdgeProcessor) rbfBasis() string {
+	if ep.shadowMode != "" {
+		return shadowBasis(ep.shadowMode)
+	}
+	switch b := ep.config.RBFBasis; b {
+	case "":
+		return RBFThinPlate
+	case RBFOff:
+		return ""
+	default:
+		return b
+	}
+}
+
+// useRBF reports whether a cycle with n probes is interpolated by RBF.
+func (ep *EdgeProcessor) useRBF(n int) bool {
+	if ep.config.LogicalGrid != nil || ep.rbfBasis() == "" {
+		return false
+	}
+	if ep.shadowMode != "" {
+		return true
+	}
+	maxSensors := ep.config.RBFMaxSensors
+	if maxSensors <= 0 {
+		maxSensors = defaultRBFMaxSensors
+	}
+	return n < maxSensors
+}
+
+// rbfDistance is the distance RBF kernels see, matching neighborsWithin.
+func (ep *EdgeProcessor) rbfDistance(a, b orb.Point) float64 {
+	return ep.effectiveDistance(a, b, geo.Distance(a, b))
+}
+
+// fitRBFModels fits every eligible variable over sensors, one surface per
+// sensor class (keyed by classVariableKey); nil when the cycle stays on IDW.
+func (ep *EdgeProcessor) fitRBFModels(sensors []SensorReading) map[string]*rbfModel {
+	if !ep.useRBF(len(sensors)) {
+		return nil
+	}
+	models := make(map[string]*rbfModel)
+	for class, group := range classGroups(sensors) {
+		for _, v := range sensorVariables {
+			if v.Interpolator != nil {
+				continue
+			}
+			samples := make([]rbfSample, 0, len(group))
+			for _, s := range group {
+				if value, ok := v.Read(s); ok {
+					samples = append(samples, rbfSample{at: orb.Point{s.Longitude, s.Latitude}, value: value})
+				}
+			}
+			m, err := ep.fitRBF(samples)
+			if err != nil {
+				ep.cycleLog.Debug("Variable stays on IDW", "component", "rbf", "variable", v.Name, "class", class, "reason", err)
+				continue
+			}
+			models[classVariableKey(class, v.Name)] = m
+		}
+	}
+	return models
+}
+
+// fitRBF solves the interpolation system for samples.
+func (ep *EdgeProcessor) fitRBF(samples []rbfSample) (*rbfModel, error) {
+	n := len(samples)
+	if n < rbfMinSamples {
+		return nil, fmt.Errorf("%d probes, need %d", n, rbfMinSamples)
+	}
+	m := &rbfModel{basis: ep.rbfBasis(), origin: samples[0].at, dist: ep.rbfDistance}
+
+	// Mean nearest-probe spacing sets the length unit
+	total := 0.0
+	for i, a := range samples {
+		nearest := math.Inf(1)
+		for j, b := range samples {
+			if i != j {
+				nearest = math.Min(nearest, m.dist(a.at, b.at))
+			}
+		}
+		total += nearest
+	}
+	m.scale = total / float64(n)
+	if m.scale < 1 {
+		return nil, fmt.Errorf("probes are co-located")
+	}
+	m.shape = 1
+	smoothing := ep.config.RBFSmoothing
+	switch {
+	case m.basis == ShadowKriging:
+		m.shape = ep.config.krigingRange() / m.scale
+		// Nugget over partial sill: kriging is blind to the overall scale
+		smoothing = ep.config.KrigingNugget / (1 - ep.config.KrigingNugget)
+	case ep.config.RBFShapeM > 0:
+		m.shape = ep.config.RBFShapeM / m.scale
+	}
+
+	// [Φ + λI  P] [w]   [v]
+	// [Pᵀ      0] [a] = [0]
+	size := n + 3
+	a := make([][]float64, size)
+	for i := range a {
+		a[i] = make([]float64, size+1)
+	}
+	m.centers = make([]orb.Point, n)
+	for i, si := range samples {
+		m.centers[i] = si.at
+		for j, sj := range samples {
+			a[i][j] = m.kernel(m.dist(si.at, sj.at) / m.scale)
+		}
+		a[i][i] += smoothing
+		row := m.affineRow(si.at)
+		for k, p := range row {
+			a[i][n+k] = p
+			a[n+k][i] = p
+		}
+		a[i][size] = si.value
+	}
+	x, ok := solveLinear(a)
+	if !ok {
+		return nil, fmt.Errorf("singular system (probes in a line?)")
+	}
+	m.weights = x[:n]
+	copy(m.affine[:], x[n:])
+	return m, nil
+}
+
+// kernel is φ at distance r (in scale units).
+func (m *rbfModel) kernel(r float64) float64 {
+	switch m.basis {
+	case RBFMultiquadric:
+		return math.Sqrt(r*r + m.shape*m.shape)
+	case RBFGaussian:
+		q := r / m.shape
+		return math.Exp(-q * q)
+	case ShadowKriging:
+		// Exponential covariance of unit partial sill; the nugget is on
+		// the diagonal
+		return math.Exp(-krigingPracticalRangeExp * r / m.shape)
+	default:
+		if r == 0 {
+			return 0
+		}
+		return r * r * math.Log(r)
+	}
+}
+
+// affineRow is the trend's basis (1, east, north) at p, in scale units.
+func (m *rbfModel) affineRow(p orb.Point) [3]float64 {
+	east, north := localOffsetMeters(m.origin, p)
+	return [3]float64{1, east / m.scale, north / m.scale}
+}
+
+// At evaluates the surface at p.
+func (m *rbfModel) At(p orb.Point) float64 {
+	row := m.affineRow(p)
+	v := m.affine[0]*row[0] + m.affine[1]*row[1] + m.affine[2]*row[2]
+	for i, c := range m.centers {
+		v += m.weights[i] * m.kernel(m.dist(p, c)/m.scale)
+	}
+	return v
+}
+
+// solveLinear solves the augmented system a (n rows, n+1 columns) by
+// Gaussian elimination with partial pivoting. a is overwritten.
+func solveLinear(a [][]float64) ([]float64, bool) {
+	n := len(a)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for r := col + 1; r < n; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c <= n; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		sum := a[r][n]
+		for c := r + 1; c < n; c++ {
+			sum -= a[r][c] * x[c]
+		}
+		x[r] = sum / a[r][r]
+	}
+	return x, true
+}
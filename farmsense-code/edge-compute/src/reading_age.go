@@ -0,0 +1,55 @@
+// Reading Age - fresher readings outweigh older ones in a cycle
+// A cycle interpolates every probe's latest reading from the last 15
+// minutes, and without this a reading taken a minute ago and one taken 14
+// minutes ago pull on a cell equally. While water is going on, the older
+// one describes soil that is no longer there.
+//
+// With reading_half_life_min set, each probe's inverse-distance weight is
+// multiplied by 0.5^(age / half-life), age being how long before the cycle
+// time the reading was taken. Probes that an irrigation pass is wetting
+// (irrigation_detection.go) use reading_half_life_irrigating_min instead
+// when it is set, so a short half-life can apply only while moisture is
+// moving fast. Like a neighbor field's virtual sensors, the factor is
+// applied by stretching the probe's distance, so it reaches every
+// distance-based interpolator, attribution and the cell's confidence. A
+// probe on the cell still sets it however old its reading, and RBF fits,
+// which use probe positions rather than distances, are unaffected.
+//
+// Both default to 0, which weights readings by distance alone.
+
+package main
+
+import "math"
+
+// ageHalfLife is the half-life in minutes that applies to a probe, 0 for
+// none.
+func (ep *EdgeProcessor) ageHalfLife(sensorID string) float64 {
+	if ep.config.ReadingHalfLifeIrrigatingMin > 0 && ep.underPass(sensorID) {
+		return ep.config.ReadingHalfLifeIrrigatingMin
+	}
+	return ep.config.ReadingHalfLifeMin
+}
+
+// weightByAge stretches probes' distances so their IDW weight decays with
+// the age of their reading.
+func (ep *EdgeProcessor) weightByAge(neighbors []sensorNeighbor) []sensorNeighbor {
+	if ep.config.ReadingHalfLifeMin <= 0 && ep.config.ReadingHalfLifeIrrigatingMin <= 0 {
+		return neighbors
+	}
+	cycleAt := ep.cycleTime()
+	out := make([]sensorNeighbor, len(neighbors))
+	for i, n := range neighbors {
+		out[i] = n
+		if n.distance == 0 || n.sensor.virtualWeight > 0 {
+			continue // on the cell, or aged by neighbor_max_age_min instead
+		}
+		halfLife := ep.ageHalfLife(n.sensor.SensorID)
+		age := cycleAt.Sub(n.sensor.Timestamp).Minutes()
+		if halfLife <= 0 || age <= 0 {
+			continue
+		}
+		weight := math.Pow(0.5, age/halfLife)
+		out[i].distance = math.Max(n.distance, 1) * math.Pow(weight, -1/ep.config.IDWPower)
+	}
+	return out
+}
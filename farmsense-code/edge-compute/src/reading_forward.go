@@ -0,0 +1,167 @@
+// Reading Forward - store-and-forward of raw sensor readings
+// Readings decoded on the gateway land in the local soil_sensor_readings
+// table first, online or not. Each sync forwards rows past a per-field
+// rowid watermark to the cloud in batches; the watermark only advances
+// after the cloud transaction commits, so an outage (or a crash between
+// commit and watermark update) replays rows instead of losing them. The
+// cloud insert skips rows it already has for (sensor_id, timestamp), so
+// replays never duplicate history.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	readingForwardBatch      = 500
+	readingForwardMaxBatches = 20 // per sync, so a long backlog can't stall the main loop
+)
+
+// initSyncStateSchema creates the local sync watermark table.
+func initSyncStateSchema(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS sync_state (name TEXT PRIMARY KEY, value INTEGER NOT NULL)`)
+	return err
+}
+
+func (ep *EdgeProcessor) readingWatermarkKey() string {
+	return "raw_readings:" + ep.config.FieldID
+}
+
+// readingWatermark returns the last forwarded local rowid.
+func (ep *EdgeProcessor) readingWatermark() (int64, error) {
+	var mark int64
+	err := ep.localDB.QueryRow(`SELECT value FROM sync_state WHERE name = ?`, ep.readingWatermarkKey()).Scan(&mark)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return mark, err
+}
+
+// localReading is a queued row with its local rowid.
+type localReading struct {
+	rowID    int64
+	profile  sql.NullString // stored vertical_profile, forwarded as is
+	channels sql.NullString // stored channels, likewise
+	extras   sql.NullString // stored extras, likewise
+	SensorReading
+}
+
+// queuedReadings returns up to limit local rows after the watermark.
+func (ep *EdgeProcessor) queuedReadings(after int64, limit int) ([]localReading, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT rowid, sensor_id, timestamp, latitude, longitude,
+		       moisture_surface, moisture_root, temp_surface, battery_voltage, quality_flag, vertical_profile, channels,
+		       extras
+		FROM soil_sensor_readings
+		WHERE rowid > ? AND field_id = ? AND origin = ?
+		ORDER BY rowid
+		LIMIT ?
+	`, after, ep.config.FieldID, ReadingOriginLocal, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]localReading, 0, limit)
+	for rows.Next() {
+		var r localReading
+		if err := rows.Scan(&r.rowID, &r.SensorID, &r.Timestamp, &r.Latitude, &r.Longitude,
+			&r.MoistureSurface, &r.MoistureRoot, &r.TempSurface, &r.BatteryVoltage, &r.QualityFlag, &r.profile,
+			&r.channels, &r.extras); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// uploadReadings inserts a batch into the cloud, skipping rows it has.
+func (ep *EdgeProcessor) uploadReadings(db *sql.DB, batch []localReading) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin reading upload: %v", err)
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO soil_sensor_readings
+			(id, sensor_id, field_id, timestamp, location, moisture_surface, moisture_root,
+			 temp_surface, battery_voltage, quality_flag, vertical_profile, channels, ec_root, extras)
+		SELECT gen_random_uuid(), $1, $2, $3, ST_SetSRID(ST_MakePoint($4, $5), 4326), $6, $7, $8, $9, $10, $11::json, $12::json,
+		       ($12::json->>'soil_ec')::double precision, $13::jsonb
+		WHERE NOT EXISTS (
+			SELECT 1 FROM soil_sensor_readings WHERE sensor_id = $1 AND timestamp = $3
+		)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to prepare reading upload: %v", err)
+	}
+	defer stmt.Close()
+
+	inserted := 0
+	for _, r := range batch {
+		res, err := stmt.Exec(r.SensorID, ep.config.FieldID, r.Timestamp, r.Longitude, r.Latitude,
+			r.MoistureSurface, r.MoistureRoot, r.TempSurface, r.BatteryVoltage, r.QualityFlag, r.profile,
+			r.channels, r.extras)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to upload reading %s@%s: %v", r.SensorID, r.Timestamp.Format(time.RFC3339), err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			inserted++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit reading upload: %v", err)
+	}
+	return inserted, nil
+}
+
+// forwardRawReadings uploads queued local readings while the cloud is up.
+func (ep *EdgeProcessor) forwardRawReadings() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	mark, err := ep.readingWatermark()
+	if err != nil {
+		ep.cycleLog.Error("Failed to read raw reading watermark", "component", "reading_forward", "error", err)
+		return
+	}
+
+	forwarded, duplicates := 0, 0
+	for i := 0; i < readingForwardMaxBatches; i++ {
+		batch, err := ep.queuedReadings(mark, readingForwardBatch)
+		if err != nil {
+			ep.cycleLog.Error("Failed to read queued raw readings", "component", "reading_forward", "error", err)
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+		inserted, err := ep.uploadReadings(db, batch)
+		if err != nil {
+			ep.cycleLog.Warn("Raw reading upload failed, keeping readings queued", "component", "reading_forward", "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+		mark = batch[len(batch)-1].rowID
+		if _, err := ep.localDB.Exec(`INSERT OR REPLACE INTO sync_state (name, value) VALUES (?, ?)`,
+			ep.readingWatermarkKey(), mark); err != nil {
+			// Rows are in the cloud; the next sync replays them and dedup drops them
+			ep.cycleLog.Error("Failed to advance raw reading watermark", "component", "reading_forward", "error", err)
+			return
+		}
+		forwarded += inserted
+		duplicates += len(batch) - inserted
+		if len(batch) < readingForwardBatch {
+			break
+		}
+	}
+	if forwarded+duplicates > 0 {
+		ep.cycleLog.Info("Forwarded raw readings to cloud", "component", "reading_forward",
+			"readings", forwarded, "already_present", duplicates)
+	}
+}
@@ -0,0 +1,689 @@
+// Reading Import - historical sensor data from legacy logger exports
+// A field moving onto FarmSense usually has years of readings in its old
+// logger's CSV or Excel (.xlsx) exports. The import command loads them
+// into the local soil_sensor_readings table as the device's own readings,
+// so the normal store-and-forward sends them to the cloud (which skips
+// rows it already has for sensor and time), and can then backfill grids
+// over the imported span so the trend layers and drydown fits have
+// history from the first live cycle.
+//
+// Columns are found by header: each reading field (sensor_id, timestamp,
+// latitude, longitude, moisture_surface, moisture_root, temp_surface,
+// battery_voltage, a registered channel such as soil_ec, or an
+// extra_channels name kept in the reading's extras) matches a
+// header of the same name, a common alias, or the header given for it in
+// -columns "moisture_root=VWC 30cm,timestamp=Date Time". Unit options:
+//
+//	moisture  fraction | percent | auto (percent when any value is above 1)
+//	temp      c | f | k
+//	battery   v | mv | auto (millivolts when any value is above 20)
+//
+// Timestamps parse with a Go layout, rfc3339, unix, unix_ms, excel
+// (serial days) or auto, which tries the common layouts and treats bare
+// numbers by magnitude; times without a zone are read in -timezone.
+// Probes without coordinate columns take them from lorawan_devices or
+// -lat/-lon. Rows that don't parse are skipped and counted; implausible
+// moisture is imported flagged out_of_range like a live uplink.
+//
+// The storage guardian prunes forwarded readings past
+// reading_retention_days and grid history past trend_retention_days, so
+// raise those first when importing older history for local use.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import unit and format options
+const (
+	ImportFormatCSV      = "csv"
+	ImportFormatXLSX     = "xlsx"
+	MoistureUnitFraction = "fraction"
+	MoistureUnitPercent  = "percent"
+	TempUnitC            = "c"
+	TempUnitF            = "f"
+	TempUnitK            = "k"
+	BatteryUnitV         = "v"
+	BatteryUnitMV        = "mv"
+	importUnitAuto       = "auto"
+	maxImportErrors      = 20 // row errors kept in the result
+)
+
+// importAliases are header names legacy loggers commonly use per field.
+var importAliases = map[string][]string{
+	"sensor_id":        {"sensor", "logger", "logger_id", "probe", "probe_id", "device", "device_id", "station"},
+	"timestamp":        {"time", "datetime", "date_time", "date", "recorded_at", "time_stamp"},
+	"latitude":         {"lat"},
+	"longitude":        {"lon", "lng", "long"},
+	"moisture_surface": {"vwc_surface", "surface_vwc", "moisture_shallow", "vwc_shallow"},
+	"moisture_root":    {"vwc_root", "root_vwc", "moisture_deep", "vwc_deep", "vwc"},
+	"temp_surface":     {"temperature", "soil_temp", "temp", "soil_temperature"},
+	"battery_voltage":  {"battery", "batt", "battery_v", "vbat"},
+}
+
+// ImportOptions describe one legacy export file.
+type ImportOptions struct {
+	Path         string
+	Format       string            // csv | xlsx; default from the extension
+	Delimiter    rune              // CSV only (default ',')
+	Columns      map[string]string // reading field -> header
+	SensorID     string            // for single-logger files without a sensor column
+	TimeFormat   string            // Go layout, rfc3339, unix, unix_ms, excel or auto
+	Location     *time.Location    // zone for times without one (default UTC)
+	MoistureUnit string
+	TempUnit     string
+	BatteryUnit  string
+	Latitude     float64 // position for probes without one
+	Longitude    float64
+	DryRun       bool
+}
+
+// ImportResult summarizes an import.
+type ImportResult struct {
+	Path       string     `json:"path"`
+	Rows       int        `json:"rows"`
+	Imported   int        `json:"imported"`
+	Duplicates int        `json:"duplicates"` // already in the local cache
+	Skipped    int        `json:"skipped"`
+	OutOfRange int        `json:"out_of_range"`
+	Sensors    int        `json:"sensors"`
+	From       *time.Time `json:"from,omitempty"`
+	To         *time.Time `json:"to,omitempty"`
+	Columns    []string   `json:"columns"` // reading fields found
+	Errors     []string   `json:"errors,omitempty"`
+	DryRun     bool       `json:"dry_run,omitempty"`
+}
+
+// importRow is a parsed row before unit conversion.
+type importRow struct {
+	line    int
+	reading SensorReading
+	hasPos  bool
+}
+
+// ImportReadings loads a legacy export into the local cache.
+func (ep *EdgeProcessor) ImportReadings(opts ImportOptions) (ImportResult, error) {
+	res := ImportResult{Path: opts.Path, DryRun: opts.DryRun}
+	table, err := readImportTable(opts)
+	if err != nil {
+		return res, err
+	}
+	if len(table) < 2 {
+		return res, fmt.Errorf("%s has no data rows", opts.Path)
+	}
+	cols, err := importColumns(table[0], opts.Columns, ep.config.ExtraChannels)
+	if err != nil {
+		return res, err
+	}
+	for field := range cols {
+		res.Columns = append(res.Columns, field)
+	}
+	sort.Strings(res.Columns)
+	if _, ok := cols["sensor_id"]; !ok && opts.SensorID == "" {
+		return res, fmt.Errorf("no sensor_id column; give -sensor-id for a single-logger file")
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+
+	rows := make([]importRow, 0, len(table)-1)
+	rowError := func(line int, format string, args ...interface{}) {
+		res.Skipped++
+		if len(res.Errors) < maxImportErrors {
+			res.Errors = append(res.Errors, fmt.Sprintf("row %d: ", line)+fmt.Sprintf(format, args...))
+		}
+	}
+	for i, record := range table[1:] {
+		line := i + 2
+		if blankRecord(record) {
+			continue
+		}
+		res.Rows++
+		row, err := ep.parseImportRecord(record, cols, opts)
+		if err != nil {
+			rowError(line, "%v", err)
+			continue
+		}
+		row.line = line
+		rows = append(rows, row)
+	}
+
+	convertImportUnits(rows, opts)
+	positions := make(map[string]LoRaWANDevice, len(ep.config.LoRaWANDevices))
+	for _, d := range ep.config.LoRaWANDevices {
+		id := d.SensorID
+		if id == "" {
+			id = strings.ToLower(d.DevEUI)
+		}
+		positions[id] = d
+	}
+
+	kept := rows[:0]
+	for _, row := range rows {
+		r := &row.reading
+		if !row.hasPos {
+			if d, ok := positions[r.SensorID]; ok {
+				r.Latitude, r.Longitude = d.Latitude, d.Longitude
+			} else if opts.Latitude != 0 || opts.Longitude != 0 {
+				r.Latitude, r.Longitude = opts.Latitude, opts.Longitude
+			} else {
+				rowError(row.line, "no position for sensor %s (add it to lorawan_devices or give -lat/-lon)", r.SensorID)
+				continue
+			}
+		}
+		r.QualityFlag = "valid"
+		if r.MoistureSurface < 0 || r.MoistureSurface > maxPlausibleVWC || r.MoistureRoot < 0 || r.MoistureRoot > maxPlausibleVWC {
+			r.QualityFlag = "out_of_range"
+			res.OutOfRange++
+		}
+		kept = append(kept, row)
+	}
+
+	sensors := make(map[string]bool)
+	for _, row := range kept {
+		at := row.reading.Timestamp
+		sensors[row.reading.SensorID] = true
+		if res.From == nil || at.Before(*res.From) {
+			t := at
+			res.From = &t
+		}
+		if res.To == nil || at.After(*res.To) {
+			t := at
+			res.To = &t
+		}
+	}
+	res.Sensors = len(sensors)
+	if opts.DryRun || len(kept) == 0 {
+		return res, nil
+	}
+
+	inserted, err := ep.insertImportedReadings(kept)
+	if err != nil {
+		return res, err
+	}
+	res.Imported = inserted
+	res.Duplicates = len(kept) - inserted
+	return res, nil
+}
+
+// parseImportRecord reads one row's fields.
+func (ep *EdgeProcessor) parseImportRecord(record []string, cols map[string]int, opts ImportOptions) (importRow, error) {
+	var row importRow
+	value := func(field string) (string, bool) {
+		i, ok := cols[field]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		v := strings.TrimSpace(record[i])
+		return v, v != ""
+	}
+	number := func(field string) (float64, bool, error) {
+		s, ok := value(field)
+		if !ok {
+			return 0, false, nil
+		}
+		v, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", "."), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, false, fmt.Errorf("%s: %q is not a number", field, s)
+		}
+		return v, true, nil
+	}
+
+	r := &row.reading
+	r.SensorID = opts.SensorID
+	if s, ok := value("sensor_id"); ok {
+		r.SensorID = s
+	}
+	if r.SensorID == "" {
+		return row, fmt.Errorf("empty sensor_id")
+	}
+	s, ok := value("timestamp")
+	if !ok {
+		return row, fmt.Errorf("empty timestamp")
+	}
+	at, err := parseImportTime(s, opts.TimeFormat, opts.Location)
+	if err != nil {
+		return row, err
+	}
+	r.Timestamp = readingTimestamp(at)
+
+	targets := map[string]*float64{
+		"moisture_surface": &r.MoistureSurface,
+		"moisture_root":    &r.MoistureRoot,
+		"temp_surface":     &r.TempSurface,
+		"battery_voltage":  &r.BatteryVoltage,
+		"latitude":         &r.Latitude,
+		"longitude":        &r.Longitude,
+	}
+	found := make(map[string]bool)
+	for field := range cols {
+		if field == "sensor_id" || field == "timestamp" {
+			continue
+		}
+		v, ok, err := number(field)
+		if err != nil {
+			return row, err
+		}
+		if !ok {
+			continue
+		}
+		found[field] = true
+		switch target, builtin := targets[field]; {
+		case builtin:
+			*target = v
+		case isRegisteredChannel(field):
+			if r.Channels == nil {
+				r.Channels = make(map[string]float64)
+			}
+			r.Channels[field] = v
+		default:
+			if r.Extras == nil {
+				r.Extras = make(map[string]float64)
+			}
+			r.Extras[field] = v
+		}
+	}
+	if !found["moisture_surface"] && !found["moisture_root"] {
+		return row, fmt.Errorf("no moisture value")
+	}
+	// A single-depth logger reports one layer; carry it to both like a live probe
+	if !found["moisture_surface"] {
+		r.MoistureSurface = r.MoistureRoot
+	} else if !found["moisture_root"] {
+		r.MoistureRoot = r.MoistureSurface
+	}
+	row.hasPos = found["latitude"] && found["longitude"]
+	return row, nil
+}
+
+// convertImportUnits converts the parsed rows to fractions, °C and volts.
+func convertImportUnits(rows []importRow, opts ImportOptions) {
+	moisture, battery := opts.MoistureUnit, opts.BatteryUnit
+	if moisture == "" || moisture == importUnitAuto {
+		moisture = MoistureUnitFraction
+		for _, row := range rows {
+			if row.reading.MoistureSurface > 1 || row.reading.MoistureRoot > 1 {
+				moisture = MoistureUnitPercent
+				break
+			}
+		}
+	}
+	if battery == "" || battery == importUnitAuto {
+		battery = BatteryUnitV
+		for _, row := range rows {
+			if row.reading.BatteryVoltage > 20 {
+				battery = BatteryUnitMV
+				break
+			}
+		}
+	}
+	for i := range rows {
+		r := &rows[i].reading
+		if moisture == MoistureUnitPercent {
+			r.MoistureSurface /= 100
+			r.MoistureRoot /= 100
+		}
+		switch opts.TempUnit {
+		case TempUnitF:
+			r.TempSurface = (r.TempSurface - 32) * 5 / 9
+		case TempUnitK:
+			r.TempSurface -= 273.15
+		}
+		if battery == BatteryUnitMV {
+			r.BatteryVoltage /= 1000
+		}
+	}
+}
+
+// insertImportedReadings writes rows to the local cache in one
+// transaction and returns how many were new.
+func (ep *EdgeProcessor) insertImportedReadings(rows []importRow) (int, error) {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin import: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO soil_sensor_readings
+			(sensor_id, field_id, timestamp, latitude, longitude, moisture_surface, moisture_root,
+			 temp_surface, battery_voltage, quality_flag, channels, extras)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare import: %v", err)
+	}
+	defer stmt.Close()
+
+	inserted := 0
+	for _, row := range rows {
+		r := row.reading
+		channels, err := encodeChannels(r.Channels)
+		if err != nil {
+			return 0, err
+		}
+		extras, err := encodeChannels(r.Extras)
+		if err != nil {
+			return 0, err
+		}
+		res, err := stmt.Exec(r.SensorID, ep.config.FieldID, r.Timestamp, r.Latitude, r.Longitude,
+			r.MoistureSurface, r.MoistureRoot, r.TempSurface, r.BatteryVoltage, r.QualityFlag, channels, extras)
+		if err != nil {
+			return 0, fmt.Errorf("failed to import row %d: %v", row.line, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			inserted++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit import: %v", err)
+	}
+	return inserted, nil
+}
+
+// importColumns maps reading fields to header indexes.
+func importColumns(header []string, explicit map[string]string, extras []ExtraChannelRule) (map[string]int, error) {
+	index := make(map[string]int, len(header))
+	for i, h := range header {
+		index[normalizeHeader(h)] = i
+	}
+	fields := []string{"sensor_id", "timestamp", "latitude", "longitude", "moisture_surface", "moisture_root",
+		"temp_surface", "battery_voltage"}
+	for _, v := range sensorVariables {
+		if v.Name != VarTemperature && !containsString(fields, v.Name) {
+			fields = append(fields, v.Name)
+		}
+	}
+	for _, r := range extras {
+		if !containsString(fields, r.Name) {
+			fields = append(fields, r.Name)
+		}
+	}
+
+	cols := make(map[string]int)
+	for field, h := range explicit {
+		if !containsString(fields, field) {
+			return nil, fmt.Errorf("-columns: unknown field %q (want one of %s)", field, strings.Join(fields, ", "))
+		}
+		i, ok := index[normalizeHeader(h)]
+		if !ok {
+			return nil, fmt.Errorf("-columns: no %q column in the header", h)
+		}
+		cols[field] = i
+	}
+	for _, field := range fields {
+		if _, ok := cols[field]; ok {
+			continue
+		}
+		for _, name := range append([]string{field}, importAliases[field]...) {
+			if i, ok := index[name]; ok {
+				cols[field] = i
+				break
+			}
+		}
+	}
+	if _, ok := cols["timestamp"]; !ok {
+		return nil, fmt.Errorf("no timestamp column (header: %s)", strings.Join(header, ", "))
+	}
+	return cols, nil
+}
+
+// normalizeHeader lower-cases a header and joins its words with _.
+func normalizeHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+	return strings.Join(strings.FieldsFunc(h, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_' || r == '.' || r == '(' || r == ')' || r == '/'
+	}), "_")
+}
+
+func blankRecord(record []string) bool {
+	for _, v := range record {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// importTimeLayouts are tried in order by the auto time format.
+var importTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"01/02/2006 15:04:05",
+	"01/02/2006 15:04",
+	"1/2/2006 15:04",
+	"01/02/2006 3:04:05 PM",
+	"1/2/2006 3:04 PM",
+	"2006-01-02",
+}
+
+// parseImportTime parses a timestamp cell.
+func parseImportTime(s, format string, loc *time.Location) (time.Time, error) {
+	unix := func(v float64, unit time.Duration) time.Time {
+		return time.Unix(0, int64(v*float64(unit))).UTC()
+	}
+	switch format {
+	case "rfc3339":
+		return time.Parse(time.RFC3339Nano, s)
+	case "unix", "unix_ms", "excel":
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("timestamp %q is not a number", s)
+		}
+		switch format {
+		case "unix":
+			return unix(v, time.Second), nil
+		case "unix_ms":
+			return unix(v, time.Millisecond), nil
+		}
+		return excelSerialTime(v, loc), nil
+	case "", importUnitAuto:
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			switch {
+			case v > 1e11:
+				return unix(v, time.Millisecond), nil
+			case v > 1e8:
+				return unix(v, time.Second), nil
+			case v > 0 && v < 100000:
+				return excelSerialTime(v, loc), nil
+			}
+			return time.Time{}, fmt.Errorf("timestamp %v is out of range", v)
+		}
+		for _, layout := range importTimeLayouts {
+			if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("unrecognized timestamp %q (give -time-format)", s)
+	default:
+		t, err := time.ParseInLocation(format, s, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("timestamp %q doesn't match %q", s, format)
+		}
+		return t, nil
+	}
+}
+
+// excelSerialTime converts an Excel date serial (days since 1899-12-30, in
+// the workbook's local time) to a time.
+func excelSerialTime(serial float64, loc *time.Location) time.Time {
+	days := math.Floor(serial)
+	secs := math.Round((serial - days) * 86400)
+	return time.Date(1899, 12, 30, 0, 0, 0, 0, loc).AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+}
+
+// readImportTable reads the file's first sheet as rows of cells.
+func readImportTable(opts ImportOptions) ([][]string, error) {
+	format := opts.Format
+	if format == "" {
+		format = ImportFormatCSV
+		if strings.EqualFold(filepath.Ext(opts.Path), ".xlsx") {
+			format = ImportFormatXLSX
+		}
+	}
+	switch format {
+	case ImportFormatCSV:
+		f, err := os.Open(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r := csv.NewReader(f)
+		if opts.Delimiter != 0 {
+			r.Comma = opts.Delimiter
+		}
+		r.FieldsPerRecord = -1
+		r.LazyQuotes = true
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", opts.Path, err)
+		}
+		return records, nil
+	case ImportFormatXLSX:
+		return readXLSX(opts.Path)
+	default:
+		return nil, fmt.Errorf("unknown import format %q (want csv or xlsx)", format)
+	}
+}
+
+// xlsx parts read by readXLSX
+type xlsxSharedStrings struct {
+	Items []struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline struct {
+				Text string `xml:"t"`
+			} `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX reads the first worksheet of an Excel workbook. Dates come back
+// as their serial numbers, which the auto and excel time formats accept.
+func readXLSX(path string) ([][]string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer zr.Close()
+
+	parts := make(map[string]*zip.File, len(zr.File))
+	sheets := make([]string, 0, 1)
+	for _, f := range zr.File {
+		parts[f.Name] = f
+		if strings.HasPrefix(f.Name, "xl/worksheets/sheet") && strings.HasSuffix(f.Name, ".xml") {
+			sheets = append(sheets, f.Name)
+		}
+	}
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("%s has no worksheets", path)
+	}
+	sheetName := "xl/worksheets/sheet1.xml"
+	if parts[sheetName] == nil {
+		sort.Strings(sheets)
+		sheetName = sheets[0]
+	}
+
+	var shared []string
+	if f := parts["xl/sharedStrings.xml"]; f != nil {
+		var sst xlsxSharedStrings
+		if err := decodeZipXML(f, &sst); err != nil {
+			return nil, fmt.Errorf("failed to read shared strings: %v", err)
+		}
+		for _, si := range sst.Items {
+			text := si.Text
+			for _, run := range si.Runs {
+				text += run.Text
+			}
+			shared = append(shared, text)
+		}
+	}
+	var sheet xlsxWorksheet
+	if err := decodeZipXML(parts[sheetName], &sheet); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", sheetName, err)
+	}
+
+	table := make([][]string, 0, len(sheet.Rows))
+	for _, row := range sheet.Rows {
+		record := make([]string, 0, len(row.Cells))
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col = xlsxColumn(c.Ref)
+			}
+			for len(record) < col {
+				record = append(record, "")
+			}
+			v := c.Value
+			switch c.Type {
+			case "s":
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 || n >= len(shared) {
+					return nil, fmt.Errorf("cell %s: bad shared string %q", c.Ref, v)
+				}
+				v = shared[n]
+			case "inlineStr":
+				v = c.Inline.Text
+			}
+			record = append(record, v)
+		}
+		table = append(table, record)
+	}
+	return table, nil
+}
+
+func decodeZipXML(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(io.LimitReader(rc, 512<<20)).Decode(v)
+}
+
+// xlsxColumn is the zero-based column of a cell reference like "AB12".
+func xlsxColumn(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
+
+// importedBackfill is the window a backfill over an import covers.
+func importedBackfill(res ImportResult, step time.Duration) (BackfillRequest, bool) {
+	if res.From == nil || res.To == nil || step <= 0 {
+		return BackfillRequest{}, false
+	}
+	req := BackfillRequest{From: res.From.Add(-time.Second), To: res.To.Add(time.Second), Step: step}
+	return req, req.To.After(req.From)
+}
@@ -0,0 +1,191 @@
+// Reading Trace - follows a single sensor reading through the edge pipeline
+// Every reading gets a trace ID derived from (sensor_id, timestamp), so the
+// cloud can compute the same ID independently. The tracer records each
+// stage the reading passes (ingest, QC, interpolation, sync, cloud ack) and
+// which grid points used it, answering "where is reading X?" without
+// grepping logs on both sides.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Trace stages
+const (
+	TraceIngested     = "ingested"
+	TraceQCPassed     = "qc_passed"
+	TraceQCRejected   = "qc_rejected"
+	TraceInterpolated = "interpolated"
+	TraceQueued       = "queued_for_sync"
+	TraceSyncSkipped  = "sync_skipped"
+	TraceSyncStarted  = "sync_started"
+	TraceSyncFailed   = "sync_failed"
+	TraceCloudAck     = "cloud_ack"
+)
+
+const defaultTraceRetention = 24 * time.Hour
+
+// TraceEvent is one stage transition of a reading.
+type TraceEvent struct {
+	Stage  string    `json:"stage"`
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// ReadingTrace is the full journey of one reading on this device.
+type ReadingTrace struct {
+	TraceID   string       `json:"trace_id"`
+	SensorID  string       `json:"sensor_id"`
+	Timestamp time.Time    `json:"timestamp"`
+	Events    []TraceEvent `json:"events"`
+	GridIDs   []string     `json:"grid_ids"`
+
+	gridSet  map[string]bool
+	lastSeen time.Time
+}
+
+// traceIDFor derives the correlation ID for a reading.
+func traceIDFor(sensorID string, ts time.Time) string {
+	h := sha256.Sum256([]byte(sensorID + "|" + ts.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(h[:8])
+}
+
+// ReadingTracer keeps recent traces in memory.
+type ReadingTracer struct {
+	mu        sync.Mutex
+	traces    map[string]*ReadingTrace
+	retention time.Duration
+}
+
+func NewReadingTracer(retention time.Duration) *ReadingTracer {
+	if retention <= 0 {
+		retention = defaultTraceRetention
+	}
+	return &ReadingTracer{
+		traces:    make(map[string]*ReadingTrace),
+		retention: retention,
+	}
+}
+
+// Ingest registers a reading (idempotent: re-fetching it only adds an event
+// the first time) and returns its trace ID.
+func (t *ReadingTracer) Ingest(r SensorReading) string {
+	id := traceIDFor(r.SensorID, r.Timestamp)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr, ok := t.traces[id]; ok {
+		tr.lastSeen = time.Now()
+		return id
+	}
+	now := time.Now()
+	t.traces[id] = &ReadingTrace{
+		TraceID:   id,
+		SensorID:  r.SensorID,
+		Timestamp: r.Timestamp,
+		Events:    []TraceEvent{{Stage: TraceIngested, At: now}},
+		GridIDs:   make([]string, 0),
+		gridSet:   make(map[string]bool),
+		lastSeen:  now,
+	}
+	return id
+}
+
+// Record appends a stage event to each of the given traces.
+func (t *ReadingTracer) Record(traceIDs []string, stage, detail string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range traceIDs {
+		if tr, ok := t.traces[id]; ok {
+			tr.Events = append(tr.Events, TraceEvent{Stage: stage, At: now, Detail: detail})
+			tr.lastSeen = now
+		}
+	}
+}
+
+// RecordLineage marks which grid points used which readings and adds one
+// interpolation event per reading for the cycle.
+func (t *ReadingTracer) RecordLineage(points []VirtualGridPoint) {
+	usage := make(map[string]int)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range points {
+		for _, id := range p.SourceTraceIDs {
+			tr, ok := t.traces[id]
+			if !ok {
+				continue
+			}
+			usage[id]++
+			if !tr.gridSet[p.GridID] {
+				tr.gridSet[p.GridID] = true
+				tr.GridIDs = append(tr.GridIDs, p.GridID)
+			}
+		}
+	}
+	for id, n := range usage {
+		tr := t.traces[id]
+		tr.Events = append(tr.Events, TraceEvent{Stage: TraceInterpolated, At: now, Detail: pluralPoints(n)})
+		tr.lastSeen = now
+	}
+}
+
+// RecordPoints records a stage for every reading feeding the given points.
+func (t *ReadingTracer) RecordPoints(points []VirtualGridPoint, stage, detail string) {
+	t.Record(traceIDsOf(points), stage, detail)
+}
+
+// Get returns a copy of a trace.
+func (t *ReadingTracer) Get(traceID string) (ReadingTrace, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.traces[traceID]
+	if !ok {
+		return ReadingTrace{}, false
+	}
+	out := *tr
+	out.Events = append([]TraceEvent(nil), tr.Events...)
+	out.GridIDs = append([]string(nil), tr.GridIDs...)
+	return out, true
+}
+
+// Prune drops traces not touched within the retention window.
+func (t *ReadingTracer) Prune() {
+	cutoff := time.Now().Add(-t.retention)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, tr := range t.traces {
+		if tr.lastSeen.Before(cutoff) {
+			delete(t.traces, id)
+		}
+	}
+}
+
+// traceIDsOf collects the distinct reading trace IDs behind a set of points.
+func traceIDsOf(points []VirtualGridPoint) []string {
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	for _, p := range points {
+		for _, id := range p.SourceTraceIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func pluralPoints(n int) string {
+	if n == 1 {
+		return "used by 1 grid point"
+	}
+	return fmt.Sprintf("used by %d grid points", n)
+}
@@ -0,0 +1,190 @@
+// Reading Units - canonical units for incoming readings
+// Probe vendors disagree on units: one reports VWC as a fraction (m³/m³),
+// another as a percentage, a third as raw ADC counts; temperatures arrive
+// in °C, °F or K. Each probe's registry entry (sensor_registry.go) names
+// the units it reports, and every fetched reading is converted to the
+// units the grid works in before QC, normalization and interpolation:
+//
+//   - moisture_unit: fraction (m³/m³, the default), percent, or
+//     raw_counts with a two-point calibration (raw_dry_counts reads
+//     raw_dry_vwc, raw_wet_counts reads raw_wet_vwc, linear between);
+//   - temp_unit: c (the default), f or k;
+//   - channel_units: per channel or extra, the length unit it reports
+//     (mm, cm or in), converted to mm.
+//
+// A reading whose probe names a unit this table doesn't know, reports raw
+// counts without a calibration, or converts to something no soil reads
+// (moisture outside [0, 1] m³/m³, a percentage probe registered as a
+// fraction) is rejected: traced as qc_rejected with the reason and left
+// out of the cycle. Probes without a registry entry are taken to report
+// canonical units. Stored readings stay as reported.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Reading units beyond the import units (reading_import.go)
+const (
+	MoistureUnitRawCounts = "raw_counts"
+	LengthUnitMM          = "mm"
+	LengthUnitCM          = "cm"
+	LengthUnitIn          = "in"
+)
+
+const (
+	minCanonicalTempC = -50.0
+	maxCanonicalTempC = 80.0
+)
+
+// lengthToMM is the millimetres in one of each length unit.
+var lengthToMM = map[string]float64{
+	LengthUnitMM: 1,
+	LengthUnitCM: 10,
+	LengthUnitIn: 25.4,
+}
+
+// checkUnitNames reports a unit the conversion table doesn't know, or nil.
+func (inst SensorInstall) checkUnitNames() error {
+	switch inst.MoistureUnit {
+	case "", MoistureUnitFraction, MoistureUnitPercent, MoistureUnitRawCounts:
+	default:
+		return fmt.Errorf("unknown moisture_unit %q", inst.MoistureUnit)
+	}
+	switch inst.TempUnit {
+	case "", TempUnitC, TempUnitF, TempUnitK:
+	default:
+		return fmt.Errorf("unknown temp_unit %q", inst.TempUnit)
+	}
+	for name, unit := range inst.ChannelUnits {
+		if _, ok := lengthToMM[unit]; !ok {
+			return fmt.Errorf("unknown unit %q for channel %s", unit, name)
+		}
+	}
+	return nil
+}
+
+// toCanonical converts r in place from inst's units to m³/m³, °C and mm.
+func (inst SensorInstall) toCanonical(r *SensorReading) error {
+	if err := inst.checkUnitNames(); err != nil {
+		return err
+	}
+	if inst.MoistureUnit == MoistureUnitRawCounts && inst.RawDryCounts == inst.RawWetCounts {
+		return fmt.Errorf("moisture_unit %s needs raw_dry_counts and raw_wet_counts that differ", MoistureUnitRawCounts)
+	}
+	moisture := func(v float64) float64 {
+		switch inst.MoistureUnit {
+		case MoistureUnitPercent:
+			return v / 100
+		case MoistureUnitRawCounts:
+			return inst.RawDryVWC + (v-inst.RawDryCounts)*(inst.RawWetVWC-inst.RawDryVWC)/(inst.RawWetCounts-inst.RawDryCounts)
+		}
+		return v
+	}
+	temp := func(v float64) float64 {
+		switch inst.TempUnit {
+		case TempUnitF:
+			return (v - 32) * 5 / 9
+		case TempUnitK:
+			return v - 273.15
+		}
+		return v
+	}
+	checkMoisture := func(v float64) error {
+		if math.IsNaN(v) || v < 0 || v > 1 {
+			return fmt.Errorf("moisture %.3f m³/m³ after conversion from %s is not physical", v, unitOrDefault(inst.MoistureUnit, MoistureUnitFraction))
+		}
+		return nil
+	}
+	checkTemp := func(v float64) error {
+		if math.IsNaN(v) || v < minCanonicalTempC || v > maxCanonicalTempC {
+			return fmt.Errorf("temperature %.1f °C after conversion from %s is not plausible", v, unitOrDefault(inst.TempUnit, TempUnitC))
+		}
+		return nil
+	}
+
+	r.MoistureSurface = moisture(r.MoistureSurface)
+	r.MoistureRoot = moisture(r.MoistureRoot)
+	r.TempSurface = temp(r.TempSurface)
+	if err := checkMoisture(r.MoistureSurface); err != nil {
+		return err
+	}
+	if err := checkMoisture(r.MoistureRoot); err != nil {
+		return err
+	}
+	if err := checkTemp(r.TempSurface); err != nil {
+		return err
+	}
+	for j := range r.Profile {
+		d := &r.Profile[j]
+		if d.Moisture != nil {
+			d.Moisture = float64Ptr(moisture(*d.Moisture))
+			if err := checkMoisture(*d.Moisture); err != nil {
+				return fmt.Errorf("%d cm: %v", int(d.DepthCm), err)
+			}
+		}
+		if d.Temperature != nil {
+			d.Temperature = float64Ptr(temp(*d.Temperature))
+			if err := checkTemp(*d.Temperature); err != nil {
+				return fmt.Errorf("%d cm: %v", int(d.DepthCm), err)
+			}
+		}
+	}
+	for name, unit := range inst.ChannelUnits {
+		if v, ok := r.Channels[name]; ok {
+			r.Channels[name] = v * lengthToMM[unit]
+		}
+		if v, ok := r.Extras[name]; ok {
+			r.Extras[name] = v * lengthToMM[unit]
+		}
+	}
+	return nil
+}
+
+func unitOrDefault(unit, def string) string {
+	if unit == "" {
+		return def
+	}
+	return unit
+}
+
+// canonicalizeReadings converts fetched readings to canonical units and
+// returns those that converted, tracing the rest as rejected.
+func (ep *EdgeProcessor) canonicalizeReadings(sensors []SensorReading) []SensorReading {
+	installs := ep.SensorInstalls()
+	if len(installs) == 0 {
+		return sensors
+	}
+	byID := make(map[string]SensorInstall, len(installs))
+	for _, inst := range installs {
+		byID[inst.SensorID] = inst
+	}
+
+	kept := sensors[:0]
+	rejected := make(map[string]string)
+	for _, s := range sensors {
+		if inst, ok := byID[s.SensorID]; ok {
+			if err := inst.toCanonical(&s); err != nil {
+				rejected[s.SensorID] = err.Error()
+				if s.TraceID != "" {
+					ep.tracer.Record([]string{s.TraceID}, TraceQCRejected, "units: "+err.Error())
+				}
+				continue
+			}
+		}
+		kept = append(kept, s)
+	}
+	ids := make([]string, 0, len(rejected))
+	for id := range rejected {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		ep.cycleLog.Warn("Rejected readings in unknown or unconvertible units", "component", "reading_units",
+			"sensor_id", id, "reason", rejected[id])
+	}
+	return kept
+}
@@ -0,0 +1,288 @@
+// Remote Config Sync - per-device configuration from the cloud control plane
+// The control plane publishes a signed document per device, either at an
+// HTTP endpoint or in the devices.config column. The document carries a
+// monotonically increasing version and a partial EdgeConfig that is
+// overlaid on the local (file/default) config. It is applied only if the
+// Ed25519 signature verifies, it targets this device, it is newer than the
+// one in use, and the merged result passes validation. The last accepted
+// document is cached on disk so the device boots with it when offline.
+// The overlay never touches the keys and URLs it is verified with, nor the
+// OTA update key and manifest URL, which only the local config sets.
+//
+// Envelope:
+//
+//	{"payload": "<base64 JSON RemoteConfigDoc>", "signature": "<base64 ed25519>"}
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultRemoteConfigPoll = 5 * time.Minute
+	remoteConfigTimeout     = 15 * time.Second
+	remoteConfigMaxBytes    = 1 << 20
+)
+
+// RemoteConfigEnvelope is the signed wire format.
+type RemoteConfigEnvelope struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// RemoteConfigDoc is the signed payload.
+type RemoteConfigDoc struct {
+	Version  int64           `json:"version"`
+	DeviceID string          `json:"device_id"`
+	IssuedAt time.Time       `json:"issued_at"`
+	Config   json.RawMessage `json:"config"` // partial EdgeConfig
+}
+
+// VersionTag is the label stamped on grid batches.
+func (d *RemoteConfigDoc) VersionTag() string {
+	if d == nil {
+		return "local"
+	}
+	return fmt.Sprintf("v%d", d.Version)
+}
+
+// verifyRemoteConfig checks the envelope signature and decodes the payload.
+func verifyRemoteConfig(raw []byte, publicKey ed25519.PublicKey, deviceID string) (*RemoteConfigDoc, error) {
+	payload, err := openSignedEnvelope(raw, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc RemoteConfigDoc
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	if doc.DeviceID != deviceID {
+		return nil, fmt.Errorf("config targets device %q, not %q", doc.DeviceID, deviceID)
+	}
+	return &doc, nil
+}
+
+// openSignedEnvelope verifies an envelope and returns its payload. Release
+// manifests use the same envelope.
+func openSignedEnvelope(raw []byte, publicKey ed25519.PublicKey) ([]byte, error) {
+	var env RemoteConfigEnvelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload encoding: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(publicKey, payload, sig) {
+		return nil, errors.New("signature verification failed")
+	}
+	return payload, nil
+}
+
+// mergeRemoteConfig overlays a remote partial config on a base config.
+func mergeRemoteConfig(base EdgeConfig, doc *RemoteConfigDoc) (EdgeConfig, error) {
+	if doc == nil || len(doc.Config) == 0 {
+		return base, nil
+	}
+	merged := base
+	// AESKey is json:"-" so it survives the overlay untouched
+	if err := json.Unmarshal(doc.Config, &merged); err != nil {
+		return base, fmt.Errorf("invalid remote config: %v", err)
+	}
+	// The control plane can't redirect or re-key its own trust anchor
+	merged.RemoteConfigURL = base.RemoteConfigURL
+	merged.RemoteConfigPublicKey = base.RemoteConfigPublicKey
+	merged.RemoteConfigCache = base.RemoteConfigCache
+	// nor hand its signing key the power to authorize binaries
+	merged.UpdateManifestURL = base.UpdateManifestURL
+	merged.UpdatePublicKey = base.UpdatePublicKey
+	if err := merged.Validate(); err != nil {
+		return base, fmt.Errorf("remote config %s rejected: %v", doc.VersionTag(), err)
+	}
+	return merged, nil
+}
+
+// parseRemoteConfigKey decodes the base64 Ed25519 public key from config.
+func parseRemoteConfigKey(encoded string) (ed25519.PublicKey, error) {
+	return parseEd25519Key("remote_config_public_key", encoded)
+}
+
+// parseEd25519Key decodes a base64 Ed25519 public key setting.
+func parseEd25519Key(setting, encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be base64: %v", setting, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s must be %d bytes", setting, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// LoadCachedRemoteConfig returns the last accepted document, if any.
+func LoadCachedRemoteConfig(config EdgeConfig) *RemoteConfigDoc {
+	if config.RemoteConfigCache == "" || config.RemoteConfigPublicKey == "" {
+		return nil
+	}
+	key, err := parseRemoteConfigKey(config.RemoteConfigPublicKey)
+	if err != nil {
+		return nil
+	}
+	raw, err := os.ReadFile(config.RemoteConfigCache)
+	if err != nil {
+		return nil
+	}
+	doc, err := verifyRemoteConfig(raw, key, config.DeviceID)
+	if err != nil {
+		slog.Warn("Ignoring cached remote config", "component", "remote_config", "error", err)
+		return nil
+	}
+	return doc
+}
+
+// RemoteConfigSync polls the control plane for this device's config.
+type RemoteConfigSync struct {
+	deviceID  string
+	url       string
+	cloud     *CloudConnManager
+	publicKey ed25519.PublicKey
+	cachePath string
+	interval  time.Duration
+	current   int64
+	updates   chan *RemoteConfigDoc
+	client    *http.Client
+	logger    *slog.Logger
+}
+
+func NewRemoteConfigSync(config EdgeConfig, cloud *CloudConnManager, current *RemoteConfigDoc) (*RemoteConfigSync, error) {
+	key, err := parseRemoteConfigKey(config.RemoteConfigPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.RemoteConfigPollSec) * time.Second
+	if interval <= 0 {
+		interval = defaultRemoteConfigPoll
+	}
+	rs := &RemoteConfigSync{
+		deviceID:  config.DeviceID,
+		url:       config.RemoteConfigURL,
+		cloud:     cloud,
+		publicKey: key,
+		cachePath: config.RemoteConfigCache,
+		interval:  interval,
+		updates:   make(chan *RemoteConfigDoc, 1),
+		client:    &http.Client{Timeout: remoteConfigTimeout},
+		logger:    slog.With("component", "remote_config"),
+	}
+	if current != nil {
+		rs.current = current.Version
+	}
+	return rs, nil
+}
+
+// Updates delivers verified documents newer than the one in use.
+func (rs *RemoteConfigSync) Updates() <-chan *RemoteConfigDoc {
+	return rs.updates
+}
+
+// Run polls until the process exits.
+func (rs *RemoteConfigSync) Run() {
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+	for {
+		rs.poll()
+		<-ticker.C
+	}
+}
+
+func (rs *RemoteConfigSync) poll() {
+	raw, err := rs.fetch()
+	if err != nil {
+		rs.logger.Warn("Remote config fetch failed", "error", err)
+		return
+	}
+	if raw == nil {
+		return
+	}
+
+	doc, err := verifyRemoteConfig(raw, rs.publicKey, rs.deviceID)
+	if err != nil {
+		rs.logger.Error("Remote config rejected", "error", err)
+		return
+	}
+	if doc.Version <= rs.current {
+		return
+	}
+	rs.current = doc.Version
+
+	if rs.cachePath != "" {
+		if err := os.WriteFile(rs.cachePath, raw, 0600); err != nil {
+			rs.logger.Warn("Failed to cache remote config", "error", err)
+		}
+	}
+
+	rs.logger.Info("New remote config received", "version", doc.Version, "issued_at", doc.IssuedAt)
+	select {
+	case <-rs.updates:
+	default:
+	}
+	rs.updates <- doc
+}
+
+// fetch reads the envelope from the HTTP endpoint if configured, otherwise
+// from the devices table. A nil result means nothing is published.
+func (rs *RemoteConfigSync) fetch() ([]byte, error) {
+	if rs.url != "" {
+		req, err := http.NewRequest(http.MethodGet, rs.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Device-ID", rs.deviceID)
+		resp, err := rs.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("control plane returned HTTP %d", resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, remoteConfigMaxBytes))
+	}
+
+	db := rs.cloud.DB()
+	if db == nil {
+		return nil, nil // offline; try again next poll
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+
+	var raw []byte
+	err := db.QueryRowContext(ctx,
+		`SELECT config -> 'signed_edge_config' FROM devices WHERE external_id = $1`,
+		rs.deviceID,
+	).Scan(&raw)
+	if err == sql.ErrNoRows || len(raw) == 0 {
+		return nil, nil
+	}
+	return raw, err
+}
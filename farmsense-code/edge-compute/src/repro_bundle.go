@@ -0,0 +1,376 @@
+// Reproduction Bundle Export - anonymized datasets for support
+// Packages config, recent sensor readings and grid output into a single
+// JSON file that customers can hand to support without revealing where
+// the farm is or who owns it.
+//
+// Anonymization:
+//   - Coordinates are rigidly transformed (random rotation + translation to
+//     a synthetic origin) so inter-sensor distances, and therefore the IDW
+//     result, are preserved while the real location is not recoverable.
+//   - Sensor, field, tenant and device IDs are replaced with salted HMAC pseudonyms.
+//   - The config carries only the settings that shape the interpolation
+//     and its layers (reproConfigKeys), with their geometry transformed
+//     like the readings. Anything not listed, credentials, endpoints and
+//     notification targets included, stays on the device, so a setting
+//     added later can't leak until it is listed. Secrets are also stripped
+//     from the full config before the keys are picked.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+// Synthetic origin for anonymized coordinates (near Null Island, where
+// degrees-to-meters conversion is closest to uniform).
+const (
+	reproOriginLat = 0.5
+	reproOriginLon = 0.5
+	metersPerDeg   = 111111.0
+)
+
+// ReproBundle is the on-disk format shared with support.
+type ReproBundle struct {
+	FormatVersion int                        `json:"format_version"`
+	CreatedAt     time.Time                  `json:"created_at"`
+	Config        map[string]json.RawMessage `json:"config"` // reproConfigKeys only
+	Readings      []SensorReading            `json:"readings"`
+	Grid          []VirtualGridPoint         `json:"grid"`
+	Notes         string                     `json:"notes"`
+}
+
+// reproConfigKeys are the config settings a bundle carries.
+var reproConfigKeys = []string{
+	"field_id", "tenant_id", "grid_resolution_m", "idw_power", "search_radius_m", "min_sensors",
+	"compute_interval_sec", "crop", "irrigation_thresholds", "derived_metrics", "gdd_base_c",
+	"trend_layer_cycles", "units", "anisotropy",
+	"irrigation_water_ec_dsm", "soil_ec_factor", "salinity_threshold_dsm", "max_leaching_fraction",
+	"rbf_basis", "rbf_max_sensors", "rbf_smoothing", "rbf_shape_m",
+	"sensor_classes", "sensor_class_reference", "sensor_installs", "soil_damping_depth_cm",
+	"reading_half_life_min", "reading_half_life_irrigating_min",
+	"microclimate_terrain", "canopy_zones", "water_bodies", "lapse_rate_day_c_per_m",
+	"inversion_night_c_per_m", "canopy_day_c", "canopy_night_c", "water_day_c", "water_night_c",
+	"water_range_m", "frost_alert_c", "heat_alert_c", "temp_event_hysteresis_c", "temp_event_hold_min",
+	"shadow_interpolator", "shadow_idw_power", "kriging_range_m", "kriging_nugget",
+	"late_reading_policy", "late_reading_max_hours",
+	"field_boundary", "exclusion_zones", "management_zones", "lorawan_devices",
+	"rain_gauges", "rain_drain_hours", "rain_min_mm", "rain_rise_vwc", "rain_rise_sensor_pct",
+	"irrigation_rise_vwc", "irrigation_mask_hours", "irrigation_mask_share",
+	"min_need_confidence", "extrapolation_policy", "extrapolation_buffer_m", "extrapolation_alpha_m",
+	"soil_texture", "traffic_go_pct", "logical_grid",
+}
+
+// Anonymizer holds the per-export random salt and transform.
+// A fresh Anonymizer must be used for every bundle so pseudonyms and
+// coordinates can't be correlated across exports.
+type Anonymizer struct {
+	salt     []byte
+	rotation float64 // radians
+	refLat   float64 // real-world reference point (never exported)
+	refLon   float64
+}
+
+func NewAnonymizer(ref orb.Point) (*Anonymizer, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	var rb [8]byte
+	if _, err := rand.Read(rb[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate rotation: %v", err)
+	}
+	rotation := float64(binary.BigEndian.Uint64(rb[:])%36000) / 36000.0 * 2 * math.Pi
+
+	return &Anonymizer{
+		salt:     salt,
+		rotation: rotation,
+		refLat:   ref.Lat(),
+		refLon:   ref.Lon(),
+	}, nil
+}
+
+// Pseudonym maps an identifier to a stable (within this export) opaque token.
+func (a *Anonymizer) Pseudonym(kind, id string) string {
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(kind + ":" + id))
+	return fmt.Sprintf("%s_%s", kind, hex.EncodeToString(mac.Sum(nil))[:12])
+}
+
+// Transform moves a point into the synthetic frame.
+// Local equirectangular meters are used so distances up to a few km are
+// preserved well within the search radius tolerance.
+func (a *Anonymizer) Transform(lat, lon float64) (float64, float64) {
+	cosRef := math.Cos(a.refLat * math.Pi / 180.0)
+	east := (lon - a.refLon) * metersPerDeg * cosRef
+	north := (lat - a.refLat) * metersPerDeg
+
+	sin, cos := math.Sincos(a.rotation)
+	rotEast := east*cos - north*sin
+	rotNorth := east*sin + north*cos
+
+	cosOrigin := math.Cos(reproOriginLat * math.Pi / 180.0)
+	newLat := reproOriginLat + rotNorth/metersPerDeg
+	newLon := reproOriginLon + rotEast/(metersPerDeg*cosOrigin)
+	return newLat, newLon
+}
+
+// SanitizeConfig strips secrets and pseudonymizes identifiers.
+func (a *Anonymizer) SanitizeConfig(cfg EdgeConfig) EdgeConfig {
+	cfg.FieldID = a.Pseudonym("field", cfg.FieldID)
+	cfg.TenantID = a.Pseudonym("tenant", cfg.TenantID)
+	cfg.DatabaseURL = ""
+	cfg.LocalCacheDB = ""
+	cfg.BackendCallbackURL = ""
+	cfg.MQTTBrokerURL = ""
+	cfg.MQTTUsername = ""
+	cfg.MQTTPassword = ""
+	cfg.PeerDHUAddresses = nil
+	cfg.Peers = nil
+	cfg.PeerAdvertiseURL = ""
+	cfg.AESKey = nil
+	cfg.NotificationChannels = nil
+	cfg.APIKeys = nil
+	cfg.APITenantKeys = nil
+	cfg.ObjectStoreEndpoint = ""
+	cfg.ObjectStoreBucket = ""
+	cfg.ObjectStoreAccessKey = ""
+
+	devices := make([]LoRaWANDevice, len(cfg.LoRaWANDevices))
+	for i, d := range cfg.LoRaWANDevices {
+		if d.SensorID == "" {
+			d.SensorID = d.DevEUI // so it still matches the readings' pseudonym
+		}
+		d.DevEUI = a.Pseudonym("deveui", d.DevEUI)
+		d.SensorID = a.Pseudonym("sensor", d.SensorID)
+		d.FieldID = a.Pseudonym("field", d.FieldID)
+		d.Latitude, d.Longitude = a.Transform(d.Latitude, d.Longitude)
+		devices[i] = d
+	}
+	cfg.LoRaWANDevices = devices
+
+	installs := make([]SensorInstall, len(cfg.SensorInstalls))
+	for i, s := range cfg.SensorInstalls {
+		s.SensorID = a.Pseudonym("sensor", s.SensorID)
+		installs[i] = s
+	}
+	cfg.SensorInstalls = installs
+	if cfg.LogicalGrid != nil {
+		grid := *cfg.LogicalGrid
+		grid.ZoneID = a.Pseudonym("zone", grid.ZoneID)
+		grid.Sensors = make([]LogicalSensor, len(cfg.LogicalGrid.Sensors))
+		for i, s := range cfg.LogicalGrid.Sensors {
+			s.SensorID = a.Pseudonym("sensor", s.SensorID)
+			grid.Sensors[i] = s
+		}
+		cfg.LogicalGrid = &grid
+	}
+
+	zones := make([]ManagementZone, len(cfg.ManagementZones))
+	for i, z := range cfg.ManagementZones {
+		z.Name = a.Pseudonym("zone_name", z.Name) // names like "Smith north 40" identify the farm
+		z.Boundary = a.TransformRing(z.Boundary)
+		zones[i] = z
+	}
+	cfg.ManagementZones = zones
+
+	gauges := make([]RainGauge, len(cfg.RainGauges))
+	for i, g := range cfg.RainGauges {
+		g.GaugeID = a.Pseudonym("gauge", g.GaugeID)
+		if g.Latitude != 0 || g.Longitude != 0 { // 0/0 is field-wide
+			g.Latitude, g.Longitude = a.Transform(g.Latitude, g.Longitude)
+		}
+		gauges[i] = g
+	}
+	cfg.RainGauges = gauges
+
+	if cfg.FieldBoundary != nil {
+		boundary := &FieldBoundary{Polygons: make([][][][2]float64, len(cfg.FieldBoundary.Polygons))}
+		for i, rings := range cfg.FieldBoundary.Polygons {
+			boundary.Polygons[i] = make([][][2]float64, len(rings))
+			for j, ring := range rings {
+				boundary.Polygons[i][j] = a.TransformRing(ring)
+			}
+		}
+		cfg.FieldBoundary = boundary
+	}
+	exclusions := make([]ExclusionZone, len(cfg.ExclusionZones))
+	for i, z := range cfg.ExclusionZones {
+		z.Boundary = a.TransformRing(z.Boundary)
+		exclusions[i] = z
+	}
+	cfg.ExclusionZones = exclusions
+
+	terrain := make([][3]float64, len(cfg.MicroclimateTerrain))
+	for i, pt := range cfg.MicroclimateTerrain {
+		lat, lon := a.Transform(pt[1], pt[0])
+		terrain[i] = [3]float64{lon, lat, pt[2]}
+	}
+	cfg.MicroclimateTerrain = terrain
+	canopies := make([]CanopyZone, len(cfg.CanopyZones))
+	for i, z := range cfg.CanopyZones {
+		z.Boundary = a.TransformRing(z.Boundary)
+		canopies[i] = z
+	}
+	cfg.CanopyZones = canopies
+	water := make([]WaterBody, len(cfg.WaterBodies))
+	for i, w := range cfg.WaterBodies {
+		w.Boundary = a.TransformRing(w.Boundary)
+		water[i] = w
+	}
+	cfg.WaterBodies = water
+
+	stations := make([]WeatherStation, len(cfg.WeatherStations))
+	for i, s := range cfg.WeatherStations {
+		s.FieldID = a.Pseudonym("field", s.FieldID)
+		s.WeatherLinkAPIKey = ""
+		s.Latitude, s.Longitude = a.Transform(s.Latitude, s.Longitude)
+		stations[i] = s
+	}
+	cfg.WeatherStations = stations
+	return cfg
+}
+
+// BundleConfig is the sanitized config cut down to reproConfigKeys.
+func (a *Anonymizer) BundleConfig(cfg EdgeConfig) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(a.SanitizeConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	out := make(map[string]json.RawMessage, len(reproConfigKeys))
+	for _, key := range reproConfigKeys {
+		if v, ok := all[key]; ok {
+			out[key] = v
+		}
+	}
+	return out, nil
+}
+
+// TransformRing moves an outline of [lon, lat] pairs into the synthetic
+// frame, as a copy.
+func (a *Anonymizer) TransformRing(ring [][2]float64) [][2]float64 {
+	if ring == nil {
+		return nil
+	}
+	out := make([][2]float64, len(ring))
+	for i, v := range ring {
+		lat, lon := a.Transform(v[1], v[0])
+		out[i] = [2]float64{lon, lat}
+	}
+	return out
+}
+
+func (a *Anonymizer) AnonymizeReading(r SensorReading) SensorReading {
+	r.SensorID = a.Pseudonym("sensor", r.SensorID)
+	r.TraceID = a.Pseudonym("trace", r.TraceID)
+	r.Latitude, r.Longitude = a.Transform(r.Latitude, r.Longitude)
+	return r
+}
+
+func (a *Anonymizer) AnonymizeGridPoint(p VirtualGridPoint) VirtualGridPoint {
+	var row, col int
+	_, err := fmt.Sscanf(strings.TrimPrefix(p.GridID, p.FieldID+"_"), "r%d_c%d", &row, &col)
+	p.FieldID = a.Pseudonym("field", p.FieldID)
+	p.EdgeDeviceID = a.Pseudonym("device", p.EdgeDeviceID)
+	p.TenantID = a.Pseudonym("tenant", p.TenantID)
+	p.Latitude, p.Longitude = a.Transform(p.Latitude, p.Longitude)
+	if err == nil {
+		p.GridID = fmt.Sprintf("%s_r%03d_c%03d", p.FieldID, row, col) // same cell index as generateGridID
+	} else {
+		p.GridID = a.Pseudonym("grid", p.GridID)
+	}
+
+	sources := make([]string, len(p.SourceSensors))
+	for i, id := range p.SourceSensors {
+		sources[i] = a.Pseudonym("sensor", id)
+	}
+	p.SourceSensors = sources
+
+	traces := make([]string, len(p.SourceTraceIDs))
+	for i, id := range p.SourceTraceIDs {
+		traces[i] = a.Pseudonym("trace", id)
+	}
+	p.SourceTraceIDs = traces
+	return p
+}
+
+// ExportReproBundle writes an anonymized reproduction bundle to path.
+// Readings come from the last `window`; grid output is the most recent cycle.
+func (ep *EdgeProcessor) ExportReproBundle(path string, window time.Duration) error {
+	readings, err := ep.fetchRecentSensors(window)
+	if err != nil {
+		return fmt.Errorf("failed to fetch readings: %v", err)
+	}
+	grid := ep.LatestGrid()
+	if len(grid) == 0 {
+		// No cycle has run in this process yet; interpolate one on the spot
+		// so the bundle always contains the output support needs to compare.
+		sensors, err := ep.fetchRecentSensors(15 * time.Minute)
+		if err == nil {
+			grid = ep.interpolateField(sensors)
+		}
+	}
+
+	// Center the transform on the data so the synthetic field sits at
+	// the origin regardless of where the real farm is.
+	ref := orb.Point{0, 0}
+	if len(readings) > 0 {
+		ref = orb.Point{readings[0].Longitude, readings[0].Latitude}
+	} else if len(grid) > 0 {
+		ref = orb.Point{grid[0].Longitude, grid[0].Latitude}
+	}
+
+	anon, err := NewAnonymizer(ref)
+	if err != nil {
+		return err
+	}
+
+	config, err := anon.BundleConfig(ep.config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	bundle := ReproBundle{
+		FormatVersion: 2,
+		CreatedAt:     time.Now().UTC(),
+		Config:        config,
+		Readings:      make([]SensorReading, 0, len(readings)),
+		Grid:          make([]VirtualGridPoint, 0, len(grid)),
+		Notes:         "Coordinates rigidly transformed and IDs pseudonymized; secrets removed.",
+	}
+	for _, r := range readings {
+		bundle.Readings = append(bundle.Readings, anon.AnonymizeReading(r))
+	}
+	for _, p := range grid {
+		bundle.Grid = append(bundle.Grid, anon.AnonymizeGridPoint(p))
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+
+	ep.logger.Info("Wrote reproduction bundle", "component", "repro", "path", path, "readings", len(bundle.Readings), "grid_points", len(bundle.Grid))
+	return nil
+}
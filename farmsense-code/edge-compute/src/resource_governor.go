@@ -0,0 +1,265 @@
+// Resource Governor - compute priority against CPU temperature and load
+// A Pi in an enclosure in the sun throttles itself, and the edge shares it
+// with the LoRaWAN network server and MQTT broker, whose uplinks matter
+// more than a grid finishing a few seconds sooner. Every
+// governorCheckInterval the governor reads the SoC temperature, the
+// firmware throttle flags (Raspberry Pi) and the 1-minute load, and puts
+// the device in one of three levels:
+//
+//	normal     interpolation_workers goroutines (default: the CPUs the
+//	           process may use, i.e. its affinity capped by a cgroup
+//	           cpu quota)
+//	throttled  SoC at throttle_temp_c (75), firmware throttling, or load
+//	           per CPU above throttle_load_per_cpu (1.5): half the
+//	           workers, and the GeoJSON file export and per-cell MQTT
+//	           grid publish are deferred to a cooler cycle
+//	critical   SoC at throttle_critical_temp_c (80): a single worker
+//
+// A temperature level is left only governorRecoverMarginC below its
+// threshold. Zone summaries, cloud uploads and alerts are never deferred.
+// compute_nice (0-19) lowers the whole process's CPU priority so the
+// other services on the device win any contention; it is applied to every
+// thread of the process, since Linux niceness is per thread.
+
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	governorCheckInterval     = 30 * time.Second
+	governorRecoverMarginC    = 3.0
+	defaultThrottleTempC      = 75.0
+	defaultThrottleCriticalC  = 80.0
+	defaultThrottleLoadPerCPU = 1.5
+	piThrottledPath           = "/sys/devices/platform/soc/soc:firmware/get_throttled"
+	piThrottledNowMask        = 0xe // frequency capped, throttled, soft temperature limit
+	cgroupV2CPUMaxPath        = "/sys/fs/cgroup/cpu.max"
+	cgroupV1CPUQuotaPath      = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriodPath     = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+)
+
+// Governor levels
+const (
+	GovernorNormal    = "normal"
+	GovernorThrottled = "throttled"
+	GovernorCritical  = "critical"
+)
+
+// ThrottleState is the governor's latest check.
+type ThrottleState struct {
+	Level             string    `json:"level"`
+	Reasons           []string  `json:"reasons,omitempty"`
+	TempC             *float64  `json:"temp_c,omitempty"`
+	LoadPerCPU        *float64  `json:"load_per_cpu,omitempty"`
+	FirmwareThrottled bool      `json:"firmware_throttled"`
+	EffectiveCPUs     int       `json:"effective_cpus"`
+	Workers           int       `json:"workers"` // interpolation goroutines at this level
+	ExportsDeferred   bool      `json:"exports_deferred"`
+	CheckedAt         time.Time `json:"checked_at"`
+}
+
+// effectiveCPUs is the CPUs the process may use: its affinity, capped by
+// a cgroup CPU quota when one is set.
+func effectiveCPUs() int {
+	cpus := runtime.NumCPU()
+	if quota, ok := cgroupCPUQuota(); ok && quota < float64(cpus) {
+		cpus = int(math.Ceil(quota))
+	}
+	if cpus < 1 {
+		cpus = 1
+	}
+	return cpus
+}
+
+// cgroupCPUQuota reads the CPU quota in CPUs, v2 then v1; false when unlimited.
+func cgroupCPUQuota() (float64, bool) {
+	if data, err := os.ReadFile(cgroupV2CPUMaxPath); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				return quota / period, true
+			}
+		}
+		return 0, false
+	}
+	quota, ok1 := readFirstFloat(cgroupV1CPUQuotaPath)
+	period, ok2 := readFirstFloat(cgroupV1CPUPeriodPath)
+	if !ok1 || !ok2 || quota <= 0 || period <= 0 {
+		return 0, false
+	}
+	return quota / period, true
+}
+
+// firmwareThrottled reports the Pi firmware's current throttle flags.
+func firmwareThrottled() bool {
+	data, err := os.ReadFile(piThrottledPath)
+	if err != nil {
+		return false
+	}
+	flags, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 32)
+	return err == nil && flags&piThrottledNowMask != 0
+}
+
+// governorLevelFor classifies the readings, with hysteresis on temperature.
+func (ep *EdgeProcessor) governorLevelFor(temp *float64, loadPerCPU *float64, firmware bool) (string, []string) {
+	warm := ep.config.ThrottleTempC
+	if warm <= 0 {
+		warm = defaultThrottleTempC
+	}
+	hot := ep.config.ThrottleCriticalTempC
+	if hot <= 0 {
+		hot = defaultThrottleCriticalC
+	}
+	maxLoad := ep.config.ThrottleLoadPerCPU
+	if maxLoad <= 0 {
+		maxLoad = defaultThrottleLoadPerCPU
+	}
+
+	level := GovernorNormal
+	reasons := make([]string, 0)
+	if temp != nil {
+		t := *temp
+		switch {
+		case t >= hot || (ep.governorLevel == GovernorCritical && t >= hot-governorRecoverMarginC):
+			level = GovernorCritical
+			reasons = append(reasons, "soc_temperature_critical")
+		case t >= warm || (ep.governorLevel != GovernorNormal && t >= warm-governorRecoverMarginC):
+			level = GovernorThrottled
+			reasons = append(reasons, "soc_temperature")
+		}
+	}
+	if firmware {
+		reasons = append(reasons, "firmware_throttled")
+	}
+	if loadPerCPU != nil && *loadPerCPU > maxLoad {
+		reasons = append(reasons, "load")
+	}
+	if level == GovernorNormal && len(reasons) > 0 {
+		level = GovernorThrottled
+	}
+	return level, reasons
+}
+
+// configuredWorkers is interpolation_workers, defaulting to the CPUs available.
+func (ep *EdgeProcessor) configuredWorkers() int {
+	cpus := effectiveCPUs()
+	if n := ep.config.InterpolationWorkers; n > 0 && n < cpus {
+		return n
+	}
+	return cpus
+}
+
+// interpolationWorkers is the goroutine count for this cycle's cells.
+func (ep *EdgeProcessor) interpolationWorkers() int {
+	workers := ep.configuredWorkers()
+	switch ep.governorLevel {
+	case GovernorThrottled:
+		workers /= 2
+	case GovernorCritical:
+		workers = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// throttled reports whether non-critical exports are deferred.
+func (ep *EdgeProcessor) throttled() bool {
+	return ep.governorLevel != GovernorNormal
+}
+
+// maybeCheckResources runs the governor when it is due.
+func (ep *EdgeProcessor) maybeCheckResources() {
+	now := time.Now()
+	if now.Sub(ep.lastGovernorCheck) < governorCheckInterval {
+		return
+	}
+	ep.lastGovernorCheck = now
+	ep.applyComputeNice()
+
+	cpus := effectiveCPUs()
+	state := &ThrottleState{EffectiveCPUs: cpus, FirmwareThrottled: firmwareThrottled(), CheckedAt: now.UTC()}
+	if v, ok := readFirstFloat(thermalZonePath); ok {
+		v /= 1000 // millidegrees
+		state.TempC = &v
+	}
+	if v, ok := readFirstFloat("/proc/loadavg"); ok {
+		perCPU := v / float64(cpus)
+		state.LoadPerCPU = &perCPU
+	}
+
+	level, reasons := ep.governorLevelFor(state.TempC, state.LoadPerCPU, state.FirmwareThrottled)
+	if level != ep.governorLevel {
+		log := ep.logger.Info
+		if level != GovernorNormal {
+			log = ep.logger.Warn
+		}
+		log("Compute throttle level changed", "component", "governor", "from", ep.governorLevel, "to", level,
+			"reasons", strings.Join(reasons, ","), "workers", ep.configuredWorkers())
+		ep.governorLevel = level
+	}
+	state.Level = level
+	state.Reasons = reasons
+	state.Workers = ep.interpolationWorkers()
+	state.ExportsDeferred = ep.throttled()
+
+	ep.stateMu.Lock()
+	ep.throttleState = state
+	ep.stateMu.Unlock()
+}
+
+// applyComputeNice sets compute_nice on every thread of the process when
+// it changed.
+func (ep *EdgeProcessor) applyComputeNice() {
+	nice := ep.config.ComputeNice
+	if nice == ep.appliedNice {
+		return
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		ep.logger.Warn("Failed to list process threads", "component", "governor", "error", err)
+		return
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			// Raising priority back needs CAP_SYS_NICE; keep trying on later checks
+			ep.logger.Warn("Failed to set compute priority", "component", "governor", "nice", nice, "error", err)
+			return
+		}
+	}
+	ep.appliedNice = nice
+	ep.logger.Info("Set compute priority", "component", "governor", "nice", nice, "threads", len(tasks))
+}
+
+// ThrottleState returns the latest governor check, nil before the first.
+func (ep *EdgeProcessor) ThrottleState() *ThrottleState {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return ep.throttleState
+}
+
+// governorLevelValue is a level as a metric value (0 normal, 1 throttled, 2 critical).
+func governorLevelValue(level string) float64 {
+	switch level {
+	case GovernorThrottled:
+		return 1
+	case GovernorCritical:
+		return 2
+	}
+	return 0
+}
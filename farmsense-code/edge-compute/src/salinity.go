@@ -0,0 +1,180 @@
+// Salinity - soil EC layer and leaching in irrigation recommendations
+// Probes that measure electrical conductivity report it as the soil_ec
+// channel (dS/m, in the reading's channels; the Dragino LSE01 decoder
+// fills it from its µS/cm field), and it is interpolated like any other
+// registered variable into the cell's variables.soil_ec layer. Forwarded
+// readings also fill the cloud's ec_root, and cloud rows with only ec_root
+// read back as soil_ec.
+//
+// Crop tolerance follows Maas–Hoffman: yield is unaffected up to a
+// threshold saturated-paste ECe and falls by a fixed percentage per dS/m
+// above it. The probe's value times soil_ec_factor is taken as ECe (most
+// probes report bulk or pore-water EC, so the factor is a per-site
+// calibration; default 1). Thresholds come from the crop model's
+// salinity_threshold_dsm, else the built-in table for crop_type (FAO-29
+// Table 4), else the field's salinity_threshold_dsm; with none of them the
+// module is off.
+//
+// A cell above threshold gets a leaching fraction, the extra share of the
+// applied water that has to drain past the root zone to carry salt out:
+//
+//	maintenance  ECw / (5·ECt − ECw)     (FAO-29, irrigation_water_ec_dsm)
+//	reclamation  (ECe − ECt) / ECe       when the water EC isn't known
+//
+// the larger of the two, capped at max_leaching_fraction. Water deficits
+// are unchanged; the VRI prescription and zone run times apply deficit ÷
+// (1 − LF), and the cell reports the yield loss its salinity implies.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// VarSoilEC is the soil EC channel (dS/m).
+const VarSoilEC = "soil_ec"
+
+const (
+	defaultSoilECFactor        = 1.0
+	defaultMaxLeachingFraction = 0.3
+)
+
+func init() {
+	RegisterSensorVariable(SensorVariable{Name: VarSoilEC})
+}
+
+// salinityTolerance is a crop's Maas–Hoffman response.
+type salinityTolerance struct {
+	ThresholdDSm float64 // ECe at which yield starts to fall
+	SlopePct     float64 // yield loss per dS/m above it
+}
+
+// Built-in tolerances from FAO-29 Table 4 (Maas and Hoffman 1977)
+var cropSalinity = map[string]salinityTolerance{
+	"maize":   {1.7, 12.0},
+	"wheat":   {6.0, 7.1},
+	"soybean": {5.0, 20.0},
+	"cotton":  {7.7, 5.2},
+	"potato":  {1.7, 12.0},
+	"tomato":  {2.5, 9.9},
+	"lettuce": {1.3, 13.0},
+	"spinach": {2.0, 7.6},
+	"grapes":  {1.5, 9.6},
+	"almonds": {1.5, 19.0},
+}
+
+// salinityTolerance returns the field's tolerance, or false when none is
+// known.
+func (ep *EdgeProcessor) salinityTolerance() (salinityTolerance, bool) {
+	if crop := ep.cropModelAt(ep.cycleTime()); crop != nil {
+		t, builtIn := cropSalinity[crop.CropType]
+		if crop.SalinityThresholdDSm > 0 {
+			t.ThresholdDSm = crop.SalinityThresholdDSm
+		}
+		if crop.SalinitySlopePct > 0 {
+			t.SlopePct = crop.SalinitySlopePct
+		}
+		if builtIn || crop.SalinityThresholdDSm > 0 {
+			return t, true
+		}
+	}
+	if t := ep.config.SalinityThresholdDSm; t > 0 {
+		return salinityTolerance{ThresholdDSm: t}, true
+	}
+	return salinityTolerance{}, false
+}
+
+// cellECe is a cell's interpolated soil EC as ECe.
+func (ep *EdgeProcessor) cellECe(p VirtualGridPoint) (float64, bool) {
+	ec, ok := p.Variables[VarSoilEC]
+	if !ok {
+		return 0, false
+	}
+	factor := ep.config.SoilECFactor
+	if factor <= 0 {
+		factor = defaultSoilECFactor
+	}
+	return ec * factor, true
+}
+
+// leachingFraction is the leaching a cell at ece needs.
+func (ep *EdgeProcessor) leachingFraction(ece float64, t salinityTolerance) float64 {
+	if ece <= t.ThresholdDSm {
+		return 0
+	}
+	maxLF := ep.config.MaxLeachingFraction
+	if maxLF <= 0 {
+		maxLF = defaultMaxLeachingFraction
+	}
+	lf := (ece - t.ThresholdDSm) / ece
+	if ecw := ep.config.IrrigationWaterECdSm; ecw > 0 {
+		if limit := 5*t.ThresholdDSm - ecw; limit > 0 {
+			lf = math.Max(lf, ecw/limit)
+		} else {
+			lf = maxLF // water too saline to leach with; as much as allowed
+		}
+	}
+	return math.Min(lf, maxLF)
+}
+
+// applySalinity sets each cell's leaching fraction and salinity yield loss.
+func (ep *EdgeProcessor) applySalinity(points []VirtualGridPoint) {
+	t, ok := ep.salinityTolerance()
+	if !ok {
+		return
+	}
+	above := 0
+	for i := range points {
+		p := &points[i]
+		ece, ok := ep.cellECe(*p)
+		if !ok {
+			continue
+		}
+		p.LeachingFraction = ep.leachingFraction(ece, t)
+		if ece > t.ThresholdDSm {
+			above++
+			p.SalinityLossPct = math.Min(100, (ece-t.ThresholdDSm)*t.SlopePct)
+		}
+	}
+	if above > 0 {
+		ep.cycleLog.Info("Cells above crop salinity threshold", "component", "salinity", "cells", above,
+			"threshold_dsm", t.ThresholdDSm)
+	}
+}
+
+// leachedDepth is the gross depth that leaves depth in the root zone after
+// the leaching fraction drains.
+func leachedDepth(depth, lf float64) float64 {
+	if lf <= 0 || lf >= 1 {
+		return depth
+	}
+	return depth / (1 - lf)
+}
+
+// encodeChannels converts channels to the stored JSON object, NULL when
+// empty.
+func encodeChannels(channels map[string]float64) (sql.NullString, error) {
+	if len(channels) == 0 {
+		return sql.NullString{}, nil
+	}
+	raw, err := json.Marshal(channels)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode channels: %v", err)
+	}
+	return sql.NullString{String: string(raw), Valid: true}, nil
+}
+
+// decodeChannels parses stored channels JSON.
+func decodeChannels(raw sql.NullString) (map[string]float64, error) {
+	if !raw.Valid || raw.String == "" {
+		return nil, nil
+	}
+	var channels map[string]float64
+	if err := json.Unmarshal([]byte(raw.String), &channels); err != nil {
+		return nil, fmt.Errorf("invalid channels: %v", err)
+	}
+	return channels, nil
+}
@@ -0,0 +1,133 @@
+// Sensor Cache - read-through mirror of cloud sensor readings
+// When the cloud is the source of readings (probes uplinked through the
+// backend rather than decoded on this gateway), every reading fetched from
+// it is also written to the local soil_sensor_readings table, so a link
+// drop between one cycle's fetch and the next still leaves the processor
+// with the same sensors. Mirrored rows are marked origin = 'cloud': the
+// store-and-forward path only uploads 'local' rows, and mirrored rows are
+// pruned after sensor_cache_days while local ones wait to be forwarded.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultSensorCacheDays = 14
+	sensorCachePruneEvery  = 24 * time.Hour
+)
+
+// Reading origins in the local table
+const (
+	ReadingOriginLocal     = "local"     // decoded on this gateway; forwarded to the cloud
+	ReadingOriginCloud     = "cloud"     // mirrored from the cloud
+	ReadingOriginSimulated = "simulated" // from run -simulate; never forwarded
+)
+
+// ensureReadingsOrigin adds the origin column to caches created before
+// mirroring existed.
+func ensureReadingsOrigin(db *sql.DB) error {
+	return ensureLocalColumn(db, "soil_sensor_readings", "origin", "TEXT NOT NULL DEFAULT 'local'")
+}
+
+// ensureLocalColumn adds a column to a local table created by an older
+// release. table and column are constants, never user input.
+func ensureLocalColumn(db *sql.DB, table, column, decl string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err
+}
+
+// mirrorReadings copies cloud-fetched readings into the local cache.
+// Readings already there (including this gateway's own, forwarded and
+// fetched back) are left alone. Failure only costs offline coverage, so
+// it is logged, not returned.
+func (ep *EdgeProcessor) mirrorReadings(readings []SensorReading) {
+	if len(readings) == 0 {
+		return
+	}
+	if err := ep.writeMirror(readings); err != nil {
+		ep.cycleLog.Warn("Failed to mirror cloud readings to local cache", "component", "sensor_cache", "error", err)
+	}
+}
+
+func (ep *EdgeProcessor) writeMirror(readings []SensorReading) error {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin mirror transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO soil_sensor_readings
+			(sensor_id, field_id, timestamp, latitude, longitude, moisture_surface, moisture_root,
+			 temp_surface, battery_voltage, quality_flag, origin, vertical_profile, channels, extras)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare mirror insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range readings {
+		profile, err := encodeProfile(r.Profile)
+		if err != nil {
+			return err
+		}
+		channels, err := encodeChannels(r.Channels)
+		if err != nil {
+			return err
+		}
+		extras, err := encodeChannels(r.Extras)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(r.SensorID, ep.config.FieldID, readingTimestamp(r.Timestamp), r.Latitude, r.Longitude,
+			r.MoistureSurface, r.MoistureRoot, r.TempSurface, r.BatteryVoltage, r.QualityFlag, ReadingOriginCloud, profile,
+			channels, extras); err != nil {
+			return fmt.Errorf("failed to mirror reading: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit mirror: %v", err)
+	}
+	return nil
+}
+
+// readingTimestamp normalizes a timestamp for the local table's unique key:
+// UTC at the cloud's timestamptz precision, so a reading forwarded to the
+// cloud and mirrored back matches its local row.
+func readingTimestamp(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// maybePruneSensorCache drops mirrored readings past sensor_cache_days.
+func (ep *EdgeProcessor) maybePruneSensorCache() {
+	now := time.Now()
+	if now.Sub(ep.lastCachePrune) < sensorCachePruneEvery {
+		return
+	}
+	ep.lastCachePrune = now
+
+	days := ep.retentionDays(ep.config.SensorCacheDays, defaultSensorCacheDays)
+	cutoff := readingTimestamp(ep.clock.Now().AddDate(0, 0, -days))
+	res, err := ep.localDB.Exec(`DELETE FROM soil_sensor_readings WHERE origin IN (?, ?) AND timestamp < ?`,
+		ReadingOriginCloud, ReadingOriginSimulated, cutoff)
+	if err != nil {
+		ep.logger.Error("Failed to prune sensor cache", "component", "sensor_cache", "error", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		ep.logger.Debug("Pruned mirrored readings", "component", "sensor_cache", "rows", n)
+	}
+	ep.pruneLocalReadings()
+}
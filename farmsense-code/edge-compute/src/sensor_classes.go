@@ -0,0 +1,279 @@
+// Sensor Classes - separate interpolation passes per probe class
+// Capacitance and TDR probes in the same soil don't read the same VWC, and
+// a field refitted with a second probe model over a few seasons mixes
+// both. One IDW over all of them pulls every cell towards whichever type
+// happens to be nearer, so the map shows the probe layout as much as the
+// soil. sensor_classes groups probes by the sensor registry's probe type
+// and install depth:
+//
+//	"sensor_classes": [
+//	  {"name": "tdr", "probe_type": "tdr", "weight": 2},
+//	  {"name": "cap_30", "probe_type": "capacitive", "max_depth_cm": 45},
+//	  {"name": "cap_60", "probe_type": "capacitive", "min_depth_cm": 45}
+//	],
+//	"sensor_class_reference": "tdr"
+//
+// A probe belongs to the first class it matches; probes matching none form
+// one more, unclassed, pass. Each variable at each cell is then estimated
+// once per class from that class's neighbors (IDW, or the class's own RBF
+// surface on sparse cycles), and the passes are fused: their mean weighted
+// by the class weight (default 1) times the pass's IDW weight mass, so a
+// class with probes close by counts for more than one reaching in from
+// the edge of the search radius.
+//
+// With sensor_class_reference set, each other class is first brought to
+// the reference: every cycle, at each of its probes with reference probes
+// in range, the difference between its reading and the reference IDW
+// estimate there is taken, and the median over at least
+// minClassBiasPairs probes is the class's bias, subtracted from its
+// passes before fusion. Surface and root layers are compared separately,
+// so a 30 cm probe is never corrected against a 60 cm one. Biases need
+// coordinates and are skipped on logical grids.
+
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/paulmach/orb"
+)
+
+const minClassBiasPairs = 3
+
+// SensorClass is one group of probes interpolated on its own.
+type SensorClass struct {
+	Name       string  `json:"name"`
+	ProbeType  string  `json:"probe_type,omitempty"`   // Registry probe_type (empty = any)
+	MinDepthCm float64 `json:"min_depth_cm,omitempty"` // Install depth >= this (0 = no lower bound)
+	MaxDepthCm float64 `json:"max_depth_cm,omitempty"` // Install depth < this (0 = no upper bound)
+	Weight     float64 `json:"weight,omitempty"`       // Relative trust in fusion (default 1)
+}
+
+// matches reports whether a probe's install falls in the class. A depth
+// bound never matches a probe of unknown depth.
+func (c SensorClass) matches(inst SensorInstall) bool {
+	if c.ProbeType != "" && !strings.EqualFold(c.ProbeType, inst.ProbeType) {
+		return false
+	}
+	if c.MinDepthCm > 0 || c.MaxDepthCm > 0 {
+		if inst.DepthCm <= 0 {
+			return false
+		}
+		if inst.DepthCm < c.MinDepthCm || (c.MaxDepthCm > 0 && inst.DepthCm >= c.MaxDepthCm) {
+			return false
+		}
+	}
+	return true
+}
+
+// classifyReadings tags each reading with its probe's class.
+func (ep *EdgeProcessor) classifyReadings(sensors []SensorReading, installs map[string]SensorInstall) {
+	if len(ep.config.SensorClasses) == 0 {
+		return
+	}
+	for i := range sensors {
+		inst, ok := installs[sensors[i].SensorID]
+		if !ok {
+			continue
+		}
+		for _, c := range ep.config.SensorClasses {
+			if c.matches(inst) {
+				sensors[i].class = c.Name
+				break
+			}
+		}
+	}
+}
+
+// classWeight is a class's fusion weight.
+func (ep *EdgeProcessor) classWeight(name string) float64 {
+	for _, c := range ep.config.SensorClasses {
+		if c.Name == name && c.Weight > 0 {
+			return c.Weight
+		}
+	}
+	return 1
+}
+
+// classVariableKey names a class's surface for a variable; the unclassed
+// pass keeps the bare variable name.
+func classVariableKey(class, variable string) string {
+	if class == "" {
+		return variable
+	}
+	return class + "/" + variable
+}
+
+// classGroups splits readings by class; a single unclassed group without
+// sensor_classes.
+func classGroups(sensors []SensorReading) map[string][]SensorReading {
+	groups := make(map[string][]SensorReading)
+	for _, s := range sensors {
+		groups[s.class] = append(groups[s.class], s)
+	}
+	return groups
+}
+
+// classPass is one class's estimate of a variable at a cell.
+type classPass struct {
+	class    string
+	estimate float64 // bias-corrected
+	bias     float64
+	mass     float64 // class weight × sum of IDW weights; +Inf for a probe on the cell
+	samples  []int   // indices into the cell's samples
+}
+
+// classPasses estimates v at point once per class present in samples.
+func (ep *EdgeProcessor) classPasses(point orb.Point, v SensorVariable, samples []NeighborSample, classes []string, models map[string]*rbfModel) []classPass {
+	order := make([]string, 0)
+	members := make(map[string][]int)
+	for i, class := range classes {
+		if _, ok := members[class]; !ok {
+			order = append(order, class)
+		}
+		members[class] = append(members[class], i)
+	}
+
+	passes := make([]classPass, 0, len(order))
+	sub := make([]NeighborSample, 0, len(samples))
+	for _, class := range order {
+		sub = sub[:0]
+		mass := 0.0
+		for _, i := range members[class] {
+			s := samples[i]
+			sub = append(sub, s)
+			if s.Distance == 0 {
+				mass = math.Inf(1)
+			} else {
+				mass += 1.0 / math.Pow(s.Distance, ep.config.IDWPower)
+			}
+		}
+		estimate, ok := ep.estimatePass(point, v, class, sub, models)
+		if !ok {
+			continue
+		}
+		bias := ep.cycleClassBias[class][v.Name]
+		passes = append(passes, classPass{
+			class:    class,
+			estimate: estimate - bias,
+			bias:     bias,
+			mass:     ep.classWeight(class) * mass,
+			samples:  members[class],
+		})
+	}
+	return passes
+}
+
+// passShares are the passes' fusion weights, summing to 1. Passes with a
+// probe on the cell take all of it.
+func passShares(passes []classPass) []float64 {
+	shares := make([]float64, len(passes))
+	total, onCell := 0.0, 0
+	for _, p := range passes {
+		if math.IsInf(p.mass, 1) {
+			onCell++
+		}
+		total += p.mass
+	}
+	for i, p := range passes {
+		switch {
+		case onCell > 0:
+			if math.IsInf(p.mass, 1) {
+				shares[i] = 1 / float64(onCell)
+			}
+		case total > 0:
+			shares[i] = p.mass / total
+		default:
+			shares[i] = 1 / float64(len(passes))
+		}
+	}
+	return shares
+}
+
+// fusePasses is the passes' weighted mean.
+func fusePasses(passes []classPass) (float64, bool) {
+	if len(passes) == 0 {
+		return 0, false
+	}
+	value := 0.0
+	for i, share := range passShares(passes) {
+		value += share * passes[i].estimate
+	}
+	return value, true
+}
+
+// fusedWeights are each sample's share of the fused estimate under a
+// weighted-mean interpolator: its weight within its class's pass times the
+// pass's share. Like attribution elsewhere, RBF passes count by IDW weight.
+func (ep *EdgeProcessor) fusedWeights(point orb.Point, v SensorVariable, weighter SampleWeighter, samples []NeighborSample, classes []string) []float64 {
+	passes := ep.classPasses(point, v, samples, classes, ep.cycleRBF)
+	weights := make([]float64, len(samples))
+	sub := make([]NeighborSample, 0, len(samples))
+	for i, share := range passShares(passes) {
+		p := passes[i]
+		sub = sub[:0]
+		for _, idx := range p.samples {
+			sub = append(sub, samples[idx])
+		}
+		for k, w := range weighter.Weights(sub) {
+			weights[p.samples[k]] = w * share
+		}
+	}
+	return weights
+}
+
+// classBiases estimates each class's offset from the reference class, per
+// variable.
+func (ep *EdgeProcessor) classBiases(sensors []SensorReading) map[string]map[string]float64 {
+	ref := ep.config.SensorClassReference
+	if ref == "" || ep.config.LogicalGrid != nil {
+		return nil
+	}
+	refs := classGroups(sensors)[ref]
+	if len(refs) == 0 {
+		ep.cycleLog.Debug("No reference-class probes this cycle, classes fused uncorrected", "component", "sensor_classes", "reference", ref)
+		return nil
+	}
+
+	idw := ep.idw()
+	biases := make(map[string]map[string]float64)
+	samples := make([]NeighborSample, 0, len(refs))
+	for _, v := range sensorVariables {
+		diffs := make(map[string][]float64)
+		for _, s := range sensors {
+			value, ok := v.Read(s)
+			if !ok || s.class == ref {
+				continue
+			}
+			at := orb.Point{s.Longitude, s.Latitude}
+			samples = samples[:0]
+			for _, r := range refs {
+				rv, ok := v.Read(r)
+				if !ok {
+					continue
+				}
+				if d := ep.sensorDistance(at, r); d <= ep.config.SearchRadius {
+					samples = append(samples, NeighborSample{Distance: d, Value: rv})
+				}
+			}
+			if estimate, ok := idw.Estimate(samples); ok && len(samples) > 0 {
+				diffs[s.class] = append(diffs[s.class], value-estimate)
+			}
+		}
+		for class, d := range diffs {
+			if len(d) < minClassBiasPairs {
+				continue
+			}
+			if biases[class] == nil {
+				biases[class] = make(map[string]float64)
+			}
+			biases[class][v.Name] = median(d)
+		}
+	}
+	for class, b := range biases {
+		ep.cycleLog.Debug("Sensor class bias", "component", "sensor_classes", "class", class, "reference", ref,
+			"moisture_surface", b[VarMoistureSurface], "moisture_root", b[VarMoistureRoot], "temperature", b[VarTemperature])
+	}
+	return biases
+}
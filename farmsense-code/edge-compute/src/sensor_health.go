@@ -0,0 +1,359 @@
+// Sensor Health - per-probe fault detection and a 0–100 health score
+// Four signals over the last day, each scored 0–1 and weighted:
+//   - cadence:  uplinks received vs expected at the reporting interval,
+//     and how long since the last one (a silent probe scores 0)
+//   - battery:  projected days until the voltage crosses the cutoff, from
+//     a linear trend, so crews swap packs before probes go dark
+//   - variance: a flat-lined reading (stuck ADC, probe out of the soil) or
+//     step-to-step jumps far beyond what soil does in 15 minutes
+//   - neighbors: the probe's latest moisture against a leave-one-out IDW
+//     estimate from the other probes within search radius, skipped while
+//     an irrigation pass marks the probe (irrigation_detection.go)
+//
+// Scores are synced to the cloud sensor_health table so maintenance
+// crews know which probes to visit; a probe dropping below the alert
+// score also raises an alert once. Longer-range battery forecasts and the
+// visits they turn into are in maintenance_schedule.go.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+const (
+	sensorHealthInterval        = time.Hour
+	sensorHealthWindow          = 24 * time.Hour
+	defaultSensorReportInterval = 15 * time.Minute
+	defaultSensorHealthAlert    = 50.0
+	defaultBatteryCutoffV       = 3.3
+	batteryWarnDays             = 14.0
+	stuckMoistureStdDev         = 0.0005 // m³/m³, flatter than any real soil over a day
+	maxPlausibleStepVWC         = 0.08   // per reading
+	neighborDisagreeVWC         = 0.10   // |probe − neighbors| that scores 0
+	minHealthSamples            = 4
+)
+
+// Score weights (sum to 1)
+const (
+	weightCadence   = 0.35
+	weightBattery   = 0.20
+	weightVariance  = 0.20
+	weightNeighbors = 0.25
+)
+
+// AlertSensorUnhealthy is raised when a probe's health score falls below the alert score.
+const AlertSensorUnhealthy = "sensor_unhealthy"
+
+// SensorHealth is one probe's health assessment.
+type SensorHealth struct {
+	SensorID         string    `json:"sensor_id"`
+	FieldID          string    `json:"field_id"`
+	Score            float64   `json:"score"` // 0–100
+	CadenceScore     float64   `json:"cadence_score"`
+	BatteryScore     float64   `json:"battery_score"`
+	VarianceScore    float64   `json:"variance_score"`
+	NeighborScore    float64   `json:"neighbor_score"`
+	Readings         int       `json:"readings_24h"`
+	ExpectedReadings int       `json:"expected_readings_24h"`
+	LastSeen         time.Time `json:"last_seen"`
+	BatteryVoltage   float64   `json:"battery_voltage"`
+	BatteryDaysLeft  *float64  `json:"battery_days_left"` // nil = not declining
+	MoistureStdDev   float64   `json:"moisture_stddev"`
+	NeighborDelta    *float64  `json:"neighbor_delta_vwc"` // nil = no neighbors in range
+	Issues           []string  `json:"issues"`
+	AssessedAt       time.Time `json:"assessed_at"`
+}
+
+// scoreCadence compares uplinks received with those expected.
+func scoreCadence(h *SensorHealth, readings []SensorReading, interval time.Duration, now time.Time) float64 {
+	h.ExpectedReadings = int(sensorHealthWindow / interval)
+	h.Readings = len(readings)
+	if len(readings) == 0 {
+		h.Issues = append(h.Issues, "no uplinks in 24h")
+		return 0
+	}
+	h.LastSeen = readings[len(readings)-1].Timestamp
+	ratio := math.Min(float64(h.Readings)/float64(h.ExpectedReadings), 1)
+	if ratio < 0.8 {
+		h.Issues = append(h.Issues, fmt.Sprintf("missing %.0f%% of expected uplinks", (1-ratio)*100))
+	}
+	// Silence now matters more than gaps earlier in the day
+	silent := now.Sub(h.LastSeen)
+	if silent > 4*interval {
+		h.Issues = append(h.Issues, fmt.Sprintf("silent for %s", silent.Truncate(time.Minute)))
+		ratio *= math.Max(0, 1-silent.Hours()/sensorHealthWindow.Hours())
+	}
+	return ratio
+}
+
+// scoreBattery projects when the battery crosses the cutoff voltage.
+func scoreBattery(h *SensorHealth, readings []SensorReading, cutoff float64) float64 {
+	samples := make([]SensorReading, 0, len(readings))
+	for _, r := range readings {
+		if r.BatteryVoltage > 0 {
+			samples = append(samples, r)
+		}
+	}
+	if len(samples) == 0 {
+		return 1 // mains-powered or not reported
+	}
+	last := samples[len(samples)-1].BatteryVoltage
+	h.BatteryVoltage = last
+	if last <= cutoff {
+		h.Issues = append(h.Issues, fmt.Sprintf("battery at %.2f V, below %.2f V cutoff", last, cutoff))
+		return 0
+	}
+	if len(samples) < minHealthSamples {
+		return 1
+	}
+
+	// Least-squares slope in V/day
+	t0 := samples[0].Timestamp
+	var n, sumT, sumV, sumTT, sumTV float64
+	for _, s := range samples {
+		t := s.Timestamp.Sub(t0).Hours() / 24
+		n++
+		sumT += t
+		sumV += s.BatteryVoltage
+		sumTT += t * t
+		sumTV += t * s.BatteryVoltage
+	}
+	denom := n*sumTT - sumT*sumT
+	if denom <= 0 {
+		return 1
+	}
+	slope := (n*sumTV - sumT*sumV) / denom
+	if slope >= 0 {
+		return 1
+	}
+	days := (last - cutoff) / -slope
+	h.BatteryDaysLeft = &days
+	if days < batteryWarnDays {
+		h.Issues = append(h.Issues, fmt.Sprintf("battery cutoff in %.0f days", days))
+	}
+	return math.Min(days/batteryWarnDays, 1)
+}
+
+// scoreVariance catches flat-lined and erratic moisture readings.
+func scoreVariance(h *SensorHealth, readings []SensorReading) float64 {
+	if len(readings) < minHealthSamples {
+		return 1
+	}
+	mean := 0.0
+	for _, r := range readings {
+		mean += r.MoistureRoot
+	}
+	mean /= float64(len(readings))
+	variance := 0.0
+	jumps := 0
+	for i, r := range readings {
+		variance += (r.MoistureRoot - mean) * (r.MoistureRoot - mean)
+		if i > 0 && math.Abs(r.MoistureRoot-readings[i-1].MoistureRoot) > maxPlausibleStepVWC {
+			jumps++
+		}
+	}
+	h.MoistureStdDev = math.Sqrt(variance / float64(len(readings)))
+
+	score := 1.0
+	if h.MoistureStdDev < stuckMoistureStdDev {
+		h.Issues = append(h.Issues, "moisture flat-lined (stuck reading)")
+		score = 0
+	}
+	if jumps > 0 {
+		h.Issues = append(h.Issues, fmt.Sprintf("%d implausible moisture jumps", jumps))
+		score = math.Min(score, math.Max(0, 1-float64(jumps)/float64(len(readings))*4))
+	}
+	return score
+}
+
+// scoreNeighbors compares the probe with a leave-one-out estimate.
+func (ep *EdgeProcessor) scoreNeighbors(h *SensorHealth, latest SensorReading, others []SensorReading) float64 {
+	if len(others) == 0 || ep.config.LogicalGrid != nil {
+		return 1
+	}
+	est := ep.interpolatePoint(orb.Point{latest.Longitude, latest.Latitude}, others)
+	if est == nil || len(est.SourceSensors) == 0 {
+		return 1
+	}
+	delta := latest.MoistureRoot - est.MoistureRoot
+	h.NeighborDelta = &delta
+	if math.Abs(delta) >= neighborDisagreeVWC/2 {
+		h.Issues = append(h.Issues, fmt.Sprintf("reads %+.3f m³/m³ vs neighbors", delta))
+	}
+	return math.Max(0, 1-math.Abs(delta)/neighborDisagreeVWC)
+}
+
+// assessSensorHealth scores every probe seen in the window or previously.
+func (ep *EdgeProcessor) assessSensorHealth(now time.Time) []SensorHealth {
+	history, err := ep.fetchRecentSensors(sensorHealthWindow)
+	if err != nil {
+		ep.logger.Error("Failed to fetch sensor history for health scoring", "component", "sensor_health", "error", err)
+		return nil
+	}
+	bySensor := make(map[string][]SensorReading)
+	for _, r := range history {
+		bySensor[r.SensorID] = append(bySensor[r.SensorID], r)
+	}
+	// Probes that went completely silent still need a visit
+	for _, inst := range ep.SensorInstalls() {
+		if _, ok := bySensor[inst.SensorID]; !ok {
+			bySensor[inst.SensorID] = nil
+		}
+	}
+	ep.stateMu.RLock()
+	for id := range ep.sensorHealth {
+		if _, ok := bySensor[id]; !ok {
+			bySensor[id] = nil
+		}
+	}
+	ep.stateMu.RUnlock()
+
+	// Latest reading per probe for the neighbor comparison
+	latest := make(map[string]SensorReading, len(bySensor))
+	for id, readings := range bySensor {
+		sort.Slice(readings, func(i, j int) bool { return readings[i].Timestamp.Before(readings[j].Timestamp) })
+		if len(readings) > 0 {
+			latest[id] = readings[len(readings)-1]
+		}
+	}
+
+	interval := time.Duration(ep.config.SensorReportIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = defaultSensorReportInterval
+	}
+	cutoff := ep.config.BatteryCutoffV
+	if cutoff <= 0 {
+		cutoff = defaultBatteryCutoffV
+	}
+
+	results := make([]SensorHealth, 0, len(bySensor))
+	for id, readings := range bySensor {
+		h := SensorHealth{SensorID: id, FieldID: ep.config.FieldID, Issues: make([]string, 0), AssessedAt: now}
+		h.CadenceScore = scoreCadence(&h, readings, interval, now)
+		h.BatteryScore = scoreBattery(&h, readings, cutoff)
+		h.VarianceScore = scoreVariance(&h, readings)
+		h.NeighborScore = 1
+		if last, ok := latest[id]; ok && !ep.underPass(id) {
+			others := make([]SensorReading, 0, len(latest)-1)
+			for otherID, r := range latest {
+				if otherID != id && !ep.underPass(otherID) {
+					others = append(others, r)
+				}
+			}
+			h.NeighborScore = ep.scoreNeighbors(&h, last, others)
+		}
+		h.Score = math.Round(100 * (weightCadence*h.CadenceScore + weightBattery*h.BatteryScore +
+			weightVariance*h.VarianceScore + weightNeighbors*h.NeighborScore))
+		if h.Readings == 0 {
+			h.Score = 0 // nothing else can be judged on a silent probe
+		}
+		results = append(results, h)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score < results[j].Score })
+	return results
+}
+
+// checkSensorHealth scores probes, alerts on newly unhealthy ones and
+// syncs the scores to the cloud.
+func (ep *EdgeProcessor) checkSensorHealth(now time.Time) {
+	results := ep.assessSensorHealth(now)
+	if len(results) == 0 {
+		return
+	}
+	alertScore := ep.config.SensorHealthAlertScore
+	if alertScore <= 0 {
+		alertScore = defaultSensorHealthAlert
+	}
+
+	ep.stateMu.Lock()
+	previous := ep.sensorHealth
+	ep.sensorHealth = make(map[string]SensorHealth, len(results))
+	for _, h := range results {
+		ep.sensorHealth[h.SensorID] = h
+	}
+	ep.stateMu.Unlock()
+
+	for _, h := range results {
+		if h.Score >= alertScore {
+			continue
+		}
+		if prev, ok := previous[h.SensorID]; ok && prev.Score < alertScore {
+			continue // already alerted
+		}
+		severity := SeverityWarning
+		if h.Score < alertScore/2 {
+			severity = SeverityCritical
+		}
+		ep.alerts.Raise(Alert{
+			Kind:     AlertSensorUnhealthy,
+			Severity: severity,
+			FieldID:  ep.config.FieldID,
+			Subject:  h.SensorID,
+			Message:  fmt.Sprintf("Probe health %.0f/100; visit probe (%v)", h.Score, h.Issues),
+			Value:    h.Score,
+		})
+	}
+
+	if err := ep.syncSensorHealth(results); err != nil {
+		ep.logger.Warn("Sensor health not synced, retrying next check", "component", "sensor_health", "error", err)
+	}
+}
+
+// syncSensorHealth upserts the latest scores into the cloud sensor_health table.
+func (ep *EdgeProcessor) syncSensorHealth(results []SensorHealth) error {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return fmt.Errorf("cloud offline")
+	}
+	query := `
+		INSERT INTO sensor_health (sensor_id, field_id, score, cadence_score, battery_score,
+		                           variance_score, neighbor_score, last_seen, battery_voltage, issues, assessed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (sensor_id) DO UPDATE SET
+			field_id = EXCLUDED.field_id, score = EXCLUDED.score,
+			cadence_score = EXCLUDED.cadence_score, battery_score = EXCLUDED.battery_score,
+			variance_score = EXCLUDED.variance_score, neighbor_score = EXCLUDED.neighbor_score,
+			last_seen = EXCLUDED.last_seen, battery_voltage = EXCLUDED.battery_voltage,
+			issues = EXCLUDED.issues, assessed_at = EXCLUDED.assessed_at
+	`
+	for _, h := range results {
+		var lastSeen interface{}
+		if !h.LastSeen.IsZero() {
+			lastSeen = h.LastSeen
+		}
+		if _, err := db.Exec(query, h.SensorID, h.FieldID, h.Score, h.CadenceScore, h.BatteryScore,
+			h.VarianceScore, h.NeighborScore, lastSeen, h.BatteryVoltage, strings.Join(h.Issues, "; "), h.AssessedAt); err != nil {
+			return fmt.Errorf("failed to upsert health for %s: %v", h.SensorID, err)
+		}
+	}
+	return nil
+}
+
+// maybeCheckSensorHealth rate-limits health scoring to sensorHealthInterval.
+func (ep *EdgeProcessor) maybeCheckSensorHealth() {
+	now := time.Now()
+	if now.Sub(ep.lastSensorHealthCheck) < sensorHealthInterval {
+		return
+	}
+	ep.lastSensorHealthCheck = now
+	ep.checkSensorHealth(now)
+}
+
+// SensorHealth returns the latest scores, lowest first.
+func (ep *EdgeProcessor) SensorHealth() []SensorHealth {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	out := make([]SensorHealth, 0, len(ep.sensorHealth))
+	for _, h := range ep.sensorHealth {
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Score < out[j].Score })
+	return out
+}
@@ -0,0 +1,379 @@
+// Sensor Registry - per-probe install metadata and reading normalization
+// The cloud sensor_registry table holds what the installer recorded for
+// each probe: install depth, probe type, soil texture at the probe, install
+// date, calibration offsets and reporting units (reading_units.go). It is synced hourly into the local cache so the
+// edge keeps normalizing through outages and restarts; sensor_installs in
+// the config overrides it field by field (a set value wins).
+//
+// Before interpolation each registered probe's reading, already converted
+// to canonical units (reading_units.go), is normalized:
+//   - offsets: moisture_offset_vwc and temp_offset_c are added;
+//   - texture: moisture is rescaled by field capacity from the probe's
+//     soil texture to the field's (soil_texture, else the deficit model's
+//     0.35), so a sand probe at its field capacity reads as "at field
+//     capacity" rather than "bone dry";
+//   - depth: a single-depth probe (one value reported as both surface and
+//     root) counts only toward the layer it sits in, surface down to 30 cm
+//     and root below, and becomes a one-entry depth profile at its install
+//     depth. Cells whose neighbors all lack a layer take it from the other.
+//
+// Stored readings are left raw; only the cycle's copy is normalized. The
+// probe type and depth also put each reading in its sensor class
+// (sensor_classes.go).
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	sensorRegistrySyncInterval = time.Hour
+	surfaceLayerMaxCm          = 30.0 // 0-12 in, the backend's surface band
+)
+
+// SensorInstall describes a probe's declared installation.
+type SensorInstall struct {
+	SensorID          string    `json:"sensor_id"`
+	DepthCm           float64   `json:"depth_cm"`
+	ProbeType         string    `json:"probe_type,omitempty"` // capacitive, tdr... (sensor_classes)
+	InstalledAt       time.Time `json:"installed_at"`
+	SoilTexture       string    `json:"soil_texture,omitempty"`        // texture at the probe (default: field's)
+	MoistureOffsetVWC float64   `json:"moisture_offset_vwc,omitempty"` // added to every moisture value
+	TempOffsetC       float64   `json:"temp_offset_c,omitempty"`       // added to every temperature
+
+	// Reporting units (reading_units.go); empty is canonical
+	MoistureUnit string            `json:"moisture_unit,omitempty"`  // fraction, percent or raw_counts
+	RawDryCounts float64           `json:"raw_dry_counts,omitempty"` // raw_counts calibration: counts reading raw_dry_vwc
+	RawDryVWC    float64           `json:"raw_dry_vwc,omitempty"`
+	RawWetCounts float64           `json:"raw_wet_counts,omitempty"` // ... and counts reading raw_wet_vwc
+	RawWetVWC    float64           `json:"raw_wet_vwc,omitempty"`
+	TempUnit     string            `json:"temp_unit,omitempty"`     // c, f or k
+	ChannelUnits map[string]string `json:"channel_units,omitempty"` // channel -> mm, cm or in
+}
+
+// overlay returns inst with every field set in o replacing it.
+func (inst SensorInstall) overlay(o SensorInstall) SensorInstall {
+	if o.DepthCm > 0 {
+		inst.DepthCm = o.DepthCm
+	}
+	if !o.InstalledAt.IsZero() {
+		inst.InstalledAt = o.InstalledAt
+	}
+	if o.ProbeType != "" {
+		inst.ProbeType = o.ProbeType
+	}
+	if o.SoilTexture != "" {
+		inst.SoilTexture = o.SoilTexture
+	}
+	if o.MoistureOffsetVWC != 0 {
+		inst.MoistureOffsetVWC = o.MoistureOffsetVWC
+	}
+	if o.TempOffsetC != 0 {
+		inst.TempOffsetC = o.TempOffsetC
+	}
+	if o.MoistureUnit != "" {
+		inst.MoistureUnit = o.MoistureUnit
+	}
+	if o.RawDryCounts != 0 || o.RawWetCounts != 0 {
+		inst.RawDryCounts, inst.RawDryVWC = o.RawDryCounts, o.RawDryVWC
+		inst.RawWetCounts, inst.RawWetVWC = o.RawWetCounts, o.RawWetVWC
+	}
+	if o.TempUnit != "" {
+		inst.TempUnit = o.TempUnit
+	}
+	if len(o.ChannelUnits) > 0 {
+		inst.ChannelUnits = o.ChannelUnits
+	}
+	return inst
+}
+
+// SensorInstalls returns the registry merged with sensor_installs, by
+// sensor ID.
+func (ep *EdgeProcessor) SensorInstalls() []SensorInstall {
+	ep.stateMu.RLock()
+	merged := make(map[string]SensorInstall, len(ep.registry)+len(ep.config.SensorInstalls))
+	for id, inst := range ep.registry {
+		merged[id] = inst
+	}
+	ep.stateMu.RUnlock()
+	for _, inst := range ep.config.SensorInstalls {
+		base, ok := merged[inst.SensorID]
+		if !ok {
+			base = SensorInstall{SensorID: inst.SensorID}
+		}
+		merged[inst.SensorID] = base.overlay(inst)
+	}
+
+	out := make([]SensorInstall, 0, len(merged))
+	for _, inst := range merged {
+		out = append(out, inst)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SensorID < out[j].SensorID })
+	return out
+}
+
+// initRegistrySchema creates the local registry cache.
+func initRegistrySchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sensor_registry (
+			field_id            TEXT NOT NULL,
+			sensor_id           TEXT NOT NULL,
+			depth_cm            REAL,
+			probe_type          TEXT NOT NULL DEFAULT '',
+			soil_texture        TEXT,
+			installed_at        INTEGER,
+			moisture_offset_vwc REAL,
+			temp_offset_c       REAL,
+			PRIMARY KEY (field_id, sensor_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	for _, col := range []struct{ name, decl string }{
+		{"probe_type", "TEXT NOT NULL DEFAULT ''"},
+		{"moisture_unit", "TEXT NOT NULL DEFAULT ''"},
+		{"raw_dry_counts", "REAL NOT NULL DEFAULT 0"},
+		{"raw_dry_vwc", "REAL NOT NULL DEFAULT 0"},
+		{"raw_wet_counts", "REAL NOT NULL DEFAULT 0"},
+		{"raw_wet_vwc", "REAL NOT NULL DEFAULT 0"},
+		{"temp_unit", "TEXT NOT NULL DEFAULT ''"},
+		{"channel_units", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := ensureLocalColumn(db, "sensor_registry", col.name, col.decl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRegistryLocal reads the cached registry.
+func (ep *EdgeProcessor) loadRegistryLocal() error {
+	rows, err := ep.localDB.Query(`
+		SELECT sensor_id, depth_cm, probe_type, soil_texture, installed_at, moisture_offset_vwc, temp_offset_c,
+		       moisture_unit, raw_dry_counts, raw_dry_vwc, raw_wet_counts, raw_wet_vwc, temp_unit, channel_units
+		FROM sensor_registry WHERE field_id = ?
+	`, ep.config.FieldID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	registry := make(map[string]SensorInstall)
+	for rows.Next() {
+		var inst SensorInstall
+		var installed int64
+		var channelUnits string
+		if err := rows.Scan(&inst.SensorID, &inst.DepthCm, &inst.ProbeType, &inst.SoilTexture, &installed,
+			&inst.MoistureOffsetVWC, &inst.TempOffsetC, &inst.MoistureUnit, &inst.RawDryCounts, &inst.RawDryVWC,
+			&inst.RawWetCounts, &inst.RawWetVWC, &inst.TempUnit, &channelUnits); err != nil {
+			return err
+		}
+		if installed > 0 {
+			inst.InstalledAt = time.Unix(installed, 0).UTC()
+		}
+		if err := decodeChannelUnits(channelUnits, &inst); err != nil {
+			return err
+		}
+		registry[inst.SensorID] = inst
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	ep.stateMu.Lock()
+	ep.registry = registry
+	ep.stateMu.Unlock()
+	return nil
+}
+
+// fetchRegistryCloud reads the field's probes from the cloud registry.
+func (ep *EdgeProcessor) fetchRegistryCloud(db *sql.DB) (map[string]SensorInstall, error) {
+	rows, err := db.Query(`
+		SELECT sensor_id, COALESCE(install_depth_cm, 0), COALESCE(probe_type, ''), COALESCE(soil_texture, ''), installed_at,
+		       COALESCE(moisture_offset_vwc, 0), COALESCE(temp_offset_c, 0),
+		       COALESCE(moisture_unit, ''), COALESCE(raw_dry_counts, 0), COALESCE(raw_dry_vwc, 0),
+		       COALESCE(raw_wet_counts, 0), COALESCE(raw_wet_vwc, 0), COALESCE(temp_unit, ''),
+		       COALESCE(channel_units::text, '')
+		FROM sensor_registry
+		WHERE field_id = $1
+	`, ep.config.FieldID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registry := make(map[string]SensorInstall)
+	for rows.Next() {
+		var inst SensorInstall
+		var installed sql.NullTime
+		var channelUnits string
+		if err := rows.Scan(&inst.SensorID, &inst.DepthCm, &inst.ProbeType, &inst.SoilTexture, &installed,
+			&inst.MoistureOffsetVWC, &inst.TempOffsetC, &inst.MoistureUnit, &inst.RawDryCounts, &inst.RawDryVWC,
+			&inst.RawWetCounts, &inst.RawWetVWC, &inst.TempUnit, &channelUnits); err != nil {
+			return nil, err
+		}
+		if installed.Valid {
+			inst.InstalledAt = installed.Time
+		}
+		if err := decodeChannelUnits(channelUnits, &inst); err != nil {
+			return nil, err
+		}
+		registry[inst.SensorID] = inst
+	}
+	return registry, rows.Err()
+}
+
+// decodeChannelUnits fills inst.ChannelUnits from its stored JSON object.
+func decodeChannelUnits(raw string, inst *SensorInstall) error {
+	if raw == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(raw), &inst.ChannelUnits)
+}
+
+// storeRegistryLocal replaces the field's cached registry.
+func (ep *EdgeProcessor) storeRegistryLocal(registry map[string]SensorInstall) error {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM sensor_registry WHERE field_id = ?`, ep.config.FieldID); err != nil {
+		return err
+	}
+	for _, inst := range registry {
+		var installed int64
+		if !inst.InstalledAt.IsZero() {
+			installed = inst.InstalledAt.Unix()
+		}
+		var channelUnits string
+		if len(inst.ChannelUnits) > 0 {
+			b, err := json.Marshal(inst.ChannelUnits)
+			if err != nil {
+				return err
+			}
+			channelUnits = string(b)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO sensor_registry
+				(field_id, sensor_id, depth_cm, probe_type, soil_texture, installed_at, moisture_offset_vwc, temp_offset_c,
+				 moisture_unit, raw_dry_counts, raw_dry_vwc, raw_wet_counts, raw_wet_vwc, temp_unit, channel_units)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, ep.config.FieldID, inst.SensorID, inst.DepthCm, inst.ProbeType, inst.SoilTexture, installed,
+			inst.MoistureOffsetVWC, inst.TempOffsetC, inst.MoistureUnit, inst.RawDryCounts, inst.RawDryVWC,
+			inst.RawWetCounts, inst.RawWetVWC, inst.TempUnit, channelUnits); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// maybeSyncSensorRegistry refreshes the registry from the cloud at most
+// once per sensorRegistrySyncInterval, keeping the cache while offline.
+func (ep *EdgeProcessor) maybeSyncSensorRegistry() {
+	now := time.Now()
+	if now.Sub(ep.lastRegistrySync) < sensorRegistrySyncInterval {
+		return
+	}
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	ep.lastRegistrySync = now
+
+	registry, err := ep.fetchRegistryCloud(db)
+	if err != nil {
+		ep.cycleLog.Warn("Sensor registry sync failed, using the cached registry", "component", "sensor_registry", "error", err)
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	if err := ep.storeRegistryLocal(registry); err != nil {
+		ep.cycleLog.Warn("Failed to cache sensor registry", "component", "sensor_registry", "error", err)
+	}
+	ep.stateMu.Lock()
+	ep.registry = registry
+	ep.stateMu.Unlock()
+	ep.cycleLog.Info("Synced sensor registry", "component", "sensor_registry", "sensors", len(registry))
+}
+
+// normalizeReadings applies each registered probe's offsets, texture and
+// depth to the cycle's readings in place, and tags them with their class.
+func (ep *EdgeProcessor) normalizeReadings(sensors []SensorReading) {
+	installs := ep.SensorInstalls()
+	if len(installs) == 0 {
+		return
+	}
+	byID := make(map[string]SensorInstall, len(installs))
+	for _, inst := range installs {
+		byID[inst.SensorID] = inst
+	}
+	fieldSoil, ok := soilTrafficTable[ep.config.SoilTexture]
+	if !ok {
+		fieldSoil = defaultSoilTraffic
+	}
+
+	normalized := 0
+	for i := range sensors {
+		s := &sensors[i]
+		inst, ok := byID[s.SensorID]
+		if !ok {
+			continue
+		}
+		scale := 1.0
+		if soil, ok := soilTrafficTable[inst.SoilTexture]; ok {
+			scale = fieldSoil.FieldCapacity / soil.FieldCapacity
+		}
+		adjust := func(vwc float64) float64 { return math.Max((vwc+inst.MoistureOffsetVWC)*scale, 0) }
+
+		singleDepth := len(s.Profile) == 0 && s.MoistureSurface == s.MoistureRoot
+		s.MoistureSurface = adjust(s.MoistureSurface)
+		s.MoistureRoot = adjust(s.MoistureRoot)
+		s.TempSurface += inst.TempOffsetC
+		for j := range s.Profile {
+			d := &s.Profile[j]
+			if d.Moisture != nil {
+				d.Moisture = float64Ptr(adjust(*d.Moisture))
+			}
+			if d.Temperature != nil {
+				d.Temperature = float64Ptr(*d.Temperature + inst.TempOffsetC)
+			}
+		}
+
+		if singleDepth && inst.DepthCm > 0 {
+			s.Profile = []DepthReading{{
+				DepthCm:     inst.DepthCm,
+				Moisture:    float64Ptr(s.MoistureRoot),
+				Temperature: float64Ptr(s.TempSurface),
+			}}
+			if inst.DepthCm <= surfaceLayerMaxCm {
+				s.noRoot = true
+			} else {
+				s.noSurface = true
+			}
+		}
+		normalized++
+	}
+	ep.classifyReadings(sensors, byID)
+	ep.cycleLog.Debug("Normalized readings from the sensor registry", "component", "sensor_registry", "readings", normalized)
+}
+
+// fillMissingLayers gives a cell whose neighbors all sit in one layer the
+// same value for the other.
+func fillMissingLayers(cell *VirtualGridPoint, neighbors []sensorNeighbor) {
+	surface, root := false, false
+	for _, n := range neighbors {
+		surface = surface || !n.sensor.noSurface
+		root = root || !n.sensor.noRoot
+	}
+	switch {
+	case !surface && root:
+		cell.MoistureSurface = cell.MoistureRoot
+	case !root && surface:
+		cell.MoistureRoot = cell.MoistureSurface
+	}
+}
@@ -0,0 +1,601 @@
+// Serial Ingest - probes wired straight to the gateway
+// Polls sensors on the Pi's own serial ports and inserts their readings
+// into the local soil_sensor_readings table, the same way decoded LoRaWAN
+// uplinks are stored (lorawan_ingest.go). Each serial_ports entry is one
+// port with its protocol, line speed, poll interval and sensors:
+//
+//	sdi12       an SDI-12 USB adapter that passes commands through
+//	            (aM!, then aD0!, aD1!… until the measurement's n values
+//	            are in). A value's index is its position in that list.
+//	modbus_rtu  an RS-485 bus of Modbus RTU slaves. A value is one
+//	            holding (function 3) or input (function 4) register, or
+//	            a pair of them for 32-bit types, high word first.
+//
+// Each value maps to a reading field by name: moisture_surface,
+// moisture_root, temp_surface, battery_voltage, profile_moisture or
+// profile_temperature (with depth_cm), a registered channel such as
+// soil_ec, or any other name kept as an extra. The raw number is
+// converted as value × scale + offset, so a probe reporting percent VWC
+// uses scale 0.01.
+//
+// Every port polls on its own goroutine, sensors one after another since
+// they share the bus. The port is opened for each poll, so a USB adapter
+// that drops off and comes back is picked up at the next one. Line
+// settings are applied on Linux (serial_linux.go); elsewhere the port is
+// used as the system left it.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serial protocols
+const (
+	SerialSDI12     = "sdi12"
+	SerialModbusRTU = "modbus_rtu"
+)
+
+const (
+	defaultSerialBaud      = 9600
+	defaultSerialPollSec   = 900
+	defaultSerialTimeoutMs = 1000
+	defaultSDI12Command    = "M"
+	maxSDI12WaitSec        = 999
+)
+
+// serialBauds are the line speeds the drivers accept.
+var serialBauds = map[int]bool{1200: true, 2400: true, 4800: true, 9600: true, 19200: true, 38400: true, 57600: true, 115200: true}
+
+// SerialPort is one local serial port and the sensors on it.
+type SerialPort struct {
+	Device    string         `json:"device"`     // e.g. /dev/ttyUSB0
+	Protocol  string         `json:"protocol"`   // sdi12 | modbus_rtu
+	Baud      int            `json:"baud"`       // Line speed (default 9600)
+	Parity    string         `json:"parity"`     // none | even | odd (default none)
+	PollSec   int            `json:"poll_sec"`   // Poll interval (default 900)
+	TimeoutMs int            `json:"timeout_ms"` // Wait for each response (default 1000)
+	Sensors   []SerialSensor `json:"sensors"`
+}
+
+// SerialSensor is one probe on a serial port.
+type SerialSensor struct {
+	SensorID  string        `json:"sensor_id"`
+	FieldID   string        `json:"field_id"` // default: field_id
+	Latitude  float64       `json:"latitude"`
+	Longitude float64       `json:"longitude"`
+	Address   string        `json:"address"`  // SDI-12 address, 0-9, a-z or A-Z
+	Command   string        `json:"command"`  // SDI-12 measurement, M or M1-M9 (default M)
+	SlaveID   int           `json:"slave_id"` // Modbus slave, 1-247
+	Values    []SerialValue `json:"values"`
+}
+
+// SerialValue maps one reported number to a reading field.
+type SerialValue struct {
+	Name     string  `json:"name"`     // Reading field, channel or extra (see above)
+	DepthCm  float64 `json:"depth_cm"` // Depth of a profile_* value
+	Index    int     `json:"index"`    // SDI-12: position in the measurement's values, from 0
+	Register int     `json:"register"` // Modbus: register address, from 0
+	Function int     `json:"function"` // Modbus: 3 holding (default) or 4 input
+	Type     string  `json:"type"`     // Modbus: uint16 (default), int16, uint32, int32, float32
+	Scale    float64 `json:"scale"`    // Multiplier (default 1)
+	Offset   float64 `json:"offset"`   // Added after scaling
+}
+
+// SerialSensorStatus is per-sensor poll state exposed by the API.
+type SerialSensorStatus struct {
+	Device     string    `json:"device"`
+	Protocol   string    `json:"protocol"`
+	SensorID   string    `json:"sensor_id"`
+	Polls      int       `json:"polls"`
+	Stored     int       `json:"stored"`
+	Errors     int       `json:"errors"`
+	LastPollAt time.Time `json:"last_poll_at"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+var (
+	sdi12AddressPattern = regexp.MustCompile(`^[0-9a-zA-Z]$`)
+	sdi12CommandPattern = regexp.MustCompile(`^M[1-9]?$`)
+	sdi12ValuePattern   = regexp.MustCompile(`[+-][0-9]*\.?[0-9]+`)
+	serialDepthNames    = map[string]bool{"profile_moisture": true, "profile_temperature": true}
+	modbusValueRegs     = map[string]int{"": 1, "uint16": 1, "int16": 1, "uint32": 2, "int32": 2, "float32": 2}
+)
+
+// checkSerialPorts validates serial_ports.
+func checkSerialPorts(ports []SerialPort) error {
+	devices := make(map[string]bool, len(ports))
+	sensors := make(map[string]bool)
+	for i, p := range ports {
+		switch {
+		case p.Device == "":
+			return fmt.Errorf("[%d] needs device", i)
+		case devices[p.Device]:
+			return fmt.Errorf("[%d]: %s is listed twice", i, p.Device)
+		case p.Protocol != SerialSDI12 && p.Protocol != SerialModbusRTU:
+			return fmt.Errorf("[%d].protocol must be sdi12 or modbus_rtu (got %q)", i, p.Protocol)
+		case p.Baud != 0 && !serialBauds[p.Baud]:
+			return fmt.Errorf("[%d].baud %d is not a supported speed", i, p.Baud)
+		case p.Parity != "" && p.Parity != "none" && p.Parity != "even" && p.Parity != "odd":
+			return fmt.Errorf("[%d].parity must be none, even or odd (got %q)", i, p.Parity)
+		case p.PollSec < 0 || p.TimeoutMs < 0:
+			return fmt.Errorf("[%d]: poll_sec and timeout_ms must be >= 0", i)
+		case len(p.Sensors) == 0:
+			return fmt.Errorf("[%d] needs sensors", i)
+		}
+		devices[p.Device] = true
+		addresses := make(map[string]bool, len(p.Sensors))
+		for j, s := range p.Sensors {
+			at := fmt.Sprintf("[%d].sensors[%d]", i, j)
+			if s.SensorID == "" {
+				return fmt.Errorf("%s needs sensor_id", at)
+			}
+			if sensors[s.SensorID] {
+				return fmt.Errorf("%s: duplicate sensor_id %q", at, s.SensorID)
+			}
+			sensors[s.SensorID] = true
+			address := s.Address
+			if p.Protocol == SerialSDI12 {
+				if !sdi12AddressPattern.MatchString(s.Address) {
+					return fmt.Errorf("%s.address must be one of 0-9, a-z, A-Z (got %q)", at, s.Address)
+				}
+				if s.Command != "" && !sdi12CommandPattern.MatchString(s.Command) {
+					return fmt.Errorf("%s.command must be M or M1-M9 (got %q)", at, s.Command)
+				}
+			} else {
+				if s.SlaveID < 1 || s.SlaveID > 247 {
+					return fmt.Errorf("%s.slave_id must be in [1, 247] (got %d)", at, s.SlaveID)
+				}
+				address = strconv.Itoa(s.SlaveID)
+			}
+			if addresses[address] {
+				return fmt.Errorf("%s: address %s is used twice on %s", at, address, p.Device)
+			}
+			addresses[address] = true
+			if err := checkSerialValues(p.Protocol, s.Values); err != nil {
+				return fmt.Errorf("%s.values%v", at, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkSerialValues(protocol string, values []SerialValue) error {
+	moisture := false
+	for k, v := range values {
+		switch {
+		case !extraChannelNamePattern.MatchString(v.Name):
+			return fmt.Errorf("[%d]: name %q must be lower-case letters, digits and underscores", k, v.Name)
+		case serialDepthNames[v.Name] && v.DepthCm <= 0:
+			return fmt.Errorf("[%d]: %s needs depth_cm", k, v.Name)
+		case protocol == SerialSDI12 && v.Index < 0:
+			return fmt.Errorf("[%d].index must be >= 0", k)
+		case protocol == SerialModbusRTU && (v.Register < 0 || v.Register+modbusValueRegs[v.Type] > 65536):
+			return fmt.Errorf("[%d].register must be in [0, 65535] (got %d)", k, v.Register)
+		case protocol == SerialModbusRTU && v.Function != 0 && v.Function != 3 && v.Function != 4:
+			return fmt.Errorf("[%d].function must be 3 or 4 (got %d)", k, v.Function)
+		case protocol == SerialModbusRTU && modbusValueRegs[v.Type] == 0:
+			return fmt.Errorf("[%d].type must be uint16, int16, uint32, int32 or float32 (got %q)", k, v.Type)
+		}
+		if v.Name == "moisture_surface" || v.Name == "moisture_root" || v.Name == "profile_moisture" {
+			moisture = true
+		}
+	}
+	if !moisture {
+		return fmt.Errorf(" need a moisture value")
+	}
+	return nil
+}
+
+func (p SerialPort) baud() int {
+	if p.Baud <= 0 {
+		return defaultSerialBaud
+	}
+	return p.Baud
+}
+
+func (p SerialPort) timeout() time.Duration {
+	if p.TimeoutMs <= 0 {
+		return defaultSerialTimeoutMs * time.Millisecond
+	}
+	return time.Duration(p.TimeoutMs) * time.Millisecond
+}
+
+// SerialIngestor polls serial probes into the local cache.
+type SerialIngestor struct {
+	ports   []SerialPort
+	localDB *sql.DB
+	clock   *ReferenceClock
+
+	mu     sync.Mutex
+	status map[string]*SerialSensorStatus // by sensor_id
+	logger *slog.Logger
+}
+
+func NewSerialIngestor(config EdgeConfig, localDB *sql.DB, clock *ReferenceClock) *SerialIngestor {
+	in := &SerialIngestor{
+		localDB: localDB,
+		clock:   clock,
+		status:  make(map[string]*SerialSensorStatus),
+		logger:  slog.With("component", "serial"),
+	}
+	for _, p := range config.SerialPorts {
+		sensors := make([]SerialSensor, len(p.Sensors))
+		for i, s := range p.Sensors {
+			if s.FieldID == "" {
+				s.FieldID = config.FieldID
+			}
+			if s.Command == "" {
+				s.Command = defaultSDI12Command
+			}
+			sensors[i] = s
+			in.status[s.SensorID] = &SerialSensorStatus{Device: p.Device, Protocol: p.Protocol, SensorID: s.SensorID}
+		}
+		p.Sensors = sensors
+		in.ports = append(in.ports, p)
+	}
+	return in
+}
+
+// Start creates the local readings table and starts a poller per port.
+func (in *SerialIngestor) Start() error {
+	if err := initLocalReadingsSchema(in.localDB); err != nil {
+		return fmt.Errorf("failed to create local readings table: %v", err)
+	}
+	for _, p := range in.ports {
+		go in.pollLoop(p)
+	}
+	in.logger.Info("Serial ingest started", "ports", len(in.ports), "sensors", len(in.status))
+	return nil
+}
+
+func (in *SerialIngestor) pollLoop(p SerialPort) {
+	interval := time.Duration(p.PollSec) * time.Second
+	if interval <= 0 {
+		interval = defaultSerialPollSec * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		in.poll(p)
+		<-ticker.C
+	}
+}
+
+// poll reads every sensor on the port once.
+func (in *SerialIngestor) poll(p SerialPort) {
+	port, err := openSerialPort(p)
+	if err != nil {
+		in.logger.Warn("Serial port unavailable", "device", p.Device, "error", err)
+		for _, s := range p.Sensors {
+			in.record(s.SensorID, false, err)
+		}
+		return
+	}
+	defer port.Close()
+
+	line := &serialLine{port: port, reader: bufio.NewReader(port), timeout: p.timeout(), baud: p.baud()}
+	for _, s := range p.Sensors {
+		raw, err := line.read(p.Protocol, s)
+		stored := false
+		if err == nil {
+			var d DecodedUplink
+			if d, err = decodeSerialValues(s.Values, raw); err == nil {
+				probe := LoRaWANDevice{SensorID: s.SensorID, FieldID: s.FieldID, Latitude: s.Latitude, Longitude: s.Longitude}
+				stored, err = storeDecodedReading(in.localDB, in.clock, probe, readingTimestamp(in.clock.Now()), 0, d)
+			}
+		}
+		in.record(s.SensorID, stored, err)
+		if err != nil {
+			in.logger.Warn("Serial reading not stored", "device", p.Device, "sensor_id", s.SensorID, "error", err)
+		}
+	}
+}
+
+func (in *SerialIngestor) record(sensorID string, stored bool, err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	st := in.status[sensorID]
+	st.Polls++
+	st.LastPollAt = time.Now()
+	switch {
+	case err != nil:
+		st.Errors++
+		st.LastError = err.Error()
+	case stored:
+		st.Stored++
+		st.LastError = ""
+	}
+}
+
+// Status returns per-sensor poll counters.
+func (in *SerialIngestor) Status() []SerialSensorStatus {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := make([]SerialSensorStatus, 0, len(in.status))
+	for _, st := range in.status {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Device != out[j].Device {
+			return out[i].Device < out[j].Device
+		}
+		return out[i].SensorID < out[j].SensorID
+	})
+	return out
+}
+
+// decodeSerialValues converts a sensor's raw numbers, one per value, into
+// a reading.
+func decodeSerialValues(values []SerialValue, raw []float64) (DecodedUplink, error) {
+	var d DecodedUplink
+	builtin := map[string]*float64{
+		"moisture_surface": &d.MoistureSurface,
+		"moisture_root":    &d.MoistureRoot,
+		"temp_surface":     &d.TempSurface,
+		"battery_voltage":  &d.BatteryVoltage,
+	}
+	depths := make(map[float64]*DepthReading)
+	for i, v := range values {
+		x := raw[i]
+		if v.Scale != 0 {
+			x *= v.Scale
+		}
+		x += v.Offset
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return d, fmt.Errorf("%s is not a number", v.Name)
+		}
+		switch target, ok := builtin[v.Name]; {
+		case ok:
+			*target = x
+		case serialDepthNames[v.Name]:
+			r := depths[v.DepthCm]
+			if r == nil {
+				r = &DepthReading{DepthCm: v.DepthCm}
+				depths[v.DepthCm] = r
+			}
+			if v.Name == "profile_moisture" {
+				r.Moisture = &x
+			} else {
+				r.Temperature = &x
+			}
+		case isRegisteredChannel(v.Name):
+			if d.Channels == nil {
+				d.Channels = make(map[string]float64)
+			}
+			d.Channels[v.Name] = x
+		default:
+			if d.Extras == nil {
+				d.Extras = make(map[string]float64)
+			}
+			d.Extras[v.Name] = x
+		}
+	}
+	for _, r := range depths {
+		d.Profile = append(d.Profile, *r)
+	}
+	sort.Slice(d.Profile, func(i, j int) bool { return d.Profile[i].DepthCm < d.Profile[j].DepthCm })
+	return d, nil
+}
+
+// serialLine is an open port during one poll.
+type serialLine struct {
+	port    io.ReadWriter
+	reader  *bufio.Reader
+	timeout time.Duration
+	baud    int
+}
+
+// read returns the sensor's raw numbers in the order of its values.
+func (l *serialLine) read(protocol string, s SerialSensor) ([]float64, error) {
+	if protocol == SerialSDI12 {
+		return l.readSDI12(s)
+	}
+	raw := make([]float64, len(s.Values))
+	for i, v := range s.Values {
+		x, err := l.readModbusValue(byte(s.SlaveID), v)
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = x
+	}
+	return raw, nil
+}
+
+func (l *serialLine) deadline(d time.Duration) {
+	if dl, ok := l.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		dl.SetReadDeadline(time.Now().Add(d)) // not every tty driver supports it
+	}
+}
+
+// command sends an SDI-12 command and returns the sensor's reply, without
+// the address and line ending. Adapters that echo the command are fine.
+func (l *serialLine) command(cmd string, wait time.Duration) (string, error) {
+	if _, err := io.WriteString(l.port, cmd); err != nil {
+		return "", fmt.Errorf("failed to send %s: %v", cmd, err)
+	}
+	return l.reply(cmd, wait)
+}
+
+func (l *serialLine) reply(cmd string, wait time.Duration) (string, error) {
+	address := cmd[:1]
+	for {
+		l.deadline(wait)
+		text, err := l.reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("no reply to %s: %v", cmd, err)
+		}
+		text = strings.TrimRight(text, "\r\n")
+		if text == cmd || text == "" {
+			continue
+		}
+		if !strings.HasPrefix(text, address) {
+			return "", fmt.Errorf("reply %q to %s is from another address", text, cmd)
+		}
+		return text[1:], nil
+	}
+}
+
+// readSDI12 starts a measurement, waits for it and collects its values.
+func (l *serialLine) readSDI12(s SerialSensor) ([]float64, error) {
+	start := s.Address + s.Command + "!"
+	resp, err := l.command(start, l.timeout)
+	if err != nil {
+		return nil, err
+	}
+	// atttn: seconds until the values are ready, then how many
+	if len(resp) != 4 {
+		return nil, fmt.Errorf("unexpected reply %q to %s", resp, start)
+	}
+	wait, err1 := strconv.Atoi(resp[:3])
+	count, err2 := strconv.Atoi(resp[3:])
+	if err1 != nil || err2 != nil || wait > maxSDI12WaitSec {
+		return nil, fmt.Errorf("unexpected reply %q to %s", resp, start)
+	}
+	if wait > 0 {
+		// The sensor sends its address early if it finishes first; a
+		// timeout just means the full wait passed.
+		l.reply(start, time.Duration(wait)*time.Second+l.timeout)
+	}
+
+	values := make([]float64, 0, count)
+	for i := 0; len(values) < count && i <= 9; i++ {
+		data := s.Address + "D" + strconv.Itoa(i) + "!"
+		resp, err := l.command(data, l.timeout)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseSDI12Values(resp)
+		if err != nil {
+			return nil, fmt.Errorf("bad reply to %s: %v", data, err)
+		}
+		if len(parsed) == 0 {
+			break
+		}
+		values = append(values, parsed...)
+	}
+	raw := make([]float64, len(s.Values))
+	for i, v := range s.Values {
+		if v.Index >= len(values) {
+			return nil, fmt.Errorf("%s: measurement %s returned %d values, %s needs index %d", s.SensorID, s.Command, len(values), v.Name, v.Index)
+		}
+		raw[i] = values[v.Index]
+	}
+	return raw, nil
+}
+
+// parseSDI12Values splits a data reply such as +0.312-1.5+22.4 into its
+// signed values.
+func parseSDI12Values(resp string) ([]float64, error) {
+	fields := sdi12ValuePattern.FindAllString(resp, -1)
+	if strings.Join(fields, "") != resp {
+		return nil, fmt.Errorf("unexpected characters in %q", resp)
+	}
+	out := make([]float64, len(fields))
+	for i, field := range fields {
+		x, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = x
+	}
+	return out, nil
+}
+
+// readModbusValue reads one value's registers from a Modbus RTU slave.
+func (l *serialLine) readModbusValue(slave byte, v SerialValue) (float64, error) {
+	function := byte(0x03)
+	if v.Function == 4 {
+		function = 0x04
+	}
+	regs := modbusValueRegs[v.Type]
+
+	// Silent interval before the frame: 3.5 characters, 1.75 ms minimum
+	gap := time.Duration(float64(time.Second) * 38.5 / float64(l.baud))
+	if gap < 1750*time.Microsecond {
+		gap = 1750 * time.Microsecond
+	}
+	time.Sleep(gap)
+
+	req := make([]byte, 8)
+	req[0], req[1] = slave, function
+	binary.BigEndian.PutUint16(req[2:], uint16(v.Register))
+	binary.BigEndian.PutUint16(req[4:], uint16(regs))
+	binary.LittleEndian.PutUint16(req[6:], modbusCRC(req[:6]))
+	if _, err := l.port.Write(req); err != nil {
+		return 0, fmt.Errorf("failed to send Modbus request: %v", err)
+	}
+
+	l.deadline(l.timeout)
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(l.reader, head); err != nil {
+		return 0, fmt.Errorf("no Modbus reply from slave %d: %v", slave, err)
+	}
+	size := int(head[2])
+	if head[1] == function|0x80 {
+		size = 0 // exception: the third byte is the code
+	}
+	rest := make([]byte, size+2)
+	if _, err := io.ReadFull(l.reader, rest); err != nil {
+		return 0, fmt.Errorf("failed to read Modbus reply from slave %d: %v", slave, err)
+	}
+	frame := append(head, rest...)
+	if modbusCRC(frame[:len(frame)-2]) != binary.LittleEndian.Uint16(frame[len(frame)-2:]) {
+		return 0, fmt.Errorf("bad CRC in Modbus reply from slave %d", slave)
+	}
+	if head[0] != slave {
+		return 0, fmt.Errorf("Modbus reply from slave %d, expected %d", head[0], slave)
+	}
+	if head[1] == function|0x80 {
+		return 0, fmt.Errorf("Modbus exception %d reading register %d of slave %d", head[2], v.Register, slave)
+	}
+	if head[1] != function || size != 2*regs {
+		return 0, fmt.Errorf("unexpected Modbus response (function %d, %d bytes)", head[1], size)
+	}
+	return modbusRegisterValue(v.Type, frame[3:3+size]), nil
+}
+
+// modbusRegisterValue decodes big-endian register data, high word first.
+func modbusRegisterValue(kind string, data []byte) float64 {
+	switch kind {
+	case "int16":
+		return float64(int16(binary.BigEndian.Uint16(data)))
+	case "uint32":
+		return float64(binary.BigEndian.Uint32(data))
+	case "int32":
+		return float64(int32(binary.BigEndian.Uint32(data)))
+	case "float32":
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	default:
+		return float64(binary.BigEndian.Uint16(data))
+	}
+}
+
+// modbusCRC is the Modbus RTU CRC-16 (polynomial 0xA001, initial 0xFFFF),
+// sent low byte first.
+func modbusCRC(frame []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range frame {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
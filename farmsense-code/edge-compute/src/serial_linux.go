@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Termios bits and requests the syscall package leaves out
+const (
+	termiosCBAUD   = 0x100f
+	termiosCRTSCTS = 0x80000000
+	ioctlTCFLSH    = 0x540B
+	tcIOFlush      = 2
+)
+
+var termiosSpeeds = map[int]uint32{
+	1200: syscall.B1200, 2400: syscall.B2400, 4800: syscall.B4800, 9600: syscall.B9600,
+	19200: syscall.B19200, 38400: syscall.B38400, 57600: syscall.B57600, 115200: syscall.B115200,
+}
+
+// openSerialPort opens the device raw at the port's speed and parity, 8
+// data bits and 1 stop bit, discarding anything already buffered.
+func openSerialPort(p SerialPort) (*os.File, error) {
+	f, err := os.OpenFile(p.Device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var ioctlErr error
+	if err := conn.Control(func(fd uintptr) { ioctlErr = configureTermios(fd, p) }); err != nil {
+		ioctlErr = err
+	}
+	if ioctlErr != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to configure %s: %v", p.Device, ioctlErr)
+	}
+	return f, nil
+}
+
+func configureTermios(fd uintptr, p SerialPort) error {
+	var t syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+	speed := termiosSpeeds[p.baud()]
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.PARODD | syscall.CSTOPB | termiosCRTSCTS | termiosCBAUD
+	t.Cflag |= syscall.CS8 | syscall.CLOCAL | syscall.CREAD | speed
+	switch p.Parity {
+	case "even":
+		t.Cflag |= syscall.PARENB
+	case "odd":
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+	}
+	t.Ispeed, t.Ospeed = speed, speed
+	t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlTCFLSH, tcIOFlush); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// openSerialPort opens the device with the system's line settings; set
+// speed and parity beforehand (stty, mode) to match the port's config.
+func openSerialPort(p SerialPort) (*os.File, error) {
+	return os.OpenFile(p.Device, os.O_RDWR, 0)
+}
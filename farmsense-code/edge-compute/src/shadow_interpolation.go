@@ -0,0 +1,488 @@
+// Shadow Interpolation - a second algorithm run alongside the live one
+// Switching a field's interpolator on faith risks a season of irrigation
+// decisions. With shadow_interpolator set, every geographic cycle is
+// interpolated a second time, from the same probes, with:
+//
+//	kriging           universal kriging with a linear drift: an exponential
+//	                  covariance with practical range kriging_range_m
+//	                  (default search_radius_m) and kriging_nugget as a
+//	                  fraction of the sill (default 0, exact at probes),
+//	                  solved over every probe in its dual form, which is
+//	                  the RBF system (rbf.go) with the covariance as kernel
+//	idw               IDW at shadow_idw_power (default idw_power), never RBF
+//	rbf_<basis>       an RBF surface (thin_plate, multiquadric, gaussian)
+//	                  at any probe count, not only below rbf_max_sensors
+//
+// The shadow gets the live cycle's probes, sensor classes, microclimate
+// offsets and extrapolation guard, so the two grids differ only by
+// algorithm. Its cells (moisture, temperature and confidence) are tagged
+// computation_mode edge_20m_shadow_<algorithm> and go to the local
+// shadow_grid table, never
+// to grid_history, the API's latest grid, MQTT, zone stats or anything
+// that decides irrigation. Each cycle also records, per variable, the
+// leave-one-out RMSE of both algorithms and how far the shadow cells are
+// from the live ones. Cells are kept shadow_retention_days locally
+// (default 35); cycles are uploaded by a watermark in sync_state to the
+// cloud's virtual_sensor_grid_shadow and interpolation_shadow_comparisons
+// (migration 037). GET /grid/shadow lists the comparisons with a roll-up
+// per variable over the period.
+//
+// The shadow costs a second interpolation and cross-validation per cycle.
+// Logical grids have no shadow.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Shadow interpolators
+const (
+	ShadowKriging = "kriging"
+	ShadowIDW     = "idw"
+)
+
+const (
+	shadowModePrefix         = "edge_20m_shadow_"
+	defaultShadowRetention   = 35
+	shadowSyncCycles         = 12
+	defaultShadowLookback    = 30 * 24 * time.Hour
+	krigingPracticalRangeExp = 3.0 // exp(−3) ≈ 5% of the sill left at the range
+)
+
+// ShadowComparison is one cycle's live-vs-shadow result for a variable.
+type ShadowComparison struct {
+	CycleTime   time.Time `json:"cycle_time"`
+	Algorithm   string    `json:"algorithm"`
+	Variable    string    `json:"variable"`
+	LiveRMSE    *float64  `json:"live_rmse,omitempty"` // leave-one-out
+	ShadowRMSE  *float64  `json:"shadow_rmse,omitempty"`
+	MeanAbsDiff *float64  `json:"mean_abs_diff,omitempty"` // shadow vs live cells
+	MaxAbsDiff  *float64  `json:"max_abs_diff,omitempty"`
+	Cells       int       `json:"cells"` // cells both grids computed
+}
+
+// ShadowSummary rolls a variable's comparisons up over a period.
+type ShadowSummary struct {
+	Algorithm      string  `json:"algorithm"`
+	Variable       string  `json:"variable"`
+	Cycles         int     `json:"cycles"`
+	LiveRMSE       float64 `json:"live_rmse"`
+	ShadowRMSE     float64 `json:"shadow_rmse"`
+	ShadowBetter   int     `json:"shadow_better_cycles"` // cycles where the shadow's RMSE was lower
+	MeanAbsDiff    float64 `json:"mean_abs_diff"`
+	rmseCycles     int
+	diffCycles     int
+	liveSq, shadSq float64
+}
+
+func initShadowSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS shadow_grid (
+			field_id         TEXT    NOT NULL,
+			timestamp        INTEGER NOT NULL,
+			grid_id          TEXT    NOT NULL,
+			computation_mode TEXT    NOT NULL,
+			latitude         REAL    NOT NULL,
+			longitude        REAL    NOT NULL,
+			moisture_surface REAL,
+			moisture_root    REAL,
+			temperature      REAL,
+			confidence       REAL,
+			PRIMARY KEY (field_id, timestamp, grid_id, computation_mode)
+		);
+		CREATE TABLE IF NOT EXISTS shadow_comparisons (
+			field_id      TEXT    NOT NULL,
+			timestamp     INTEGER NOT NULL,
+			algorithm     TEXT    NOT NULL,
+			variable      TEXT    NOT NULL,
+			live_rmse     REAL,
+			shadow_rmse   REAL,
+			mean_abs_diff REAL,
+			max_abs_diff  REAL,
+			cells         INTEGER NOT NULL,
+			PRIMARY KEY (field_id, timestamp, algorithm, variable)
+		);
+	`)
+	return err
+}
+
+// shadowBasis is the RBF basis a shadow algorithm fits, "" for IDW.
+func shadowBasis(algorithm string) string {
+	switch algorithm {
+	case ShadowKriging:
+		return ShadowKriging
+	case ShadowIDW:
+		return ""
+	}
+	return strings.TrimPrefix(algorithm, "rbf_")
+}
+
+// validShadowInterpolator reports whether name is a shadow algorithm.
+func validShadowInterpolator(name string) bool {
+	switch name {
+	case ShadowKriging, ShadowIDW, "rbf_" + RBFThinPlate, "rbf_" + RBFMultiquadric, "rbf_" + RBFGaussian:
+		return true
+	}
+	return false
+}
+
+// krigingRange is the covariance's practical range in metres.
+func (c EdgeConfig) krigingRange() float64 {
+	if c.KrigingRangeM > 0 {
+		return c.KrigingRangeM
+	}
+	return c.SearchRadius
+}
+
+// runShadow interpolates the cycle with the shadow algorithm and records
+// it against live, the cycle's interpolated and guarded cells.
+func (ep *EdgeProcessor) runShadow(sensors []SensorReading, live []VirtualGridPoint, at time.Time) {
+	algorithm := ep.config.ShadowInterpolator
+	if algorithm == "" || ep.config.LogicalGrid != nil {
+		return
+	}
+	liveAcc := ep.crossValidate(sensors, at)
+
+	liveRBF, liveBias, liveMicro := ep.cycleRBF, ep.cycleClassBias, ep.cycleMicro
+	ep.shadowMode = algorithm
+	defer func() {
+		ep.shadowMode = ""
+		ep.cycleRBF, ep.cycleClassBias, ep.cycleMicro = liveRBF, liveBias, liveMicro
+	}()
+	shadow := ep.interpolateField(sensors)
+	shadow = ep.applyExtrapolationGuard(shadow, sensors)
+	shadowAcc := ep.crossValidate(sensors, at)
+	mode := shadowModePrefix + algorithm
+	for i := range shadow {
+		shadow[i].ComputationMode = mode
+	}
+
+	comparisons := compareShadow(algorithm, at, live, shadow, liveAcc, shadowAcc)
+	if err := ep.storeShadow(at, shadow, comparisons); err != nil {
+		ep.cycleLog.Warn("Shadow grid not stored", "component", "shadow", "algorithm", algorithm, "error", err)
+		return
+	}
+	for _, c := range comparisons {
+		if c.LiveRMSE != nil && c.ShadowRMSE != nil && c.Variable == VarMoistureRoot {
+			ep.cycleLog.Info("Shadow interpolation compared", "component", "shadow", "algorithm", algorithm,
+				"cells", len(shadow), "live_rmse", *c.LiveRMSE, "shadow_rmse", *c.ShadowRMSE)
+		}
+	}
+}
+
+// shadowCellValue reads a variable from a cell.
+func shadowCellValue(p VirtualGridPoint, name string) (float64, bool) {
+	switch name {
+	case VarMoistureSurface:
+		return p.MoistureSurface, true
+	case VarMoistureRoot:
+		return p.MoistureRoot, true
+	case VarTemperature:
+		return p.Temperature, true
+	}
+	v, ok := p.Variables[name]
+	return v, ok
+}
+
+// compareShadow sets each variable's RMSE pair and cell differences.
+func compareShadow(algorithm string, at time.Time, live, shadow []VirtualGridPoint, liveAcc, shadowAcc *CycleAccuracy) []ShadowComparison {
+	rmse := func(acc *CycleAccuracy, name string) *float64 {
+		if acc == nil {
+			return nil
+		}
+		for _, v := range acc.Variables {
+			if v.Variable == name && v.N > 0 {
+				x := v.RMSE
+				return &x
+			}
+		}
+		return nil
+	}
+	byID := make(map[string]VirtualGridPoint, len(live))
+	for _, p := range live {
+		byID[p.GridID] = p
+	}
+	out := make([]ShadowComparison, 0, len(sensorVariables))
+	for _, v := range sensorVariables {
+		c := ShadowComparison{CycleTime: at, Algorithm: algorithm, Variable: v.Name,
+			LiveRMSE: rmse(liveAcc, v.Name), ShadowRMSE: rmse(shadowAcc, v.Name)}
+		sum, worst := 0.0, 0.0
+		for _, s := range shadow {
+			l, ok := byID[s.GridID]
+			if !ok {
+				continue
+			}
+			a, okA := shadowCellValue(l, v.Name)
+			b, okB := shadowCellValue(s, v.Name)
+			if !okA || !okB {
+				continue
+			}
+			d := math.Abs(b - a)
+			sum += d
+			worst = math.Max(worst, d)
+			c.Cells++
+		}
+		if c.Cells > 0 {
+			mean := sum / float64(c.Cells)
+			c.MeanAbsDiff, c.MaxAbsDiff = &mean, &worst
+		} else if c.LiveRMSE == nil && c.ShadowRMSE == nil {
+			continue // no probe reports it
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// storeShadow writes the shadow cycle and prunes expired cells.
+func (ep *EdgeProcessor) storeShadow(at time.Time, cells []VirtualGridPoint, comparisons []ShadowComparison) error {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO shadow_grid (field_id, timestamp, grid_id, computation_mode, latitude, longitude,
+			moisture_surface, moisture_root, temperature, confidence)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range cells {
+		if _, err := stmt.Exec(ep.config.FieldID, at.Unix(), p.GridID, p.ComputationMode, p.Latitude, p.Longitude,
+			p.MoistureSurface, p.MoistureRoot, p.Temperature, p.Confidence); err != nil {
+			return fmt.Errorf("failed to store shadow cell: %v", err)
+		}
+	}
+	for _, c := range comparisons {
+		if _, err := tx.Exec(`
+			INSERT OR REPLACE INTO shadow_comparisons (field_id, timestamp, algorithm, variable, live_rmse, shadow_rmse,
+				mean_abs_diff, max_abs_diff, cells)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, ep.config.FieldID, at.Unix(), c.Algorithm, c.Variable, c.LiveRMSE, c.ShadowRMSE,
+			c.MeanAbsDiff, c.MaxAbsDiff, c.Cells); err != nil {
+			return fmt.Errorf("failed to store shadow comparison: %v", err)
+		}
+	}
+	days := ep.config.ShadowRetentionDays
+	if days <= 0 {
+		days = defaultShadowRetention
+	}
+	cutoff := at.AddDate(0, 0, -days).Unix()
+	for _, table := range []string{"shadow_grid", "shadow_comparisons"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE field_id = ? AND timestamp < ?`, ep.config.FieldID, cutoff); err != nil {
+			return fmt.Errorf("failed to prune %s: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ShadowComparisons returns the field's comparisons in [from, to] (the
+// last 30 days by default) and their roll-up per algorithm and variable.
+func (ep *EdgeProcessor) ShadowComparisons(from, to time.Time) ([]ShadowComparison, []ShadowSummary, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultShadowLookback)
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT timestamp, algorithm, variable, live_rmse, shadow_rmse, mean_abs_diff, max_abs_diff, cells
+		FROM shadow_comparisons WHERE field_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp, algorithm, variable
+	`, ep.config.FieldID, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query shadow comparisons: %v", err)
+	}
+	defer rows.Close()
+	comparisons, err := scanShadowComparisons(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	return comparisons, summarizeShadow(comparisons), nil
+}
+
+func scanShadowComparisons(rows *sql.Rows) ([]ShadowComparison, error) {
+	out := make([]ShadowComparison, 0)
+	for rows.Next() {
+		var c ShadowComparison
+		var at int64
+		if err := rows.Scan(&at, &c.Algorithm, &c.Variable, &c.LiveRMSE, &c.ShadowRMSE,
+			&c.MeanAbsDiff, &c.MaxAbsDiff, &c.Cells); err != nil {
+			return nil, fmt.Errorf("failed to read shadow comparison: %v", err)
+		}
+		c.CycleTime = time.Unix(at, 0).UTC()
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// summarizeShadow rolls comparisons up per algorithm and variable; RMSEs
+// are pooled over the cycles where both algorithms have one.
+func summarizeShadow(comparisons []ShadowComparison) []ShadowSummary {
+	index := make(map[string]int)
+	var out []ShadowSummary
+	for _, c := range comparisons {
+		key := c.Algorithm + "\x00" + c.Variable
+		i, ok := index[key]
+		if !ok {
+			i = len(out)
+			index[key] = i
+			out = append(out, ShadowSummary{Algorithm: c.Algorithm, Variable: c.Variable})
+		}
+		s := &out[i]
+		s.Cycles++
+		if c.LiveRMSE != nil && c.ShadowRMSE != nil {
+			s.rmseCycles++
+			s.liveSq += *c.LiveRMSE * *c.LiveRMSE
+			s.shadSq += *c.ShadowRMSE * *c.ShadowRMSE
+			if *c.ShadowRMSE < *c.LiveRMSE {
+				s.ShadowBetter++
+			}
+		}
+		if c.MeanAbsDiff != nil {
+			s.diffCycles++
+			s.MeanAbsDiff += *c.MeanAbsDiff
+		}
+	}
+	for i := range out {
+		s := &out[i]
+		if s.rmseCycles > 0 {
+			s.LiveRMSE = math.Sqrt(s.liveSq / float64(s.rmseCycles))
+			s.ShadowRMSE = math.Sqrt(s.shadSq / float64(s.rmseCycles))
+		}
+		if s.diffCycles > 0 {
+			s.MeanAbsDiff /= float64(s.diffCycles)
+		}
+	}
+	return out
+}
+
+func (ep *EdgeProcessor) shadowWatermarkKey() string {
+	return "shadow_grid:" + ep.config.FieldID
+}
+
+// syncShadow uploads the shadow cycles past the watermark, a few at a
+// time, each cycle's cells and comparisons in one transaction.
+func (ep *EdgeProcessor) syncShadow() {
+	db := ep.cloud.DB()
+	if ep.config.ShadowInterpolator == "" || !ep.isOnline.Load() || db == nil {
+		return
+	}
+	var mark int64
+	err := ep.localDB.QueryRow(`SELECT value FROM sync_state WHERE name = ?`, ep.shadowWatermarkKey()).Scan(&mark)
+	if err != nil && err != sql.ErrNoRows {
+		ep.cycleLog.Error("Failed to read shadow watermark", "component", "shadow", "error", err)
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT DISTINCT timestamp FROM shadow_comparisons WHERE field_id = ? AND timestamp > ? ORDER BY timestamp LIMIT ?
+	`, ep.config.FieldID, mark, shadowSyncCycles)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read shadow cycles", "component", "shadow", "error", err)
+		return
+	}
+	var cycles []int64
+	for rows.Next() {
+		var at int64
+		if err := rows.Scan(&at); err != nil {
+			rows.Close()
+			ep.cycleLog.Error("Failed to read shadow cycles", "component", "shadow", "error", err)
+			return
+		}
+		cycles = append(cycles, at)
+	}
+	rows.Close()
+
+	for _, at := range cycles {
+		if err := ep.uploadShadowCycle(db, at); err != nil {
+			ep.cycleLog.Warn("Shadow upload failed, retrying next sync", "component", "shadow", "error", err)
+			return
+		}
+		if _, err := ep.localDB.Exec(`INSERT OR REPLACE INTO sync_state (name, value) VALUES (?, ?)`,
+			ep.shadowWatermarkKey(), at); err != nil {
+			ep.cycleLog.Warn("Failed to advance shadow watermark", "component", "shadow", "error", err)
+			return
+		}
+	}
+}
+
+// uploadShadowCycle copies one shadow cycle to the cloud.
+func (ep *EdgeProcessor) uploadShadowCycle(db *sql.DB, at int64) error {
+	rows, err := ep.localDB.Query(`
+		SELECT grid_id, computation_mode, latitude, longitude, moisture_surface, moisture_root, temperature, confidence
+		FROM shadow_grid WHERE field_id = ? AND timestamp = ?
+	`, ep.config.FieldID, at)
+	if err != nil {
+		return fmt.Errorf("failed to read shadow cells: %v", err)
+	}
+	type cell struct {
+		gridID, mode                    string
+		lat, lon                        float64
+		surface, root, temp, confidence sql.NullFloat64
+	}
+	var cells []cell
+	for rows.Next() {
+		var c cell
+		if err := rows.Scan(&c.gridID, &c.mode, &c.lat, &c.lon, &c.surface, &c.root, &c.temp, &c.confidence); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read shadow cells: %v", err)
+		}
+		cells = append(cells, c)
+	}
+	rows.Close()
+	rows, err = ep.localDB.Query(`
+		SELECT timestamp, algorithm, variable, live_rmse, shadow_rmse, mean_abs_diff, max_abs_diff, cells
+		FROM shadow_comparisons WHERE field_id = ? AND timestamp = ?
+	`, ep.config.FieldID, at)
+	if err != nil {
+		return fmt.Errorf("failed to read shadow comparisons: %v", err)
+	}
+	comparisons, err := scanShadowComparisons(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	cycleAt := time.Unix(at, 0).UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range cells {
+		if _, err := tx.Exec(`
+			INSERT INTO virtual_sensor_grid_shadow
+				(field_id, grid_id, timestamp, computation_mode, edge_device_id, location,
+				 moisture_surface, moisture_root, temperature, confidence)
+			VALUES ($1, $2, $3, $4, $5, ST_SetSRID(ST_MakePoint($6, $7), 4326), $8, $9, $10, $11)
+			ON CONFLICT (field_id, grid_id, timestamp, computation_mode) DO NOTHING
+		`, ep.config.FieldID, c.gridID, cycleAt, c.mode, ep.deviceID, c.lon, c.lat,
+			c.surface, c.root, c.temp, c.confidence); err != nil {
+			return fmt.Errorf("failed to upload shadow cell: %v", err)
+		}
+	}
+	for _, c := range comparisons {
+		if _, err := tx.Exec(`
+			INSERT INTO interpolation_shadow_comparisons
+				(field_id, cycle_time, algorithm, variable, edge_device_id, live_rmse, shadow_rmse, mean_abs_diff, max_abs_diff, cells)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (field_id, cycle_time, algorithm, variable) DO NOTHING
+		`, ep.config.FieldID, cycleAt, c.Algorithm, c.Variable, ep.deviceID, c.LiveRMSE, c.ShadowRMSE,
+			c.MeanAbsDiff, c.MaxAbsDiff, c.Cells); err != nil {
+			return fmt.Errorf("failed to upload shadow comparison: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Shapefile - minimal ESRI shapefile writer for prescription zones
+// Writes polygon (type 5) .shp/.shx, a dBASE III .dbf attribute table and
+// a WGS84 .prj. Each prescription zone is one record whose parts are its
+// cell squares, wound clockwise as the format requires for outer rings.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	shpFileCode    = 9994
+	shpVersion     = 1000
+	shpTypePolygon = 5
+	shpHeaderBytes = 100
+)
+
+const wgs84PRJ = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+// dbfField is a dBASE column definition.
+type dbfField struct {
+	name     string
+	kind     byte // 'N' numeric, 'C' character
+	width    int
+	decimals int
+}
+
+var prescriptionDBFFields = []dbfField{
+	{"ZONE_ID", 'N', 6, 0},
+	{"RATE_MM", 'N', 8, 2},
+	{"CELLS", 'N', 8, 0},
+	{"AREA_HA", 'N', 12, 3},
+}
+
+// writeShapefile adds base.shp/.shx/.dbf/.prj for rx to the archive.
+func writeShapefile(zw *zip.Writer, base string, rx *Prescription) error {
+	var shp, shx bytes.Buffer
+	bbox := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	records := make([][]byte, 0, len(rx.Zones))
+
+	for _, zone := range rx.Zones {
+		rec, zb := polygonRecord(zone.Cells)
+		records = append(records, rec)
+		bbox[0], bbox[1] = math.Min(bbox[0], zb[0]), math.Min(bbox[1], zb[1])
+		bbox[2], bbox[3] = math.Max(bbox[2], zb[2]), math.Max(bbox[3], zb[3])
+	}
+	if len(records) == 0 {
+		bbox = [4]float64{}
+	}
+
+	shpLen := shpHeaderBytes
+	for _, rec := range records {
+		shpLen += 8 + len(rec)
+	}
+	writeShpHeader(&shp, shpLen, bbox)
+	writeShpHeader(&shx, shpHeaderBytes+8*len(records), bbox)
+
+	offset := shpHeaderBytes
+	for i, rec := range records {
+		// Record header is big-endian, lengths and offsets in 16-bit words
+		binary.Write(&shp, binary.BigEndian, int32(i+1))
+		binary.Write(&shp, binary.BigEndian, int32(len(rec)/2))
+		shp.Write(rec)
+		binary.Write(&shx, binary.BigEndian, int32(offset/2))
+		binary.Write(&shx, binary.BigEndian, int32(len(rec)/2))
+		offset += 8 + len(rec)
+	}
+
+	rows := make([][]string, 0, len(rx.Zones))
+	for _, zone := range rx.Zones {
+		rows = append(rows, []string{
+			fmt.Sprintf("%d", zone.ZoneID),
+			fmt.Sprintf("%.2f", zone.RateMM),
+			fmt.Sprintf("%d", len(zone.Cells)),
+			fmt.Sprintf("%.3f", zone.AreaHa),
+		})
+	}
+
+	files := []struct {
+		ext  string
+		data []byte
+	}{
+		{".shp", shp.Bytes()},
+		{".shx", shx.Bytes()},
+		{".dbf", dbfTable(prescriptionDBFFields, rows, rx.CreatedAt)},
+		{".prj", []byte(wgs84PRJ)},
+	}
+	for _, f := range files {
+		w, err := zw.Create(base + f.ext)
+		if err != nil {
+			return fmt.Errorf("failed to add %s%s: %v", base, f.ext, err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return fmt.Errorf("failed to write %s%s: %v", base, f.ext, err)
+		}
+	}
+	return nil
+}
+
+func writeShpHeader(w io.Writer, fileBytes int, bbox [4]float64) {
+	binary.Write(w, binary.BigEndian, int32(shpFileCode))
+	binary.Write(w, binary.BigEndian, [5]int32{})
+	binary.Write(w, binary.BigEndian, int32(fileBytes/2))
+	binary.Write(w, binary.LittleEndian, int32(shpVersion))
+	binary.Write(w, binary.LittleEndian, int32(shpTypePolygon))
+	binary.Write(w, binary.LittleEndian, bbox)
+	binary.Write(w, binary.LittleEndian, [4]float64{}) // Z and M ranges
+}
+
+// polygonRecord encodes cells as one multi-part polygon record.
+func polygonRecord(cells []cellBounds) ([]byte, [4]float64) {
+	bbox := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, c := range cells {
+		bbox[0], bbox[1] = math.Min(bbox[0], c[0]), math.Min(bbox[1], c[1])
+		bbox[2], bbox[3] = math.Max(bbox[2], c[2]), math.Max(bbox[3], c[3])
+	}
+
+	var rec bytes.Buffer
+	binary.Write(&rec, binary.LittleEndian, int32(shpTypePolygon))
+	binary.Write(&rec, binary.LittleEndian, bbox)
+	binary.Write(&rec, binary.LittleEndian, int32(len(cells)))
+	binary.Write(&rec, binary.LittleEndian, int32(len(cells)*5))
+	for i := range cells {
+		binary.Write(&rec, binary.LittleEndian, int32(i*5))
+	}
+	for _, c := range cells {
+		// Clockwise: SW, NW, NE, SE, back to SW
+		binary.Write(&rec, binary.LittleEndian, [10]float64{
+			c[0], c[1], c[0], c[3], c[2], c[3], c[2], c[1], c[0], c[1],
+		})
+	}
+	return rec.Bytes(), bbox
+}
+
+// dbfTable encodes rows as a dBASE III table.
+func dbfTable(fields []dbfField, rows [][]string, modified time.Time) []byte {
+	recordLen := 1 // deletion flag
+	for _, f := range fields {
+		recordLen += f.width
+	}
+	headerLen := 32 + 32*len(fields) + 1
+
+	var b bytes.Buffer
+	b.WriteByte(0x03)
+	b.Write([]byte{byte(modified.Year() - 1900), byte(modified.Month()), byte(modified.Day())})
+	binary.Write(&b, binary.LittleEndian, uint32(len(rows)))
+	binary.Write(&b, binary.LittleEndian, uint16(headerLen))
+	binary.Write(&b, binary.LittleEndian, uint16(recordLen))
+	b.Write(make([]byte, 20))
+
+	for _, f := range fields {
+		name := make([]byte, 11)
+		copy(name, f.name)
+		b.Write(name)
+		b.WriteByte(f.kind)
+		b.Write(make([]byte, 4))
+		b.WriteByte(byte(f.width))
+		b.WriteByte(byte(f.decimals))
+		b.Write(make([]byte, 14))
+	}
+	b.WriteByte(0x0D)
+
+	for _, row := range rows {
+		b.WriteByte(' ')
+		for i, f := range fields {
+			v := row[i]
+			if len(v) > f.width {
+				v = v[:f.width]
+			}
+			if f.kind == 'N' {
+				fmt.Fprintf(&b, "%*s", f.width, v)
+			} else {
+				fmt.Fprintf(&b, "%-*s", f.width, v)
+			}
+		}
+	}
+	b.WriteByte(0x1A)
+	return b.Bytes()
+}
@@ -0,0 +1,290 @@
+// Simulation - synthetic field for development without a farm
+// run -simulate replaces the probes and the cloud with a generator, so the
+// whole pipeline (registry normalization, interpolation, crop and rain
+// models, zones, trends, exports, MQTT) runs on a laptop. Every
+// sample_interval_sec each simulated probe writes a reading into the local
+// cache, exactly where LoRaWAN ingest would put it:
+//
+//	root VWC    = base_vwc + gradient across the field - drydown since the
+//	              last irrigation (refilled every irrigation_interval_hours)
+//	surface VWC = root VWC - 0.03, drying twice as fast
+//	temperature = temp_c with a ±6 °C day/night swing
+//
+// plus Gaussian noise_vwc on every moisture value, and each reading lost
+// with probability dropout_rate. Probes are laid out as a grid, uniformly
+// at random or along a diagonal transect (seeded, so a layout repeats).
+//
+// Nothing leaves the machine: the cloud link isn't started, fleet, OTA,
+// remote config and LoRaWAN ingest are off, and everything is written under
+// output_dir: the local cache (edge_cache.db, so the export subcommand
+// works on it), latest.geojson after each cycle, and grid.jsonl with each
+// cycle's upload batch as it would have been sent. The config is read once;
+// config/simulation.json is a starting point.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSimSensors       = 12
+	defaultSimBaseVWC       = 0.30
+	defaultSimNoiseVWC      = 0.01
+	defaultSimDrydownPerDay = 0.02
+	defaultSimTempC         = 20.0
+	defaultSimSampleSec     = 300
+	defaultSimOutputDir     = "simulation"
+	simSurfaceOffsetVWC     = 0.03
+	simMinVWC               = 0.05
+	simDiurnalSwingC        = 6.0
+)
+
+// Simulated probe layouts
+const (
+	SimLayoutGrid     = "grid"
+	SimLayoutRandom   = "random"
+	SimLayoutTransect = "transect"
+)
+
+// SimulationConfig shapes the synthetic field for run -simulate.
+type SimulationConfig struct {
+	Sensors                 int     `json:"sensors"`                   // Simulated probes (default 12)
+	Layout                  string  `json:"layout"`                    // grid | random | transect (default grid)
+	BaseVWC                 float64 `json:"base_vwc"`                  // Root-zone moisture at the field center after irrigation (default 0.30)
+	GradientVWC             float64 `json:"gradient_vwc"`              // Moisture difference from one edge of the field to the other (0 = uniform)
+	GradientBearingDeg      float64 `json:"gradient_bearing_deg"`      // Direction moisture increases toward, clockwise from north
+	DrydownPerDay           float64 `json:"drydown_vwc_per_day"`       // Root-zone loss per day between irrigations (default 0.02)
+	IrrigationIntervalHours float64 `json:"irrigation_interval_hours"` // Refill to base_vwc this often (0 = never)
+	NoiseVWC                float64 `json:"noise_vwc"`                 // Standard deviation of moisture noise (default 0.01)
+	TempC                   float64 `json:"temp_c"`                    // Mean soil temperature (default 20)
+	DropoutRate             float64 `json:"dropout_rate"`              // Probability a reading is lost (0-1)
+	SampleIntervalSec       int     `json:"sample_interval_sec"`       // Seconds between readings (default 300)
+	Seed                    int64   `json:"seed"`                      // Layout and noise seed (0 = time-based)
+	OutputDir               string  `json:"output_dir"`                // Where the cache and results go (default ./simulation)
+}
+
+// withDefaults fills unset fields.
+func (s SimulationConfig) withDefaults() SimulationConfig {
+	if s.Sensors <= 0 {
+		s.Sensors = defaultSimSensors
+	}
+	if s.Layout == "" {
+		s.Layout = SimLayoutGrid
+	}
+	if s.BaseVWC <= 0 {
+		s.BaseVWC = defaultSimBaseVWC
+	}
+	if s.DrydownPerDay <= 0 {
+		s.DrydownPerDay = defaultSimDrydownPerDay
+	}
+	if s.NoiseVWC <= 0 {
+		s.NoiseVWC = defaultSimNoiseVWC
+	}
+	if s.TempC == 0 {
+		s.TempC = defaultSimTempC
+	}
+	if s.SampleIntervalSec <= 0 {
+		s.SampleIntervalSec = defaultSimSampleSec
+	}
+	if s.Seed == 0 {
+		s.Seed = time.Now().UnixNano()
+	}
+	if s.OutputDir == "" {
+		s.OutputDir = defaultSimOutputDir
+	}
+	return s
+}
+
+// simulationConfig is config with everything that would reach outside the
+// machine turned off and the outputs moved under output_dir.
+func simulationConfig(config EdgeConfig) (EdgeConfig, error) {
+	sim := SimulationConfig{}
+	if config.Simulation != nil {
+		sim = *config.Simulation
+	}
+	sim = sim.withDefaults()
+	if config.LogicalGrid != nil {
+		return config, fmt.Errorf("simulation needs a geographic grid")
+	}
+	if err := os.MkdirAll(sim.OutputDir, 0755); err != nil {
+		return config, fmt.Errorf("failed to create %s: %v", sim.OutputDir, err)
+	}
+	config.Simulation = &sim
+	config.DatabaseURL = ""
+	config.CloudStore = CloudStorePostgres
+	config.LocalCacheDB = filepath.Join(sim.OutputDir, "edge_cache.db")
+	config.GeoJSONExportPath = filepath.Join(sim.OutputDir, "latest.geojson")
+	config.TrustSystemClock = true
+	config.LoRaWANDevices = nil
+	config.Fields = nil
+	config.FleetHeartbeatSec = 0
+	config.UpdateManifestURL = ""
+	config.RemoteConfigPublicKey = ""
+	config.AllianceHTTPPort = 0
+	return config, nil
+}
+
+// simProbe is one simulated sensor.
+type simProbe struct {
+	sensorID string
+	lat, lon float64
+	offset   float64 // gradient contribution at the probe
+}
+
+// Simulator writes synthetic readings into the local cache.
+type Simulator struct {
+	config  SimulationConfig
+	fieldID string
+	ep      *EdgeProcessor
+	probes  []simProbe
+	rng     *rand.Rand
+	start   time.Time
+	logger  *slog.Logger
+}
+
+// EnableSimulation swaps the processor's probes and cloud for the
+// simulator. Call before Run, with a config from simulationConfig.
+func (ep *EdgeProcessor) EnableSimulation() error {
+	if ep.config.Simulation == nil {
+		return fmt.Errorf("simulation not configured")
+	}
+	sim := *ep.config.Simulation
+	s := &Simulator{
+		config:  sim,
+		fieldID: ep.config.FieldID,
+		ep:      ep,
+		rng:     rand.New(rand.NewSource(sim.Seed)),
+		start:   time.Now(),
+		logger:  ep.logger.With("component", "simulation"),
+	}
+	s.layout(ep.gridLayout())
+	ep.simulator = s
+	ep.store = &simulationStore{path: filepath.Join(sim.OutputDir, "grid.jsonl")}
+	s.logger.Info("Simulating field", "sensors", len(s.probes), "layout", sim.Layout, "seed", sim.Seed,
+		"output_dir", sim.OutputDir)
+	return nil
+}
+
+// layout places the probes over the field.
+func (s *Simulator) layout(g gridLayout) {
+	n := s.config.Sensors
+	place := func(fy, fx float64) {
+		s.probes = append(s.probes, simProbe{
+			sensorID: fmt.Sprintf("SIM-%03d", len(s.probes)+1),
+			lat:      g.minLat + fy*(g.maxLat-g.minLat),
+			lon:      g.minLon + fx*(g.maxLon-g.minLon),
+			offset:   s.gradientAt(fy, fx),
+		})
+	}
+	switch s.config.Layout {
+	case SimLayoutRandom:
+		for i := 0; i < n; i++ {
+			place(s.rng.Float64(), s.rng.Float64())
+		}
+	case SimLayoutTransect:
+		for i := 0; i < n; i++ {
+			f := (float64(i) + 0.5) / float64(n)
+			place(f, f)
+		}
+	default:
+		cols := int(math.Ceil(math.Sqrt(float64(n))))
+		rows := int(math.Ceil(float64(n) / float64(cols)))
+		for i := 0; i < n; i++ {
+			r, c := i/cols, i%cols
+			place((float64(r)+0.5)/float64(rows), (float64(c)+0.5)/float64(cols))
+		}
+	}
+}
+
+// gradientAt is the gradient's VWC offset at a fractional field position
+// (0-1 south to north, west to east), zero at the center.
+func (s *Simulator) gradientAt(fy, fx float64) float64 {
+	b := s.config.GradientBearingDeg * math.Pi / 180
+	along := (fy-0.5)*math.Cos(b) + (fx-0.5)*math.Sin(b)
+	reach := (math.Abs(math.Cos(b)) + math.Abs(math.Sin(b))) / 2 // along at the far corner
+	return s.config.GradientVWC / 2 * along / reach
+}
+
+// Start writes a first round of readings, then one every sample interval.
+func (s *Simulator) Start() {
+	s.sample(time.Now())
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.config.SampleIntervalSec) * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.sample(now)
+		}
+	}()
+}
+
+// sample writes one reading per probe that doesn't drop out.
+func (s *Simulator) sample(now time.Time) {
+	days := now.Sub(s.start).Hours() / 24
+	if h := s.config.IrrigationIntervalHours; h > 0 {
+		days = math.Mod(now.Sub(s.start).Hours(), h) / 24
+	}
+	hour := float64(now.Hour()) + float64(now.Minute())/60
+	temp := s.config.TempC + simDiurnalSwingC*math.Sin(2*math.Pi*(hour-9)/24) // warmest mid-afternoon
+
+	written, dropped := 0, 0
+	for _, p := range s.probes {
+		if s.rng.Float64() < s.config.DropoutRate {
+			dropped++
+			continue
+		}
+		root := s.config.BaseVWC + p.offset - s.config.DrydownPerDay*days
+		surface := root - simSurfaceOffsetVWC - s.config.DrydownPerDay*days
+		root = math.Max(root+s.rng.NormFloat64()*s.config.NoiseVWC, simMinVWC)
+		surface = math.Max(surface+s.rng.NormFloat64()*s.config.NoiseVWC, simMinVWC)
+
+		if _, err := s.ep.localDB.Exec(`
+			INSERT OR IGNORE INTO soil_sensor_readings
+				(sensor_id, field_id, timestamp, latitude, longitude, moisture_surface, moisture_root,
+				 temp_surface, battery_voltage, quality_flag, origin)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'valid', ?)
+		`, p.sensorID, s.fieldID, readingTimestamp(now), p.lat, p.lon, surface, root,
+			temp+s.rng.NormFloat64()*0.3, 3.6, ReadingOriginSimulated); err != nil {
+			s.logger.Warn("Simulated reading not stored", "sensor_id", p.sensorID, "error", err)
+			continue
+		}
+		written++
+	}
+	s.logger.Debug("Simulated readings", "written", written, "dropped", dropped)
+}
+
+// simulationStore appends each upload batch to a JSON-lines file in place
+// of the cloud.
+type simulationStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *simulationStore) Name() string    { return "simulation" }
+func (s *simulationStore) Available() bool { return true }
+
+func (s *simulationStore) StoreGrid(points []VirtualGridPoint) error {
+	line, err := json.Marshal(map[string]interface{}{"stored_at": time.Now().UTC(), "points": points})
+	if err != nil {
+		return fmt.Errorf("failed to encode grid batch: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", s.path, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", s.path, err)
+	}
+	return f.Close()
+}
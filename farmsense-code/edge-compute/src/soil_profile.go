@@ -0,0 +1,162 @@
+// Soil Profile - multi-depth moisture and temperature
+// Multi-depth probes (Sentek Drill & Drop, Teralytic) report moisture and
+// temperature at several depths. Besides the surface/root summary, the
+// full profile is kept on the reading (the cloud's vertical_profile column,
+// depths in inches) and mapped onto standard horizons at 10, 30 and 60 cm:
+// a horizon takes the mean of the probe depths within 6 cm of it, so
+// Sentek's 5/15 cm sensors make up the 10 cm horizon and Teralytic's 15 cm
+// sensor stands in for it. Each horizon is a registered sensor variable
+// (moisture_30cm, temperature_60cm...), interpolated like any other and
+// carried as a per-depth grid layer in the cell's variables.
+//
+// Where a cell has profile layers, water deficit is computed from the
+// thickness-weighted moisture of the horizons within the crop's root depth
+// instead of the surface/root average. Probes without a profile are
+// unaffected, and cells they alone cover keep the surface/root average.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+const (
+	profileDepthToleranceCm = 6.0
+	cmPerInch               = 2.54
+)
+
+// profileHorizonsCm are the depths grid layers are produced at.
+var profileHorizonsCm = []int{10, 30, 60}
+
+// DepthReading is one depth of a probe's profile.
+type DepthReading struct {
+	DepthCm     float64  `json:"depth_cm"`
+	Moisture    *float64 `json:"moisture,omitempty"`    // m³/m³
+	Temperature *float64 `json:"temperature,omitempty"` // °C
+}
+
+// profileEntry is a depth in the stored vertical_profile format.
+type profileEntry struct {
+	DepthIn  float64  `json:"depth_in"`
+	Moisture *float64 `json:"moisture,omitempty"`
+	Temp     *float64 `json:"temp,omitempty"`
+}
+
+func profileMoistureVar(depthCm int) string    { return fmt.Sprintf("moisture_%dcm", depthCm) }
+func profileTemperatureVar(depthCm int) string { return fmt.Sprintf("temperature_%dcm", depthCm) }
+
+func init() {
+	for _, h := range profileHorizonsCm {
+		depth := float64(h)
+		RegisterSensorVariable(SensorVariable{
+			Name: profileMoistureVar(h),
+			Read: func(s SensorReading) (float64, bool) {
+				return horizonMean(s.Profile, depth, func(d DepthReading) *float64 { return d.Moisture })
+			},
+		})
+		RegisterSensorVariable(SensorVariable{
+			Name: profileTemperatureVar(h),
+			Read: func(s SensorReading) (float64, bool) {
+				return horizonMean(s.Profile, depth, func(d DepthReading) *float64 { return d.Temperature })
+			},
+		})
+	}
+}
+
+// horizonMean averages a profile value over the depths near a horizon.
+func horizonMean(profile []DepthReading, horizonCm float64, value func(DepthReading) *float64) (float64, bool) {
+	sum, n := 0.0, 0
+	for _, d := range profile {
+		v := value(d)
+		if v == nil || math.Abs(d.DepthCm-horizonCm) > profileDepthToleranceCm {
+			continue
+		}
+		sum += *v
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+// encodeProfile converts a profile to the stored vertical_profile JSON,
+// NULL when empty.
+func encodeProfile(profile []DepthReading) (sql.NullString, error) {
+	if len(profile) == 0 {
+		return sql.NullString{}, nil
+	}
+	entries := make([]profileEntry, 0, len(profile))
+	for _, d := range profile {
+		entries = append(entries, profileEntry{DepthIn: d.DepthCm / cmPerInch, Moisture: d.Moisture, Temp: d.Temperature})
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode depth profile: %v", err)
+	}
+	return sql.NullString{String: string(raw), Valid: true}, nil
+}
+
+// decodeProfile parses stored vertical_profile JSON.
+func decodeProfile(raw sql.NullString) ([]DepthReading, error) {
+	if !raw.Valid || raw.String == "" {
+		return nil, nil
+	}
+	var entries []profileEntry
+	if err := json.Unmarshal([]byte(raw.String), &entries); err != nil {
+		return nil, fmt.Errorf("invalid depth profile: %v", err)
+	}
+	profile := make([]DepthReading, 0, len(entries))
+	for _, e := range entries {
+		profile = append(profile, DepthReading{DepthCm: e.DepthIn * cmPerInch, Moisture: e.Moisture, Temperature: e.Temp})
+	}
+	return profile, nil
+}
+
+// profileRootZoneVWC is the cell's moisture over the root zone from its
+// profile layers: each horizon stands for the soil from halfway to the
+// horizon above to halfway to the one below, clipped to the root depth.
+func (ep *EdgeProcessor) profileRootZoneVWC(cell VirtualGridPoint) (float64, bool) {
+	rootDepthCm := 60.0
+	if crop := ep.cycleCrop; crop != nil {
+		rootDepthCm = crop.RootDepthMM / 10
+	}
+
+	type layer struct{ depth, vwc float64 }
+	layers := make([]layer, 0, len(profileHorizonsCm))
+	for _, h := range profileHorizonsCm {
+		if v, ok := cell.Variables[profileMoistureVar(h)]; ok {
+			layers = append(layers, layer{float64(h), v})
+		}
+	}
+	if len(layers) == 0 {
+		return 0, false
+	}
+
+	sum, total := 0.0, 0.0
+	for i, l := range layers {
+		top := 0.0
+		if i > 0 {
+			top = (layers[i-1].depth + l.depth) / 2
+		}
+		bottom := rootDepthCm
+		if i < len(layers)-1 {
+			bottom = math.Min(bottom, (l.depth+layers[i+1].depth)/2)
+		}
+		if bottom <= top {
+			continue
+		}
+		sum += l.vwc * (bottom - top)
+		total += bottom - top
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return sum / total, true
+}
+
+// float64Ptr returns a pointer to v.
+func float64Ptr(v float64) *float64 { return &v }
@@ -0,0 +1,12 @@
+//go:build sqlite_mattn && cgo && !sqlcipher
+
+package main
+
+import _ "github.com/mattn/go-sqlite3"
+
+func init() {
+	localDrivers[LocalDriverMattn] = localDriver{
+		sqlName: "sqlite3",
+		dsn:     func(path string) string { return path },
+	}
+}
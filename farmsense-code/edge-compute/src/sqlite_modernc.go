@@ -0,0 +1,14 @@
+//go:build !no_modernc
+
+package main
+
+import _ "modernc.org/sqlite"
+
+func init() {
+	localDrivers[LocalDriverModernc] = localDriver{
+		sqlName: "sqlite",
+		dsn: func(path string) string {
+			return dsnWithParam(path, "_time_format=sqlite") // mattn's timestamp format
+		},
+	}
+}
@@ -0,0 +1,21 @@
+//go:build sqlcipher && cgo
+
+package main
+
+import (
+	"encoding/hex"
+	"net/url"
+
+	_ "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+func init() {
+	localDrivers[LocalDriverSQLCipher] = localDriver{
+		sqlName: "sqlite3",
+		dsn:     func(path string) string { return path },
+		keyedDSN: func(path string, key []byte) string {
+			// A raw key skips SQLCipher's passphrase derivation
+			return dsnWithParam(path, "_pragma_key="+url.QueryEscape("x'"+hex.EncodeToString(key)+"'"))
+		},
+	}
+}
@@ -0,0 +1,262 @@
+// Storage Guardian - SD card free-space watchdog and tiered retention
+// The local cache lives on the device's SD card, and a full card stops
+// SQLite writes, then OTA staging, then the OS. Local data is kept in
+// tiers, each pruned by its own job:
+//
+//	raw readings    reading_retention_days (30) once forwarded to the cloud;
+//	                mirrored cloud readings sensor_cache_days (14)
+//	grid history    trend_retention_days (90), with its batch records
+//	zone summaries  zone_retention_days (365)
+//
+// Every storageCheckInterval the guardian reads the free space of the
+// cache's filesystem. Below storage_low_free_pct the device is "low": every
+// tier is halved and pruned at once, the GeoJSON file export and packet
+// captures pause, and a warning alert is raised. Below
+// storage_critical_free_pct it is "critical": tiers are quartered, and
+// readings that never reached the cloud are pruned past the tier as well
+// (losing old readings beats losing the device). A level is left only
+// once free space is storageRecoverMarginPct above its threshold.
+//
+// After a pressure prune, and weekly otherwise, the cache is VACUUMed so
+// freed pages go back to the filesystem. VACUUM writes a copy of the
+// database, so it is skipped while the free space couldn't hold one.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	storageCheckInterval        = 5 * time.Minute
+	storageVacuumInterval       = 7 * 24 * time.Hour
+	storageRecoverMarginPct     = 2.0
+	defaultStorageLowFreePct    = 15.0
+	defaultStorageCriticalPct   = 5.0
+	defaultReadingRetentionDays = 30
+	defaultZoneRetentionDays    = 365
+)
+
+// Storage levels
+const (
+	StorageOK       = "ok"
+	StorageLow      = "low"
+	StorageCritical = "critical"
+)
+
+// AlertStorageLow is raised when the cache's filesystem runs short.
+const AlertStorageLow = "storage_low"
+
+// StorageStatus is the guardian's latest check.
+type StorageStatus struct {
+	Level         string     `json:"level"`
+	Path          string     `json:"path"`
+	FreeBytes     uint64     `json:"free_bytes"`
+	FreePct       float64    `json:"free_pct"`
+	CacheBytes    int64      `json:"cache_bytes"` // local SQLite cache incl. its WAL
+	ExportsPaused bool       `json:"exports_paused"`
+	CheckedAt     time.Time  `json:"checked_at"`
+	LastVacuumAt  *time.Time `json:"last_vacuum_at,omitempty"`
+}
+
+// diskFree returns the space available to the device on path's filesystem.
+func diskFree(path string) (uint64, float64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	if fs.Blocks == 0 {
+		return 0, 0, fmt.Errorf("%s reports no blocks", path)
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), 100 * float64(fs.Bavail) / float64(fs.Blocks), nil
+}
+
+// localCacheBytes is the size of the SQLite cache and its WAL.
+func (ep *EdgeProcessor) localCacheBytes() int64 {
+	var size int64
+	for _, path := range []string{ep.config.LocalCacheDB, ep.config.LocalCacheDB + "-wal"} {
+		if fi, err := os.Stat(path); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// storageLevelFor classifies free space, with hysteresis on the way back up.
+func (ep *EdgeProcessor) storageLevelFor(freePct float64) string {
+	low := ep.config.StorageLowFreePct
+	if low <= 0 {
+		low = defaultStorageLowFreePct
+	}
+	critical := ep.config.StorageCriticalFreePct
+	if critical <= 0 {
+		critical = defaultStorageCriticalPct
+	}
+	switch {
+	case freePct < critical || (ep.storageLevel == StorageCritical && freePct < critical+storageRecoverMarginPct):
+		return StorageCritical
+	case freePct < low || (ep.storageLevel != StorageOK && freePct < low+storageRecoverMarginPct):
+		return StorageLow
+	}
+	return StorageOK
+}
+
+// retentionDays is a tier's retention under the current storage level.
+func (ep *EdgeProcessor) retentionDays(days, def int) int {
+	if days <= 0 {
+		days = def
+	}
+	switch ep.storageLevel {
+	case StorageLow:
+		days /= 2
+	case StorageCritical:
+		days /= 4
+	}
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+// exportsPaused reports whether optional file output is held back.
+func (ep *EdgeProcessor) exportsPaused() bool {
+	return ep.storageLevel != StorageOK
+}
+
+// maybeCheckStorage runs the free-space check when it is due.
+func (ep *EdgeProcessor) maybeCheckStorage() {
+	now := time.Now()
+	if now.Sub(ep.lastStorageCheck) < storageCheckInterval {
+		return
+	}
+	ep.lastStorageCheck = now
+
+	path := filepath.Dir(ep.config.LocalCacheDB)
+	free, freePct, err := diskFree(path)
+	if err != nil {
+		ep.logger.Warn("Storage check failed", "component", "storage", "path", path, "error", err)
+		return
+	}
+
+	level := ep.storageLevelFor(freePct)
+	if level != ep.storageLevel {
+		ep.logger.Warn("Storage level changed", "component", "storage", "from", ep.storageLevel, "to", level,
+			"free_pct", freePct, "free_bytes", free)
+		ep.storageLevel = level
+		if level == StorageOK {
+			ep.captures.Suspend("")
+		} else {
+			ep.captures.Suspend("storage " + level)
+			ep.raiseStorageAlert(level, freePct)
+
+			// Prune every tier now under the shortened retention
+			ep.lastTrendPrune, ep.lastCachePrune = time.Time{}, time.Time{}
+			ep.maybePruneTrendHistory()
+			ep.maybePruneSensorCache()
+			ep.vacuumLocalCache(now)
+			free, freePct, _ = diskFree(path)
+		}
+	}
+	if now.Sub(ep.lastVacuum) >= storageVacuumInterval {
+		ep.vacuumLocalCache(now)
+	}
+
+	status := &StorageStatus{
+		Level:         level,
+		Path:          path,
+		FreeBytes:     free,
+		FreePct:       freePct,
+		CacheBytes:    ep.localCacheBytes(),
+		ExportsPaused: ep.exportsPaused(),
+		CheckedAt:     now.UTC(),
+	}
+	if !ep.lastVacuum.IsZero() {
+		t := ep.lastVacuum.UTC()
+		status.LastVacuumAt = &t
+	}
+	ep.stateMu.Lock()
+	ep.storageStatus = status
+	ep.stateMu.Unlock()
+}
+
+func (ep *EdgeProcessor) raiseStorageAlert(level string, freePct float64) {
+	severity := SeverityWarning
+	if level == StorageCritical {
+		severity = SeverityCritical
+	}
+	ep.alerts.Raise(Alert{
+		Kind:     AlertStorageLow,
+		Severity: severity,
+		FieldID:  ep.config.FieldID,
+		Subject:  ep.deviceID,
+		Message:  fmt.Sprintf("Only %.1f%% of the local cache's filesystem is free; retention shortened and exports paused", freePct),
+		Value:    freePct,
+	})
+}
+
+// vacuumLocalCache rebuilds the cache file to release free pages, when the
+// filesystem has room for the copy.
+func (ep *EdgeProcessor) vacuumLocalCache(now time.Time) {
+	ep.lastVacuum = now
+	before := ep.localCacheBytes()
+	free, _, err := diskFree(filepath.Dir(ep.config.LocalCacheDB))
+	if err != nil || free <= uint64(before) {
+		ep.logger.Warn("Not enough free space to vacuum the local cache", "component", "storage",
+			"cache_bytes", before, "free_bytes", free)
+		return
+	}
+	started := time.Now()
+	if _, err := ep.localDB.Exec(`VACUUM`); err != nil {
+		ep.logger.Error("Failed to vacuum local cache", "component", "storage", "error", err)
+		return
+	}
+	ep.logger.Info("Vacuumed local cache", "component", "storage", "bytes_before", before,
+		"bytes_after", ep.localCacheBytes(), "duration_s", time.Since(started).Seconds())
+}
+
+// pruneLocalReadings drops the field's own readings past the reading tier.
+// Rows not yet forwarded are kept unless storage is critical.
+func (ep *EdgeProcessor) pruneLocalReadings() {
+	days := ep.retentionDays(ep.config.ReadingRetentionDays, defaultReadingRetentionDays)
+	cutoff := readingTimestamp(ep.clock.Now().AddDate(0, 0, -days))
+	mark, err := ep.readingWatermark()
+	if err != nil {
+		ep.logger.Error("Failed to read reading watermark", "component", "storage", "error", err)
+		return
+	}
+	res, err := ep.localDB.Exec(`
+		DELETE FROM soil_sensor_readings WHERE field_id = ? AND origin = ? AND timestamp < ? AND rowid <= ?
+	`, ep.config.FieldID, ReadingOriginLocal, cutoff, mark)
+	if err != nil {
+		ep.logger.Error("Failed to prune local readings", "component", "storage", "error", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		ep.logger.Debug("Pruned forwarded readings", "component", "storage", "rows", n, "retention_days", days)
+	}
+	if ep.storageLevel != StorageCritical {
+		return
+	}
+	res, err = ep.localDB.Exec(`
+		DELETE FROM soil_sensor_readings WHERE field_id = ? AND origin = ? AND timestamp < ?
+	`, ep.config.FieldID, ReadingOriginLocal, cutoff)
+	if err != nil {
+		ep.logger.Error("Failed to prune unforwarded readings", "component", "storage", "error", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		ep.logger.Warn("Dropped readings that never reached the cloud", "component", "storage", "rows", n,
+			"before", cutoff)
+	}
+}
+
+// StorageStatus returns the latest storage check, nil before the first.
+func (ep *EdgeProcessor) StorageStatus() *StorageStatus {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return ep.storageStatus
+}
@@ -0,0 +1,348 @@
+// Sync Encoding - compact wire format for edge→cloud grid uploads
+// JSON per point repeats every key name, a 30-character grid ID, full
+// float64 precision and the same sensor/trace IDs hundreds of times. The
+// compact format is CBOR (RFC 8949) with:
+//   - a batch-level string table: grid IDs, sensor IDs, trace IDs and enum
+//     values are sent once and referenced by index
+//   - fixed-point quantization at sensor precision
+//   - timestamps and coordinates delta-encoded against the previous point,
+//     so a regular grid compresses to one- or two-byte deltas
+//
+// and the result is then gzip or zstd compressed.
+//
+// Batch (CBOR map):
+//
+//	{"v": 1, "field_id": str, "device_id": str, "strings": [str...],
+//	 "t0": unix ms, "lat0": int, "lon0": int, "points": [[...]...]}
+//
+// Point (CBOR array, in order):
+//
+//	0 grid_id (string index)       10 stress_index (×1e3)
+//	1 Δtimestamp ms                11 irrigation_need (string index)
+//	2 Δlatitude (×1e7 deg)         12 trafficability_index (×1e3)
+//	3 Δlongitude (×1e7 deg)        13 trafficable (bool)
+//	4 row                          14 confidence (×1e3)
+//	5 bench                        15 computation_mode (string index)
+//	6 moisture_surface (×1e4)      16 edge_device_id (string index)
+//	7 moisture_root (×1e4)         17 config_version (string index)
+//	8 temperature (×1e2 °C)        18 source_sensors ([string index...])
+//	9 water_deficit_mm (×1e1)      19 source_trace_ids ([string index...])
+//	                               20 variables ([string index, value ×1e4]..., sorted by name)
+//	                               21 loocv_rmse_vwc (×1e4)
+//	                               22 rain_state (string index)
+//	                               23 need_flag (string index)
+//	                               24 batch_id (string index)
+//	                               25 algorithm_version (string index)
+//	                               26 drydown_rate_mm_day (×1e2, null = not fitted)
+//	                               27 temp_trend_c_day (×1e2, null = not fitted)
+//	                               28 hours_to_refill (×1e1, null = not drying)
+//	                               29 hours_to_wilting (×1e1, null = not drying)
+//	                               30 leaching_fraction (×1e3)
+//	                               31 salinity_yield_loss_pct (×1e1)
+//	                               32 quality_flags (bitfield, quality_flags.go)
+//	                               33 moisture_root_pct_30d (×1e1, null = too little history)
+//	                               34 moisture_root_pct_90d (×1e1, null = too little history)
+//	                               35 moisture_root_last_season (×1e4, null = no record)
+//	                               36 moisture_root_vs_last_season (×1e4, null = no record)
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const compactFormatVersion = 10
+
+// Sync encodings and compressions
+const (
+	SyncEncodingJSON = "json"
+	SyncEncodingCBOR = "cbor"
+
+	SyncCompressionNone = "none"
+	SyncCompressionGzip = "gzip"
+	SyncCompressionZstd = "zstd"
+)
+
+// Fixed-point scales
+const (
+	scaleCoord      = 1e7
+	scaleMoisture   = 1e4
+	scaleTemp       = 1e2
+	scaleDeficit    = 1e1
+	scaleIndex      = 1e3
+	scaleVariable   = 1e4
+	scaleRate       = 1e2
+	scaleHours      = 1e1
+	scalePercentile = 1e1
+)
+
+// cborWriter appends CBOR items to a buffer. Only the subset the sync
+// format needs is implemented.
+type cborWriter struct {
+	buf bytes.Buffer
+}
+
+func (c *cborWriter) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		c.buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		c.buf.WriteByte(major | 24)
+		c.buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		c.buf.WriteByte(major | 25)
+		binary.Write(&c.buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		c.buf.WriteByte(major | 26)
+		binary.Write(&c.buf, binary.BigEndian, uint32(n))
+	default:
+		c.buf.WriteByte(major | 27)
+		binary.Write(&c.buf, binary.BigEndian, n)
+	}
+}
+
+func (c *cborWriter) Int(v int64) {
+	if v >= 0 {
+		c.head(0, uint64(v))
+	} else {
+		c.head(1, uint64(-(v + 1)))
+	}
+}
+
+func (c *cborWriter) String(s string) {
+	c.head(3, uint64(len(s)))
+	c.buf.WriteString(s)
+}
+
+func (c *cborWriter) Array(n int) { c.head(4, uint64(n)) }
+func (c *cborWriter) Map(n int)   { c.head(5, uint64(n)) }
+
+// Fixed writes v at scale, or null when v is nil.
+func (c *cborWriter) Fixed(v *float64, scale float64) {
+	if v == nil {
+		c.buf.WriteByte(0xf6)
+		return
+	}
+	c.Int(fixed(*v, scale))
+}
+
+func (c *cborWriter) Bool(v bool) {
+	if v {
+		c.buf.WriteByte(0xf5)
+	} else {
+		c.buf.WriteByte(0xf4)
+	}
+}
+
+// stringTable interns strings for index references.
+type stringTable struct {
+	index  map[string]int
+	values []string
+}
+
+func (t *stringTable) ref(s string) int64 {
+	if i, ok := t.index[s]; ok {
+		return int64(i)
+	}
+	t.index[s] = len(t.values)
+	t.values = append(t.values, s)
+	return int64(len(t.values) - 1)
+}
+
+func fixed(v, scale float64) int64 {
+	return int64(math.Round(v * scale))
+}
+
+// encodeCompactBatch encodes points in the compact CBOR format.
+func encodeCompactBatch(fieldID, deviceID string, points []VirtualGridPoint) []byte {
+	strs := &stringTable{index: make(map[string]int)}
+	body := &cborWriter{}
+
+	var t0, lat0, lon0 int64
+	if len(points) > 0 {
+		t0 = points[0].Timestamp.UnixMilli()
+		lat0 = fixed(points[0].Latitude, scaleCoord)
+		lon0 = fixed(points[0].Longitude, scaleCoord)
+	}
+	prevT, prevLat, prevLon := t0, lat0, lon0
+
+	body.Array(len(points))
+	for _, p := range points {
+		t := p.Timestamp.UnixMilli()
+		lat := fixed(p.Latitude, scaleCoord)
+		lon := fixed(p.Longitude, scaleCoord)
+
+		body.Array(37)
+		body.Int(strs.ref(p.GridID))
+		body.Int(t - prevT)
+		body.Int(lat - prevLat)
+		body.Int(lon - prevLon)
+		body.Int(int64(p.Row))
+		body.Int(int64(p.Bench))
+		body.Int(fixed(p.MoistureSurface, scaleMoisture))
+		body.Int(fixed(p.MoistureRoot, scaleMoisture))
+		body.Int(fixed(p.Temperature, scaleTemp))
+		body.Int(fixed(p.WaterDeficit, scaleDeficit))
+		body.Int(fixed(p.StressIndex, scaleIndex))
+		body.Int(strs.ref(p.IrrigationNeed))
+		body.Int(fixed(p.Trafficability, scaleIndex))
+		body.Bool(p.Trafficable)
+		body.Int(fixed(p.Confidence, scaleIndex))
+		body.Int(strs.ref(p.ComputationMode))
+		body.Int(strs.ref(p.EdgeDeviceID))
+		body.Int(strs.ref(p.ConfigVersion))
+		body.Array(len(p.SourceSensors))
+		for _, s := range p.SourceSensors {
+			body.Int(strs.ref(s))
+		}
+		body.Array(len(p.SourceTraceIDs))
+		for _, s := range p.SourceTraceIDs {
+			body.Int(strs.ref(s))
+		}
+		names := make([]string, 0, len(p.Variables))
+		for name := range p.Variables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		body.Array(2 * len(names))
+		for _, name := range names {
+			body.Int(strs.ref(name))
+			body.Int(fixed(p.Variables[name], scaleVariable))
+		}
+		body.Int(fixed(p.LOOCVRMSE, scaleMoisture))
+		body.Int(strs.ref(p.RainState))
+		body.Int(strs.ref(p.NeedFlag))
+		body.Int(strs.ref(p.BatchID))
+		body.Int(strs.ref(p.AlgorithmVersion))
+		body.Fixed(p.DrydownRate, scaleRate)
+		body.Fixed(p.TempTrend, scaleRate)
+		body.Fixed(p.HoursToRefill, scaleHours)
+		body.Fixed(p.HoursToWilting, scaleHours)
+		body.Int(fixed(p.LeachingFraction, scaleIndex))
+		body.Int(fixed(p.SalinityLossPct, scaleDeficit))
+		body.Int(int64(p.QualityFlags))
+		body.Fixed(p.MoisturePct30d, scalePercentile)
+		body.Fixed(p.MoisturePct90d, scalePercentile)
+		body.Fixed(p.MoistureLastSeason, scaleMoisture)
+		body.Fixed(p.MoistureVsLastSeason, scaleMoisture)
+
+		prevT, prevLat, prevLon = t, lat, lon
+	}
+
+	out := &cborWriter{}
+	out.Map(8)
+	out.String("v")
+	out.Int(compactFormatVersion)
+	out.String("field_id")
+	out.String(fieldID)
+	out.String("device_id")
+	out.String(deviceID)
+	out.String("strings")
+	out.Array(len(strs.values))
+	for _, s := range strs.values {
+		out.String(s)
+	}
+	out.String("t0")
+	out.Int(t0)
+	out.String("lat0")
+	out.Int(lat0)
+	out.String("lon0")
+	out.Int(lon0)
+	out.String("points")
+	out.buf.Write(body.buf.Bytes())
+	return out.buf.Bytes()
+}
+
+// encodeSyncPayload encodes and compresses a batch for upload, returning
+// the body and its Content-Type / Content-Encoding.
+func encodeSyncPayload(encoding, compression, fieldID, deviceID string, points []VirtualGridPoint) ([]byte, string, string, error) {
+	var payload []byte
+	contentType := "application/json"
+	switch encoding {
+	case SyncEncodingCBOR:
+		payload = encodeCompactBatch(fieldID, deviceID, points)
+		contentType = "application/cbor"
+	case SyncEncodingJSON, "":
+		var err error
+		if payload, err = json.Marshal(points); err != nil {
+			return nil, "", "", fmt.Errorf("failed to encode batch: %v", err)
+		}
+	default:
+		return nil, "", "", fmt.Errorf("unknown sync encoding %q", encoding)
+	}
+
+	var out bytes.Buffer
+	switch compression {
+	case SyncCompressionGzip:
+		zw, _ := gzip.NewWriterLevel(&out, gzip.BestCompression)
+		zw.Write(payload)
+		if err := zw.Close(); err != nil {
+			return nil, "", "", fmt.Errorf("failed to gzip batch: %v", err)
+		}
+	case SyncCompressionZstd:
+		zw, err := zstd.NewWriter(&out, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to init zstd: %v", err)
+		}
+		zw.Write(payload)
+		if err := zw.Close(); err != nil {
+			return nil, "", "", fmt.Errorf("failed to zstd batch: %v", err)
+		}
+	case SyncCompressionNone, "":
+		return payload, contentType, "", nil
+	default:
+		return nil, "", "", fmt.Errorf("unknown sync compression %q", compression)
+	}
+	return out.Bytes(), contentType, compression, nil
+}
+
+var syncHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// uploadBatch POSTs a batch to the cloud ingest endpoint.
+func (ep *EdgeProcessor) uploadBatch(points []VirtualGridPoint) error {
+	body, contentType, contentEncoding, err := encodeSyncPayload(
+		ep.config.SyncEncoding, ep.config.SyncCompression, ep.config.FieldID, ep.deviceID, points)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ep.config.SyncUploadURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build upload request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set("X-Device-ID", ep.deviceID)
+	req.Header.Set("X-Field-ID", ep.config.FieldID)
+	if ep.config.TenantID != "" {
+		req.Header.Set("X-Tenant-ID", ep.config.TenantID)
+	}
+	req.Header.Set("X-Batch-IDs", strings.Join(batchIDs(points), ",")) // ingest dedups per batch
+
+	resp, err := syncHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload batch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ingest endpoint returned HTTP %d", resp.StatusCode)
+	}
+
+	ep.cycleLog.Info("Uploaded grid batch", "points", len(points), "bytes", len(body),
+		"encoding", contentType, "compression", contentEncoding)
+	return nil
+}
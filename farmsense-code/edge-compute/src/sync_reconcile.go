@@ -0,0 +1,337 @@
+// Sync Reconcile - conflict resolution and count checks for grid uploads
+// After days offline a device flushes a long queue, and some of it may
+// already be in the cloud: a batch whose commit succeeded but whose
+// acknowledgement was lost, or one that only partly arrived. Cells are
+// upserted on (grid_id, timestamp, batch_id) so resending is always safe;
+// this file keeps the device from resending what it needn't and notices
+// what didn't land.
+//
+// Every Postgres/TimescaleDB upload also advances the device's
+// server-acknowledged high-water mark (edge_sync_watermarks: the latest
+// cycle_at committed for it) in the same transaction. Before a queued
+// flush the device reads the mark, asks the cloud how many cells it holds
+// for each queued batch at or below it, and marks batches held in full as
+// synced without sending them. Anything newer than the mark can't be in
+// the cloud and is sent as is.
+//
+// After a flush of at least sync_reconcile_min_cells cells (default 2000)
+// the batches just sent are counted again. A batch the cloud holds fewer
+// cells of than were sent is marked unsynced and re-queued; after
+// syncReconcileMaxRetries short counts in a row it is left unsynced and a
+// sync_mismatch alert is raised. The HTTP ingest dedups per batch on its
+// side and InfluxDB overwrites identical points, so neither is counted.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSyncReconcileMinCells = 2000
+	syncReconcileMaxRetries      = 3
+	cloudWatermarkStreamGrid     = "grid"
+	batchCountChunk              = 500 // batch IDs per count query
+)
+
+// AlertSyncMismatch is raised when a batch keeps coming up short in the cloud.
+const AlertSyncMismatch = "sync_mismatch"
+
+// batchLedger is implemented by stores that can report what they hold.
+type batchLedger interface {
+	// BatchCounts returns the cells stored per batch; absent batches are omitted.
+	BatchCounts(ids []string) (map[string]int, error)
+	// HighWater returns the device's acknowledged high-water mark, false before any upload.
+	HighWater(fieldID, deviceID string) (time.Time, bool, error)
+}
+
+// advanceCloudHighWater raises the uploading devices' marks inside tx.
+func advanceCloudHighWater(tx *sql.Tx, points []VirtualGridPoint) error {
+	type key struct{ field, device string }
+	marks := make(map[key]time.Time)
+	for _, p := range points {
+		if p.BatchID == "" {
+			continue
+		}
+		k := key{p.FieldID, p.EdgeDeviceID}
+		if p.Timestamp.After(marks[k]) {
+			marks[k] = p.Timestamp
+		}
+	}
+	for k, at := range marks {
+		if _, err := tx.Exec(`
+			INSERT INTO edge_sync_watermarks (edge_device_id, field_id, stream, high_water, acked_at)
+			VALUES ($1, $2, $3, $4, now())
+			ON CONFLICT (edge_device_id, field_id, stream) DO UPDATE
+			SET high_water = GREATEST(edge_sync_watermarks.high_water, EXCLUDED.high_water), acked_at = now()
+		`, k.device, k.field, cloudWatermarkStreamGrid, at); err != nil {
+			return fmt.Errorf("failed to advance sync high-water mark: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) BatchCounts(ids []string) (map[string]int, error) {
+	db := s.cloud.DB()
+	if db == nil {
+		return nil, fmt.Errorf("cloud database offline")
+	}
+	counts := make(map[string]int, len(ids))
+	for start := 0; start < len(ids); start += batchCountChunk {
+		end := start + batchCountChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+		placeholders := make([]string, len(chunk))
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			placeholders[i] = fmt.Sprintf("$%d::uuid", i+1)
+			args[i] = id
+		}
+		rows, err := db.Query(`SELECT batch_id::text, COUNT(*) FROM `+cloudGridTable+
+			` WHERE batch_id IN (`+strings.Join(placeholders, ", ")+`) GROUP BY batch_id`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count cloud batch cells: %v", err)
+		}
+		for rows.Next() {
+			var id string
+			var n int
+			if err := rows.Scan(&id, &n); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read cloud batch count: %v", err)
+			}
+			counts[id] = n
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to count cloud batch cells: %v", err)
+		}
+	}
+	return counts, nil
+}
+
+func (s *postgresStore) HighWater(fieldID, deviceID string) (time.Time, bool, error) {
+	db := s.cloud.DB()
+	if db == nil {
+		return time.Time{}, false, fmt.Errorf("cloud database offline")
+	}
+	var at time.Time
+	err := db.QueryRow(`
+		SELECT high_water FROM edge_sync_watermarks WHERE edge_device_id = $1 AND field_id = $2 AND stream = $3
+	`, deviceID, fieldID, cloudWatermarkStreamGrid).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to read sync high-water mark: %v", err)
+	}
+	return at, true, nil
+}
+
+// batchCellCounts counts distinct cells per batch, as the upsert stores them.
+func batchCellCounts(points []VirtualGridPoint) map[string]int {
+	type cell struct {
+		batch, grid string
+		at          time.Time
+	}
+	seen := make(map[cell]bool, len(points))
+	counts := make(map[string]int)
+	for _, p := range points {
+		c := cell{p.BatchID, p.GridID, p.Timestamp}
+		if p.BatchID == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		counts[p.BatchID]++
+	}
+	return counts
+}
+
+// resolveSyncConflicts drops the queued batches the cloud already holds in
+// full and marks them synced.
+func (ep *EdgeProcessor) resolveSyncConflicts(points []VirtualGridPoint) []VirtualGridPoint {
+	ledger, ok := ep.store.(batchLedger)
+	if !ok {
+		return points
+	}
+	mark, ok, err := ledger.HighWater(ep.config.FieldID, ep.deviceID)
+	if err != nil {
+		ep.cycleLog.Warn("Failed to read sync high-water mark", "component", "sync", "error", err)
+		return points
+	}
+	if !ok {
+		return points // nothing of ours was ever committed
+	}
+	ep.recordCloudHighWater(mark)
+
+	candidates := make([]VirtualGridPoint, 0, len(points))
+	for _, p := range points {
+		if p.BatchID != "" && !p.Timestamp.After(mark) {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return points
+	}
+	expected := batchCellCounts(candidates)
+	held, err := ledger.BatchCounts(mapKeys(expected))
+	if err != nil {
+		ep.cycleLog.Warn("Failed to check queued batches against the cloud", "component", "sync", "error", err)
+		return points
+	}
+
+	complete := make(map[string]bool)
+	completeIDs := make([]string, 0)
+	partial := 0
+	for id, n := range expected {
+		switch {
+		case held[id] >= n:
+			complete[id] = true
+			completeIDs = append(completeIDs, id)
+		case held[id] > 0:
+			partial++
+		}
+	}
+	if len(complete) == 0 {
+		if partial > 0 {
+			ep.cycleLog.Info("Resuming partly synced batches", "component", "sync", "batches", partial)
+		}
+		return points
+	}
+
+	kept := make([]VirtualGridPoint, 0, len(points))
+	acked := make([]VirtualGridPoint, 0)
+	for _, p := range points {
+		if complete[p.BatchID] {
+			acked = append(acked, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	ep.markBatchesSynced(completeIDs)
+	ep.tracer.RecordPoints(acked, TraceCloudAck, "already in cloud")
+	ep.differ.Commit(acked)
+	ep.cycleLog.Info("Resolved sync conflicts", "component", "sync", "already_synced_batches", len(complete),
+		"skipped_points", len(acked), "partial_batches", partial, "high_water", mark)
+	return kept
+}
+
+// reconcileUpload re-counts a large flush's batches in the cloud and
+// returns the points of batches that came up short, to be queued again.
+func (ep *EdgeProcessor) reconcileUpload(points []VirtualGridPoint) []VirtualGridPoint {
+	minCells := ep.config.SyncReconcileMinCells
+	if minCells <= 0 {
+		minCells = defaultSyncReconcileMinCells
+	}
+	ledger, ok := ep.store.(batchLedger)
+	if !ok || len(points) < minCells {
+		return nil
+	}
+	expected := batchCellCounts(points)
+	held, err := ledger.BatchCounts(mapKeys(expected))
+	if err != nil {
+		ep.cycleLog.Warn("Failed to reconcile upload", "component", "sync", "error", err)
+		return nil
+	}
+	if mark, ok, err := ledger.HighWater(ep.config.FieldID, ep.deviceID); err == nil && ok {
+		ep.recordCloudHighWater(mark)
+	}
+
+	if ep.reconcileRetries == nil {
+		ep.reconcileRetries = make(map[string]int)
+	}
+	short := make(map[string]bool)
+	unsynced := make([]string, 0)
+	missing := 0
+	for id, n := range expected {
+		if held[id] < n {
+			missing += n - held[id]
+			unsynced = append(unsynced, id)
+			ep.reconcileRetries[id]++
+			if ep.reconcileRetries[id] < syncReconcileMaxRetries {
+				short[id] = true
+				continue
+			}
+			ep.alerts.Raise(Alert{
+				Kind:     AlertSyncMismatch,
+				Severity: SeverityWarning,
+				FieldID:  ep.config.FieldID,
+				Subject:  id,
+				Message: fmt.Sprintf("Cloud holds %d of %d cells of grid batch %s after %d attempts; left unsynced",
+					held[id], n, id, syncReconcileMaxRetries),
+				Value: float64(n - held[id]),
+			})
+			delete(ep.reconcileRetries, id)
+		} else {
+			delete(ep.reconcileRetries, id)
+		}
+	}
+	if missing == 0 {
+		ep.cycleLog.Info("Reconciled upload", "component", "sync", "batches", len(expected), "points", len(points))
+		return nil
+	}
+	ep.markBatchesUnsynced(unsynced)
+
+	requeue := make([]VirtualGridPoint, 0)
+	for _, p := range points {
+		if short[p.BatchID] {
+			requeue = append(requeue, p)
+		}
+	}
+	ep.cycleLog.Warn("Cloud is missing cells after sync", "component", "sync", "missing_cells", missing,
+		"requeued_batches", len(short), "requeued_points", len(requeue))
+	return requeue
+}
+
+// markBatchesUnsynced clears the acknowledgement of batches the cloud
+// turned out not to hold in full.
+func (ep *EdgeProcessor) markBatchesUnsynced(ids []string) {
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	if _, err := ep.localDB.Exec(`UPDATE grid_batches SET synced_at = NULL WHERE batch_id IN (`+placeholders+`)`,
+		args...); err != nil {
+		ep.cycleLog.Warn("Failed to mark grid batches unsynced", "component", "batches", "error", err)
+	}
+}
+
+func (ep *EdgeProcessor) cloudHighWaterKey() string {
+	return "grid_high_water:" + ep.config.FieldID
+}
+
+// recordCloudHighWater keeps the latest acknowledged mark locally.
+func (ep *EdgeProcessor) recordCloudHighWater(mark time.Time) {
+	if _, err := ep.localDB.Exec(`INSERT OR REPLACE INTO sync_state (name, value) VALUES (?, ?)`,
+		ep.cloudHighWaterKey(), mark.Unix()); err != nil {
+		ep.cycleLog.Warn("Failed to record sync high-water mark", "component", "sync", "error", err)
+	}
+}
+
+// cloudHighWater returns the locally recorded mark, nil when none is known.
+func (ep *EdgeProcessor) cloudHighWater() (*time.Time, error) {
+	var mark int64
+	err := ep.localDB.QueryRow(`SELECT value FROM sync_state WHERE name = ?`, ep.cloudHighWaterKey()).Scan(&mark)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(mark, 0).UTC()
+	return &t, nil
+}
+
+func mapKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
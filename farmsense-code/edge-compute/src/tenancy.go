@@ -0,0 +1,126 @@
+// Tenancy - grower ownership of fields on shared gateways
+// A co-op gateway can serve fields belonging to several growers (fields,
+// field_scheduler.go). tenant_id names the grower or organization owning
+// field_id, and a fields entry's tenant_id overrides it for that field.
+// Every grid cell carries its field's tenant, and so does the data sent up:
+// a tenant_id column on the cloud grid and zone stats (migration 022), a
+// tenant_id tag in InfluxDB and an X-Tenant-ID header on HTTP ingest.
+//
+// Local API credentials are either the device's (api_keys, client
+// certificates, JWTs without a tenant_id claim, or no auth at all) or a
+// tenant's (api_tenant_keys, JWTs with a tenant_id claim):
+//   - field endpoints (grid, sensors, fields, zones, trends, prescriptions,
+//     trace) take ?field_id=, defaulting to field_id for the device and to
+//     the tenant's first field for a tenant; another tenant's field is
+//     answered as unknown
+//   - /alerts and /fields/schedule list only the tenant's fields
+//   - device endpoints (sync, storage, fleet, OTA, peers, captures, LoRaWAN,
+//     commands, time, metrics) need the device's credentials
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// TenantKey is an API key scoped to one tenant.
+type TenantKey struct {
+	TenantID string `json:"tenant_id"`
+	Key      string `json:"key"`
+	Role     string `json:"role,omitempty"` // viewer | operator | admin (default, api_rbac.go)
+}
+
+// apiPrincipal is who a local API request authenticated as.
+type apiPrincipal struct {
+	tenant string // empty = the device, every field
+	role   string // empty = admin (api_rbac.go)
+	user   string // provisioned user or JWT subject, empty for config credentials
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p apiPrincipal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalOf is the request's principal; unauthenticated requests only
+// get this far with auth off, when everyone is the device.
+func principalOf(r *http.Request) apiPrincipal {
+	p, _ := r.Context().Value(principalKey{}).(apiPrincipal)
+	return p
+}
+
+// processors are every field processor the server can answer for, the
+// primary first.
+func (s *EdgeAPIServer) processors() []*EdgeProcessor {
+	return gatewayProcessors(s.processor, s.scheduler)
+}
+
+// gatewayProcessors lists main and the scheduler's other fields.
+func gatewayProcessors(main *EdgeProcessor, scheduler *FieldScheduler) []*EdgeProcessor {
+	out := []*EdgeProcessor{main}
+	if scheduler != nil {
+		for _, p := range scheduler.Processors() {
+			if p != main {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// visibleFields are the field IDs a principal may read.
+func (s *EdgeAPIServer) visibleFields(p apiPrincipal) map[string]bool {
+	fields := make(map[string]bool)
+	for _, proc := range s.processors() {
+		if p.tenant == "" || proc.config.TenantID == p.tenant {
+			fields[proc.config.FieldID] = true
+		}
+	}
+	return fields
+}
+
+// fieldProcessor resolves the ?field_id= a request is about.
+func (s *EdgeAPIServer) fieldProcessor(r *http.Request) (*EdgeProcessor, error) {
+	p := principalOf(r)
+	fieldID := r.URL.Query().Get("field_id")
+	for _, proc := range s.processors() {
+		if p.tenant != "" && proc.config.TenantID != p.tenant {
+			continue
+		}
+		if fieldID == "" || proc.config.FieldID == fieldID {
+			return proc, nil
+		}
+	}
+	if fieldID == "" {
+		return nil, fmt.Errorf("tenant %s has no fields on this device", p.tenant)
+	}
+	return nil, fmt.Errorf("unknown field %s", fieldID)
+}
+
+// fieldScoped runs h with the server answering for the request's field.
+func (s *EdgeAPIServer) fieldScoped(h func(*EdgeAPIServer, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		proc, err := s.fieldProcessor(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		scoped := *s
+		scoped.processor = proc
+		h(&scoped, w, r)
+	}
+}
+
+// deviceScoped refuses tenant credentials.
+func deviceScoped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principalOf(r).tenant != "" {
+			http.Error(w, "forbidden: needs device credentials", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
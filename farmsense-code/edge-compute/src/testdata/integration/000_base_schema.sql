@@ -0,0 +1,129 @@
+-- Integration harness base schema (integration_env_test.go)
+-- The backend's SQLAlchemy models create these tables before
+-- database/migrations run: 001 turns them into hypertables and later
+-- migrations add columns and indexes to them. The primary keys include
+-- timestamp, which a TimescaleDB hypertable needs for any unique index.
+
+CREATE EXTENSION IF NOT EXISTS postgis;
+
+DO $$
+BEGIN
+    CREATE ROLE farmsense_user;
+EXCEPTION WHEN duplicate_object THEN
+    NULL;
+END $$;
+
+CREATE TABLE IF NOT EXISTS soil_sensor_readings (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    sensor_id VARCHAR(50) NOT NULL,
+    field_id VARCHAR(50) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    moisture_surface FLOAT,
+    moisture_root FLOAT,
+    temp_surface FLOAT,
+    temp_root FLOAT,
+    ec_surface FLOAT,
+    ec_root FLOAT,
+    ph FLOAT,
+    quality_flag VARCHAR(20) DEFAULT 'valid',
+    battery_voltage FLOAT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS pump_telemetry (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    pump_id VARCHAR(50) NOT NULL,
+    field_id VARCHAR(50) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    status VARCHAR(20),
+    flow_rate_lpm FLOAT,
+    pressure_bar FLOAT,
+    power_consumption_kw FLOAT,
+    runtime_hours FLOAT,
+    volume_delivered_l FLOAT,
+    cumulative_volume_l FLOAT,
+    anomaly_score FLOAT,
+    anomaly_flag VARCHAR(20) DEFAULT 'normal',
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS weather_data (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    station_id VARCHAR(50),
+    field_id VARCHAR(50) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    data_type VARCHAR(20),
+    temperature_c FLOAT,
+    humidity_pct FLOAT,
+    pressure_hpa FLOAT,
+    wind_speed_ms FLOAT,
+    wind_direction_deg FLOAT,
+    rainfall_mm FLOAT,
+    rainfall_intensity VARCHAR(20),
+    solar_radiation_wm2 FLOAT,
+    et0_mm FLOAT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS virtual_sensor_grid_20m (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    field_id VARCHAR(50) NOT NULL,
+    grid_id VARCHAR(50) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    grid_cell GEOMETRY(POLYGON, 4326),
+    moisture_surface FLOAT,
+    moisture_root FLOAT,
+    temperature FLOAT,
+    water_deficit_mm FLOAT,
+    stress_index FLOAT,
+    irrigation_need VARCHAR(20),
+    computation_mode VARCHAR(20),
+    source_sensors JSON,
+    confidence FLOAT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    physical_probe_value FLOAT,
+    edge_device_id VARCHAR(50),
+    PRIMARY KEY (id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS virtual_sensor_grid_50m (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    field_id VARCHAR(50) NOT NULL,
+    grid_id VARCHAR(50) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    grid_cell GEOMETRY(POLYGON, 4326),
+    moisture_surface FLOAT,
+    moisture_root FLOAT,
+    temperature FLOAT,
+    water_deficit_mm FLOAT,
+    stress_index FLOAT,
+    irrigation_need VARCHAR(20),
+    computation_mode VARCHAR(20),
+    source_sensors JSON,
+    confidence FLOAT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    physical_probe_value FLOAT,
+    edge_device_id VARCHAR(50),
+    PRIMARY KEY (id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS virtual_sensor_grid_1m (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    field_id VARCHAR(50) NOT NULL,
+    grid_id VARCHAR(100) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    location GEOMETRY(POINT, 4326) NOT NULL,
+    moisture_surface FLOAT,
+    moisture_root FLOAT,
+    temperature FLOAT,
+    confidence_score FLOAT DEFAULT 1.0,
+    physical_probe_value FLOAT,
+    edge_device_id VARCHAR(50),
+    PRIMARY KEY (id, timestamp)
+);
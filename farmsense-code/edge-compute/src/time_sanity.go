@@ -0,0 +1,239 @@
+// Time Sanity - clock validation without NTP
+// Gateways without an RTC battery boot at the epoch and only get the time
+// right once NTP reaches them, which in the field may be never. The
+// processor keeps its own reference clock, anchored to the monotonic
+// clock so a later wall-clock jump doesn't corrupt it:
+//   - cloud: the database server's now(), corrected for half the round trip
+//   - gateway: LoRaWAN uplink receive times from the network server, which
+//     gateways stamp from GPS or their own NTP; several must agree
+//
+// Until one of those (or trust_system_clock on devices with a working RTC)
+// vouches for the time, grid cycles are skipped and decoded readings are
+// stored as time_unverified rather than valid. Readings stamped in the
+// future by more than a few minutes are stored as time_skewed.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	clockCheckInterval      = time.Hour
+	clockRetryInterval      = time.Minute // while untrusted
+	clockSkewAlertThreshold = 5 * time.Minute
+	gatewayTimeSamples      = 15
+	gatewayMinAgreeing      = 3
+	gatewayAgreeWindow      = time.Minute
+	maxFutureReadingSkew    = 5 * time.Minute
+)
+
+// Nothing this software computes predates this
+var minPlausibleTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Time reference sources
+const (
+	ClockSourceNone    = "none"
+	ClockSourceSystem  = "system"
+	ClockSourceCloud   = "cloud"
+	ClockSourceGateway = "gateway"
+)
+
+// Quality flags for readings stored before the clock is trusted
+const (
+	QualityTimeUnverified = "time_unverified"
+	QualityTimeSkewed     = "time_skewed"
+)
+
+// AlertClockSkew is raised when the system clock is far from the reference.
+const AlertClockSkew = "clock_skew"
+
+// ClockStatus is the reference clock state exposed by the API.
+type ClockStatus struct {
+	Trusted        bool      `json:"trusted"`
+	Source         string    `json:"source"`
+	SystemTime     time.Time `json:"system_time"`
+	CorrectedTime  time.Time `json:"corrected_time"`
+	OffsetSec      float64   `json:"offset_sec"` // corrected − system
+	VerifiedAt     time.Time `json:"verified_at,omitempty"`
+	GatewaySamples int       `json:"gateway_samples"`
+}
+
+// ReferenceClock is the processor's corrected notion of now.
+type ReferenceClock struct {
+	mu          sync.RWMutex
+	source      string
+	anchorRef   time.Time // true time at the anchor
+	anchorLocal time.Time // time.Now() at the anchor (carries the monotonic reading)
+
+	gatewayOffsets []time.Duration // reference − system, most recent last
+	trustSystem    bool
+	logger         *slog.Logger
+}
+
+func NewReferenceClock(trustSystem bool) *ReferenceClock {
+	c := &ReferenceClock{source: ClockSourceNone, trustSystem: trustSystem, logger: slog.With("component", "clock")}
+	if trustSystem && time.Now().After(minPlausibleTime) {
+		c.anchor(time.Now(), time.Now(), ClockSourceSystem)
+	}
+	return c
+}
+
+func (c *ReferenceClock) anchor(ref, local time.Time, source string) {
+	c.anchorRef = ref
+	c.anchorLocal = local
+	c.source = source
+}
+
+// Now returns the corrected time (the system time until a reference exists).
+func (c *ReferenceClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.anchorLocal.IsZero() {
+		return time.Now()
+	}
+	return c.anchorRef.Add(time.Since(c.anchorLocal))
+}
+
+// Trusted reports whether a reference has vouched for the time.
+func (c *ReferenceClock) Trusted() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.anchorLocal.IsZero()
+}
+
+// Offset is corrected − system time.
+func (c *ReferenceClock) Offset() time.Duration {
+	return c.Now().Sub(time.Now())
+}
+
+// ObserveCloud anchors to the cloud server's clock read between sent and received.
+func (c *ReferenceClock) ObserveCloud(server, sent, received time.Time) {
+	mid := sent.Add(received.Sub(sent) / 2)
+	c.mu.Lock()
+	c.anchor(server, mid, ClockSourceCloud)
+	c.mu.Unlock()
+}
+
+// ObserveGateway records a network-server receive time for an uplink that
+// arrived at the local time received. Once enough recent samples agree it
+// anchors the clock, unless the cloud already has.
+func (c *ReferenceClock) ObserveGateway(gateway, received time.Time) {
+	if gateway.Before(minPlausibleTime) {
+		return // gateway without a fix yet
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gatewayOffsets = append(c.gatewayOffsets, gateway.Sub(received))
+	if len(c.gatewayOffsets) > gatewayTimeSamples {
+		c.gatewayOffsets = c.gatewayOffsets[len(c.gatewayOffsets)-gatewayTimeSamples:]
+	}
+	if c.source == ClockSourceCloud {
+		return
+	}
+
+	sorted := append([]time.Duration(nil), c.gatewayOffsets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	agreeing := 0
+	for _, off := range sorted {
+		if d := off - median; d < gatewayAgreeWindow && d > -gatewayAgreeWindow {
+			agreeing++
+		}
+	}
+	if agreeing < gatewayMinAgreeing {
+		return
+	}
+	if c.source != ClockSourceGateway {
+		c.logger.Info("Clock anchored to gateway time", "offset", median.String(), "samples", agreeing)
+	}
+	c.anchor(received.Add(median), received, ClockSourceGateway)
+}
+
+// Status returns the clock state.
+func (c *ReferenceClock) Status() ClockStatus {
+	now := time.Now()
+	corrected := c.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	st := ClockStatus{
+		Trusted:        !c.anchorLocal.IsZero(),
+		Source:         c.source,
+		SystemTime:     now,
+		CorrectedTime:  corrected,
+		OffsetSec:      corrected.Sub(now).Seconds(),
+		GatewaySamples: len(c.gatewayOffsets),
+	}
+	if st.Trusted {
+		st.VerifiedAt = c.anchorRef
+	}
+	return st
+}
+
+// readingQuality flags a reading's timestamp against the reference clock.
+func (c *ReferenceClock) readingQuality(at time.Time) string {
+	if !c.Trusted() {
+		return QualityTimeUnverified
+	}
+	if at.Before(minPlausibleTime) || at.Sub(c.Now()) > maxFutureReadingSkew {
+		return QualityTimeSkewed
+	}
+	return "valid"
+}
+
+// checkCloudClock reads the cloud server's time.
+func (ep *EdgeProcessor) checkCloudClock() error {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return fmt.Errorf("cloud offline")
+	}
+	var server time.Time
+	sent := time.Now()
+	if err := db.QueryRow(`SELECT now()`).Scan(&server); err != nil {
+		return fmt.Errorf("failed to read cloud time: %v", err)
+	}
+	received := time.Now()
+
+	wasTrusted := ep.clock.Trusted()
+	ep.clock.ObserveCloud(server, sent, received)
+	offset := ep.clock.Offset()
+	if !wasTrusted {
+		ep.logger.Info("Clock verified against cloud", "component", "clock", "offset", offset.String())
+	}
+	if offset > clockSkewAlertThreshold || offset < -clockSkewAlertThreshold {
+		if !ep.clockSkewAlerted {
+			ep.clockSkewAlerted = true
+			ep.alerts.Raise(Alert{
+				Kind:     AlertClockSkew,
+				Severity: SeverityWarning,
+				FieldID:  ep.config.FieldID,
+				Subject:  ep.deviceID,
+				Message:  fmt.Sprintf("System clock is off by %s; timestamps are being corrected (check RTC battery / NTP)", offset.Round(time.Second)),
+				Value:    offset.Seconds(),
+			})
+		}
+	} else {
+		ep.clockSkewAlerted = false
+	}
+	return nil
+}
+
+// maybeCheckClock re-verifies the clock hourly, or every minute until trusted.
+func (ep *EdgeProcessor) maybeCheckClock() {
+	now := time.Now()
+	interval := clockCheckInterval
+	if !ep.clock.Trusted() {
+		interval = clockRetryInterval
+	}
+	if now.Sub(ep.lastClockCheck) < interval {
+		return
+	}
+	ep.lastClockCheck = now
+	if err := ep.checkCloudClock(); err != nil && !ep.clock.Trusted() {
+		ep.logger.Warn("Clock not yet verified", "component", "clock", "error", err)
+	}
+}
@@ -0,0 +1,440 @@
+// TLS + Auth - encrypted cloud connections and local API authentication
+// Cloud DB: the TLS settings are folded into the PostgreSQL DSN (sslmode,
+// sslrootcert, sslcert, sslkey), and a password can come from a file or
+// the environment instead of sitting in database_url. lib/pq reads the
+// certificate files on every new connection, so when a client certificate
+// is configured pooled connections are recycled hourly and a rotated
+// certificate takes effect without a restart.
+//
+// Local API: optional HTTPS with the key pair reloaded when the files
+// change, optional client certificates (mTLS), and a middleware accepting
+// a static API key (X-API-Key or Bearer) or an HS256 bearer JWT. Health
+// probes stay open so systemd and load balancers don't need credentials.
+// api_tenant_keys and JWTs with a tenant_id claim authenticate as one
+// tenant and only reach its fields (tenancy.go). Each credential carries
+// a role (viewer, operator, admin), and api_cloud_tokens adds per-user
+// tokens provisioned from the cloud and cached for offline use
+// (api_rbac.go).
+// With no keys, JWT secret or client CA configured the API is open, which
+// is logged at startup.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cloudCertRecycle      = time.Hour
+	certReloadCheck       = 30 * time.Second
+	certExpiryWarning     = 14 * 24 * time.Hour
+	certCheckInterval     = 24 * time.Hour
+	jwtClockSkewAllowance = time.Minute
+)
+
+// Cloud TLS modes (PostgreSQL sslmode)
+const (
+	CloudTLSDisable    = "disable"
+	CloudTLSRequire    = "require"
+	CloudTLSVerifyCA   = "verify-ca"
+	CloudTLSVerifyFull = "verify-full"
+)
+
+// AlertCertExpiring is raised when a configured certificate is about to expire.
+const AlertCertExpiring = "cert_expiring"
+
+// cloudTLSMode is the configured sslmode, defaulting to verify-full when a
+// CA is given and leaving the DSN's own setting alone otherwise.
+func (c *EdgeConfig) cloudTLSMode() string {
+	if c.CloudTLSMode != "" {
+		return c.CloudTLSMode
+	}
+	if c.CloudTLSCA != "" {
+		return CloudTLSVerifyFull
+	}
+	return ""
+}
+
+// databasePassword reads database_password_file, if set.
+func (c *EdgeConfig) databasePassword() (string, error) {
+	if c.DatabasePasswordFile == "" {
+		return c.DatabasePassword, nil
+	}
+	data, err := os.ReadFile(c.DatabasePasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read database password: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// cloudDSN returns database_url with the TLS and password settings applied.
+// Both the URL and the key=value DSN forms are supported.
+func cloudDSN(c EdgeConfig) (string, error) {
+	if c.DatabaseURL == "" {
+		return "", nil
+	}
+	password, err := c.databasePassword()
+	if err != nil {
+		return "", err
+	}
+	params := make([][2]string, 0, 5)
+	if mode := c.cloudTLSMode(); mode != "" {
+		params = append(params, [2]string{"sslmode", mode})
+	}
+	for _, p := range [][2]string{{"sslrootcert", c.CloudTLSCA}, {"sslcert", c.CloudTLSCert}, {"sslkey", c.CloudTLSKey}} {
+		if p[1] != "" {
+			params = append(params, p)
+		}
+	}
+
+	if strings.Contains(c.DatabaseURL, "://") {
+		u, err := url.Parse(c.DatabaseURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid database_url: %v", err)
+		}
+		if password != "" {
+			u.User = url.UserPassword(u.User.Username(), password)
+		}
+		q := u.Query()
+		for _, p := range params {
+			q.Set(p[0], p[1])
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	// key=value form: later keys win in lib/pq
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	dsn := c.DatabaseURL
+	if password != "" {
+		params = append(params, [2]string{"password", password})
+	}
+	for _, p := range params {
+		dsn += fmt.Sprintf(" %s='%s'", p[0], quote.Replace(p[1]))
+	}
+	return dsn, nil
+}
+
+// certReloader serves a key pair, re-reading it when either file changes.
+type certReloader struct {
+	certPath, keyPath string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, p := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(p)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	mod, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %v", r.certPath, err)
+	}
+	r.cert = &cert
+	r.modTime = mod
+	return nil
+}
+
+// GetCertificate is a tls.Config hook. A rotation that fails to load
+// keeps the previous pair in service.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) >= certReloadCheck {
+		r.checkedAt = time.Now()
+		if mod, err := r.latestModTime(); err == nil && mod.After(r.modTime) {
+			if err := r.reload(); err != nil {
+				slog.Warn("Certificate rotation failed, keeping current certificate", "component", "tls", "error", err)
+			} else {
+				slog.Info("Certificate reloaded", "component", "tls", "cert", r.certPath)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// apiTLSConfig returns the local API's server TLS config, or nil for HTTP.
+func apiTLSConfig(c EdgeConfig) (*tls.Config, error) {
+	if c.APITLSCert == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(c.APITLSCert, c.APITLSKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+	if c.APIClientCA != "" {
+		pemData, err := os.ReadFile(c.APIClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api_client_ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, errors.New("api_client_ca contains no certificates")
+		}
+		cfg.ClientCAs = pool
+		// Verified when presented; the middleware decides what needs one,
+		// so health probes still work without a certificate
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// APIAuth authenticates local API requests.
+type APIAuth struct {
+	keys       [][]byte
+	tenantKeys []TenantKey
+	jwtSecret  []byte
+	audience   string
+	clientCert bool               // a verified client certificate is enough
+	tokens     *APITokenDirectory // nil without api_cloud_tokens
+}
+
+// NewAPIAuth returns nil when no authentication is configured.
+func NewAPIAuth(c EdgeConfig) *APIAuth {
+	if len(c.APIKeys) == 0 && len(c.APITenantKeys) == 0 && c.APIJWTSecret == "" && c.APIClientCA == "" &&
+		!c.APICloudTokens {
+		return nil
+	}
+	a := &APIAuth{jwtSecret: []byte(c.APIJWTSecret), audience: c.APIJWTAudience, clientCert: c.APIClientCA != ""}
+	for _, k := range c.APIKeys {
+		a.keys = append(a.keys, []byte(k))
+	}
+	a.tenantKeys = append(a.tenantKeys, c.APITenantKeys...)
+	return a
+}
+
+// Wrap requires authentication on every path except exempt ones and
+// attaches the caller's principal to the request. A nil APIAuth leaves the
+// handler open, every caller being the device.
+func (a *APIAuth) Wrap(next http.Handler, exempt ...string) http.Handler {
+	if a == nil {
+		return next
+	}
+	open := make(map[string]bool, len(exempt))
+	for _, p := range exempt {
+		open[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if open[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="farmsense-edge"`)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+func (a *APIAuth) authenticate(r *http.Request) (apiPrincipal, error) {
+	if a.clientCert && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return apiPrincipal{}, nil
+	}
+	token := r.Header.Get("X-API-Key")
+	if token == "" {
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+		}
+	}
+	if token == "" {
+		return apiPrincipal{}, errors.New("missing credentials")
+	}
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(token), k) == 1 {
+			return apiPrincipal{}, nil
+		}
+	}
+	for _, k := range a.tenantKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k.Key)) == 1 {
+			return apiPrincipal{tenant: k.TenantID, role: k.Role}, nil
+		}
+	}
+	if a.tokens != nil {
+		if t, ok := a.tokens.lookup(token, time.Now()); ok {
+			return apiPrincipal{tenant: t.tenant, role: t.role, user: t.userID}, nil
+		}
+	}
+	if len(a.jwtSecret) > 0 && strings.Count(token, ".") == 2 {
+		claims, err := verifyHS256JWT(token, a.jwtSecret, a.audience, time.Now())
+		if err != nil {
+			return apiPrincipal{}, err
+		}
+		if !validRole(claims.Role) {
+			return apiPrincipal{}, errors.New("unknown token role")
+		}
+		return apiPrincipal{tenant: claims.TenantID, role: claims.Role, user: claims.Subject}, nil
+	}
+	return apiPrincipal{}, errors.New("invalid credentials")
+}
+
+// jwtClaims are the registered claims we check, plus the tenant scope.
+type jwtClaims struct {
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Audience  json.RawMessage `json:"aud"`       // string or array
+	TenantID  string          `json:"tenant_id"` // empty = device-wide
+	Role      string          `json:"role"`      // empty = admin
+	Subject   string          `json:"sub"`
+}
+
+func (c jwtClaims) hasAudience(want string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		for _, a := range many {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyHS256JWT checks a compact JWT's signature, exp, nbf and audience
+// and returns its claims.
+func verifyHS256JWT(token string, secret []byte, audience string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtClaims{}, errors.New("invalid token header")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return jwtClaims{}, errors.New("unsupported token algorithm")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("invalid token signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return jwtClaims{}, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtClaims{}, errors.New("invalid token payload")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return jwtClaims{}, errors.New("invalid token payload")
+	}
+	if claims.ExpiresAt == nil {
+		return jwtClaims{}, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(jwtClockSkewAllowance)) {
+		return jwtClaims{}, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtClockSkewAllowance).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return jwtClaims{}, errors.New("token not yet valid")
+	}
+	if audience != "" && !claims.hasAudience(audience) {
+		return jwtClaims{}, errors.New("token audience mismatch")
+	}
+	return claims, nil
+}
+
+// certNotAfter returns the expiry of the first certificate in a PEM file.
+func certNotAfter(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("%s holds no PEM certificate", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// maybeCheckCertificates warns daily about certificates nearing expiry.
+func (ep *EdgeProcessor) maybeCheckCertificates() {
+	now := time.Now()
+	if now.Sub(ep.lastCertCheck) < certCheckInterval {
+		return
+	}
+	ep.lastCertCheck = now
+
+	for _, path := range []string{ep.config.CloudTLSCert, ep.config.APITLSCert} {
+		if path == "" {
+			continue
+		}
+		notAfter, err := certNotAfter(path)
+		if err != nil {
+			ep.logger.Warn("Failed to read certificate", "component", "tls", "cert", path, "error", err)
+			continue
+		}
+		left := notAfter.Sub(ep.clock.Now())
+		if left > certExpiryWarning {
+			continue
+		}
+		severity, msg := SeverityWarning, fmt.Sprintf("Certificate %s expires in %.0f days; rotate it", path, left.Hours()/24)
+		if left <= 0 {
+			severity, msg = SeverityCritical, fmt.Sprintf("Certificate %s expired %s", path, notAfter.Format(time.RFC3339))
+		}
+		ep.alerts.Raise(Alert{
+			Kind:     AlertCertExpiring,
+			Severity: severity,
+			FieldID:  ep.config.FieldID,
+			Subject:  path,
+			Message:  msg,
+			Value:    left.Hours() / 24,
+		})
+	}
+}
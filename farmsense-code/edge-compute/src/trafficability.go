@@ -0,0 +1,199 @@
+// Trafficability - can heavy equipment enter without rutting or compaction?
+// Each cell is scored from surface moisture relative to the soil's traffic
+// limit (a texture-dependent fraction of field capacity: clays rut well
+// before field capacity, sands carry load almost up to it), then penalized
+// for rain in the last 48 h because the top few cm wet up before the
+// surface probe sees it. A field gets a go/no-go from the share of cells
+// that are trafficable.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	trafficGoThreshold     = 0.5  // cell index at or above this is trafficable
+	defaultTrafficGoPct    = 90.0 // % of cells that must be trafficable for "go"
+	trafficMarginalPct     = 70.0
+	trafficRainWindow      = 48 * time.Hour
+	trafficRainPenaltyMax  = 0.3
+	trafficRainPenalty24h  = 0.02 // per mm in the last 24h
+	trafficRainPenalty48h  = 0.01 // per mm 24-48h ago
+	trafficTransitionWidth = 0.3  // fraction of the limit over which the index ramps 1 -> 0
+)
+
+// soilTraffic holds texture-specific moisture limits.
+type soilTraffic struct {
+	FieldCapacity float64 // m³/m³
+	LimitFraction float64 // traffic limit as a fraction of field capacity
+}
+
+var soilTrafficTable = map[string]soilTraffic{
+	"sand":       {FieldCapacity: 0.12, LimitFraction: 1.00},
+	"loamy_sand": {FieldCapacity: 0.16, LimitFraction: 0.95},
+	"sandy_loam": {FieldCapacity: 0.22, LimitFraction: 0.92},
+	"loam":       {FieldCapacity: 0.30, LimitFraction: 0.90},
+	"silt_loam":  {FieldCapacity: 0.33, LimitFraction: 0.87},
+	"clay_loam":  {FieldCapacity: 0.36, LimitFraction: 0.84},
+	"clay":       {FieldCapacity: 0.40, LimitFraction: 0.80},
+}
+
+// Default matches the field capacity assumed by calculateWaterDeficit
+var defaultSoilTraffic = soilTraffic{FieldCapacity: 0.35, LimitFraction: 0.88}
+
+// Field-level trafficability decisions
+const (
+	TrafficGo       = "go"
+	TrafficMarginal = "marginal"
+	TrafficNoGo     = "no_go"
+)
+
+// TrafficabilitySummary is the per-field go/no-go for harvest managers.
+type TrafficabilitySummary struct {
+	FieldID         string    `json:"field_id"`
+	Decision        string    `json:"decision"`
+	TrafficablePct  float64   `json:"trafficable_pct"`
+	MeanIndex       float64   `json:"mean_index"`
+	Cells           int       `json:"cells"`
+	SoilTexture     string    `json:"soil_texture"`
+	Rain24hMM       float64   `json:"rain_24h_mm"`
+	Rain48hMM       float64   `json:"rain_48h_mm"`
+	ComputedAt      time.Time `json:"computed_at"`
+	WettestGridIDs  []string  `json:"wettest_grid_ids"`
+	TrafficLimitVWC float64   `json:"traffic_limit_vwc"`
+}
+
+// trafficabilityIndex scores a cell 0 (will rut) to 1 (firm).
+// The index crosses trafficGoThreshold exactly at the traffic limit.
+func trafficabilityIndex(moistureSurface float64, soil soilTraffic, rainPenalty float64) float64 {
+	limit := soil.FieldCapacity * soil.LimitFraction
+	if limit <= 0 {
+		return 0
+	}
+	index := 0.5 + (limit-moistureSurface)/(trafficTransitionWidth*limit)*0.5
+	index -= rainPenalty
+	return math.Max(0, math.Min(1, index))
+}
+
+// fetchRecentRainfall returns rain totals for the last 24h and 24-48h,
+// from the field's weather stations when they report rain.
+func (ep *EdgeProcessor) fetchRecentRainfall(now time.Time) (float64, float64, error) {
+	if len(ep.config.WeatherStations) > 0 {
+		rain24, n, err := ep.stationWeatherSum("rainfall_mm", now.Add(-24*time.Hour), now)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n > 0 {
+			rain24to48, _, err := ep.stationWeatherSum("rainfall_mm", now.Add(-trafficRainWindow), now.Add(-24*time.Hour))
+			return rain24, rain24to48, err
+		}
+	}
+	query := `
+		SELECT COALESCE(SUM(CASE WHEN timestamp > $3 THEN rainfall_mm ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN timestamp <= $3 THEN rainfall_mm ELSE 0 END), 0)
+		FROM weather_data
+		WHERE field_id = $1
+		  AND timestamp > $2
+		  AND timestamp <= $4
+		  AND rainfall_mm IS NOT NULL
+	`
+
+	db := ep.cloud.DB()
+	if db == nil {
+		db = ep.localDB
+	}
+
+	var rain24, rain24to48 float64
+	err := db.QueryRow(query, ep.config.FieldID, now.Add(-trafficRainWindow), now.Add(-24*time.Hour), now).Scan(&rain24, &rain24to48)
+	return rain24, rain24to48, err
+}
+
+// applyTrafficability scores every cell and updates the field summary.
+func (ep *EdgeProcessor) applyTrafficability(points []VirtualGridPoint) {
+	if len(points) == 0 {
+		return
+	}
+	summary := ep.scoreTrafficability(points, time.Now())
+	ep.stateMu.Lock()
+	ep.trafficSummary = &summary
+	ep.stateMu.Unlock()
+}
+
+// scoreTrafficability scores every cell against the rain up to now.
+func (ep *EdgeProcessor) scoreTrafficability(points []VirtualGridPoint, now time.Time) TrafficabilitySummary {
+	soil, ok := soilTrafficTable[ep.config.SoilTexture]
+	if !ok {
+		soil = defaultSoilTraffic
+	}
+
+	rain24, rain24to48, err := ep.fetchRecentRainfall(now)
+	if err != nil {
+		// Without rain data, fall back to moisture alone
+		ep.cycleLog.Warn("Rainfall lookup failed for trafficability", "error", err)
+		rain24, rain24to48 = 0, 0
+	}
+	penalty := math.Min(trafficRainPenaltyMax, rain24*trafficRainPenalty24h+rain24to48*trafficRainPenalty48h)
+
+	trafficable := 0
+	sum := 0.0
+	wettest := make([]int, 0, 5)
+	for i := range points {
+		idx := trafficabilityIndex(points[i].MoistureSurface, soil, penalty)
+		points[i].Trafficability = idx
+		points[i].Trafficable = idx >= trafficGoThreshold
+		sum += idx
+		if points[i].Trafficable {
+			trafficable++
+		}
+
+		// Keep the five least trafficable cells so crews know where not to enter
+		wettest = append(wettest, i)
+		for j := len(wettest) - 1; j > 0 && points[wettest[j]].Trafficability < points[wettest[j-1]].Trafficability; j-- {
+			wettest[j], wettest[j-1] = wettest[j-1], wettest[j]
+		}
+		if len(wettest) > 5 {
+			wettest = wettest[:5]
+		}
+	}
+
+	goPct := ep.config.TrafficGoPct
+	if goPct <= 0 {
+		goPct = defaultTrafficGoPct
+	}
+	pct := float64(trafficable) / float64(len(points)) * 100
+	decision := TrafficNoGo
+	if pct >= goPct {
+		decision = TrafficGo
+	} else if pct >= trafficMarginalPct {
+		decision = TrafficMarginal
+	}
+
+	wettestIDs := make([]string, len(wettest))
+	for i, idx := range wettest {
+		wettestIDs[i] = points[idx].GridID
+	}
+
+	summary := TrafficabilitySummary{
+		FieldID:         ep.config.FieldID,
+		Decision:        decision,
+		TrafficablePct:  pct,
+		MeanIndex:       sum / float64(len(points)),
+		Cells:           len(points),
+		SoilTexture:     ep.config.SoilTexture,
+		Rain24hMM:       rain24,
+		Rain48hMM:       rain24 + rain24to48,
+		ComputedAt:      now,
+		WettestGridIDs:  wettestIDs,
+		TrafficLimitVWC: soil.FieldCapacity * soil.LimitFraction,
+	}
+	return summary
+}
+
+// TrafficabilitySummary returns the latest field go/no-go, or nil before the first cycle.
+func (ep *EdgeProcessor) TrafficabilitySummary() *TrafficabilitySummary {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return ep.trafficSummary
+}
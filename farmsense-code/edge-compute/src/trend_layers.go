@@ -0,0 +1,178 @@
+// Trend Layers - per-cell rates of change over the recent cycles
+// Each cycle, a cell's last trend_layer_cycles recorded cycles (from the
+// local grid_history, no older than trendLayerMaxSpan) plus the current one
+// are fitted by least squares to give:
+//
+//	drydown_rate_mm_day   root-zone water lost per day since the last
+//	                      wetting event: −d(θ)/dt × root zone depth
+//	temp_trend_c_day      temperature change per day over all the cycles
+//	hours_to_refill       at the drydown rate, until root moisture reaches
+//	                      the refill point (field capacity less the crop's
+//	                      readily available water; half of TAW without a
+//	                      crop model)
+//	hours_to_wilting      the same to the wilting point
+//
+// The drydown run starts after the last rise of drydownWettingRiseVWC, as
+// in the /trends/drydown fit, so irrigation or rain doesn't read as a
+// negative rate. Time-to-threshold is nil while the cell isn't drying or
+// when the crossing is past trendLayerMaxHours; a cell already past the
+// threshold reads 0. Layers that can't be fitted (fewer than
+// trendLayerMinSamples cycles, or a drydown run that short) are left nil.
+// Unlike the /trends fit (exponential over a window, computed on request)
+// these are linear and short-horizon, cheap enough to ride along with
+// every cell to the cloud, exports and MQTT.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultTrendLayerCycles = 12
+	trendLayerMinSamples    = 3
+	trendLayerMaxSpan       = 72 * time.Hour // older cycles say little about the current rate
+	trendLayerMaxHours      = 14 * 24.0      // crossings further out than this are "not soon"
+	defaultRefillDepletion  = 0.5            // fraction of TAW used before refill without a crop model
+)
+
+type trendSample struct {
+	at         time.Time
+	root, temp float64
+}
+
+// fetchRecentCycles returns each cell's last n recorded cycles before
+// cycleAt, oldest first.
+func (ep *EdgeProcessor) fetchRecentCycles(n int, cycleAt time.Time) (map[string][]trendSample, error) {
+	before := cycleAt.Unix()
+	if ep.packedHistory() {
+		return ep.packedRecentCycles(n, cycleAt)
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT grid_id, timestamp, moisture_root, temperature
+		FROM grid_history
+		WHERE field_id = ? AND timestamp < ? AND timestamp >= ?
+		  AND timestamp >= COALESCE((
+			SELECT MIN(timestamp) FROM (
+				SELECT DISTINCT timestamp FROM grid_history
+				WHERE field_id = ? AND timestamp < ?
+				ORDER BY timestamp DESC
+				LIMIT ?
+			)
+		  ), 0)
+		ORDER BY grid_id, timestamp
+	`, ep.config.FieldID, before, cycleAt.Add(-trendLayerMaxSpan).Unix(), ep.config.FieldID, before, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grid history: %v", err)
+	}
+	defer rows.Close()
+
+	byCell := make(map[string][]trendSample)
+	for rows.Next() {
+		var id string
+		var ts int64
+		var s trendSample
+		if err := rows.Scan(&id, &ts, &s.root, &s.temp); err != nil {
+			return nil, fmt.Errorf("failed to read grid history: %v", err)
+		}
+		s.at = time.Unix(ts, 0)
+		byCell[id] = append(byCell[id], s)
+	}
+	return byCell, rows.Err()
+}
+
+// linearSlope fits y = a + b·t (t in days) and returns b.
+func linearSlope(samples []trendSample, value func(trendSample) float64) (float64, bool) {
+	t0 := samples[0].at
+	n := float64(len(samples))
+	var sumT, sumY, sumTT, sumTY float64
+	for _, s := range samples {
+		t := s.at.Sub(t0).Hours() / 24
+		y := value(s)
+		sumT += t
+		sumY += y
+		sumTT += t * t
+		sumTY += t * y
+	}
+	denom := n*sumTT - sumT*sumT
+	if denom <= 0 {
+		return 0, false
+	}
+	return (n*sumTY - sumT*sumY) / denom, true
+}
+
+// refillPointVWC is the root moisture at which the cycle's crop should be
+// irrigated.
+func (ep *EdgeProcessor) refillPointVWC() float64 {
+	if crop := ep.cycleCrop; crop != nil && crop.RootDepthMM > 0 {
+		return fieldCapacityVWC - crop.RAWMM/crop.RootDepthMM
+	}
+	return fieldCapacityVWC - defaultRefillDepletion*(fieldCapacityVWC-wiltingPointVWC)
+}
+
+// hoursToThreshold extrapolates a falling moisture to threshold.
+func hoursToThreshold(current, threshold, slopePerDay float64) *float64 {
+	hours := 0.0
+	if current > threshold {
+		if slopePerDay >= 0 {
+			return nil
+		}
+		hours = (current - threshold) / -slopePerDay * 24
+	}
+	if hours > trendLayerMaxHours {
+		return nil
+	}
+	return &hours
+}
+
+// applyTrendLayers fills the rate-of-change layers of a cycle's cells.
+func (ep *EdgeProcessor) applyTrendLayers(points []VirtualGridPoint, cycleAt time.Time) {
+	cycles := ep.config.TrendLayerCycles
+	if cycles <= 0 {
+		cycles = defaultTrendLayerCycles
+	}
+	history, err := ep.fetchRecentCycles(cycles, cycleAt)
+	if err != nil {
+		ep.cycleLog.Warn("Trend layers skipped", "component", "trends", "error", err)
+		return
+	}
+	rootMM := 600.0 // as rootZoneDeficit
+	if crop := ep.cycleCrop; crop != nil {
+		rootMM = crop.RootDepthMM
+	}
+	refill := ep.refillPointVWC()
+
+	for i := range points {
+		p := &points[i]
+		samples := append(history[p.GridID], trendSample{at: cycleAt, root: p.MoistureRoot, temp: p.Temperature})
+		p.TrendCycles = len(samples)
+		if len(samples) < trendLayerMinSamples {
+			continue
+		}
+		if slope, ok := linearSlope(samples, func(s trendSample) float64 { return s.temp }); ok {
+			p.TempTrend = &slope
+		}
+
+		start := 0
+		for j := len(samples) - 1; j > 0; j-- {
+			if samples[j].root-samples[j-1].root >= drydownWettingRiseVWC {
+				start = j
+				break
+			}
+		}
+		run := samples[start:]
+		if len(run) < trendLayerMinSamples {
+			continue
+		}
+		slope, ok := linearSlope(run, func(s trendSample) float64 { return s.root })
+		if !ok {
+			continue
+		}
+		rate := math.Max(0, -slope*rootMM)
+		p.DrydownRate = &rate
+		p.HoursToRefill = hoursToThreshold(p.MoistureRoot, refill, slope)
+		p.HoursToWilting = hoursToThreshold(p.MoistureRoot, wiltingPointVWC, slope)
+	}
+}
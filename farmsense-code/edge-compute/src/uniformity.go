@@ -0,0 +1,290 @@
+// Irrigation Uniformity - distribution uniformity from moisture response
+// After an irrigation set, every cell in a well-performing zone should
+// wet up by about the same amount. We compare each cell's moisture before
+// the set with its moisture once water has redistributed, and summarize
+// the spread of the rises as low-quarter distribution uniformity
+// (DU_lq = mean of the lowest 25% ÷ overall mean) and Christiansen's CU.
+// Interpolation smooths the map, so absolute values read high; the useful
+// signal is a zone's DU falling against its own early-season baseline,
+// which shows up well before yield maps do.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	uniformityCheckInterval  = time.Hour
+	uniformityHistoryWindow  = 48 * time.Hour
+	uniformityResponseDelay  = 2 * time.Hour // time for water to redistribute after a set
+	uniformityMinRiseVWC     = 0.01
+	uniformityMinCells       = 8
+	uniformityBaselineSets   = 5
+	uniformityRecentSets     = 3
+	uniformityMaxResults     = 200
+	defaultUniformityDropPct = 10.0
+	moistureHistoryRetention = 36 * time.Hour
+)
+
+// AlertUniformityDegraded is raised when a zone's DU drops below its baseline.
+const AlertUniformityDegraded = "uniformity_degraded"
+
+// UniformityResult is the uniformity estimate for one irrigation set.
+type UniformityResult struct {
+	ZoneID      string    `json:"zone_id"`
+	SetStart    time.Time `json:"set_start"`
+	SetEnd      time.Time `json:"set_end"`
+	DULowQuart  float64   `json:"du_lq"`
+	CU          float64   `json:"cu"`
+	MeanRiseVWC float64   `json:"mean_rise_vwc"`
+	Cells       int       `json:"cells"`
+	ComputedAt  time.Time `json:"computed_at"`
+}
+
+// moistureSnapshot is the per-cell mean moisture of one cycle.
+type moistureSnapshot struct {
+	at    time.Time
+	cells map[string]float64
+	pts   map[string][2]float64 // grid_id -> lon, lat
+}
+
+// moistureHistory keeps recent cycles for before/after comparisons. It is
+// used only from the processor's main loop.
+type moistureHistory struct {
+	snapshots []moistureSnapshot
+}
+
+func (h *moistureHistory) Add(at time.Time, points []VirtualGridPoint) {
+	snap := moistureSnapshot{
+		at:    at,
+		cells: make(map[string]float64, len(points)),
+		pts:   make(map[string][2]float64, len(points)),
+	}
+	for _, p := range points {
+		snap.cells[p.GridID] = (p.MoistureSurface + p.MoistureRoot) / 2
+		snap.pts[p.GridID] = [2]float64{p.Longitude, p.Latitude}
+	}
+	h.snapshots = append(h.snapshots, snap)
+
+	cutoff := at.Add(-moistureHistoryRetention)
+	for len(h.snapshots) > 0 && h.snapshots[0].at.Before(cutoff) {
+		h.snapshots = h.snapshots[1:]
+	}
+}
+
+// before returns the last snapshot at or before t.
+func (h *moistureHistory) before(t time.Time) *moistureSnapshot {
+	for i := len(h.snapshots) - 1; i >= 0; i-- {
+		if !h.snapshots[i].at.After(t) {
+			return &h.snapshots[i]
+		}
+	}
+	return nil
+}
+
+// after returns the first snapshot at or after t.
+func (h *moistureHistory) after(t time.Time) *moistureSnapshot {
+	for i := range h.snapshots {
+		if !h.snapshots[i].at.Before(t) {
+			return &h.snapshots[i]
+		}
+	}
+	return nil
+}
+
+// pointInRing tests a lon/lat point against a closed or open polygon ring.
+func pointInRing(lon, lat float64, ring [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// distributionUniformity returns DU_lq and Christiansen CU for rises.
+func distributionUniformity(rises []float64) (float64, float64, float64) {
+	sorted := append([]float64(nil), rises...)
+	sort.Float64s(sorted)
+	mean := 0.0
+	for _, r := range sorted {
+		mean += r
+	}
+	mean /= float64(len(sorted))
+	if mean <= 0 {
+		return 0, 0, mean
+	}
+
+	quarter := len(sorted) / 4
+	if quarter == 0 {
+		quarter = 1
+	}
+	lowMean := 0.0
+	for _, r := range sorted[:quarter] {
+		lowMean += r
+	}
+	lowMean /= float64(quarter)
+
+	absDev := 0.0
+	for _, r := range sorted {
+		absDev += math.Abs(r - mean)
+	}
+	cu := 1 - absDev/(float64(len(sorted))*mean)
+	return math.Max(lowMean/mean, 0), math.Max(cu, 0), mean
+}
+
+// assessSetUniformity compares the zone's cells before and after a set.
+func (ep *EdgeProcessor) assessSetUniformity(zone FlowZone, set irrigationSet, now time.Time) (UniformityResult, bool) {
+	pre := ep.moistureHist.before(set.Start)
+	post := ep.moistureHist.after(set.End.Add(uniformityResponseDelay))
+	if pre == nil || post == nil {
+		return UniformityResult{}, false
+	}
+
+	rises := make([]float64, 0)
+	for id, after := range post.cells {
+		before, ok := pre.cells[id]
+		if !ok {
+			continue
+		}
+		pt := post.pts[id]
+		if !pointInRing(pt[0], pt[1], zone.Boundary) {
+			continue
+		}
+		rises = append(rises, math.Max(after-before, 0))
+	}
+	if len(rises) < uniformityMinCells {
+		return UniformityResult{}, false
+	}
+
+	du, cu, mean := distributionUniformity(rises)
+	if mean < uniformityMinRiseVWC {
+		// Too little response to say anything (short set, already wet)
+		return UniformityResult{}, false
+	}
+	return UniformityResult{
+		ZoneID:      zone.ZoneID,
+		SetStart:    set.Start,
+		SetEnd:      set.End,
+		DULowQuart:  du,
+		CU:          cu,
+		MeanRiseVWC: mean,
+		Cells:       len(rises),
+		ComputedAt:  now,
+	}, true
+}
+
+// checkUniformity evaluates irrigation sets that have finished
+// redistributing since the last check, and alerts on degradation.
+func (ep *EdgeProcessor) checkUniformity(now time.Time) {
+	zones := make([]FlowZone, 0)
+	for _, z := range ep.config.FlowZones {
+		if len(z.Boundary) >= 3 {
+			zones = append(zones, z)
+		}
+	}
+	if len(zones) == 0 {
+		return
+	}
+
+	readings, err := ep.fetchFlowReadings(uniformityHistoryWindow)
+	if err != nil {
+		ep.logger.Error("Failed to fetch flow readings", "component", "uniformity", "error", err)
+		return
+	}
+	byMeter := make(map[string][]FlowReading)
+	for _, r := range readings {
+		byMeter[r.MeterID] = append(byMeter[r.MeterID], r)
+	}
+
+	dropPct := ep.config.UniformityDropPct
+	if dropPct <= 0 {
+		dropPct = defaultUniformityDropPct
+	}
+
+	for _, zone := range zones {
+		for _, set := range segmentIrrigationSets(byMeter[zone.MeterID]) {
+			if !set.End.After(ep.uniformityDoneUntil[zone.ZoneID]) || now.Sub(set.End) < uniformityResponseDelay {
+				continue
+			}
+			ep.uniformityDoneUntil[zone.ZoneID] = set.End
+
+			result, ok := ep.assessSetUniformity(zone, set, now)
+			if !ok {
+				continue
+			}
+			ep.stateMu.Lock()
+			history := append(ep.uniformity[zone.ZoneID], result)
+			if len(history) > uniformityMaxResults {
+				history = history[len(history)-uniformityMaxResults:]
+			}
+			ep.uniformity[zone.ZoneID] = history
+			ep.stateMu.Unlock()
+
+			ep.logger.Info("Irrigation uniformity assessed", "component", "uniformity", "zone_id", zone.ZoneID,
+				"du_lq", result.DULowQuart, "cu", result.CU, "cells", result.Cells)
+			ep.checkUniformityTrend(zone.ZoneID, history, dropPct)
+		}
+	}
+}
+
+// checkUniformityTrend alerts when recent sets sit below the season baseline.
+func (ep *EdgeProcessor) checkUniformityTrend(zoneID string, history []UniformityResult, dropPct float64) {
+	if len(history) < uniformityBaselineSets+uniformityRecentSets {
+		return
+	}
+	base := make([]float64, uniformityBaselineSets)
+	for i := range base {
+		base[i] = history[i].DULowQuart
+	}
+	recent := make([]float64, uniformityRecentSets)
+	for i := range recent {
+		recent[i] = history[len(history)-uniformityRecentSets+i].DULowQuart
+	}
+	baseline, current := median(base), median(recent)
+	if baseline <= 0 {
+		return
+	}
+	drop := (baseline - current) / baseline * 100
+	if drop < dropPct {
+		return
+	}
+	ep.alerts.Raise(Alert{
+		Kind:     AlertUniformityDegraded,
+		Severity: SeverityWarning,
+		FieldID:  ep.config.FieldID,
+		Subject:  zoneID,
+		Message:  "Distribution uniformity dropped below the zone's season baseline; check pressure and nozzles",
+		Value:    drop,
+	})
+}
+
+// maybeCheckUniformity rate-limits uniformity checks to uniformityCheckInterval.
+func (ep *EdgeProcessor) maybeCheckUniformity() {
+	now := time.Now()
+	if now.Sub(ep.lastUniformityCheck) < uniformityCheckInterval {
+		return
+	}
+	ep.lastUniformityCheck = now
+	ep.checkUniformity(now)
+}
+
+// Uniformity returns the per-set uniformity history for a zone, or all zones.
+func (ep *EdgeProcessor) Uniformity(zoneID string) []UniformityResult {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	out := make([]UniformityResult, 0)
+	for id, history := range ep.uniformity {
+		if zoneID == "" || id == zoneID {
+			out = append(out, history...)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SetEnd.Before(out[j].SetEnd) })
+	return out
+}
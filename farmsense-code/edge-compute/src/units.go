@@ -0,0 +1,166 @@
+// Units - imperial rendering of API responses and exports
+// Everything is computed and stored in metric. With units imperial (per
+// field config, so the control plane can set it per tenant through remote
+// config) or ?units=imperial on a request, API responses, the GeoJSON
+// grid and export files are converted on the way out. Quantities are
+// recognized by the unit suffix of their JSON key, and the key is renamed
+// to the imperial unit so a value is never mislabeled:
+//
+//	_mm → _in     _mm_day → _in_day   _mm_h → _in_h
+//	_cm → _in     _m → _ft            _m2 → _ft2   _ha → _ac
+//	_m3 → _acre_in                    _lph → _gph  _lpm → _gpm
+//	_kpa → _psi   _c → _f             _c_day → _f_day
+//
+// Bare temperature keys (temperature, temp, temperature_10cm, ...) keep
+// their names and become °F; the X-Units response header says which
+// system a response is in. Offsets and differences (temp_offset_c,
+// amplitude_c, _c_day) scale without the 32 °F shift. Fractions,
+// indices and hours are unitless or the same in both systems and pass
+// through, as do the few values named without a unit (attribution
+// distance, /grid/accuracy errors), which stay metric. Cloud sync, MQTT,
+// the peer protocol and the VRI machine formats are always metric.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Unit systems
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+)
+
+// unitRule converts one key suffix: imperial = metric × scale + offset.
+type unitRule struct {
+	metric, imperial string
+	scale, offset    float64
+}
+
+// unitRules are matched in order against the end of a key, so longer
+// suffixes come first.
+var unitRules = []unitRule{
+	{"mm_day", "in_day", 1 / 25.4, 0},
+	{"mm_h", "in_h", 1 / 25.4, 0},
+	{"c_day", "f_day", 1.8, 0},
+	{"offset_c", "offset_f", 1.8, 0},
+	{"delta_c", "delta_f", 1.8, 0},
+	{"amplitude_c", "amplitude_f", 1.8, 0},
+	{"mm", "in", 1 / 25.4, 0},
+	{"cm", "in", 1 / 2.54, 0},
+	{"m", "ft", 3.28084, 0},
+	{"m2", "ft2", 10.7639, 0},
+	{"m3", "acre_in", 1 / 102.7902, 0},
+	{"ha", "ac", 2.47105, 0},
+	{"lph", "gph", 0.264172, 0},
+	{"lpm", "gpm", 0.264172, 0},
+	{"kpa", "psi", 0.145038, 0},
+	{"c", "f", 1.8, 32},
+}
+
+var fahrenheit = unitRule{scale: 1.8, offset: 32}
+
+// validUnits reports whether a units setting is recognized; empty is metric.
+func validUnits(units string) bool {
+	return units == "" || units == UnitsMetric || units == UnitsImperial
+}
+
+// unitRuleFor returns the conversion for a key and its imperial name.
+func unitRuleFor(key string) (unitRule, string, bool) {
+	for _, r := range unitRules {
+		if key == r.metric {
+			return r, r.imperial, true
+		}
+		if strings.HasSuffix(key, "_"+r.metric) {
+			return r, strings.TrimSuffix(key, r.metric) + r.imperial, true
+		}
+	}
+	if key == "temperature" || key == "temp" || strings.HasPrefix(key, "temperature_") || strings.HasPrefix(key, "temp_") {
+		return fahrenheit, key, true
+	}
+	return unitRule{}, key, false
+}
+
+// convert applies the rule to a decoded JSON number, or to every number
+// in an array of them; anything else is returned as is.
+func (r unitRule) convert(v interface{}) interface{} {
+	switch x := v.(type) {
+	case float64:
+		return x*r.scale + r.offset
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = r.convert(e)
+		}
+		return out
+	}
+	return v
+}
+
+// imperialValue returns a copy of a decoded JSON document with its metric
+// quantities converted and renamed.
+func imperialValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			if _, nested := e.(map[string]interface{}); !nested {
+				if r, name, ok := unitRuleFor(k); ok {
+					out[name] = r.convert(e)
+					continue
+				}
+			}
+			out[k] = imperialValue(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = imperialValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// toImperial round-trips body through JSON and converts it.
+func toImperial(body interface{}) (interface{}, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return imperialValue(doc), nil
+}
+
+// imperialColumn is a metric column or variable name in imperial, and
+// the conversion for its values.
+func imperialColumn(name string) (string, unitRule) {
+	r, imperial, ok := unitRuleFor(name)
+	if !ok {
+		return name, unitRule{scale: 1}
+	}
+	return imperial, r
+}
+
+// unitsFor is the unit system a request asked for, else the field's.
+func (ep *EdgeProcessor) unitsFor(r *http.Request) (string, error) {
+	units := r.URL.Query().Get("units")
+	if units == "" {
+		units = ep.config.Units
+	}
+	if !validUnits(units) {
+		return "", fmt.Errorf("units must be %s or %s", UnitsMetric, UnitsImperial)
+	}
+	if units == "" {
+		units = UnitsMetric
+	}
+	return units, nil
+}
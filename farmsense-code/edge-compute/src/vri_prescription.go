@@ -0,0 +1,250 @@
+// VRI Prescription - variable-rate irrigation maps from the virtual grid
+// Each cell's application depth is its water deficit (root-zone refill,
+// Kc×ET0-adjusted when a crop model is set) grossed up for the leaching
+// fraction on saline cells and for application efficiency, capped at what
+// the machine can apply in one pass and quantized to rate steps
+// controllers can follow. Cells with the same rate form one prescription
+// zone (a multi-part polygon of cell squares).
+// Zones export as an ESRI shapefile for pivot/VRI software and as an
+// ISO 11783-10 (ISOXML) task with one treatment zone per rate.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	defaultVRIRateStepMM   = 2.5
+	defaultVRIMaxDepthMM   = 25.0
+	defaultVRIEfficiency   = 0.85
+	metersPerDegreeLat     = 111111.0
+	ddiVolumePerAreaRate   = "0001" // Setpoint Volume Per Area Application Rate, mm³/m²
+	mm3PerM2PerMMOfDepth   = 1e6
+	isoxmlOutOfFieldZone   = 0
+	isoxmlTreatmentPolygon = 2
+	isoxmlPolygonExterior  = 1
+	isoxmlPointOther       = 2
+)
+
+// Prescription export formats
+const (
+	PrescriptionShapefile = "shapefile"
+	PrescriptionISOXML    = "isoxml"
+)
+
+// cellBounds is a grid cell square: min lon, min lat, max lon, max lat.
+type cellBounds [4]float64
+
+// PrescriptionZone groups cells that get the same application depth.
+type PrescriptionZone struct {
+	ZoneID int          `json:"zone_id"`
+	RateMM float64      `json:"rate_mm"`
+	AreaHa float64      `json:"area_ha"`
+	Cells  []cellBounds `json:"-"`
+}
+
+// Prescription is a field's VRI map.
+type Prescription struct {
+	FieldID   string             `json:"field_id"`
+	CreatedAt time.Time          `json:"created_at"`
+	Zones     []PrescriptionZone `json:"zones"`
+}
+
+// BuildPrescription turns grid points into rate zones.
+func (ep *EdgeProcessor) BuildPrescription(points []VirtualGridPoint) (*Prescription, error) {
+	if len(points) == 0 {
+		return nil, errors.New("no grid computed yet")
+	}
+	if ep.config.LogicalGrid != nil {
+		return nil, errors.New("VRI prescriptions need a geographic grid")
+	}
+
+	step := ep.config.VRIRateStepMM
+	if step <= 0 {
+		step = defaultVRIRateStepMM
+	}
+	maxDepth := ep.config.VRIMaxDepthMM
+	if maxDepth <= 0 {
+		maxDepth = defaultVRIMaxDepthMM
+	}
+	efficiency := ep.config.VRIEfficiency
+	if efficiency <= 0 || efficiency > 1 {
+		efficiency = defaultVRIEfficiency
+	}
+	res := ep.config.GridResolution
+	if res <= 0 {
+		res = 20.0
+	}
+	cellHa := res * res / 10000
+
+	byRate := make(map[float64]*PrescriptionZone)
+	for _, p := range points {
+		rate := 0.0
+		if p.IrrigationNeed != "none" {
+			gross := math.Min(leachedDepth(p.WaterDeficit, p.LeachingFraction)/efficiency, maxDepth)
+			rate = math.Round(gross/step) * step
+		}
+		zone, ok := byRate[rate]
+		if !ok {
+			zone = &PrescriptionZone{RateMM: rate}
+			byRate[rate] = zone
+		}
+		zone.Cells = append(zone.Cells, ep.cellSquare(p))
+		zone.AreaHa += cellHa
+	}
+
+	rx := &Prescription{FieldID: ep.config.FieldID, CreatedAt: time.Now()}
+	for _, zone := range byRate {
+		rx.Zones = append(rx.Zones, *zone)
+	}
+	sort.Slice(rx.Zones, func(i, j int) bool { return rx.Zones[i].RateMM < rx.Zones[j].RateMM })
+	for i := range rx.Zones {
+		rx.Zones[i].ZoneID = i + 1
+	}
+	return rx, nil
+}
+
+// WritePrescriptionZip writes the prescription in the given format as a zip.
+func WritePrescriptionZip(w io.Writer, rx *Prescription, format string) error {
+	zw := zip.NewWriter(w)
+	var err error
+	switch format {
+	case PrescriptionShapefile:
+		err = writeShapefile(zw, "prescription", rx)
+	case PrescriptionISOXML:
+		var f io.Writer
+		if f, err = zw.Create("TASKDATA/TASKDATA.XML"); err == nil {
+			err = writeISOXMLTask(f, rx)
+		}
+	default:
+		err = fmt.Errorf("unknown prescription format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ISO 11783-10 elements (subset used for treatment-zone prescriptions)
+type isoTaskData struct {
+	XMLName      xml.Name `xml:"ISO11783_TaskData"`
+	VersionMajor int      `xml:"VersionMajor,attr"`
+	VersionMinor int      `xml:"VersionMinor,attr"`
+	Software     string   `xml:"ManagementSoftwareManufacturer,attr"`
+	SoftwareVer  string   `xml:"ManagementSoftwareVersion,attr"`
+	Origin       int      `xml:"DataTransferOrigin,attr"`
+	Partfield    isoPFD   `xml:"PFD"`
+	Task         isoTSK   `xml:"TSK"`
+}
+
+type isoPFD struct {
+	ID         string `xml:"A,attr"`
+	Designator string `xml:"C,attr"`
+	AreaM2     int64  `xml:"D,attr"`
+}
+
+type isoTSK struct {
+	ID             string   `xml:"A,attr"`
+	Designator     string   `xml:"B,attr"`
+	PartfieldRef   string   `xml:"E,attr"`
+	Status         int      `xml:"G,attr"`
+	OutOfFieldZone int      `xml:"J,attr"`
+	Zones          []isoTZN `xml:"TZN"`
+}
+
+type isoTZN struct {
+	Code       int      `xml:"A,attr"`
+	Designator string   `xml:"B,attr,omitempty"`
+	Polygons   []isoPLN `xml:"PLN"`
+	Values     []isoPDV `xml:"PDV"`
+}
+
+type isoPLN struct {
+	Type  int      `xml:"A,attr"`
+	Lines []isoLSG `xml:"LSG"`
+}
+
+type isoLSG struct {
+	Type   int      `xml:"A,attr"`
+	Points []isoPNT `xml:"PNT"`
+}
+
+type isoPNT struct {
+	Type int     `xml:"A,attr"`
+	Lat  float64 `xml:"C,attr"`
+	Lon  float64 `xml:"D,attr"`
+}
+
+type isoPDV struct {
+	DDI   string `xml:"A,attr"`
+	Value int64  `xml:"B,attr"`
+}
+
+// writeISOXMLTask writes a TASKDATA.XML with one treatment zone per rate.
+func writeISOXMLTask(w io.Writer, rx *Prescription) error {
+	totalHa := 0.0
+	task := isoTSK{
+		ID:             "TSK1",
+		Designator:     fmt.Sprintf("VRI %s %s", rx.FieldID, rx.CreatedAt.UTC().Format("2006-01-02 15:04")),
+		PartfieldRef:   "PFD1",
+		Status:         1, // planned
+		OutOfFieldZone: isoxmlOutOfFieldZone,
+	}
+	// Outside the field: apply nothing
+	task.Zones = append(task.Zones, isoTZN{
+		Code:       isoxmlOutOfFieldZone,
+		Designator: "out of field",
+		Values:     []isoPDV{{DDI: ddiVolumePerAreaRate, Value: 0}},
+	})
+
+	for _, zone := range rx.Zones {
+		tzn := isoTZN{
+			Code:       zone.ZoneID,
+			Designator: fmt.Sprintf("%.1f mm", zone.RateMM),
+			Values:     []isoPDV{{DDI: ddiVolumePerAreaRate, Value: int64(math.Round(zone.RateMM * mm3PerM2PerMMOfDepth))}},
+		}
+		for _, c := range zone.Cells {
+			ring := []isoPNT{
+				{isoxmlPointOther, c[1], c[0]},
+				{isoxmlPointOther, c[3], c[0]},
+				{isoxmlPointOther, c[3], c[2]},
+				{isoxmlPointOther, c[1], c[2]},
+				{isoxmlPointOther, c[1], c[0]},
+			}
+			tzn.Polygons = append(tzn.Polygons, isoPLN{
+				Type:  isoxmlTreatmentPolygon,
+				Lines: []isoLSG{{Type: isoxmlPolygonExterior, Points: ring}},
+			})
+		}
+		totalHa += zone.AreaHa
+		task.Zones = append(task.Zones, tzn)
+	}
+
+	doc := isoTaskData{
+		VersionMajor: 4,
+		VersionMinor: 3,
+		Software:     "FarmSense",
+		SoftwareVer:  "edge",
+		Origin:       1, // FMIS
+		Partfield:    isoPFD{ID: "PFD1", Designator: rx.FieldID, AreaM2: int64(math.Round(totalHa * 10000))},
+		Task:         task,
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to encode ISOXML task: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,566 @@
+// Water Budget - per-zone soil-water balance over the season
+// The grid's deficit is a snapshot from the probes; the budget is the
+// running account of what went in and out of each management zone:
+//
+//	depletion(t) = depletion(t-1) + ET - rain - applied,  floored at 0
+//
+// where anything that would push depletion below zero (the profile above
+// field capacity) is booked as drainage. Every cycle books the interval
+// since the previous one:
+//   - applied: the zone's flow meter (a flow_zones entry with the same
+//     zone_id) integrated over the interval and spread over the zone's
+//     area, otherwise the zone's irrigation runs, prorated by overlap: the
+//     ones ingested on this device (irrigation_events.go) and the ones
+//     other sources logged in the cloud's irrigation_events;
+//   - rain: the gauge rain assigned to the zone (rain_gauges), otherwise
+//     the field's weather_data rainfall;
+//   - ET: the crop model's ETc for the day, prorated (0 without a crop).
+//
+// The budget starts from the zone's measured deficit and restarts from it
+// after an outage longer than waterBudgetMaxGap, since nothing was booked
+// meanwhile, and when a lifecycle event starts a new season (see
+// field_lifecycle.go). Day totals per zone and season (the lifecycle's
+// season, else the crop's planting date, else the calendar year) are kept
+// in the local
+// water_budget table and upserted to the cloud water_budget_daily table.
+// Depletion is reported next to the measured deficit: a growing gap
+// points at a meter, a controller log or the crop coefficients.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	waterBudgetMaxGap = 72 * time.Hour
+	waterBudgetDay    = "2006-01-02"
+)
+
+// Applied water sources
+const (
+	AppliedSourceFlowMeter  = "flow_meter"
+	AppliedSourceController = "controller_log"
+	AppliedSourceNone       = "none"
+)
+
+// WaterBudgetDay is one zone's account for one day.
+type WaterBudgetDay struct {
+	ZoneID            string  `json:"zone_id"`
+	Season            string  `json:"season"`
+	Day               string  `json:"day"` // YYYY-MM-DD (UTC)
+	AppliedMM         float64 `json:"applied_mm"`
+	RainMM            float64 `json:"rain_mm"`
+	ETMM              float64 `json:"et_mm"`
+	DrainageMM        float64 `json:"drainage_mm"`
+	DepletionMM       float64 `json:"depletion_mm"`        // end of day
+	MeasuredDeficitMM float64 `json:"measured_deficit_mm"` // latest zone mean from the grid
+	AppliedSource     string  `json:"applied_source"`
+}
+
+// ZoneWaterBudget is a zone's season totals and current balance.
+type ZoneWaterBudget struct {
+	ZoneID            string    `json:"zone_id"`
+	Season            string    `json:"season"`
+	AppliedMM         float64   `json:"applied_mm"`
+	RainMM            float64   `json:"rain_mm"`
+	ETMM              float64   `json:"et_mm"`
+	DrainageMM        float64   `json:"drainage_mm"`
+	DepletionMM       float64   `json:"depletion_mm"`
+	MeasuredDeficitMM float64   `json:"measured_deficit_mm"`
+	DiscrepancyMM     float64   `json:"discrepancy_mm"` // depletion - measured deficit
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// waterBudget holds the running balance between cycles (Run goroutine only).
+type waterBudget struct {
+	last      time.Time
+	season    string
+	depletion map[string]float64 // zone_id -> mm below field capacity
+}
+
+func newWaterBudget() *waterBudget {
+	return &waterBudget{depletion: make(map[string]float64)}
+}
+
+// waterSeason names the season at for budget totals.
+func (ep *EdgeProcessor) waterSeason(at time.Time) string {
+	if s := ep.seasonAt(at); s.season != "" {
+		return s.season
+	}
+	if c := ep.config.Crop; c != nil && c.PlantingDate != "" {
+		return c.PlantingDate
+	}
+	return strconv.Itoa(at.UTC().Year())
+}
+
+// initWaterBudgetSchema creates the local budget table.
+func initWaterBudgetSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS water_budget (
+			field_id            TEXT    NOT NULL,
+			zone_id             TEXT    NOT NULL,
+			season              TEXT    NOT NULL,
+			day                 TEXT    NOT NULL,
+			applied_mm          REAL    NOT NULL DEFAULT 0,
+			rain_mm             REAL    NOT NULL DEFAULT 0,
+			et_mm               REAL    NOT NULL DEFAULT 0,
+			drainage_mm         REAL    NOT NULL DEFAULT 0,
+			depletion_mm        REAL    NOT NULL DEFAULT 0,
+			measured_deficit_mm REAL,
+			applied_source      TEXT,
+			updated_at          INTEGER NOT NULL,
+			synced              INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (field_id, zone_id, day)
+		)
+	`)
+	return err
+}
+
+// loadWaterBudget restores each zone's latest balance from the local table.
+func (ep *EdgeProcessor) loadWaterBudget() error {
+	rows, err := ep.localDB.Query(`
+		SELECT zone_id, season, depletion_mm, updated_at
+		FROM water_budget b
+		WHERE field_id = ? AND updated_at = (
+			SELECT MAX(updated_at) FROM water_budget WHERE field_id = b.field_id AND zone_id = b.zone_id
+		)
+	`, ep.config.FieldID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var zoneID, season string
+		var depletion float64
+		var updated int64
+		if err := rows.Scan(&zoneID, &season, &depletion, &updated); err != nil {
+			return err
+		}
+		ep.budget.depletion[zoneID] = depletion
+		if t := time.Unix(updated, 0); t.After(ep.budget.last) {
+			ep.budget.last, ep.budget.season = t, season
+		}
+	}
+	return rows.Err()
+}
+
+// updateWaterBudget books the interval since the previous cycle for each
+// zone in stats.
+func (ep *EdgeProcessor) updateWaterBudget(stats []ZoneStats, now time.Time) {
+	b := ep.budget
+	if len(stats) == 0 {
+		return
+	}
+	from := b.last
+	b.last = now
+	season := ep.waterSeason(now)
+	newSeason := b.season != "" && season != b.season
+	b.season = season
+	restart := from.IsZero() || now.Sub(from) > waterBudgetMaxGap || !now.After(from) || newSeason
+	if restart && !from.IsZero() {
+		ep.cycleLog.Info("Restarting water budget from measured deficit", "component", "water_budget",
+			"gap_h", now.Sub(from).Hours(), "season", season, "new_season", newSeason)
+	}
+
+	etMM := 0.0
+	if crop := ep.cycleCrop; crop != nil && !restart {
+		etMM = crop.ETcMM * now.Sub(from).Hours() / 24
+	}
+	var fieldRainMM float64
+	var meterLiters map[string]float64
+	if !restart {
+		var err error
+		if len(ep.config.RainGauges) == 0 {
+			if fieldRainMM, err = ep.fetchRainfallBetween(from, now); err != nil {
+				ep.cycleLog.Warn("Rainfall lookup failed for water budget", "component", "water_budget", "error", err)
+			}
+		}
+		if meterLiters, err = ep.fetchMeteredLiters(from, now); err != nil {
+			ep.cycleLog.Warn("Flow meter lookup failed for water budget", "component", "water_budget", "error", err)
+		}
+	}
+	meters := make(map[string]string, len(ep.config.FlowZones))
+	for _, z := range ep.config.FlowZones {
+		meters[z.ZoneID] = z.MeterID
+	}
+
+	days := make([]WaterBudgetDay, 0, len(stats))
+	for _, s := range stats {
+		day := WaterBudgetDay{
+			ZoneID:            s.ZoneID,
+			Season:            season,
+			Day:               now.UTC().Format(waterBudgetDay),
+			MeasuredDeficitMM: s.WaterDeficitMeanMM,
+			AppliedSource:     AppliedSourceNone,
+		}
+		depletion, known := b.depletion[s.ZoneID]
+		if restart || !known {
+			day.DepletionMM = s.WaterDeficitMeanMM
+			b.depletion[s.ZoneID] = day.DepletionMM
+			days = append(days, day)
+			continue
+		}
+
+		if meterID, ok := meters[s.ZoneID]; ok && s.AreaM2 > 0 {
+			day.AppliedMM = meterLiters[meterID] / s.AreaM2 // 1 L over 1 m² = 1 mm
+			day.AppliedSource = AppliedSourceFlowMeter
+		} else if applied, ok, err := ep.fetchControllerApplied(s.ZoneID, s.AreaM2, from, now); err != nil {
+			ep.cycleLog.Warn("Irrigation event lookup failed for water budget", "component", "water_budget",
+				"zone_id", s.ZoneID, "error", err)
+		} else if ok {
+			day.AppliedMM = applied
+			day.AppliedSource = AppliedSourceController
+		}
+		day.RainMM = fieldRainMM
+		if len(ep.config.RainGauges) > 0 {
+			day.RainMM = s.RainfallMM
+		}
+		day.ETMM = etMM
+
+		depletion += day.ETMM - day.RainMM - day.AppliedMM
+		if depletion < 0 {
+			day.DrainageMM = -depletion
+			depletion = 0
+		}
+		day.DepletionMM = depletion
+		b.depletion[s.ZoneID] = depletion
+		days = append(days, day)
+	}
+
+	if err := ep.storeWaterBudgetLocal(days, now); err != nil {
+		ep.cycleLog.Error("Failed to store water budget locally", "component", "water_budget", "error", err)
+		return
+	}
+	ep.stateMu.Lock()
+	ep.budgetUpdatedAt = now
+	ep.stateMu.Unlock()
+	ep.syncWaterBudget()
+}
+
+// fetchRainfallBetween sums weather_data rainfall in (from, to], or the
+// field's weather stations' when they report it.
+func (ep *EdgeProcessor) fetchRainfallBetween(from, to time.Time) (float64, error) {
+	if len(ep.config.WeatherStations) > 0 {
+		if mm, n, err := ep.stationWeatherSum("rainfall_mm", from, to); err != nil || n > 0 {
+			return mm, err
+		}
+	}
+	query := `
+		SELECT COALESCE(SUM(rainfall_mm), 0)
+		FROM weather_data
+		WHERE field_id = $1
+		  AND timestamp > $2
+		  AND timestamp <= $3
+		  AND rainfall_mm IS NOT NULL
+	`
+
+	db := ep.cloud.DB()
+	if db == nil {
+		db = ep.localDB
+	}
+
+	var mm float64
+	err := db.QueryRow(query, ep.config.FieldID, from, to).Scan(&mm)
+	return mm, err
+}
+
+// fetchMeteredLiters integrates each meter's flow over (from, to]. Samples
+// further apart than clogSetGap are treated as the meter being off.
+func (ep *EdgeProcessor) fetchMeteredLiters(from, to time.Time) (map[string]float64, error) {
+	if len(ep.config.FlowZones) == 0 {
+		return nil, nil
+	}
+	query := `
+		SELECT meter_id, timestamp, flow_lpm
+		FROM zone_flow_readings
+		WHERE field_id = $1
+		  AND timestamp > $2
+		  AND timestamp <= $3
+		ORDER BY meter_id, timestamp ASC
+	`
+
+	db := ep.cloud.DB()
+	if db == nil {
+		db = ep.localDB
+	}
+
+	// Start a gap early so the run in progress at from is counted from from
+	rows, err := db.Query(query, ep.config.FieldID, from.Add(-clogSetGap), to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	liters := make(map[string]float64)
+	var prev FlowReading
+	for rows.Next() {
+		var r FlowReading
+		if err := rows.Scan(&r.MeterID, &r.Timestamp, &r.FlowLPM); err != nil {
+			return nil, err
+		}
+		if r.MeterID == prev.MeterID && r.Timestamp.Sub(prev.Timestamp) <= clogSetGap && r.Timestamp.After(from) {
+			start := prev.Timestamp
+			if start.Before(from) {
+				start = from
+			}
+			liters[r.MeterID] += (prev.FlowLPM + r.FlowLPM) / 2 * r.Timestamp.Sub(start).Minutes()
+		}
+		prev = r
+	}
+	return liters, rows.Err()
+}
+
+// irrigationRun is a logged run's span and what it applied.
+type irrigationRun struct {
+	start, end time.Time
+	mm, liters float64
+}
+
+// fetchControllerApplied returns the depth logged for zoneID in (from,
+// to], prorating runs that straddle the interval. ok is false when the
+// zone has no logged runs.
+func (ep *EdgeProcessor) fetchControllerApplied(zoneID string, areaM2 float64, from, to time.Time) (float64, bool, error) {
+	runs, err := ep.localIrrigationRuns(zoneID, from, to)
+	if err != nil {
+		return 0, false, err
+	}
+	if db := ep.cloud.DB(); db != nil {
+		logged, err := ep.cloudIrrigationRuns(db, zoneID, from, to)
+		if err != nil {
+			ep.cycleLog.Warn("Cloud irrigation event lookup failed, using local runs", "component", "water_budget",
+				"zone_id", zoneID, "error", err)
+		}
+		runs = append(runs, logged...)
+	}
+
+	total := 0.0
+	for _, r := range runs {
+		mm := r.mm
+		if mm == 0 && r.liters > 0 && areaM2 > 0 {
+			mm = r.liters / areaM2
+		}
+		dur := r.end.Sub(r.start)
+		if dur <= 0 {
+			total += mm
+			continue
+		}
+		overlapStart, overlapEnd := r.start, r.end
+		if overlapStart.Before(from) {
+			overlapStart = from
+		}
+		if overlapEnd.After(to) {
+			overlapEnd = to
+		}
+		total += mm * overlapEnd.Sub(overlapStart).Seconds() / dur.Seconds()
+	}
+	return total, len(runs) > 0, nil
+}
+
+// cloudIrrigationRuns returns the zone's runs in the cloud table overlapping
+// (from, to], except the ones this device uploaded.
+func (ep *EdgeProcessor) cloudIrrigationRuns(db *sql.DB, zoneID string, from, to time.Time) ([]irrigationRun, error) {
+	rows, err := db.Query(`
+		SELECT started_at, ended_at, COALESCE(applied_mm, 0), COALESCE(volume_l, 0)
+		FROM irrigation_events
+		WHERE field_id = $1
+		  AND zone_id = $2
+		  AND ended_at > $3
+		  AND started_at <= $4
+		  AND edge_device_id IS DISTINCT FROM $5
+	`, ep.config.FieldID, zoneID, from, to, ep.deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]irrigationRun, 0)
+	for rows.Next() {
+		var r irrigationRun
+		if err := rows.Scan(&r.start, &r.end, &r.mm, &r.liters); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// storeWaterBudgetLocal adds the cycle's bookings to each zone's day.
+func (ep *EdgeProcessor) storeWaterBudgetLocal(days []WaterBudgetDay, now time.Time) error {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, d := range days {
+		if _, err := tx.Exec(`
+			INSERT INTO water_budget
+				(field_id, zone_id, season, day, applied_mm, rain_mm, et_mm, drainage_mm, depletion_mm,
+				 measured_deficit_mm, applied_source, updated_at, synced)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)
+			ON CONFLICT (field_id, zone_id, day) DO UPDATE SET
+				season = excluded.season,
+				applied_mm = applied_mm + excluded.applied_mm,
+				rain_mm = rain_mm + excluded.rain_mm,
+				et_mm = et_mm + excluded.et_mm,
+				drainage_mm = drainage_mm + excluded.drainage_mm,
+				depletion_mm = excluded.depletion_mm,
+				measured_deficit_mm = excluded.measured_deficit_mm,
+				applied_source = CASE WHEN excluded.applied_source = ? THEN applied_source ELSE excluded.applied_source END,
+				updated_at = excluded.updated_at,
+				synced = 0
+		`, ep.config.FieldID, d.ZoneID, d.Season, d.Day, d.AppliedMM, d.RainMM, d.ETMM, d.DrainageMM, d.DepletionMM,
+			d.MeasuredDeficitMM, d.AppliedSource, now.Unix(), AppliedSourceNone); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// WaterBudgetDays returns the field's day rows for season, oldest first,
+// optionally for one zone.
+func (ep *EdgeProcessor) WaterBudgetDays(season, zoneID string) ([]WaterBudgetDay, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT zone_id, season, day, applied_mm, rain_mm, et_mm, drainage_mm, depletion_mm,
+		       COALESCE(measured_deficit_mm, 0), COALESCE(applied_source, '')
+		FROM water_budget
+		WHERE field_id = ? AND season = ? AND (? = '' OR zone_id = ?)
+		ORDER BY day, zone_id
+	`, ep.config.FieldID, season, zoneID, zoneID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query water budget: %v", err)
+	}
+	defer rows.Close()
+
+	out := make([]WaterBudgetDay, 0)
+	for rows.Next() {
+		var d WaterBudgetDay
+		if err := rows.Scan(&d.ZoneID, &d.Season, &d.Day, &d.AppliedMM, &d.RainMM, &d.ETMM, &d.DrainageMM,
+			&d.DepletionMM, &d.MeasuredDeficitMM, &d.AppliedSource); err != nil {
+			return nil, fmt.Errorf("failed to read water budget: %v", err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// WaterBudget returns each zone's season totals and latest balance.
+// An empty season means the current one.
+func (ep *EdgeProcessor) WaterBudget(season string) ([]ZoneWaterBudget, error) {
+	if season == "" {
+		season = ep.waterSeason(ep.clock.Now())
+	}
+	days, err := ep.WaterBudgetDays(season, "")
+	if err != nil {
+		return nil, err
+	}
+	byZone := make(map[string]*ZoneWaterBudget)
+	for _, d := range days {
+		z, ok := byZone[d.ZoneID]
+		if !ok {
+			z = &ZoneWaterBudget{ZoneID: d.ZoneID, Season: season}
+			byZone[d.ZoneID] = z
+		}
+		z.AppliedMM += d.AppliedMM
+		z.RainMM += d.RainMM
+		z.ETMM += d.ETMM
+		z.DrainageMM += d.DrainageMM
+		z.DepletionMM = d.DepletionMM // days are oldest first
+		z.MeasuredDeficitMM = d.MeasuredDeficitMM
+	}
+	ep.stateMu.RLock()
+	updated := ep.budgetUpdatedAt
+	ep.stateMu.RUnlock()
+
+	out := make([]ZoneWaterBudget, 0, len(byZone))
+	for _, z := range byZone {
+		z.DiscrepancyMM = z.DepletionMM - z.MeasuredDeficitMM
+		z.UpdatedAt = updated
+		out = append(out, *z)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ZoneID < out[j].ZoneID })
+	return out, nil
+}
+
+// syncWaterBudget upserts changed day rows to the cloud, leaving them
+// flagged for the next sync while offline.
+func (ep *EdgeProcessor) syncWaterBudget() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT zone_id, season, day, applied_mm, rain_mm, et_mm, drainage_mm, depletion_mm,
+		       COALESCE(measured_deficit_mm, 0), COALESCE(applied_source, ''), updated_at
+		FROM water_budget
+		WHERE field_id = ? AND synced = 0
+	`, ep.config.FieldID)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read unsynced water budget", "component", "water_budget", "error", err)
+		return
+	}
+	type pending struct {
+		WaterBudgetDay
+		updated int64
+	}
+	batch := make([]pending, 0)
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.ZoneID, &p.Season, &p.Day, &p.AppliedMM, &p.RainMM, &p.ETMM, &p.DrainageMM,
+			&p.DepletionMM, &p.MeasuredDeficitMM, &p.AppliedSource, &p.updated); err != nil {
+			rows.Close()
+			ep.cycleLog.Error("Failed to read unsynced water budget", "component", "water_budget", "error", err)
+			return
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	defer tx.Rollback()
+	for _, p := range batch {
+		if _, err := tx.Exec(`
+			INSERT INTO water_budget_daily
+				(field_id, zone_id, day, season, applied_mm, rain_mm, et_mm, drainage_mm, depletion_mm,
+				 measured_deficit_mm, applied_source, edge_device_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (field_id, zone_id, day) DO UPDATE SET
+				season = EXCLUDED.season, applied_mm = EXCLUDED.applied_mm, rain_mm = EXCLUDED.rain_mm,
+				et_mm = EXCLUDED.et_mm, drainage_mm = EXCLUDED.drainage_mm, depletion_mm = EXCLUDED.depletion_mm,
+				measured_deficit_mm = EXCLUDED.measured_deficit_mm, applied_source = EXCLUDED.applied_source,
+				edge_device_id = EXCLUDED.edge_device_id
+		`, ep.config.FieldID, p.ZoneID, p.Day, p.Season, p.AppliedMM, p.RainMM, p.ETMM, p.DrainageMM,
+			p.DepletionMM, p.MeasuredDeficitMM, p.AppliedSource, ep.deviceID); err != nil {
+			ep.cycleLog.Warn("Water budget upload failed, keeping rows queued", "component", "water_budget", "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+
+	// Rows updated since they were read stay queued
+	for _, p := range batch {
+		if _, err := ep.localDB.Exec(`
+			UPDATE water_budget SET synced = 1
+			WHERE field_id = ? AND zone_id = ? AND day = ? AND updated_at = ?
+		`, ep.config.FieldID, p.ZoneID, p.Day, p.updated); err != nil {
+			ep.cycleLog.Warn("Failed to mark water budget synced", "component", "water_budget", "error", err)
+			return
+		}
+	}
+}
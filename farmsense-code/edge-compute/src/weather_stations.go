@@ -0,0 +1,813 @@
+// Weather Stations - on-farm stations polled into weather_observations
+// Each weather_stations entry is one station and the driver that reads it:
+//
+//	davis_weatherlink  WeatherLink v2 current conditions for
+//	                   weatherlink_station_id, authenticated with
+//	                   weatherlink_api_key and the account's API secret
+//	                   (FARMSENSE_WEATHERLINK_API_SECRET). Imperial units
+//	                   are converted; rain is the rise in the day's total
+//	                   since the previous poll.
+//	campbell_csv       a Campbell Scientific TOA5 table file (path) as
+//	                   LoggerNet or a logger's file export writes it. Rows
+//	                   newer than the last one stored are read; columns
+//	                   maps logger column names to observation fields and
+//	                   defaults to the CR1000 standard program's names.
+//	                   Logger clocks keep local time, so timezone (IANA,
+//	                   default UTC) places them.
+//	atmos41            a METER ATMOS 41 on an SDI-12 adapter (device,
+//	                   address), read with aM! as serial probes are
+//	                   (serial_ingest.go). values maps the measurement's
+//	                   positions and defaults to METER's layout: solar,
+//	                   precipitation, strikes, strike distance, wind speed,
+//	                   direction, gust, air temperature, vapour pressure,
+//	                   atmospheric pressure.
+//
+// Observation fields are temperature_c, humidity_pct, pressure_hpa,
+// wind_speed_ms, wind_direction_deg, gust_ms, rainfall_mm (over the
+// interval since the previous observation), solar_radiation_wm2 and
+// vapor_pressure_kpa, which stands in for humidity when a station reports
+// no RH. When temperature, humidity, wind and solar radiation are all
+// there, each observation carries reference ET0 over its interval, by the
+// FAO-56 hourly Penman-Monteith equation with the wind brought to 2 m from
+// wind_height_m (net long-wave taken at a fixed 0.8 of clear-sky
+// radiation, since there is no clear-sky model here). Intervals over two
+// hours are not given ET0.
+//
+// Observations land in the local weather_observations table, one row per
+// station and timestamp, and are uploaded to the cloud table of the same
+// name (migration 036) by a watermark in sync_state. With stations
+// configured, the crop model's daily ET0 (and with it the moisture
+// forecast's persistence days), the water budget and trafficability take
+// rain and ET0 from them, falling back to the cloud weather_data when the
+// stations report none, and a station's air temperature counts towards
+// frost and heat events (microclimate.go). GET /weather/stations has each
+// station's poll counters and GET /weather/observations the field's
+// observations.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Weather station drivers
+const (
+	WeatherDavis    = "davis_weatherlink"
+	WeatherCampbell = "campbell_csv"
+	WeatherATMOS41  = "atmos41"
+)
+
+const (
+	defaultWeatherPollSec  = 300
+	defaultWindHeightM     = 2.0
+	defaultWeatherLinkURL  = "https://api.weatherlink.com/v2"
+	weatherFetchTimeout    = 30 * time.Second
+	weatherMaxET0Interval  = 2 * time.Hour
+	weatherSyncBatch       = 1000
+	defaultWeatherLookback = 7 * 24 * time.Hour
+	stationTempMaxAge      = 30 * time.Minute
+	standardPressureKPa    = 101.3
+)
+
+// campbellColumns are the CR1000 standard program's column names.
+var campbellColumns = map[string]string{
+	"AirTC_Avg":   "temperature_c",
+	"RH":          "humidity_pct",
+	"BP_mbar_Avg": "pressure_hpa",
+	"WS_ms_Avg":   "wind_speed_ms",
+	"WindDir":     "wind_direction_deg",
+	"WS_ms_Max":   "gust_ms",
+	"Rain_mm_Tot": "rainfall_mm",
+	"SlrW_Avg":    "solar_radiation_wm2",
+}
+
+// atmos41Values is the ATMOS 41's aM! layout.
+var atmos41Values = []SerialValue{
+	{Name: "solar_radiation_wm2", Index: 0},
+	{Name: "rainfall_mm", Index: 1},
+	{Name: "wind_speed_ms", Index: 4},
+	{Name: "wind_direction_deg", Index: 5},
+	{Name: "gust_ms", Index: 6},
+	{Name: "temperature_c", Index: 7},
+	{Name: "vapor_pressure_kpa", Index: 8},
+	{Name: "pressure_hpa", Index: 9, Scale: 10},
+}
+
+// WeatherStation is one on-farm station and how to read it.
+type WeatherStation struct {
+	StationID   string  `json:"station_id"`
+	FieldID     string  `json:"field_id"` // default: field_id
+	Kind        string  `json:"kind"`     // davis_weatherlink | campbell_csv | atmos41
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	PollSec     int     `json:"poll_sec"`      // Poll interval (default 300)
+	WindHeightM float64 `json:"wind_height_m"` // Anemometer height, for ET0 (default 2)
+
+	WeatherLinkStationID string `json:"weatherlink_station_id"` // davis_weatherlink
+	WeatherLinkAPIKey    string `json:"weatherlink_api_key"`
+	WeatherLinkURL       string `json:"weatherlink_url"` // default https://api.weatherlink.com/v2
+
+	Path     string            `json:"path"`     // campbell_csv: TOA5 table file
+	Columns  map[string]string `json:"columns"`  // Logger column → observation field (default CR1000 names)
+	Timezone string            `json:"timezone"` // Logger clock's zone (default UTC)
+
+	Device  string        `json:"device"`  // atmos41: SDI-12 adapter, e.g. /dev/ttyUSB1
+	Baud    int           `json:"baud"`    // Adapter line speed (default 9600)
+	Address string        `json:"address"` // SDI-12 address (default 0)
+	Values  []SerialValue `json:"values"`  // Measurement positions (default METER's layout)
+}
+
+// WeatherObservation is one normalized station reading; nil = not reported.
+type WeatherObservation struct {
+	StationID     string    `json:"station_id"`
+	FieldID       string    `json:"field_id"`
+	Timestamp     time.Time `json:"timestamp"`
+	Source        string    `json:"source"` // the driver
+	TemperatureC  *float64  `json:"temperature_c,omitempty"`
+	HumidityPct   *float64  `json:"humidity_pct,omitempty"`
+	PressureHPa   *float64  `json:"pressure_hpa,omitempty"`
+	WindSpeedMS   *float64  `json:"wind_speed_ms,omitempty"`
+	WindDirDeg    *float64  `json:"wind_direction_deg,omitempty"`
+	GustMS        *float64  `json:"gust_ms,omitempty"`
+	RainfallMM    *float64  `json:"rainfall_mm,omitempty"`
+	SolarWM2      *float64  `json:"solar_radiation_wm2,omitempty"`
+	ET0MM         *float64  `json:"et0_mm,omitempty"`
+	vaporPressure *float64  // kPa, folded into HumidityPct
+}
+
+// field returns the observation's value for a field name, nil if unknown.
+func (o *WeatherObservation) field(name string) **float64 {
+	switch name {
+	case "temperature_c":
+		return &o.TemperatureC
+	case "humidity_pct":
+		return &o.HumidityPct
+	case "pressure_hpa":
+		return &o.PressureHPa
+	case "wind_speed_ms":
+		return &o.WindSpeedMS
+	case "wind_direction_deg":
+		return &o.WindDirDeg
+	case "gust_ms":
+		return &o.GustMS
+	case "rainfall_mm":
+		return &o.RainfallMM
+	case "solar_radiation_wm2":
+		return &o.SolarWM2
+	case "vapor_pressure_kpa":
+		return &o.vaporPressure
+	}
+	return nil
+}
+
+// WeatherStationStatus is per-station poll state exposed by the API.
+type WeatherStationStatus struct {
+	StationID     string    `json:"station_id"`
+	Kind          string    `json:"kind"`
+	Polls         int       `json:"polls"`
+	Stored        int       `json:"stored"`
+	Errors        int       `json:"errors"`
+	LastPollAt    time.Time `json:"last_poll_at"`
+	LastObserved  time.Time `json:"last_observed_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	lastDailyRain *float64  // davis_weatherlink: the day's total at the last poll
+}
+
+func initWeatherSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS weather_observations (
+			id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+			station_id          TEXT    NOT NULL,
+			field_id            TEXT    NOT NULL,
+			timestamp           INTEGER NOT NULL,
+			source              TEXT    NOT NULL,
+			temperature_c       REAL,
+			humidity_pct        REAL,
+			pressure_hpa        REAL,
+			wind_speed_ms       REAL,
+			wind_direction_deg  REAL,
+			gust_ms             REAL,
+			rainfall_mm         REAL,
+			solar_radiation_wm2 REAL,
+			et0_mm              REAL,
+			UNIQUE (station_id, timestamp)
+		);
+		CREATE INDEX IF NOT EXISTS weather_observations_field_time ON weather_observations (field_id, timestamp);
+	`)
+	return err
+}
+
+// checkWeatherStations validates weather_stations.
+func checkWeatherStations(stations []WeatherStation) error {
+	ids := make(map[string]bool, len(stations))
+	for i, st := range stations {
+		switch {
+		case st.StationID == "":
+			return fmt.Errorf("[%d] needs station_id", i)
+		case ids[st.StationID]:
+			return fmt.Errorf("[%d]: duplicate station_id %q", i, st.StationID)
+		case st.PollSec < 0 || st.WindHeightM < 0:
+			return fmt.Errorf("[%d]: poll_sec and wind_height_m must be >= 0", i)
+		}
+		ids[st.StationID] = true
+		switch st.Kind {
+		case WeatherDavis:
+			if st.WeatherLinkStationID == "" || st.WeatherLinkAPIKey == "" {
+				return fmt.Errorf("[%d] needs weatherlink_station_id and weatherlink_api_key", i)
+			}
+		case WeatherCampbell:
+			if st.Path == "" {
+				return fmt.Errorf("[%d] needs path", i)
+			}
+			if _, err := time.LoadLocation(st.Timezone); err != nil {
+				return fmt.Errorf("[%d].timezone: %v", i, err)
+			}
+			for column, name := range st.Columns {
+				if (&WeatherObservation{}).field(name) == nil {
+					return fmt.Errorf("[%d].columns[%s]: unknown observation field %q", i, column, name)
+				}
+			}
+		case WeatherATMOS41:
+			if st.Device == "" {
+				return fmt.Errorf("[%d] needs device", i)
+			}
+			if st.Address != "" && !sdi12AddressPattern.MatchString(st.Address) {
+				return fmt.Errorf("[%d].address must be one of 0-9, a-z, A-Z (got %q)", i, st.Address)
+			}
+			if st.Baud != 0 && !serialBauds[st.Baud] {
+				return fmt.Errorf("[%d].baud %d is not a supported speed", i, st.Baud)
+			}
+			for k, v := range st.Values {
+				if (&WeatherObservation{}).field(v.Name) == nil || v.Index < 0 {
+					return fmt.Errorf("[%d].values[%d]: needs an observation field and an index >= 0", i, k)
+				}
+			}
+		default:
+			return fmt.Errorf("[%d].kind must be davis_weatherlink, campbell_csv or atmos41 (got %q)", i, st.Kind)
+		}
+	}
+	return nil
+}
+
+// WeatherIngestor polls the stations into the local cache.
+type WeatherIngestor struct {
+	stations []WeatherStation
+	secret   string // WeatherLink API secret
+	localDB  *sql.DB
+	clock    *ReferenceClock
+
+	mu     sync.Mutex
+	status map[string]*WeatherStationStatus // by station_id
+	logger *slog.Logger
+}
+
+func NewWeatherIngestor(config EdgeConfig, localDB *sql.DB, clock *ReferenceClock) *WeatherIngestor {
+	in := &WeatherIngestor{
+		secret:  config.WeatherLinkAPISecret,
+		localDB: localDB,
+		clock:   clock,
+		status:  make(map[string]*WeatherStationStatus),
+		logger:  slog.With("component", "weather"),
+	}
+	for _, st := range config.WeatherStations {
+		if st.FieldID == "" {
+			st.FieldID = config.FieldID
+		}
+		if st.Address == "" {
+			st.Address = "0"
+		}
+		if len(st.Values) == 0 {
+			st.Values = atmos41Values
+		}
+		if len(st.Columns) == 0 {
+			st.Columns = campbellColumns
+		}
+		in.stations = append(in.stations, st)
+		in.status[st.StationID] = &WeatherStationStatus{StationID: st.StationID, Kind: st.Kind}
+	}
+	return in
+}
+
+// Start creates the observations table and starts a poller per station.
+func (in *WeatherIngestor) Start() error {
+	if err := initWeatherSchema(in.localDB); err != nil {
+		return fmt.Errorf("failed to create weather observations table: %v", err)
+	}
+	for _, st := range in.stations {
+		var last sql.NullInt64
+		if err := in.localDB.QueryRow(`SELECT MAX(timestamp) FROM weather_observations WHERE station_id = ?`,
+			st.StationID).Scan(&last); err != nil {
+			return fmt.Errorf("failed to read last weather observation: %v", err)
+		}
+		if last.Valid {
+			in.status[st.StationID].LastObserved = time.UnixMilli(last.Int64).UTC()
+		}
+		go in.pollLoop(st)
+	}
+	in.logger.Info("Weather station ingest started", "stations", len(in.stations))
+	return nil
+}
+
+func (in *WeatherIngestor) pollLoop(st WeatherStation) {
+	interval := time.Duration(st.PollSec) * time.Second
+	if interval <= 0 {
+		interval = defaultWeatherPollSec * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		in.poll(st)
+		<-ticker.C
+	}
+}
+
+// poll reads a station once and stores what it has that is new.
+func (in *WeatherIngestor) poll(st WeatherStation) {
+	in.mu.Lock()
+	status := *in.status[st.StationID]
+	in.mu.Unlock()
+
+	var obs []WeatherObservation
+	var err error
+	switch st.Kind {
+	case WeatherDavis:
+		var daily *float64
+		var o WeatherObservation
+		if o, daily, err = in.readWeatherLink(st); err == nil {
+			o.RainfallMM = rainSincePoll(status.lastDailyRain, daily)
+			status.lastDailyRain = daily
+			obs = []WeatherObservation{o}
+		}
+	case WeatherCampbell:
+		obs, err = readCampbellFile(st, status.LastObserved)
+	case WeatherATMOS41:
+		var o WeatherObservation
+		if o, err = in.readATMOS41(st); err == nil {
+			obs = []WeatherObservation{o}
+		}
+	}
+
+	stored := 0
+	for _, o := range obs {
+		if !o.Timestamp.After(status.LastObserved) {
+			continue // Davis current conditions repeat until the next archive
+		}
+		o.StationID, o.FieldID, o.Source = st.StationID, st.FieldID, st.Kind
+		completeObservation(&o, status.LastObserved, st.windHeight())
+		if err = storeWeatherObservation(in.localDB, o); err != nil {
+			break
+		}
+		status.LastObserved = o.Timestamp
+		stored++
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	s := in.status[st.StationID]
+	s.Polls++
+	s.LastPollAt = time.Now()
+	s.Stored += stored
+	s.LastObserved, s.lastDailyRain = status.LastObserved, status.lastDailyRain
+	if err != nil {
+		s.Errors++
+		s.LastError = err.Error()
+		in.logger.Warn("Weather station poll failed", "station_id", st.StationID, "kind", st.Kind, "error", err)
+	} else {
+		s.LastError = ""
+	}
+}
+
+// Status returns per-station poll counters.
+func (in *WeatherIngestor) Status() []WeatherStationStatus {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := make([]WeatherStationStatus, 0, len(in.status))
+	for _, st := range in.status {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StationID < out[j].StationID })
+	return out
+}
+
+func (st WeatherStation) windHeight() float64 {
+	if st.WindHeightM <= 0 {
+		return defaultWindHeightM
+	}
+	return st.WindHeightM
+}
+
+// rainSincePoll is the rise in a day's rain total, nil without a previous
+// total; a lower total means the day rolled over.
+func rainSincePoll(previous, total *float64) *float64 {
+	if previous == nil || total == nil {
+		return nil
+	}
+	rain := *total - *previous
+	if rain < 0 {
+		rain = *total
+	}
+	return &rain
+}
+
+// readWeatherLink fetches a Davis station's current conditions and the
+// day's rain total.
+func (in *WeatherIngestor) readWeatherLink(st WeatherStation) (WeatherObservation, *float64, error) {
+	base := st.WeatherLinkURL
+	if base == "" {
+		base = defaultWeatherLinkURL
+	}
+	u := strings.TrimRight(base, "/") + "/current/" + url.PathEscape(st.WeatherLinkStationID) +
+		"?api-key=" + url.QueryEscape(st.WeatherLinkAPIKey)
+	ctx, cancel := context.WithTimeout(context.Background(), weatherFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return WeatherObservation{}, nil, err
+	}
+	req.Header.Set("X-Api-Secret", in.secret)
+	resp, err := forecastHTTPClient.Do(req)
+	if err != nil {
+		return WeatherObservation{}, nil, fmt.Errorf("failed to fetch WeatherLink conditions: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return WeatherObservation{}, nil, fmt.Errorf("WeatherLink returned %s", resp.Status)
+	}
+	return parseWeatherLinkCurrent(resp.Body)
+}
+
+// parseWeatherLinkCurrent merges the sensors of a WeatherLink v2 current
+// conditions document into one observation.
+func parseWeatherLinkCurrent(r io.Reader) (WeatherObservation, *float64, error) {
+	var doc struct {
+		Sensors []struct {
+			Data []map[string]interface{} `json:"data"`
+		} `json:"sensors"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return WeatherObservation{}, nil, fmt.Errorf("invalid WeatherLink response: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, s := range doc.Sensors {
+		for _, d := range s.Data {
+			for k, v := range d {
+				if x, ok := v.(float64); ok {
+					values[k] = x
+				}
+			}
+		}
+	}
+	ts, ok := values["ts"]
+	if !ok {
+		return WeatherObservation{}, nil, fmt.Errorf("WeatherLink response has no conditions")
+	}
+	var o WeatherObservation
+	o.Timestamp = time.Unix(int64(ts), 0).UTC()
+	set := func(key string, into **float64, convert func(float64) float64) {
+		if x, ok := values[key]; ok {
+			x = convert(x)
+			*into = &x
+		}
+	}
+	same := func(x float64) float64 { return x }
+	mph := func(x float64) float64 { return x * 0.44704 }
+	set("temp", &o.TemperatureC, func(f float64) float64 { return (f - 32) * 5 / 9 })
+	set("hum", &o.HumidityPct, same)
+	set("bar_absolute", &o.PressureHPa, func(inHg float64) float64 { return inHg * 33.8639 })
+	set("wind_speed_avg_last_10_min", &o.WindSpeedMS, mph)
+	set("wind_dir_scalar_avg_last_10_min", &o.WindDirDeg, same)
+	set("wind_speed_hi_last_10_min", &o.GustMS, mph)
+	set("solar_rad", &o.SolarWM2, same)
+	var daily *float64
+	set("rainfall_daily_mm", &daily, same)
+	return o, daily, nil
+}
+
+// readCampbellFile reads the rows of a TOA5 file newer than after.
+func readCampbellFile(st WeatherStation, after time.Time) ([]WeatherObservation, error) {
+	f, err := os.Open(st.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open logger file: %v", err)
+	}
+	defer f.Close()
+	loc, err := time.LoadLocation(st.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return parseTOA5(bufio.NewReader(f), st.Columns, loc, after)
+}
+
+// parseTOA5 decodes a TOA5 table: an environment line, column names,
+// units and processing, then one row per record.
+func parseTOA5(r io.Reader, columns map[string]string, loc *time.Location, after time.Time) ([]WeatherObservation, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header := make([][]string, 0, 4)
+	for len(header) < 4 {
+		rec, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("incomplete TOA5 header: %v", err)
+		}
+		header = append(header, rec)
+	}
+	if len(header[0]) == 0 || header[0][0] != "TOA5" {
+		return nil, fmt.Errorf("not a TOA5 file")
+	}
+	names := header[1]
+	timeCol := -1
+	for i, name := range names {
+		if name == "TIMESTAMP" {
+			timeCol = i
+		}
+	}
+	if timeCol < 0 {
+		return nil, fmt.Errorf("TOA5 file has no TIMESTAMP column")
+	}
+
+	var out []WeatherObservation
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return out, fmt.Errorf("bad TOA5 row: %v", err)
+		}
+		if len(rec) != len(names) {
+			continue // a row the logger is still writing
+		}
+		at, err := time.ParseInLocation("2006-01-02 15:04:05", strings.SplitN(rec[timeCol], ".", 2)[0], loc)
+		if err != nil {
+			return out, fmt.Errorf("bad TOA5 timestamp %q", rec[timeCol])
+		}
+		if !at.After(after) {
+			continue
+		}
+		o := WeatherObservation{Timestamp: at.UTC()}
+		for i, name := range names {
+			target := o.field(columns[name])
+			if target == nil {
+				continue
+			}
+			x, err := strconv.ParseFloat(rec[i], 64)
+			if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+				continue // NAN from a failed sensor
+			}
+			*target = &x
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// readATMOS41 takes one SDI-12 measurement from an ATMOS 41.
+func (in *WeatherIngestor) readATMOS41(st WeatherStation) (WeatherObservation, error) {
+	p := SerialPort{Device: st.Device, Protocol: SerialSDI12, Baud: st.Baud}
+	port, err := openSerialPort(p)
+	if err != nil {
+		return WeatherObservation{}, fmt.Errorf("serial port unavailable: %v", err)
+	}
+	defer port.Close()
+	line := &serialLine{port: port, reader: bufio.NewReader(port), timeout: p.timeout(), baud: p.baud()}
+	raw, err := line.readSDI12(SerialSensor{SensorID: st.StationID, Address: st.Address, Command: defaultSDI12Command, Values: st.Values})
+	if err != nil {
+		return WeatherObservation{}, err
+	}
+	o := WeatherObservation{Timestamp: readingTimestamp(in.clock.Now())}
+	for i, v := range st.Values {
+		x := raw[i]
+		if v.Scale != 0 {
+			x *= v.Scale
+		}
+		x += v.Offset
+		*o.field(v.Name) = &x
+	}
+	return o, nil
+}
+
+// completeObservation derives humidity from vapour pressure and ET0 over
+// the interval since previous.
+func completeObservation(o *WeatherObservation, previous time.Time, windHeight float64) {
+	if o.HumidityPct == nil && o.vaporPressure != nil && o.TemperatureC != nil {
+		rh := math.Min(100, *o.vaporPressure/saturationVaporPressure(*o.TemperatureC)*100)
+		o.HumidityPct = &rh
+	}
+	if previous.IsZero() || o.TemperatureC == nil || o.HumidityPct == nil || o.WindSpeedMS == nil || o.SolarWM2 == nil {
+		return
+	}
+	interval := o.Timestamp.Sub(previous)
+	if interval <= 0 || interval > weatherMaxET0Interval {
+		return
+	}
+	pressure := standardPressureKPa
+	if o.PressureHPa != nil {
+		pressure = *o.PressureHPa / 10
+	}
+	et0 := hourlyET0(*o.TemperatureC, *o.HumidityPct, *o.WindSpeedMS, windHeight, *o.SolarWM2, pressure) * interval.Hours()
+	o.ET0MM = &et0
+}
+
+func saturationVaporPressure(t float64) float64 {
+	return 0.6108 * math.Exp(17.27*t/(t+237.3))
+}
+
+// hourlyET0 is FAO-56 reference ET in mm/h (eq. 53) from air temperature
+// (°C), RH (%), wind (m/s at height m), solar radiation (W/m²) and
+// pressure (kPa).
+func hourlyET0(t, rh, wind, height, solar, pressure float64) float64 {
+	u2 := wind * 4.87 / math.Log(67.8*height-5.42)
+	es := saturationVaporPressure(t)
+	ea := es * rh / 100
+	delta := 4098 * es / math.Pow(t+237.3, 2)
+	gamma := 0.000665 * pressure
+	rs := solar * 0.0036 // MJ/m²/h
+	tk := t + 273.16
+	rnl := 2.043e-10 * math.Pow(tk, 4) * (0.34 - 0.14*math.Sqrt(ea)) * (1.35*0.8 - 0.35)
+	rn := 0.77*rs - rnl
+	g := 0.1 * rn
+	if solar <= 0 {
+		g = 0.5 * rn
+	}
+	et0 := (0.408*delta*(rn-g) + gamma*37/tk*u2*(es-ea)) / (delta + gamma*(1+0.34*u2))
+	return math.Max(et0, 0)
+}
+
+func storeWeatherObservation(db *sql.DB, o WeatherObservation) error {
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO weather_observations
+			(station_id, field_id, timestamp, source, temperature_c, humidity_pct, pressure_hpa, wind_speed_ms,
+			 wind_direction_deg, gust_ms, rainfall_mm, solar_radiation_wm2, et0_mm)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, o.StationID, o.FieldID, o.Timestamp.UnixMilli(), o.Source, o.TemperatureC, o.HumidityPct, o.PressureHPa,
+		o.WindSpeedMS, o.WindDirDeg, o.GustMS, o.RainfallMM, o.SolarWM2, o.ET0MM)
+	if err != nil {
+		return fmt.Errorf("failed to store weather observation: %v", err)
+	}
+	return nil
+}
+
+const weatherColumns = `id, station_id, field_id, timestamp, source, temperature_c, humidity_pct, pressure_hpa,
+	wind_speed_ms, wind_direction_deg, gust_ms, rainfall_mm, solar_radiation_wm2, et0_mm`
+
+// scanWeatherObservations reads weatherColumns rows, returning the last id.
+func scanWeatherObservations(rows *sql.Rows) ([]WeatherObservation, int64, error) {
+	var out []WeatherObservation
+	var last int64
+	for rows.Next() {
+		var o WeatherObservation
+		var at int64
+		if err := rows.Scan(&last, &o.StationID, &o.FieldID, &at, &o.Source, &o.TemperatureC, &o.HumidityPct,
+			&o.PressureHPa, &o.WindSpeedMS, &o.WindDirDeg, &o.GustMS, &o.RainfallMM, &o.SolarWM2, &o.ET0MM); err != nil {
+			return nil, 0, fmt.Errorf("failed to read weather observation: %v", err)
+		}
+		o.Timestamp = time.UnixMilli(at).UTC()
+		out = append(out, o)
+	}
+	return out, last, rows.Err()
+}
+
+// WeatherObservations returns the field's observations in [from, to],
+// the last week by default, optionally for one station.
+func (ep *EdgeProcessor) WeatherObservations(from, to time.Time, stationID string) ([]WeatherObservation, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultWeatherLookback)
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT `+weatherColumns+` FROM weather_observations
+		WHERE field_id = ? AND timestamp >= ? AND timestamp <= ? AND (? = '' OR station_id = ?)
+		ORDER BY timestamp, station_id
+	`, ep.config.FieldID, from.UnixMilli(), to.UnixMilli(), stationID, stationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query weather observations: %v", err)
+	}
+	defer rows.Close()
+	obs, _, err := scanWeatherObservations(rows)
+	return obs, err
+}
+
+// stationWeatherSum totals a column of the field's observations in
+// (from, to] and counts the observations reporting it.
+func (ep *EdgeProcessor) stationWeatherSum(column string, from, to time.Time) (float64, int, error) {
+	var n int
+	var sum float64
+	err := ep.localDB.QueryRow(`
+		SELECT COUNT(`+column+`), COALESCE(SUM(`+column+`), 0) FROM weather_observations
+		WHERE field_id = ? AND timestamp > ? AND timestamp <= ?
+	`, ep.config.FieldID, from.UnixMilli(), to.UnixMilli()).Scan(&n, &sum)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to total weather observations: %v", err)
+	}
+	return sum, n, nil
+}
+
+// stationTemperatures returns each station's latest air temperature within
+// stationTempMaxAge of at, as pseudo-cells named station:<id>.
+func (ep *EdgeProcessor) stationTemperatures(at time.Time) []VirtualGridPoint {
+	if len(ep.config.WeatherStations) == 0 {
+		return nil
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT station_id, temperature_c FROM weather_observations w
+		WHERE field_id = ? AND temperature_c IS NOT NULL AND timestamp > ? AND timestamp <= ?
+		  AND timestamp = (SELECT MAX(timestamp) FROM weather_observations
+		                   WHERE station_id = w.station_id AND temperature_c IS NOT NULL AND timestamp <= ?)
+	`, ep.config.FieldID, at.Add(-stationTempMaxAge).UnixMilli(), at.UnixMilli(), at.UnixMilli())
+	if err != nil {
+		ep.cycleLog.Warn("Station temperatures unavailable", "component", "weather", "error", err)
+		return nil
+	}
+	defer rows.Close()
+	var out []VirtualGridPoint
+	for rows.Next() {
+		var id string
+		var t float64
+		if err := rows.Scan(&id, &t); err != nil {
+			ep.cycleLog.Warn("Station temperatures unavailable", "component", "weather", "error", err)
+			return nil
+		}
+		out = append(out, VirtualGridPoint{GridID: "station:" + id, Temperature: t})
+	}
+	return out
+}
+
+func (ep *EdgeProcessor) weatherWatermarkKey() string {
+	return "weather_observations:" + ep.config.FieldID
+}
+
+// syncWeatherObservations uploads the field's observations past the
+// watermark.
+func (ep *EdgeProcessor) syncWeatherObservations() {
+	db := ep.cloud.DB()
+	if len(ep.config.WeatherStations) == 0 || !ep.isOnline.Load() || db == nil {
+		return
+	}
+	var mark int64
+	err := ep.localDB.QueryRow(`SELECT value FROM sync_state WHERE name = ?`, ep.weatherWatermarkKey()).Scan(&mark)
+	if err != nil && err != sql.ErrNoRows {
+		ep.cycleLog.Error("Failed to read weather watermark", "component", "weather", "error", err)
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT `+weatherColumns+` FROM weather_observations WHERE field_id = ? AND id > ? ORDER BY id LIMIT ?
+	`, ep.config.FieldID, mark, weatherSyncBatch)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read weather observations", "component", "weather", "error", err)
+		return
+	}
+	obs, last, err := scanWeatherObservations(rows)
+	rows.Close()
+	if err != nil {
+		ep.cycleLog.Error("Failed to read weather observations", "component", "weather", "error", err)
+		return
+	}
+	if len(obs) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	defer tx.Rollback()
+	for _, o := range obs {
+		if _, err := tx.Exec(`
+			INSERT INTO weather_observations
+				(station_id, field_id, edge_device_id, observed_at, source, temperature_c, humidity_pct, pressure_hpa,
+				 wind_speed_ms, wind_direction_deg, gust_ms, rainfall_mm, solar_radiation_wm2, et0_mm)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			ON CONFLICT (station_id, observed_at) DO NOTHING
+		`, o.StationID, o.FieldID, ep.deviceID, o.Timestamp, o.Source, o.TemperatureC, o.HumidityPct, o.PressureHPa,
+			o.WindSpeedMS, o.WindDirDeg, o.GustMS, o.RainfallMM, o.SolarWM2, o.ET0MM); err != nil {
+			ep.cycleLog.Warn("Weather upload failed, retrying next sync", "component", "weather", "error", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	if _, err := ep.localDB.Exec(`INSERT OR REPLACE INTO sync_state (name, value) VALUES (?, ?)`,
+		ep.weatherWatermarkKey(), last); err != nil {
+		ep.cycleLog.Warn("Failed to advance weather watermark", "component", "weather", "error", err)
+	}
+}
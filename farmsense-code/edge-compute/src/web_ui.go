@@ -0,0 +1,32 @@
+// Web UI - installer's status page served by the local API
+// A small static page (webui/, embedded in the binary) at /ui/ shows the
+// latest grid as a heatmap (and saves the server-rendered field map,
+// map_tiles.go), the probes with their health scores, the sync backlog and
+// the alert log, all from the local API. An installer on the
+// farm Wi-Fi can check a new install end-to-end from a phone with no cloud
+// access and nothing to install.
+//
+// The page, its script and stylesheet hold no field data and are served
+// without credentials; the script prompts for an API key when the API
+// answers 401 and sends it as X-API-Key, keeping it in the browser's local
+// storage.
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed webui
+var webUIFiles embed.FS
+
+// webUIPaths are the static files, left open by the API auth.
+var webUIPaths = []string{"/", "/ui/", "/ui/app.js", "/ui/style.css"}
+
+// webUIHandler serves the embedded UI under /ui/.
+func webUIHandler() http.Handler {
+	root, _ := fs.Sub(webUIFiles, "webui") // fails only on an invalid directory name
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(root)))
+}
@@ -0,0 +1,214 @@
+// FarmSense edge status page. Polls the local API and redraws; no
+// dependencies, so it works with no internet access.
+"use strict";
+
+const refreshMs = 30000;
+let grid = null;
+
+// request fetches a local endpoint, asking once for an API key when the
+// device requires one.
+async function request(path) {
+  const headers = {};
+  const key = localStorage.getItem("farmsense_api_key");
+  if (key) {
+    headers["X-API-Key"] = key;
+  }
+  const resp = await fetch(path, { headers });
+  if (resp.status === 401) {
+    const current = localStorage.getItem("farmsense_api_key");
+    if (current && current !== key) {
+      return request(path); // entered for a request in parallel with this one
+    }
+    const entered = prompt("API key for this device");
+    if (entered) {
+      localStorage.setItem("farmsense_api_key", entered);
+      return request(path);
+    }
+  }
+  if (!resp.ok) {
+    throw new Error((await resp.text()).trim() || resp.statusText);
+  }
+  return resp;
+}
+
+async function api(path) {
+  return (await request(path)).json();
+}
+
+function text(el, value, cls) {
+  el.textContent = value;
+  el.className = cls || "";
+  return el;
+}
+
+function ago(ts) {
+  if (!ts) {
+    return "never";
+  }
+  const s = Math.round((Date.now() - new Date(ts).getTime()) / 1000);
+  if (s < 120) {
+    return s + " s ago";
+  }
+  if (s < 7200) {
+    return Math.round(s / 60) + " min ago";
+  }
+  return Math.round(s / 3600) + " h ago";
+}
+
+// Heatmap: cell squares projected onto the canvas, dry (orange) to wet (blue).
+function drawGrid() {
+  const canvas = document.getElementById("heatmap");
+  const ctx = canvas.getContext("2d");
+  const layer = document.getElementById("layer").value;
+  const summary = document.getElementById("grid-summary");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  if (!grid || grid.features.length === 0) {
+    return;
+  }
+
+  let minX = Infinity, minY = Infinity, maxX = -Infinity, maxY = -Infinity;
+  let lo = Infinity, hi = -Infinity;
+  for (const f of grid.features) {
+    for (const [x, y] of f.geometry.coordinates[0]) {
+      minX = Math.min(minX, x); maxX = Math.max(maxX, x);
+      minY = Math.min(minY, y); maxY = Math.max(maxY, y);
+    }
+    const v = f.properties[layer];
+    if (typeof v === "number") {
+      lo = Math.min(lo, v); hi = Math.max(hi, v);
+    }
+  }
+  // Equal metres per pixel both ways at the field's latitude
+  const kx = Math.cos(((minY + maxY) / 2) * Math.PI / 180);
+  const scale = Math.min(canvas.width / ((maxX - minX) * kx), canvas.height / (maxY - minY));
+  const px = (x) => (x - minX) * kx * scale;
+  const py = (y) => canvas.height - (y - minY) * scale;
+  const span = hi > lo ? hi - lo : 1;
+
+  for (const f of grid.features) {
+    const v = f.properties[layer];
+    if (typeof v !== "number") {
+      continue;
+    }
+    const t = (v - lo) / span;
+    ctx.fillStyle = "hsl(" + (30 + t * 190) + ", 65%, 45%)";
+    ctx.beginPath();
+    f.geometry.coordinates[0].forEach(([x, y], i) => (i ? ctx.lineTo(px(x), py(y)) : ctx.moveTo(px(x), py(y))));
+    ctx.fill();
+  }
+
+  const legend = document.getElementById("legend");
+  legend.innerHTML = "";
+  legend.append(text(document.createElement("span"), lo.toFixed(3)), text(document.createElement("span"), hi.toFixed(3)));
+  summary.textContent = grid.features.length + " cells, computed " + ago(grid.features[0].properties.timestamp);
+}
+
+async function loadGrid() {
+  try {
+    // The layer legend is metric whatever the field's units setting
+    grid = await api("/grid/latest.geojson?units=metric");
+  } catch (err) {
+    grid = null;
+    text(document.getElementById("grid-summary"), err.message, "warning");
+  }
+  drawGrid();
+}
+
+// saveMap downloads the server-rendered PNG of the selected layer, with
+// the fixed color range the map tiles use.
+async function saveMap() {
+  const layer = document.getElementById("layer").value;
+  try {
+    const blob = await (await request("/grid/map.png?variable=" + encodeURIComponent(layer))).blob();
+    const a = document.createElement("a");
+    a.href = URL.createObjectURL(blob);
+    a.download = "field-" + layer + ".png";
+    a.click();
+    URL.revokeObjectURL(a.href);
+  } catch (err) {
+    text(document.getElementById("grid-summary"), err.message, "warning");
+  }
+}
+
+async function loadSync() {
+  const dl = document.getElementById("sync");
+  dl.innerHTML = "";
+  const row = (label, value, cls) => {
+    dl.append(text(document.createElement("dt"), label), text(document.createElement("dd"), value, cls));
+  };
+  try {
+    const s = await api("/sync/status");
+    row("Cloud", s.online ? "online (" + s.cloud_store + ")" : "offline", s.online ? "ok" : "warning");
+    row("Last cycle", ago(s.last_cycle), s.last_cycle ? "" : "warning");
+    row("Last upload", ago(s.last_synced_at));
+    row("Cloud has up to", s.cloud_high_water ? new Date(s.cloud_high_water).toLocaleString() : "unknown");
+    row("Waiting", s.unsynced_batches + " batches, " + s.unsynced_cells + " cells",
+      s.unsynced_batches > 0 ? "warning" : "ok");
+    row("Readings queued", String(s.queued_readings), s.queued_readings > 0 ? "warning" : "ok");
+  } catch (err) {
+    row("Error", err.message, "bad");
+  }
+}
+
+async function loadSensors() {
+  const body = document.getElementById("sensors");
+  body.innerHTML = "";
+  try {
+    const { sensors } = await api("/sensors/health?units=metric");
+    for (const h of sensors) {
+      const tr = document.createElement("tr");
+      const cls = h.score >= 70 ? "ok" : h.score >= 40 ? "warning" : "bad";
+      tr.append(
+        text(document.createElement("td"), h.sensor_id),
+        text(document.createElement("td"), Math.round(h.score), cls),
+        text(document.createElement("td"), ago(h.last_seen)),
+        text(document.createElement("td"), h.battery_voltage ? h.battery_voltage.toFixed(2) + " V" : "–"),
+        text(document.createElement("td"), (h.issues || []).join(", "), "muted"),
+      );
+      body.append(tr);
+    }
+    if (sensors.length === 0) {
+      const tr = document.createElement("tr");
+      const td = text(document.createElement("td"), "No health scores yet", "muted");
+      td.colSpan = 5;
+      tr.append(td);
+      body.append(tr);
+    }
+  } catch (err) {
+    const tr = document.createElement("tr");
+    tr.append(text(document.createElement("td"), err.message, "bad"));
+    body.append(tr);
+  }
+}
+
+async function loadAlerts() {
+  const ul = document.getElementById("alerts");
+  ul.innerHTML = "";
+  try {
+    const alerts = await api("/alerts");
+    for (const a of alerts.slice(0, 50)) {
+      ul.append(text(document.createElement("li"), ago(a.raised_at) + " — " + a.message, a.severity));
+    }
+    if (alerts.length === 0) {
+      ul.append(text(document.createElement("li"), "No alerts", "muted"));
+    }
+  } catch (err) {
+    ul.append(text(document.createElement("li"), err.message, "bad"));
+  }
+}
+
+async function refresh() {
+  try {
+    const health = await api("/healthz");
+    document.getElementById("device").textContent = health.device_id;
+  } catch (err) {
+    document.getElementById("device").textContent = err.message;
+  }
+  await Promise.all([loadGrid(), loadSync(), loadSensors(), loadAlerts()]);
+  document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+}
+
+document.getElementById("layer").addEventListener("change", drawGrid);
+document.getElementById("save-map").addEventListener("click", saveMap);
+refresh();
+setInterval(refresh, refreshMs);
@@ -0,0 +1,328 @@
+// Zone Aggregator - management-zone rollup of the 20m grid
+// Irrigation is applied per zone (a valve, a pivot sector), not per cell,
+// so each cycle's cells are grouped by the management_zones polygons and
+// summarized: root-zone moisture mean/min/max, share of the zone's area
+// whose irrigation need is high or critical, and the deficit as a water
+// volume (mm over each cell's area). A cell belongs to the first zone
+// containing its center; cells outside every zone are left out, and so
+// are holes and exclusion zones, which have no cells (field_boundary.go),
+// so a farmstead inside a zone doesn't count toward its area. The
+// zone's irrigation need is classified from its mean deficit and stress
+// with the same rules as a single cell, and with irrigation_hardware the
+// deficit is turned into a run time (irrigation_hardware.go). Cells under
+// an irrigation pass are left out of the means and the need while the rest
+// of the zone has cells (irrigation_detection.go).
+//
+// Stats go to the local zone_stats table every cycle and to the cloud
+// zone_stats table with the grid upload, queued while offline.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ManagementZone is an irrigation management unit.
+type ManagementZone struct {
+	ZoneID   string       `json:"zone_id"`
+	Name     string       `json:"name"`
+	Boundary [][2]float64 `json:"boundary"` // Outline as [lon, lat] pairs
+}
+
+// ZoneStats is one zone's summary for one cycle.
+type ZoneStats struct {
+	ZoneID              string    `json:"zone_id"`
+	Name                string    `json:"name,omitempty"`
+	Timestamp           time.Time `json:"timestamp"`
+	Cells               int       `json:"cells"`
+	MaskedCells         int       `json:"masked_cells,omitempty"` // under an irrigation pass, out of the means
+	AreaM2              float64   `json:"area_m2"`
+	MoistureRootMean    float64   `json:"moisture_root_mean"`
+	MoistureRootMin     float64   `json:"moisture_root_min"`
+	MoistureRootMax     float64   `json:"moisture_root_max"`
+	MoistureSurfaceMean float64   `json:"moisture_surface_mean"`
+	WaterDeficitMeanMM  float64   `json:"water_deficit_mean_mm"`
+	DeficitVolumeM3     float64   `json:"deficit_volume_m3"`
+	StressedAreaPct     float64   `json:"stressed_area_pct"` // cells with high/critical need
+	StressIndexMean     float64   `json:"stress_index_mean"`
+	IrrigationNeed      string    `json:"irrigation_need"`
+	RainfallMM          float64   `json:"rainfall_mm"`                 // gauge rain since the previous cycle
+	LeachingFraction    float64   `json:"leaching_fraction,omitempty"` // mean over the zone's cells (salinity.go)
+
+	// Irrigation runs behind the need (irrigation_events.go)
+	IrrigationStatus string     `json:"irrigation_status,omitempty"` // running | scheduled | watered | neglected
+	LastIrrigatedAt  *time.Time `json:"last_irrigated_at,omitempty"`
+	NextIrrigationAt *time.Time `json:"next_irrigation_at,omitempty"`
+
+	// Mean cell's moisture forecast (moisture_forecast.go)
+	MoistureRootForecast []float64  `json:"moisture_root_forecast,omitempty"`
+	IrrigateBy           *time.Time `json:"irrigate_by,omitempty"`
+
+	// Run time recommendation for the zone's irrigation_hardware
+	HardwareType       string  `json:"hardware_type,omitempty"`
+	ApplicationRateMMH float64 `json:"application_rate_mm_h,omitempty"`
+	GrossDepthMM       float64 `json:"gross_depth_mm,omitempty"` // deficit plus leaching, over application efficiency
+	RuntimeMinutes     float64 `json:"runtime_min,omitempty"`
+	Runtime            string  `json:"runtime,omitempty"` // h:mm, "0:00" when no irrigation is needed
+	Sets               int     `json:"sets,omitempty"`    // runs of at most max_set_hours
+}
+
+// ZoneAggregator assigns grid cells to zones and summarizes them. Cell
+// membership is cached by grid ID since the grid doesn't move.
+type ZoneAggregator struct {
+	zones      []ManagementZone
+	cellAreaM2 float64
+	membership map[string]int // grid_id -> zone index, -1 = no zone
+}
+
+func NewZoneAggregator(zones []ManagementZone, gridResolution float64) *ZoneAggregator {
+	return &ZoneAggregator{
+		zones:      zones,
+		cellAreaM2: gridResolution * gridResolution,
+		membership: make(map[string]int),
+	}
+}
+
+func (za *ZoneAggregator) zoneOf(p VirtualGridPoint) int {
+	if idx, ok := za.membership[p.GridID]; ok {
+		return idx
+	}
+	idx := -1
+	for i, z := range za.zones {
+		if pointInRing(p.Longitude, p.Latitude, z.Boundary) {
+			idx = i
+			break
+		}
+	}
+	za.membership[p.GridID] = idx
+	return idx
+}
+
+// Aggregate summarizes points per zone. classify grades a zone's mean
+// deficit and stress; zones without cells are omitted.
+func (za *ZoneAggregator) Aggregate(points []VirtualGridPoint, at time.Time, classify func(deficit, stress float64) string) []ZoneStats {
+	type acc struct {
+		cells, masked                       int
+		rootSum, surfSum, defSum, stressSum float64
+		leachSum, volumeSum                 float64
+		rootMin, rootMax                    float64
+		stressed                            int
+	}
+	accs := make([]acc, len(za.zones))
+	for i := range accs {
+		accs[i].rootMin, accs[i].rootMax = math.Inf(1), math.Inf(-1)
+	}
+	zoneCells := make([]int, len(za.zones))
+	masked := make([]int, len(za.zones))
+	for _, p := range points {
+		if idx := za.zoneOf(p); idx >= 0 {
+			zoneCells[idx]++
+			if p.IrrigationState != "" {
+				masked[idx]++
+			}
+		}
+	}
+	for _, p := range points {
+		idx := za.zoneOf(p)
+		if idx < 0 {
+			continue
+		}
+		a := &accs[idx]
+		a.volumeSum += p.WaterDeficit
+		if p.IrrigationState != "" && masked[idx] < zoneCells[idx] {
+			a.masked++
+			continue
+		}
+		a.cells++
+		a.rootSum += p.MoistureRoot
+		a.surfSum += p.MoistureSurface
+		a.defSum += p.WaterDeficit
+		a.stressSum += p.StressIndex
+		a.leachSum += p.LeachingFraction
+		a.rootMin = math.Min(a.rootMin, p.MoistureRoot)
+		a.rootMax = math.Max(a.rootMax, p.MoistureRoot)
+		if irrigationNeedRank[p.IrrigationNeed] >= irrigationNeedRank["high"] {
+			a.stressed++
+		}
+	}
+
+	out := make([]ZoneStats, 0, len(za.zones))
+	for i, a := range accs {
+		if a.cells == 0 {
+			continue
+		}
+		n := float64(a.cells)
+		st := ZoneStats{
+			ZoneID:              za.zones[i].ZoneID,
+			Name:                za.zones[i].Name,
+			Timestamp:           at,
+			Cells:               a.cells + a.masked,
+			MaskedCells:         a.masked,
+			AreaM2:              float64(a.cells+a.masked) * za.cellAreaM2,
+			MoistureRootMean:    a.rootSum / n,
+			MoistureRootMin:     a.rootMin,
+			MoistureRootMax:     a.rootMax,
+			MoistureSurfaceMean: a.surfSum / n,
+			WaterDeficitMeanMM:  a.defSum / n,
+			DeficitVolumeM3:     a.volumeSum / 1000 * za.cellAreaM2, // mm -> m over each cell
+			StressedAreaPct:     100 * float64(a.stressed) / n,
+			StressIndexMean:     a.stressSum / n,
+			LeachingFraction:    a.leachSum / n,
+		}
+		st.IrrigationNeed = classify(st.WaterDeficitMeanMM, st.StressIndexMean)
+		out = append(out, st)
+	}
+	return out
+}
+
+// newZoneAggregator returns the config's aggregator, or nil when there
+// are no zones or the grid has no coordinates to place cells with.
+func newZoneAggregator(c EdgeConfig) *ZoneAggregator {
+	if len(c.ManagementZones) == 0 || c.LogicalGrid != nil {
+		return nil
+	}
+	return NewZoneAggregator(c.ManagementZones, c.GridResolution)
+}
+
+// initZoneSchema creates the local zone stats table.
+func initZoneSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS zone_stats (
+			field_id              TEXT    NOT NULL,
+			zone_id               TEXT    NOT NULL,
+			timestamp             INTEGER NOT NULL,
+			cells                 INTEGER NOT NULL,
+			area_m2               REAL,
+			moisture_root_mean    REAL,
+			moisture_root_min     REAL,
+			moisture_root_max     REAL,
+			moisture_surface_mean REAL,
+			water_deficit_mean_mm REAL,
+			deficit_volume_m3     REAL,
+			stressed_area_pct     REAL,
+			irrigation_need       TEXT,
+			rainfall_mm           REAL,
+			runtime_min           REAL,
+			PRIMARY KEY (field_id, zone_id, timestamp)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	if err := ensureLocalColumn(db, "zone_stats", "rainfall_mm", "REAL"); err != nil {
+		return err
+	}
+	return ensureLocalColumn(db, "zone_stats", "runtime_min", "REAL")
+}
+
+// aggregateZones rolls the cycle up into zones, stores the result locally
+// and publishes it for the API. Returns nil without management zones.
+func (ep *EdgeProcessor) aggregateZones(points []VirtualGridPoint, at time.Time) []ZoneStats {
+	if ep.zones == nil || len(points) == 0 {
+		return nil
+	}
+	stats := ep.zones.Aggregate(points, at, ep.classifyIrrigationNeed)
+	ep.applyLifecycleZones(stats, at)
+	ep.applyZoneRain(stats)
+	ep.applyZoneRuntimes(stats)
+	ep.applyIrrigationStatus(stats, at)
+	ep.applyZoneForecast(stats, points)
+	if err := ep.storeZoneStatsLocal(stats); err != nil {
+		ep.cycleLog.Error("Failed to store zone stats locally", "component", "zones", "error", err)
+	}
+	ep.stateMu.Lock()
+	ep.zoneStats = stats
+	ep.stateMu.Unlock()
+	ep.cycleLog.Info("Aggregated management zones", "component", "zones", "zones", len(stats))
+	return stats
+}
+
+func (ep *EdgeProcessor) storeZoneStatsLocal(stats []ZoneStats) error {
+	tx, err := ep.localDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range stats {
+		if _, err := tx.Exec(`
+			INSERT OR REPLACE INTO zone_stats
+				(field_id, zone_id, timestamp, cells, area_m2, moisture_root_mean, moisture_root_min,
+				 moisture_root_max, moisture_surface_mean, water_deficit_mean_mm, deficit_volume_m3,
+				 stressed_area_pct, irrigation_need, rainfall_mm, runtime_min)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, ep.config.FieldID, s.ZoneID, s.Timestamp.Unix(), s.Cells, s.AreaM2, s.MoistureRootMean,
+			s.MoistureRootMin, s.MoistureRootMax, s.MoistureSurfaceMean, s.WaterDeficitMeanMM,
+			s.DeficitVolumeM3, s.StressedAreaPct, s.IrrigationNeed, s.RainfallMM, s.RuntimeMinutes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// storeZoneStatsCloud upserts zone stats into the cloud; a row for the
+// same cycle (an earlier attempt, or the original of a backfill) is replaced.
+func (ep *EdgeProcessor) storeZoneStatsCloud(db *sql.DB, stats []ZoneStats) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin zone stats upload: %v", err)
+	}
+	defer tx.Rollback()
+	for _, s := range stats {
+		if _, err := tx.Exec(`
+			INSERT INTO zone_stats
+				(field_id, zone_id, timestamp, zone_name, cells, area_m2, moisture_root_mean,
+				 moisture_root_min, moisture_root_max, moisture_surface_mean, water_deficit_mean_mm,
+				 deficit_volume_m3, stressed_area_pct, irrigation_need, edge_device_id, rainfall_mm,
+				 hardware_type, gross_depth_mm, runtime_min, tenant_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+			ON CONFLICT (field_id, zone_id, timestamp) DO UPDATE SET
+				zone_name = EXCLUDED.zone_name, cells = EXCLUDED.cells, area_m2 = EXCLUDED.area_m2,
+				moisture_root_mean = EXCLUDED.moisture_root_mean, moisture_root_min = EXCLUDED.moisture_root_min,
+				moisture_root_max = EXCLUDED.moisture_root_max, moisture_surface_mean = EXCLUDED.moisture_surface_mean,
+				water_deficit_mean_mm = EXCLUDED.water_deficit_mean_mm, deficit_volume_m3 = EXCLUDED.deficit_volume_m3,
+				stressed_area_pct = EXCLUDED.stressed_area_pct, irrigation_need = EXCLUDED.irrigation_need,
+				edge_device_id = EXCLUDED.edge_device_id, rainfall_mm = EXCLUDED.rainfall_mm,
+				hardware_type = EXCLUDED.hardware_type, gross_depth_mm = EXCLUDED.gross_depth_mm,
+				runtime_min = EXCLUDED.runtime_min, tenant_id = EXCLUDED.tenant_id
+		`, ep.config.FieldID, s.ZoneID, s.Timestamp, s.Name, s.Cells, s.AreaM2, s.MoistureRootMean,
+			s.MoistureRootMin, s.MoistureRootMax, s.MoistureSurfaceMean, s.WaterDeficitMeanMM,
+			s.DeficitVolumeM3, s.StressedAreaPct, s.IrrigationNeed, ep.deviceID, s.RainfallMM,
+			s.HardwareType, s.GrossDepthMM, s.RuntimeMinutes, nullString(ep.config.TenantID)); err != nil {
+			return fmt.Errorf("failed to insert zone stats: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit zone stats: %v", err)
+	}
+	return nil
+}
+
+// syncZoneStats uploads this cycle's stats plus any queued ones, keeping
+// them queued while the cloud is unreachable.
+func (ep *EdgeProcessor) syncZoneStats(stats []ZoneStats) {
+	ep.pendingZoneSync = append(ep.pendingZoneSync, stats...)
+	if len(ep.pendingZoneSync) == 0 {
+		return
+	}
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	if err := ep.storeZoneStatsCloud(db, ep.pendingZoneSync); err != nil {
+		ep.cycleLog.Warn("Zone stats upload failed, keeping them queued", "component", "zones",
+			"pending", len(ep.pendingZoneSync), "error", err)
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	ep.pendingZoneSync = ep.pendingZoneSync[:0]
+}
+
+// ZoneStats returns the latest cycle's per-zone summary.
+func (ep *EdgeProcessor) ZoneStats() []ZoneStats {
+	ep.stateMu.RLock()
+	defer ep.stateMu.RUnlock()
+	return append([]ZoneStats(nil), ep.zoneStats...)
+}
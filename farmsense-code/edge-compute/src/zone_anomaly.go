@@ -0,0 +1,593 @@
+// Zone Anomaly Detection - statistical process control on zone series
+// Each cycle every management zone contributes two samples: the hourly
+// change of its root moisture mean and of its mean temperature. Each
+// series runs an EWMA chart (catches a sudden move within a cycle or two)
+// and a one-sided CUSUM (catches a small, sustained one) against the
+// zone's own in-control baseline, learnt over the first
+// anomaly_warmup_cycles undisturbed cycles and then tracked slowly while
+// the charts are in control. Only the harmful side is watched: moisture
+// drops and temperature spikes. Cycles with rain or an irrigation pass
+// are charted but kept out of the baseline.
+//
+// A signal is classified from the probes behind the zone's cells:
+//
+//	field_event   two or more probes moved together with plausible values
+//	sensor_fault  the move comes from probes with a failure signature: a
+//	              value out of range, a step no soil makes in one reading,
+//	              a poor health score (sensor_health.go), a probe that
+//	              stopped reporting, or one probe moving while at least two
+//	              others stay flat
+//	unconfirmed   a single probe moved with nothing to corroborate or
+//	              contradict it
+//
+// One record is kept per episode (from the first signal until both charts
+// are back in control) in the local zone_anomalies table, raised as a
+// zone_anomaly alert, and upserted to the cloud table of the same name
+// (migration 030). An episode lasting anomalyMaxEpisodeCycles becomes the
+// new baseline. Charts live in memory and relearn after a restart or a
+// gap over anomalyMaxGap.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAnomalyLambda     = 0.2
+	defaultAnomalyLimitSigma = 3.0
+	defaultAnomalyCUSUMH     = 5.0
+	defaultAnomalyWarmup     = 24
+	anomalyCUSUMK            = 0.5 // allowance, in standard deviations
+	anomalyMaxGap            = 6 * time.Hour
+	anomalyMaxEpisodeCycles  = 48
+	anomalyMinSigmaVWC       = 0.0005 // per hour, floor for a very quiet warm-up
+	anomalyMinSigmaC         = 0.05   // °C per hour
+	anomalyProbeMoveVWC      = 0.01   // probe change since the last cycle that counts as moving
+	anomalyProbeMoveC        = 1.5
+	anomalyMaxStepC          = 10.0 // per reading, beyond any real canopy or soil
+	anomalyMaxResults        = 500
+)
+
+// AlertZoneAnomaly is raised for each new zone anomaly episode.
+const AlertZoneAnomaly = "zone_anomaly"
+
+// Anomaly metrics, detectors and classes
+const (
+	AnomalyMetricMoisture    = "moisture_root"
+	AnomalyMetricTemperature = "temperature"
+
+	AnomalyDetectorEWMA  = "ewma"
+	AnomalyDetectorCUSUM = "cusum"
+
+	AnomalyFieldEvent  = "field_event"
+	AnomalySensorFault = "sensor_fault"
+	AnomalyUnconfirmed = "unconfirmed"
+)
+
+// ZoneAnomaly is one classified anomaly episode.
+type ZoneAnomaly struct {
+	ID         int64     `json:"id"`
+	ZoneID     string    `json:"zone_id"`
+	Metric     string    `json:"metric"`    // moisture_root | temperature
+	Direction  string    `json:"direction"` // drop | spike
+	Detector   string    `json:"detector"`  // ewma | cusum
+	Class      string    `json:"class"`     // field_event | sensor_fault | unconfirmed
+	ValuePerH  float64   `json:"value_per_h"`
+	BaselinePH float64   `json:"baseline_per_h"`
+	SigmaPerH  float64   `json:"sigma_per_h"`
+	Statistic  float64   `json:"statistic"` // EWMA or CUSUM value that crossed the limit
+	Limit      float64   `json:"limit"`
+	Sensors    []string  `json:"sensors"`    // probes implicated
+	Signatures []string  `json:"signatures"` // out_of_range, step, unhealthy, dropout, isolated, corroborated
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// spcChart is one zone series' EWMA and CUSUM state.
+type spcChart struct {
+	n       int     // warm-up samples
+	mean    float64 // baseline change per hour
+	m2      float64 // Welford sum of squares during warm-up
+	sigma   float64 // 0 until warmed up
+	ewma    float64
+	cusum   float64 // in the watched direction
+	active  bool
+	episode int
+}
+
+// spcSignal is a chart crossing its limit.
+type spcSignal struct {
+	detector         string
+	statistic, limit float64
+}
+
+// update feeds x, watching side (+1 above the mean, -1 below). disturbed
+// samples are charted but never learnt. Returns a signal only when an
+// episode starts.
+func (c *spcChart) update(x float64, side float64, disturbed bool, p spcParams) *spcSignal {
+	if c.sigma == 0 {
+		if disturbed {
+			return nil
+		}
+		c.n++
+		delta := x - c.mean
+		c.mean += delta / float64(c.n)
+		c.m2 += delta * (x - c.mean)
+		if c.n >= p.warmup {
+			c.sigma = math.Max(math.Sqrt(c.m2/float64(c.n-1)), p.minSigma)
+			c.ewma, c.cusum = c.mean, 0
+		}
+		return nil
+	}
+
+	c.ewma = p.lambda*x + (1-p.lambda)*c.ewma
+	c.cusum = math.Max(0, c.cusum+side*(x-c.mean)-anomalyCUSUMK*c.sigma)
+	ewmaLimit := p.limitSigma * c.sigma * math.Sqrt(p.lambda/(2-p.lambda))
+	var sig *spcSignal
+	switch {
+	case side*(c.ewma-c.mean) > ewmaLimit:
+		sig = &spcSignal{detector: AnomalyDetectorEWMA, statistic: c.ewma, limit: c.mean + side*ewmaLimit}
+	case c.cusum > p.cusumH*c.sigma:
+		sig = &spcSignal{detector: AnomalyDetectorCUSUM, statistic: c.cusum, limit: p.cusumH * c.sigma}
+	}
+
+	if sig == nil {
+		c.active, c.episode = false, 0
+		if !disturbed && math.Abs(x-c.mean) <= p.limitSigma*c.sigma {
+			// Track the baseline slowly: weight 1/warmup per in-control sample
+			a := 1 / float64(p.warmup)
+			d := x - c.mean
+			c.mean += a * d
+			c.sigma = math.Max(math.Sqrt((1-a)*(c.sigma*c.sigma+a*d*d)), p.minSigma)
+		}
+		return nil
+	}
+	c.cusum = 0 // restart after a signal so one outlier can't hold it out of control
+	c.episode++
+	if c.episode >= anomalyMaxEpisodeCycles {
+		*c = spcChart{} // the new regime becomes the baseline
+		return nil
+	}
+	if c.active {
+		return nil
+	}
+	c.active = true
+	return sig
+}
+
+// restart clears the running statistics after a gap, keeping the baseline.
+func (c *spcChart) restart() {
+	c.ewma, c.cusum, c.active, c.episode = c.mean, 0, false, 0
+}
+
+type spcParams struct {
+	lambda, limitSigma, cusumH, minSigma float64
+	warmup                               int
+}
+
+// zoneSeries is one zone's previous cycle and charts.
+type zoneSeries struct {
+	at          time.Time
+	moisture    float64
+	temperature float64
+	sensors     map[string]bool // probes behind the zone's cells
+	charts      map[string]*spcChart
+}
+
+// anomalyDetector holds the zone charts and each probe's previous reading
+// (Run goroutine only).
+type anomalyDetector struct {
+	zones  map[string]*zoneSeries
+	probes map[string]SensorReading
+}
+
+func newAnomalyDetector() *anomalyDetector {
+	return &anomalyDetector{zones: make(map[string]*zoneSeries), probes: make(map[string]SensorReading)}
+}
+
+// initZoneAnomalySchema creates the local anomaly table.
+func initZoneAnomalySchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS zone_anomalies (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			field_id    TEXT    NOT NULL,
+			zone_id     TEXT    NOT NULL,
+			metric      TEXT    NOT NULL,
+			direction   TEXT    NOT NULL,
+			detector    TEXT    NOT NULL,
+			class       TEXT    NOT NULL,
+			value_ph    REAL    NOT NULL,
+			baseline_ph REAL    NOT NULL,
+			sigma_ph    REAL    NOT NULL,
+			statistic   REAL    NOT NULL,
+			limit_value REAL    NOT NULL,
+			sensors     TEXT    NOT NULL,
+			signatures  TEXT    NOT NULL,
+			detected_at INTEGER NOT NULL,
+			synced      INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS zone_anomalies_time ON zone_anomalies (field_id, detected_at);
+	`)
+	return err
+}
+
+func (ep *EdgeProcessor) spcParams(metric string) spcParams {
+	p := spcParams{lambda: ep.config.AnomalyEWMALambda, limitSigma: ep.config.AnomalyLimitSigma,
+		cusumH: ep.config.AnomalyCUSUMH, warmup: ep.config.AnomalyWarmupCycles, minSigma: anomalyMinSigmaVWC}
+	if p.lambda <= 0 {
+		p.lambda = defaultAnomalyLambda
+	}
+	if p.limitSigma <= 0 {
+		p.limitSigma = defaultAnomalyLimitSigma
+	}
+	if p.cusumH <= 0 {
+		p.cusumH = defaultAnomalyCUSUMH
+	}
+	if p.warmup <= 1 {
+		p.warmup = defaultAnomalyWarmup
+	}
+	if metric == AnomalyMetricTemperature {
+		p.minSigma = anomalyMinSigmaC
+	}
+	return p
+}
+
+// detectZoneAnomalies charts this cycle's zone stats and records any new
+// episode.
+func (ep *EdgeProcessor) detectZoneAnomalies(stats []ZoneStats, points []VirtualGridPoint, sensors []SensorReading, at time.Time) {
+	d := ep.anomalies
+	defer func() {
+		for _, r := range sensors {
+			d.probes[r.SensorID] = r
+		}
+	}()
+	if len(stats) == 0 {
+		return
+	}
+
+	type zoneCells struct {
+		temp    float64
+		n       int
+		sensors map[string]bool
+	}
+	cells := make(map[string]*zoneCells, len(stats))
+	for _, p := range points {
+		idx := ep.zones.zoneOf(p)
+		if idx < 0 {
+			continue
+		}
+		id := ep.zones.zones[idx].ZoneID
+		zc := cells[id]
+		if zc == nil {
+			zc = &zoneCells{sensors: make(map[string]bool)}
+			cells[id] = zc
+		}
+		zc.temp += p.Temperature
+		zc.n++
+		for _, s := range p.SourceSensors {
+			zc.sensors[s] = true
+		}
+	}
+	current := make(map[string]SensorReading, len(sensors))
+	for _, r := range sensors {
+		current[r.SensorID] = r
+	}
+
+	for _, s := range stats {
+		zc := cells[s.ZoneID]
+		if zc == nil || zc.n == 0 {
+			continue
+		}
+		temp := zc.temp / float64(zc.n)
+		series := d.zones[s.ZoneID]
+		if series == nil {
+			series = &zoneSeries{charts: map[string]*spcChart{AnomalyMetricMoisture: {}, AnomalyMetricTemperature: {}}}
+			d.zones[s.ZoneID] = series
+		}
+		prev := *series
+		series.at, series.moisture, series.temperature, series.sensors = at, s.MoistureRootMean, temp, zc.sensors
+		if prev.at.IsZero() {
+			continue
+		}
+		hours := at.Sub(prev.at).Hours()
+		if hours <= 0 || at.Sub(prev.at) > anomalyMaxGap {
+			for _, c := range series.charts {
+				c.restart()
+			}
+			continue
+		}
+		disturbed := s.RainfallMM > 0 || s.MaskedCells > 0 || s.IrrigationStatus == "running"
+
+		samples := []struct {
+			metric string
+			x      float64
+			side   float64
+		}{
+			{AnomalyMetricMoisture, (s.MoistureRootMean - prev.moisture) / hours, -1},
+			{AnomalyMetricTemperature, (temp - prev.temperature) / hours, 1},
+		}
+		for _, smp := range samples {
+			chart := series.charts[smp.metric]
+			sig := chart.update(smp.x, smp.side, disturbed, ep.spcParams(smp.metric))
+			if sig == nil {
+				continue
+			}
+			a := ZoneAnomaly{
+				ZoneID:     s.ZoneID,
+				Metric:     smp.metric,
+				Direction:  "drop",
+				Detector:   sig.detector,
+				ValuePerH:  smp.x,
+				BaselinePH: chart.mean,
+				SigmaPerH:  chart.sigma,
+				Statistic:  sig.statistic,
+				Limit:      sig.limit,
+				DetectedAt: at,
+			}
+			if smp.side > 0 {
+				a.Direction = "spike"
+			}
+			probes := make(map[string]bool, len(zc.sensors)+len(prev.sensors))
+			for id := range zc.sensors {
+				probes[id] = true
+			}
+			for id := range prev.sensors {
+				probes[id] = true
+			}
+			a.Class, a.Sensors, a.Signatures = ep.classifyAnomaly(smp.metric, smp.side, probes, d.probes, current)
+			ep.recordZoneAnomaly(a)
+		}
+	}
+}
+
+// classifyAnomaly tells sensor failure patterns from a genuine field event
+// by how the zone's probes moved since the previous cycle.
+func (ep *EdgeProcessor) classifyAnomaly(metric string, side float64, probes map[string]bool,
+	previous, current map[string]SensorReading) (string, []string, []string) {
+	value := func(r SensorReading) float64 {
+		if metric == AnomalyMetricTemperature {
+			return r.TempSurface
+		}
+		return r.MoistureRoot
+	}
+	move, maxStep := anomalyProbeMoveVWC, maxPlausibleStepVWC
+	if metric == AnomalyMetricTemperature {
+		move, maxStep = anomalyProbeMoveC, anomalyMaxStepC
+	}
+	alertScore := ep.config.SensorHealthAlertScore
+	if alertScore <= 0 {
+		alertScore = defaultSensorHealthAlert
+	}
+	ep.stateMu.RLock()
+	health := ep.sensorHealth
+	ep.stateMu.RUnlock()
+
+	var moving, faulty []string
+	signatures := make(map[string]bool)
+	flat := 0
+	ids := make([]string, 0, len(probes))
+	for id := range probes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		prev, hadPrev := previous[id]
+		cur, ok := current[id]
+		if !ok {
+			if hadPrev {
+				faulty = append(faulty, id)
+				signatures["dropout"] = true
+			}
+			continue
+		}
+		if !hadPrev {
+			continue
+		}
+		delta := value(cur) - value(prev)
+		if side*delta < move {
+			flat++
+			continue
+		}
+		var sigs []string
+		if !plausibleReading(metric, value(cur)) {
+			sigs = append(sigs, "out_of_range")
+		}
+		if math.Abs(delta) > maxStep {
+			sigs = append(sigs, "step")
+		}
+		if h, ok := health[id]; ok && h.Score < alertScore {
+			sigs = append(sigs, "unhealthy")
+		}
+		if len(sigs) == 0 {
+			moving = append(moving, id)
+			continue
+		}
+		faulty = append(faulty, id)
+		for _, s := range sigs {
+			signatures[s] = true
+		}
+	}
+
+	switch {
+	case len(moving) >= 2:
+		return AnomalyFieldEvent, moving, []string{"corroborated"}
+	case len(faulty) > 0:
+		return AnomalySensorFault, faulty, sortedKeys(signatures)
+	case len(moving) == 1 && flat >= 2:
+		return AnomalySensorFault, moving, []string{"isolated"}
+	default:
+		return AnomalyUnconfirmed, append(make([]string, 0), moving...), []string{}
+	}
+}
+
+// plausibleReading rejects values no working probe reports.
+func plausibleReading(metric string, v float64) bool {
+	if metric == AnomalyMetricTemperature {
+		return v > -40 && v < 70
+	}
+	return v > 0.005 && v < 0.6
+}
+
+func sortedKeys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// recordZoneAnomaly stores an episode locally and raises its alert.
+func (ep *EdgeProcessor) recordZoneAnomaly(a ZoneAnomaly) {
+	res, err := ep.localDB.Exec(`
+		INSERT INTO zone_anomalies
+			(field_id, zone_id, metric, direction, detector, class, value_ph, baseline_ph, sigma_ph, statistic,
+			 limit_value, sensors, signatures, detected_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ep.config.FieldID, a.ZoneID, a.Metric, a.Direction, a.Detector, a.Class, a.ValuePerH, a.BaselinePH,
+		a.SigmaPerH, a.Statistic, a.Limit, strings.Join(a.Sensors, ","), strings.Join(a.Signatures, ","),
+		a.DetectedAt.Unix())
+	if err != nil {
+		ep.cycleLog.Error("Failed to store zone anomaly", "component", "anomaly", "zone_id", a.ZoneID, "error", err)
+	} else {
+		a.ID, _ = res.LastInsertId()
+	}
+	ep.cycleLog.Info("Zone anomaly", "component", "anomaly", "zone_id", a.ZoneID, "metric", a.Metric,
+		"detector", a.Detector, "class", a.Class, "value_per_h", a.ValuePerH, "sensors", a.Sensors)
+
+	var severity, message string
+	switch a.Class {
+	case AnomalyFieldEvent:
+		severity = SeverityWarning
+		message = fmt.Sprintf("Unusual %s %s across probes %s; check the zone", strings.ReplaceAll(a.Metric, "_", " "),
+			a.Direction, strings.Join(a.Sensors, ", "))
+	case AnomalySensorFault:
+		severity = SeverityWarning
+		message = fmt.Sprintf("Unusual %s %s looks like a sensor fault (%s) at %s", strings.ReplaceAll(a.Metric, "_", " "),
+			a.Direction, strings.Join(a.Signatures, ", "), strings.Join(a.Sensors, ", "))
+	default:
+		severity = SeverityInfo
+		message = fmt.Sprintf("Unusual %s %s seen by one probe only", strings.ReplaceAll(a.Metric, "_", " "), a.Direction)
+	}
+	ep.alerts.Raise(Alert{
+		Kind:     AlertZoneAnomaly,
+		Severity: severity,
+		FieldID:  ep.config.FieldID,
+		Subject:  a.ZoneID,
+		Message:  message,
+		Value:    a.ValuePerH,
+	})
+}
+
+// ZoneAnomalies returns episodes detected since from, newest first,
+// optionally for one zone and/or class.
+func (ep *EdgeProcessor) ZoneAnomalies(from time.Time, zoneID, class string) ([]ZoneAnomaly, error) {
+	rows, err := ep.localDB.Query(`
+		SELECT id, zone_id, metric, direction, detector, class, value_ph, baseline_ph, sigma_ph, statistic,
+		       limit_value, sensors, signatures, detected_at
+		FROM zone_anomalies
+		WHERE field_id = ? AND detected_at >= ? AND (? = '' OR zone_id = ?) AND (? = '' OR class = ?)
+		ORDER BY detected_at DESC, id DESC
+		LIMIT ?
+	`, ep.config.FieldID, from.Unix(), zoneID, zoneID, class, class, anomalyMaxResults)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query zone anomalies: %v", err)
+	}
+	defer rows.Close()
+	out := make([]ZoneAnomaly, 0)
+	for rows.Next() {
+		var a ZoneAnomaly
+		var sensors, signatures string
+		var detected int64
+		if err := rows.Scan(&a.ID, &a.ZoneID, &a.Metric, &a.Direction, &a.Detector, &a.Class, &a.ValuePerH,
+			&a.BaselinePH, &a.SigmaPerH, &a.Statistic, &a.Limit, &sensors, &signatures, &detected); err != nil {
+			return nil, fmt.Errorf("failed to read zone anomalies: %v", err)
+		}
+		a.Sensors, a.Signatures = splitList(sensors), splitList(signatures)
+		a.DetectedAt = time.Unix(detected, 0).UTC()
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// syncZoneAnomalies upserts unsynced episodes to the cloud, leaving them
+// flagged while offline.
+func (ep *EdgeProcessor) syncZoneAnomalies() {
+	db := ep.cloud.DB()
+	if !ep.isOnline.Load() || db == nil {
+		return
+	}
+	rows, err := ep.localDB.Query(`
+		SELECT id, zone_id, metric, direction, detector, class, value_ph, baseline_ph, sigma_ph, statistic,
+		       limit_value, sensors, signatures, detected_at
+		FROM zone_anomalies WHERE field_id = ? AND synced = 0
+	`, ep.config.FieldID)
+	if err != nil {
+		ep.cycleLog.Error("Failed to read unsynced zone anomalies", "component", "anomaly", "error", err)
+		return
+	}
+	type pending struct {
+		ZoneAnomaly
+		sensors, signatures string
+		detected            int64
+	}
+	batch := make([]pending, 0)
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.ID, &p.ZoneID, &p.Metric, &p.Direction, &p.Detector, &p.Class, &p.ValuePerH,
+			&p.BaselinePH, &p.SigmaPerH, &p.Statistic, &p.Limit, &p.sensors, &p.signatures, &p.detected); err != nil {
+			rows.Close()
+			ep.cycleLog.Error("Failed to read unsynced zone anomalies", "component", "anomaly", "error", err)
+			return
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	defer tx.Rollback()
+	for _, p := range batch {
+		if _, err := tx.Exec(`
+			INSERT INTO zone_anomalies
+				(field_id, anomaly_uid, zone_id, metric, direction, detector, class, value_per_h, baseline_per_h,
+				 sigma_per_h, statistic, limit_value, sensors, signatures, detected_at, edge_device_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+			ON CONFLICT (field_id, anomaly_uid) DO NOTHING
+		`, ep.config.FieldID, fmt.Sprintf("%s:%d", ep.deviceID, p.ID), p.ZoneID, p.Metric, p.Direction, p.Detector,
+			p.Class, p.ValuePerH, p.BaselinePH, p.SigmaPerH, p.Statistic, p.Limit, p.sensors, p.signatures,
+			time.Unix(p.detected, 0).UTC(), ep.deviceID); err != nil {
+			ep.cycleLog.Warn("Zone anomaly upload failed, keeping them queued", "component", "anomaly",
+				"pending", len(batch), "error", err)
+			ep.cloud.ReportFailure(err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		ep.cloud.ReportFailure(err)
+		return
+	}
+	for _, p := range batch {
+		if _, err := ep.localDB.Exec(`UPDATE zone_anomalies SET synced = 1 WHERE id = ?`, p.ID); err != nil {
+			ep.cycleLog.Warn("Failed to mark zone anomaly synced", "component", "anomaly", "error", err)
+		}
+	}
+}